@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/google/uuid"
+	"github.com/uselagoon/ssh-portal/internal/keycloak"
+	"github.com/uselagoon/ssh-portal/internal/lagoon"
+	"github.com/uselagoon/ssh-portal/internal/lagoondb"
+	"github.com/uselagoon/ssh-portal/internal/rbac"
+)
+
+// CheckAccessCmd represents the check-user-access command.
+type CheckAccessCmd struct {
+	APIDBAddress         string      `kong:"env='API_DB_ADDRESS',help='Lagoon API DB Address (host[:port]). Required unless --project-group-ids is given'"`
+	APIDBDatabase        string      `kong:"default='infrastructure',env='API_DB_DATABASE',help='Lagoon API DB Database Name'"`
+	APIDBPassword        string      `kong:"env='API_DB_PASSWORD',help='Lagoon API DB Password'"`
+	APIDBUsername        string      `kong:"default='api',env='API_DB_USERNAME',help='Lagoon API DB Username'"`
+	BlockDeveloperSSH    bool        `kong:"env='BLOCK_DEVELOPER_SSH',help='Disallow Developer SSH access'"`
+	EnvType              string      `kong:"required,name='env-type',enum='development,production',help='Type of the environment (development or production)'"`
+	ExecOnlyRoles        []string    `kong:"env='EXEC_ONLY_ROLES',help='Roles granted exec-only SSH access (shells, commands, and sftp, but not logs) to environments they cannot otherwise SSH to'"`
+	KeycloakBaseURL      string      `kong:"required,env='KEYCLOAK_BASE_URL',help='Keycloak Base URL'"`
+	KeycloakClientID     string      `kong:"default='service-api',env='KEYCLOAK_SERVICE_API_CLIENT_ID',help='Keycloak OAuth2 Client ID'"`
+	KeycloakClientSecret string      `kong:"required,env='KEYCLOAK_SERVICE_API_CLIENT_SECRET',help='Keycloak OAuth2 Client Secret'"`
+	KeycloakRateLimit    int         `kong:"default=10,env='KEYCLOAK_RATE_LIMIT',help='Keycloak API Rate Limit (requests/second)'"`
+	LogsOnlyRoles        []string    `kong:"env='LOGS_ONLY_ROLES',help='Roles granted logs-only SSH access to environments they cannot otherwise SSH to (e.g. guest,reporter)'"`
+	ProjectGroupIDs      []uuid.UUID `kong:"name='project-group-ids',help='IDs of the Keycloak groups of the project, used instead of querying the Lagoon API DB'"`
+	ProjectID            int         `kong:"required,name='project-id',help='Lagoon project ID'"`
+	UserUUID             uuid.UUID   `kong:"required,name='user-uuid',help='Keycloak user UUID'"`
+}
+
+// checkAccessResult is the Decision printed by the check-user-access command.
+// Capability and Group are omitted if they are not meaningful.
+type checkAccessResult struct {
+	Allowed    bool             `json:"allowed"`
+	Capability *rbac.Capability `json:"capability,omitempty"`
+	Reason     string           `json:"reason,omitempty"`
+	Group      *uuid.UUID       `json:"group,omitempty"`
+}
+
+// staticProjectGroups implements rbac.LagoonDBService by returning the same
+// group IDs for any project, so that access can be checked without the
+// Lagoon API DB.
+type staticProjectGroups []uuid.UUID
+
+// ProjectGroupIDs implements rbac.LagoonDBService.
+func (s staticProjectGroups) ProjectGroupIDs(
+	context.Context,
+	int,
+) ([]uuid.UUID, error) {
+	return s, nil
+}
+
+// flagErrors returns a description of each inconsistent combination of flags
+// in cmd, or nil if there are none.
+func (cmd *CheckAccessCmd) flagErrors() []string {
+	var errs []string
+	switch {
+	case cmd.APIDBAddress == "" && len(cmd.ProjectGroupIDs) == 0:
+		errs = append(errs, "one of --apidb-address/API_DB_ADDRESS and "+
+			"--project-group-ids is required")
+	case cmd.APIDBAddress != "" && len(cmd.ProjectGroupIDs) > 0:
+		errs = append(errs, "--apidb-address/API_DB_ADDRESS and "+
+			"--project-group-ids can't be used together")
+	case cmd.APIDBAddress != "" && cmd.APIDBPassword == "":
+		errs = append(errs, "--apidb-address/API_DB_ADDRESS requires "+
+			"--apidb-password/API_DB_PASSWORD")
+	}
+	if cmd.KeycloakRateLimit < 1 {
+		errs = append(errs, "--keycloak-rate-limit/KEYCLOAK_RATE_LIMIT must "+
+			"be at least one, otherwise Keycloak requests are rejected")
+	}
+	return errs
+}
+
+// AfterApply is called by kong once flag values have been applied. It checks
+// that the flags are consistent with each other.
+func (cmd *CheckAccessCmd) AfterApply() error {
+	if errs := cmd.flagErrors(); len(errs) > 0 {
+		return fmt.Errorf("invalid flags:\n  %s", strings.Join(errs, "\n  "))
+	}
+	return nil
+}
+
+// permissionOptions returns the rbac options configured by the flags, which
+// are the same as those of the ssh-portal-api.
+func (cmd *CheckAccessCmd) permissionOptions() ([]rbac.Option, error) {
+	var permOpts []rbac.Option
+	if cmd.BlockDeveloperSSH {
+		permOpts = append(permOpts, rbac.BlockDeveloperSSH())
+	}
+	if len(cmd.LogsOnlyRoles) > 0 {
+		var roles []lagoon.UserRole
+		for _, name := range cmd.LogsOnlyRoles {
+			role, err := lagoon.UserRoleFromString(name)
+			if err != nil {
+				return nil, fmt.Errorf("invalid logs-only role: %s", name)
+			}
+			roles = append(roles, role)
+		}
+		permOpts = append(permOpts, rbac.LogsOnlySSH(roles...))
+	}
+	if len(cmd.ExecOnlyRoles) > 0 {
+		var roles []lagoon.UserRole
+		for _, name := range cmd.ExecOnlyRoles {
+			role, err := lagoon.UserRoleFromString(name)
+			if err != nil {
+				return nil, fmt.Errorf("invalid exec-only role: %s", name)
+			}
+			roles = append(roles, role)
+		}
+		permOpts = append(permOpts, rbac.ExecOnlySSH(roles...))
+	}
+	return permOpts, nil
+}
+
+// Run the check-user-access command to print the SSH access decision of the
+// ssh-portal-api for a user and project.
+func (cmd *CheckAccessCmd) Run(log *slog.Logger) error {
+	// get main process context, which cancels on SIGTERM
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM)
+	defer stop()
+	// init lagoon DB client, unless the project groups were given
+	var ldb rbac.LagoonDBService = staticProjectGroups(cmd.ProjectGroupIDs)
+	if cmd.APIDBAddress != "" {
+		dbConf := mysql.NewConfig()
+		dbConf.Addr = cmd.APIDBAddress
+		dbConf.DBName = cmd.APIDBDatabase
+		dbConf.Net = "tcp"
+		dbConf.Passwd = cmd.APIDBPassword
+		dbConf.User = cmd.APIDBUsername
+		var err error
+		ldb, err = lagoondb.NewClient(ctx, dbConf.FormatDSN())
+		if err != nil {
+			return fmt.Errorf("couldn't init lagoondb client: %v", err)
+		}
+	}
+	// init keycloak client
+	k, err := keycloak.NewClient(ctx, log,
+		cmd.KeycloakBaseURL,
+		cmd.KeycloakClientID,
+		cmd.KeycloakClientSecret,
+		keycloak.NewLimiter(log, nil, float64(cmd.KeycloakRateLimit), 0))
+	if err != nil {
+		return fmt.Errorf("couldn't init keycloak client: %v", err)
+	}
+	return cmd.checkAccess(ctx, log, k, ldb, os.Stdout)
+}
+
+// checkAccess writes the SSH access decision for the user and project given
+// by the flags to w as JSON, using the given services.
+func (cmd *CheckAccessCmd) checkAccess(
+	ctx context.Context,
+	log *slog.Logger,
+	k rbac.KeycloakService,
+	ldb rbac.LagoonDBService,
+	w io.Writer,
+) error {
+	envType, err := lagoon.EnvironmentTypeFromString(cmd.EnvType)
+	if err != nil {
+		return fmt.Errorf("invalid environment type: %v", err)
+	}
+	permOpts, err := cmd.permissionOptions()
+	if err != nil {
+		return err
+	}
+	p := rbac.NewPermission(k, ldb, permOpts...)
+	decision, err := p.UserSSHAccess(ctx, log, cmd.UserUUID, cmd.ProjectID,
+		envType)
+	if err != nil {
+		return fmt.Errorf("couldn't check user access: %v", err)
+	}
+	result := checkAccessResult{
+		Allowed: decision.Allowed,
+		Reason:  decision.Reason,
+	}
+	if decision.Allowed {
+		result.Capability = &decision.Capability
+	}
+	if decision.Group != uuid.Nil {
+		result.Group = &decision.Group
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err = enc.Encode(result); err != nil {
+		return fmt.Errorf("couldn't write decision: %v", err)
+	}
+	return nil
+}
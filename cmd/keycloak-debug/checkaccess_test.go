@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/alecthomas/assert/v2"
+	"github.com/google/uuid"
+	"github.com/uselagoon/ssh-portal/internal/keycloak"
+	"github.com/uselagoon/ssh-portal/internal/lagoon"
+	"github.com/uselagoon/ssh-portal/internal/rbac"
+	"go.uber.org/mock/gomock"
+)
+
+func TestCheckAccessFlagErrors(t *testing.T) {
+	groupIDs := []uuid.UUID{uuid.New()}
+	var testCases = map[string]struct {
+		cmd    CheckAccessCmd
+		expect []string
+	}{
+		"database": {
+			cmd: CheckAccessCmd{
+				APIDBAddress:      "db:3306",
+				APIDBPassword:     "secret",
+				KeycloakRateLimit: 10,
+			},
+		},
+		"project group IDs": {
+			cmd: CheckAccessCmd{
+				ProjectGroupIDs:   groupIDs,
+				KeycloakRateLimit: 10,
+			},
+		},
+		"neither": {
+			cmd:    CheckAccessCmd{KeycloakRateLimit: 10},
+			expect: []string{"one of --apidb-address/API_DB_ADDRESS"},
+		},
+		"both": {
+			cmd: CheckAccessCmd{
+				APIDBAddress:      "db:3306",
+				APIDBPassword:     "secret",
+				ProjectGroupIDs:   groupIDs,
+				KeycloakRateLimit: 10,
+			},
+			expect: []string{
+				"--apidb-address/API_DB_ADDRESS and --project-group-ids"},
+		},
+		"database without password": {
+			cmd: CheckAccessCmd{
+				APIDBAddress:      "db:3306",
+				KeycloakRateLimit: 10,
+			},
+			expect: []string{
+				"--apidb-address/API_DB_ADDRESS requires"},
+		},
+		"zero keycloak rate limit": {
+			cmd: CheckAccessCmd{ProjectGroupIDs: groupIDs},
+			expect: []string{
+				"--keycloak-rate-limit/KEYCLOAK_RATE_LIMIT"},
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			errs := tc.cmd.flagErrors()
+			assert.Equal(tt, len(tc.expect), len(errs), name)
+			for i := range errs {
+				assert.True(tt, strings.HasPrefix(errs[i], tc.expect[i]), name)
+			}
+		})
+	}
+}
+
+func TestCheckAccess(t *testing.T) {
+	log := slog.New(slog.NewJSONHandler(os.Stderr, nil))
+	userUUID := uuid.MustParse("11111111-1111-1111-1111-111111111111")
+	projectGroupID := uuid.MustParse("00000000-0000-0000-0000-000000000001")
+	userGroupPaths := []string{"/project-foo/project-foo-maintainer"}
+	var testCases = map[string]struct {
+		// input
+		envType       string
+		logsOnlyRoles []string
+		execOnlyRoles []string
+		staticGroups  bool
+		invalidFlags  bool
+		// mock data
+		realmRoles []string
+		userRole   lagoon.UserRole
+		kcErr      error
+		ldbErr     error
+		// expectations
+		expectError string
+		expect      string
+	}{
+		"full access from database": {
+			envType:  "production",
+			userRole: lagoon.Maintainer,
+			expect: `{
+  "allowed": true,
+  "capability": "full",
+  "group": "00000000-0000-0000-0000-000000000001"
+}
+`,
+		},
+		"logs-only from project group IDs": {
+			envType:       "production",
+			logsOnlyRoles: []string{"guest"},
+			staticGroups:  true,
+			userRole:      lagoon.Guest,
+			expect: `{
+  "allowed": true,
+  "capability": "logs-only",
+  "group": "00000000-0000-0000-0000-000000000001"
+}
+`,
+		},
+		"exec-only from project group IDs": {
+			envType:       "production",
+			execOnlyRoles: []string{"developer"},
+			staticGroups:  true,
+			userRole:      lagoon.Developer,
+			expect: `{
+  "allowed": true,
+  "capability": "exec-only",
+  "group": "00000000-0000-0000-0000-000000000001"
+}
+`,
+		},
+		"denied": {
+			envType:      "production",
+			staticGroups: true,
+			userRole:     lagoon.Guest,
+			expect: `{
+  "allowed": false
+}
+`,
+		},
+		"platform-owner": {
+			envType:    "development",
+			realmRoles: []string{"platform-owner"},
+			expect: `{
+  "allowed": true,
+  "capability": "full"
+}
+`,
+		},
+		"user not in keycloak": {
+			envType: "development",
+			kcErr:   keycloak.ErrUserNotFound,
+			expect: `{
+  "allowed": false,
+  "reason": "user-not-in-keycloak"
+}
+`,
+		},
+		"database error": {
+			envType:     "development",
+			userRole:    lagoon.Developer,
+			ldbErr:      errors.New("connection refused"),
+			expectError: "couldn't check user access",
+		},
+		"invalid logs-only role": {
+			envType:       "development",
+			logsOnlyRoles: []string{"admin"},
+			invalidFlags:  true,
+			expectError:   "invalid logs-only role: admin",
+		},
+		"invalid exec-only role": {
+			envType:       "development",
+			execOnlyRoles: []string{"admin"},
+			invalidFlags:  true,
+			expectError:   "invalid exec-only role: admin",
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			ctx := context.Background()
+			cmd := CheckAccessCmd{
+				EnvType:       tc.envType,
+				LogsOnlyRoles: tc.logsOnlyRoles,
+				ExecOnlyRoles: tc.execOnlyRoles,
+				ProjectID:     4,
+				UserUUID:      userUUID,
+			}
+			// set up mocks
+			ctrl := gomock.NewController(tt)
+			kcService := NewMockKeycloakService(ctrl)
+			ldbService := NewMockLagoonDBService(ctrl)
+			var ldb rbac.LagoonDBService = ldbService
+			if tc.staticGroups {
+				cmd.ProjectGroupIDs = []uuid.UUID{projectGroupID}
+				ldb = staticProjectGroups(cmd.ProjectGroupIDs)
+			}
+			if !tc.invalidFlags {
+				kcService.EXPECT().UserRolesAndGroups(ctx, userUUID).
+					Return(tc.realmRoles, userGroupPaths, tc.kcErr)
+			}
+			if tc.userRole != 0 || tc.staticGroups {
+				kcService.EXPECT().UserGroupIDRole(ctx, userGroupPaths).
+					Return(map[uuid.UUID]lagoon.UserRole{
+						projectGroupID: tc.userRole,
+					})
+				if !tc.staticGroups {
+					ldbService.EXPECT().ProjectGroupIDs(ctx, 4).
+						Return([]uuid.UUID{projectGroupID}, tc.ldbErr)
+				}
+				if tc.ldbErr == nil {
+					kcService.EXPECT().
+						AncestorGroups(ctx, []uuid.UUID{projectGroupID}).
+						Return([]uuid.UUID{projectGroupID}, nil)
+				}
+			}
+			var buf bytes.Buffer
+			err := cmd.checkAccess(ctx, log, kcService, ldb, &buf)
+			if tc.expectError != "" {
+				assert.Error(tt, err, name)
+				assert.Contains(tt, err.Error(), tc.expectError, name)
+				return
+			}
+			assert.NoError(tt, err, name)
+			assert.Equal(tt, tc.expect, buf.String(), name)
+		})
+	}
+}
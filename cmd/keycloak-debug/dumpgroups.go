@@ -29,7 +29,7 @@ func (cmd *DumpGroupsCmd) Run(log *slog.Logger) error {
 		cmd.KeycloakBaseURL,
 		cmd.KeycloakClientID,
 		cmd.KeycloakClientSecret,
-		cmd.KeycloakRateLimit)
+		keycloak.NewLimiter(log, nil, float64(cmd.KeycloakRateLimit), 0))
 	if err != nil {
 		return fmt.Errorf("couldn't init keycloak client: %v", err)
 	}
@@ -10,8 +10,10 @@ import (
 
 // CLI represents the command-line interface.
 type CLI struct {
-	Debug      bool          `kong:"env='DEBUG',help='Enable debug logging'"`
-	DumpGroups DumpGroupsCmd `kong:"cmd,default=1,help='(default) Dump top-level Keycloak groups to stdout'"`
+	Debug           bool           `kong:"env='DEBUG',help='Enable debug logging'"`
+	CheckUserAccess CheckAccessCmd `kong:"cmd,help='Print the SSH access decision for a user and project as JSON'"`
+	DumpGroups      DumpGroupsCmd  `kong:"cmd,default=1,help='(default) Dump top-level Keycloak groups to stdout'"`
+	Version         VersionCmd     `kong:"cmd,help='Print version information'"`
 }
 
 func main() {
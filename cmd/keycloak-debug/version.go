@@ -0,0 +1,34 @@
+package main
+
+import (
+	"os"
+
+	"github.com/uselagoon/ssh-portal/internal/versioninfo"
+)
+
+// These variables are set by GoReleaser during the build.
+var (
+	commit      string
+	date        string
+	goVersion   string
+	projectName string
+	version     string
+)
+
+// VersionCmd represents the `version` command.
+type VersionCmd struct {
+	Verbose bool   `kong:"short='v',help='Include the effective configuration parsed from the environment, with secrets redacted'"`
+	Output  string `kong:"short='o',enum='json,text',default='json',help='Output format (json, text)'"`
+}
+
+// Run the Version command.
+func (cmd *VersionCmd) Run() error {
+	info := versioninfo.New(versioninfo.Build{
+		ProjectName: projectName,
+		Version:     version,
+		Commit:      commit,
+		BuildDate:   date,
+		GoVersion:   goVersion,
+	}, &DumpGroupsCmd{}, cmd.Verbose)
+	return info.Write(os.Stdout, cmd.Output)
+}
@@ -5,33 +5,85 @@ import (
 	"fmt"
 	"log/slog"
 	"os/signal"
+	"strings"
 	"syscall"
+	"time"
 
-	"github.com/go-sql-driver/mysql"
-	"github.com/uselagoon/ssh-portal/internal/keycloak"
-	"github.com/uselagoon/ssh-portal/internal/lagoondb"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/uselagoon/ssh-portal/internal/bootstrap"
 	"github.com/uselagoon/ssh-portal/internal/metrics"
-	"github.com/uselagoon/ssh-portal/internal/rbac"
 	"github.com/uselagoon/ssh-portal/internal/sshportalapi"
 	"golang.org/x/sync/errgroup"
 )
 
-const (
-	metricsPort = ":9911"
-)
-
 // ServeCmd represents the serve command.
 type ServeCmd struct {
-	APIDBAddress         string `kong:"required,env='API_DB_ADDRESS',help='Lagoon API DB Address (host[:port])'"`
-	APIDBDatabase        string `kong:"default='infrastructure',env='API_DB_DATABASE',help='Lagoon API DB Database Name'"`
-	APIDBPassword        string `kong:"required,env='API_DB_PASSWORD',help='Lagoon API DB Password'"`
-	APIDBUsername        string `kong:"default='api',env='API_DB_USERNAME',help='Lagoon API DB Username'"`
-	BlockDeveloperSSH    bool   `kong:"env='BLOCK_DEVELOPER_SSH',help='Disallow Developer SSH access'"`
-	KeycloakBaseURL      string `kong:"required,env='KEYCLOAK_BASE_URL',help='Keycloak Base URL'"`
-	KeycloakClientID     string `kong:"default='service-api',env='KEYCLOAK_SERVICE_API_CLIENT_ID',help='Keycloak OAuth2 Client ID'"`
-	KeycloakClientSecret string `kong:"required,env='KEYCLOAK_SERVICE_API_CLIENT_SECRET',help='Keycloak OAuth2 Client Secret'"`
-	KeycloakRateLimit    int    `kong:"default=10,env='KEYCLOAK_RATE_LIMIT',help='Keycloak API Rate Limit (requests/second)'"`
-	NATSURL              string `kong:"required,env='NATS_URL',help='NATS server URL (nats://... or tls://...)'"`
+	APIDBAddress          string        `kong:"required,env='API_DB_ADDRESS',help='Lagoon API DB Address (host[:port])'"`
+	APIDBDatabase         string        `kong:"default='infrastructure',env='API_DB_DATABASE',help='Lagoon API DB Database Name'"`
+	APIDBPassword         string        `kong:"required,env='API_DB_PASSWORD',help='Lagoon API DB Password'"`
+	APIDBUsername         string        `kong:"default='api',env='API_DB_USERNAME',help='Lagoon API DB Username'"`
+	BackendFailures       int           `kong:"default='5',env='BACKEND_FAILURE_THRESHOLD',name='backend-failure-threshold',help='Consecutive failed Keycloak or Lagoon API DB calls after which queries are denied without calling the backend (0 to disable)'"`
+	BackendCoolDown       time.Duration `kong:"default='30s',env='BACKEND_COOL_DOWN',help='Time to deny queries after a backend fails, before probing it again'"`
+	BlockDeveloperSSH     bool          `kong:"env='BLOCK_DEVELOPER_SSH',help='Disallow Developer SSH access'"`
+	DisableAncestorGroups bool          `kong:"env='DISABLE_ANCESTOR_GROUPS',help='Only consider the groups a project is directly in when checking SSH access, for installations without nested groups'"`
+	ExecOnlyRoles         []string      `kong:"env='EXEC_ONLY_ROLES',help='Roles granted exec-only SSH access (shells, commands, and sftp, but not logs) to environments they cannot otherwise SSH to'"`
+	KeycloakBaseURL       string        `kong:"required,env='KEYCLOAK_BASE_URL',help='Keycloak Base URL'"`
+	KeycloakCACert        string        `kong:"name='keycloak-ca-cert',env='KEYCLOAK_CA_CERT',help='Path of a PEM bundle of certificate authorities used to verify the Keycloak TLS certificate (default uses the system trust store)'"`
+	KeycloakClientID      string        `kong:"default='service-api',env='KEYCLOAK_SERVICE_API_CLIENT_ID',help='Keycloak OAuth2 Client ID'"`
+	KeycloakClientSecret  string        `kong:"required,env='KEYCLOAK_SERVICE_API_CLIENT_SECRET',help='Keycloak OAuth2 Client Secret'"`
+	KeycloakInsecureTLS   bool          `kong:"name='keycloak-insecure-tls',env='KEYCLOAK_INSECURE_TLS',help='Skip verification of the Keycloak TLS certificate (for testing only)'"`
+	KeycloakMaxGroupDepth int           `kong:"name='keycloak-max-group-depth',env='KEYCLOAK_MAX_GROUP_DEPTH',help='Maximum depth of the Keycloak group hierarchy, beyond which group lookups fail (default 32)'"`
+	KeycloakPageSize      int           `kong:"name='keycloak-page-size',env='KEYCLOAK_PAGE_SIZE',help='Number of groups requested per page from the Keycloak API (default 1000)'"`
+	KeycloakRateLimit     int           `kong:"default=10,env='KEYCLOAK_RATE_LIMIT',help='Keycloak API Rate Limit (requests/second)'"`
+	KeycloakRateBurst     int           `kong:"env='KEYCLOAK_RATE_BURST',help='Keycloak API Rate Limit burst (default equal to the rate limit)'"`
+	LogsOnlyRoles         []string      `kong:"env='LOGS_ONLY_ROLES',help='Roles granted logs-only SSH access to environments they cannot otherwise SSH to (e.g. guest,reporter)'"`
+	MetricsDisabled       bool          `kong:"name='metrics-disabled',env='METRICS_DISABLED',help='Disable the Prometheus metrics server'"`
+	MetricsPort           string        `kong:"name='metrics-port',default=':9911',env='METRICS_PORT',help='Address the Prometheus metrics server will listen on ([host]:port)'"`
+	NATSURL               string        `kong:"required,env='NATS_URL',help='NATS server URL (nats://... or tls://...)'"`
+	NATSSubjects          []string      `kong:"name='nats-subjects',default='lagoon.sshportal.api',env='NATS_SUBJECTS',help='NATS subjects to serve SSH access queries on. Queries on the legacy lagoon.serviceapi.sshportal subject are answered in the legacy format'"`
+	NATSWorkers           uint          `kong:"default='8',env='NATS_WORKERS',help='Maximum number of NATS requests processed concurrently'"`
+}
+
+// flagErrors returns a description of each inconsistent combination of flags
+// in cmd, or nil if there are none.
+func (cmd *ServeCmd) flagErrors() []string {
+	var errs []string
+	if cmd.BackendFailures > 0 && cmd.BackendCoolDown <= 0 {
+		errs = append(errs, "--backend-failure-threshold/"+
+			"BACKEND_FAILURE_THRESHOLD requires --backend-cool-down/"+
+			"BACKEND_COOL_DOWN greater than zero; set the threshold to 0 to "+
+			"disable the circuit breakers")
+	}
+	if cmd.KeycloakRateLimit < 1 {
+		errs = append(errs, "--keycloak-rate-limit/KEYCLOAK_RATE_LIMIT must "+
+			"be at least one, otherwise Keycloak requests are rejected")
+	}
+	if !cmd.MetricsDisabled {
+		if err := metrics.ValidateAddress(cmd.MetricsPort); err != nil {
+			errs = append(errs, fmt.Sprintf("--metrics-port/METRICS_PORT %q "+
+				"is not a valid [host]:port address: %v", cmd.MetricsPort, err))
+		}
+	}
+	return errs
+}
+
+// metricsAddress returns the address the metrics server listens on, or an
+// empty string if it is disabled.
+func (cmd *ServeCmd) metricsAddress() string {
+	if cmd.MetricsDisabled {
+		return ""
+	}
+	return cmd.MetricsPort
+}
+
+// AfterApply is called by kong once flag values have been applied. It checks
+// that the flags are consistent with each other, so that misconfiguration is
+// reported at startup rather than on first use.
+func (cmd *ServeCmd) AfterApply() error {
+	if errs := cmd.flagErrors(); len(errs) > 0 {
+		return fmt.Errorf("invalid flags:\n  %s", strings.Join(errs, "\n  "))
+	}
+	return nil
 }
 
 // Run the serve command to ssh-portal API requests.
@@ -40,40 +92,66 @@ func (cmd *ServeCmd) Run(log *slog.Logger) error {
 	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM)
 	defer stop()
 	// init lagoon DB client
-	dbConf := mysql.NewConfig()
-	dbConf.Addr = cmd.APIDBAddress
-	dbConf.DBName = cmd.APIDBDatabase
-	dbConf.Net = "tcp"
-	dbConf.Passwd = cmd.APIDBPassword
-	dbConf.User = cmd.APIDBUsername
-	ldb, err := lagoondb.NewClient(ctx, dbConf.FormatDSN())
+	ldb, err := bootstrap.NewLagoonDB(ctx, bootstrap.DBConfig{
+		Address:  cmd.APIDBAddress,
+		Database: cmd.APIDBDatabase,
+		Username: cmd.APIDBUsername,
+		Password: cmd.APIDBPassword,
+	})
 	if err != nil {
-		return fmt.Errorf("couldn't init lagoondb client: %v", err)
+		return err
 	}
 	// init keycloak client
-	k, err := keycloak.NewClient(ctx, log,
-		cmd.KeycloakBaseURL,
-		cmd.KeycloakClientID,
-		cmd.KeycloakClientSecret,
-		cmd.KeycloakRateLimit)
+	kb, err := bootstrap.NewKeycloak(log, prometheus.DefaultRegisterer,
+		bootstrap.KeycloakConfig{
+			BaseURL:       cmd.KeycloakBaseURL,
+			RateLimit:     cmd.KeycloakRateLimit,
+			RateBurst:     cmd.KeycloakRateBurst,
+			PageSize:      cmd.KeycloakPageSize,
+			MaxGroupDepth: cmd.KeycloakMaxGroupDepth,
+			InsecureTLS:   cmd.KeycloakInsecureTLS,
+			CACert:        cmd.KeycloakCACert,
+		})
+	if err != nil {
+		return err
+	}
+	k, err := kb.NewClient(ctx, cmd.KeycloakClientID, cmd.KeycloakClientSecret)
 	if err != nil {
 		return fmt.Errorf("couldn't init keycloak client: %v", err)
 	}
+	// guard the backends with circuit breakers
+	m := sshportalapi.NewMetrics(prometheus.DefaultRegisterer)
+	breakers, err := sshportalapi.NewBreakers(
+		m, cmd.BackendFailures, cmd.BackendCoolDown)
+	if err != nil {
+		return fmt.Errorf("couldn't init circuit breakers: %v", err)
+	}
+	// time each stage of a query inside the breakers, so that calls which
+	// fail fast while a breaker is open aren't recorded
+	guardedLDB := sshportalapi.GuardLagoonDB(
+		sshportalapi.TimeLagoonDB(ldb, m), breakers.LagoonDB)
+	guardedKeycloak := sshportalapi.GuardKeycloak(
+		sshportalapi.TimeKeycloak(k, m), breakers.Keycloak)
 	// init RBAC permission engine
-	var p *rbac.Permission
-	if cmd.BlockDeveloperSSH {
-		p = rbac.NewPermission(k, ldb, rbac.BlockDeveloperSSH())
-	} else {
-		p = rbac.NewPermission(k, ldb)
+	p, err := bootstrap.NewPermission(guardedKeycloak, guardedLDB,
+		bootstrap.RBACConfig{
+			BlockDeveloperSSH:     cmd.BlockDeveloperSSH,
+			DisableAncestorGroups: cmd.DisableAncestorGroups,
+			LogsOnlyRoles:         cmd.LogsOnlyRoles,
+			ExecOnlyRoles:         cmd.ExecOnlyRoles,
+		})
+	if err != nil {
+		return err
 	}
 	// set up goroutine handler
 	eg, ctx := errgroup.WithContext(ctx)
 	// start the metrics server
-	metrics.Serve(ctx, eg, metricsPort)
+	metrics.Serve(ctx, eg, cmd.metricsAddress())
 	// start serving SSH token requests
 	eg.Go(func() error {
 		// start serving NATS requests
-		return sshportalapi.ServeNATS(ctx, stop, log, p, ldb, cmd.NATSURL)
+		return sshportalapi.ServeNATS(ctx, stop, log, m, p, guardedLDB,
+			breakers, cmd.NATSURL, cmd.NATSSubjects, cmd.NATSWorkers)
 	})
 	return eg.Wait()
 }
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/assert/v2"
+)
+
+func TestServeFlagErrors(t *testing.T) {
+	var testCases = map[string]struct {
+		cmd    ServeCmd
+		expect []string
+	}{
+		"defaults": {
+			cmd: ServeCmd{
+				BackendFailures:   5,
+				BackendCoolDown:   30 * time.Second,
+				KeycloakRateLimit: 10,
+			},
+		},
+		"breakers disabled": {
+			cmd: ServeCmd{KeycloakRateLimit: 10},
+		},
+		"threshold without cool-down": {
+			cmd: ServeCmd{BackendFailures: 5, KeycloakRateLimit: 10},
+			expect: []string{
+				"--backend-failure-threshold/BACKEND_FAILURE_THRESHOLD"},
+		},
+		"zero keycloak rate limit": {
+			cmd: ServeCmd{KeycloakRateBurst: 5},
+			expect: []string{
+				"--keycloak-rate-limit/KEYCLOAK_RATE_LIMIT"},
+		},
+		"malformed metrics port": {
+			cmd:    ServeCmd{KeycloakRateLimit: 10, MetricsPort: "localhost"},
+			expect: []string{"--metrics-port/METRICS_PORT"},
+		},
+		"metrics disabled": {
+			cmd: ServeCmd{KeycloakRateLimit: 10, MetricsDisabled: true},
+		},
+		"multiple": {
+			cmd: ServeCmd{BackendFailures: 5},
+			expect: []string{
+				"--backend-failure-threshold/BACKEND_FAILURE_THRESHOLD",
+				"--keycloak-rate-limit/KEYCLOAK_RATE_LIMIT",
+			},
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			// fill in the defaults which are not under test
+			if tc.cmd.MetricsPort == "" && !tc.cmd.MetricsDisabled {
+				tc.cmd.MetricsPort = ":9911"
+			}
+			errs := tc.cmd.flagErrors()
+			assert.Equal(tt, len(tc.expect), len(errs), name)
+			for i := range errs {
+				assert.True(tt, strings.HasPrefix(errs[i], tc.expect[i]), name)
+			}
+		})
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/uselagoon/ssh-portal/internal/audit"
+	"github.com/uselagoon/ssh-portal/internal/k8s"
+	"github.com/uselagoon/ssh-portal/internal/metrics"
+	"github.com/uselagoon/ssh-portal/internal/readiness"
+	"github.com/uselagoon/ssh-portal/internal/sshserver"
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	// checkMetricsPort is the default address of the ssh-portal metrics
+	// server. The check runs its own server, so it ignores --metrics-port.
+	checkMetricsPort     = ":9912"
+	checkMetricsURL      = "http://127.0.0.1" + checkMetricsPort + "/metrics"
+	checkMetricsInterval = 100 * time.Millisecond
+)
+
+// CheckMetricsCmd represents the check-metrics command.
+type CheckMetricsCmd struct {
+	Timeout time.Duration `kong:"default='10s',help='Maximum time to wait for the metrics server to respond'"`
+}
+
+// scrape fetches url, retrying until the server responds or ctx is
+// cancelled, and verifies that the response contains each of the expected
+// metric families.
+func scrape(
+	ctx context.Context,
+	url string,
+	expected []metrics.Family,
+) ([]string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't construct request: %v", err)
+	}
+	ticker := time.NewTicker(checkMetricsInterval)
+	defer ticker.Stop()
+	for {
+		res, err := http.DefaultClient.Do(req)
+		if err == nil {
+			defer res.Body.Close()
+			if res.StatusCode != http.StatusOK {
+				return nil, fmt.Errorf("bad metrics response status: %s",
+					res.Status)
+			}
+			return metrics.Verify(res.Body, expected)
+		}
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("couldn't scrape metrics: %v", err)
+		case <-ticker.C:
+		}
+	}
+}
+
+// Run the CheckMetrics command.
+func (cmd *CheckMetricsCmd) Run(log *slog.Logger) error {
+	ctx, cancel := context.WithTimeout(context.Background(), cmd.Timeout)
+	defer cancel()
+	// register the metrics exported by ssh-portal, and generate synthetic
+	// observations without starting any real sessions.
+	var collectors []prometheus.Collector
+	collectors = append(collectors,
+		k8s.NewMetrics(prometheus.DefaultRegisterer).Collectors()...)
+	collectors = append(collectors,
+		sshserver.NewMetrics(prometheus.DefaultRegisterer).Collectors()...)
+	collectors = append(collectors, audit.Collectors()...)
+	collectors = append(collectors,
+		readiness.NewChecker(log, prometheus.DefaultRegisterer, "sshportal",
+			readinessComponents(nil, nil, "")...).Collectors()...)
+	expected, err := metrics.Synthesize(collectors...)
+	if err != nil {
+		return fmt.Errorf("couldn't synthesize metrics: %v", err)
+	}
+	// start the metrics server and scrape it
+	eg, ctx := errgroup.WithContext(ctx)
+	serveCtx, stopServe := context.WithCancel(ctx)
+	metrics.Serve(serveCtx, eg, checkMetricsPort)
+	missing, scrapeErr := scrape(ctx, checkMetricsURL, expected)
+	stopServe()
+	if err = eg.Wait(); err != nil {
+		return err
+	}
+	if scrapeErr != nil {
+		return scrapeErr
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("missing metrics: %s", strings.Join(missing, ", "))
+	}
+	log.Info("all metrics present", slog.Int("count", len(expected)))
+	return nil
+}
@@ -6,19 +6,17 @@ import (
 	"os"
 
 	"github.com/alecthomas/kong"
-	"github.com/moby/spdystream"
 )
 
 // CLI represents the command-line interface.
 type CLI struct {
-	Debug   bool       `kong:"env='DEBUG',help='Enable debug logging'"`
-	Serve   ServeCmd   `kong:"cmd,default=1,help='(default) Serve ssh-portal requests'"`
-	Version VersionCmd `kong:"cmd,help='Print version information'"`
+	Debug        bool            `kong:"env='DEBUG',help='Enable debug logging'"`
+	Serve        ServeCmd        `kong:"cmd,default=1,help='(default) Serve ssh-portal requests'"`
+	CheckMetrics CheckMetricsCmd `kong:"cmd,name='check-metrics',help='Check that the metrics server exports every ssh-portal metric, using synthetic observations'"`
+	Version      VersionCmd      `kong:"cmd,help='Print version information'"`
 }
 
 func main() {
-	// work around https://github.com/moby/spdystream/issues/87
-	spdystream.DEBUG = ""
 	// parse CLI config
 	cli := CLI{}
 	kctx := kong.Parse(&cli,
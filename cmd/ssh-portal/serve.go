@@ -2,35 +2,180 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net"
+	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/uselagoon/ssh-portal/internal/audit"
 	"github.com/uselagoon/ssh-portal/internal/bus"
+	"github.com/uselagoon/ssh-portal/internal/hostkey"
 	"github.com/uselagoon/ssh-portal/internal/k8s"
+	"github.com/uselagoon/ssh-portal/internal/keypolicy"
+	"github.com/uselagoon/ssh-portal/internal/listener"
+	"github.com/uselagoon/ssh-portal/internal/messages"
 	"github.com/uselagoon/ssh-portal/internal/metrics"
+	"github.com/uselagoon/ssh-portal/internal/readiness"
 	"github.com/uselagoon/ssh-portal/internal/sshserver"
 	"golang.org/x/sync/errgroup"
 )
 
-const (
-	metricsPort = ":9912"
-)
-
 // ServeCmd represents the serve command.
 type ServeCmd struct {
 	NATSServer         string        `kong:"required,env='NATS_URL',help='NATS server URL (nats://... or tls://...)'"`
+	NATSReResolve      time.Duration `kong:"name='nats-re-resolve-interval',env='NATS_RE_RESOLVE_INTERVAL',help='Interval at which to re-resolve the NATS server hostname, which is resolved as a DNS SRV record if it begins with an underscore (default disabled)'"`
+	ClusterName        string        `kong:"env='CLUSTER_NAME',help='Name of the cluster ssh-portal is running in, as known to Lagoon'"`
+	SSHListenAddress   string        `kong:"name='ssh-listen-address',env='SSH_LISTEN_ADDRESS',help='IPv4 or IPv6 address the SSH server will listen on for SSH client connections (default all interfaces)'"`
 	SSHServerPort      uint          `kong:"default='2222',env='SSH_SERVER_PORT',help='Port the SSH server will listen on for SSH client connections'"`
+	ListenFD           int           `kong:"name='listen-fd',default='-1',env='LISTEN_FD',help='Inherited file descriptor of a listening socket to use instead of binding the SSH server port (systemd socket activation via LISTEN_FDS is also supported)'"`
+	ReusePort          bool          `kong:"env='REUSE_PORT',help='Set SO_REUSEPORT on the SSH server socket, so that a new process can listen on the port before the old one stops'"`
+	ListenSocket       string        `kong:"name='listen-socket',env='LISTEN_SOCKET',help='Path of a Unix domain socket to accept SSH client connections on, in addition to the SSH server port'"`
+	ListenSocketMode   string        `kong:"name='listen-socket-mode',default='0660',env='LISTEN_SOCKET_MODE',help='Octal permission bits of the Unix domain socket'"`
+	DisableTCP         bool          `kong:"name='disable-tcp',env='DISABLE_TCP',help='Only accept SSH client connections on the Unix domain socket'"`
 	HostKeyECDSA       string        `kong:"env='HOST_KEY_ECDSA',help='PEM encoded ECDSA host key'"`
 	HostKeyED25519     string        `kong:"env='HOST_KEY_ED25519',help='PEM encoded Ed25519 host key'"`
 	HostKeyRSA         string        `kong:"env='HOST_KEY_RSA',help='PEM encoded RSA host key'"`
 	LogAccessEnabled   bool          `kong:"env='LOG_ACCESS_ENABLED',help='Allow any user who can SSH into a pod to also access its logs'"`
-	Banner             string        `kong:"env='BANNER',help='Text sent to remote users before authentication'"`
+	DebugEnabled       bool          `kong:"name='debug-containers',env='DEBUG_CONTAINERS_ENABLED',help='Allow the debug connection parameter to add ephemeral debug containers to pods'"`
+	DebugImage         string        `kong:"default='busybox',env='DEBUG_IMAGE',help='Image used for ephemeral debug containers'"`
+	Banner             string        `kong:"xor='banner',env='BANNER',help='Text sent to remote users before authentication'"`
+	BannerFile         string        `kong:"xor='banner',env='BANNER_FILE',help='Path of a file containing text sent to remote users before authentication, which is re-read on SIGHUP'"`
+	OldClientVersion   string        `kong:"name='old-client-version',env='OLD_CLIENT_VERSION',help='Append a warning to the banner sent to OpenSSH clients older than this release (e.g. 7.4); clients are never rejected (default disabled)'"`
+	DefaultShell       string        `kong:"default='sh',env='DEFAULT_SHELL',help='Shell used for interactive sessions and commands, unless overridden by the ssh.lagoon.sh/shell namespace annotation'"`
 	ConcurrentLogLimit uint          `kong:"default='32',env='CONCURRENT_LOG_LIMIT',help='Maximum number of concurrent log sessions'"`
+	ExecTimeLimit      time.Duration `kong:"default='0',env='EXEC_TIME_LIMIT',help='Maximum lifetime of each shell, command, or sftp session (0 means unlimited)'"`
+	ReauthPerSession   bool          `kong:"name='reauth-per-session',env='REAUTH_PER_SESSION',help='Check SSH access again at the start of every session, so that revoked keys cannot open new sessions on an existing connection'"`
+	DisableExec        bool          `kong:"name='disable-exec',env='DISABLE_EXEC',help='Reject shell, command, and debug sessions regardless of SSH access, e.g. on observability-only portals'"`
+	DisableSFTP        bool          `kong:"name='disable-sftp',env='DISABLE_SFTP',help='Reject sftp sessions regardless of SSH access'"`
+	ConfirmProduction  bool          `kong:"name='confirm-production',env='CONFIRM_PRODUCTION',help='Require users to type yes before interactive sessions to production environments start'"`
 	LogTimeLimit       time.Duration `kong:"default='4h',env='LOG_TIME_LIMIT',help='Maximum lifetime of each logs session'"`
+	LogsDefaultTail    int64         `kong:"name='logs-default-tail',default='32',env='LOGS_DEFAULT_TAIL',help='Number of log lines returned if none are requested'"`
+	LogsMaxTail        int64         `kong:"name='logs-max-tail',default='1024',env='LOGS_MAX_TAIL',help='Maximum number of log lines which may be requested'"`
+	LogsMaxBytes       int64         `kong:"name='logs-max-bytes',default='1048576',env='LOGS_MAX_BYTES',help='Maximum number of bytes of logs returned from a single container'"`
+	LogsQueueBytes     int64         `kong:"name='logs-queue-bytes',default='4194304',env='LOGS_QUEUE_BYTES',help='Maximum number of bytes of log lines buffered per logs session'"`
+	LogMaxLineLength   int           `kong:"default='1048576',env='LOG_MAX_LINE_LENGTH',help='Maximum length in bytes of a container log line before it is truncated'"`
+	MaxCommandLength   int           `kong:"name='max-command-length',default='65536',env='MAX_COMMAND_LENGTH',help='Maximum length in bytes of the command requested by a client (0 means unlimited)'"`
+	LogSanitize        bool          `kong:"env='LOG_SANITIZE',help='Strip ANSI escape sequences and control characters from container logs'"`
+	KubeAPIQPS         float32       `kong:"default='5',env='KUBE_API_QPS',help='Sustained queries per second allowed to the Kubernetes API'"`
+	KubeAPIBurst       int           `kong:"default='10',env='KUBE_API_BURST',help='Maximum burst of queries allowed to the Kubernetes API'"`
+	KubeAPISlowCall    time.Duration `kong:"name='kube-api-slow-call-threshold',default='1s',env='KUBE_API_SLOW_CALL_THRESHOLD',help='Log Kubernetes API calls on the session critical path which take longer than this (0 disables)'"`
+	NamespaceAllow     string        `kong:"name='namespace-allow-pattern',env='NAMESPACE_ALLOW_PATTERN',help='Only serve namespaces matching this RE2 pattern (must match the entire name)'"`
+	NamespaceDeny      string        `kong:"name='namespace-deny-pattern',env='NAMESPACE_DENY_PATTERN',help='Never serve namespaces matching this RE2 pattern (must match the entire name)'"`
+	KeyAlgorithms      []string      `kong:"env='KEY_ALGORITHMS',help='Allowed client public key algorithms (default allows any)'"`
+	KeyMinRSABits      int           `kong:"name='key-min-rsa-bits',env='KEY_MIN_RSA_BITS',help='Minimum size of client RSA public keys in bits (default allows any)'"`
+	MessagesFile       string        `kong:"name='messages-file',env='MESSAGES_FILE',help='Path of a YAML file overriding the messages printed to users'"`
+	MetricsDisabled    bool          `kong:"name='metrics-disabled',env='METRICS_DISABLED',help='Disable the Prometheus metrics server'"`
+	MetricsPort        string        `kong:"name='metrics-port',default=':9912',env='METRICS_PORT',help='Address the Prometheus metrics server will listen on ([host]:port)'"`
+	ReadinessInterval  time.Duration `kong:"name='readiness-check-interval',default='15s',env='READINESS_CHECK_INTERVAL',help='Interval at which NATS and Kubernetes API connectivity are checked and exported as readiness metrics'"`
+	ReadinessNamespace string        `kong:"name='readiness-namespace',default='default',env='READINESS_NAMESPACE',help='Namespace fetched to check that the Kubernetes API is reachable'"`
+	AuditSink          string        `kong:"enum='none,slog,nats',default='none',env='AUDIT_SINK',help='Where to send audit events (none, slog, nats)'"`
+	AuditQueueSize     uint          `kong:"default='256',env='AUDIT_QUEUE_SIZE',help='Maximum number of audit events buffered before events are dropped'"`
+	AuthTarpitLimit    int           `kong:"name='auth-tarpit-threshold',env='AUTH_TARPIT_THRESHOLD',help='Delay failed authentication from a source IP after this many connections from it fail to authenticate within the tarpit window (0 disables)'"`
+	AuthTarpitWindow   time.Duration `kong:"name='auth-tarpit-window',default='10m',env='AUTH_TARPIT_WINDOW',help='Window in which connections from a source IP which fail to authenticate are counted'"`
+	AuthTarpitMaxDelay time.Duration `kong:"name='auth-tarpit-max-delay',default='8s',env='AUTH_TARPIT_MAX_DELAY',help='Maximum delay applied to a failed authentication attempt'"`
+}
+
+// flagErrors returns a description of each inconsistent combination of flags
+// in cmd, or nil if there are none.
+func (cmd *ServeCmd) flagErrors() []string {
+	var errs []string
+	if cmd.LogAccessEnabled && cmd.ConcurrentLogLimit == 0 {
+		errs = append(errs, "--log-access-enabled/LOG_ACCESS_ENABLED "+
+			"requires --concurrent-log-limit/CONCURRENT_LOG_LIMIT greater "+
+			"than zero, otherwise every logs session is rejected")
+	}
+	if cmd.DebugEnabled && cmd.DisableExec {
+		errs = append(errs, "--debug-containers/DEBUG_CONTAINERS_ENABLED "+
+			"has no effect with --disable-exec/DISABLE_EXEC, since debug "+
+			"sessions are rejected; unset one of them")
+	}
+	if cmd.DisableTCP {
+		if cmd.ListenSocket == "" {
+			errs = append(errs, "--disable-tcp/DISABLE_TCP requires "+
+				"--listen-socket/LISTEN_SOCKET, otherwise no SSH client "+
+				"connections are accepted")
+		}
+		if cmd.ListenFD >= 0 || cmd.ReusePort || cmd.SSHListenAddress != "" {
+			errs = append(errs, "--listen-fd/LISTEN_FD, "+
+				"--reuse-port/REUSE_PORT, and "+
+				"--ssh-listen-address/SSH_LISTEN_ADDRESS have no effect with "+
+				"--disable-tcp/DISABLE_TCP; unset them")
+		}
+	}
+	if cmd.LogsDefaultTail > cmd.LogsMaxTail {
+		errs = append(errs, fmt.Sprintf(
+			"--logs-default-tail/LOGS_DEFAULT_TAIL %d exceeds "+
+				"--logs-max-tail/LOGS_MAX_TAIL %d",
+			cmd.LogsDefaultTail, cmd.LogsMaxTail))
+	}
+	if cmd.MaxCommandLength < 0 {
+		errs = append(errs, fmt.Sprintf(
+			"--max-command-length/MAX_COMMAND_LENGTH %d is negative",
+			cmd.MaxCommandLength))
+	}
+	if cmd.AuditSink != "none" && cmd.AuditQueueSize == 0 {
+		errs = append(errs, fmt.Sprintf("--audit-sink/AUDIT_SINK %s "+
+			"requires --audit-queue-size/AUDIT_QUEUE_SIZE greater than zero, "+
+			"otherwise audit events are dropped", cmd.AuditSink))
+	}
+	if !cmd.MetricsDisabled {
+		if err := metrics.ValidateAddress(cmd.MetricsPort); err != nil {
+			errs = append(errs, fmt.Sprintf("--metrics-port/METRICS_PORT %q "+
+				"is not a valid [host]:port address: %v", cmd.MetricsPort, err))
+		}
+	}
+	if cmd.ReadinessInterval <= 0 {
+		errs = append(errs, fmt.Sprintf("--readiness-check-interval/"+
+			"READINESS_CHECK_INTERVAL %v must be positive",
+			cmd.ReadinessInterval))
+	}
+	return errs
+}
+
+// readinessComponents returns the components which must be ready for
+// ssh-portal to be ready.
+func readinessComponents(
+	nc *bus.NATSClient,
+	c *k8s.Client,
+	namespace string,
+) []readiness.Component {
+	return []readiness.Component{{
+		Name:  "nats_connected",
+		Help:  "Whether the NATS connection is connected (1) or not (0)",
+		Check: nc.CheckConnected,
+	}, {
+		Name: "k8s_api_reachable",
+		Help: "Whether the Kubernetes API is reachable (1) or not (0)",
+		Check: func(ctx context.Context) error {
+			return c.CheckAPI(ctx, namespace)
+		},
+	}}
+}
+
+// metricsAddress returns the address the metrics server listens on, or an
+// empty string if it is disabled.
+func (cmd *ServeCmd) metricsAddress() string {
+	if cmd.MetricsDisabled {
+		return ""
+	}
+	return cmd.MetricsPort
+}
+
+// AfterApply is called by kong once flag values have been applied. It checks
+// that the flags are consistent with each other, so that misconfiguration is
+// reported at startup rather than on first use.
+func (cmd *ServeCmd) AfterApply() error {
+	if errs := cmd.flagErrors(); len(errs) > 0 {
+		return fmt.Errorf("invalid flags:\n  %s", strings.Join(errs, "\n  "))
+	}
+	return nil
 }
 
 // Run the serve command to handle SSH connection requests.
@@ -38,47 +183,226 @@ func (cmd *ServeCmd) Run(log *slog.Logger) error {
 	// get main process context, which cancels on SIGTERM
 	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGTERM)
 	defer cancel()
-	// get nats client
-	nc, err := bus.NewNATSClient(cmd.NATSServer, log, cancel)
+	// identify the cluster in all log lines
+	if cmd.ClusterName != "" {
+		log = log.With(slog.String("clusterName", cmd.ClusterName))
+	}
+	// validate namespace patterns
+	nsFilter, err := sshserver.NewNamespaceFilter(cmd.NamespaceAllow,
+		cmd.NamespaceDeny)
+	if err != nil {
+		return fmt.Errorf("couldn't configure namespace filter: %v", err)
+	}
+	// validate key policy
+	keyPolicy, err := keypolicy.NewPolicy(cmd.KeyAlgorithms, cmd.KeyMinRSABits)
+	if err != nil {
+		return fmt.Errorf("couldn't configure key policy: %v", err)
+	}
+	// parse persistent host key arguments
+	hostkeys, err := hostkey.Parse(
+		hostkey.Source{Name: "--host-key-ecdsa/HOST_KEY_ECDSA",
+			PEM: cmd.HostKeyECDSA},
+		hostkey.Source{Name: "--host-key-ed-25519/HOST_KEY_ED25519",
+			PEM: cmd.HostKeyED25519},
+		hostkey.Source{Name: "--host-key-rsa/HOST_KEY_RSA",
+			PEM: cmd.HostKeyRSA})
+	if err != nil {
+		return err
+	}
+	// read banner file
+	var bannerFile *sshserver.BannerFile
+	if cmd.BannerFile != "" {
+		bannerFile, err = sshserver.NewBannerFile(cmd.BannerFile)
+		if err != nil {
+			return err
+		}
+	}
+	// load message overrides
+	var msgs *messages.Catalog
+	if cmd.MessagesFile != "" {
+		if msgs, err = messages.Load(log, cmd.MessagesFile); err != nil {
+			return err
+		}
+	}
+	// validate auth tarpit
+	authTarpit, err := sshserver.NewAuthTarpit(cmd.AuthTarpitLimit,
+		cmd.AuthTarpitWindow, cmd.AuthTarpitMaxDelay)
+	if err != nil {
+		return fmt.Errorf("couldn't configure auth tarpit: %v", err)
+	}
+	// validate logs configuration
+	if cmd.LogsDefaultTail < 1 || cmd.LogsMaxTail < 1 || cmd.LogsMaxBytes < 1 ||
+		cmd.LogsQueueBytes < 1 {
+		return errors.New("logs tail and byte limits must be positive")
+	}
+	// validate listener configuration
+	socketMode, err := strconv.ParseUint(cmd.ListenSocketMode, 8, 32)
+	if err != nil || socketMode > 0777 {
+		return fmt.Errorf("invalid listen socket mode %q", cmd.ListenSocketMode)
+	}
+	listenAddress, err := listener.JoinAddress(cmd.SSHListenAddress,
+		cmd.SSHServerPort)
+	if err != nil {
+		return fmt.Errorf("invalid ssh-listen-address or ssh-server-port: %v",
+			err)
+	}
+	// get nats client. It is closed last on shutdown, once the SSH server has
+	// stopped and the audit queue has been flushed.
+	nc, err := bus.NewNATSClient(cmd.NATSServer, cmd.ClusterName, log, cancel,
+		bus.NATSReResolveInterval(cmd.NATSReResolve))
 	if err != nil {
 		return fmt.Errorf("couldn't get nats client: %v", err)
 	}
 	defer nc.Close()
-	// start listening on TCP port
-	l, err := net.Listen("tcp", fmt.Sprintf(":%d", cmd.SSHServerPort))
-	if err != nil {
-		return fmt.Errorf("couldn't listen on port %d: %v", cmd.SSHServerPort, err)
+	// configure audit sink
+	var auditSink audit.Sink = audit.Discard{}
+	var auditQueue *audit.Queue
+	switch cmd.AuditSink {
+	case "slog":
+		auditQueue = audit.NewQueue(log, audit.NewSlogSink(log),
+			cmd.AuditQueueSize)
+	case "nats":
+		auditQueue = audit.NewQueue(log,
+			audit.NewNATSSink(nc, bus.SubjectSSHAuditEvent), cmd.AuditQueueSize)
+	}
+	if auditQueue != nil {
+		auditSink = auditQueue
 	}
-	defer l.Close()
+	// start listening on TCP port and Unix socket. The socket is removed when
+	// its listener is closed.
+	var listeners []net.Listener
+	if !cmd.DisableTCP {
+		tl, err := listener.New(cmd.SSHServerPort, listener.FD(cmd.ListenFD),
+			listener.Address(cmd.SSHListenAddress),
+			listener.ReusePort(cmd.ReusePort))
+		if err != nil {
+			return fmt.Errorf("couldn't listen on %s: %v", listenAddress, err)
+		}
+		defer tl.Close()
+		listeners = append(listeners, tl)
+	}
+	if cmd.ListenSocket != "" {
+		ul, err := listener.NewUnix(cmd.ListenSocket, os.FileMode(socketMode))
+		if err != nil {
+			return fmt.Errorf("couldn't listen on socket %s: %v",
+				cmd.ListenSocket, err)
+		}
+		defer ul.Close()
+		listeners = append(listeners, ul)
+	}
+	l := listener.Multi(listeners...)
 	// get kubernetes client
-	c, err := k8s.NewClient(cmd.ConcurrentLogLimit, cmd.LogTimeLimit)
+	k8s.DisableSPDYStreamDebug(log)
+	c, err := k8s.NewClient(cmd.ConcurrentLogLimit, cmd.LogTimeLimit,
+		k8s.APIRateLimit(cmd.KubeAPIQPS, cmd.KubeAPIBurst),
+		k8s.SlowCallThreshold(cmd.KubeAPISlowCall),
+		k8s.LogSanitization(cmd.LogSanitize),
+		k8s.LogMaxLineLength(cmd.LogMaxLineLength),
+		k8s.LogTailLines(cmd.LogsDefaultTail, cmd.LogsMaxTail),
+		k8s.LogLimitBytes(cmd.LogsMaxBytes),
+		k8s.LogQueueBytes(cmd.LogsQueueBytes),
+		k8s.DebugImage(cmd.DebugImage),
+		k8s.ClientMetrics(k8s.NewMetrics(prometheus.DefaultRegisterer)))
 	if err != nil {
 		return fmt.Errorf("couldn't create k8s client: %v", err)
 	}
-	// check for persistent host key arguments
-	var hostkeys [][]byte
-	for _, hk := range []string{cmd.HostKeyECDSA, cmd.HostKeyED25519, cmd.HostKeyRSA} {
-		if len(hk) > 0 {
-			hostkeys = append(hostkeys, []byte(hk))
-		}
-	}
+	qps, burst := c.APIRateLimit()
+	log.Info("configured kubernetes API client rate limit",
+		slog.Float64("qps", float64(qps)),
+		slog.Int("burst", burst))
 	// set up goroutine handler
 	eg, ctx := errgroup.WithContext(ctx)
 	// start the metrics server
-	metrics.Serve(ctx, eg, metricsPort)
-	// start serving SSH token requests
+	metrics.Serve(ctx, eg, cmd.metricsAddress())
+	// export readiness metrics
+	checker := readiness.NewChecker(log, prometheus.DefaultRegisterer,
+		"sshportal", readinessComponents(nc, c, cmd.ReadinessNamespace)...)
+	eg.Go(func() error {
+		checker.Run(ctx, cmd.ReadinessInterval)
+		return nil
+	})
+	// re-read the banner file on SIGHUP
+	if bannerFile != nil {
+		eg.Go(func() error {
+			reloadBanner(ctx, log, bannerFile)
+			return nil
+		})
+	}
+	// start forwarding audit events. The audit queue keeps running until the
+	// SSH server has stopped, so that events from in-flight sessions are
+	// forwarded during shutdown.
+	auditCtx, auditCancel := context.WithCancel(context.WithoutCancel(ctx))
+	defer auditCancel()
+	if auditQueue != nil {
+		eg.Go(func() error {
+			auditQueue.Run(auditCtx)
+			return nil
+		})
+	}
+	// Shutdown happens in this order once ctx is cancelled:
+	//
+	// 1. the SSH server closes its listener, and waits for in-flight
+	//    connections to finish;
+	// 2. the audit queue is flushed;
+	// 3. the NATS connection is closed.
 	eg.Go(func() error {
+		defer auditCancel()
 		// start serving SSH connection requests
-		return sshserver.Serve(
-			ctx,
-			log,
-			nc,
-			l,
-			c,
-			hostkeys,
-			cmd.LogAccessEnabled,
-			cmd.Banner,
-		)
+		return sshserver.Serve(ctx, log, sshserver.Options{
+			Metrics:           sshserver.NewMetrics(prometheus.DefaultRegisterer),
+			NATS:              nc,
+			Listener:          l,
+			K8S:               c,
+			Namespaces:        c,
+			HostKeys:          hostkeys,
+			LogAccessEnabled:  cmd.LogAccessEnabled,
+			DebugEnabled:      cmd.DebugEnabled,
+			DefaultShell:      cmd.DefaultShell,
+			ExecTimeLimit:     cmd.ExecTimeLimit,
+			LogsMaxTail:       cmd.LogsMaxTail,
+			LogTimeLimit:      cmd.LogTimeLimit,
+			Version:           version,
+			MaxCommandLength:  cmd.MaxCommandLength,
+			ReauthPerSession:  cmd.ReauthPerSession,
+			ConfirmProduction: cmd.ConfirmProduction,
+			DisableExec:       cmd.DisableExec,
+			DisableSFTP:       cmd.DisableSFTP,
+			Banner:            cmd.Banner,
+			BannerFile:        bannerFile,
+			OldClientVersion:  cmd.OldClientVersion,
+			NamespaceFilter:   nsFilter,
+			KeyPolicy:         keyPolicy,
+			AuthTarpit:        authTarpit,
+			Messages:          msgs,
+			AuditSink:         auditSink,
+		})
 	})
 	return eg.Wait()
 }
+
+// reloadBanner re-reads the given banner file each time the process receives
+// SIGHUP, until ctx is cancelled. If the file can't be read the previous
+// banner is retained.
+func reloadBanner(
+	ctx context.Context,
+	log *slog.Logger,
+	bannerFile *sshserver.BannerFile,
+) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	log = log.With(slog.String("bannerFile", bannerFile.Path()))
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			if err := bannerFile.Reload(); err != nil {
+				log.Warn("couldn't reload banner, keeping previous banner",
+					slog.Any("error", err))
+				continue
+			}
+			log.Info("reloaded banner")
+		}
+	}
+}
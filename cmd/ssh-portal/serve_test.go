@@ -0,0 +1,194 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/assert/v2"
+	"github.com/alecthomas/kong"
+)
+
+func TestServeBannerFlags(t *testing.T) {
+	var testCases = map[string]struct {
+		args      []string
+		expectErr bool
+	}{
+		"neither": {},
+		"banner": {
+			args: []string{"--banner=welcome"},
+		},
+		"banner file": {
+			args: []string{"--banner-file=/etc/ssh-portal/banner"},
+		},
+		"both": {
+			args: []string{"--banner=welcome",
+				"--banner-file=/etc/ssh-portal/banner"},
+			expectErr: true,
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			parser, err := kong.New(&CLI{})
+			assert.NoError(tt, err, name)
+			_, err = parser.Parse(append(
+				[]string{"serve", "--nats-server=nats://localhost:4222"},
+				tc.args...))
+			if tc.expectErr {
+				assert.Error(tt, err, name)
+			} else {
+				assert.NoError(tt, err, name)
+			}
+		})
+	}
+}
+
+func TestServeFlagErrors(t *testing.T) {
+	var testCases = map[string]struct {
+		cmd    ServeCmd
+		expect []string
+	}{
+		"defaults": {
+			cmd: ServeCmd{},
+		},
+		"log access without log limit": {
+			cmd:    ServeCmd{LogAccessEnabled: true},
+			expect: []string{"--log-access-enabled/LOG_ACCESS_ENABLED"},
+		},
+		"log access with log limit": {
+			cmd: ServeCmd{LogAccessEnabled: true, ConcurrentLogLimit: 1},
+		},
+		"debug containers with exec disabled": {
+			cmd: ServeCmd{DebugEnabled: true, DisableExec: true},
+			expect: []string{
+				"--debug-containers/DEBUG_CONTAINERS_ENABLED"},
+		},
+		"disable tcp without socket": {
+			cmd:    ServeCmd{DisableTCP: true},
+			expect: []string{"--disable-tcp/DISABLE_TCP"},
+		},
+		"disable tcp with socket": {
+			cmd: ServeCmd{DisableTCP: true, ListenSocket: "/run/ssh.sock"},
+		},
+		"disable tcp with tcp flags": {
+			cmd: ServeCmd{
+				DisableTCP:       true,
+				ListenSocket:     "/run/ssh.sock",
+				ListenFD:         3,
+				SSHListenAddress: "::1",
+			},
+			expect: []string{"--listen-fd/LISTEN_FD"},
+		},
+		"logs default tail exceeds max": {
+			cmd:    ServeCmd{LogsDefaultTail: 64, LogsMaxTail: 32},
+			expect: []string{"--logs-default-tail/LOGS_DEFAULT_TAIL 64"},
+		},
+		"negative max command length": {
+			cmd:    ServeCmd{MaxCommandLength: -1},
+			expect: []string{"--max-command-length/MAX_COMMAND_LENGTH -1"},
+		},
+		"audit sink without queue": {
+			cmd:    ServeCmd{AuditSink: "nats"},
+			expect: []string{"--audit-sink/AUDIT_SINK nats"},
+		},
+		"negative readiness check interval": {
+			cmd: ServeCmd{ReadinessInterval: -time.Second},
+			expect: []string{
+				"--readiness-check-interval/READINESS_CHECK_INTERVAL -1s"},
+		},
+		"multiple": {
+			cmd: ServeCmd{
+				LogAccessEnabled: true,
+				DisableTCP:       true,
+				AuditSink:        "slog",
+			},
+			expect: []string{
+				"--log-access-enabled/LOG_ACCESS_ENABLED",
+				"--disable-tcp/DISABLE_TCP",
+				"--audit-sink/AUDIT_SINK slog",
+			},
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			// fill in the defaults which are not under test
+			if tc.cmd.AuditSink == "" {
+				tc.cmd.AuditSink = "none"
+			}
+			if tc.cmd.ListenFD == 0 {
+				tc.cmd.ListenFD = -1
+			}
+			if tc.cmd.MetricsPort == "" && !tc.cmd.MetricsDisabled {
+				tc.cmd.MetricsPort = ":9912"
+			}
+			if tc.cmd.ReadinessInterval == 0 {
+				tc.cmd.ReadinessInterval = 15 * time.Second
+			}
+			errs := tc.cmd.flagErrors()
+			assert.Equal(tt, len(tc.expect), len(errs), name)
+			for i := range errs {
+				assert.True(tt, strings.HasPrefix(errs[i], tc.expect[i]), name)
+			}
+		})
+	}
+}
+
+func TestServeMetricsFlags(t *testing.T) {
+	var testCases = map[string]struct {
+		args          []string
+		expectAddress string
+		expectErr     bool
+	}{
+		"default": {
+			expectAddress: ":9912",
+		},
+		"custom port": {
+			args:          []string{"--metrics-port=127.0.0.1:9000"},
+			expectAddress: "127.0.0.1:9000",
+		},
+		"disabled": {
+			args:          []string{"--metrics-disabled"},
+			expectAddress: "",
+		},
+		"disabled with malformed port": {
+			args:          []string{"--metrics-disabled", "--metrics-port=x"},
+			expectAddress: "",
+		},
+		"malformed port": {
+			args:      []string{"--metrics-port=9000"},
+			expectErr: true,
+		},
+		"port out of range": {
+			args:      []string{"--metrics-port=:99999"},
+			expectErr: true,
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			var cli CLI
+			parser, err := kong.New(&cli)
+			assert.NoError(tt, err, name)
+			_, err = parser.Parse(append(
+				[]string{"serve", "--nats-server=nats://localhost:4222"},
+				tc.args...))
+			if tc.expectErr {
+				assert.Error(tt, err, name)
+				return
+			}
+			assert.NoError(tt, err, name)
+			assert.Equal(tt, tc.expectAddress, cli.Serve.metricsAddress(), name)
+		})
+	}
+}
+
+func TestServeAfterApply(t *testing.T) {
+	parser, err := kong.New(&CLI{})
+	assert.NoError(t, err)
+	_, err = parser.Parse([]string{"serve",
+		"--nats-server=nats://localhost:4222", "--disable-tcp",
+		"--concurrent-log-limit=0", "--log-access-enabled"})
+	assert.Error(t, err)
+	// all violations are reported at once
+	assert.Contains(t, err.Error(), "--log-access-enabled/LOG_ACCESS_ENABLED")
+	assert.Contains(t, err.Error(), "--disable-tcp/DISABLE_TCP")
+}
@@ -1,8 +1,9 @@
 package main
 
 import (
-	"encoding/json"
-	"fmt"
+	"os"
+
+	"github.com/uselagoon/ssh-portal/internal/versioninfo"
 )
 
 // These variables are set by GoReleaser during the build.
@@ -15,27 +16,19 @@ var (
 )
 
 // VersionCmd represents the `version` command.
-type VersionCmd struct{}
+type VersionCmd struct {
+	Verbose bool   `kong:"short='v',help='Include the effective configuration parsed from the environment, with secrets redacted'"`
+	Output  string `kong:"short='o',enum='json,text',default='json',help='Output format (json, text)'"`
+}
 
 // Run the Version command.
-func (*VersionCmd) Run() error {
-	v, err := json.Marshal(
-		struct {
-			ProjectName string
-			Version     string
-			Commit      string
-			BuildDate   string
-			GoVersion   string
-		}{
-			projectName,
-			version,
-			commit,
-			date,
-			goVersion,
-		})
-	if err != nil {
-		return err
-	}
-	_, err = fmt.Println(string(v))
-	return err
+func (cmd *VersionCmd) Run() error {
+	info := versioninfo.New(versioninfo.Build{
+		ProjectName: projectName,
+		Version:     version,
+		Commit:      commit,
+		BuildDate:   date,
+		GoVersion:   goVersion,
+	}, &ServeCmd{}, cmd.Verbose)
+	return info.Write(os.Stdout, cmd.Output)
 }
@@ -4,40 +4,96 @@ import (
 	"context"
 	"fmt"
 	"log/slog"
-	"net"
 	"os/signal"
+	"strings"
 	"syscall"
 
-	"github.com/go-sql-driver/mysql"
-	"github.com/uselagoon/ssh-portal/internal/keycloak"
-	"github.com/uselagoon/ssh-portal/internal/lagoondb"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/uselagoon/ssh-portal/internal/bootstrap"
+	"github.com/uselagoon/ssh-portal/internal/bus"
+	"github.com/uselagoon/ssh-portal/internal/hostkey"
+	"github.com/uselagoon/ssh-portal/internal/keypolicy"
+	"github.com/uselagoon/ssh-portal/internal/listener"
+	"github.com/uselagoon/ssh-portal/internal/messages"
 	"github.com/uselagoon/ssh-portal/internal/metrics"
-	"github.com/uselagoon/ssh-portal/internal/rbac"
 	"github.com/uselagoon/ssh-portal/internal/sshtoken"
 	"golang.org/x/sync/errgroup"
 )
 
-const (
-	metricsPort = ":9948"
-)
-
 // ServeCmd represents the serve command.
 type ServeCmd struct {
-	APIDBAddress                   string `kong:"required,env='API_DB_ADDRESS',help='Lagoon API DB Address (host[:port])'"`
-	APIDBDatabase                  string `kong:"default='infrastructure',env='API_DB_DATABASE',help='Lagoon API DB Database Name'"`
-	APIDBPassword                  string `kong:"required,env='API_DB_PASSWORD',help='Lagoon API DB Password'"`
-	APIDBUsername                  string `kong:"default='api',env='API_DB_USERNAME',help='Lagoon API DB Username'"`
-	BlockDeveloperSSH              bool   `kong:"env='BLOCK_DEVELOPER_SSH',help='Disallow Developer SSH access'"`
-	HostKeyECDSA                   string `kong:"env='HOST_KEY_ECDSA',help='PEM encoded ECDSA host key'"`
-	HostKeyED25519                 string `kong:"env='HOST_KEY_ED25519',help='PEM encoded Ed25519 host key'"`
-	HostKeyRSA                     string `kong:"env='HOST_KEY_RSA',help='PEM encoded RSA host key'"`
-	KeycloakBaseURL                string `kong:"required,env='KEYCLOAK_BASE_URL',help='Keycloak Base URL'"`
-	KeycloakPermissionClientID     string `kong:"default='service-api',env='KEYCLOAK_SERVICE_API_CLIENT_ID',help='Keycloak service-api OAuth2 Client ID'"`
-	KeycloakPermissionClientSecret string `kong:"env='KEYCLOAK_SERVICE_API_CLIENT_SECRET',help='Keycloak service-api OAuth2 Client Secret'"`
-	KeycloakRateLimit              int    `kong:"default=10,env='KEYCLOAK_RATE_LIMIT',help='Keycloak API Rate Limit (requests/second)'"`
-	KeycloakTokenClientID          string `kong:"default='auth-server',env='KEYCLOAK_AUTH_SERVER_CLIENT_ID',help='Keycloak auth-server OAuth2 Client ID'"`
-	KeycloakTokenClientSecret      string `kong:"required,env='KEYCLOAK_AUTH_SERVER_CLIENT_SECRET',help='Keycloak auth-server OAuth2 Client Secret'"`
-	SSHServerPort                  uint   `kong:"default='2222',env='SSH_SERVER_PORT',help='Port the SSH server will listen on for SSH client connections'"`
+	APIDBAddress                   string   `kong:"required,env='API_DB_ADDRESS',help='Lagoon API DB Address (host[:port])'"`
+	APIDBDatabase                  string   `kong:"default='infrastructure',env='API_DB_DATABASE',help='Lagoon API DB Database Name'"`
+	APIDBPassword                  string   `kong:"required,env='API_DB_PASSWORD',help='Lagoon API DB Password'"`
+	APIDBUsername                  string   `kong:"default='api',env='API_DB_USERNAME',help='Lagoon API DB Username'"`
+	BlockDeveloperSSH              bool     `kong:"env='BLOCK_DEVELOPER_SSH',help='Disallow Developer SSH access'"`
+	DisableAncestorGroups          bool     `kong:"env='DISABLE_ANCESTOR_GROUPS',help='Only consider the groups a project is directly in when checking SSH access, for installations without nested groups'"`
+	EndpointLookup                 string   `kong:"enum='db,nats',default='db',env='ENDPOINT_LOOKUP',help='How to look up the SSH endpoint users are redirected to (db, nats). In nats mode failed lookups fall back to the Lagoon API DB'"`
+	HostKeyECDSA                   string   `kong:"env='HOST_KEY_ECDSA',help='PEM encoded ECDSA host key'"`
+	HostKeyED25519                 string   `kong:"env='HOST_KEY_ED25519',help='PEM encoded Ed25519 host key'"`
+	HostKeyRSA                     string   `kong:"env='HOST_KEY_RSA',help='PEM encoded RSA host key'"`
+	KeyAlgorithms                  []string `kong:"env='KEY_ALGORITHMS',help='Allowed client public key algorithms (default allows any)'"`
+	KeyMinRSABits                  int      `kong:"name='key-min-rsa-bits',env='KEY_MIN_RSA_BITS',help='Minimum size of client RSA public keys in bits (default allows any)'"`
+	KeycloakBaseURL                string   `kong:"required,env='KEYCLOAK_BASE_URL',help='Keycloak Base URL'"`
+	KeycloakCACert                 string   `kong:"name='keycloak-ca-cert',env='KEYCLOAK_CA_CERT',help='Path of a PEM bundle of certificate authorities used to verify the Keycloak TLS certificate (default uses the system trust store)'"`
+	KeycloakInsecureTLS            bool     `kong:"name='keycloak-insecure-tls',env='KEYCLOAK_INSECURE_TLS',help='Skip verification of the Keycloak TLS certificate (for testing only)'"`
+	KeycloakMaxGroupDepth          int      `kong:"name='keycloak-max-group-depth',env='KEYCLOAK_MAX_GROUP_DEPTH',help='Maximum depth of the Keycloak group hierarchy, beyond which group lookups fail (default 32)'"`
+	KeycloakPageSize               int      `kong:"name='keycloak-page-size',env='KEYCLOAK_PAGE_SIZE',help='Number of groups requested per page from the Keycloak API (default 1000)'"`
+	KeycloakPermissionClientID     string   `kong:"default='service-api',env='KEYCLOAK_SERVICE_API_CLIENT_ID',help='Keycloak service-api OAuth2 Client ID'"`
+	KeycloakPermissionClientSecret string   `kong:"env='KEYCLOAK_SERVICE_API_CLIENT_SECRET',help='Keycloak service-api OAuth2 Client Secret'"`
+	KeycloakRateBurst              int      `kong:"env='KEYCLOAK_RATE_BURST',help='Keycloak API Rate Limit burst (default equal to the rate limit)'"`
+	KeycloakRateLimit              int      `kong:"default=10,env='KEYCLOAK_RATE_LIMIT',help='Keycloak API Rate Limit (requests/second), shared by all Keycloak clients'"`
+	KeycloakTokenClientID          string   `kong:"default='auth-server',env='KEYCLOAK_AUTH_SERVER_CLIENT_ID',help='Keycloak auth-server OAuth2 Client ID'"`
+	KeycloakTokenClientSecret      string   `kong:"required,env='KEYCLOAK_AUTH_SERVER_CLIENT_SECRET',help='Keycloak auth-server OAuth2 Client Secret'"`
+	ListenFD                       int      `kong:"name='listen-fd',default='-1',env='LISTEN_FD',help='Inherited file descriptor of a listening socket to use instead of binding the SSH server port (systemd socket activation via LISTEN_FDS is also supported)'"`
+	MessagesFile                   string   `kong:"name='messages-file',env='MESSAGES_FILE',help='Path of a YAML file overriding the messages printed to users'"`
+	MetricsDisabled                bool     `kong:"name='metrics-disabled',env='METRICS_DISABLED',help='Disable the Prometheus metrics server'"`
+	MetricsPort                    string   `kong:"name='metrics-port',default=':9948',env='METRICS_PORT',help='Address the Prometheus metrics server will listen on ([host]:port)'"`
+	NATSURL                        string   `kong:"name='nats-url',env='NATS_URL',help='NATS server URL (nats://... or tls://...). Required if endpoint-lookup is nats'"`
+	ReusePort                      bool     `kong:"env='REUSE_PORT',help='Set SO_REUSEPORT on the SSH server socket, so that a new process can listen on the port before the old one stops'"`
+	SkipStartupChecks              bool     `kong:"name='skip-startup-checks',env='SKIP_STARTUP_CHECKS',help='Skip the check of Keycloak client credentials at startup'"`
+	SSHListenAddress               string   `kong:"name='ssh-listen-address',env='SSH_LISTEN_ADDRESS',help='IPv4 or IPv6 address the SSH server will listen on for SSH client connections (default all interfaces)'"`
+	SSHServerPort                  uint     `kong:"default='2222',env='SSH_SERVER_PORT',help='Port the SSH server will listen on for SSH client connections'"`
+}
+
+// flagErrors returns a description of each inconsistent combination of flags
+// in cmd, or nil if there are none.
+func (cmd *ServeCmd) flagErrors() []string {
+	var errs []string
+	if cmd.EndpointLookup == "nats" && cmd.NATSURL == "" {
+		errs = append(errs, "--endpoint-lookup/ENDPOINT_LOOKUP nats "+
+			"requires --nats-url/NATS_URL")
+	}
+	if cmd.KeycloakRateLimit < 1 {
+		errs = append(errs, "--keycloak-rate-limit/KEYCLOAK_RATE_LIMIT must "+
+			"be at least one, otherwise Keycloak requests are rejected")
+	}
+	if !cmd.MetricsDisabled {
+		if err := metrics.ValidateAddress(cmd.MetricsPort); err != nil {
+			errs = append(errs, fmt.Sprintf("--metrics-port/METRICS_PORT %q "+
+				"is not a valid [host]:port address: %v", cmd.MetricsPort, err))
+		}
+	}
+	return errs
+}
+
+// metricsAddress returns the address the metrics server listens on, or an
+// empty string if it is disabled.
+func (cmd *ServeCmd) metricsAddress() string {
+	if cmd.MetricsDisabled {
+		return ""
+	}
+	return cmd.MetricsPort
+}
+
+// AfterApply is called by kong once flag values have been applied. It checks
+// that the flags are consistent with each other, so that misconfiguration is
+// reported at startup rather than on first use.
+func (cmd *ServeCmd) AfterApply() error {
+	if errs := cmd.flagErrors(); len(errs) > 0 {
+		return fmt.Errorf("invalid flags:\n  %s", strings.Join(errs, "\n  "))
+	}
+	return nil
 }
 
 // Run the serve command to ssh-portal API requests.
@@ -45,63 +101,130 @@ func (cmd *ServeCmd) Run(log *slog.Logger) error {
 	// get main process context, which cancels on SIGTERM
 	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM)
 	defer stop()
+	// validate key policy
+	keyPolicy, err := keypolicy.NewPolicy(cmd.KeyAlgorithms, cmd.KeyMinRSABits)
+	if err != nil {
+		return fmt.Errorf("couldn't configure key policy: %v", err)
+	}
+	// parse persistent host key arguments
+	hostkeys, err := hostkey.Parse(
+		hostkey.Source{Name: "--host-key-ecdsa/HOST_KEY_ECDSA",
+			PEM: cmd.HostKeyECDSA},
+		hostkey.Source{Name: "--host-key-ed-25519/HOST_KEY_ED25519",
+			PEM: cmd.HostKeyED25519},
+		hostkey.Source{Name: "--host-key-rsa/HOST_KEY_RSA",
+			PEM: cmd.HostKeyRSA})
+	if err != nil {
+		return err
+	}
+	// load message overrides
+	var msgs *messages.Catalog
+	if cmd.MessagesFile != "" {
+		if msgs, err = messages.Load(log, cmd.MessagesFile); err != nil {
+			return err
+		}
+	}
 	// init lagoon DB client
-	dbConf := mysql.NewConfig()
-	dbConf.Addr = cmd.APIDBAddress
-	dbConf.DBName = cmd.APIDBDatabase
-	dbConf.Net = "tcp"
-	dbConf.Passwd = cmd.APIDBPassword
-	dbConf.User = cmd.APIDBUsername
-	ldb, err := lagoondb.NewClient(ctx, dbConf.FormatDSN())
+	ldb, err := bootstrap.NewLagoonDB(ctx, bootstrap.DBConfig{
+		Address:  cmd.APIDBAddress,
+		Database: cmd.APIDBDatabase,
+		Username: cmd.APIDBUsername,
+		Password: cmd.APIDBPassword,
+	})
+	if err != nil {
+		return err
+	}
+	// init SSH endpoint lookup
+	var endpoints sshtoken.SSHEndpointService = ldb
+	if cmd.EndpointLookup == "nats" {
+		nc, err := bus.NewNATSClient(cmd.NATSURL, "", log, stop)
+		if err != nil {
+			return fmt.Errorf("couldn't get nats client: %v", err)
+		}
+		defer nc.Close()
+		endpoints = sshtoken.NewFallbackSSHEndpoint(log, nc, ldb)
+	}
+	// init keycloak rate limiter and metrics shared by both keycloak clients
+	kb, err := bootstrap.NewKeycloak(log, prometheus.DefaultRegisterer,
+		bootstrap.KeycloakConfig{
+			BaseURL:       cmd.KeycloakBaseURL,
+			RateLimit:     cmd.KeycloakRateLimit,
+			RateBurst:     cmd.KeycloakRateBurst,
+			PageSize:      cmd.KeycloakPageSize,
+			MaxGroupDepth: cmd.KeycloakMaxGroupDepth,
+			InsecureTLS:   cmd.KeycloakInsecureTLS,
+			CACert:        cmd.KeycloakCACert,
+		})
 	if err != nil {
-		return fmt.Errorf("couldn't init lagoonDB client: %v", err)
+		return err
 	}
 	// init token / auth-server keycloak client
-	keycloakToken, err := keycloak.NewClient(ctx, log,
-		cmd.KeycloakBaseURL,
-		cmd.KeycloakTokenClientID,
-		cmd.KeycloakTokenClientSecret,
-		cmd.KeycloakRateLimit)
+	keycloakToken, err := kb.NewClient(ctx,
+		cmd.KeycloakTokenClientID, cmd.KeycloakTokenClientSecret)
 	if err != nil {
 		return fmt.Errorf("couldn't init keycloak token client: %v", err)
 	}
 	// init permission / service-api keycloak client
-	keycloakPermission, err := keycloak.NewClient(ctx, log,
-		cmd.KeycloakBaseURL,
-		cmd.KeycloakPermissionClientID,
-		cmd.KeycloakPermissionClientSecret,
-		cmd.KeycloakRateLimit)
+	keycloakPermission, err := kb.NewClient(ctx,
+		cmd.KeycloakPermissionClientID, cmd.KeycloakPermissionClientSecret)
 	if err != nil {
 		return fmt.Errorf("couldn't init keycloak permission client: %v", err)
 	}
+	// check keycloak client credentials, since a misconfigured client would
+	// otherwise only fail on the first user request
+	if !cmd.SkipStartupChecks {
+		if err = keycloakToken.CheckCredentials(ctx); err != nil {
+			return fmt.Errorf("keycloak token client failed startup check, "+
+				"check KEYCLOAK_AUTH_SERVER_CLIENT_ID and "+
+				"KEYCLOAK_AUTH_SERVER_CLIENT_SECRET: %v", err)
+		}
+		if err = keycloakPermission.CheckCredentials(ctx); err != nil {
+			return fmt.Errorf("keycloak permission client failed startup "+
+				"check, check KEYCLOAK_SERVICE_API_CLIENT_ID and "+
+				"KEYCLOAK_SERVICE_API_CLIENT_SECRET: %v", err)
+		}
+	}
 	// init RBAC permission engine
-	var p *rbac.Permission
-	if cmd.BlockDeveloperSSH {
-		p = rbac.NewPermission(keycloakPermission, ldb, rbac.BlockDeveloperSSH())
-	} else {
-		p = rbac.NewPermission(keycloakPermission, ldb)
+	p, err := bootstrap.NewPermission(keycloakPermission, ldb,
+		bootstrap.RBACConfig{
+			BlockDeveloperSSH:     cmd.BlockDeveloperSSH,
+			DisableAncestorGroups: cmd.DisableAncestorGroups,
+		})
+	if err != nil {
+		return err
 	}
 	// start listening on TCP port
-	l, err := net.Listen("tcp", fmt.Sprintf(":%d", cmd.SSHServerPort))
+	listenAddress, err := listener.JoinAddress(cmd.SSHListenAddress,
+		cmd.SSHServerPort)
 	if err != nil {
-		return fmt.Errorf("couldn't listen on port %d: %v", cmd.SSHServerPort, err)
+		return fmt.Errorf("invalid ssh-listen-address or ssh-server-port: %v",
+			err)
 	}
-	defer l.Close()
-	// check for persistent host key arguments
-	var hostkeys [][]byte
-	for _, hk := range []string{cmd.HostKeyECDSA, cmd.HostKeyED25519,
-		cmd.HostKeyRSA} {
-		if len(hk) > 0 {
-			hostkeys = append(hostkeys, []byte(hk))
-		}
+	l, err := listener.New(cmd.SSHServerPort, listener.FD(cmd.ListenFD),
+		listener.Address(cmd.SSHListenAddress),
+		listener.ReusePort(cmd.ReusePort))
+	if err != nil {
+		return fmt.Errorf("couldn't listen on %s: %v", listenAddress, err)
 	}
+	defer l.Close()
 	// set up goroutine handler
 	eg, ctx := errgroup.WithContext(ctx)
 	// start the metrics server
-	metrics.Serve(ctx, eg, metricsPort)
+	metrics.Serve(ctx, eg, cmd.metricsAddress())
 	// start serving SSH token requests
 	eg.Go(func() error {
-		return sshtoken.Serve(ctx, log, l, p, ldb, keycloakToken, hostkeys)
+		return sshtoken.Serve(ctx, log, sshtoken.Options{
+			Metrics:       sshtoken.NewMetrics(prometheus.DefaultRegisterer),
+			Listener:      l,
+			Permission:    p,
+			LagoonDB:      ldb,
+			SSHEndpoint:   endpoints,
+			KeycloakToken: keycloakToken,
+			KeycloakUser:  keycloakPermission,
+			HostKeys:      hostkeys,
+			KeyPolicy:     keyPolicy,
+			Messages:      msgs,
+		})
 	})
 	return eg.Wait()
 }
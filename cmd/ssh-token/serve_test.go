@@ -0,0 +1,70 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/alecthomas/assert/v2"
+)
+
+func TestServeFlagErrors(t *testing.T) {
+	var testCases = map[string]struct {
+		cmd    ServeCmd
+		expect []string
+	}{
+		"db lookup": {
+			cmd: ServeCmd{EndpointLookup: "db", KeycloakRateLimit: 10},
+		},
+		"nats lookup": {
+			cmd: ServeCmd{
+				EndpointLookup:    "nats",
+				NATSURL:           "nats://localhost:4222",
+				KeycloakRateLimit: 10,
+			},
+		},
+		"nats lookup without nats url": {
+			cmd:    ServeCmd{EndpointLookup: "nats", KeycloakRateLimit: 10},
+			expect: []string{"--endpoint-lookup/ENDPOINT_LOOKUP nats"},
+		},
+		"zero keycloak rate limit": {
+			cmd: ServeCmd{EndpointLookup: "db", KeycloakRateBurst: 5},
+			expect: []string{
+				"--keycloak-rate-limit/KEYCLOAK_RATE_LIMIT"},
+		},
+		"malformed metrics port": {
+			cmd: ServeCmd{
+				EndpointLookup:    "db",
+				KeycloakRateLimit: 10,
+				MetricsPort:       "9948",
+			},
+			expect: []string{"--metrics-port/METRICS_PORT"},
+		},
+		"metrics disabled": {
+			cmd: ServeCmd{
+				EndpointLookup:    "db",
+				KeycloakRateLimit: 10,
+				MetricsDisabled:   true,
+			},
+		},
+		"multiple": {
+			cmd: ServeCmd{EndpointLookup: "nats"},
+			expect: []string{
+				"--endpoint-lookup/ENDPOINT_LOOKUP nats",
+				"--keycloak-rate-limit/KEYCLOAK_RATE_LIMIT",
+			},
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			// fill in the defaults which are not under test
+			if tc.cmd.MetricsPort == "" && !tc.cmd.MetricsDisabled {
+				tc.cmd.MetricsPort = ":9948"
+			}
+			errs := tc.cmd.flagErrors()
+			assert.Equal(tt, len(tc.expect), len(errs), name)
+			for i := range errs {
+				assert.True(tt, strings.HasPrefix(errs[i], tc.expect[i]), name)
+			}
+		})
+	}
+}
@@ -0,0 +1,78 @@
+// Package audit implements audit event emission for SSH sessions, so that
+// integrators can forward events to external systems.
+package audit
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// EventType identifies the kind of audit Event.
+type EventType string
+
+const (
+	// SessionStart is emitted when a command or logs session starts.
+	SessionStart EventType = "sessionStart"
+	// SessionEnd is emitted when a command or logs session ends.
+	SessionEnd EventType = "sessionEnd"
+	// AuthDenied is emitted when a public key is denied access.
+	AuthDenied EventType = "authDenied"
+)
+
+// Event is an audit event.
+type Event struct {
+	Type            EventType `json:"type"`
+	Time            time.Time `json:"time"`
+	SessionID       string    `json:"sessionID"`
+	SessionTag      string    `json:"sessionTag,omitempty"`
+	Namespace       string    `json:"namespace"`
+	SSHFingerprint  string    `json:"sshFingerprint"`
+	EnvironmentID   int       `json:"environmentID,omitempty"`
+	EnvironmentName string    `json:"environmentName,omitempty"`
+	ProjectID       int       `json:"projectID,omitempty"`
+	ProjectName     string    `json:"projectName,omitempty"`
+	Deployment      string    `json:"deployment,omitempty"`
+	Container       string    `json:"container,omitempty"`
+	Job             string    `json:"job,omitempty"`
+	Command         []string  `json:"command,omitempty"`
+	Logs            bool      `json:"logs,omitempty"`
+	Debug           bool      `json:"debug,omitempty"`
+	Reason          string    `json:"reason,omitempty"`
+}
+
+// LogValue implements the slog.LogValuer interface.
+func (e Event) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.String("type", string(e.Type)),
+		slog.Time("time", e.Time),
+		slog.String("sessionID", e.SessionID),
+		slog.String("sessionTag", e.SessionTag),
+		slog.String("namespace", e.Namespace),
+		slog.String("sshFingerprint", e.SSHFingerprint),
+		slog.Int("environmentID", e.EnvironmentID),
+		slog.String("environmentName", e.EnvironmentName),
+		slog.Int("projectID", e.ProjectID),
+		slog.String("projectName", e.ProjectName),
+		slog.String("deployment", e.Deployment),
+		slog.String("container", e.Container),
+		slog.String("job", e.Job),
+		slog.Any("command", e.Command),
+		slog.Bool("logs", e.Logs),
+		slog.Bool("debug", e.Debug),
+		slog.String("reason", e.Reason),
+	)
+}
+
+// Sink receives audit events.
+type Sink interface {
+	Emit(context.Context, Event) error
+}
+
+// Discard is a Sink which discards all events.
+type Discard struct{}
+
+// Emit implements the Sink interface.
+func (Discard) Emit(context.Context, Event) error {
+	return nil
+}
@@ -0,0 +1,104 @@
+package audit_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/assert/v2"
+	"github.com/uselagoon/ssh-portal/internal/audit"
+)
+
+var testEvent = audit.Event{
+	Type:            audit.SessionStart,
+	Time:            time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+	SessionID:       "abc123",
+	Namespace:       "project-main",
+	SSHFingerprint:  "SHA256:foo",
+	EnvironmentID:   1,
+	EnvironmentName: "main",
+	ProjectID:       2,
+	ProjectName:     "project",
+	Deployment:      "cli",
+	Command:         []string{"sh"},
+}
+
+type fakePublisher struct {
+	subject string
+	data    []byte
+}
+
+func (p *fakePublisher) Publish(subject string, data []byte) error {
+	p.subject = subject
+	p.data = data
+	return nil
+}
+
+// blockingSink records events, blocking each Emit until release is closed.
+type blockingSink struct {
+	release chan struct{}
+	events  []audit.Event
+}
+
+func (s *blockingSink) Emit(_ context.Context, e audit.Event) error {
+	<-s.release
+	s.events = append(s.events, e)
+	return nil
+}
+
+func TestSlogSink(t *testing.T) {
+	var buf bytes.Buffer
+	sink := audit.NewSlogSink(slog.New(slog.NewJSONHandler(&buf, nil)))
+	assert.NoError(t, sink.Emit(context.Background(), testEvent))
+	var line struct {
+		Msg   string
+		Event map[string]any
+	}
+	assert.NoError(t, json.Unmarshal(buf.Bytes(), &line))
+	assert.Equal(t, "audit event", line.Msg)
+	assert.Equal(t, "sessionStart", line.Event["type"])
+	assert.Equal(t, "abc123", line.Event["sessionID"])
+	assert.Equal(t, "project-main", line.Event["namespace"])
+}
+
+func TestNATSSink(t *testing.T) {
+	var pub fakePublisher
+	sink := audit.NewNATSSink(&pub, "lagoon.sshportal.audit")
+	assert.NoError(t, sink.Emit(context.Background(), testEvent))
+	assert.Equal(t, "lagoon.sshportal.audit", pub.subject)
+	var e audit.Event
+	assert.NoError(t, json.Unmarshal(pub.data, &e))
+	assert.Equal(t, testEvent, e)
+}
+
+func TestQueue(t *testing.T) {
+	var testCases = map[string]struct {
+		size   uint
+		emit   int
+		expect int
+	}{
+		"within bounds": {size: 4, emit: 3, expect: 3},
+		"drop overflow": {size: 2, emit: 5, expect: 2},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			sink := blockingSink{release: make(chan struct{})}
+			q := audit.NewQueue(slog.Default(), &sink, tc.size)
+			ctx, cancel := context.WithCancel(context.Background())
+			// emit before starting Run so that the queue fills up
+			start := time.Now()
+			for range tc.emit {
+				assert.NoError(tt, q.Emit(ctx, testEvent), name)
+			}
+			assert.True(tt, time.Since(start) < time.Second, name)
+			// cancel the context and check queued events are still forwarded
+			cancel()
+			close(sink.release)
+			q.Run(ctx)
+			assert.Equal(tt, tc.expect, len(sink.events), name)
+		})
+	}
+}
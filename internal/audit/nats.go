@@ -0,0 +1,39 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+// Publisher publishes messages to a NATS subject.
+type Publisher interface {
+	Publish(string, []byte) error
+}
+
+// NATSSink is a Sink which publishes events as JSON to a NATS subject.
+type NATSSink struct {
+	pub     Publisher
+	subject string
+}
+
+// NewNATSSink returns a NATSSink which publishes events to the given subject
+// via pub.
+func NewNATSSink(pub Publisher, subject string) *NATSSink {
+	return &NATSSink{
+		pub:     pub,
+		subject: subject,
+	}
+}
+
+// Emit implements the Sink interface.
+func (s *NATSSink) Emit(_ context.Context, e Event) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("couldn't marshal audit event: %v", err)
+	}
+	if err = s.pub.Publish(s.subject, data); err != nil {
+		return fmt.Errorf("couldn't publish audit event: %v", err)
+	}
+	return nil
+}
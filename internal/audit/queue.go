@@ -0,0 +1,81 @@
+package audit
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	eventsDroppedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sshportal_audit_events_dropped_total",
+		Help: "The total number of audit events dropped due to a full queue",
+	})
+)
+
+// Collectors returns the metrics exported by the audit package.
+func Collectors() []prometheus.Collector {
+	return []prometheus.Collector{eventsDroppedTotal}
+}
+
+// Queue is a Sink which buffers events in a bounded queue, and forwards them
+// to another Sink in the background. Emit never blocks: if the queue is full
+// the event is dropped.
+type Queue struct {
+	log    *slog.Logger
+	sink   Sink
+	events chan Event
+}
+
+// NewQueue returns a Queue which forwards events to sink, buffering up to
+// size events.
+func NewQueue(log *slog.Logger, sink Sink, size uint) *Queue {
+	return &Queue{
+		log:    log,
+		sink:   sink,
+		events: make(chan Event, size),
+	}
+}
+
+// Emit implements the Sink interface. It returns immediately, and never
+// returns an error. Events which don't fit in the queue are dropped.
+func (q *Queue) Emit(_ context.Context, e Event) error {
+	select {
+	case q.events <- e:
+	default:
+		eventsDroppedTotal.Inc()
+	}
+	return nil
+}
+
+// forward emits e to the wrapped Sink, logging any error.
+func (q *Queue) forward(ctx context.Context, e Event) {
+	if err := q.sink.Emit(ctx, e); err != nil {
+		q.log.Warn("couldn't emit audit event",
+			slog.Any("event", e),
+			slog.Any("error", err))
+	}
+}
+
+// Run forwards queued events to the wrapped Sink until ctx is cancelled. Any
+// events remaining in the queue at that point are forwarded before Run
+// returns.
+func (q *Queue) Run(ctx context.Context) {
+	for {
+		select {
+		case e := <-q.events:
+			q.forward(ctx, e)
+		case <-ctx.Done():
+			for {
+				select {
+				case e := <-q.events:
+					q.forward(context.WithoutCancel(ctx), e)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,22 @@
+package audit
+
+import (
+	"context"
+	"log/slog"
+)
+
+// SlogSink is a Sink which writes events to a structured logger.
+type SlogSink struct {
+	log *slog.Logger
+}
+
+// NewSlogSink returns a SlogSink which writes events to log.
+func NewSlogSink(log *slog.Logger) *SlogSink {
+	return &SlogSink{log: log}
+}
+
+// Emit implements the Sink interface.
+func (s *SlogSink) Emit(ctx context.Context, e Event) error {
+	s.log.LogAttrs(ctx, slog.LevelInfo, "audit event", slog.Any("event", e))
+	return nil
+}
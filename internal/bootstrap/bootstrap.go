@@ -0,0 +1,254 @@
+// Package bootstrap constructs the Lagoon API DB client, Keycloak clients, and
+// RBAC permission engine shared by the ssh-portal-api and ssh-token services,
+// so that both services are configured in the same way.
+package bootstrap
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/uselagoon/ssh-portal/internal/keycloak"
+	"github.com/uselagoon/ssh-portal/internal/lagoon"
+	"github.com/uselagoon/ssh-portal/internal/lagoondb"
+	"github.com/uselagoon/ssh-portal/internal/rbac"
+)
+
+// DBConfig is the configuration of the Lagoon API DB client.
+type DBConfig struct {
+	// Address is the host[:port] of the database server.
+	Address  string
+	Database string
+	Username string
+	Password string
+}
+
+// Validate returns an error if the configuration is incomplete.
+func (c DBConfig) Validate() error {
+	switch {
+	case c.Address == "":
+		return errors.New("missing Lagoon API DB address")
+	case c.Database == "":
+		return errors.New("missing Lagoon API DB database name")
+	case c.Username == "":
+		return errors.New("missing Lagoon API DB username")
+	}
+	return nil
+}
+
+// dsn returns the data source name of the database.
+func (c DBConfig) dsn() string {
+	dbConf := mysql.NewConfig()
+	dbConf.Addr = c.Address
+	dbConf.DBName = c.Database
+	dbConf.Net = "tcp"
+	dbConf.Passwd = c.Password
+	dbConf.User = c.Username
+	return dbConf.FormatDSN()
+}
+
+// NewLagoonDB validates the configuration and returns a connected Lagoon API
+// DB client.
+func NewLagoonDB(ctx context.Context, c DBConfig) (*lagoondb.Client, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	ldb, err := lagoondb.NewClient(ctx, c.dsn())
+	if err != nil {
+		return nil, fmt.Errorf("couldn't init lagoondb client: %v", err)
+	}
+	return ldb, nil
+}
+
+// KeycloakConfig is the configuration shared by all the Keycloak clients of a
+// service.
+type KeycloakConfig struct {
+	BaseURL string
+	// RateLimit is the number of requests per second allowed to the Keycloak
+	// API, shared by all clients.
+	RateLimit int
+	// RateBurst is the burst allowed by the rate limit. Zero means the burst
+	// is equal to the rate limit.
+	RateBurst int
+	// PageSize is the number of groups requested per page. Zero means the
+	// keycloak package default.
+	PageSize int
+	// MaxGroupDepth is the maximum depth of the group hierarchy. Zero means
+	// the keycloak package default.
+	MaxGroupDepth int
+	// InsecureTLS skips verification of the Keycloak TLS certificate.
+	InsecureTLS bool
+	// CACert is the path of a PEM bundle of certificate authorities used to
+	// verify the Keycloak TLS certificate instead of the system trust store.
+	CACert string
+}
+
+// Validate returns an error if the configuration is invalid.
+func (c KeycloakConfig) Validate() error {
+	u, err := url.Parse(c.BaseURL)
+	if err != nil {
+		return fmt.Errorf("couldn't parse keycloak base URL: %v", err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid keycloak base URL %q: must be an absolute "+
+			"http or https URL", c.BaseURL)
+	}
+	switch {
+	case c.RateLimit < 1:
+		return errors.New("keycloak rate limit must be at least one")
+	case c.RateBurst < 0:
+		return errors.New("keycloak rate burst must not be negative")
+	case c.PageSize < 0:
+		return errors.New("keycloak page size must not be negative")
+	case c.MaxGroupDepth < 0:
+		return errors.New("keycloak maximum group depth must not be negative")
+	case c.InsecureTLS && c.CACert != "":
+		return errors.New("keycloak CA certificate has no effect with " +
+			"insecure TLS")
+	}
+	return nil
+}
+
+// loadCACert returns a pool containing the certificates in the PEM bundle at
+// the given path.
+func loadCACert(path string) (*x509.CertPool, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read keycloak CA certificate: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(buf) {
+		return nil, fmt.Errorf("no certificates found in keycloak CA "+
+			"certificate %s", path)
+	}
+	return pool, nil
+}
+
+// Keycloak constructs Keycloak clients which share a rate limiter and a set
+// of metrics.
+type Keycloak struct {
+	log     *slog.Logger
+	conf    KeycloakConfig
+	limiter *keycloak.Limiter
+	metrics *keycloak.Metrics
+	rootCAs *x509.CertPool
+}
+
+// NewKeycloak validates the configuration and returns a Keycloak which
+// registers the shared rate limiter and client metrics in reg.
+func NewKeycloak(
+	log *slog.Logger,
+	reg prometheus.Registerer,
+	c KeycloakConfig,
+) (*Keycloak, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	var rootCAs *x509.CertPool
+	if c.CACert != "" {
+		var err error
+		if rootCAs, err = loadCACert(c.CACert); err != nil {
+			return nil, err
+		}
+	}
+	limiter := keycloak.NewLimiter(log, reg, float64(c.RateLimit), c.RateBurst)
+	log.Info("configured keycloak API rate limit",
+		slog.Float64("limit", limiter.Limit()),
+		slog.Int("burst", limiter.Burst()))
+	return &Keycloak{
+		log:     log,
+		conf:    c,
+		limiter: limiter,
+		metrics: keycloak.NewMetrics(reg),
+		rootCAs: rootCAs,
+	}, nil
+}
+
+// NewClient returns a Keycloak client using the given OAuth2 client
+// credentials.
+func (k *Keycloak) NewClient(
+	ctx context.Context,
+	clientID,
+	clientSecret string,
+) (*keycloak.Client, error) {
+	opts := []keycloak.Option{
+		keycloak.ClientMetrics(k.metrics),
+		keycloak.PageSize(k.conf.PageSize),
+		keycloak.MaxGroupDepth(k.conf.MaxGroupDepth),
+	}
+	if k.conf.InsecureTLS {
+		k.log.Warn("keycloak TLS certificate verification is disabled",
+			slog.String("clientID", clientID))
+		opts = append(opts, keycloak.InsecureTLS())
+	}
+	if k.rootCAs != nil {
+		opts = append(opts, keycloak.RootCAs(k.rootCAs))
+	}
+	return keycloak.NewClient(ctx, k.log, k.conf.BaseURL, clientID,
+		clientSecret, k.limiter, opts...)
+}
+
+// RBACConfig is the configuration of the RBAC permission engine.
+type RBACConfig struct {
+	BlockDeveloperSSH     bool
+	DisableAncestorGroups bool
+	// LogsOnlyRoles are the names of the roles granted logs-only SSH access.
+	LogsOnlyRoles []string
+	// ExecOnlyRoles are the names of the roles granted exec-only SSH access.
+	ExecOnlyRoles []string
+}
+
+// Options validates the configuration and returns the equivalent
+// rbac.Options.
+func (c RBACConfig) Options() ([]rbac.Option, error) {
+	var opts []rbac.Option
+	if c.BlockDeveloperSSH {
+		opts = append(opts, rbac.BlockDeveloperSSH())
+	}
+	if c.DisableAncestorGroups {
+		opts = append(opts, rbac.DisableAncestorGroups())
+	}
+	if len(c.LogsOnlyRoles) > 0 {
+		var roles []lagoon.UserRole
+		for _, name := range c.LogsOnlyRoles {
+			role, err := lagoon.UserRoleFromString(name)
+			if err != nil {
+				return nil, fmt.Errorf("invalid logs-only role: %s", name)
+			}
+			roles = append(roles, role)
+		}
+		opts = append(opts, rbac.LogsOnlySSH(roles...))
+	}
+	if len(c.ExecOnlyRoles) > 0 {
+		var roles []lagoon.UserRole
+		for _, name := range c.ExecOnlyRoles {
+			role, err := lagoon.UserRoleFromString(name)
+			if err != nil {
+				return nil, fmt.Errorf("invalid exec-only role: %s", name)
+			}
+			roles = append(roles, role)
+		}
+		opts = append(opts, rbac.ExecOnlySSH(roles...))
+	}
+	return opts, nil
+}
+
+// NewPermission validates the configuration and returns an RBAC permission
+// engine using the given backends.
+func NewPermission(
+	k rbac.KeycloakService,
+	ldb rbac.LagoonDBService,
+	c RBACConfig,
+) (*rbac.Permission, error) {
+	opts, err := c.Options()
+	if err != nil {
+		return nil, err
+	}
+	return rbac.NewPermission(k, ldb, opts...), nil
+}
@@ -0,0 +1,280 @@
+package bootstrap_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"log/slog"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/assert/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/uselagoon/ssh-portal/internal/bootstrap"
+)
+
+func TestDBConfigValidate(t *testing.T) {
+	var testCases = map[string]struct {
+		conf        bootstrap.DBConfig
+		expectError string
+	}{
+		"valid": {
+			conf: bootstrap.DBConfig{
+				Address:  "mariadb:3306",
+				Database: "infrastructure",
+				Username: "api",
+			},
+		},
+		"missing address": {
+			conf: bootstrap.DBConfig{
+				Database: "infrastructure",
+				Username: "api",
+			},
+			expectError: "missing Lagoon API DB address",
+		},
+		"missing database": {
+			conf: bootstrap.DBConfig{
+				Address:  "mariadb:3306",
+				Username: "api",
+			},
+			expectError: "missing Lagoon API DB database name",
+		},
+		"missing username": {
+			conf: bootstrap.DBConfig{
+				Address:  "mariadb:3306",
+				Database: "infrastructure",
+			},
+			expectError: "missing Lagoon API DB username",
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			err := tc.conf.Validate()
+			if tc.expectError != "" {
+				assert.EqualError(tt, err, tc.expectError, name)
+				// the constructor fails before connecting to the database
+				_, err = bootstrap.NewLagoonDB(context.Background(), tc.conf)
+				assert.EqualError(tt, err, tc.expectError, name)
+			} else {
+				assert.NoError(tt, err, name)
+			}
+		})
+	}
+}
+
+func TestKeycloakConfigValidate(t *testing.T) {
+	var testCases = map[string]struct {
+		conf        bootstrap.KeycloakConfig
+		expectError bool
+	}{
+		"valid": {
+			conf: bootstrap.KeycloakConfig{
+				BaseURL:   "https://keycloak.example.com",
+				RateLimit: 10,
+			},
+		},
+		"valid with options": {
+			conf: bootstrap.KeycloakConfig{
+				BaseURL:     "http://keycloak:8080/",
+				RateLimit:   10,
+				RateBurst:   20,
+				PageSize:    100,
+				InsecureTLS: true,
+			},
+		},
+		"missing base URL": {
+			conf:        bootstrap.KeycloakConfig{RateLimit: 10},
+			expectError: true,
+		},
+		"relative base URL": {
+			conf: bootstrap.KeycloakConfig{
+				BaseURL:   "keycloak.example.com",
+				RateLimit: 10,
+			},
+			expectError: true,
+		},
+		"unsupported scheme": {
+			conf: bootstrap.KeycloakConfig{
+				BaseURL:   "ftp://keycloak.example.com",
+				RateLimit: 10,
+			},
+			expectError: true,
+		},
+		"zero rate limit": {
+			conf: bootstrap.KeycloakConfig{
+				BaseURL: "https://keycloak.example.com",
+			},
+			expectError: true,
+		},
+		"negative burst": {
+			conf: bootstrap.KeycloakConfig{
+				BaseURL:   "https://keycloak.example.com",
+				RateLimit: 10,
+				RateBurst: -1,
+			},
+			expectError: true,
+		},
+		"insecure TLS with CA certificate": {
+			conf: bootstrap.KeycloakConfig{
+				BaseURL:     "https://keycloak.example.com",
+				RateLimit:   10,
+				InsecureTLS: true,
+				CACert:      "/etc/ssl/keycloak-ca.pem",
+			},
+			expectError: true,
+		},
+		"negative maximum group depth": {
+			conf: bootstrap.KeycloakConfig{
+				BaseURL:       "https://keycloak.example.com",
+				RateLimit:     10,
+				MaxGroupDepth: -1,
+			},
+			expectError: true,
+		},
+		"negative page size": {
+			conf: bootstrap.KeycloakConfig{
+				BaseURL:   "https://keycloak.example.com",
+				RateLimit: 10,
+				PageSize:  -1,
+			},
+			expectError: true,
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			log := slog.New(slog.NewJSONHandler(os.Stderr, nil))
+			reg := prometheus.NewRegistry()
+			k, err := bootstrap.NewKeycloak(log, reg, tc.conf)
+			assert.Equal(tt, tc.conf.Validate(), err, name)
+			if tc.expectError {
+				assert.Error(tt, err, name)
+				assert.Zero(tt, k, name)
+			} else {
+				assert.NoError(tt, err, name)
+				assert.NotZero(tt, k, name)
+			}
+		})
+	}
+}
+
+func TestRBACConfigOptions(t *testing.T) {
+	var testCases = map[string]struct {
+		conf        bootstrap.RBACConfig
+		expectOpts  int
+		expectError bool
+	}{
+		"defaults": {},
+		"all options": {
+			conf: bootstrap.RBACConfig{
+				BlockDeveloperSSH:     true,
+				DisableAncestorGroups: true,
+				LogsOnlyRoles:         []string{"guest", " reporter"},
+				ExecOnlyRoles:         []string{"developer"},
+			},
+			expectOpts: 4,
+		},
+		"invalid logs-only role": {
+			conf: bootstrap.RBACConfig{
+				LogsOnlyRoles: []string{"guest", "janitor"},
+			},
+			expectError: true,
+		},
+		"invalid exec-only role": {
+			conf: bootstrap.RBACConfig{
+				ExecOnlyRoles: []string{"janitor"},
+			},
+			expectError: true,
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			opts, err := tc.conf.Options()
+			_, permErr := bootstrap.NewPermission(nil, nil, tc.conf)
+			if tc.expectError {
+				assert.Error(tt, err, name)
+				assert.Error(tt, permErr, name)
+			} else {
+				assert.NoError(tt, err, name)
+				assert.NoError(tt, permErr, name)
+				assert.Equal(tt, tc.expectOpts, len(opts), name)
+			}
+		})
+	}
+}
+
+// writeCACert writes a self-signed CA certificate in PEM format to a file in
+// a temporary directory, and returns its path.
+func writeCACert(t *testing.T) string {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &tmpl, &tmpl,
+		&key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "ca.pem")
+	err = os.WriteFile(path,
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestKeycloakCACert(t *testing.T) {
+	notPEM := filepath.Join(t.TempDir(), "not-a-cert.pem")
+	err := os.WriteFile(notPEM, []byte("not a certificate"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var testCases = map[string]struct {
+		path        string
+		expectError string
+	}{
+		"valid": {
+			path: writeCACert(t),
+		},
+		"missing file": {
+			path:        filepath.Join(t.TempDir(), "missing.pem"),
+			expectError: "couldn't read keycloak CA certificate",
+		},
+		"not PEM": {
+			path:        notPEM,
+			expectError: "no certificates found",
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			log := slog.New(slog.NewJSONHandler(os.Stderr, nil))
+			_, err := bootstrap.NewKeycloak(log, prometheus.NewRegistry(),
+				bootstrap.KeycloakConfig{
+					BaseURL:   "https://keycloak.example.com",
+					RateLimit: 10,
+					CACert:    tc.path,
+				})
+			if tc.expectError != "" {
+				assert.Error(tt, err, name)
+				assert.Contains(tt, err.Error(), tc.expectError, name)
+			} else {
+				assert.NoError(tt, err, name)
+			}
+		})
+	}
+}
@@ -0,0 +1,190 @@
+// Package breaker implements a circuit breaker which stops calls to a failing
+// backend for a cool-down period, so that callers fail fast instead of waiting
+// on requests which are likely to fail.
+package breaker
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrOpen is returned by Allow when the breaker is open.
+var ErrOpen = errors.New("circuit breaker open")
+
+// State is the state of a Breaker.
+type State int
+
+const (
+	// Closed breakers allow all calls.
+	Closed State = iota
+	// HalfOpen breakers allow a single probe call to test whether the
+	// backend has recovered.
+	HalfOpen
+	// Open breakers reject all calls until the cool-down period has elapsed.
+	Open
+)
+
+// String implements fmt.Stringer.
+func (s State) String() string {
+	switch s {
+	case Closed:
+		return "closed"
+	case HalfOpen:
+		return "half-open"
+	case Open:
+		return "open"
+	default:
+		return fmt.Sprintf("State(%d)", int(s))
+	}
+}
+
+// Option performs optional configuration on Breaker objects during
+// initialization, and is passed to New().
+type Option func(*Breaker)
+
+// Clock sets the function used to get the current time. It is intended for
+// use in tests.
+func Clock(now func() time.Time) Option {
+	return func(b *Breaker) {
+		b.now = now
+	}
+}
+
+// OnStateChange sets a function which is called with the new state each time
+// the breaker changes state. The function is called with the breaker locked,
+// so it must not call methods of the breaker.
+func OnStateChange(fn func(State)) Option {
+	return func(b *Breaker) {
+		b.onStateChange = fn
+	}
+}
+
+// Breaker is a circuit breaker. It is closed initially, and opens after the
+// given number of consecutive failed calls. Once the cool-down period has
+// elapsed it becomes half-open, and allows a single probe call. If the probe
+// succeeds the breaker closes, otherwise it opens again.
+//
+// A Breaker with a zero threshold is disabled, and allows all calls.
+type Breaker struct {
+	threshold     int
+	coolDown      time.Duration
+	now           func() time.Time
+	onStateChange func(State)
+
+	mu       sync.Mutex
+	state    State
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+// New returns a Breaker which opens after threshold consecutive failures,
+// and stays open for the given cool-down period.
+func New(
+	threshold int,
+	coolDown time.Duration,
+	opts ...Option,
+) (*Breaker, error) {
+	if threshold < 0 {
+		return nil, fmt.Errorf("invalid threshold: %d", threshold)
+	}
+	if threshold > 0 && coolDown <= 0 {
+		return nil, fmt.Errorf("invalid cool-down: %v", coolDown)
+	}
+	b := Breaker{
+		threshold: threshold,
+		coolDown:  coolDown,
+		now:       time.Now,
+	}
+	for _, opt := range opts {
+		opt(&b)
+	}
+	return &b, nil
+}
+
+// setState sets the state of the breaker. It must be called with the breaker
+// locked.
+func (b *Breaker) setState(state State) {
+	if b.state == state {
+		return
+	}
+	b.state = state
+	if b.onStateChange != nil {
+		b.onStateChange(state)
+	}
+}
+
+// Allow returns nil if a call to the backend may proceed, and ErrOpen
+// otherwise. Each call which is allowed must be followed by a call to Done
+// reporting its result.
+func (b *Breaker) Allow() error {
+	if b.threshold == 0 {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case Open:
+		if b.now().Before(b.openedAt.Add(b.coolDown)) {
+			return ErrOpen
+		}
+		b.setState(HalfOpen)
+		b.probing = true
+		return nil
+	case HalfOpen:
+		if b.probing {
+			return ErrOpen
+		}
+		b.probing = true
+		return nil
+	default:
+		return nil
+	}
+}
+
+// Done reports the result of a call which was allowed by Allow.
+func (b *Breaker) Done(success bool) {
+	if b.threshold == 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case HalfOpen:
+		b.probing = false
+		if success {
+			b.failures = 0
+			b.setState(Closed)
+			return
+		}
+		b.openedAt = b.now()
+		b.setState(Open)
+	case Closed:
+		if success {
+			b.failures = 0
+			return
+		}
+		b.failures++
+		if b.failures >= b.threshold {
+			b.openedAt = b.now()
+			b.setState(Open)
+		}
+	}
+}
+
+// State returns the current state of the breaker. An open breaker whose
+// cool-down period has elapsed is reported as half-open, since the next call
+// will be allowed as a probe.
+func (b *Breaker) State() State {
+	if b.threshold == 0 {
+		return Closed
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == Open && !b.now().Before(b.openedAt.Add(b.coolDown)) {
+		return HalfOpen
+	}
+	return b.state
+}
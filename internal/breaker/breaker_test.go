@@ -0,0 +1,192 @@
+package breaker_test
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/assert/v2"
+	"github.com/uselagoon/ssh-portal/internal/breaker"
+)
+
+// step is a call to the breaker under test.
+type step struct {
+	// elapsed is the fake time which passes before the call
+	elapsed time.Duration
+	// expectAllow is the expected result of Allow
+	expectAllow bool
+	// success is the result passed to Done if the call is allowed
+	success bool
+	// expectState is the expected state after the call
+	expectState breaker.State
+}
+
+func TestBreaker(t *testing.T) {
+	var testCases = map[string]struct {
+		threshold     int
+		steps         []step
+		expectChanges []breaker.State
+	}{
+		"disabled": {
+			steps: []step{
+				{expectAllow: true, expectState: breaker.Closed},
+				{expectAllow: true, expectState: breaker.Closed},
+				{expectAllow: true, expectState: breaker.Closed},
+			},
+		},
+		"opens at threshold": {
+			threshold: 2,
+			steps: []step{
+				{expectAllow: true, expectState: breaker.Closed},
+				{expectAllow: true, expectState: breaker.Open},
+				{expectAllow: false, expectState: breaker.Open},
+			},
+			expectChanges: []breaker.State{breaker.Open},
+		},
+		"success resets failures": {
+			threshold: 2,
+			steps: []step{
+				{expectAllow: true, expectState: breaker.Closed},
+				{expectAllow: true, success: true, expectState: breaker.Closed},
+				{expectAllow: true, expectState: breaker.Closed},
+				{expectAllow: true, expectState: breaker.Open},
+			},
+			expectChanges: []breaker.State{breaker.Open},
+		},
+		"probe success closes": {
+			threshold: 1,
+			steps: []step{
+				{expectAllow: true, expectState: breaker.Open},
+				{elapsed: 30 * time.Second, expectAllow: false,
+					expectState: breaker.Open},
+				{elapsed: 30 * time.Second, expectAllow: true, success: true,
+					expectState: breaker.Closed},
+				{expectAllow: true, success: true, expectState: breaker.Closed},
+			},
+			expectChanges: []breaker.State{
+				breaker.Open, breaker.HalfOpen, breaker.Closed},
+		},
+		"probe failure reopens": {
+			threshold: 1,
+			steps: []step{
+				{expectAllow: true, expectState: breaker.Open},
+				{elapsed: time.Minute, expectAllow: true,
+					expectState: breaker.Open},
+				{elapsed: 30 * time.Second, expectAllow: false,
+					expectState: breaker.Open},
+				{elapsed: 30 * time.Second, expectAllow: true, success: true,
+					expectState: breaker.Closed},
+			},
+			expectChanges: []breaker.State{breaker.Open, breaker.HalfOpen,
+				breaker.Open, breaker.HalfOpen, breaker.Closed},
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			now := time.Unix(0, 0)
+			var changes []breaker.State
+			b, err := breaker.New(tc.threshold, time.Minute,
+				breaker.Clock(func() time.Time { return now }),
+				breaker.OnStateChange(func(s breaker.State) {
+					changes = append(changes, s)
+				}))
+			assert.NoError(tt, err, name)
+			for i, s := range tc.steps {
+				now = now.Add(s.elapsed)
+				err := b.Allow()
+				assert.Equal(tt, s.expectAllow, err == nil, "%s: step %d", name, i)
+				if err != nil {
+					assert.IsError(tt, err, breaker.ErrOpen, name)
+				} else {
+					b.Done(s.success)
+				}
+				assert.Equal(tt, s.expectState, b.State(), "%s: step %d", name, i)
+			}
+			assert.Equal(tt, tc.expectChanges, changes, name)
+		})
+	}
+}
+
+func TestBreakerHalfOpen(t *testing.T) {
+	now := time.Unix(0, 0)
+	b, err := breaker.New(1, time.Minute,
+		breaker.Clock(func() time.Time { return now }))
+	assert.NoError(t, err)
+	assert.NoError(t, b.Allow())
+	b.Done(false)
+	assert.Equal(t, breaker.Open, b.State())
+	// once the cool-down has elapsed the breaker reports half-open
+	now = now.Add(time.Minute)
+	assert.Equal(t, breaker.HalfOpen, b.State())
+	// only a single probe is allowed at a time
+	assert.NoError(t, b.Allow())
+	assert.IsError(t, b.Allow(), breaker.ErrOpen)
+	assert.Equal(t, breaker.HalfOpen, b.State())
+	b.Done(true)
+	assert.Equal(t, breaker.Closed, b.State())
+	assert.NoError(t, b.Allow())
+}
+
+func TestBreakerLateResult(t *testing.T) {
+	b, err := breaker.New(1, time.Minute)
+	assert.NoError(t, err)
+	// two calls are allowed while closed
+	assert.NoError(t, b.Allow())
+	assert.NoError(t, b.Allow())
+	b.Done(false)
+	assert.Equal(t, breaker.Open, b.State())
+	// the result of the second call doesn't close the open breaker
+	b.Done(true)
+	assert.Equal(t, breaker.Open, b.State())
+}
+
+func TestBreakerConcurrent(t *testing.T) {
+	b, err := breaker.New(5, time.Minute)
+	assert.NoError(t, err)
+	var wg sync.WaitGroup
+	for range 50 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if b.Allow() == nil {
+				b.Done(false)
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, breaker.Open, b.State())
+}
+
+func TestNewInvalid(t *testing.T) {
+	var testCases = map[string]struct {
+		threshold int
+		coolDown  time.Duration
+	}{
+		"negative threshold": {threshold: -1, coolDown: time.Minute},
+		"zero cool-down":     {threshold: 1},
+		"negative cool-down": {threshold: 1, coolDown: -time.Second},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			_, err := breaker.New(tc.threshold, tc.coolDown)
+			assert.Error(tt, err, name)
+		})
+	}
+}
+
+func TestStateString(t *testing.T) {
+	var testCases = map[string]struct {
+		input  breaker.State
+		expect string
+	}{
+		"closed":    {input: breaker.Closed, expect: "closed"},
+		"half-open": {input: breaker.HalfOpen, expect: "half-open"},
+		"open":      {input: breaker.Open, expect: "open"},
+		"unknown":   {input: breaker.State(9), expect: "State(9)"},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			assert.Equal(tt, tc.expect, tc.input.String(), name)
+		})
+	}
+}
@@ -0,0 +1,96 @@
+package bus
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"github.com/nats-io/nats.go"
+)
+
+// ReasonUnknownEnvironment indicates that the environment in an SSH endpoint
+// query has no SSH endpoint.
+const ReasonUnknownEnvironment = "unknown-environment"
+
+// ErrUnknownEnvironment is returned by SSHEndpointByEnvironmentID if the
+// environment has no SSH endpoint.
+var ErrUnknownEnvironment = errors.New("unknown environment")
+
+// SSHEndpointQuery defines the structure of an SSH endpoint query. It asks
+// for the SSH endpoint of the ssh-portal serving the environment with the
+// given ID.
+type SSHEndpointQuery struct {
+	EnvironmentID int
+}
+
+// LogValue implements the slog.LogValuer interface.
+func (q SSHEndpointQuery) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.Int("environmentID", q.EnvironmentID),
+	)
+}
+
+// SSHEndpointResponse defines the structure of an SSH endpoint query
+// response. If the endpoint couldn't be resolved, Host and Port are empty and
+// Reason explains why.
+type SSHEndpointResponse struct {
+	Host   string `json:",omitempty"`
+	Port   string `json:",omitempty"`
+	Reason string `json:",omitempty"`
+}
+
+// requester makes NATS requests. It is implemented by *nats.Conn.
+type requester interface {
+	RequestWithContext(ctx context.Context, subject string,
+		data []byte) (*nats.Msg, error)
+}
+
+// sshEndpointRequest queries the SSH endpoint of the given environment using
+// the given requester.
+func sshEndpointRequest(
+	ctx context.Context,
+	r requester,
+	environmentID int,
+) (string, string, error) {
+	// construct ssh endpoint query
+	queryData, err := json.Marshal(SSHEndpointQuery{
+		EnvironmentID: environmentID,
+	})
+	if err != nil {
+		return "", "", fmt.Errorf("couldn't marshal NATS request: %v", err)
+	}
+	// send query
+	ctx, cancel := context.WithTimeout(ctx, natsTimeout)
+	defer cancel()
+	msg, err := r.RequestWithContext(ctx, SubjectSSHEndpointQuery, queryData)
+	if err != nil {
+		return "", "", fmt.Errorf("couldn't make NATS request: %v", err)
+	}
+	// handle response
+	var response SSHEndpointResponse
+	if err = json.Unmarshal(msg.Data, &response); err != nil {
+		return "", "", fmt.Errorf("couldn't unmarshal response: %v", err)
+	}
+	switch {
+	case response.Reason == ReasonUnknownEnvironment:
+		return "", "", ErrUnknownEnvironment
+	case response.Reason != "":
+		return "", "", fmt.Errorf("SSH endpoint not resolved: %s",
+			response.Reason)
+	case response.Host == "" || response.Port == "":
+		return "", "", errors.New("empty SSH endpoint in response")
+	}
+	return response.Host, response.Port, nil
+}
+
+// SSHEndpointByEnvironmentID returns the SSH host and port of the ssh-portal
+// serving the environment with the given ID, as known to the ssh-portal-api.
+// If the environment has no SSH endpoint, ErrUnknownEnvironment is returned.
+func (c *NATSClient) SSHEndpointByEnvironmentID(
+	ctx context.Context,
+	environmentID int,
+) (string, string, error) {
+	return sshEndpointRequest(ctx, c.conn, environmentID)
+}
@@ -0,0 +1,88 @@
+package bus
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/alecthomas/assert/v2"
+	"github.com/nats-io/nats.go"
+)
+
+// fakeRequester records the last request made, and replies with the given
+// data or error.
+type fakeRequester struct {
+	reply   []byte
+	err     error
+	subject string
+	query   SSHEndpointQuery
+}
+
+func (r *fakeRequester) RequestWithContext(_ context.Context,
+	subject string, data []byte) (*nats.Msg, error) {
+	r.subject = subject
+	if err := json.Unmarshal(data, &r.query); err != nil {
+		return nil, err
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	return &nats.Msg{Data: r.reply}, nil
+}
+
+func TestSSHEndpointRequest(t *testing.T) {
+	var testCases = map[string]struct {
+		reply      string
+		requestErr error
+		expectHost string
+		expectPort string
+		expectErr  bool
+		unknown    bool
+	}{
+		"resolved": {
+			reply:      `{"Host":"ssh.example.com","Port":"22"}`,
+			expectHost: "ssh.example.com",
+			expectPort: "22",
+		},
+		"unknown environment": {
+			reply:     `{"Reason":"unknown-environment"}`,
+			expectErr: true,
+			unknown:   true,
+		},
+		"invalid query": {
+			reply:     `{"Reason":"invalid-query"}`,
+			expectErr: true,
+		},
+		"empty endpoint": {
+			reply:     `{}`,
+			expectErr: true,
+		},
+		"malformed reply": {
+			reply:     `false`,
+			expectErr: true,
+		},
+		"request error": {
+			requestErr: nats.ErrNoResponders,
+			expectErr:  true,
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			r := &fakeRequester{reply: []byte(tc.reply), err: tc.requestErr}
+			host, port, err :=
+				sshEndpointRequest(context.Background(), r, 2)
+			assert.Equal(tt, SubjectSSHEndpointQuery, r.subject, name)
+			assert.Equal(tt, SSHEndpointQuery{EnvironmentID: 2}, r.query, name)
+			if tc.expectErr {
+				assert.Error(tt, err, name)
+			} else {
+				assert.NoError(tt, err, name)
+			}
+			assert.Equal(tt, tc.unknown,
+				errors.Is(err, ErrUnknownEnvironment), name)
+			assert.Equal(tt, tc.expectHost, host, name)
+			assert.Equal(tt, tc.expectPort, port, name)
+		})
+	}
+}
@@ -0,0 +1,11 @@
+package bus
+
+import "github.com/google/uuid"
+
+// InvalidateMessage defines the structure of a cache invalidation message.
+// It is published by Lagoon core when an SSH key or user is changed, and
+// asks subscribers to purge any data cached for the given identities.
+type InvalidateMessage struct {
+	SSHFingerprints []string    `json:",omitempty"`
+	UserUUIDs       []uuid.UUID `json:",omitempty"`
+}
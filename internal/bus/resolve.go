@@ -0,0 +1,162 @@
+package bus
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultNATSPort is used if the NATS URL does not specify a port.
+const defaultNATSPort = "4222"
+
+// Resolver looks up the addresses of NATS servers. It is implemented by
+// *net.Resolver.
+type Resolver interface {
+	LookupHost(ctx context.Context, host string) ([]string, error)
+	LookupSRV(ctx context.Context, service, proto, name string) (string,
+		[]*net.SRV, error)
+}
+
+// serverResolver periodically resolves the hostname of a NATS URL, and
+// implements nats.CustomDialer to dial the most recently resolved addresses.
+//
+// If the hostname begins with an underscore (e.g. _nats._tcp.nats.svc) it is
+// resolved as a DNS SRV record. Otherwise its A/AAAA records are resolved,
+// and the port of the URL is used.
+type serverResolver struct {
+	log      *slog.Logger
+	resolver Resolver
+	scheme   string
+	hostname string
+	port     string
+	timeout  time.Duration
+	mu       sync.Mutex
+	urls     []string
+}
+
+// newServerResolver returns a serverResolver for the given NATS URL.
+func newServerResolver(
+	log *slog.Logger,
+	resolver Resolver,
+	srvAddr string,
+) (*serverResolver, error) {
+	if strings.Contains(srvAddr, ",") {
+		return nil, fmt.Errorf("re-resolution requires a single NATS URL")
+	}
+	u, err := url.Parse(srvAddr)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse NATS URL: %v", err)
+	}
+	port := u.Port()
+	if port == "" {
+		port = defaultNATSPort
+	}
+	return &serverResolver{
+		log:      log,
+		resolver: resolver,
+		scheme:   u.Scheme,
+		hostname: u.Hostname(),
+		port:     port,
+		timeout:  natsTimeout,
+	}, nil
+}
+
+// resolve looks up the current set of NATS server URLs. If the lookup fails
+// or returns no addresses, the previous set is kept and an error is
+// returned.
+func (r *serverResolver) resolve(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+	var urls []string
+	if strings.HasPrefix(r.hostname, "_") {
+		_, records, err := r.resolver.LookupSRV(ctx, "", "", r.hostname)
+		if err != nil {
+			return fmt.Errorf("couldn't look up SRV records: %v", err)
+		}
+		for _, record := range records {
+			urls = append(urls, fmt.Sprintf("%s://%s", r.scheme, net.JoinHostPort(
+				strings.TrimSuffix(record.Target, "."),
+				strconv.Itoa(int(record.Port)))))
+		}
+	} else {
+		addrs, err := r.resolver.LookupHost(ctx, r.hostname)
+		if err != nil {
+			return fmt.Errorf("couldn't look up host: %v", err)
+		}
+		for _, addr := range addrs {
+			urls = append(urls,
+				fmt.Sprintf("%s://%s", r.scheme, net.JoinHostPort(addr, r.port)))
+		}
+	}
+	if len(urls) == 0 {
+		return fmt.Errorf("no addresses found for %s", r.hostname)
+	}
+	slices.Sort(urls)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !slices.Equal(r.urls, urls) {
+		r.log.Info("resolved NATS servers", slog.Any("urls", urls))
+	}
+	r.urls = urls
+	return nil
+}
+
+// URLs returns the most recently resolved set of NATS server URLs.
+func (r *serverResolver) URLs() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return slices.Clone(r.urls)
+}
+
+// run re-resolves the NATS server URLs at the given interval until ctx is
+// cancelled. Resolution failures are logged, and retried at the next
+// interval.
+func (r *serverResolver) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := r.resolve(ctx); err != nil {
+				r.log.Warn("couldn't re-resolve NATS servers", slog.Any("error", err))
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Dial implements nats.CustomDialer. If address is the configured NATS
+// server, each of the most recently resolved addresses is tried in turn.
+// Otherwise, such as for servers discovered from the NATS cluster or if the
+// hostname has not yet been resolved, address is dialled directly.
+func (r *serverResolver) Dial(network, address string) (net.Conn, error) {
+	dialer := net.Dialer{Timeout: r.timeout}
+	host, _, err := net.SplitHostPort(address)
+	urls := r.URLs()
+	if err != nil || host != r.hostname || len(urls) == 0 {
+		return dialer.Dial(network, address)
+	}
+	for _, rawURL := range urls {
+		u, err := url.Parse(rawURL)
+		if err != nil {
+			continue
+		}
+		conn, err := dialer.Dial(network, u.Host)
+		if err == nil {
+			return conn, nil
+		}
+		r.log.Debug("couldn't dial NATS server",
+			slog.String("url", rawURL),
+			slog.Any("error", err))
+	}
+	return nil, fmt.Errorf("couldn't dial any resolved address for %s",
+		r.hostname)
+}
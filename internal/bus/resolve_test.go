@@ -0,0 +1,167 @@
+package bus
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/assert/v2"
+)
+
+// stubResolver is a Resolver which returns configurable results.
+type stubResolver struct {
+	mu    sync.Mutex
+	hosts []string
+	srvs  []*net.SRV
+	err   error
+}
+
+func (r *stubResolver) set(hosts []string, srvs []*net.SRV, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.hosts, r.srvs, r.err = hosts, srvs, err
+}
+
+func (r *stubResolver) LookupHost(_ context.Context, _ string) (
+	[]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.hosts, r.err
+}
+
+func (r *stubResolver) LookupSRV(_ context.Context, _, _, _ string) (
+	string, []*net.SRV, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return "", r.srvs, r.err
+}
+
+func TestServerResolverResolve(t *testing.T) {
+	log := slog.New(slog.NewJSONHandler(os.Stderr, nil))
+	var testCases = map[string]struct {
+		srvAddr string
+		hosts   []string
+		srvs    []*net.SRV
+		err     error
+		expect  []string
+		expErr  bool
+	}{
+		"a records": {
+			srvAddr: "nats://nats.lagoon.svc:4222",
+			hosts:   []string{"10.0.0.2", "10.0.0.1"},
+			expect: []string{
+				"nats://10.0.0.1:4222",
+				"nats://10.0.0.2:4222",
+			},
+		},
+		"a records default port": {
+			srvAddr: "tls://nats.lagoon.svc",
+			hosts:   []string{"10.0.0.1"},
+			expect:  []string{"tls://10.0.0.1:4222"},
+		},
+		"srv records": {
+			srvAddr: "nats://_nats._tcp.nats.lagoon.svc",
+			srvs: []*net.SRV{
+				{Target: "nats-1.nats.lagoon.svc.", Port: 4223},
+				{Target: "nats-0.nats.lagoon.svc.", Port: 4222},
+			},
+			expect: []string{
+				"nats://nats-0.nats.lagoon.svc:4222",
+				"nats://nats-1.nats.lagoon.svc:4223",
+			},
+		},
+		"lookup error": {
+			srvAddr: "nats://nats.lagoon.svc:4222",
+			err:     errors.New("no such host"),
+			expErr:  true,
+		},
+		"no addresses": {
+			srvAddr: "nats://nats.lagoon.svc:4222",
+			expErr:  true,
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			resolver := &stubResolver{}
+			resolver.set(tc.hosts, tc.srvs, tc.err)
+			r, err := newServerResolver(log, resolver, tc.srvAddr)
+			assert.NoError(tt, err, name)
+			err = r.resolve(context.Background())
+			if tc.expErr {
+				assert.Error(tt, err, name)
+			} else {
+				assert.NoError(tt, err, name)
+			}
+			assert.Equal(tt, tc.expect, r.URLs(), name)
+		})
+	}
+}
+
+func TestServerResolverMultipleURLs(t *testing.T) {
+	log := slog.New(slog.NewJSONHandler(os.Stderr, nil))
+	_, err := newServerResolver(log, &stubResolver{},
+		"nats://nats-0:4222,nats://nats-1:4222")
+	assert.Error(t, err)
+}
+
+func TestServerResolverRun(t *testing.T) {
+	log := slog.New(slog.NewJSONHandler(os.Stderr, nil))
+	resolver := &stubResolver{}
+	resolver.set([]string{"10.0.0.1"}, nil, nil)
+	r, err := newServerResolver(log, resolver, "nats://nats.lagoon.svc:4222")
+	assert.NoError(t, err)
+	assert.NoError(t, r.resolve(context.Background()))
+	assert.Equal(t, []string{"nats://10.0.0.1:4222"}, r.URLs())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go r.run(ctx, 10*time.Millisecond)
+	// waitFor waits until the resolved URLs equal expect
+	waitFor := func(expect []string) {
+		t.Helper()
+		for range 100 {
+			if urls := r.URLs(); len(urls) == len(expect) &&
+				urls[0] == expect[0] {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		assert.Equal(t, expect, r.URLs())
+	}
+	// the address changes
+	resolver.set([]string{"10.0.0.2"}, nil, nil)
+	waitFor([]string{"nats://10.0.0.2:4222"})
+	// resolution failures keep the previous addresses
+	resolver.set(nil, nil, errors.New("no such host"))
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, []string{"nats://10.0.0.2:4222"}, r.URLs())
+	// and are retried
+	resolver.set([]string{"10.0.0.3", "10.0.0.4"}, nil, nil)
+	waitFor([]string{"nats://10.0.0.3:4222", "nats://10.0.0.4:4222"})
+}
+
+func TestServerResolverDial(t *testing.T) {
+	log := slog.New(slog.NewJSONHandler(os.Stderr, nil))
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	_, port, err := net.SplitHostPort(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resolver := &stubResolver{}
+	// the first address refuses connections, so the second is used
+	resolver.set([]string{"127.0.0.1", "127.0.0.0"}, nil, nil)
+	r, err := newServerResolver(log, resolver, "nats://nats.invalid:"+port)
+	assert.NoError(t, err)
+	assert.NoError(t, r.resolve(context.Background()))
+	conn, err := r.Dial("tcp", "nats.invalid:"+port)
+	assert.NoError(t, err)
+	assert.NoError(t, conn.Close())
+}
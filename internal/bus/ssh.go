@@ -6,14 +6,31 @@ import (
 	"encoding/json"
 	"fmt"
 	"log/slog"
+	"net"
+	"sync/atomic"
 	"time"
 
 	"github.com/nats-io/nats.go"
+	"github.com/uselagoon/ssh-portal/internal/rbac"
 )
 
 const (
 	// SubjectSSHAccessQuery defines the NATS subject for SSH access queries.
 	SubjectSSHAccessQuery = "lagoon.sshportal.api"
+	// SubjectLegacySSHAccessQuery defines the NATS subject for SSH access
+	// queries used by the legacy service-api. Responses on this subject are a
+	// bare JSON boolean rather than an SSHAccessResponse.
+	SubjectLegacySSHAccessQuery = "lagoon.serviceapi.sshportal"
+	// SubjectUserInfoQuery defines the NATS subject for user info queries.
+	SubjectUserInfoQuery = "lagoon.sshportal.api.userinfo"
+	// SubjectSSHEndpointQuery defines the NATS subject for SSH endpoint
+	// queries.
+	SubjectSSHEndpointQuery = "lagoon.sshportal.api.endpoint"
+	// SubjectInvalidate defines the NATS subject for cache invalidation
+	// messages.
+	SubjectInvalidate = "lagoon.sshportal.api.invalidate"
+	// SubjectSSHAuditEvent defines the NATS subject for SSH audit events.
+	SubjectSSHAuditEvent = "lagoon.sshportal.audit"
 	// NATS request timeout.
 	natsTimeout = 8 * time.Second
 )
@@ -25,6 +42,7 @@ type SSHAccessQuery struct {
 	NamespaceName  string
 	ProjectID      int
 	EnvironmentID  int
+	ClusterName    string
 }
 
 // LogValue implements the slog.LogValuer interface.
@@ -35,62 +53,196 @@ func (q SSHAccessQuery) LogValue() slog.Value {
 		slog.Int("projectID", q.ProjectID),
 		slog.Int("environmentID", q.EnvironmentID),
 		slog.String("sessionID", q.SessionID),
+		slog.String("clusterName", q.ClusterName),
 	)
 }
 
+// ReasonUnknownNamespace indicates that SSH access was denied because the
+// namespace in the query doesn't belong to a current Lagoon environment, such
+// as when the environment has been deleted.
+const ReasonUnknownNamespace = "unknown-namespace"
+
+// ReasonIDMismatch indicates that SSH access was denied because the project
+// or environment ID in the query doesn't match the Lagoon API DB. This
+// usually means that the namespace labels have drifted from the API.
+const ReasonIDMismatch = "id-mismatch"
+
+// ReasonBackendUnavailable indicates that a query was denied without being
+// evaluated because a backend of ssh-portal-api is failing.
+const ReasonBackendUnavailable = "backend-unavailable"
+
+// SSHAccessResponse defines the structure of an SSH access query response.
+// Capability is only meaningful if Allowed is true. Reason may explain why
+// access was not allowed.
+type SSHAccessResponse struct {
+	Allowed    bool
+	Capability rbac.Capability
+	Reason     string `json:",omitempty"`
+}
+
+// sshAccessResponse is used to avoid recursion in the JSON (un)marshalling
+// methods of SSHAccessResponse.
+type sshAccessResponse SSHAccessResponse
+
+// MarshalJSON implements json.Marshaler.
+//
+// For compatibility with older ssh-portal clients, responses which deny
+// access without a reason or grant full access are encoded as a bare JSON
+// boolean. Older clients will deny responses with any other capability or a
+// reason, since they can't unmarshal them.
+func (r SSHAccessResponse) MarshalJSON() ([]byte, error) {
+	if r.Reason == "" && (!r.Allowed || r.Capability == rbac.FullAccess) {
+		return json.Marshal(r.Allowed)
+	}
+	return json.Marshal(sshAccessResponse(r))
+}
+
+// UnmarshalJSON implements json.Unmarshaler. It accepts either a bare JSON
+// boolean, or a JSON object.
+func (r *SSHAccessResponse) UnmarshalJSON(data []byte) error {
+	var allowed bool
+	if err := json.Unmarshal(data, &allowed); err == nil {
+		*r = SSHAccessResponse{Allowed: allowed, Capability: rbac.FullAccess}
+		return nil
+	}
+	return json.Unmarshal(data, (*sshAccessResponse)(r))
+}
+
 // NATSClient is a NATS client.
 type NATSClient struct {
-	conn *nats.Conn
+	conn        *nats.Conn
+	clusterName string
+	closing     atomic.Bool
+	stopResolve context.CancelFunc
+}
+
+// natsConfig contains the optional configuration of a NATSClient.
+type natsConfig struct {
+	reResolveInterval time.Duration
+	resolver          Resolver
+}
+
+// NATSOption performs optional configuration on NATSClient objects during
+// initialization, and is passed to NewNATSClient().
+type NATSOption func(*natsConfig)
+
+// NATSReResolveInterval configures the NATSClient to resolve the hostname of
+// the NATS URL itself rather than pinning the addresses resolved on first
+// connection, and to re-resolve it at the given interval. Reconnections use
+// the most recently resolved addresses. If the hostname begins with an
+// underscore it is resolved as a DNS SRV record. Values less than one disable
+// re-resolution, which is the default.
+func NATSReResolveInterval(d time.Duration) NATSOption {
+	return func(c *natsConfig) {
+		c.reResolveInterval = d
+	}
+}
+
+// NATSResolver configures the Resolver used to resolve the NATS URL when
+// re-resolution is enabled. The default is net.DefaultResolver.
+func NATSResolver(r Resolver) NATSOption {
+	return func(c *natsConfig) {
+		c.resolver = r
+	}
 }
 
 // NewNATSClient constructs a new NATS client which connects to the given
 // srvAddr. It logs to the given log, and calls the given context.CancelFunc
-// when the NATS connection closes.
+// when the NATS connection closes unexpectedly. The given clusterName
+// identifies the cluster in SSH access queries, and may be empty.
 //
 // The idea is that when the connection closes on the other end, this function
-// must be called again to construct a new client.
+// must be called again to construct a new client. Closing the connection by
+// calling Close() is an orderly shutdown, so the context.CancelFunc is not
+// called.
 func NewNATSClient(
-	srvAddr string,
+	srvAddr,
+	clusterName string,
 	log *slog.Logger,
 	cancel context.CancelFunc,
+	opts ...NATSOption,
 ) (*NATSClient, error) {
+	config := natsConfig{resolver: net.DefaultResolver}
+	for _, opt := range opts {
+		opt(&config)
+	}
+	c := NATSClient{clusterName: clusterName, stopResolve: func() {}}
+	var natsOpts []nats.Option
+	if config.reResolveInterval > 0 {
+		r, err := newServerResolver(log, config.resolver, srvAddr)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't configure NATS resolution: %v", err)
+		}
+		// the initial resolution is retried in the background on failure
+		if err = r.resolve(context.Background()); err != nil {
+			log.Warn("couldn't resolve NATS servers", slog.Any("error", err))
+		}
+		var resolveCtx context.Context
+		resolveCtx, c.stopResolve = context.WithCancel(context.Background())
+		go r.run(resolveCtx, config.reResolveInterval)
+		natsOpts = append(natsOpts, nats.SkipHostLookup(), nats.SetCustomDialer(r))
+	}
 	// get nats server connection
 	conn, err := nats.Connect(
 		srvAddr,
-		nats.Name("ssh-portal"),
-		// cancel upstream context on connection close
-		nats.ClosedHandler(func(_ *nats.Conn) {
-			log.Error("nats connection closed")
-			cancel()
-		}),
-		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
-			log.Warn("nats disconnected", slog.Any("error", err))
-		}),
-		nats.ReconnectHandler(func(nc *nats.Conn) {
-			log.Info("nats reconnected", slog.String("url", nc.ConnectedUrl()))
-		}))
+		append(natsOpts,
+			nats.Name("ssh-portal"),
+			// cancel upstream context on unexpected connection close
+			nats.ClosedHandler(func(_ *nats.Conn) {
+				if c.closing.Load() {
+					log.Info("nats connection closed")
+					return
+				}
+				log.Error("nats connection closed")
+				cancel()
+			}),
+			nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+				log.Warn("nats disconnected", slog.Any("error", err))
+			}),
+			nats.ReconnectHandler(func(nc *nats.Conn) {
+				log.Info("nats reconnected", slog.String("url", nc.ConnectedUrl()))
+			}))...)
 	if err != nil {
+		c.stopResolve()
 		return nil, fmt.Errorf("couldn't connect to NATS server: %v", err)
 	}
-	return &NATSClient{
-		conn: conn,
-	}, nil
+	c.conn = conn
+	return &c, nil
 }
 
-// Close calls Close() on the underlying NATS connection.
+// Close calls Close() on the underlying NATS connection. It should be called
+// only once all users of the NATSClient have stopped.
 func (c *NATSClient) Close() {
+	c.closing.Store(true)
 	c.conn.Close()
+	c.stopResolve()
+}
+
+// CheckConnected returns an error if the underlying NATS connection is not
+// currently connected, such as while it is reconnecting. It may be used as a
+// readiness check.
+func (c *NATSClient) CheckConnected(context.Context) error {
+	if !c.conn.IsConnected() {
+		return fmt.Errorf("nats connection is %v", c.conn.Status())
+	}
+	return nil
+}
+
+// Publish publishes the given data to the given subject on the underlying
+// NATS connection.
+func (c *NATSClient) Publish(subject string, data []byte) error {
+	return c.conn.Publish(subject, data)
 }
 
-// KeyCanAccessEnvironment returns true if the given key can access the given
-// environment, or false otherwise.
+// KeyCanAccessEnvironment returns a response indicating whether the given key
+// can access the given environment, and with what capability.
 func (c *NATSClient) KeyCanAccessEnvironment(
 	sessionID,
 	sshFingerprint,
 	namespaceName string,
 	projectID,
 	environmentID int,
-) (bool, error) {
+) (SSHAccessResponse, error) {
 	// construct ssh access query
 	queryData, err := json.Marshal(SSHAccessQuery{
 		SessionID:      sessionID,
@@ -98,9 +250,10 @@ func (c *NATSClient) KeyCanAccessEnvironment(
 		NamespaceName:  namespaceName,
 		ProjectID:      projectID,
 		EnvironmentID:  environmentID,
+		ClusterName:    c.clusterName,
 	})
 	if err != nil {
-		return false, fmt.Errorf("couldn't marshal NATS request: %v", err)
+		return SSHAccessResponse{}, fmt.Errorf("couldn't marshal NATS request: %v", err)
 	}
 	// send query
 	msg, err := c.conn.Request(
@@ -108,12 +261,12 @@ func (c *NATSClient) KeyCanAccessEnvironment(
 		queryData,
 		natsTimeout)
 	if err != nil {
-		return false, fmt.Errorf("couldn't make NATS request: %v", err)
+		return SSHAccessResponse{}, fmt.Errorf("couldn't make NATS request: %v", err)
 	}
 	// handle response
-	var ok bool
-	if err := json.Unmarshal(msg.Data, &ok); err != nil {
-		return false, fmt.Errorf("couldn't unmarshal response: %v", err)
+	var response SSHAccessResponse
+	if err := json.Unmarshal(msg.Data, &response); err != nil {
+		return SSHAccessResponse{}, fmt.Errorf("couldn't unmarshal response: %v", err)
 	}
-	return ok, nil
+	return response, nil
 }
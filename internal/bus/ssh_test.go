@@ -0,0 +1,59 @@
+package bus_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/alecthomas/assert/v2"
+	"github.com/uselagoon/ssh-portal/internal/bus"
+	"github.com/uselagoon/ssh-portal/internal/rbac"
+)
+
+func TestSSHAccessResponse(t *testing.T) {
+	var testCases = map[string]struct {
+		response bus.SSHAccessResponse
+		expect   string
+	}{
+		"denied": {
+			response: bus.SSHAccessResponse{},
+			expect:   `false`,
+		},
+		"full access": {
+			response: bus.SSHAccessResponse{
+				Allowed:    true,
+				Capability: rbac.FullAccess,
+			},
+			expect: `true`,
+		},
+		"logs only": {
+			response: bus.SSHAccessResponse{
+				Allowed:    true,
+				Capability: rbac.LogsOnly,
+			},
+			expect: `{"Allowed":true,"Capability":"logs-only"}`,
+		},
+		"denied with reason": {
+			response: bus.SSHAccessResponse{
+				Reason: rbac.ReasonUserNotInKeycloak,
+			},
+			expect: `{"Allowed":false,"Capability":"full","Reason":"user-not-in-keycloak"}`,
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			data, err := json.Marshal(tc.response)
+			assert.NoError(tt, err, name)
+			assert.Equal(tt, tc.expect, string(data), name)
+			var response bus.SSHAccessResponse
+			assert.NoError(tt, json.Unmarshal(data, &response), name)
+			assert.Equal(tt, tc.response, response, name)
+		})
+	}
+}
+
+func TestSSHAccessResponseInvalid(t *testing.T) {
+	var response bus.SSHAccessResponse
+	assert.Error(t, json.Unmarshal(
+		[]byte(`{"Allowed":true,"Capability":"root"}`), &response))
+	assert.Error(t, json.Unmarshal([]byte(`"true"`), &response))
+}
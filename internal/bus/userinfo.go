@@ -0,0 +1,42 @@
+package bus
+
+import (
+	"log/slog"
+
+	"github.com/google/uuid"
+	"github.com/uselagoon/ssh-portal/internal/lagoon"
+)
+
+const (
+	// ReasonInvalidQuery indicates that a user info query was rejected
+	// without being processed.
+	ReasonInvalidQuery = "invalid-query"
+	// ReasonUnknownSSHKey indicates that the SSH key in a user info query is
+	// not registered to a Lagoon user.
+	ReasonUnknownSSHKey = "unknown-ssh-key"
+)
+
+// UserInfoQuery defines the structure of a user info query. It asks for the
+// Lagoon user who owns the SSH key with the given fingerprint.
+type UserInfoQuery struct {
+	SSHFingerprint string
+}
+
+// LogValue implements the slog.LogValuer interface.
+func (q UserInfoQuery) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.String("sshFingerprint", q.SSHFingerprint),
+	)
+}
+
+// UserInfoResponse defines the structure of a user info query response. If
+// the user couldn't be resolved, UserUUID is nil and Reason explains why.
+// GroupRoles maps the IDs of the Keycloak groups the user is a member of to
+// the user's role in each group. It is empty for platform owners, since they
+// have access to every group.
+type UserInfoResponse struct {
+	UserUUID      *uuid.UUID                    `json:",omitempty"`
+	PlatformOwner bool                          `json:",omitempty"`
+	GroupRoles    map[uuid.UUID]lagoon.UserRole `json:",omitempty"`
+	Reason        string                        `json:",omitempty"`
+}
@@ -0,0 +1,167 @@
+// Package cachemetrics instruments the caches in package cache with Prometheus
+// metrics describing how stale the cached data is. It is separate from
+// package cache so that consumers which don't export metrics don't depend on
+// Prometheus.
+package cachemetrics
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/uselagoon/ssh-portal/internal/cache"
+)
+
+// Metrics contains the Prometheus metrics of instrumented caches. Each metric
+// has a cache label identifying the instrumented cache.
+type Metrics struct {
+	entryAge    *prometheus.GaugeVec
+	lastRefresh *prometheus.GaugeVec
+}
+
+// NewMetrics creates the cache metrics, with names prefixed by namespace, and
+// registers them with reg. A nil reg leaves the metrics unregistered.
+func NewMetrics(reg prometheus.Registerer, namespace string) *Metrics {
+	factory := promauto.With(reg)
+	return &Metrics{
+		entryAge: factory.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "cache_entry_age_seconds",
+			Help:      "Time since the cache entry most recently returned by the cache was set",
+		}, []string{"cache"}),
+		lastRefresh: factory.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "cache_last_refresh_timestamp_seconds",
+			Help:      "Unix time at which an entry was last set in the cache",
+		}, []string{"cache"}),
+	}
+}
+
+// Option performs optional configuration on instrumented caches during
+// initialization, and is passed to NewAny() or NewMap().
+type Option func(*gauges)
+
+// Clock sets the function used to get the current time. It is intended for
+// use in tests.
+func Clock(now func() time.Time) Option {
+	return func(g *gauges) {
+		g.now = now
+	}
+}
+
+// gauges are the metrics of a single instrumented cache.
+type gauges struct {
+	entryAge    prometheus.Gauge
+	lastRefresh prometheus.Gauge
+	now         func() time.Time
+}
+
+// newGauges returns the gauges of the named cache in m.
+func newGauges(m *Metrics, name string, opts []Option) gauges {
+	g := gauges{
+		entryAge:    m.entryAge.WithLabelValues(name),
+		lastRefresh: m.lastRefresh.WithLabelValues(name),
+		now:         time.Now,
+	}
+	for _, opt := range opts {
+		opt(&g)
+	}
+	return g
+}
+
+// set records that an entry was set at the given time.
+func (g *gauges) set(now time.Time) {
+	g.entryAge.Set(0)
+	g.lastRefresh.Set(float64(now.UnixNano()) / float64(time.Second))
+}
+
+// hit records that an entry set at the given time was returned.
+func (g *gauges) hit(set time.Time) {
+	g.entryAge.Set(g.now().Sub(set).Seconds())
+}
+
+// Any is a cache.Any which records the age of its value.
+type Any[T any] struct {
+	c *cache.Any[T]
+	g gauges
+
+	mu  sync.Mutex
+	set time.Time
+}
+
+// NewAny returns c instrumented with the metrics in m, labelled with the
+// given cache name.
+func NewAny[T any](
+	c *cache.Any[T],
+	m *Metrics,
+	name string,
+	opts ...Option,
+) *Any[T] {
+	return &Any[T]{c: c, g: newGauges(m, name, opts)}
+}
+
+// Set updates the value in the cache, and records the time it was set.
+func (a *Any[T]) Set(value T) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.c.Set(value)
+	a.set = a.g.now()
+	a.g.set(a.set)
+}
+
+// Get retrieves the value from the cache. If the value hasn't expired, its
+// age is recorded.
+func (a *Any[T]) Get() (T, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	value, ok := a.c.Get()
+	if ok {
+		a.g.hit(a.set)
+	}
+	return value, ok
+}
+
+// Map is a cache.Map which records the age of its values.
+type Map[K comparable, V any] struct {
+	c *cache.Map[K, V]
+	g gauges
+
+	mu  sync.Mutex
+	set map[K]time.Time
+}
+
+// NewMap returns c instrumented with the metrics in m, labelled with the
+// given cache name.
+func NewMap[K comparable, V any](
+	c *cache.Map[K, V],
+	m *Metrics,
+	name string,
+	opts ...Option,
+) *Map[K, V] {
+	return &Map[K, V]{c: c, g: newGauges(m, name, opts), set: map[K]time.Time{}}
+}
+
+// Set updates the value in the cache, and records the time it was set.
+func (m *Map[K, V]) Set(key K, value V) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.c.Set(key, value)
+	now := m.g.now()
+	m.set[key] = now
+	m.g.set(now)
+}
+
+// Get retrieves the value from the cache. If the value exists and hasn't
+// expired, its age is recorded.
+func (m *Map[K, V]) Get(key K) (V, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	value, ok := m.c.Get(key)
+	if ok {
+		m.g.hit(m.set[key])
+	} else {
+		delete(m.set, key)
+	}
+	return value, ok
+}
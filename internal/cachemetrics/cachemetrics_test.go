@@ -0,0 +1,120 @@
+package cachemetrics_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alecthomas/assert/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/uselagoon/ssh-portal/internal/cache"
+	"github.com/uselagoon/ssh-portal/internal/cachemetrics"
+)
+
+// fakeClock is a clock which only advances when told to.
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+// gaugeValue returns the value of the named gauge of the given cache.
+func gaugeValue(tt *testing.T, reg *prometheus.Registry, name,
+	cacheName string) float64 {
+	families, err := reg.Gather()
+	if err != nil {
+		tt.Fatal(err)
+	}
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == "cache" && label.GetValue() == cacheName {
+					return metric.GetGauge().GetValue()
+				}
+			}
+		}
+	}
+	tt.Fatalf("couldn't find gauge %s for cache %s", name, cacheName)
+	return 0
+}
+
+func TestAny(t *testing.T) {
+	var testCases = map[string]struct {
+		set       bool
+		elapsed   time.Duration
+		expectHit bool
+		expectAge float64
+	}{
+		"fresh": {
+			set:       true,
+			expectHit: true,
+		},
+		"stale": {
+			set:       true,
+			elapsed:   30 * time.Second,
+			expectHit: true,
+			expectAge: 30,
+		},
+		"never set": {
+			elapsed: 30 * time.Second,
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			reg := prometheus.NewRegistry()
+			m := cachemetrics.NewMetrics(reg, "test")
+			clock := &fakeClock{now: time.Unix(1700000000, 0)}
+			c := cachemetrics.NewAny(cache.NewAny[int](), m, "any",
+				cachemetrics.Clock(clock.Now))
+			if tc.set {
+				c.Set(11)
+				assert.Equal(tt, float64(1700000000), gaugeValue(tt, reg,
+					"test_cache_last_refresh_timestamp_seconds", "any"), name)
+			}
+			clock.now = clock.now.Add(tc.elapsed)
+			value, ok := c.Get()
+			assert.Equal(tt, tc.expectHit, ok, name)
+			if tc.expectHit {
+				assert.Equal(tt, 11, value, name)
+			}
+			assert.Equal(tt, tc.expectAge, gaugeValue(tt, reg,
+				"test_cache_entry_age_seconds", "any"), name)
+		})
+	}
+}
+
+func TestMap(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	m := cachemetrics.NewMetrics(reg, "test")
+	clock := &fakeClock{now: time.Unix(1700000000, 0)}
+	c := cachemetrics.NewMap(cache.NewMap[string, string](), m, "map",
+		cachemetrics.Clock(clock.Now))
+	c.Set("foo", "bar")
+	clock.now = clock.now.Add(10 * time.Second)
+	c.Set("baz", "qux")
+	assert.Equal(t, float64(1700000010), gaugeValue(t, reg,
+		"test_cache_last_refresh_timestamp_seconds", "map"))
+	assert.Equal(t, float64(0), gaugeValue(t, reg,
+		"test_cache_entry_age_seconds", "map"))
+	clock.now = clock.now.Add(5 * time.Second)
+	// the age of the entry returned is recorded
+	value, ok := c.Get("foo")
+	assert.True(t, ok)
+	assert.Equal(t, "bar", value)
+	assert.Equal(t, float64(15), gaugeValue(t, reg,
+		"test_cache_entry_age_seconds", "map"))
+	value, ok = c.Get("baz")
+	assert.True(t, ok)
+	assert.Equal(t, "qux", value)
+	assert.Equal(t, float64(5), gaugeValue(t, reg,
+		"test_cache_entry_age_seconds", "map"))
+	// misses don't change the recorded age
+	_, ok = c.Get("missing")
+	assert.False(t, ok)
+	assert.Equal(t, float64(5), gaugeValue(t, reg,
+		"test_cache_entry_age_seconds", "map"))
+}
@@ -0,0 +1,44 @@
+// Package hostkey parses the PEM encoded host keys of the SSH servers.
+package hostkey
+
+import (
+	"fmt"
+	"strings"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// Source is a PEM encoded host key, and the name of the flag or environment
+// variable it was read from. The name is used to identify the key in errors.
+type Source struct {
+	Name string
+	PEM  string
+}
+
+// Parse parses each of the given host keys which is not empty, and returns
+// their signers in the given order. CRLF line endings are converted to LF
+// before parsing, since keys pasted on Windows often contain them. An error
+// naming the source is returned if a key can't be parsed, or if more than one
+// key has the same type.
+func Parse(sources ...Source) ([]gossh.Signer, error) {
+	var signers []gossh.Signer
+	keyTypes := map[string]string{}
+	for _, src := range sources {
+		if src.PEM == "" {
+			continue
+		}
+		pem := strings.ReplaceAll(src.PEM, "\r\n", "\n")
+		signer, err := gossh.ParsePrivateKey([]byte(pem))
+		if err != nil {
+			return nil, fmt.Errorf("invalid host key in %s: %v", src.Name, err)
+		}
+		keyType := signer.PublicKey().Type()
+		if other, ok := keyTypes[keyType]; ok {
+			return nil, fmt.Errorf("duplicate %s host key in %s and %s",
+				keyType, other, src.Name)
+		}
+		keyTypes[keyType] = src.Name
+		signers = append(signers, signer)
+	}
+	return signers, nil
+}
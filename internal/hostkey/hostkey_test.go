@@ -0,0 +1,109 @@
+package hostkey_test
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/pem"
+	"strings"
+	"testing"
+
+	"github.com/alecthomas/assert/v2"
+	"github.com/uselagoon/ssh-portal/internal/hostkey"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// marshalKey returns the PEM encoding of the given private key.
+func marshalKey(t *testing.T, key crypto.PrivateKey) string {
+	block, err := gossh.MarshalPrivateKey(key, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(block))
+}
+
+func TestParse(t *testing.T) {
+	_, ed25519Key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, otherED25519Key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ed25519PEM := marshalKey(t, ed25519Key)
+	ecdsaPEM := marshalKey(t, ecdsaKey)
+	var testCases = map[string]struct {
+		sources     []hostkey.Source
+		expectTypes []string
+		expectError string
+	}{
+		"none": {
+			sources: []hostkey.Source{
+				{Name: "HOST_KEY_ECDSA"},
+				{Name: "HOST_KEY_ED25519"},
+			},
+		},
+		"valid": {
+			sources: []hostkey.Source{
+				{Name: "HOST_KEY_ECDSA", PEM: ecdsaPEM},
+				{Name: "HOST_KEY_ED25519", PEM: ed25519PEM},
+				{Name: "HOST_KEY_RSA"},
+			},
+			expectTypes: []string{
+				gossh.KeyAlgoECDSA256,
+				gossh.KeyAlgoED25519,
+			},
+		},
+		"CRLF": {
+			sources: []hostkey.Source{{
+				Name: "HOST_KEY_ED25519",
+				PEM:  strings.ReplaceAll(ed25519PEM, "\n", "\r\n"),
+			}},
+			expectTypes: []string{gossh.KeyAlgoED25519},
+		},
+		"truncated": {
+			sources: []hostkey.Source{
+				{Name: "HOST_KEY_ECDSA", PEM: ecdsaPEM},
+				{Name: "HOST_KEY_ED25519", PEM: ed25519PEM[:len(ed25519PEM)/2]},
+			},
+			expectError: "invalid host key in HOST_KEY_ED25519",
+		},
+		"not PEM": {
+			sources: []hostkey.Source{
+				{Name: "HOST_KEY_RSA", PEM: "not a key"},
+			},
+			expectError: "invalid host key in HOST_KEY_RSA",
+		},
+		"duplicate": {
+			sources: []hostkey.Source{
+				{Name: "HOST_KEY_ECDSA", PEM: ed25519PEM},
+				{Name: "HOST_KEY_ED25519", PEM: marshalKey(t, otherED25519Key)},
+			},
+			expectError: "duplicate ssh-ed25519 host key in HOST_KEY_ECDSA " +
+				"and HOST_KEY_ED25519",
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			signers, err := hostkey.Parse(tc.sources...)
+			if tc.expectError != "" {
+				assert.Error(tt, err, name)
+				assert.Contains(tt, err.Error(), tc.expectError, name)
+				return
+			}
+			assert.NoError(tt, err, name)
+			var types []string
+			for _, signer := range signers {
+				types = append(types, signer.PublicKey().Type())
+			}
+			assert.Equal(tt, tc.expectTypes, types, name)
+		})
+	}
+}
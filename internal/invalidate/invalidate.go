@@ -0,0 +1,103 @@
+// Package invalidate implements the explicit invalidation of data cached for
+// an identity, such as SSH access decisions for a key which has since been
+// deleted from Lagoon.
+//
+// Lagoon core publishes a bus.InvalidateMessage to bus.SubjectInvalidate,
+// and every subscribed service instance passes the identities in the message
+// to each of its registered Purgers.
+package invalidate
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go"
+	"github.com/uselagoon/ssh-portal/internal/bus"
+	"github.com/uselagoon/ssh-portal/internal/sshfingerprint"
+)
+
+// maxMessageBytes is the maximum accepted size of an invalidation message.
+const maxMessageBytes = 65536
+
+// Purger removes any data cached for the given identities. Fingerprints are
+// normalised to match the Lagoon API DB. It returns the number of cache
+// entries removed.
+type Purger interface {
+	Purge(fingerprints []string, userUUIDs []uuid.UUID) int
+}
+
+// subscriber subscribes to NATS subjects. It is implemented by *nats.Conn.
+type subscriber interface {
+	Subscribe(subject string, cb nats.MsgHandler) (*nats.Subscription, error)
+}
+
+// decode returns the identities in the given invalidation message, with the
+// fingerprints normalised. Invalid fingerprints are an error, since they
+// can't match any cached entry.
+func decode(data []byte) ([]string, []uuid.UUID, error) {
+	if len(data) > maxMessageBytes {
+		return nil, nil, fmt.Errorf("oversized message: %d bytes", len(data))
+	}
+	var msg bus.InvalidateMessage
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return nil, nil, fmt.Errorf("couldn't unmarshal message: %v", err)
+	}
+	fingerprints := make([]string, 0, len(msg.SSHFingerprints))
+	for _, f := range msg.SSHFingerprints {
+		fingerprint, err := sshfingerprint.Normalize(f)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid fingerprint %q: %v", f, err)
+		}
+		fingerprints = append(fingerprints, fingerprint)
+	}
+	return fingerprints, msg.UserUUIDs, nil
+}
+
+// handler returns a nats.MsgHandler which passes the identities in each
+// invalidation message to every purger.
+func handler(log *slog.Logger, m *Metrics, purgers []Purger) nats.MsgHandler {
+	return func(msg *nats.Msg) {
+		fingerprints, userUUIDs, err := decode(msg.Data)
+		if err != nil {
+			m.messagesTotal.WithLabelValues("invalid").Inc()
+			log.Warn("couldn't decode invalidation message",
+				slog.Any("error", err))
+			return
+		}
+		m.messagesTotal.WithLabelValues("processed").Inc()
+		var purged int
+		for _, p := range purgers {
+			purged += p.Purge(fingerprints, userUUIDs)
+		}
+		m.purgedEntriesTotal.Add(float64(purged))
+		log.Info("invalidated cached identities",
+			slog.Any("sshFingerprints", fingerprints),
+			slog.Any("userUUIDs", userUUIDs),
+			slog.Int("purgedEntries", purged))
+	}
+}
+
+// Subscribe subscribes to bus.SubjectInvalidate, and passes the identities in
+// each message received to every purger. A queue group is not used, since
+// every instance of a service must purge its own caches. If there are no
+// purgers, because caching is disabled, it does not subscribe and returns a
+// nil subscription.
+func Subscribe(
+	log *slog.Logger,
+	m *Metrics,
+	s subscriber,
+	purgers ...Purger,
+) (*nats.Subscription, error) {
+	if len(purgers) == 0 {
+		log.Debug("no caches to invalidate")
+		return nil, nil
+	}
+	sub, err := s.Subscribe(bus.SubjectInvalidate, handler(log, m, purgers))
+	if err != nil {
+		return nil, fmt.Errorf("couldn't subscribe to invalidation subject: %v",
+			err)
+	}
+	return sub, nil
+}
@@ -0,0 +1,156 @@
+package invalidate
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"testing"
+
+	"github.com/alecthomas/assert/v2"
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/uselagoon/ssh-portal/internal/bus"
+)
+
+// fakeSubscriber records the subject and handler of the last subscription.
+type fakeSubscriber struct {
+	err     error
+	subject string
+	handler nats.MsgHandler
+}
+
+func (s *fakeSubscriber) Subscribe(subject string,
+	cb nats.MsgHandler) (*nats.Subscription, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+	s.subject, s.handler = subject, cb
+	return &nats.Subscription{Subject: subject}, nil
+}
+
+// fakePurger records the identities it is asked to purge, and reports that
+// the given number of entries were purged.
+type fakePurger struct {
+	purged       int
+	fingerprints []string
+	userUUIDs    []uuid.UUID
+}
+
+func (p *fakePurger) Purge(fingerprints []string, userUUIDs []uuid.UUID) int {
+	p.fingerprints, p.userUUIDs = fingerprints, userUUIDs
+	return p.purged
+}
+
+func TestSubscribe(t *testing.T) {
+	log := slog.New(slog.NewJSONHandler(os.Stderr, nil))
+	var testCases = map[string]struct {
+		purgers         []Purger
+		subscribeErr    error
+		expectSubscribe bool
+		expectErr       bool
+	}{
+		"caching disabled": {},
+		"caching enabled": {
+			purgers:         []Purger{&fakePurger{}},
+			expectSubscribe: true,
+		},
+		"subscribe error": {
+			purgers:      []Purger{&fakePurger{}},
+			subscribeErr: errors.New("nats: connection closed"),
+			expectErr:    true,
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			s := &fakeSubscriber{err: tc.subscribeErr}
+			sub, err := Subscribe(log, NewMetrics(prometheus.NewRegistry()), s,
+				tc.purgers...)
+			if tc.expectErr {
+				assert.Error(tt, err, name)
+			} else {
+				assert.NoError(tt, err, name)
+			}
+			assert.Equal(tt, tc.expectSubscribe, sub != nil, name)
+			if tc.expectSubscribe {
+				assert.Equal(tt, bus.SubjectInvalidate, s.subject, name)
+			} else {
+				assert.Equal(tt, "", s.subject, name)
+			}
+		})
+	}
+}
+
+func TestHandler(t *testing.T) {
+	log := slog.New(slog.NewJSONHandler(os.Stderr, nil))
+	userUUID := uuid.MustParse("91435afe-ba81-406b-9308-f80b79fae350")
+	var testCases = map[string]struct {
+		data               string
+		expectResult       string
+		expectFingerprints []string
+		expectUserUUIDs    []uuid.UUID
+		expectPurged       float64
+	}{
+		"fingerprint": {
+			data: `{"SSHFingerprints":` +
+				`["SHA256:NtOIKkyGp6ubsA4F2PDr1EltRRj4Rx+KZ1YYPrzIzE8"]}`,
+			expectResult: "processed",
+			expectFingerprints: []string{
+				"SHA256:NtOIKkyGp6ubsA4F2PDr1EltRRj4Rx+KZ1YYPrzIzE8",
+			},
+			expectPurged: 3,
+		},
+		"user UUID": {
+			data:               `{"UserUUIDs":["` + userUUID.String() + `"]}`,
+			expectResult:       "processed",
+			expectFingerprints: []string{},
+			expectUserUUIDs:    []uuid.UUID{userUUID},
+			expectPurged:       3,
+		},
+		"malformed": {
+			data:         `{"UserUUIDs":["foo"]}`,
+			expectResult: "invalid",
+		},
+		"invalid fingerprint": {
+			data:         `{"SSHFingerprints":["SHA256:abc"]}`,
+			expectResult: "invalid",
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			m := NewMetrics(prometheus.NewRegistry())
+			purgers := []*fakePurger{{purged: 1}, {purged: 2}}
+			s := &fakeSubscriber{}
+			_, err := Subscribe(log, m, s, purgers[0], purgers[1])
+			assert.NoError(tt, err, name)
+			s.handler(&nats.Msg{
+				Subject: bus.SubjectInvalidate,
+				Data:    []byte(tc.data),
+			})
+			// check fan-out to every purger
+			for _, p := range purgers {
+				assert.Equal(tt, tc.expectFingerprints, p.fingerprints, name)
+				assert.Equal(tt, tc.expectUserUUIDs, p.userUUIDs, name)
+			}
+			// check metrics
+			for _, result := range []string{"processed", "invalid"} {
+				var expect float64
+				if result == tc.expectResult {
+					expect = 1
+				}
+				assert.Equal(tt, expect, testutil.ToFloat64(
+					m.messagesTotal.WithLabelValues(result)), name)
+			}
+			assert.Equal(tt, tc.expectPurged,
+				testutil.ToFloat64(m.purgedEntriesTotal), name)
+		})
+	}
+}
+
+func TestInvalidateMessage(t *testing.T) {
+	data, err := json.Marshal(bus.InvalidateMessage{})
+	assert.NoError(t, err)
+	assert.Equal(t, `{}`, string(data))
+}
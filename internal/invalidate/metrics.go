@@ -0,0 +1,28 @@
+package invalidate
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Metrics contains the Prometheus metrics exported by the invalidation
+// subscriber.
+type Metrics struct {
+	messagesTotal      *prometheus.CounterVec
+	purgedEntriesTotal prometheus.Counter
+}
+
+// NewMetrics creates the invalidation metrics and registers them with reg.
+func NewMetrics(reg prometheus.Registerer) *Metrics {
+	factory := promauto.With(reg)
+	return &Metrics{
+		messagesTotal: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "invalidate_messages_total",
+			Help: "The total number of cache invalidation messages received",
+		}, []string{"result"}),
+		purgedEntriesTotal: factory.NewCounter(prometheus.CounterOpts{
+			Name: "invalidate_purged_entries_total",
+			Help: "The total number of cache entries purged by invalidation messages",
+		}),
+	}
+}
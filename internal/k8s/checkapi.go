@@ -0,0 +1,22 @@
+package k8s
+
+import (
+	"context"
+	"fmt"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// CheckAPI returns an error if the Kubernetes API is unreachable. It gets
+// the given namespace, which is cheap and also verifies that ssh-portal is
+// still authorized to read namespaces. It may be used as a readiness check.
+func (c *Client) CheckAPI(ctx context.Context, namespace string) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	_, err := c.clientset.CoreV1().Namespaces().
+		Get(ctx, namespace, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("couldn't get namespace %s: %w", namespace, err)
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+package k8s
+
+import (
+	"context"
+	"testing"
+
+	"github.com/alecthomas/assert/v2"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestCheckAPI(t *testing.T) {
+	namespace := &corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{Name: "default"},
+	}
+	var testCases = map[string]struct {
+		clientset      *fake.Clientset
+		expectErr      bool
+		expectNotFound bool
+	}{
+		"reachable": {clientset: fake.NewClientset(namespace)},
+		"not found": {
+			clientset:      fake.NewClientset(),
+			expectErr:      true,
+			expectNotFound: true,
+		},
+		"unreachable": {clientset: errorClientset(), expectErr: true},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			c := &Client{clientset: tc.clientset}
+			err := c.CheckAPI(context.Background(), "default")
+			if tc.expectErr {
+				assert.Error(tt, err, name)
+				// the API status is still detected through the wrapped error
+				assert.Equal(tt, tc.expectNotFound, apierrors.IsNotFound(err),
+					name)
+			} else {
+				assert.NoError(tt, err, name)
+			}
+		})
+	}
+}
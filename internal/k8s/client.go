@@ -3,48 +3,251 @@
 package k8s
 
 import (
-	"sync"
+	"context"
+	"log/slog"
+	"net/url"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/uselagoon/ssh-portal/internal/sessionlog"
 	"golang.org/x/sync/semaphore"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/metrics"
+	"k8s.io/client-go/tools/remotecommand"
 )
 
 const (
 	// timeout defines the common timeout for k8s API operations
 	timeout = 90 * time.Second
+	// defaultSlowCallThreshold is the default duration above which API calls
+	// on the SSH session critical path are logged as slow.
+	defaultSlowCallThreshold = time.Second
+)
+
+// Outcomes of API calls, used as the outcome label of the call duration
+// metric.
+const (
+	callOutcomeOK       = "ok"
+	callOutcomeNotFound = "not-found"
+	callOutcomeError    = "error"
 )
 
 // timeoutSeconds defines the common timeout for k8s API operations in the type
 // required by metav1.ListOptions.
 var timeoutSeconds = int64(timeout / time.Second)
 
+// rateLimiterMetric implements the client-go metrics.LatencyMetric interface.
+type rateLimiterMetric struct {
+	latency *prometheus.HistogramVec
+}
+
+// Observe implements the metrics.LatencyMetric interface.
+func (m rateLimiterMetric) Observe(
+	_ context.Context,
+	verb string,
+	_ url.URL,
+	latency time.Duration,
+) {
+	m.latency.WithLabelValues(verb).Observe(latency.Seconds())
+}
+
+// callOutcome returns the outcome label value for an API call which returned
+// the given error.
+func callOutcome(err error) string {
+	switch {
+	case err == nil:
+		return callOutcomeOK
+	case apierrors.IsNotFound(err):
+		return callOutcomeNotFound
+	default:
+		return callOutcomeError
+	}
+}
+
 // Client is a k8s client.
 type Client struct {
-	config       *rest.Config
-	clientset    kubernetes.Interface
-	logStreamIDs sync.Map
-	logSem       *semaphore.Weighted
-	logTimeLimit time.Duration
+	config         *rest.Config
+	clientset      kubernetes.Interface
+	logSem         *semaphore.Weighted
+	logTimeLimit   time.Duration
+	logSanitize    bool
+	logMaxLine     int
+	logDefaultTail int64
+	logMaxTail     int64
+	logLimitBytes  int64
+	logQueueBytes  int64
+	podInformers   podInformers
+	metrics        *Metrics
+	slowCall       time.Duration
+	debugImage     string
+	// newExecutor constructs the executor for exec and attach requests. If
+	// nil, remotecommand.NewSPDYExecutor is used.
+	newExecutor func(*rest.Config, string,
+		*url.URL) (remotecommand.Executor, error)
+}
+
+// Option performs optional configuration on Client objects during
+// initialization, and is passed to NewClient().
+type Option func(*Client)
+
+// APIRateLimit configures the client-side rate limit of the Kubernetes API
+// client returned by NewClient(). qps is the sustained queries per second,
+// and burst is the maximum burst above qps.
+func APIRateLimit(qps float32, burst int) Option {
+	return func(c *Client) {
+		c.config.QPS = qps
+		c.config.Burst = burst
+	}
+}
+
+// LogSanitization configures whether ANSI escape sequences and non-printable
+// control characters are stripped from log lines returned by Logs(). By
+// default log lines are passed through unmodified.
+func LogSanitization(enabled bool) Option {
+	return func(c *Client) {
+		c.logSanitize = enabled
+	}
+}
+
+// LogMaxLineLength configures the maximum length in bytes of a single log
+// line returned by Logs(). Longer lines are truncated. Values less than one
+// are ignored. The default is 1MiB.
+func LogMaxLineLength(n int) Option {
+	return func(c *Client) {
+		if n > 0 {
+			c.logMaxLine = n
+		}
+	}
+}
+
+// LogTailLines configures the number of log lines returned by Logs() when no
+// number is requested, and the maximum number of lines which may be
+// requested. Values less than one are ignored. The defaults are 32 and 1024
+// respectively.
+func LogTailLines(defaultTail, maxTail int64) Option {
+	return func(c *Client) {
+		if defaultTail > 0 {
+			c.logDefaultTail = defaultTail
+		}
+		if maxTail > 0 {
+			c.logMaxTail = maxTail
+		}
+	}
+}
+
+// LogLimitBytes configures the maximum number of bytes of logs returned by
+// Logs() from a single container. Values less than one are ignored. The
+// default is 1MiB.
+func LogLimitBytes(n int64) Option {
+	return func(c *Client) {
+		if n > 0 {
+			c.logLimitBytes = n
+		}
+	}
+}
+
+// LogQueueBytes configures the maximum number of bytes of log lines queued
+// for writing to the client in each call to Logs(). When the queue is full,
+// reading logs from containers pauses until the client catches up. Values
+// less than one are ignored. The default is 4MiB.
+func LogQueueBytes(n int64) Option {
+	return func(c *Client) {
+		if n > 0 {
+			c.logQueueBytes = n
+		}
+	}
+}
+
+// SlowCallThreshold configures the duration above which FindDeployment() and
+// NamespaceDetails() API calls are logged with a warning. Values less than
+// one disable the warning. The default is one second.
+func SlowCallThreshold(d time.Duration) Option {
+	return func(c *Client) {
+		c.slowCall = d
+	}
+}
+
+// DebugImage configures the image used for the ephemeral containers created
+// by Debug(). The default is busybox.
+func DebugImage(image string) Option {
+	return func(c *Client) {
+		if image != "" {
+			c.debugImage = image
+		}
+	}
+}
+
+// ClientMetrics configures the Metrics updated by the Kubernetes client. If
+// this option is not given, the client updates a set of metrics which is not
+// registered with any prometheus.Registerer, and so is not exported.
+func ClientMetrics(m *Metrics) Option {
+	return func(c *Client) {
+		c.metrics = m
+	}
 }
 
 // NewClient creates a new kubernetes API client.
-func NewClient(concurrentLogLimit uint, logTimeLimit time.Duration) (*Client, error) {
+func NewClient(
+	concurrentLogLimit uint,
+	logTimeLimit time.Duration,
+	opts ...Option,
+) (*Client, error) {
 	// create the in-cluster config
 	config, err := rest.InClusterConfig()
 	if err != nil {
 		return nil, err
 	}
+	c := Client{
+		config:         config,
+		logSem:         semaphore.NewWeighted(int64(concurrentLogLimit)),
+		logTimeLimit:   logTimeLimit,
+		logMaxLine:     defaultMaxLineLength,
+		logDefaultTail: defaultTailLines,
+		logMaxTail:     defaultMaxTailLines,
+		logLimitBytes:  defaultLimitBytes,
+		logQueueBytes:  defaultLogQueueBytes,
+		slowCall:       defaultSlowCallThreshold,
+		debugImage:     defaultDebugImage,
+	}
+	for _, opt := range opts {
+		opt(&c)
+	}
+	if c.metrics == nil {
+		c.metrics = NewMetrics(prometheus.NewRegistry())
+	}
+	// export client-side rate limiter metrics. Note that client-go only
+	// supports registering these metrics once per process.
+	metrics.Register(metrics.RegisterOpts{
+		RateLimiterLatency: rateLimiterMetric{latency: c.metrics.rateLimiterLatency},
+	})
 	// create the clientset
-	clientset, err := kubernetes.NewForConfig(config)
+	c.clientset, err = kubernetes.NewForConfig(c.config)
 	if err != nil {
 		return nil, err
 	}
-	return &Client{
-		config:       config,
-		clientset:    clientset,
-		logSem:       semaphore.NewWeighted(int64(concurrentLogLimit)),
-		logTimeLimit: logTimeLimit,
-	}, nil
+	return &c, nil
+}
+
+// APIRateLimit returns the effective client-side rate limit of the Kubernetes
+// API client as queries per second and burst.
+func (c *Client) APIRateLimit() (float32, int) {
+	return c.config.QPS, c.config.Burst
+}
+
+// observeCall records the duration of the given API call method which
+// started at start and had the given outcome, and logs a warning if the call
+// was slower than the slow call threshold.
+func (c *Client) observeCall(ctx context.Context, method string,
+	start time.Time, outcome string) {
+	duration := time.Since(start)
+	c.metrics.callDuration.WithLabelValues(method, outcome).
+		Observe(duration.Seconds())
+	if c.slowCall > 0 && duration > c.slowCall {
+		sessionlog.FromContext(ctx).Warn("slow Kubernetes API call",
+			slog.String("method", method),
+			slog.String("outcome", outcome),
+			slog.Duration("duration", duration))
+	}
 }
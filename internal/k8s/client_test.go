@@ -0,0 +1,98 @@
+package k8s
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/assert/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/rest"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestAPIRateLimit(t *testing.T) {
+	var testCases = map[string]struct {
+		qps   float32
+		burst int
+	}{
+		"client-go defaults": {qps: 5, burst: 10},
+		"raised limits":      {qps: 50, burst: 100},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			c := Client{config: &rest.Config{}}
+			APIRateLimit(tc.qps, tc.burst)(&c)
+			assert.Equal(tt, tc.qps, c.config.QPS, name)
+			assert.Equal(tt, tc.burst, c.config.Burst, name)
+			qps, burst := c.APIRateLimit()
+			assert.Equal(tt, tc.qps, qps, name)
+			assert.Equal(tt, tc.burst, burst, name)
+		})
+	}
+}
+
+// callCount returns the number of observations of the call duration metric
+// with the given labels.
+func callCount(tt *testing.T, m *Metrics, method, outcome string) uint64 {
+	h, ok := m.callDuration.WithLabelValues(method, outcome).(prometheus.Histogram)
+	if !ok {
+		tt.Fatal("couldn't get call duration histogram")
+	}
+	var metric dto.Metric
+	if err := h.Write(&metric); err != nil {
+		tt.Fatal(err)
+	}
+	return metric.GetHistogram().GetSampleCount()
+}
+
+// errorClientset returns a fake clientset which returns an error for all
+// API calls.
+func errorClientset() *fake.Clientset {
+	clientset := fake.NewClientset()
+	clientset.PrependReactor("*", "*",
+		func(_ k8stesting.Action) (bool, runtime.Object, error) {
+			return true, nil, errors.New("connection refused")
+		})
+	return clientset
+}
+
+func TestSlowCallThreshold(t *testing.T) {
+	var testCases = map[string]struct {
+		threshold  time.Duration
+		expectWarn bool
+	}{
+		"slow":     {threshold: time.Nanosecond, expectWarn: true},
+		"fast":     {threshold: time.Hour},
+		"disabled": {threshold: 0},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			// capture log output from the default logger
+			var buf bytes.Buffer
+			defaultLog := slog.Default()
+			slog.SetDefault(slog.New(slog.NewJSONHandler(&buf, nil)))
+			defer slog.SetDefault(defaultLog)
+			c := &Client{
+				clientset: fake.NewClientset(),
+				metrics:   NewMetrics(prometheus.NewRegistry()),
+			}
+			SlowCallThreshold(tc.threshold)(c)
+			_, _, err := c.FindDeployment(context.Background(), "testns", "nginx")
+			assert.Error(tt, err, name)
+			if tc.expectWarn {
+				assert.Contains(tt, buf.String(), "slow Kubernetes API call", name)
+				assert.Contains(tt, buf.String(), `"method":"FindDeployment"`, name)
+				assert.Contains(tt, buf.String(), `"outcome":"not-found"`, name)
+			} else {
+				assert.NotContains(tt, buf.String(), "slow Kubernetes API call", name)
+			}
+		})
+	}
+}
@@ -0,0 +1,218 @@
+package k8s
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilrand "k8s.io/apimachinery/pkg/util/rand"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/remotecommand"
+)
+
+// defaultDebugImage is the default image used for ephemeral debug
+// containers.
+const defaultDebugImage = "busybox"
+
+// debugContainerPrefix is the name prefix of ephemeral debug containers.
+const debugContainerPrefix = "debugger-"
+
+// ErrEphemeralContainersUnsupported is returned by Debug() if the Kubernetes
+// API doesn't support ephemeral containers.
+var ErrEphemeralContainersUnsupported = errors.New(
+	"ephemeral containers are not supported by this cluster")
+
+// ephemeralContainersUnsupported returns true if err, returned from an
+// update of the ephemeralcontainers subresource, indicates that the API
+// server doesn't support ephemeral containers.
+func ephemeralContainersUnsupported(err error) bool {
+	if apierrors.IsMethodNotSupported(err) {
+		return true
+	}
+	status, ok := err.(apierrors.APIStatus)
+	if !ok || !apierrors.IsNotFound(err) {
+		return false
+	}
+	// A NotFound error which doesn't name the pod refers to the subresource.
+	details := status.Status().Details
+	return details == nil || details.Name == ""
+}
+
+// debugContainer returns an ephemeral container with the given name and
+// image, which runs command in the process namespace of the target
+// container. Stdin is closed when the attached client disconnects, so that
+// an interactive shell exits at the end of the session.
+func debugContainer(name, target, image string, command []string,
+	tty bool) corev1.EphemeralContainer {
+	return corev1.EphemeralContainer{
+		TargetContainerName: target,
+		EphemeralContainerCommon: corev1.EphemeralContainerCommon{
+			Name:                     name,
+			Image:                    image,
+			Command:                  command,
+			Stdin:                    true,
+			StdinOnce:                true,
+			TTY:                      tty,
+			TerminationMessagePolicy: corev1.TerminationMessageReadFile,
+		},
+	}
+}
+
+// createDebugContainer adds an ephemeral debug container running command to
+// the given pod, targeting the given container. It returns the name of the
+// debug container.
+func (c *Client) createDebugContainer(ctx context.Context, namespace, pod,
+	target string, command []string, tty bool) (string, error) {
+	p, err := c.clientset.CoreV1().Pods(namespace).Get(ctx, pod,
+		metav1.GetOptions{})
+	if err != nil {
+		return "", fmt.Errorf("couldn't get pod: %w", err)
+	}
+	name := debugContainerPrefix + utilrand.String(5)
+	p.Spec.EphemeralContainers = append(p.Spec.EphemeralContainers,
+		debugContainer(name, target, c.debugImage, command, tty))
+	_, err = c.clientset.CoreV1().Pods(namespace).UpdateEphemeralContainers(ctx,
+		pod, p, metav1.UpdateOptions{})
+	if err != nil {
+		if ephemeralContainersUnsupported(err) {
+			return "", ErrEphemeralContainersUnsupported
+		}
+		return "", fmt.Errorf("couldn't add ephemeral container: %w", err)
+	}
+	return name, nil
+}
+
+// debugContainerRunning returns a condition which is true once the given
+// ephemeral container in the given pod is running. The condition returns an
+// error if the container has terminated.
+func (c *Client) debugContainerRunning(namespace, pod,
+	container string) wait.ConditionWithContextFunc {
+	return func(ctx context.Context) (bool, error) {
+		p, err := c.clientset.CoreV1().Pods(namespace).Get(ctx, pod,
+			metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		for _, cStatus := range p.Status.EphemeralContainerStatuses {
+			if cStatus.Name != container {
+				continue
+			}
+			if cStatus.State.Terminated != nil {
+				return false, fmt.Errorf("debug container terminated: %s",
+					cStatus.State.Terminated.Reason)
+			}
+			return cStatus.State.Running != nil, nil
+		}
+		return false, nil
+	}
+}
+
+// attachRequest configures req to attach to the given container. If tty is
+// true, stderr is not requested since it is merged into stdout by the
+// terminal.
+func attachRequest(req *rest.Request, namespace, pod, container string,
+	tty bool) *rest.Request {
+	return req.Namespace(namespace).Resource("pods").Name(pod).
+		SubResource("attach").VersionedParams(
+		&corev1.PodAttachOptions{
+			Container: container,
+			Stdin:     true,
+			Stdout:    true,
+			Stderr:    !tty,
+			TTY:       tty,
+		},
+		scheme.ParameterCodec,
+	)
+}
+
+// getDebugExecutor prepares the environment as getExecutor does, adds an
+// ephemeral debug container running command to the first pod of the
+// deployment, and returns an executor object which attaches to it.
+func (c *Client) getDebugExecutor(ctx context.Context, namespace, deployment,
+	container string, command []string, stderr io.Writer,
+	tty bool) (remotecommand.Executor, error) {
+	// See getExecutor() for the spinner and context cancellation order.
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	if tty {
+		wg := spinAfter(ctx, stderr, 2*time.Second)
+		defer wg.Wait()
+	}
+	defer cancel()
+	if err := c.unidle(ctx, namespace, deployment); err != nil {
+		return nil, err
+	}
+	firstPod, containers, err := c.podContainers(ctx, namespace, deployment)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get pod name: %w", err)
+	}
+	target, err := execContainer(containers, container)
+	if err != nil {
+		return nil, err
+	}
+	name, err := c.createDebugContainer(ctx, namespace, firstPod, target,
+		command, tty)
+	if err != nil {
+		return nil, err
+	}
+	err = wait.PollUntilContextTimeout(ctx, time.Second, timeout, true,
+		c.debugContainerRunning(namespace, firstPod, name))
+	if err != nil {
+		return nil, fmt.Errorf("couldn't start debug container: %w", err)
+	}
+	req := attachRequest(c.clientset.CoreV1().RESTClient().Post(), namespace,
+		firstPod, name, tty)
+	return c.executor(req.URL())
+}
+
+// Debug takes a target namespace, deployment, command, and IO streams, and
+// joins the streams to the command running in a new ephemeral container in a
+// pod inside the deployment. The ephemeral container uses the configured
+// debug image, and shares the process namespace of the given container, or
+// of the first container in the pod if none is given. This allows debugging
+// containers whose images have no shell.
+//
+// Ephemeral containers can't be removed from a pod, so the debug container
+// remains in the pod spec until the pod is deleted. Its process exits when
+// the client disconnects.
+//
+// If the given container does not exist in the pod, a
+// *ContainerNotFoundError is returned. If the deployment has been
+// deliberately scaled to zero, a *ScaledToZeroError is returned. If the
+// cluster doesn't support ephemeral containers,
+// ErrEphemeralContainersUnsupported is returned.
+func (c *Client) Debug(ctx context.Context, namespace, deployment,
+	container string, command []string, stdio io.ReadWriter, stderr io.Writer,
+	tty bool, winch <-chan ssh.Window) error {
+	exec, err := c.getDebugExecutor(ctx, namespace, deployment, container,
+		command, stderr, tty)
+	if err != nil {
+		switch err.(type) {
+		case *ContainerNotFoundError, *ScaledToZeroError:
+			return err
+		}
+		if errors.Is(err, ErrEphemeralContainersUnsupported) {
+			return err
+		}
+		return fmt.Errorf("couldn't get debug executor: %w", err)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	opts := remotecommand.StreamOptions{
+		Stdin:             stdio,
+		Stdout:            stdio,
+		Tty:               tty,
+		TerminalSizeQueue: newTermSizeQueue(ctx, winch),
+	}
+	if !tty {
+		opts.Stderr = stderr
+	}
+	return exec.StreamWithContext(ctx, opts)
+}
@@ -0,0 +1,198 @@
+package k8s
+
+import (
+	"context"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/alecthomas/assert/v2"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/rest"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// debugTestPod returns a pod in testns with a single nginx container.
+func debugTestPod() *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "nginx-123xyz",
+			Namespace: "testns",
+		},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{Name: "nginx"}},
+		},
+	}
+}
+
+func TestCreateDebugContainer(t *testing.T) {
+	var testCases = map[string]struct {
+		updateErr   error
+		tty         bool
+		expectErr   error
+		expectError bool
+	}{
+		"interactive": {
+			tty: true,
+		},
+		"no tty": {},
+		"unsupported": {
+			updateErr: apierrors.NewNotFound(schema.GroupResource{}, ""),
+			expectErr: ErrEphemeralContainersUnsupported,
+		},
+		"method not supported": {
+			updateErr: apierrors.NewMethodNotSupported(
+				schema.GroupResource{Resource: "pods"}, "update"),
+			expectErr: ErrEphemeralContainersUnsupported,
+		},
+		"forbidden": {
+			updateErr: apierrors.NewForbidden(
+				schema.GroupResource{Resource: "pods"}, "nginx-123xyz", nil),
+			expectError: true,
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			clientset := fake.NewClientset(debugTestPod())
+			if tc.updateErr != nil {
+				clientset.PrependReactor("update", "pods",
+					func(action k8stesting.Action) (bool, runtime.Object, error) {
+						if action.GetSubresource() != "ephemeralcontainers" {
+							return false, nil, nil
+						}
+						return true, nil, tc.updateErr
+					})
+			}
+			c := &Client{clientset: clientset, debugImage: "busybox:1.36"}
+			command := []string{"sh", "-c", "exec sh"}
+			container, err := c.createDebugContainer(context.Background(), "testns",
+				"nginx-123xyz", "nginx", command, tc.tty)
+			if tc.expectErr != nil {
+				assert.Equal(tt, tc.expectErr, err, name)
+				return
+			}
+			if tc.expectError {
+				assert.Error(tt, err, name)
+				assert.NotEqual(tt, ErrEphemeralContainersUnsupported, err, name)
+				return
+			}
+			assert.NoError(tt, err, name)
+			assert.True(tt, strings.HasPrefix(container, debugContainerPrefix), name)
+			pod, err := clientset.CoreV1().Pods("testns").Get(context.Background(),
+				"nginx-123xyz", metav1.GetOptions{})
+			assert.NoError(tt, err, name)
+			assert.Equal(tt, []corev1.EphemeralContainer{
+				debugContainer(container, "nginx", "busybox:1.36", command, tc.tty),
+			}, pod.Spec.EphemeralContainers, name)
+			ec := pod.Spec.EphemeralContainers[0]
+			assert.Equal(tt, "nginx", ec.TargetContainerName, name)
+			assert.True(tt, ec.Stdin && ec.StdinOnce, name)
+			assert.Equal(tt, tc.tty, ec.TTY, name)
+		})
+	}
+}
+
+func TestDebugContainerRunning(t *testing.T) {
+	var testCases = map[string]struct {
+		statuses    []corev1.ContainerStatus
+		expect      bool
+		expectError bool
+	}{
+		"no status": {},
+		"waiting": {
+			statuses: []corev1.ContainerStatus{{
+				Name: "debugger-abcde",
+				State: corev1.ContainerState{
+					Waiting: &corev1.ContainerStateWaiting{Reason: "PodInitializing"},
+				},
+			}},
+		},
+		"running": {
+			statuses: []corev1.ContainerStatus{
+				{
+					Name: "debugger-fghij",
+					State: corev1.ContainerState{
+						Terminated: &corev1.ContainerStateTerminated{},
+					},
+				},
+				{
+					Name: "debugger-abcde",
+					State: corev1.ContainerState{
+						Running: &corev1.ContainerStateRunning{},
+					},
+				},
+			},
+			expect: true,
+		},
+		"terminated": {
+			statuses: []corev1.ContainerStatus{{
+				Name: "debugger-abcde",
+				State: corev1.ContainerState{
+					Terminated: &corev1.ContainerStateTerminated{Reason: "Error"},
+				},
+			}},
+			expectError: true,
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			pod := debugTestPod()
+			pod.Status.EphemeralContainerStatuses = tc.statuses
+			c := &Client{clientset: fake.NewClientset(pod)}
+			running, err := c.debugContainerRunning("testns", "nginx-123xyz",
+				"debugger-abcde")(context.Background())
+			if tc.expectError {
+				assert.Error(tt, err, name)
+			} else {
+				assert.NoError(tt, err, name)
+			}
+			assert.Equal(tt, tc.expect, running, name)
+		})
+	}
+}
+
+func TestAttachRequest(t *testing.T) {
+	base, err := url.Parse("https://kubernetes.default.svc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var testCases = map[string]struct {
+		tty    bool
+		expect url.Values
+	}{
+		"tty": {
+			tty: true,
+			expect: url.Values{
+				"container": {"debugger-abcde"},
+				"stdin":     {"true"},
+				"stdout":    {"true"},
+				"tty":       {"true"},
+			},
+		},
+		"no tty": {
+			expect: url.Values{
+				"container": {"debugger-abcde"},
+				"stdin":     {"true"},
+				"stdout":    {"true"},
+				"stderr":    {"true"},
+			},
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			content := rest.ClientContentConfig{GroupVersion: corev1.SchemeGroupVersion}
+			req := rest.NewRequestWithClient(base, "/api/v1", content, nil).
+				Verb("POST")
+			u := attachRequest(req, "testns", "nginx-123xyz", "debugger-abcde",
+				tc.tty).URL()
+			assert.Equal(tt,
+				"/api/v1/namespaces/testns/pods/nginx-123xyz/attach", u.Path, name)
+			assert.Equal(tt, tc.expect, u.Query(), name)
+		})
+	}
+}
@@ -2,15 +2,22 @@
 package k8s
 
 import (
+	"cmp"
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"net/url"
+	"slices"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gliderlabs/ssh"
+	"github.com/uselagoon/ssh-portal/internal/retry"
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/util/wait"
@@ -33,35 +40,157 @@ var (
 		"idling.lagoon.sh/watch=true",
 		"idling.amazee.io/watch=true",
 	}
+	// scaleConflictBackoff retries scaling a deployment when the update
+	// conflicts with a concurrent change to the deployment, such as another
+	// session unidling the same namespace.
+	scaleConflictBackoff = retry.Must(retry.New(
+		retry.Base(50*time.Millisecond),
+		retry.Cap(time.Second),
+		retry.RetryIf(apierrors.IsConflict)))
 )
 
-// podContainer returns the first pod and first container inside that pod for
-// the given namespace and deployment.
-func (c *Client) podContainer(ctx context.Context, namespace,
-	deployment string) (string, string, error) {
+// ContainerNotFoundError is returned when the requested container does not
+// exist in the pod selected for exec.
+type ContainerNotFoundError struct {
+	// Container is the name of the requested container.
+	Container string
+	// Available is the names of the containers in the pod.
+	Available []string
+}
+
+func (e *ContainerNotFoundError) Error() string {
+	return fmt.Sprintf("unknown container %s. Available containers: %s",
+		e.Container, strings.Join(e.Available, ", "))
+}
+
+// InitContainerError is returned when the pod selected for exec has not
+// started because one of its init containers has not completed.
+type InitContainerError struct {
+	// Pod is the name of the pod.
+	Pod string
+	// Container is the name of the init container.
+	Container string
+	// State describes the state of the init container, e.g. "running" or the
+	// reason it is waiting or terminated.
+	State string
+	// Err is the error which occurred while waiting for the pod to start, if
+	// any.
+	Err error
+}
+
+func (e *InitContainerError) Error() string {
+	msg := fmt.Sprintf("pod %s is blocked on init container %s (%s)",
+		e.Pod, e.Container, e.State)
+	if e.Err != nil {
+		return fmt.Sprintf("%v: %s", e.Err, msg)
+	}
+	return msg
+}
+
+func (e *InitContainerError) Unwrap() error {
+	return e.Err
+}
+
+// blockedOnInitContainer returns an *InitContainerError describing the first
+// init container of the given pending pod which has not completed. It returns
+// nil if the pod is not pending, or is not blocked on an init container.
+func blockedOnInitContainer(pod *corev1.Pod) *InitContainerError {
+	if pod.Status.Phase != corev1.PodPending {
+		return nil
+	}
+	for _, cStatus := range pod.Status.InitContainerStatuses {
+		var state string
+		switch {
+		case cStatus.State.Terminated != nil:
+			if cStatus.State.Terminated.ExitCode == 0 {
+				continue // completed
+			}
+			state = cmp.Or(cStatus.State.Terminated.Reason, "terminated")
+		case cStatus.State.Running != nil:
+			state = "running"
+		case cStatus.State.Waiting != nil:
+			state = cmp.Or(cStatus.State.Waiting.Reason, "waiting")
+		default:
+			state = "unknown"
+		}
+		return &InitContainerError{
+			Pod:       pod.Name,
+			Container: cStatus.Name,
+			State:     state,
+		}
+	}
+	return nil
+}
+
+// ScaledToZeroError is returned when the requested deployment has been
+// deliberately scaled to zero replicas, and so will not be unidled.
+type ScaledToZeroError struct {
+	// Deployment is the name of the deployment.
+	Deployment string
+}
+
+func (e *ScaledToZeroError) Error() string {
+	return fmt.Sprintf(
+		"service %s is scaled to zero and is not configured for unidling",
+		e.Deployment)
+}
+
+// podContainers returns the first pod and the names of the containers inside
+// that pod for the given namespace and deployment. If the first pod is blocked
+// on an init container, an *InitContainerError is returned.
+func (c *Client) podContainers(ctx context.Context, namespace,
+	deployment string) (string, []string, error) {
 	d, err := c.clientset.AppsV1().Deployments(namespace).Get(ctx, deployment,
 		metav1.GetOptions{})
 	if err != nil {
-		return "", "", err
+		return "", nil, err
 	}
 	pods, err := c.clientset.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{
 		LabelSelector: labels.FormatLabels(d.Spec.Selector.MatchLabels),
 	})
 	if err != nil {
-		return "", "", err
+		return "", nil, err
 	}
 	if len(pods.Items) == 0 {
-		return "", "", fmt.Errorf("no pods for deployment %s", deployment)
+		return "", nil, fmt.Errorf("no pods for deployment %s", deployment)
+	}
+	if blocked := blockedOnInitContainer(&pods.Items[0]); blocked != nil {
+		return "", nil, blocked
 	}
 	if len(pods.Items[0].Spec.Containers) == 0 {
-		return "", "", fmt.Errorf("no containers for pod %s in deployment %s",
+		return "", nil, fmt.Errorf("no containers for pod %s in deployment %s",
 			pods.Items[0].Name, deployment)
 	}
-	return pods.Items[0].Name, pods.Items[0].Spec.Containers[0].Name, nil
+	var containers []string
+	for _, container := range pods.Items[0].Spec.Containers {
+		containers = append(containers, container.Name)
+	}
+	return pods.Items[0].Name, containers, nil
 }
 
+// execContainer returns the container to exec into, given the names of the
+// containers in the pod and the requested container. If the requested
+// container is empty, the first container is returned. If the requested
+// container is not in the pod, a *ContainerNotFoundError is returned.
+func execContainer(containers []string, container string) (string, error) {
+	if container == "" {
+		return containers[0], nil
+	}
+	if !slices.Contains(containers, container) {
+		return "", &ContainerNotFoundError{
+			Container: container,
+			Available: containers,
+		}
+	}
+	return container, nil
+}
+
+// hasRunningPod returns a condition which is true once the first pod of the
+// given deployment is running. While it is not running, blocked is set to
+// describe the init container it is blocked on, if any.
 func (c *Client) hasRunningPod(ctx context.Context,
-	namespace, deployment string) wait.ConditionWithContextFunc {
+	namespace, deployment string,
+	blocked **InitContainerError) wait.ConditionWithContextFunc {
 	return func(context.Context) (bool, error) {
 		d, err := c.clientset.AppsV1().Deployments(namespace).Get(ctx, deployment,
 			metav1.GetOptions{})
@@ -77,6 +206,7 @@ func (c *Client) hasRunningPod(ctx context.Context,
 		if len(pods.Items) == 0 {
 			return false, nil
 		}
+		*blocked = blockedOnInitContainer(&pods.Items[0])
 		return pods.Items[0].Status.Phase == "Running", nil
 	}
 }
@@ -102,6 +232,25 @@ func unidleReplicas(deploy appsv1.Deployment) int {
 	return 1
 }
 
+// idleConfigured returns true if the deployment has any of the
+// idleReplicaAnnotations or idleWatchLabels, which indicates that a
+// deployment with zero replicas has been idled rather than deliberately
+// scaled to zero.
+func idleConfigured(deploy *appsv1.Deployment) bool {
+	for _, ra := range idleReplicaAnnotations {
+		if _, ok := deploy.Annotations[ra]; ok {
+			return true
+		}
+	}
+	for _, wl := range idleWatchLabels {
+		k, v, _ := strings.Cut(wl, "=")
+		if deploy.Labels[k] == v {
+			return true
+		}
+	}
+	return false
+}
+
 // idledDeploys returns the DeploymentList of idled deployments in the given
 // namespace.
 func (c *Client) idledDeploys(ctx context.Context, namespace string) (
@@ -114,7 +263,7 @@ func (c *Client) idledDeploys(ctx context.Context, namespace string) (
 				LabelSelector: selector,
 			})
 		if err != nil {
-			return nil, fmt.Errorf("couldn't select deploys by label: %v", err)
+			return nil, fmt.Errorf("couldn't select deploys by label: %w", err)
 		}
 		if deploys != nil && len(deploys.Items) > 0 {
 			return deploys, nil
@@ -124,57 +273,142 @@ func (c *Client) idledDeploys(ctx context.Context, namespace string) (
 }
 
 // unidleNamespace scales all deployments with the idleWatchLabels up to the
-// number of replicas in the idleReplicaAnnotations.
-func (c *Client) unidleNamespace(ctx context.Context, namespace string) error {
+// number of replicas in the idleReplicaAnnotations. It returns true if any
+// deployment was scaled up.
+func (c *Client) unidleNamespace(ctx context.Context, namespace string) (
+	bool, error,
+) {
 	deploys, err := c.idledDeploys(ctx, namespace)
 	if err != nil {
-		return fmt.Errorf("couldn't get idled deploys: %v", err)
+		return false, fmt.Errorf("couldn't get idled deploys: %w", err)
 	}
 	if deploys == nil {
-		return nil // no deploys to unidle
+		return false, nil // no deploys to unidle
 	}
+	var unidled bool
 	for _, deploy := range deploys.Items {
-		// check if idled
+		scaled, err := c.scaleFromZero(ctx, namespace, deploy.Name,
+			int32(unidleReplicas(deploy)))
+		if err != nil {
+			return unidled, err
+		}
+		unidled = unidled || scaled
+	}
+	return unidled, nil
+}
+
+// scaleFromZero scales the given deployment to the given number of replicas
+// if it has none, and returns true if it was scaled. If the update conflicts
+// with a concurrent change to the deployment, the scale is read again and the
+// update retried, so a deployment scaled up concurrently is left alone.
+func (c *Client) scaleFromZero(ctx context.Context, namespace,
+	deployment string, replicas int32) (bool, error) {
+	var scaled bool
+	err := scaleConflictBackoff.Do(ctx, func(ctx context.Context) error {
 		s, err := c.clientset.AppsV1().Deployments(namespace).
-			GetScale(ctx, deploy.Name, metav1.GetOptions{})
+			GetScale(ctx, deployment, metav1.GetOptions{})
 		if err != nil {
-			return fmt.Errorf("couldn't get deployment scale: %v", err)
+			return err
 		}
 		if s.Spec.Replicas > 0 {
-			continue
+			return nil
 		}
-		// scale up the deployment
 		sc := *s
-		sc.Spec.Replicas = int32(unidleReplicas(deploy))
+		sc.Spec.Replicas = replicas
 		_, err = c.clientset.AppsV1().Deployments(namespace).
-			UpdateScale(ctx, deploy.Name, &sc, metav1.UpdateOptions{})
+			UpdateScale(ctx, deployment, &sc, metav1.UpdateOptions{})
 		if err != nil {
-			return fmt.Errorf("couldn't scale deployment: %v", err)
+			return err
 		}
+		scaled = true
+		return nil
+	})
+	if err != nil {
+		return false, fmt.Errorf("couldn't scale deployment: %w", err)
 	}
-	return nil
+	return scaled, nil
 }
 
-func (c *Client) ensureScaled(ctx context.Context, namespace, deployment string) error {
+// ensureScaled scales the given deployment up to one replica if it has none,
+// and waits for a pod in the deployment to start running. It returns true if
+// the deployment was scaled up. If the deployment has no replicas and is not
+// configured for idling, it returns a *ScaledToZeroError without waiting. If
+// the pod doesn't start because it is blocked on an init container, an
+// *InitContainerError wrapping the wait error is returned.
+func (c *Client) ensureScaled(ctx context.Context, namespace,
+	deployment string) (bool, error) {
 	// get current scale
 	s, err := c.clientset.AppsV1().Deployments(namespace).
 		GetScale(ctx, deployment, metav1.GetOptions{})
 	if err != nil {
-		return fmt.Errorf("couldn't get deployment scale: %v", err)
+		return false, fmt.Errorf("couldn't get deployment scale: %w", err)
 	}
 	// scale up the deployment if required
+	var scaled bool
 	if s.Spec.Replicas == 0 {
-		sc := *s
-		sc.Spec.Replicas = 1
-		_, err = c.clientset.AppsV1().Deployments(namespace).
-			UpdateScale(ctx, deployment, &sc, metav1.UpdateOptions{})
+		d, err := c.clientset.AppsV1().Deployments(namespace).
+			Get(ctx, deployment, metav1.GetOptions{})
 		if err != nil {
-			return fmt.Errorf("couldn't scale deployment: %v", err)
+			return false, fmt.Errorf("couldn't get deployment: %w", err)
+		}
+		if !idleConfigured(d) {
+			return false, &ScaledToZeroError{Deployment: deployment}
+		}
+		scaled, err = c.scaleFromZero(ctx, namespace, deployment, 1)
+		if err != nil {
+			return false, err
 		}
 	}
 	// wait for a pod to start running
-	return wait.PollUntilContextTimeout(ctx, time.Second, timeout, true,
-		c.hasRunningPod(ctx, namespace, deployment))
+	var blocked *InitContainerError
+	err = wait.PollUntilContextTimeout(ctx, time.Second, timeout, true,
+		c.hasRunningPod(ctx, namespace, deployment, &blocked))
+	if err != nil && blocked != nil {
+		blocked.Err = err
+		return scaled, blocked
+	}
+	return scaled, err
+}
+
+// unidle unidles the given namespace and ensures that the given deployment
+// has a running pod. If this required any deployment to be scaled up, the
+// outcome and duration are recorded in the unidle metrics.
+func (c *Client) unidle(ctx context.Context, namespace,
+	deployment string) error {
+	start := time.Now()
+	unidled, err := c.unidleNamespace(ctx, namespace)
+	if err != nil {
+		if unidled {
+			c.observeUnidle(start, err)
+		}
+		return fmt.Errorf("couldn't unidle namespace: %w", err)
+	}
+	scaled, err := c.ensureScaled(ctx, namespace, deployment)
+	if unidled || scaled {
+		c.observeUnidle(start, err)
+	}
+	if err != nil {
+		if _, ok := err.(*ScaledToZeroError); ok {
+			return err
+		}
+		return fmt.Errorf("couldn't scale deployment: %w", err)
+	}
+	return nil
+}
+
+// observeUnidle records the outcome of unidling which started at start and
+// finished with the given error.
+func (c *Client) observeUnidle(start time.Time, err error) {
+	switch {
+	case err == nil:
+		c.metrics.unidleTotal.WithLabelValues(unidleOutcomeSuccess).Inc()
+		c.metrics.unidleDuration.Observe(time.Since(start).Seconds())
+	case errors.Is(err, context.DeadlineExceeded):
+		c.metrics.unidleTotal.WithLabelValues(unidleOutcomeTimeout).Inc()
+		c.metrics.unidleTimeoutSessions.Inc()
+	default:
+		c.metrics.unidleTotal.WithLabelValues(unidleOutcomeError).Inc()
+	}
 }
 
 // getExecutor prepares the environment by ensuring pods are scaled etc. and
@@ -193,22 +427,20 @@ func (c *Client) getExecutor(ctx context.Context, namespace, deployment,
 		defer wg.Wait()
 	}
 	defer cancel()
-	// unidle the entire namespace asynchronously
-	if err := c.unidleNamespace(ctx, namespace); err != nil {
-		return nil, fmt.Errorf("couldn't unidle namespace: %v", err)
-	}
-	// ensure the target deployment has at least one replica
-	if err := c.ensureScaled(ctx, namespace, deployment); err != nil {
-		return nil, fmt.Errorf("couldn't scale deployment: %v", err)
+	// unidle the entire namespace asynchronously, and ensure the target
+	// deployment has at least one replica
+	if err := c.unidle(ctx, namespace, deployment); err != nil {
+		return nil, err
 	}
-	// get the name of the first pod and first container
-	firstPod, firstContainer, err := c.podContainer(ctx, namespace, deployment)
+	// get the name of the first pod and its containers
+	firstPod, containers, err := c.podContainers(ctx, namespace, deployment)
 	if err != nil {
-		return nil, fmt.Errorf("couldn't get pod name: %v", err)
+		return nil, fmt.Errorf("couldn't get pod name: %w", err)
 	}
 	// check if we were given a container. If not, use the first container found.
-	if container == "" {
-		container = firstContainer
+	container, err = execContainer(containers, container)
+	if err != nil {
+		return nil, err
 	}
 	// construct the request
 	req := c.clientset.CoreV1().RESTClient().Post().Namespace(namespace).
@@ -225,19 +457,35 @@ func (c *Client) getExecutor(ctx context.Context, namespace, deployment,
 		scheme.ParameterCodec,
 	)
 	// construct the executor
-	return remotecommand.NewSPDYExecutor(c.config, "POST", req.URL())
+	return c.executor(req.URL())
+}
+
+// executor returns an executor for the exec or attach request URL u.
+func (c *Client) executor(u *url.URL) (remotecommand.Executor, error) {
+	newExecutor := c.newExecutor
+	if newExecutor == nil {
+		newExecutor = remotecommand.NewSPDYExecutor
+	}
+	return newExecutor(c.config, "POST", u)
 }
 
 // Exec takes a target namespace, deployment, command, and IO streams, and
 // joins the streams to the command, or if command is empty to an interactive
-// shell, running in a pod inside the deployment.
+// shell, running in a pod inside the deployment. If the given container does
+// not exist in the pod, a *ContainerNotFoundError is returned. If the
+// deployment has been deliberately scaled to zero, a *ScaledToZeroError is
+// returned.
 func (c *Client) Exec(ctx context.Context, namespace, deployment,
 	container string, command []string, stdio io.ReadWriter, stderr io.Writer,
 	tty bool, winch <-chan ssh.Window) error {
 	exec, err := c.getExecutor(ctx, namespace, deployment, container, command,
 		stderr, tty)
 	if err != nil {
-		return fmt.Errorf("couldn't get executor: %v", err)
+		switch err.(type) {
+		case *ContainerNotFoundError, *ScaledToZeroError:
+			return err
+		}
+		return fmt.Errorf("couldn't get executor: %w", err)
 	}
 	// Ensure the TerminalSizeQueue goroutine is cancelled immediately after
 	// command exection completes by deferring its cancellation here.
@@ -2,12 +2,23 @@ package k8s
 
 import (
 	"context"
+	"errors"
 	"testing"
+	"time"
 
 	"github.com/alecthomas/assert/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/uselagoon/ssh-portal/internal/retry"
 	appsv1 "k8s.io/api/apps/v1"
+	autoscalingv1 "k8s.io/api/autoscaling/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
 )
 
 func TestUnidleReplicasParsing(t *testing.T) {
@@ -161,3 +172,490 @@ func TestIdledDeployLabels(t *testing.T) {
 		})
 	}
 }
+
+func TestPodContainers(t *testing.T) {
+	testNS := "testns"
+	deploy := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "nginx",
+			Namespace: testNS,
+		},
+		Spec: appsv1.DeploymentSpec{
+			Selector: &metav1.LabelSelector{
+				MatchLabels: map[string]string{"app": "nginx"},
+			},
+		},
+	}
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "nginx-abc123",
+			Namespace: testNS,
+			Labels:    map[string]string{"app": "nginx"},
+		},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{Name: "nginx"}, {Name: "php"}},
+		},
+	}
+	c := &Client{
+		clientset: fake.NewClientset(deploy, pod),
+	}
+	podName, containers, err :=
+		c.podContainers(context.Background(), testNS, "nginx")
+	assert.NoError(t, err)
+	assert.Equal(t, "nginx-abc123", podName)
+	assert.Equal(t, []string{"nginx", "php"}, containers)
+}
+
+func TestPodContainersInitContainer(t *testing.T) {
+	testNS := "testns"
+	deploy := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "nginx",
+			Namespace: testNS,
+		},
+		Spec: appsv1.DeploymentSpec{
+			Selector: &metav1.LabelSelector{
+				MatchLabels: map[string]string{"app": "nginx"},
+			},
+		},
+	}
+	var testCases = map[string]struct {
+		phase     corev1.PodPhase
+		state     corev1.ContainerState
+		expectErr string
+	}{
+		"running": {
+			phase: corev1.PodPending,
+			state: corev1.ContainerState{
+				Running: &corev1.ContainerStateRunning{},
+			},
+			expectErr: "pod nginx-abc123 is blocked on init container " +
+				"migrate (running)",
+		},
+		"failed": {
+			phase: corev1.PodPending,
+			state: corev1.ContainerState{
+				Terminated: &corev1.ContainerStateTerminated{
+					ExitCode: 1,
+					Reason:   "Error",
+				},
+			},
+			expectErr: "pod nginx-abc123 is blocked on init container " +
+				"migrate (Error)",
+		},
+		"crash loop": {
+			phase: corev1.PodPending,
+			state: corev1.ContainerState{
+				Waiting: &corev1.ContainerStateWaiting{
+					Reason: "CrashLoopBackOff",
+				},
+			},
+			expectErr: "pod nginx-abc123 is blocked on init container " +
+				"migrate (CrashLoopBackOff)",
+		},
+		"completed": {
+			phase: corev1.PodRunning,
+			state: corev1.ContainerState{
+				Terminated: &corev1.ContainerStateTerminated{
+					Reason: "Completed",
+				},
+			},
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "nginx-abc123",
+					Namespace: testNS,
+					Labels:    map[string]string{"app": "nginx"},
+				},
+				Spec: corev1.PodSpec{
+					InitContainers: []corev1.Container{{Name: "migrate"}},
+					Containers:     []corev1.Container{{Name: "nginx"}},
+				},
+				Status: corev1.PodStatus{
+					Phase: tc.phase,
+					InitContainerStatuses: []corev1.ContainerStatus{{
+						Name:  "migrate",
+						State: tc.state,
+					}},
+				},
+			}
+			c := &Client{
+				clientset: fake.NewClientset(deploy, pod),
+			}
+			_, containers, err :=
+				c.podContainers(context.Background(), testNS, "nginx")
+			if tc.expectErr != "" {
+				var initErr *InitContainerError
+				assert.True(tt, errors.As(err, &initErr), name)
+				assert.EqualError(tt, err, tc.expectErr, name)
+				return
+			}
+			assert.NoError(tt, err, name)
+			assert.Equal(tt, []string{"nginx"}, containers, name)
+		})
+	}
+}
+
+func TestEnsureScaledInitContainer(t *testing.T) {
+	testNS := "testns"
+	deploy := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "solr",
+			Namespace: testNS,
+		},
+		Spec: appsv1.DeploymentSpec{
+			Selector: &metav1.LabelSelector{
+				MatchLabels: map[string]string{"app": "solr"},
+			},
+		},
+	}
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "solr-abc123",
+			Namespace: testNS,
+			Labels:    map[string]string{"app": "solr"},
+		},
+		Status: corev1.PodStatus{
+			Phase: corev1.PodPending,
+			InitContainerStatuses: []corev1.ContainerStatus{{
+				Name: "migrate",
+				State: corev1.ContainerState{
+					Running: &corev1.ContainerStateRunning{},
+				},
+			}},
+		},
+	}
+	clientset := fake.NewClientset(deploy, pod)
+	scaleReactors(clientset, 1)
+	c := &Client{
+		clientset: clientset,
+		metrics:   NewMetrics(prometheus.NewRegistry()),
+	}
+	ctx, cancel :=
+		context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err := c.ensureScaled(ctx, testNS, "solr")
+	assert.Error(t, err)
+	// the wait error is still identifiable as a timeout
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+	assert.Contains(t, err.Error(),
+		"pod solr-abc123 is blocked on init container migrate (running)")
+}
+
+func TestExecContainer(t *testing.T) {
+	containers := []string{"nginx", "php"}
+	var testCases = map[string]struct {
+		container string
+		expect    string
+		expectErr error
+	}{
+		"valid": {
+			container: "php",
+			expect:    "php",
+		},
+		"invalid": {
+			container: "typo",
+			expectErr: &ContainerNotFoundError{
+				Container: "typo",
+				Available: containers,
+			},
+		},
+		"empty": {
+			expect: "nginx",
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			container, err := execContainer(containers, tc.container)
+			assert.Equal(tt, tc.expectErr, err, name)
+			assert.Equal(tt, tc.expect, container, name)
+		})
+	}
+}
+
+func TestContainerNotFoundError(t *testing.T) {
+	err := &ContainerNotFoundError{
+		Container: "typo",
+		Available: []string{"nginx", "php"},
+	}
+	assert.Equal(t,
+		"unknown container typo. Available containers: nginx, php", err.Error())
+}
+
+// scaleReactors configures the fake clientset to report the given number of
+// replicas for all deployments, and to accept updates to the scale.
+func scaleReactors(clientset *fake.Clientset, replicas int32) {
+	clientset.PrependReactor("get", "deployments",
+		func(action k8stesting.Action) (bool, runtime.Object, error) {
+			get := action.(k8stesting.GetAction)
+			if get.GetSubresource() != "scale" {
+				return false, nil, nil
+			}
+			return true, &autoscalingv1.Scale{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      get.GetName(),
+					Namespace: get.GetNamespace(),
+				},
+				Spec: autoscalingv1.ScaleSpec{Replicas: replicas},
+			}, nil
+		})
+	clientset.PrependReactor("update", "deployments",
+		func(action k8stesting.Action) (bool, runtime.Object, error) {
+			update := action.(k8stesting.UpdateAction)
+			if update.GetSubresource() != "scale" {
+				return false, nil, nil
+			}
+			return true, update.GetObject(), nil
+		})
+}
+
+func TestUnidleMetrics(t *testing.T) {
+	testNS := "testns"
+	var testCases = map[string]struct {
+		replicas       int32
+		podPhase       corev1.PodPhase
+		expectErr      bool
+		expectSuccess  float64
+		expectTimeout  float64
+		expectDuration uint64
+	}{
+		"running": {
+			replicas: 1,
+			podPhase: corev1.PodRunning,
+		},
+		"unidled": {
+			replicas:       0,
+			podPhase:       corev1.PodRunning,
+			expectSuccess:  1,
+			expectDuration: 1,
+		},
+		"unidle timeout": {
+			replicas:      0,
+			podPhase:      corev1.PodPending,
+			expectErr:     true,
+			expectTimeout: 1,
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			deploy := &appsv1.Deployment{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "nginx",
+					Namespace: testNS,
+					Labels: map[string]string{
+						"idling.lagoon.sh/watch": "true",
+					},
+				},
+				Spec: appsv1.DeploymentSpec{
+					Selector: &metav1.LabelSelector{
+						MatchLabels: map[string]string{"app": "nginx"},
+					},
+				},
+			}
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "nginx-abc123",
+					Namespace: testNS,
+					Labels:    map[string]string{"app": "nginx"},
+				},
+				Status: corev1.PodStatus{Phase: tc.podPhase},
+			}
+			clientset := fake.NewClientset(deploy, pod)
+			scaleReactors(clientset, tc.replicas)
+			m := NewMetrics(prometheus.NewRegistry())
+			c := &Client{
+				clientset: clientset,
+				metrics:   m,
+			}
+			ctx, cancel :=
+				context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+			err := c.unidle(ctx, testNS, "nginx")
+			if tc.expectErr {
+				assert.Error(tt, err, name)
+			} else {
+				assert.NoError(tt, err, name)
+			}
+			assert.Equal(tt, tc.expectSuccess, testutil.ToFloat64(
+				m.unidleTotal.WithLabelValues(unidleOutcomeSuccess)), name)
+			assert.Equal(tt, tc.expectTimeout, testutil.ToFloat64(
+				m.unidleTotal.WithLabelValues(unidleOutcomeTimeout)), name)
+			assert.Equal(tt, float64(0), testutil.ToFloat64(
+				m.unidleTotal.WithLabelValues(unidleOutcomeError)), name)
+			assert.Equal(tt, tc.expectTimeout,
+				testutil.ToFloat64(m.unidleTimeoutSessions), name)
+			var metric dto.Metric
+			assert.NoError(tt, m.unidleDuration.Write(&metric), name)
+			assert.Equal(tt, tc.expectDuration,
+				metric.GetHistogram().GetSampleCount(), name)
+		})
+	}
+}
+
+func TestScaledToZeroError(t *testing.T) {
+	err := &ScaledToZeroError{Deployment: "solr"}
+	assert.Equal(t,
+		"service solr is scaled to zero and is not configured for unidling",
+		err.Error())
+}
+
+func TestEnsureScaled(t *testing.T) {
+	testNS := "testns"
+	var testCases = map[string]struct {
+		replicas     int32
+		annotations  map[string]string
+		labels       map[string]string
+		expectScaled bool
+		expectErr    error
+	}{
+		"running": {
+			replicas: 1,
+		},
+		"annotated idle": {
+			replicas: 0,
+			annotations: map[string]string{
+				"idling.lagoon.sh/unidle-replicas": "2",
+			},
+			expectScaled: true,
+		},
+		"legacy annotated idle": {
+			replicas: 0,
+			annotations: map[string]string{
+				"idling.amazee.io/unidle-replicas": "1",
+			},
+			expectScaled: true,
+		},
+		"watched idle": {
+			replicas:     0,
+			labels:       map[string]string{"idling.lagoon.sh/watch": "true"},
+			expectScaled: true,
+		},
+		"intentionally zero": {
+			replicas:  0,
+			labels:    map[string]string{"idling.lagoon.sh/watch": "false"},
+			expectErr: &ScaledToZeroError{Deployment: "solr"},
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			deploy := &appsv1.Deployment{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        "solr",
+					Namespace:   testNS,
+					Annotations: tc.annotations,
+					Labels:      tc.labels,
+				},
+				Spec: appsv1.DeploymentSpec{
+					Selector: &metav1.LabelSelector{
+						MatchLabels: map[string]string{"app": "solr"},
+					},
+				},
+			}
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "solr-abc123",
+					Namespace: testNS,
+					Labels:    map[string]string{"app": "solr"},
+				},
+				Status: corev1.PodStatus{Phase: corev1.PodRunning},
+			}
+			clientset := fake.NewClientset(deploy, pod)
+			scaleReactors(clientset, tc.replicas)
+			c := &Client{
+				clientset: clientset,
+				metrics:   NewMetrics(prometheus.NewRegistry()),
+			}
+			// if the poll wait were not skipped for a deployment which is
+			// intentionally scaled to zero, a timeout error would be returned
+			ctx, cancel :=
+				context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+			scaled, err := c.ensureScaled(ctx, testNS, "solr")
+			assert.Equal(tt, tc.expectErr, err, name)
+			assert.Equal(tt, tc.expectScaled, scaled, name)
+		})
+	}
+}
+
+func TestScaleFromZeroConflict(t *testing.T) {
+	// retry without waiting
+	original := scaleConflictBackoff
+	t.Cleanup(func() { scaleConflictBackoff = original })
+	scaleConflictBackoff = retry.Must(retry.New(
+		retry.RetryIf(apierrors.IsConflict),
+		retry.Clock(func(time.Duration) <-chan time.Time {
+			ch := make(chan time.Time, 1)
+			ch <- time.Time{}
+			return ch
+		})))
+	var testCases = map[string]struct {
+		conflicts      int
+		scaledOnRetry  bool
+		expectScaled   bool
+		expectUpdates  int
+		expectConflict bool
+	}{
+		"no conflict": {
+			expectScaled:  true,
+			expectUpdates: 1,
+		},
+		"conflict": {
+			conflicts:     2,
+			expectScaled:  true,
+			expectUpdates: 3,
+		},
+		"scaled concurrently": {
+			conflicts:     1,
+			scaledOnRetry: true,
+			expectUpdates: 1,
+		},
+		"persistent conflict": {
+			conflicts:      retry.DefaultMaxAttempts,
+			expectUpdates:  retry.DefaultMaxAttempts,
+			expectConflict: true,
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			var updates int
+			clientset := fake.NewClientset()
+			clientset.PrependReactor("get", "deployments",
+				func(action k8stesting.Action) (bool, runtime.Object, error) {
+					var replicas int32
+					if tc.scaledOnRetry && updates > 0 {
+						replicas = 1
+					}
+					return true, &autoscalingv1.Scale{
+						ObjectMeta: metav1.ObjectMeta{Name: "nginx"},
+						Spec:       autoscalingv1.ScaleSpec{Replicas: replicas},
+					}, nil
+				})
+			clientset.PrependReactor("update", "deployments",
+				func(action k8stesting.Action) (bool, runtime.Object, error) {
+					updates++
+					if updates <= tc.conflicts {
+						return true, nil, apierrors.NewConflict(
+							autoscalingv1.Resource("scale"), "nginx",
+							errors.New("object has been modified"))
+					}
+					update := action.(k8stesting.UpdateAction)
+					return true, update.GetObject(), nil
+				})
+			c := &Client{clientset: clientset}
+			scaled, err := c.scaleFromZero(context.Background(), "testns",
+				"nginx", 2)
+			if tc.expectConflict {
+				assert.Error(tt, err, name)
+				assert.Contains(tt, err.Error(), "object has been modified",
+					name)
+			} else {
+				assert.NoError(tt, err, name)
+			}
+			assert.Equal(tt, tc.expectScaled, scaled, name)
+			assert.Equal(tt, tc.expectUpdates, updates, name)
+		})
+	}
+}
@@ -2,25 +2,102 @@ package k8s
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"slices"
+	"strconv"
+	"time"
 
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
+const (
+	// ExecAnnotation may be set to "false" on a deployment to refuse exec and
+	// sftp sessions to it.
+	ExecAnnotation = "ssh.lagoon.sh/exec"
+	// LogsAnnotation may be set to "false" on a deployment to refuse logs
+	// sessions to it.
+	LogsAnnotation = "ssh.lagoon.sh/logs"
+)
+
+// ErrDeploymentNotFound is wrapped by the error returned by FindDeployment if
+// there is no deployment for the given service.
+var ErrDeploymentNotFound = errors.New("deployment not found")
+
+// DeploymentAccess describes the types of SSH session permitted to a
+// deployment by its annotations.
+type DeploymentAccess struct {
+	// Exec is true if exec and sftp sessions are permitted.
+	Exec bool
+	// Logs is true if logs sessions are permitted.
+	Logs bool
+}
+
+// annotationEnabled returns true if the given annotation is not set, or is
+// set to a true value. Values which can't be parsed as a boolean are treated
+// as false, so that a typo in the annotation can't enable access.
+func annotationEnabled(annotations map[string]string, annotation string) bool {
+	value, ok := annotations[annotation]
+	if !ok {
+		return true
+	}
+	enabled, err := strconv.ParseBool(value)
+	return err == nil && enabled
+}
+
 // FindDeployment searches the given namespace for a deployment with a matching
-// lagoon.sh/service= label, and returns the name of that deployment.
+// lagoon.sh/service= label, and returns the name of that deployment and the
+// types of SSH session permitted to it by the ExecAnnotation and
+// LogsAnnotation.
+//
+// If there is no deployment for the service, the error wraps
+// ErrDeploymentNotFound. Other errors indicate a failure to query the
+// Kubernetes API.
 func (c *Client) FindDeployment(ctx context.Context, namespace,
-	service string) (string, error) {
+	service string) (string, DeploymentAccess, error) {
+	start := time.Now()
 	deployments, err := c.clientset.AppsV1().Deployments(namespace).
 		List(ctx, metav1.ListOptions{
 			LabelSelector:  fmt.Sprintf("lagoon.sh/service=%s", service),
 			TimeoutSeconds: &timeoutSeconds,
 		})
 	if err != nil {
-		return "", fmt.Errorf("couldn't list deployments: %v", err)
+		c.observeCall(ctx, "FindDeployment", start, callOutcome(err))
+		return "", DeploymentAccess{},
+			fmt.Errorf("couldn't list deployments: %w", err)
 	}
 	if len(deployments.Items) == 0 {
-		return "", fmt.Errorf("couldn't find deployment for service %s", service)
+		c.observeCall(ctx, "FindDeployment", start, callOutcomeNotFound)
+		return "", DeploymentAccess{},
+			fmt.Errorf("service %s in namespace %s: %w", service, namespace,
+				ErrDeploymentNotFound)
+	}
+	c.observeCall(ctx, "FindDeployment", start, callOutcomeOK)
+	d := deployments.Items[0]
+	return d.Name, DeploymentAccess{
+		Exec: annotationEnabled(d.Annotations, ExecAnnotation),
+		Logs: annotationEnabled(d.Annotations, LogsAnnotation),
+	}, nil
+}
+
+// ListServices returns the sorted names of the Lagoon services in the given
+// namespace, taken from the lagoon.sh/service= label of its deployments.
+func (c *Client) ListServices(ctx context.Context,
+	namespace string) ([]string, error) {
+	start := time.Now()
+	deployments, err := c.clientset.AppsV1().Deployments(namespace).
+		List(ctx, metav1.ListOptions{
+			LabelSelector:  "lagoon.sh/service",
+			TimeoutSeconds: &timeoutSeconds,
+		})
+	c.observeCall(ctx, "ListServices", start, callOutcome(err))
+	if err != nil {
+		return nil, fmt.Errorf("couldn't list deployments: %w", err)
+	}
+	var services []string
+	for _, d := range deployments.Items {
+		services = append(services, d.Labels["lagoon.sh/service"])
 	}
-	return deployments.Items[0].Name, nil
+	slices.Sort(services)
+	return slices.Compact(services), nil
 }
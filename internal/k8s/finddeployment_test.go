@@ -0,0 +1,198 @@
+package k8s
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/alecthomas/assert/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestFindDeployment(t *testing.T) {
+	testNS := "testns"
+	var testCases = map[string]struct {
+		annotations  map[string]string
+		expectAccess DeploymentAccess
+	}{
+		"allowed": {
+			expectAccess: DeploymentAccess{Exec: true, Logs: true},
+		},
+		"explicitly allowed": {
+			annotations: map[string]string{
+				ExecAnnotation: "true",
+				LogsAnnotation: "true",
+			},
+			expectAccess: DeploymentAccess{Exec: true, Logs: true},
+		},
+		"exec disabled": {
+			annotations:  map[string]string{ExecAnnotation: "false"},
+			expectAccess: DeploymentAccess{Exec: false, Logs: true},
+		},
+		"logs disabled": {
+			annotations:  map[string]string{LogsAnnotation: "false"},
+			expectAccess: DeploymentAccess{Exec: true, Logs: false},
+		},
+		"invalid value": {
+			annotations:  map[string]string{ExecAnnotation: "no"},
+			expectAccess: DeploymentAccess{Exec: false, Logs: true},
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			c := &Client{
+				clientset: fake.NewClientset(&appsv1.Deployment{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:        "payments",
+						Namespace:   testNS,
+						Labels:      map[string]string{"lagoon.sh/service": "payments"},
+						Annotations: tc.annotations,
+					},
+				}),
+				metrics: NewMetrics(prometheus.NewRegistry()),
+			}
+			deployment, access, err :=
+				c.FindDeployment(context.Background(), testNS, "payments")
+			assert.NoError(tt, err, name)
+			assert.Equal(tt, "payments", deployment, name)
+			assert.Equal(tt, tc.expectAccess, access, name)
+		})
+	}
+}
+
+func TestFindDeploymentErrors(t *testing.T) {
+	var testCases = map[string]struct {
+		clientset      *fake.Clientset
+		expectNotFound bool
+	}{
+		"unknown service": {
+			clientset:      fake.NewClientset(),
+			expectNotFound: true,
+		},
+		"api error": {
+			clientset: errorClientset(),
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			c := &Client{
+				clientset: tc.clientset,
+				metrics:   NewMetrics(prometheus.NewRegistry()),
+			}
+			_, _, err := c.FindDeployment(context.Background(), "testns", "payments")
+			assert.Error(tt, err, name)
+			// callers add their own context to the error
+			err = fmt.Errorf("couldn't start session: %w", err)
+			if tc.expectNotFound {
+				assert.IsError(tt, err, ErrDeploymentNotFound, name)
+				assert.Contains(tt, err.Error(),
+					"service payments in namespace testns", name)
+			} else {
+				assert.NotIsError(tt, err, ErrDeploymentNotFound, name)
+			}
+		})
+	}
+}
+
+func TestFindDeploymentMetrics(t *testing.T) {
+	deployment := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "payments",
+			Namespace: "testns",
+			Labels:    map[string]string{"lagoon.sh/service": "payments"},
+		},
+	}
+	var testCases = map[string]struct {
+		clientset     *fake.Clientset
+		expectOutcome string
+	}{
+		"ok": {
+			clientset:     fake.NewClientset(deployment),
+			expectOutcome: callOutcomeOK,
+		},
+		"not found": {
+			clientset:     fake.NewClientset(),
+			expectOutcome: callOutcomeNotFound,
+		},
+		"error": {
+			clientset:     errorClientset(),
+			expectOutcome: callOutcomeError,
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			m := NewMetrics(prometheus.NewRegistry())
+			c := &Client{clientset: tc.clientset, metrics: m}
+			_, _, err := c.FindDeployment(context.Background(), "testns", "payments")
+			if tc.expectOutcome == callOutcomeOK {
+				assert.NoError(tt, err, name)
+			} else {
+				assert.Error(tt, err, name)
+			}
+			for _, outcome := range []string{
+				callOutcomeOK, callOutcomeNotFound, callOutcomeError,
+			} {
+				var expect uint64
+				if outcome == tc.expectOutcome {
+					expect = 1
+				}
+				assert.Equal(tt, expect,
+					callCount(tt, m, "FindDeployment", outcome), name)
+			}
+		})
+	}
+}
+
+func TestListServices(t *testing.T) {
+	deployment := func(name, service string) *appsv1.Deployment {
+		d := &appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "testns"},
+		}
+		if service != "" {
+			d.Labels = map[string]string{"lagoon.sh/service": service}
+		}
+		return d
+	}
+	var testCases = map[string]struct {
+		clientset      *fake.Clientset
+		expectServices []string
+		expectError    bool
+	}{
+		"services": {
+			clientset: fake.NewClientset(
+				deployment("nginx", "nginx"),
+				deployment("cli", "cli"),
+				deployment("cli-canary", "cli"),
+				deployment("unlabelled", ""),
+			),
+			expectServices: []string{"cli", "nginx"},
+		},
+		"no services": {
+			clientset: fake.NewClientset(),
+		},
+		"api error": {
+			clientset:   errorClientset(),
+			expectError: true,
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			m := NewMetrics(prometheus.NewRegistry())
+			c := &Client{clientset: tc.clientset, metrics: m}
+			services, err := c.ListServices(context.Background(), "testns")
+			if tc.expectError {
+				assert.Error(tt, err, name)
+				assert.Equal(tt, uint64(1),
+					callCount(tt, m, "ListServices", callOutcomeError), name)
+				return
+			}
+			assert.NoError(tt, err, name)
+			assert.Equal(tt, tc.expectServices, services, name)
+			assert.Equal(tt, uint64(1),
+				callCount(tt, m, "ListServices", callOutcomeOK), name)
+		})
+	}
+}
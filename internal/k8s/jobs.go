@@ -0,0 +1,119 @@
+package k8s
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+
+	"golang.org/x/sync/errgroup"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// jobNameLabel is set by the job controller on the pods of a job.
+const jobNameLabel = "job-name"
+
+// jobOwnedBy returns true if the given job is owned by a CronJob with the
+// given name.
+func jobOwnedBy(j batchv1.Job, cronJob string) bool {
+	for _, owner := range j.OwnerReferences {
+		if owner.Kind == "CronJob" && owner.Name == cronJob {
+			return true
+		}
+	}
+	return false
+}
+
+// findJob returns the name of the job in the given namespace identified by
+// job. If there is a job with exactly that name, it is returned. Otherwise the
+// most recently created job which was created by a CronJob with that name, or
+// whose name has that prefix, is returned.
+func (c *Client) findJob(ctx context.Context, namespace,
+	job string) (string, error) {
+	jobs, err := c.clientset.BatchV1().Jobs(namespace).List(ctx,
+		metav1.ListOptions{TimeoutSeconds: &timeoutSeconds})
+	if err != nil {
+		return "", fmt.Errorf("couldn't list jobs: %w", err)
+	}
+	var latest *batchv1.Job
+	for i, j := range jobs.Items {
+		if j.Name == job {
+			return j.Name, nil
+		}
+		if !jobOwnedBy(j, job) && !strings.HasPrefix(j.Name, job) {
+			continue
+		}
+		if latest == nil ||
+			latest.CreationTimestamp.Before(&j.CreationTimestamp) {
+			latest = &jobs.Items[i]
+		}
+	}
+	if latest == nil {
+		return "", fmt.Errorf("couldn't find job %s", job)
+	}
+	return latest.Name, nil
+}
+
+// jobPods returns the pods of the given job.
+func (c *Client) jobPods(
+	ctx context.Context,
+	namespace,
+	job string,
+) ([]corev1.Pod, error) {
+	pods, err := c.clientset.CoreV1().Pods(namespace).List(ctx,
+		metav1.ListOptions{
+			LabelSelector: labels.FormatLabels(map[string]string{jobNameLabel: job}),
+		})
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get pods: %w", err)
+	}
+	return pods.Items, nil
+}
+
+// JobLogs takes a target namespace, job, and stdio stream, and writes the log
+// output of the pods of the job to the stdio stream. The job is identified
+// by name, by the name of the CronJob which created it, or by a name prefix,
+// as described in findJob. If several jobs match, the most recently created
+// job is used. container, follow, tailLines, format, filter, markers, and
+// initContainers are handled as they are by Logs, except that since jobs are
+// finite, following the logs does not wait for new pods to start.
+func (c *Client) JobLogs(
+	ctx context.Context,
+	namespace,
+	job,
+	container string,
+	follow bool,
+	tailLines int64,
+	format LogFormat,
+	filter *regexp.Regexp,
+	markers,
+	initContainers bool,
+	stdio io.ReadWriter,
+) error {
+	return c.streamLogs(ctx, tailLines, format, filter, markers, stdio,
+		func(ctx context.Context, _ context.CancelFunc, streams *logStreams,
+			egSend *errgroup.Group, tailLines int64, logs *logQueue) error {
+			jobName, err := c.findJob(ctx, namespace, job)
+			if err != nil {
+				return err
+			}
+			pods, err := c.jobPods(ctx, namespace, jobName)
+			if err != nil {
+				return err
+			}
+			if len(pods) == 0 {
+				return fmt.Errorf("no pods for job %s", jobName)
+			}
+			if container != "" &&
+				!podsHaveContainer(pods, container, initContainers) {
+				return fmt.Errorf("couldn't find container: %s", container)
+			}
+			c.readPodsLogs(ctx, streams, egSend, pods, container, follow,
+				initContainers, tailLines, logs)
+			return nil
+		})
+}
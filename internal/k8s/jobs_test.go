@@ -0,0 +1,179 @@
+package k8s
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/assert/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/sync/semaphore"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// testJob returns a job in testns with the given name and creation time,
+// optionally owned by the given CronJob.
+func testJob(name, cronJob string, created time.Time) *batchv1.Job {
+	j := &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:              name,
+			Namespace:         "testns",
+			CreationTimestamp: metav1.NewTime(created),
+		},
+	}
+	if cronJob != "" {
+		j.OwnerReferences = []metav1.OwnerReference{{
+			APIVersion: "batch/v1",
+			Kind:       "CronJob",
+			Name:       cronJob,
+		}}
+	}
+	return j
+}
+
+// testJobPod returns a pod in testns belonging to the given job.
+func testJobPod(name, job, container string) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "testns",
+			Labels:    map[string]string{jobNameLabel: job},
+		},
+		Status: corev1.PodStatus{
+			ContainerStatuses: []corev1.ContainerStatus{{
+				Name:        container,
+				ContainerID: "containerd://" + name,
+			}},
+		},
+	}
+}
+
+func TestFindJob(t *testing.T) {
+	now := time.Now()
+	clientset := fake.NewClientset(
+		testJob("cron-drush-cron-28001", "cron-drush-cron", now.Add(-2*time.Hour)),
+		testJob("cron-drush-cron-28002", "cron-drush-cron", now.Add(-time.Hour)),
+		testJob("migrate", "", now.Add(-3*time.Hour)),
+		testJob("migrate-2", "", now.Add(-time.Minute)),
+		testJob("backup-1", "", now.Add(-2*time.Hour)),
+		testJob("backup-2", "", now.Add(-time.Hour)),
+	)
+	var testCases = map[string]struct {
+		job       string
+		expect    string
+		expectErr bool
+	}{
+		"exact name": {
+			job:    "cron-drush-cron-28001",
+			expect: "cron-drush-cron-28001",
+		},
+		"exact name wins over newer prefix match": {
+			job:    "migrate",
+			expect: "migrate",
+		},
+		"latest job of cronjob": {
+			job:    "cron-drush-cron",
+			expect: "cron-drush-cron-28002",
+		},
+		"latest job with prefix": {
+			job:    "backup",
+			expect: "backup-2",
+		},
+		"no match": {
+			job:       "nonexistent",
+			expectErr: true,
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			c := &Client{clientset: clientset}
+			job, err := c.findJob(context.Background(), "testns", tc.job)
+			if tc.expectErr {
+				assert.Error(tt, err, name)
+			} else {
+				assert.NoError(tt, err, name)
+			}
+			assert.Equal(tt, tc.expect, job, name)
+		})
+	}
+}
+
+func TestJobLogs(t *testing.T) {
+	now := time.Now()
+	var testCases = map[string]struct {
+		job         string
+		container   string
+		follow      bool
+		expectPods  []string
+		expectError bool
+	}{
+		"cronjob": {
+			job:        "cron-drush-cron",
+			expectPods: []string{"cron-drush-cron-28002-abcde"},
+		},
+		"cronjob follow": {
+			job:        "cron-drush-cron",
+			follow:     true,
+			expectPods: []string{"cron-drush-cron-28002-abcde"},
+		},
+		"job with container": {
+			job:        "cron-drush-cron-28001",
+			container:  "cli",
+			expectPods: []string{"cron-drush-cron-28001-fghij"},
+		},
+		"missing container": {
+			job:         "cron-drush-cron",
+			container:   "php",
+			expectError: true,
+		},
+		"job without pods": {
+			job:         "migrate",
+			expectError: true,
+		},
+		"no job": {
+			job:         "nonexistent",
+			expectError: true,
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			c := &Client{
+				clientset: fake.NewClientset(
+					testJob("cron-drush-cron-28001", "cron-drush-cron",
+						now.Add(-2*time.Hour)),
+					testJob("cron-drush-cron-28002", "cron-drush-cron",
+						now.Add(-time.Hour)),
+					testJob("migrate", "", now),
+					testJobPod("cron-drush-cron-28001-fghij", "cron-drush-cron-28001",
+						"cli"),
+					testJobPod("cron-drush-cron-28002-abcde", "cron-drush-cron-28002",
+						"cli"),
+				),
+				logSem:         semaphore.NewWeighted(int64(1)),
+				logTimeLimit:   time.Second,
+				logMaxLine:     defaultMaxLineLength,
+				logDefaultTail: 5,
+				logMaxTail:     50,
+				logLimitBytes:  2048,
+				logQueueBytes:  1024,
+				metrics:        NewMetrics(prometheus.NewRegistry()),
+			}
+			var buf bytes.Buffer
+			err := c.JobLogs(context.Background(), "testns", tc.job, tc.container,
+				tc.follow, 10, LogFormatJSON, nil, false, false, &buf)
+			if tc.expectError {
+				assert.Error(tt, err, name)
+				return
+			}
+			assert.NoError(tt, err, name)
+			for _, pod := range tc.expectPods {
+				assert.Contains(tt, buf.String(), `"pod":"`+pod+`"`, name)
+			}
+			assert.Contains(tt, buf.String(), "fake logs", name)
+		})
+	}
+}
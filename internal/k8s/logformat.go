@@ -0,0 +1,102 @@
+package k8s
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// LogFormat is the output format of log lines written by Logs().
+type LogFormat int
+
+const (
+	// LogFormatText writes each log line prefixed with the pod and container
+	// name.
+	LogFormatText LogFormat = iota
+	// LogFormatJSON writes each log line as a JSON object containing the pod
+	// and container name, timestamp, and log line.
+	LogFormatJSON
+)
+
+// logRecord is a single log line read from a container.
+type logRecord struct {
+	pod       string
+	container string
+	// text is the log line as returned by the Kubernetes API, including any
+	// timestamp prefix.
+	text string
+	// marker is true if text is an informational message about the log
+	// streams, rather than a log line read from a container.
+	marker bool
+}
+
+// jsonLogRecord is the JSON serialisation of a logRecord.
+type jsonLogRecord struct {
+	Pod       string `json:"pod"`
+	Container string `json:"container"`
+	Timestamp string `json:"timestamp,omitempty"`
+	Line      string `json:"line"`
+	Marker    bool   `json:"marker,omitempty"`
+}
+
+// parseLogLine splits the timestamp prefix added by the Kubernetes API from
+// the given log line. If the line has no valid timestamp prefix, it returns
+// the zero time and the line unmodified.
+func parseLogLine(text string) (time.Time, string) {
+	ts, line, ok := strings.Cut(text, " ")
+	if !ok {
+		// the log line may be empty apart from the timestamp
+		ts, line = text, ""
+	}
+	t, err := time.Parse(time.RFC3339Nano, ts)
+	if err != nil {
+		return time.Time{}, text
+	}
+	return t, line
+}
+
+// matches returns true if filter is nil, if the logRecord is a marker, or if
+// filter matches the log line of the logRecord, excluding any timestamp
+// prefix.
+func (r logRecord) matches(filter *regexp.Regexp) bool {
+	if filter == nil || r.marker {
+		return true
+	}
+	_, line := parseLogLine(r.text)
+	return filter.MatchString(line)
+}
+
+// format returns the logRecord serialised in the given format.
+func (r logRecord) format(f LogFormat) (string, error) {
+	switch f {
+	case LogFormatText:
+		if r.marker {
+			return fmt.Sprintf("=== %s ===", r.text), nil
+		}
+		return fmt.Sprintf("[pod/%s/%s] %s", r.pod, r.container, r.text), nil
+	case LogFormatJSON:
+		// markers have no timestamp prefix
+		t, line := time.Time{}, r.text
+		if !r.marker {
+			t, line = parseLogLine(r.text)
+		}
+		jr := jsonLogRecord{
+			Pod:       r.pod,
+			Container: r.container,
+			Line:      line,
+			Marker:    r.marker,
+		}
+		if !t.IsZero() {
+			jr.Timestamp = t.UTC().Format(time.RFC3339Nano)
+		}
+		data, err := json.Marshal(jr)
+		if err != nil {
+			return "", fmt.Errorf("couldn't marshal log record: %w", err)
+		}
+		return string(data), nil
+	default:
+		return "", fmt.Errorf("unknown log format: %d", f)
+	}
+}
@@ -0,0 +1,174 @@
+package k8s
+
+import (
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/assert/v2"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestParseLogLine(t *testing.T) {
+	var testCases = map[string]struct {
+		input      string
+		expectTime time.Time
+		expectLine string
+	}{
+		"timestamp": {
+			input:      "2024-03-01T12:34:56.123456789Z GET /index.php 200",
+			expectTime: time.Date(2024, 3, 1, 12, 34, 56, 123456789, time.UTC),
+			expectLine: "GET /index.php 200",
+		},
+		"timestamp without fraction": {
+			input:      "2024-03-01T12:34:56Z foo",
+			expectTime: time.Date(2024, 3, 1, 12, 34, 56, 0, time.UTC),
+			expectLine: "foo",
+		},
+		"timestamp only": {
+			input:      "2024-03-01T12:34:56Z",
+			expectTime: time.Date(2024, 3, 1, 12, 34, 56, 0, time.UTC),
+			expectLine: "",
+		},
+		"no timestamp": {
+			input:      "GET /index.php 200",
+			expectLine: "GET /index.php 200",
+		},
+		"empty": {
+			input:      "",
+			expectLine: "",
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			ts, line := parseLogLine(tc.input)
+			assert.True(tt, tc.expectTime.Equal(ts), name)
+			assert.Equal(tt, tc.expectLine, line, name)
+		})
+	}
+}
+
+func TestLogRecordMatches(t *testing.T) {
+	var testCases = map[string]struct {
+		filter *regexp.Regexp
+		input  string
+		marker bool
+		expect bool
+	}{
+		"no filter": {
+			input:  "2024-03-01T12:34:56Z GET /index.php 200",
+			expect: true,
+		},
+		"match": {
+			filter: regexp.MustCompile(`error|warn`),
+			input:  "2024-03-01T12:34:56Z php warning: undefined index",
+			expect: true,
+		},
+		"no match": {
+			filter: regexp.MustCompile(`error|warn`),
+			input:  "2024-03-01T12:34:56Z GET /index.php 200",
+		},
+		"timestamp excluded": {
+			filter: regexp.MustCompile(`^GET`),
+			input:  "2024-03-01T12:34:56Z GET /index.php 200",
+			expect: true,
+		},
+		"no timestamp": {
+			filter: regexp.MustCompile(`^GET`),
+			input:  "GET /index.php 200",
+			expect: true,
+		},
+		"marker": {
+			filter: regexp.MustCompile(`error|warn`),
+			input:  "started streaming pod/foo/php",
+			marker: true,
+			expect: true,
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			r := logRecord{pod: "foo", container: "php", text: tc.input,
+				marker: tc.marker}
+			assert.Equal(tt, tc.expect, r.matches(tc.filter), name)
+		})
+	}
+}
+
+func TestLogRecordFormat(t *testing.T) {
+	var testCases = map[string]struct {
+		record logRecord
+		format LogFormat
+		expect string
+	}{
+		"text": {
+			record: logRecord{
+				pod:       "nginx-123",
+				container: "php",
+				text:      "2024-03-01T12:34:56.5Z foo bar",
+			},
+			format: LogFormatText,
+			expect: "[pod/nginx-123/php] 2024-03-01T12:34:56.5Z foo bar",
+		},
+		"json": {
+			record: logRecord{
+				pod:       "nginx-123",
+				container: "php",
+				text:      "2024-03-01T12:34:56.5Z foo bar",
+			},
+			format: LogFormatJSON,
+			expect: `{"pod":"nginx-123","container":"php",` +
+				`"timestamp":"2024-03-01T12:34:56.5Z","line":"foo bar"}`,
+		},
+		"json offset timestamp": {
+			record: logRecord{
+				pod:       "nginx-123",
+				container: "php",
+				text:      "2024-03-01T22:34:56+10:00 foo",
+			},
+			format: LogFormatJSON,
+			expect: `{"pod":"nginx-123","container":"php",` +
+				`"timestamp":"2024-03-01T12:34:56Z","line":"foo"}`,
+		},
+		"json no timestamp": {
+			record: logRecord{
+				pod:       "nginx-123",
+				container: "php",
+				text:      `{"level":"info"}`,
+			},
+			format: LogFormatJSON,
+			expect: `{"pod":"nginx-123","container":"php",` +
+				`"line":"{\"level\":\"info\"}"}`,
+		},
+		"json escapes control characters": {
+			record: logRecord{
+				pod:       "nginx-123",
+				container: "php",
+				text:      "2024-03-01T12:34:56Z \x1b[31mred",
+			},
+			format: LogFormatJSON,
+			expect: `{"pod":"nginx-123","container":"php",` +
+				`"timestamp":"2024-03-01T12:34:56Z","line":"\u001b[31mred"}`,
+		},
+		"text marker": {
+			record: startedMarker("nginx-123", corev1.ContainerStatus{
+				Name:         "php",
+				RestartCount: 2,
+			}),
+			format: LogFormatText,
+			expect: "=== started streaming pod/nginx-123/php (restart #2) ===",
+		},
+		"json marker": {
+			record: terminatedMarker("nginx-123"),
+			format: LogFormatJSON,
+			expect: `{"pod":"nginx-123","container":"",` +
+				`"line":"pod/nginx-123 terminated","marker":true}`,
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			line, err := tc.record.format(tc.format)
+			assert.NoError(tt, err, name)
+			assert.Equal(tt, tc.expect, line, name)
+		})
+	}
+}
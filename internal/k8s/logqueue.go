@@ -0,0 +1,92 @@
+package k8s
+
+import (
+	"context"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/sync/semaphore"
+)
+
+const (
+	// defaultLogQueueBytes is the default maximum number of bytes of log
+	// records queued for writing per logs session.
+	defaultLogQueueBytes int64 = 4 * 1024 * 1024 // 4MiB
+	// logQueueLength is the maximum number of log records queued for writing
+	// per logs session, regardless of their size.
+	logQueueLength = 64
+)
+
+// logQueue is a queue of log records bounded by the total size of the queued
+// records.
+type logQueue struct {
+	budget      int64
+	sem         *semaphore.Weighted
+	records     chan logRecord
+	queuedBytes prometheus.Gauge
+}
+
+// newLogQueue returns a logQueue which holds at most budget bytes of
+// records. The number of bytes queued is tracked in queuedBytes.
+func newLogQueue(budget int64, queuedBytes prometheus.Gauge) *logQueue {
+	return &logQueue{
+		budget:      budget,
+		sem:         semaphore.NewWeighted(budget),
+		records:     make(chan logRecord, logQueueLength),
+		queuedBytes: queuedBytes,
+	}
+}
+
+// size returns the number of bytes of the queue budget consumed by r. A
+// record larger than the entire budget consumes the entire budget, so that it
+// can still be queued once the queue is empty.
+func (q *logQueue) size(r logRecord) int64 {
+	return min(int64(len(r.pod)+len(r.container)+len(r.text)), q.budget)
+}
+
+// push adds r to the queue, blocking until there is space available in the
+// queue budget. It returns an error if ctx is cancelled before r is queued.
+func (q *logQueue) push(ctx context.Context, r logRecord) error {
+	n := q.size(r)
+	if err := q.sem.Acquire(ctx, n); err != nil {
+		return err
+	}
+	q.queuedBytes.Add(float64(n))
+	select {
+	case q.records <- r:
+		return nil
+	case <-ctx.Done():
+		q.release(r)
+		return ctx.Err()
+	}
+}
+
+// pop removes a record from the queue, blocking until one is available. It
+// returns an error if ctx is cancelled before a record is available.
+func (q *logQueue) pop(ctx context.Context) (logRecord, error) {
+	select {
+	case r := <-q.records:
+		q.release(r)
+		return r, nil
+	case <-ctx.Done():
+		return logRecord{}, ctx.Err()
+	}
+}
+
+// discard removes any records remaining in the queue without blocking.
+func (q *logQueue) discard() {
+	for {
+		select {
+		case r := <-q.records:
+			q.release(r)
+		default:
+			return
+		}
+	}
+}
+
+// release returns the budget consumed by r to the queue.
+func (q *logQueue) release(r logRecord) {
+	n := q.size(r)
+	q.queuedBytes.Sub(float64(n))
+	q.sem.Release(n)
+}
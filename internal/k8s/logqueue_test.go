@@ -0,0 +1,114 @@
+package k8s
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/assert/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// queuedBytesGauge returns a logs queued bytes gauge which is not registered
+// with the default registry.
+func queuedBytesGauge() prometheus.Gauge {
+	return NewMetrics(prometheus.NewRegistry()).logsQueuedBytes
+}
+
+// record returns a logRecord of the given total size.
+func record(size int) logRecord {
+	return logRecord{pod: "p", container: "c", text: strings.Repeat("x", size-2)}
+}
+
+func TestLogQueueBudget(t *testing.T) {
+	logsQueuedBytes := queuedBytesGauge()
+	q := newLogQueue(100, logsQueuedBytes)
+	ctx := context.Background()
+	// fill most of the budget
+	assert.NoError(t, q.push(ctx, record(60)))
+	assert.Equal(t, float64(60), testutil.ToFloat64(logsQueuedBytes))
+	// a push exceeding the remaining budget blocks
+	timeoutCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	assert.Error(t, q.push(timeoutCtx, record(60)))
+	assert.Equal(t, float64(60), testutil.ToFloat64(logsQueuedBytes))
+	// a push within the remaining budget succeeds
+	assert.NoError(t, q.push(ctx, record(40)))
+	assert.Equal(t, float64(100), testutil.ToFloat64(logsQueuedBytes))
+	// popping frees the budget
+	r, err := q.pop(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 58, len(r.text))
+	assert.Equal(t, float64(40), testutil.ToFloat64(logsQueuedBytes))
+	assert.NoError(t, q.push(ctx, record(60)))
+	q.discard()
+	assert.Equal(t, float64(0), testutil.ToFloat64(logsQueuedBytes))
+}
+
+func TestLogQueueOversizedRecord(t *testing.T) {
+	logsQueuedBytes := queuedBytesGauge()
+	q := newLogQueue(100, logsQueuedBytes)
+	ctx := context.Background()
+	assert.NoError(t, q.push(ctx, record(10)))
+	// a record larger than the budget waits until the queue is empty
+	timeoutCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	assert.Error(t, q.push(timeoutCtx, record(1000)))
+	_, err := q.pop(ctx)
+	assert.NoError(t, err)
+	assert.NoError(t, q.push(ctx, record(1000)))
+	assert.Equal(t, float64(100), testutil.ToFloat64(logsQueuedBytes))
+	r, err := q.pop(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 998, len(r.text))
+	assert.Equal(t, float64(0), testutil.ToFloat64(logsQueuedBytes))
+}
+
+func TestLogQueueConcurrentProducers(t *testing.T) {
+	const budget = 4096
+	logsQueuedBytes := queuedBytesGauge()
+	q := newLogQueue(budget, logsQueuedBytes)
+	ctx := context.Background()
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 100 {
+				assert.NoError(t, q.push(ctx, record(3000)))
+			}
+		}()
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	var received int
+	for received < 800 {
+		// the gauge never exceeds the budget
+		assert.True(t, testutil.ToFloat64(logsQueuedBytes) <= budget)
+		_, err := q.pop(ctx)
+		assert.NoError(t, err)
+		received++
+	}
+	<-done
+	assert.Equal(t, float64(0), testutil.ToFloat64(logsQueuedBytes))
+}
+
+func BenchmarkLogQueue(b *testing.B) {
+	q := newLogQueue(defaultLogQueueBytes, queuedBytesGauge())
+	ctx := context.Background()
+	r := record(64 * 1024)
+	go func() {
+		for range b.N {
+			_ = q.push(ctx, r)
+		}
+	}()
+	for range b.N {
+		_, _ = q.pop(ctx)
+	}
+}
@@ -2,32 +2,39 @@ package k8s
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
 	"io"
+	"log/slog"
+	"regexp"
 	"sync"
 	"time"
 
-	"github.com/google/uuid"
+	"github.com/uselagoon/ssh-portal/internal/sessionlog"
 	"golang.org/x/exp/slices"
 	"golang.org/x/sync/errgroup"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
-	"k8s.io/client-go/informers"
 	"k8s.io/client-go/tools/cache"
 )
 
 var (
-	// defaultTailLines is the number of log lines to tail by default if no number
+	// defaultTailLines is the default number of log lines to tail if no number
 	// is specified
 	defaultTailLines int64 = 32
-	// maxTailLines is the maximum number of log lines to tail
-	maxTailLines int64 = 1024
-	// limitBytes defines the maximum number of bytes of logs returned from a
-	// single container
-	limitBytes int64 = 1 * 1024 * 1024 // 1MiB
+	// defaultMaxTailLines is the default maximum number of log lines to tail
+	defaultMaxTailLines int64 = 1024
+	// defaultLimitBytes is the default maximum number of bytes of logs returned
+	// from a single container
+	defaultLimitBytes int64 = 1 * 1024 * 1024 // 1MiB
+	// defaultMaxLineLength is the default maximum length in bytes of a single
+	// log line. Longer lines are truncated.
+	defaultMaxLineLength = int(defaultLimitBytes)
+	// truncatedSuffix is appended to log lines which have been truncated.
+	truncatedSuffix = " [truncated]"
 
 	// ErrConcurrentLogLimit indicates that the maximum number of concurrent log
 	// sessions has been reached.
@@ -37,51 +44,305 @@ var (
 	ErrLogTimeLimit = errors.New("exceeded maximum log session time")
 )
 
+// lineSplitter is a bufio.SplitFunc which splits a stream into lines, with
+// any trailing \r\n or \n stripped. Lines longer than maxLineLength bytes
+// are truncated, and the remainder of the line is discarded. This allows the
+// scanner buffer to grow only as large as the longest line it returns.
+type lineSplitter struct {
+	maxLineLength int
+	// discarding is true while the remainder of a truncated line is skipped.
+	discarding bool
+	// truncated is true if the last line returned was truncated.
+	truncated bool
+}
+
+// split implements bufio.SplitFunc.
+func (l *lineSplitter) split(data []byte, atEOF bool) (int, []byte, error) {
+	i := bytes.IndexByte(data, '\n')
+	switch {
+	case l.discarding && i >= 0:
+		l.discarding = false
+		return i + 1, nil, nil
+	case l.discarding:
+		return len(data), nil, nil
+	case i >= 0:
+		return i + 1, l.line(data[:i]), nil
+	case len(data) >= l.bufferSize():
+		// the line doesn't fit in the buffer, so it is longer than the maximum
+		l.discarding = true
+		return len(data), l.line(data), nil
+	case atEOF && len(data) > 0:
+		return len(data), l.line(data), nil
+	}
+	return 0, nil, nil
+}
+
+// line strips any trailing \r from the given line, and truncates it to
+// maxLineLength.
+func (l *lineSplitter) line(line []byte) []byte {
+	line = bytes.TrimSuffix(line, []byte("\r"))
+	l.truncated = len(line) > l.maxLineLength
+	if l.truncated {
+		line = line[:l.maxLineLength]
+	}
+	return line
+}
+
+// bufferSize returns the maximum size of the scanner buffer, which has room
+// for a line of maxLineLength bytes and its \r\n terminator.
+func (l *lineSplitter) bufferSize() int {
+	return l.maxLineLength + 2
+}
+
 // linewiseCopy reads strings separated by \n from logStream, and writes them
-// with the given prefix and \n stripped to the logs channel. It returns when
-// ctx is cancelled or the logStream closes.
-func linewiseCopy(ctx context.Context, prefix string, logs chan<- string,
-	logStream io.ReadCloser) {
+// with \n stripped to the logs queue as records of the given pod and
+// container. Lines longer than maxLineLength bytes are truncated and marked
+// with a suffix. If sanitize is true, each line is passed through
+// sanitizeLine() first. It returns when ctx is cancelled or the logStream
+// closes.
+func linewiseCopy(ctx context.Context, pod, container string,
+	logs *logQueue, logStream io.ReadCloser, sanitize bool,
+	maxLineLength int) {
 	defer logStream.Close()
-	s := bufio.NewScanner(logStream)
-	for s.Scan() {
-		select {
-		case logs <- fmt.Sprintf("%s %s", prefix, s.Text()):
-		case <-ctx.Done():
+	splitter := &lineSplitter{maxLineLength: maxLineLength}
+	scanner := bufio.NewScanner(logStream)
+	// start with a small buffer, since most log lines are short
+	scanner.Buffer(make([]byte, min(4096, splitter.bufferSize())),
+		splitter.bufferSize())
+	scanner.Split(splitter.split)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if sanitize {
+			line = sanitizeLine(line)
+		}
+		if splitter.truncated {
+			line += truncatedSuffix
+		}
+		record := logRecord{pod: pod, container: container, text: line}
+		if err := logs.push(ctx, record); err != nil {
 			return
 		}
 	}
 }
 
+// clampTailLines returns the configured default number of lines to tail if
+// tailLines is less than one, or the configured maximum if tailLines exceeds
+// it. Otherwise tailLines is returned unmodified.
+func (c *Client) clampTailLines(tailLines int64) int64 {
+	if tailLines < 1 {
+		return c.logDefaultTail
+	}
+	return min(tailLines, c.logMaxTail)
+}
+
+// podsHaveContainer returns true if any of the given pods has a container
+// with the given name, and false otherwise. If initContainers is true, init
+// containers are also considered.
+func podsHaveContainer(
+	pods []corev1.Pod,
+	container string,
+	initContainers bool,
+) bool {
+	hasName := func(cStatus corev1.ContainerStatus) bool {
+		return cStatus.Name == container
+	}
+	for _, pod := range pods {
+		if slices.ContainsFunc(pod.Status.ContainerStatuses, hasName) {
+			return true
+		}
+		if initContainers &&
+			slices.ContainsFunc(pod.Status.InitContainerStatuses, hasName) {
+			return true
+		}
+	}
+	return false
+}
+
+// initContainerStarted returns true if the given init container status shows
+// that the container has started, and so has logs.
+func initContainerStarted(cStatus corev1.ContainerStatus) bool {
+	return cStatus.State.Running != nil || cStatus.State.Terminated != nil
+}
+
+// podLogContainers returns the statuses of the containers in the given pod
+// whose logs are streamed, and the number of those which are init containers.
+// The init containers are listed first. If initContainers is false, only the
+// regular containers are returned. Otherwise the init containers which have
+// started are returned, and the regular containers are only returned if they
+// are not waiting to start.
+func podLogContainers(
+	p *corev1.Pod,
+	initContainers bool,
+) ([]corev1.ContainerStatus, int) {
+	if !initContainers {
+		return p.Status.ContainerStatuses, 0
+	}
+	var cStatuses []corev1.ContainerStatus
+	for _, cStatus := range p.Status.InitContainerStatuses {
+		if initContainerStarted(cStatus) {
+			cStatuses = append(cStatuses, cStatus)
+		}
+	}
+	nInit := len(cStatuses)
+	for _, cStatus := range p.Status.ContainerStatuses {
+		if cStatus.State.Waiting == nil {
+			cStatuses = append(cStatuses, cStatus)
+		}
+	}
+	return cStatuses, nInit
+}
+
+// deploymentPods returns the pods of the given deployment.
+func (c *Client) deploymentPods(
+	ctx context.Context,
+	namespace,
+	deployment string,
+) ([]corev1.Pod, error) {
+	d, err := c.clientset.AppsV1().Deployments(namespace).Get(ctx, deployment,
+		metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get deployment: %w", err)
+	}
+	pods, err := c.clientset.CoreV1().Pods(namespace).List(ctx,
+		metav1.ListOptions{
+			LabelSelector: labels.FormatLabels(d.Spec.Selector.MatchLabels),
+		})
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get pods: %w", err)
+	}
+	return pods.Items, nil
+}
+
+// startedMarker returns a marker record indicating that streaming of logs
+// from the given container has started.
+func startedMarker(pod string, cStatus corev1.ContainerStatus) logRecord {
+	text := fmt.Sprintf("started streaming pod/%s/%s", pod, cStatus.Name)
+	if cStatus.RestartCount > 0 {
+		text += fmt.Sprintf(" (restart #%d)", cStatus.RestartCount)
+	}
+	return logRecord{
+		pod:       pod,
+		container: cStatus.Name,
+		text:      text,
+		marker:    true,
+	}
+}
+
+// stoppedMarker returns a marker record indicating that streaming of logs
+// from the given container has stopped.
+func stoppedMarker(pod, container string) logRecord {
+	return logRecord{
+		pod:       pod,
+		container: container,
+		text:      fmt.Sprintf("stopped streaming pod/%s/%s", pod, container),
+		marker:    true,
+	}
+}
+
+// terminatedMarker returns a marker record indicating that the given pod has
+// terminated.
+func terminatedMarker(pod string) logRecord {
+	return logRecord{
+		pod:    pod,
+		text:   fmt.Sprintf("pod/%s terminated", pod),
+		marker: true,
+	}
+}
+
+// logStreams is the set of IDs of the containers whose logs are being
+// streamed by a single log session. It is owned by the session, so that no
+// state is shared between sessions or outlives them.
+type logStreams struct {
+	mu  sync.Mutex
+	ids map[string]bool
+	// done is the set of IDs of terminated containers whose logs have been
+	// streamed in full.
+	done map[string]bool
+}
+
+// add adds the given container ID to the set. It returns false if the ID was
+// already in the set, or has been marked done.
+func (s *logStreams) add(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ids[id] || s.done[id] {
+		return false
+	}
+	if s.ids == nil {
+		s.ids = map[string]bool{}
+	}
+	s.ids[id] = true
+	return true
+}
+
+// remove removes the given container ID from the set.
+func (s *logStreams) remove(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.ids, id)
+}
+
+// finish removes the given container ID from the set, and marks it done so
+// that it can't be added again. It is used for init containers, which don't
+// restart with the same ID once they have completed.
+func (s *logStreams) finish(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.ids, id)
+	if s.done == nil {
+		s.done = map[string]bool{}
+	}
+	s.done[id] = true
+}
+
+// len returns the number of container IDs in the set.
+func (s *logStreams) len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.ids)
+}
+
 // readLogs reads logs from the given pod, writing them back to the logs
-// channel in a linewise manner. A goroutine is started via egSend to tail logs
-// for each container. requestID is used to de-duplicate simultaneous logs
-// requests associated with a single call to the higher-level Logs() function.
+// queue in a linewise manner. If containerName is specified and the pod
+// doesn't have that container, the pod is skipped. A goroutine is started
+// via egSend to tail logs for each container. streams is used to
+// de-duplicate simultaneous logs requests associated with a single call to
+// the higher-level Logs() function. If follow is true, marker records are
+// written to the logs queue when each container log stream starts and stops.
+// If initContainers is true, the logs of init containers which have started
+// are included, as described in podLogContainers.
 //
 // readLogs returns immediately, and relies on ctx cancellation to ensure the
 // goroutines it starts are cleaned up.
-func (c *Client) readLogs(ctx context.Context, requestID string,
-	egSend *errgroup.Group, p *corev1.Pod, containerName string, follow bool,
-	tailLines int64, logs chan<- string) error {
-	var cStatuses []corev1.ContainerStatus
-	// if containerName is not specified, send logs for all containers
-	if containerName == "" {
-		cStatuses = p.Status.ContainerStatuses
-	} else {
-		for _, cStatus := range p.Status.ContainerStatuses {
-			if containerName == cStatus.Name {
-				cStatuses = append(cStatuses, cStatus)
-				break
-			}
+func (c *Client) readLogs(ctx context.Context, streams *logStreams,
+	egSend *errgroup.Group, p *corev1.Pod, containerName string, follow,
+	initContainers bool, tailLines int64, logs *logQueue) error {
+	cStatuses, nInit := podLogContainers(p, initContainers)
+	// if containerName is specified, only send logs for that container
+	if containerName != "" {
+		i := slices.IndexFunc(cStatuses,
+			func(cStatus corev1.ContainerStatus) bool {
+				return containerName == cStatus.Name
+			})
+		if i < 0 {
+			// Pods in a deployment may have differing containers, for example
+			// during a rolling update. Logs() checks that at least one pod has the
+			// container, so just skip this one.
+			sessionlog.FromContext(ctx).Debug("skipping pod without container",
+				slog.String("pod", p.Name),
+				slog.String("container", containerName))
+			return nil
 		}
-		if len(cStatuses) == 0 {
-			return fmt.Errorf("couldn't find container: %s", containerName)
+		cStatuses = cStatuses[i : i+1]
+		if i < nInit {
+			nInit = 1
+		} else {
+			nInit = 0
 		}
 	}
-	for _, cStatus := range cStatuses {
+	for i, cStatus := range cStatuses {
 		// skip setting up another log stream if container is already being logged
-		_, exists := c.logStreamIDs.LoadOrStore(requestID+cStatus.ContainerID, true)
-		if exists {
+		if !streams.add(cStatus.ContainerID) {
 			continue
 		}
 		// set up stream for a single container
@@ -91,25 +352,37 @@ func (c *Client) readLogs(ctx context.Context, requestID string,
 				Follow:     follow,
 				Timestamps: true,
 				TailLines:  &tailLines,
-				LimitBytes: &limitBytes,
+				LimitBytes: &c.logLimitBytes,
 			})
 		logStream, err := req.Stream(ctx)
 		if err != nil {
-			return fmt.Errorf("couldn't stream logs: %v", err)
+			streams.remove(cStatus.ContainerID)
+			return fmt.Errorf("couldn't stream logs: %w", err)
 		}
 		egSend.Go(func() error {
-			defer c.logStreamIDs.Delete(cStatus.ContainerID)
-			linewiseCopy(ctx, fmt.Sprintf("[pod/%s/%s]", p.Name, cStatus.Name), logs,
-				logStream)
+			if i < nInit {
+				defer streams.finish(cStatus.ContainerID)
+			} else {
+				defer streams.remove(cStatus.ContainerID)
+			}
+			if follow {
+				// ignore errors, which only occur if ctx is cancelled
+				_ = logs.push(ctx, startedMarker(p.Name, cStatus))
+			}
+			linewiseCopy(ctx, p.Name, cStatus.Name, logs, logStream, c.logSanitize,
+				c.logMaxLine)
+			if follow && ctx.Err() == nil {
+				_ = logs.push(ctx, stoppedMarker(p.Name, cStatus.Name))
+			}
 			// When a pod is terminating, the k8s API sometimes sends an event
 			// showing a healthy pod _after_ an existing logStream for the same pod
 			// has closed. This happens occasionally on scale-down of a deployment.
 			// When this occurs there is a race where linewiseCopy() returns, then
 			// the "healthy" event comes in and linewiseCopy() is called again, only
 			// to return immediately. This can result in duplicated log lines being
-			// returned on the logs channel.
+			// returned on the logs queue.
 			// To hack around this behaviour, pause here before exiting. This means
-			// that the container ID is retained in c.logStreamIDs for a brief period
+			// that the container ID is retained in streams for a brief period
 			// after logs stop streaming, which causes "healthy pod" events from the
 			// k8s API to be ignored for that period and thereby avoiding duplicate
 			// log lines being returned to the caller.
@@ -121,88 +394,232 @@ func (c *Client) readLogs(ctx context.Context, requestID string,
 }
 
 // podEventHandler receives pod objects from the podInformer and, if they are
-// in a ready state, starts streaming logs from them.
+// in a ready state, starts streaming logs from them. If initContainers is
+// true, streaming also starts once any init container of the pod has started.
 func (c *Client) podEventHandler(ctx context.Context,
-	cancel context.CancelFunc, requestID string, egSend *errgroup.Group,
-	container string, follow bool, tailLines int64, logs chan<- string, obj any) {
+	cancel context.CancelFunc, streams *logStreams, egSend *errgroup.Group,
+	container string, follow, initContainers bool, tailLines int64,
+	logs *logQueue, obj any) {
 	// panic if obj is not a pod, since we specifically use a pod informer
 	pod := obj.(*corev1.Pod)
-	if !slices.ContainsFunc(pod.Status.Conditions,
+	ready := slices.ContainsFunc(pod.Status.Conditions,
 		func(cond corev1.PodCondition) bool {
 			return cond.Type == corev1.ContainersReady &&
 				cond.Status == corev1.ConditionTrue
-		}) {
+		})
+	if !ready && !(initContainers && slices.ContainsFunc(
+		pod.Status.InitContainerStatuses, initContainerStarted)) {
 		return // pod not ready
 	}
 	egSend.Go(func() error {
-		readLogsErr := c.readLogs(ctx, requestID, egSend, pod, container, follow,
-			tailLines, logs)
+		readLogsErr := c.readLogs(ctx, streams, egSend, pod, container, follow,
+			initContainers, tailLines, logs)
 		if readLogsErr != nil {
 			cancel()
-			return fmt.Errorf("couldn't read logs on new pod: %v", readLogsErr)
+			return fmt.Errorf("couldn't read logs on new pod: %w", readLogsErr)
 		}
 		return nil
 	})
 }
 
-// newPodInformer sets up a k8s informer on pods in the given deployment, and
-// returns the informer in an inert state. The informer is configured with
-// event handlers to read logs from pods in the deployment, writing log lines
-// back to the logs channel. It transparently handles the deployment scaling up
-// and down (e.g. pods being added / deleted / restarted).
-//
-// When the caller calls Run() on the returned informer, it will start watching
-// for events and sending to the logs channel.
-func (c *Client) newPodInformer(ctx context.Context,
-	cancel context.CancelFunc, requestID string, egSend *errgroup.Group,
-	namespace, deployment, container string, follow bool, tailLines int64,
-	logs chan<- string) (cache.SharedIndexInformer, error) {
+// followPods streams logs from the ready pods in the given deployment to the
+// logs queue, using event handlers on a pod informer which is shared with
+// other log sessions following the same deployment. It transparently handles
+// the deployment scaling up and down (e.g. pods being added / deleted /
+// restarted). It blocks until ctx is cancelled.
+func (c *Client) followPods(ctx context.Context,
+	cancel context.CancelFunc, streams *logStreams, egSend *errgroup.Group,
+	namespace, deployment, container string, initContainers bool,
+	tailLines int64, logs *logQueue) error {
 	// get the deployment
 	d, err := c.clientset.AppsV1().Deployments(namespace).Get(ctx, deployment,
 		metav1.GetOptions{})
 	if err != nil {
-		return nil, fmt.Errorf("couldn't get deployment: %v", err)
-	}
-	// configure the informer factory, filtering on deployment selector labels
-	factory := informers.NewSharedInformerFactoryWithOptions(
-		c.clientset,
-		time.Hour,
-		informers.WithNamespace(namespace),
-		informers.WithTweakListOptions(func(opts *metav1.ListOptions) {
-			opts.LabelSelector =
-				labels.SelectorFromSet(d.Spec.Selector.MatchLabels).String()
-		}),
-	)
-	// construct the informer
-	podInformer := factory.Core().V1().Pods().Informer()
-	_, err = podInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		return fmt.Errorf("couldn't get deployment: %w", err)
+	}
+	// Get an informer filtering on deployment selector labels. Pods running
+	// init containers are still Pending, so only filter on the pod phase if
+	// init container logs are not requested.
+	key := podInformerKey{
+		namespace: namespace,
+		labelSelector: labels.SelectorFromSet(
+			d.Spec.Selector.MatchLabels).String(),
+	}
+	if !initContainers {
+		key.fieldSelector = runningPods
+	}
+	podInformer, release := c.acquirePodInformer(key)
+	defer release()
+	// Event handlers may still be running after they are removed from the
+	// shared informer, so stop them from starting log streams once this
+	// function returns.
+	var mu sync.RWMutex
+	var stopped bool
+	handle := func(obj any) {
+		mu.RLock()
+		defer mu.RUnlock()
+		if stopped {
+			return
+		}
+		c.podEventHandler(ctx, cancel, streams, egSend, container, true,
+			initContainers, tailLines, logs, obj)
+	}
+	handleDelete := func(obj any) {
+		mu.RLock()
+		defer mu.RUnlock()
+		if stopped {
+			return
+		}
+		// the final state of the pod may be unknown if the watch was
+		// interrupted
+		if unknown, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+			obj = unknown.Obj
+		}
+		if pod, ok := obj.(*corev1.Pod); ok {
+			// ignore errors, which only occur if ctx is cancelled
+			_ = logs.push(ctx, terminatedMarker(pod.Name))
+		}
+	}
+	reg, err := podInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
 		// AddFunc handles events for new and existing pods. Since new pods are not
 		// in a ready state when initially added, it doesn't start log streaming
 		// for those.
-		AddFunc: func(obj any) {
-			c.podEventHandler(ctx, cancel, requestID, egSend, container, follow,
-				tailLines, logs, obj)
-		},
+		AddFunc: handle,
 		// UpdateFunc handles events for pod state changes. When new pods are added
 		// (e.g. deployment is scaled up) it repeatedly receives events until the
 		// pod is in its final healthy state. For that reason, the
 		// podEventHandler() inspects the pod state before initiating log
 		// streaming.
-		UpdateFunc: func(_, obj any) {
-			c.podEventHandler(ctx, cancel, requestID, egSend, container, follow,
-				tailLines, logs, obj)
-		},
+		UpdateFunc: func(_, obj any) { handle(obj) },
+		// DeleteFunc handles events for pods which have been deleted, or which
+		// are no longer running.
+		DeleteFunc: handleDelete,
 	})
 	if err != nil {
-		return nil, fmt.Errorf("couldn't add event handlers to informer: %v", err)
+		return fmt.Errorf("couldn't add event handlers to informer: %w", err)
+	}
+	<-ctx.Done()
+	if err = podInformer.RemoveEventHandler(reg); err != nil {
+		sessionlog.FromContext(ctx).Warn(
+			"couldn't remove event handlers from informer",
+			slog.Any("error", err))
 	}
-	return podInformer, nil
+	mu.Lock()
+	stopped = true
+	mu.Unlock()
+	return nil
+}
+
+// logStreamStarter starts streaming logs to the logs queue via egSend. It is
+// called by streamLogs with the context, cancel function, logStreams, and
+// clamped tailLines of the log session.
+type logStreamStarter func(ctx context.Context, cancel context.CancelFunc,
+	streams *logStreams, egSend *errgroup.Group, tailLines int64,
+	logs *logQueue) error
+
+// readPodsLogs starts a goroutine via egSend which calls readLogs for each of
+// the given pods.
+func (c *Client) readPodsLogs(ctx context.Context, streams *logStreams,
+	egSend *errgroup.Group, pods []corev1.Pod, container string, follow,
+	initContainers bool, tailLines int64, logs *logQueue) {
+	for _, pod := range pods {
+		egSend.Go(func() error {
+			readLogsErr := c.readLogs(ctx, streams, egSend, &pod,
+				container, follow, initContainers, tailLines, logs)
+			if readLogsErr != nil {
+				return fmt.Errorf("couldn't read logs on existing pods: %w", readLogsErr)
+			}
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return ErrLogTimeLimit
+			}
+			return nil
+		})
+	}
+}
+
+// streamLogs handles the parts of a log session common to Logs and JobLogs.
+// It enforces the concurrent log session and time limits, calls start to
+// begin streaming logs to the logs queue, and writes the records received on
+// the queue which match filter to stdio in the given format until the
+// sending goroutines exit or ctx is cancelled. Marker records are discarded
+// unless markers is true.
+func (c *Client) streamLogs(
+	ctx context.Context,
+	tailLines int64,
+	format LogFormat,
+	filter *regexp.Regexp,
+	markers bool,
+	stdio io.ReadWriter,
+	start logStreamStarter,
+) error {
+	// Exit with an error if we have hit the concurrent log limit.
+	if !c.logSem.TryAcquire(1) {
+		return ErrConcurrentLogLimit
+	}
+	defer c.logSem.Release(1)
+	// Wrap the context so we can cancel subroutines of this function on error.
+	childCtx, cancel := context.WithTimeout(ctx, c.logTimeLimit)
+	defer cancel()
+	// Track the container log streams of this call to this function. Entries
+	// are removed by the sending goroutines, which have all exited by the time
+	// this function returns.
+	var streams logStreams
+	tailLines = c.clampTailLines(tailLines)
+	// put sending goroutines in an errgroup.Group to handle errors, and
+	// receiving goroutines in a waitgroup (since they have no errors)
+	var egSend errgroup.Group
+	var wgRecv sync.WaitGroup
+	// initialise a bounded queue for the worker goroutines to write to, and
+	// for this function to read log lines from
+	logs := newLogQueue(c.logQueueBytes, c.metrics.logsQueuedBytes)
+	defer logs.discard()
+	// start a goroutine reading from the logs queue and writing back to stdio
+	wgRecv.Add(1)
+	go func() {
+		defer wgRecv.Done()
+		for {
+			record, err := logs.pop(childCtx)
+			if err != nil {
+				return // context done - client went away or error within Logs()
+			}
+			if (record.marker && !markers) || !record.matches(filter) {
+				continue
+			}
+			msg, err := record.format(format)
+			if err != nil {
+				continue // unrepresentable log line - skip it
+			}
+			// ignore errors writing to stdio. this may happen if the client
+			// disconnects after reading off the queue but before the log can be
+			// written. there's nothing we can do in this case and we'll see
+			// ctx.Done() shortly anyway.
+			_, _ = fmt.Fprintln(stdio, msg)
+		}
+	}()
+	if err := start(childCtx, cancel, &streams, &egSend, tailLines,
+		logs); err != nil {
+		return err
+	}
+	// Wait for the writes to finish, then cancel the logs queue, wait for the
+	// read goroutine to exit, and return any sendErr.
+	sendErr := egSend.Wait()
+	cancel()
+	wgRecv.Wait()
+	return sendErr
 }
 
 // Logs takes a target namespace, deployment, and stdio stream, and writes the
 // log output of the pods of of the deployment to the stdio stream. If
 // container is specified, only logs of this container within the deployment
-// are returned.
+// are returned, and pods which don't have that container are skipped. It is
+// an error if no pod in the deployment has the container. Each log line is
+// written in the given format. If filter is not nil, only log lines which
+// it matches are written. Lines are filtered after tailLines is applied, so
+// fewer than tailLines lines may be written. If follow and markers are true,
+// informational marker lines are written when streaming from a container
+// starts or stops, and when a pod terminates. If initContainers is true, the
+// logs of init containers which have started are also written, including
+// those of pods which are blocked on an init container.
 //
 // This function exits on one of the following events:
 //
@@ -222,102 +639,74 @@ func (c *Client) Logs(
 	container string,
 	follow bool,
 	tailLines int64,
+	format LogFormat,
+	filter *regexp.Regexp,
+	markers,
+	initContainers bool,
 	stdio io.ReadWriter,
 ) error {
-	// Exit with an error if we have hit the concurrent log limit.
-	if !c.logSem.TryAcquire(1) {
-		return ErrConcurrentLogLimit
-	}
-	defer c.logSem.Release(1)
-	// Wrap the context so we can cancel subroutines of this function on error.
-	childCtx, cancel := context.WithTimeout(ctx, c.logTimeLimit)
-	defer cancel()
-	// Generate a requestID value to uniquely distinguish between multiple calls
-	// to this function. This requestID is used in readLogs() to distinguish
-	// entries in c.logStreamIDs.
-	requestID := uuid.New().String()
-	// clamp tailLines
-	if tailLines < 1 {
-		tailLines = defaultTailLines
-	}
-	if tailLines > maxTailLines {
-		tailLines = maxTailLines
-	}
-	// put sending goroutines in an errgroup.Group to handle errors, and
-	// receiving goroutines in a waitgroup (since they have no errors)
-	var egSend errgroup.Group
-	var wgRecv sync.WaitGroup
-	// initialise a buffered channel for the worker goroutines to write to, and
-	// for this function to read log lines from
-	logs := make(chan string, 4)
-	// start a goroutine reading from the logs channel and writing back to stdio
-	wgRecv.Add(1)
-	go func() {
-		defer wgRecv.Done()
-		for {
-			select {
-			case msg := <-logs:
-				// ignore errors writing to stdio. this may happen if the client
-				// disconnects after reading off the channel but before the log can be
-				// written. there's nothing we can do in this case and we'll select
-				// ctx.Done() shortly anyway.
-				_, _ = fmt.Fprintln(stdio, msg)
-			case <-childCtx.Done():
-				return // context done - client went away or error within Logs()
+	return c.streamLogs(ctx, tailLines, format, filter, markers, stdio,
+		c.deploymentLogs(namespace, deployment, container, follow,
+			initContainers))
+}
+
+// deploymentLogs returns a logStreamStarter which streams the logs of the
+// pods of the given deployment, as described in Logs.
+func (c *Client) deploymentLogs(
+	namespace,
+	deployment,
+	container string,
+	follow,
+	initContainers bool,
+) logStreamStarter {
+	return func(childCtx context.Context, cancel context.CancelFunc,
+		streams *logStreams, egSend *errgroup.Group, tailLines int64,
+		logs *logQueue) error {
+		if !follow {
+			// If not following the logs, avoid constructing an informer.
+			// Instead just read the logs from all existing pods.
+			pods, err := c.deploymentPods(childCtx, namespace, deployment)
+			if err != nil {
+				return err
+			}
+			if len(pods) == 0 {
+				return fmt.Errorf("no pods for deployment %s", deployment)
+			}
+			if container != "" &&
+				!podsHaveContainer(pods, container, initContainers) {
+				return fmt.Errorf("couldn't find container: %s", container)
+			}
+			c.readPodsLogs(childCtx, streams, egSend, pods, container, follow,
+				initContainers, tailLines, logs)
+			return nil
+		}
+		// If a container is specified, check that it exists in at least one pod
+		// before following the logs. If the deployment has no pods, there is
+		// nothing to check yet.
+		if container != "" {
+			pods, err := c.deploymentPods(childCtx, namespace, deployment)
+			if err != nil {
+				return err
+			}
+			if len(pods) > 0 &&
+				!podsHaveContainer(pods, container, initContainers) {
+				return fmt.Errorf("couldn't find container: %s", container)
 			}
 		}
-	}()
-	if follow {
 		// If following the logs, start a goroutine which watches for new (and
 		// existing) pods in the deployment and starts streaming logs from them.
 		egSend.Go(func() error {
-			podInformer, err := c.newPodInformer(childCtx, cancel, requestID,
-				&egSend, namespace, deployment, container, follow, tailLines, logs)
+			err := c.followPods(childCtx, cancel, streams, egSend,
+				namespace, deployment, container, initContainers, tailLines,
+				logs)
 			if err != nil {
-				return fmt.Errorf("couldn't construct new pod informer: %v", err)
+				return fmt.Errorf("couldn't follow pods: %w", err)
 			}
-			podInformer.Run(childCtx.Done())
 			if errors.Is(childCtx.Err(), context.DeadlineExceeded) {
 				return ErrLogTimeLimit
 			}
 			return nil
 		})
-	} else {
-		// If not following the logs, avoid constructing an informer. Instead just
-		// read the logs from all existing pods.
-		d, err := c.clientset.AppsV1().Deployments(namespace).Get(childCtx,
-			deployment, metav1.GetOptions{})
-		if err != nil {
-			return fmt.Errorf("couldn't get deployment: %v", err)
-		}
-		pods, err := c.clientset.CoreV1().Pods(namespace).List(childCtx,
-			metav1.ListOptions{
-				LabelSelector: labels.FormatLabels(d.Spec.Selector.MatchLabels),
-			})
-		if err != nil {
-			return fmt.Errorf("couldn't get pods: %v", err)
-		}
-		if len(pods.Items) == 0 {
-			return fmt.Errorf("no pods for deployment %s", deployment)
-		}
-		for _, pod := range pods.Items {
-			egSend.Go(func() error {
-				readLogsErr := c.readLogs(childCtx, requestID, &egSend, &pod,
-					container, follow, tailLines, logs)
-				if readLogsErr != nil {
-					return fmt.Errorf("couldn't read logs on existing pods: %v", readLogsErr)
-				}
-				if errors.Is(childCtx.Err(), context.DeadlineExceeded) {
-					return ErrLogTimeLimit
-				}
-				return nil
-			})
-		}
+		return nil
 	}
-	// Wait for the writes to finish, then close the logs channel, wait for the
-	// read goroutine to exit, and return any sendErr.
-	sendErr := egSend.Wait()
-	cancel()
-	wgRecv.Wait()
-	return sendErr
 }
@@ -3,12 +3,18 @@ package k8s
 import (
 	"bytes"
 	"context"
+	"errors"
 	"io"
+	"regexp"
+	"runtime"
+	"slices"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/alecthomas/assert/v2"
+	"github.com/prometheus/client_golang/prometheus"
 	"golang.org/x/sync/errgroup"
 	"golang.org/x/sync/semaphore"
 	appsv1 "k8s.io/api/apps/v1"
@@ -19,39 +25,206 @@ import (
 
 func TestLinewiseCopy(t *testing.T) {
 	var testCases = map[string]struct {
-		input  string
-		expect []string
-		prefix string
+		input         string
+		expect        []string
+		sanitize      bool
+		maxLineLength int
 	}{
 		"logs": {
 			input:  "foo\nbar\nbaz\n",
-			expect: []string{"test: foo", "test: bar", "test: baz"},
-			prefix: "test:",
+			expect: []string{"foo", "bar", "baz"},
+		},
+		"line below limit": {
+			input:         strings.Repeat("a", 31) + "\nbar\n",
+			expect:        []string{strings.Repeat("a", 31), "bar"},
+			maxLineLength: 32,
+		},
+		"line at limit": {
+			input:         strings.Repeat("a", 32) + "\nbar\n",
+			expect:        []string{strings.Repeat("a", 32), "bar"},
+			maxLineLength: 32,
+		},
+		"line above limit": {
+			input: strings.Repeat("a", 33) + "\nbar\n",
+			expect: []string{
+				strings.Repeat("a", 32) + " [truncated]",
+				"bar",
+			},
+			maxLineLength: 32,
+		},
+		"line far above limit": {
+			input: strings.Repeat("a", 1000) + "\nbar\n" +
+				strings.Repeat("b", 100),
+			expect: []string{
+				strings.Repeat("a", 32) + " [truncated]",
+				"bar",
+				strings.Repeat("b", 32) + " [truncated]",
+			},
+			maxLineLength: 32,
+		},
+		"line above default limit": {
+			input: strings.Repeat("a", 64*1024+1) + "\nbar\n",
+			expect: []string{
+				strings.Repeat("a", 64*1024+1),
+				"bar",
+			},
+		},
+		"windows line endings": {
+			input:  "foo\r\nbar\r\n",
+			expect: []string{"foo", "bar"},
+		},
+		"windows line endings at limit": {
+			input:         strings.Repeat("a", 32) + "\r\nbar\r\n",
+			expect:        []string{strings.Repeat("a", 32), "bar"},
+			maxLineLength: 32,
+		},
+		"windows line endings above limit": {
+			input: strings.Repeat("a", 33) + "\r\nbar\r\n",
+			expect: []string{
+				strings.Repeat("a", 32) + " [truncated]",
+				"bar",
+			},
+			maxLineLength: 32,
+		},
+		"empty lines": {
+			input:  "foo\n\nbar",
+			expect: []string{"foo", "", "bar"},
+		},
+		"escape sequences passed through": {
+			input:  "\x1b[31mfoo\x1b[0m\n",
+			expect: []string{"\x1b[31mfoo\x1b[0m"},
+		},
+		"escape sequences sanitized": {
+			input:    "\x1b[31mfoo\x1b[0m\nbar\x07\n",
+			expect:   []string{"foo", "bar"},
+			sanitize: true,
 		},
 	}
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 	for name, tc := range testCases {
 		t.Run(name, func(tt *testing.T) {
-			out := make(chan string, 1)
+			if tc.maxLineLength == 0 {
+				tc.maxLineLength = defaultMaxLineLength
+			}
+			out := newLogQueue(defaultLogQueueBytes, queuedBytesGauge())
 			in := io.NopCloser(strings.NewReader(tc.input))
-			go linewiseCopy(ctx, tc.prefix, out, in)
-			timer := time.NewTimer(500 * time.Millisecond)
+			go linewiseCopy(ctx, "foo", "bar", out, in, tc.sanitize,
+				tc.maxLineLength)
+			popCtx, popCancel := context.WithTimeout(ctx, 500*time.Millisecond)
+			defer popCancel()
 			var lines []string
-		loop:
 			for {
-				select {
-				case <-timer.C:
-					break loop
-				case line := <-out:
-					lines = append(lines, line)
+				record, err := out.pop(popCtx)
+				if err != nil {
+					break
 				}
+				assert.Equal(tt, "foo", record.pod, name)
+				assert.Equal(tt, "bar", record.container, name)
+				lines = append(lines, record.text)
 			}
 			assert.Equal(tt, tc.expect, lines, name)
 		})
 	}
 }
 
+func TestLinewiseCopyBufferSize(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	out := newLogQueue(defaultLogQueueBytes, queuedBytesGauge())
+	in := io.NopCloser(strings.NewReader("foo\nbar\n"))
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	linewiseCopy(ctx, "foo", "bar", out, in, false, defaultMaxLineLength)
+	runtime.ReadMemStats(&after)
+	// short lines must not allocate a buffer of the maximum line length
+	assert.True(t, after.TotalAlloc-before.TotalAlloc <
+		uint64(defaultMaxLineLength/4))
+}
+
+func TestClampTailLines(t *testing.T) {
+	var testCases = map[string]struct {
+		opts      []Option
+		tailLines int64
+		expect    int64
+	}{
+		"default unset": {
+			tailLines: 0,
+			expect:    32,
+		},
+		"default within limit": {
+			tailLines: 100,
+			expect:    100,
+		},
+		"default above limit": {
+			tailLines: 5000,
+			expect:    1024,
+		},
+		"custom unset": {
+			opts:      []Option{LogTailLines(100, 10000)},
+			tailLines: 0,
+			expect:    100,
+		},
+		"custom negative": {
+			opts:      []Option{LogTailLines(100, 10000)},
+			tailLines: -1,
+			expect:    100,
+		},
+		"custom within limit": {
+			opts:      []Option{LogTailLines(100, 10000)},
+			tailLines: 5000,
+			expect:    5000,
+		},
+		"custom at limit": {
+			opts:      []Option{LogTailLines(100, 10000)},
+			tailLines: 10000,
+			expect:    10000,
+		},
+		"custom above limit": {
+			opts:      []Option{LogTailLines(100, 10000)},
+			tailLines: 10001,
+			expect:    10000,
+		},
+		"invalid custom values ignored": {
+			opts:      []Option{LogTailLines(0, -1)},
+			tailLines: 5000,
+			expect:    1024,
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			c := &Client{
+				logDefaultTail: defaultTailLines,
+				logMaxTail:     defaultMaxTailLines,
+				logLimitBytes:  defaultLimitBytes,
+				logQueueBytes:  defaultLogQueueBytes,
+			}
+			for _, opt := range tc.opts {
+				opt(c)
+			}
+			assert.Equal(tt, tc.expect, c.clampTailLines(tc.tailLines), name)
+		})
+	}
+}
+
+func TestLogLimitBytes(t *testing.T) {
+	var testCases = map[string]struct {
+		limitBytes int64
+		expect     int64
+	}{
+		"custom":  {limitBytes: 10 * 1024 * 1024, expect: 10 * 1024 * 1024},
+		"zero":    {limitBytes: 0, expect: defaultLimitBytes},
+		"invalid": {limitBytes: -1, expect: defaultLimitBytes},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			c := &Client{logLimitBytes: defaultLimitBytes}
+			LogLimitBytes(tc.limitBytes)(c)
+			assert.Equal(tt, tc.expect, c.logLimitBytes, name)
+		})
+	}
+}
+
 func TestLogs(t *testing.T) {
 	testNS := "testns"
 	testDeploy := "foo"
@@ -124,9 +297,15 @@ func TestLogs(t *testing.T) {
 		t.Run(name, func(tt *testing.T) {
 			// create fake Kubernetes client with test deploys
 			c := &Client{
-				clientset:    fake.NewClientset(deploys, pods),
-				logSem:       semaphore.NewWeighted(int64(2)),
-				logTimeLimit: time.Second,
+				clientset:      fake.NewClientset(deploys, pods),
+				logSem:         semaphore.NewWeighted(int64(2)),
+				logTimeLimit:   time.Second,
+				logMaxLine:     defaultMaxLineLength,
+				logDefaultTail: 5,
+				logMaxTail:     50,
+				logLimitBytes:  2048,
+				logQueueBytes:  1024,
+				metrics:        NewMetrics(prometheus.NewRegistry()),
 			}
 			// execute test
 			var buf bytes.Buffer
@@ -134,7 +313,8 @@ func TestLogs(t *testing.T) {
 			ctx := context.Background()
 			for range tc.sessionCount {
 				eg.Go(func() error {
-					return c.Logs(ctx, testNS, testDeploy, testPod, tc.follow, 10, &buf)
+					return c.Logs(ctx, testNS, testDeploy, testPod, tc.follow, 10,
+						LogFormatText, nil, false, false, &buf)
 				})
 			}
 			// check results
@@ -149,3 +329,599 @@ func TestLogs(t *testing.T) {
 		})
 	}
 }
+
+func TestLogsMixedPods(t *testing.T) {
+	testNS := "testns"
+	testDeploy := "foo"
+	deploys := &appsv1.DeploymentList{
+		Items: []appsv1.Deployment{
+			{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      testDeploy,
+					Namespace: testNS,
+				},
+				Spec: appsv1.DeploymentSpec{
+					Selector: &metav1.LabelSelector{
+						MatchLabels: map[string]string{
+							"app.kubernetes.io/name": "foo-app",
+						},
+					},
+				},
+			},
+		},
+	}
+	// emulate a rolling update where the new pod spec adds a container
+	newPod := func(name string, containers ...string) corev1.Pod {
+		pod := corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: testNS,
+				Labels: map[string]string{
+					"app.kubernetes.io/name": "foo-app",
+				},
+			},
+		}
+		for _, container := range containers {
+			pod.Status.ContainerStatuses = append(pod.Status.ContainerStatuses,
+				corev1.ContainerStatus{Name: container, ContainerID: name + container})
+		}
+		return pod
+	}
+	pods := &corev1.PodList{
+		Items: []corev1.Pod{
+			newPod("foo-old", "nginx"),
+			newPod("foo-new", "nginx", "php"),
+		},
+	}
+	var testCases = map[string]struct {
+		container   string
+		filter      *regexp.Regexp
+		expectLines []string
+		expectError bool
+	}{
+		"container in all pods": {
+			container: "nginx",
+			expectLines: []string{
+				"[pod/foo-new/nginx] fake logs",
+				"[pod/foo-old/nginx] fake logs",
+			},
+		},
+		"container in some pods": {
+			container:   "php",
+			expectLines: []string{"[pod/foo-new/php] fake logs"},
+		},
+		"container in no pods": {
+			container:   "redis",
+			expectError: true,
+		},
+		"filter matches": {
+			container:   "php",
+			filter:      regexp.MustCompile(`^fake`),
+			expectLines: []string{"[pod/foo-new/php] fake logs"},
+		},
+		"filter excludes": {
+			container:   "php",
+			filter:      regexp.MustCompile(`error|warn`),
+			expectLines: []string{""},
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			c := &Client{
+				clientset:      fake.NewClientset(deploys, pods),
+				logSem:         semaphore.NewWeighted(int64(1)),
+				logTimeLimit:   5 * time.Second,
+				logMaxLine:     defaultMaxLineLength,
+				logDefaultTail: defaultTailLines,
+				logMaxTail:     defaultMaxTailLines,
+				logLimitBytes:  defaultLimitBytes,
+				logQueueBytes:  defaultLogQueueBytes,
+				metrics:        NewMetrics(prometheus.NewRegistry()),
+			}
+			var buf bytes.Buffer
+			err := c.Logs(context.Background(), testNS, testDeploy, tc.container,
+				false, 10, LogFormatText, tc.filter, false, false, &buf)
+			if tc.expectError {
+				assert.Error(tt, err, name)
+				return
+			}
+			assert.NoError(tt, err, name)
+			lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+			slices.Sort(lines)
+			assert.Equal(tt, tc.expectLines, lines, name)
+		})
+	}
+}
+
+func TestReadLogsSkipsPodWithoutContainer(t *testing.T) {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo-old", Namespace: "testns"},
+		Status: corev1.PodStatus{
+			ContainerStatuses: []corev1.ContainerStatus{{Name: "nginx"}},
+		},
+	}
+	c := &Client{clientset: fake.NewClientset(pod)}
+	var eg errgroup.Group
+	logs := newLogQueue(defaultLogQueueBytes, queuedBytesGauge())
+	err := c.readLogs(context.Background(), &logStreams{}, &eg, pod, "php",
+		false, false, 10, logs)
+	assert.NoError(t, err)
+	assert.NoError(t, eg.Wait())
+}
+
+func TestLogStreamsCleanup(t *testing.T) {
+	testNS := "testns"
+	testDeploy := "foo"
+	deploy := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      testDeploy,
+			Namespace: testNS,
+		},
+		Spec: appsv1.DeploymentSpec{
+			Selector: &metav1.LabelSelector{
+				MatchLabels: map[string]string{
+					"app.kubernetes.io/name": "foo-app",
+				},
+			},
+		},
+	}
+	newPod := func(name string) *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: testNS,
+				Labels: map[string]string{
+					"app.kubernetes.io/name": "foo-app",
+				},
+			},
+			Status: corev1.PodStatus{
+				Phase: corev1.PodRunning,
+				Conditions: []corev1.PodCondition{{
+					Type:   corev1.ContainersReady,
+					Status: corev1.ConditionTrue,
+				}},
+				ContainerStatuses: []corev1.ContainerStatus{{
+					Name:        "nginx",
+					ContainerID: name + "-nginx",
+				}},
+			},
+		}
+	}
+	var testCases = map[string]struct {
+		follow      bool
+		container   string
+		expectError error
+	}{
+		"no follow": {},
+		"follow time limit": {
+			follow:      true,
+			expectError: ErrLogTimeLimit,
+		},
+		"missing container": {
+			container:   "php",
+			expectError: errors.New("couldn't find container: php"),
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			c := &Client{
+				clientset: fake.NewClientset(deploy, newPod("foo-1"),
+					newPod("foo-2")),
+				logSem:         semaphore.NewWeighted(int64(1)),
+				logTimeLimit:   500 * time.Millisecond,
+				logMaxLine:     defaultMaxLineLength,
+				logDefaultTail: defaultTailLines,
+				logMaxTail:     defaultMaxTailLines,
+				logLimitBytes:  defaultLimitBytes,
+				logQueueBytes:  defaultLogQueueBytes,
+				metrics:        NewMetrics(prometheus.NewRegistry()),
+			}
+			// wrap the starter used by Logs to capture the session streams
+			var streams *logStreams
+			start := c.deploymentLogs(testNS, testDeploy, tc.container,
+				tc.follow, false)
+			var out syncBuffer
+			err := c.streamLogs(context.Background(), 10, LogFormatText, nil,
+				false, &out, func(ctx context.Context,
+					cancel context.CancelFunc, s *logStreams,
+					egSend *errgroup.Group, tailLines int64,
+					logs *logQueue) error {
+					streams = s
+					return start(ctx, cancel, s, egSend, tailLines, logs)
+				})
+			if tc.expectError != nil {
+				assert.EqualError(tt, err, tc.expectError.Error(), name)
+			} else {
+				assert.NoError(tt, err, name)
+			}
+			assert.Equal(tt, 0, streams.len(), name)
+			if tc.expectError == nil || tc.follow {
+				assert.Equal(tt, 2,
+					strings.Count(out.String(), "fake logs"), name)
+			}
+		})
+	}
+}
+
+func TestLogsInitContainers(t *testing.T) {
+	testNS := "testns"
+	testDeploy := "foo"
+	deploy := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      testDeploy,
+			Namespace: testNS,
+		},
+		Spec: appsv1.DeploymentSpec{
+			Selector: &metav1.LabelSelector{
+				MatchLabels: map[string]string{
+					"app.kubernetes.io/name": "foo-app",
+				},
+			},
+		},
+	}
+	running := corev1.ContainerState{Running: &corev1.ContainerStateRunning{}}
+	initializing := corev1.ContainerState{
+		Waiting: &corev1.ContainerStateWaiting{Reason: "PodInitializing"},
+	}
+	newPod := func(phase corev1.PodPhase,
+		initState, state corev1.ContainerState) *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "foo-1",
+				Namespace: testNS,
+				Labels: map[string]string{
+					"app.kubernetes.io/name": "foo-app",
+				},
+			},
+			Status: corev1.PodStatus{
+				Phase: phase,
+				InitContainerStatuses: []corev1.ContainerStatus{{
+					Name:        "migrate",
+					ContainerID: "foo-1-migrate",
+					State:       initState,
+				}},
+				ContainerStatuses: []corev1.ContainerStatus{{
+					Name:        "nginx",
+					ContainerID: "foo-1-nginx",
+					State:       state,
+				}},
+			},
+		}
+	}
+	var testCases = map[string]struct {
+		pod            *corev1.Pod
+		container      string
+		initContainers bool
+		expectLines    []string
+		expectError    bool
+	}{
+		"running init container": {
+			pod:            newPod(corev1.PodPending, running, initializing),
+			initContainers: true,
+			expectLines:    []string{"[pod/foo-1/migrate] fake logs"},
+		},
+		"failed init container": {
+			pod: newPod(corev1.PodPending, corev1.ContainerState{
+				Terminated: &corev1.ContainerStateTerminated{
+					ExitCode: 1,
+					Reason:   "Error",
+				},
+			}, initializing),
+			initContainers: true,
+			expectLines:    []string{"[pod/foo-1/migrate] fake logs"},
+		},
+		"completed init container": {
+			pod: newPod(corev1.PodRunning, corev1.ContainerState{
+				Terminated: &corev1.ContainerStateTerminated{
+					Reason: "Completed",
+				},
+			}, running),
+			initContainers: true,
+			expectLines: []string{
+				"[pod/foo-1/migrate] fake logs",
+				"[pod/foo-1/nginx] fake logs",
+			},
+		},
+		"init container by name": {
+			pod:            newPod(corev1.PodPending, running, initializing),
+			container:      "migrate",
+			initContainers: true,
+			expectLines:    []string{"[pod/foo-1/migrate] fake logs"},
+		},
+		"init container by name without init": {
+			pod:         newPod(corev1.PodPending, running, initializing),
+			container:   "migrate",
+			expectError: true,
+		},
+		"without init": {
+			pod:         newPod(corev1.PodRunning, running, running),
+			expectLines: []string{"[pod/foo-1/nginx] fake logs"},
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			c := &Client{
+				clientset:      fake.NewClientset(deploy, tc.pod),
+				logSem:         semaphore.NewWeighted(int64(1)),
+				logTimeLimit:   5 * time.Second,
+				logMaxLine:     defaultMaxLineLength,
+				logDefaultTail: defaultTailLines,
+				logMaxTail:     defaultMaxTailLines,
+				logLimitBytes:  defaultLimitBytes,
+				logQueueBytes:  defaultLogQueueBytes,
+				metrics:        NewMetrics(prometheus.NewRegistry()),
+			}
+			var buf bytes.Buffer
+			err := c.Logs(context.Background(), testNS, testDeploy, tc.container,
+				false, 10, LogFormatText, nil, false, tc.initContainers, &buf)
+			if tc.expectError {
+				assert.Error(tt, err, name)
+				return
+			}
+			assert.NoError(tt, err, name)
+			lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+			slices.Sort(lines)
+			assert.Equal(tt, tc.expectLines, lines, name)
+		})
+	}
+}
+
+func TestLogsFollowInitContainers(t *testing.T) {
+	testNS := "testns"
+	testDeploy := "foo"
+	deploy := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      testDeploy,
+			Namespace: testNS,
+		},
+		Spec: appsv1.DeploymentSpec{
+			Selector: &metav1.LabelSelector{
+				MatchLabels: map[string]string{
+					"app.kubernetes.io/name": "foo-app",
+				},
+			},
+		},
+	}
+	// the pod is blocked on a running init container
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "foo-1",
+			Namespace: testNS,
+			Labels: map[string]string{
+				"app.kubernetes.io/name": "foo-app",
+			},
+		},
+		Status: corev1.PodStatus{
+			Phase: corev1.PodPending,
+			InitContainerStatuses: []corev1.ContainerStatus{{
+				Name:        "migrate",
+				ContainerID: "foo-1-migrate",
+				State: corev1.ContainerState{
+					Running: &corev1.ContainerStateRunning{},
+				},
+			}},
+			ContainerStatuses: []corev1.ContainerStatus{{
+				Name:        "nginx",
+				ContainerID: "foo-1-nginx",
+				State: corev1.ContainerState{
+					Waiting: &corev1.ContainerStateWaiting{
+						Reason: "PodInitializing",
+					},
+				},
+			}},
+		},
+	}
+	clientset := fake.NewClientset(deploy, pod)
+	fieldSelectors := applyPodFieldSelectors(clientset)
+	c := &Client{
+		clientset:      clientset,
+		logSem:         semaphore.NewWeighted(int64(1)),
+		logTimeLimit:   time.Minute,
+		logMaxLine:     defaultMaxLineLength,
+		logDefaultTail: defaultTailLines,
+		logMaxTail:     defaultMaxTailLines,
+		logLimitBytes:  defaultLimitBytes,
+		logQueueBytes:  defaultLogQueueBytes,
+		metrics:        NewMetrics(prometheus.NewRegistry()),
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var out syncBuffer
+	var eg errgroup.Group
+	eg.Go(func() error {
+		return c.Logs(ctx, testNS, testDeploy, "", true, 10, LogFormatText, nil,
+			false, true, &out)
+	})
+	assert.True(t, waitUntil(func() bool {
+		return strings.Contains(out.String(), "[pod/foo-1/migrate] fake logs")
+	}))
+	// complete the init container and start the pod
+	ready := pod.DeepCopy()
+	ready.Status.Phase = corev1.PodRunning
+	ready.Status.Conditions = []corev1.PodCondition{{
+		Type:   corev1.ContainersReady,
+		Status: corev1.ConditionTrue,
+	}}
+	ready.Status.InitContainerStatuses[0].State = corev1.ContainerState{
+		Terminated: &corev1.ContainerStateTerminated{Reason: "Completed"},
+	}
+	ready.Status.ContainerStatuses[0].State = corev1.ContainerState{
+		Running: &corev1.ContainerStateRunning{},
+	}
+	// wait for the init container stream to finish, so that it would be
+	// streamed again if it were not marked done
+	time.Sleep(1500 * time.Millisecond)
+	_, err := clientset.CoreV1().Pods(testNS).UpdateStatus(ctx, ready,
+		metav1.UpdateOptions{})
+	assert.NoError(t, err)
+	assert.True(t, waitUntil(func() bool {
+		return strings.Contains(out.String(), "[pod/foo-1/nginx] fake logs")
+	}))
+	cancel()
+	assert.NoError(t, eg.Wait())
+	assert.Equal(t, []string{
+		"[pod/foo-1/migrate] fake logs",
+		"[pod/foo-1/nginx] fake logs",
+	}, strings.Split(strings.TrimSpace(out.String()), "\n"))
+	// pods running init containers are Pending, so must not be filtered out
+	for _, selector := range fieldSelectors() {
+		assert.Equal(t, "", selector)
+	}
+}
+
+func TestLogStreams(t *testing.T) {
+	var streams logStreams
+	assert.True(t, streams.add("a"))
+	assert.False(t, streams.add("a"))
+	assert.True(t, streams.add("b"))
+	assert.Equal(t, 2, streams.len())
+	streams.remove("a")
+	assert.True(t, streams.add("a"))
+	streams.remove("a")
+	streams.remove("b")
+	assert.Equal(t, 0, streams.len())
+}
+
+// syncBuffer is an io.ReadWriter which may be written and read concurrently.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Read(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Read(p)
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestLogsFollowMarkers(t *testing.T) {
+	testNS := "testns"
+	testDeploy := "foo"
+	deploy := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      testDeploy,
+			Namespace: testNS,
+		},
+		Spec: appsv1.DeploymentSpec{
+			Selector: &metav1.LabelSelector{
+				MatchLabels: map[string]string{
+					"app.kubernetes.io/name": "foo-app",
+				},
+			},
+		},
+	}
+	newPod := func(name string, restarts int32) *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: testNS,
+				Labels: map[string]string{
+					"app.kubernetes.io/name": "foo-app",
+				},
+			},
+			Status: corev1.PodStatus{
+				Phase: corev1.PodRunning,
+				Conditions: []corev1.PodCondition{{
+					Type:   corev1.ContainersReady,
+					Status: corev1.ConditionTrue,
+				}},
+				ContainerStatuses: []corev1.ContainerStatus{{
+					Name:         "nginx",
+					ContainerID:  name + "-nginx",
+					RestartCount: restarts,
+				}},
+			},
+		}
+	}
+	var testCases = map[string]struct {
+		markers     bool
+		expectLines []string
+	}{
+		"markers": {
+			markers: true,
+			expectLines: []string{
+				"=== started streaming pod/foo-old/nginx ===",
+				"[pod/foo-old/nginx] fake logs",
+				"=== stopped streaming pod/foo-old/nginx ===",
+				"=== pod/foo-old terminated ===",
+				"=== started streaming pod/foo-new/nginx (restart #2) ===",
+				"[pod/foo-new/nginx] fake logs",
+				"=== stopped streaming pod/foo-new/nginx ===",
+			},
+		},
+		"no markers": {
+			expectLines: []string{
+				"[pod/foo-old/nginx] fake logs",
+				"[pod/foo-new/nginx] fake logs",
+			},
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			clientset := fake.NewClientset(deploy, newPod("foo-old", 0))
+			c := &Client{
+				clientset:      clientset,
+				logSem:         semaphore.NewWeighted(int64(1)),
+				logTimeLimit:   time.Minute,
+				logMaxLine:     defaultMaxLineLength,
+				logDefaultTail: defaultTailLines,
+				logMaxTail:     defaultMaxTailLines,
+				logLimitBytes:  defaultLimitBytes,
+				logQueueBytes:  defaultLogQueueBytes,
+				metrics:        NewMetrics(prometheus.NewRegistry()),
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			var out syncBuffer
+			var eg errgroup.Group
+			eg.Go(func() error {
+				return c.Logs(ctx, testNS, testDeploy, "", true, 10,
+					LogFormatText, nil, tc.markers, false, &out)
+			})
+			// waitFor waits until the output contains the given line
+			waitFor := func(line string) {
+				assert.True(tt, waitUntil(func() bool {
+					return strings.Contains(out.String(), line+"\n")
+				}), "%s: waiting for %q", name, line)
+			}
+			// replace the pod once its logs have been read
+			waitFor(tc.expectLines[len(tc.expectLines)/2-1])
+			err := clientset.CoreV1().Pods(testNS).Delete(ctx, "foo-old",
+				metav1.DeleteOptions{})
+			assert.NoError(tt, err, name)
+			_, err = clientset.CoreV1().Pods(testNS).Create(ctx,
+				newPod("foo-new", 2), metav1.CreateOptions{})
+			assert.NoError(tt, err, name)
+			waitFor(tc.expectLines[len(tc.expectLines)-1])
+			cancel()
+			assert.NoError(tt, eg.Wait(), name)
+			lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+			assert.Equal(tt, tc.expectLines, lines, name)
+		})
+	}
+}
+
+// waitUntil polls cond until it returns true, or a timeout is reached. It
+// returns the last result of cond.
+func waitUntil(cond func() bool) bool {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return true
+}
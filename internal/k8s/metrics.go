@@ -0,0 +1,75 @@
+package k8s
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Outcomes of unidling, used as the outcome label of the unidle_total metric.
+const (
+	unidleOutcomeSuccess = "success"
+	unidleOutcomeTimeout = "timeout"
+	unidleOutcomeError   = "error"
+)
+
+// Metrics contains the Prometheus metrics exported by the Kubernetes client.
+type Metrics struct {
+	rateLimiterLatency *prometheus.HistogramVec
+	logsQueuedBytes    prometheus.Gauge
+	podInformers       prometheus.Gauge
+	callDuration       *prometheus.HistogramVec
+	// unidle metrics
+	unidleTotal           *prometheus.CounterVec
+	unidleDuration        prometheus.Histogram
+	unidleTimeoutSessions prometheus.Counter
+}
+
+// NewMetrics creates the Kubernetes client metrics and registers them with
+// reg.
+func NewMetrics(reg prometheus.Registerer) *Metrics {
+	factory := promauto.With(reg)
+	return &Metrics{
+		rateLimiterLatency: factory.NewHistogramVec(prometheus.HistogramOpts{
+			Name: "sshportal_k8s_rate_limiter_duration_seconds",
+			Help: "Time spent waiting on the client-side Kubernetes API rate limiter",
+		}, []string{"verb"}),
+		logsQueuedBytes: factory.NewGauge(prometheus.GaugeOpts{
+			Name: "sshportal_logs_queued_bytes",
+			Help: "Current number of bytes of log lines queued for sending to clients",
+		}),
+		podInformers: factory.NewGauge(prometheus.GaugeOpts{
+			Name: "sshportal_logs_pod_informers",
+			Help: "Current number of pod informers shared by log sessions following logs",
+		}),
+		callDuration: factory.NewHistogramVec(prometheus.HistogramOpts{
+			Name: "sshportal_k8s_call_duration_seconds",
+			Help: "Time taken by Kubernetes API calls on the SSH session critical path",
+		}, []string{"method", "outcome"}),
+		unidleTotal: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "sshportal_unidle_total",
+			Help: "The total number of times SSH sessions triggered unidling",
+		}, []string{"outcome"}),
+		unidleDuration: factory.NewHistogram(prometheus.HistogramOpts{
+			Name:    "sshportal_unidle_duration_seconds",
+			Help:    "Time taken for an unidled deployment to have a running pod",
+			Buckets: prometheus.ExponentialBuckets(1, 2, 8),
+		}),
+		unidleTimeoutSessions: factory.NewCounter(prometheus.CounterOpts{
+			Name: "sshportal_unidle_timeout_sessions_total",
+			Help: "The total number of SSH sessions which failed due to unidle timeout",
+		}),
+	}
+}
+
+// Collectors returns each of the metrics in m.
+func (m *Metrics) Collectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		m.rateLimiterLatency,
+		m.logsQueuedBytes,
+		m.podInformers,
+		m.callDuration,
+		m.unidleTotal,
+		m.unidleDuration,
+		m.unidleTimeoutSessions,
+	}
+}
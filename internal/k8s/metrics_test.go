@@ -0,0 +1,22 @@
+package k8s
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/alecthomas/assert/v2"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestMetricsCollectors(t *testing.T) {
+	m := NewMetrics(prometheus.NewRegistry())
+	// check that Collectors returns every metric exactly once
+	collectors := m.Collectors()
+	assert.Equal(t, reflect.TypeOf(*m).NumField(), len(collectors))
+	seen := map[prometheus.Collector]bool{}
+	for _, c := range collectors {
+		assert.NotZero(t, c)
+		assert.False(t, seen[c])
+		seen[c] = true
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"context"
 	"fmt"
 	"strconv"
+	"strings"
+	"time"
 
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
@@ -13,6 +15,10 @@ const (
 	environmentNameLabel = "lagoon.sh/environment"
 	projectIDLabel       = "lagoon.sh/projectId"
 	projectNameLabel     = "lagoon.sh/project"
+	environmentTypeLabel = "lagoon.sh/environmentType"
+	// shellAnnotation optionally overrides the default shell used for
+	// interactive sessions and commands in the namespace.
+	shellAnnotation = "ssh.lagoon.sh/shell"
 )
 
 func intFromLabel(labels map[string]string, label string) (int, error) {
@@ -24,38 +30,46 @@ func intFromLabel(labels map[string]string, label string) (int, error) {
 	return strconv.Atoi(value)
 }
 
-// NamespaceDetails gets the environment ID, project ID, and project name from
-// the labels on a Lagoon environment namespace for a Lagoon namespace. If one
-// of the expected labels is missing or cannot be parsed, it will return an
-// error.
+// NamespaceDetails gets the environment ID, environment name, project ID, and
+// project name from the labels on a Lagoon environment namespace for a Lagoon
+// namespace. If one of the expected labels is missing or cannot be parsed, it
+// will return an error. It also returns the environment type label and the
+// value of the shell annotation on the namespace, each of which is an empty
+// string if not set.
 func (c *Client) NamespaceDetails(
 	ctx context.Context,
 	name string,
-) (int, int, string, string, error) {
+) (int, int, string, string, string, string, error) {
 	var eid, pid int
 	var ename, pname string
 	var ok bool
 	ctx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
+	start := time.Now()
 	ns, err :=
 		c.clientset.CoreV1().Namespaces().Get(ctx, name, metav1.GetOptions{})
+	c.observeCall(ctx, "NamespaceDetails", start, callOutcome(err))
 	if err != nil {
-		return 0, 0, "", "", fmt.Errorf("couldn't get namespace: %v", err)
+		return 0, 0, "", "", "", "",
+			fmt.Errorf("couldn't get namespace: %w", err)
 	}
 	if eid, err = intFromLabel(ns.Labels, environmentIDLabel); err != nil {
-		return 0, 0, "", "",
-			fmt.Errorf("couldn't get environment ID from label: %v", err)
+		return 0, 0, "", "", "", "",
+			fmt.Errorf("couldn't get environment ID from label: %w", err)
 	}
 	if pid, err = intFromLabel(ns.Labels, projectIDLabel); err != nil {
-		return 0, 0, "", "", fmt.Errorf("couldn't get project ID from label: %v", err)
+		return 0, 0, "", "", "", "",
+			fmt.Errorf("couldn't get project ID from label: %w", err)
 	}
 	if ename, ok = ns.Labels[environmentNameLabel]; !ok {
-		return 0, 0, "", "", fmt.Errorf("missing environment name label %v",
-			environmentNameLabel)
+		return 0, 0, "", "", "", "",
+			fmt.Errorf("missing environment name label %v", environmentNameLabel)
 	}
 	if pname, ok = ns.Labels[projectNameLabel]; !ok {
-		return 0, 0, "", "",
+		return 0, 0, "", "", "", "",
 			fmt.Errorf("missing project name label %v", projectNameLabel)
 	}
-	return eid, pid, ename, pname, nil
+	etype := ns.Labels[environmentTypeLabel]
+	shell := strings.TrimSpace(ns.Annotations[shellAnnotation])
+	return eid, pid, ename, pname, etype, shell, nil
 }
@@ -1,9 +1,15 @@
 package k8s
 
 import (
+	"context"
+	"maps"
 	"testing"
 
 	"github.com/alecthomas/assert/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
 )
 
 func TestIntFromLabel(t *testing.T) {
@@ -39,3 +45,111 @@ func TestIntFromLabel(t *testing.T) {
 		})
 	}
 }
+
+func TestNamespaceDetails(t *testing.T) {
+	labels := map[string]string{
+		environmentIDLabel:   "3",
+		environmentNameLabel: "main",
+		projectIDLabel:       "2",
+		projectNameLabel:     "my-project",
+	}
+	var testCases = map[string]struct {
+		labels      map[string]string
+		annotations map[string]string
+		expectType  string
+		expectShell string
+	}{
+		"no shell annotation": {},
+		"environment type label": {
+			labels:     map[string]string{environmentTypeLabel: "production"},
+			expectType: "production",
+		},
+		"shell annotation": {
+			annotations: map[string]string{shellAnnotation: "bash"},
+			expectShell: "bash",
+		},
+		"shell annotation with whitespace": {
+			annotations: map[string]string{shellAnnotation: " /opt/busybox/ash\n"},
+			expectShell: "/opt/busybox/ash",
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			nsLabels := maps.Clone(labels)
+			maps.Copy(nsLabels, tc.labels)
+			c := &Client{
+				clientset: fake.NewClientset(&corev1.Namespace{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:        "my-project-main",
+						Labels:      nsLabels,
+						Annotations: tc.annotations,
+					},
+				}),
+				metrics: NewMetrics(prometheus.NewRegistry()),
+			}
+			eid, pid, ename, pname, etype, shell, err :=
+				c.NamespaceDetails(context.Background(), "my-project-main")
+			assert.NoError(tt, err, name)
+			assert.Equal(tt, 3, eid, name)
+			assert.Equal(tt, 2, pid, name)
+			assert.Equal(tt, "main", ename, name)
+			assert.Equal(tt, "my-project", pname, name)
+			assert.Equal(tt, tc.expectType, etype, name)
+			assert.Equal(tt, tc.expectShell, shell, name)
+		})
+	}
+}
+
+func TestNamespaceDetailsMetrics(t *testing.T) {
+	namespace := &corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "my-project-main",
+			Labels: map[string]string{
+				environmentIDLabel:   "3",
+				environmentNameLabel: "main",
+				projectIDLabel:       "2",
+				projectNameLabel:     "my-project",
+			},
+		},
+	}
+	var testCases = map[string]struct {
+		clientset     *fake.Clientset
+		expectOutcome string
+	}{
+		"ok": {
+			clientset:     fake.NewClientset(namespace),
+			expectOutcome: callOutcomeOK,
+		},
+		"not found": {
+			clientset:     fake.NewClientset(),
+			expectOutcome: callOutcomeNotFound,
+		},
+		"error": {
+			clientset:     errorClientset(),
+			expectOutcome: callOutcomeError,
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			m := NewMetrics(prometheus.NewRegistry())
+			c := &Client{clientset: tc.clientset, metrics: m}
+			_, _, _, _, _, _, err :=
+				c.NamespaceDetails(context.Background(), "my-project-main")
+			if tc.expectOutcome == callOutcomeOK {
+				assert.NoError(tt, err, name)
+			} else {
+				assert.Error(tt, err, name)
+			}
+			for _, outcome := range []string{
+				callOutcomeOK, callOutcomeNotFound, callOutcomeError,
+			} {
+				var expect uint64
+				if outcome == tc.expectOutcome {
+					expect = 1
+				}
+				assert.Equal(tt, expect,
+					callCount(tt, m, "NamespaceDetails", outcome), name)
+			}
+		})
+	}
+}
@@ -0,0 +1,127 @@
+package k8s
+
+import (
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+// runningPods is the field selector which restricts pod informers to running
+// pods. Callers which only need pods with ready containers, which are always
+// running, use it so that other pods needn't be held in the informer cache.
+var runningPods = fields.OneTermEqualSelector("status.phase",
+	string(corev1.PodRunning)).String()
+
+// podInformerKey identifies the pods watched by a shared pod informer.
+// Informers are only shared by callers which need the same pods, so the
+// field selector is part of the key.
+type podInformerKey struct {
+	namespace     string
+	labelSelector string
+	fieldSelector string
+}
+
+// newPodInformerFactory returns an informer factory which watches the pods
+// identified by key.
+func newPodInformerFactory(
+	clientset kubernetes.Interface,
+	key podInformerKey,
+) informers.SharedInformerFactory {
+	return informers.NewSharedInformerFactoryWithOptions(
+		clientset,
+		time.Hour,
+		informers.WithNamespace(key.namespace),
+		informers.WithTweakListOptions(func(opts *metav1.ListOptions) {
+			opts.LabelSelector = key.labelSelector
+			opts.FieldSelector = key.fieldSelector
+		}),
+	)
+}
+
+// sharedPodInformer is a running pod informer and the number of log sessions
+// using it.
+type sharedPodInformer struct {
+	factory  informers.SharedInformerFactory
+	informer cache.SharedIndexInformer
+	stop     chan struct{}
+	refs     int
+}
+
+// podInformers is a registry of the pod informers used by log sessions
+// which follow logs. Concurrent sessions which follow the same pods share a
+// single informer, so that its cache of pods is held in memory only once.
+// The zero value is ready to use.
+type podInformers struct {
+	mu        sync.Mutex
+	informers map[podInformerKey]*sharedPodInformer
+	// newFactory constructs the informer factory for a key. If nil,
+	// newPodInformerFactory is used.
+	newFactory func(kubernetes.Interface,
+		podInformerKey) informers.SharedInformerFactory
+}
+
+// acquirePodInformer returns a running informer on the pods identified by
+// key, starting one if it isn't already shared by another log session. The
+// returned function releases the informer, and must be called once the
+// caller has removed its event handlers. The informer is stopped once it has
+// been released by every caller.
+func (c *Client) acquirePodInformer(
+	key podInformerKey,
+) (cache.SharedIndexInformer, func()) {
+	p := &c.podInformers
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	shared, ok := p.informers[key]
+	if !ok {
+		newFactory := p.newFactory
+		if newFactory == nil {
+			newFactory = newPodInformerFactory
+		}
+		factory := newFactory(c.clientset, key)
+		shared = &sharedPodInformer{
+			factory: factory,
+			// the informer must be requested before the factory is started
+			informer: factory.Core().V1().Pods().Informer(),
+			stop:     make(chan struct{}),
+		}
+		factory.Start(shared.stop)
+		if p.informers == nil {
+			p.informers = map[podInformerKey]*sharedPodInformer{}
+		}
+		p.informers[key] = shared
+		c.metrics.podInformers.Inc()
+	}
+	shared.refs++
+	var once sync.Once
+	return shared.informer, func() {
+		once.Do(func() { c.releasePodInformer(key, shared) })
+	}
+}
+
+// releasePodInformer drops a reference to the shared informer, and stops it
+// if it has no remaining references.
+func (c *Client) releasePodInformer(
+	key podInformerKey,
+	shared *sharedPodInformer,
+) {
+	p := &c.podInformers
+	p.mu.Lock()
+	shared.refs--
+	if shared.refs > 0 {
+		p.mu.Unlock()
+		return
+	}
+	delete(p.informers, key)
+	c.metrics.podInformers.Dec()
+	p.mu.Unlock()
+	// Shutdown blocks until the informer goroutines exit, so call it without
+	// holding the lock.
+	close(shared.stop)
+	shared.factory.Shutdown()
+}
@@ -0,0 +1,292 @@
+package k8s
+
+import (
+	"context"
+	"io"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/assert/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/semaphore"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/cache"
+)
+
+// countingFactory wraps an informer factory and counts calls to Shutdown.
+type countingFactory struct {
+	informers.SharedInformerFactory
+	recorder *factoryRecorder
+}
+
+func (f *countingFactory) Shutdown() {
+	f.SharedInformerFactory.Shutdown()
+	f.recorder.mu.Lock()
+	defer f.recorder.mu.Unlock()
+	f.recorder.shutdowns++
+}
+
+// factoryRecorder records the informer factories created by a Client.
+type factoryRecorder struct {
+	mu        sync.Mutex
+	keys      []podInformerKey
+	shutdowns int
+}
+
+// newFactory wraps newPodInformerFactory, recording the factories created.
+func (r *factoryRecorder) newFactory(
+	clientset kubernetes.Interface,
+	key podInformerKey,
+) informers.SharedInformerFactory {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.keys = append(r.keys, key)
+	return &countingFactory{
+		SharedInformerFactory: newPodInformerFactory(clientset, key),
+		recorder:              r,
+	}
+}
+
+// counts returns the number of factories created and shut down.
+func (r *factoryRecorder) counts() (int, int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.keys), r.shutdowns
+}
+
+// applyPodFieldSelectors makes clientset apply the status.phase field
+// selector of pod list requests, which the fake clientset otherwise ignores.
+// The returned function returns the field selectors of the requests.
+func applyPodFieldSelectors(clientset *fake.Clientset) func() []string {
+	var mu sync.Mutex
+	var selectors []string
+	clientset.PrependReactor("list", "pods",
+		func(action k8stesting.Action) (bool, runtime.Object, error) {
+			restrictions := action.(k8stesting.ListAction).GetListRestrictions()
+			mu.Lock()
+			selectors = append(selectors, restrictions.Fields.String())
+			mu.Unlock()
+			if restrictions.Fields.Empty() {
+				return false, nil, nil
+			}
+			obj, err := clientset.Tracker().List(
+				corev1.SchemeGroupVersion.WithResource("pods"),
+				corev1.SchemeGroupVersion.WithKind("Pod"),
+				action.GetNamespace())
+			if err != nil {
+				return true, nil, err
+			}
+			pods := obj.(*corev1.PodList)
+			pods.Items = slices.DeleteFunc(pods.Items, func(p corev1.Pod) bool {
+				return !restrictions.Fields.Matches(
+					fields.Set{"status.phase": string(p.Status.Phase)})
+			})
+			return true, pods, nil
+		})
+	return func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return slices.Clone(selectors)
+	}
+}
+
+func TestAcquirePodInformer(t *testing.T) {
+	var recorder factoryRecorder
+	m := NewMetrics(prometheus.NewRegistry())
+	c := &Client{clientset: fake.NewClientset(), metrics: m}
+	c.podInformers.newFactory = recorder.newFactory
+	keyA := podInformerKey{namespace: "a", labelSelector: "app=foo",
+		fieldSelector: runningPods}
+	keyB := podInformerKey{namespace: "b", labelSelector: "app=foo",
+		fieldSelector: runningPods}
+	keyC := podInformerKey{namespace: "a", labelSelector: "app=foo"}
+	// sessions on the same pods share an informer
+	informerA1, releaseA1 := c.acquirePodInformer(keyA)
+	informerA2, releaseA2 := c.acquirePodInformer(keyA)
+	informerB, releaseB := c.acquirePodInformer(keyB)
+	assert.True(t, informerA1 == informerA2)
+	assert.False(t, informerA1 == informerB)
+	// sessions which need different pods don't share an informer
+	informerC, releaseC := c.acquirePodInformer(keyC)
+	assert.False(t, informerA1 == informerC)
+	releaseC()
+	created, shutdowns := recorder.counts()
+	assert.Equal(t, 3, created)
+	assert.Equal(t, 1, shutdowns)
+	assert.Equal(t, 2.0, testutil.ToFloat64(m.podInformers))
+	// releasing more than once has no effect
+	releaseA1()
+	releaseA1()
+	created, shutdowns = recorder.counts()
+	assert.Equal(t, 3, created)
+	assert.Equal(t, 1, shutdowns)
+	assert.False(t, informerA1.IsStopped())
+	// the informer is stopped when the last session releases it
+	releaseA2()
+	_, shutdowns = recorder.counts()
+	assert.Equal(t, 2, shutdowns)
+	assert.True(t, informerA1.IsStopped())
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.podInformers))
+	// a new session after teardown starts a new informer
+	informerA3, releaseA3 := c.acquirePodInformer(keyA)
+	assert.False(t, informerA1 == informerA3)
+	releaseA3()
+	releaseB()
+	created, shutdowns = recorder.counts()
+	assert.Equal(t, 4, created)
+	assert.Equal(t, 4, shutdowns)
+	assert.Equal(t, 0.0, testutil.ToFloat64(m.podInformers))
+	assert.Equal(t, 0, len(c.podInformers.informers))
+}
+
+func TestLogsFollowSharedInformer(t *testing.T) {
+	testNS := "testns"
+	testDeploy := "foo"
+	deploy := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      testDeploy,
+			Namespace: testNS,
+		},
+		Spec: appsv1.DeploymentSpec{
+			Selector: &metav1.LabelSelector{
+				MatchLabels: map[string]string{
+					"app.kubernetes.io/name": "foo-app",
+				},
+			},
+		},
+	}
+	clientset := fake.NewClientset(deploy)
+	// record the field selectors of pod list requests
+	var mu sync.Mutex
+	var fieldSelectors []string
+	clientset.PrependReactor("list", "pods",
+		func(action k8stesting.Action) (bool, runtime.Object, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			restrictions := action.(k8stesting.ListAction).GetListRestrictions()
+			fieldSelectors = append(fieldSelectors, restrictions.Fields.String())
+			return false, nil, nil
+		})
+	var recorder factoryRecorder
+	m := NewMetrics(prometheus.NewRegistry())
+	c := &Client{
+		clientset:      clientset,
+		logSem:         semaphore.NewWeighted(int64(3)),
+		logTimeLimit:   200 * time.Millisecond,
+		logMaxLine:     defaultMaxLineLength,
+		logDefaultTail: 5,
+		logMaxTail:     50,
+		logLimitBytes:  2048,
+		logQueueBytes:  1024,
+		metrics:        m,
+	}
+	c.podInformers.newFactory = recorder.newFactory
+	// run concurrent sessions following the same deployment
+	var eg errgroup.Group
+	for range 3 {
+		eg.Go(func() error {
+			return c.Logs(context.Background(), testNS, testDeploy, "", true,
+				10, LogFormatText, nil, true, false, &nopReadWriter{})
+		})
+	}
+	assert.IsError(t, eg.Wait(), ErrLogTimeLimit)
+	// check the sessions shared one informer, which was torn down
+	created, shutdowns := recorder.counts()
+	assert.Equal(t, 1, created)
+	assert.Equal(t, 1, shutdowns)
+	assert.Equal(t, []podInformerKey{{
+		namespace:     testNS,
+		labelSelector: "app.kubernetes.io/name=foo-app",
+		fieldSelector: "status.phase=Running",
+	}}, recorder.keys)
+	assert.Equal(t, 0.0, testutil.ToFloat64(m.podInformers))
+	assert.Equal(t, 0, len(c.podInformers.informers))
+	// check the informer only listed running pods
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []string{"status.phase=Running"}, fieldSelectors)
+}
+
+func TestPodInformerFieldSelector(t *testing.T) {
+	var testCases = map[string]struct {
+		fieldSelector string
+	}{
+		"running pods": {fieldSelector: runningPods},
+		"all pods":     {},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			// record the field selectors of pod list and watch requests, which
+			// the fake clientset doesn't apply itself
+			clientset := fake.NewClientset()
+			var mu sync.Mutex
+			var lists, watches []string
+			clientset.PrependReactor("list", "pods",
+				func(action k8stesting.Action) (bool, runtime.Object, error) {
+					mu.Lock()
+					defer mu.Unlock()
+					restrictions :=
+						action.(k8stesting.ListAction).GetListRestrictions()
+					lists = append(lists, restrictions.Fields.String())
+					return false, nil, nil
+				})
+			clientset.PrependWatchReactor("pods",
+				func(action k8stesting.Action) (bool, watch.Interface, error) {
+					mu.Lock()
+					defer mu.Unlock()
+					restrictions :=
+						action.(k8stesting.WatchAction).GetWatchRestrictions()
+					watches = append(watches, restrictions.Fields.String())
+					return false, nil, nil
+				})
+			c := &Client{
+				clientset: clientset,
+				metrics:   NewMetrics(prometheus.NewRegistry()),
+			}
+			informer, release := c.acquirePodInformer(podInformerKey{
+				namespace:     "testns",
+				labelSelector: "app=foo",
+				fieldSelector: tc.fieldSelector,
+			})
+			defer release()
+			ctx, cancel :=
+				context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			synced := cache.WaitForCacheSync(ctx.Done(), informer.HasSynced)
+			assert.True(tt, synced, name)
+			// the watch starts after the initial list
+			for ctx.Err() == nil {
+				mu.Lock()
+				started := len(watches) > 0
+				mu.Unlock()
+				if started {
+					break
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			assert.Equal(tt, []string{tc.fieldSelector}, lists, name)
+			assert.Equal(tt, []string{tc.fieldSelector}, watches, name)
+		})
+	}
+}
+
+// nopReadWriter discards writes, and returns io.EOF from reads.
+type nopReadWriter struct{}
+
+func (nopReadWriter) Read([]byte) (int, error)    { return 0, io.EOF }
+func (nopReadWriter) Write(p []byte) (int, error) { return len(p), nil }
@@ -0,0 +1,72 @@
+package k8s
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// escapeLen returns the length of the escape sequence body at the start of s.
+// s is the text immediately following an ESC character. Unterminated
+// sequences are assumed to extend to the end of s.
+func escapeLen(s string) int {
+	if len(s) == 0 {
+		return 0
+	}
+	switch s[0] {
+	case '[':
+		// CSI: parameter and intermediate bytes, then a final byte
+		for i := 1; i < len(s); i++ {
+			switch {
+			case s[i] >= 0x40 && s[i] <= 0x7e:
+				return i + 1
+			case s[i] < 0x20 || s[i] > 0x3f:
+				return i // malformed sequence
+			}
+		}
+		return len(s)
+	case ']', 'P', 'X', '^', '_':
+		// OSC, DCS, SOS, PM, APC: a string terminated by BEL or ST (ESC \)
+		for i := 1; i < len(s); i++ {
+			if s[i] == '\a' {
+				return i + 1
+			}
+			if s[i] == 0x1b && i+1 < len(s) && s[i+1] == '\\' {
+				return i + 2
+			}
+		}
+		return len(s)
+	default:
+		// nF / Fp / Fe / Fs: intermediate bytes, then a final byte
+		i := 0
+		for i < len(s) && s[i] >= 0x20 && s[i] <= 0x2f {
+			i++
+		}
+		if i < len(s) && s[i] >= 0x30 && s[i] <= 0x7e {
+			return i + 1
+		}
+		return i
+	}
+}
+
+// sanitizeLine returns line with ANSI escape sequences and non-printable
+// control characters other than \t removed. Invalid UTF-8 byte sequences,
+// such as a multi-byte character split by truncation, are replaced with the
+// Unicode replacement character.
+func sanitizeLine(line string) string {
+	var b strings.Builder
+	b.Grow(len(line))
+	for i := 0; i < len(line); {
+		r, size := utf8.DecodeRuneInString(line[i:])
+		switch {
+		case r == utf8.RuneError && size == 1:
+			b.WriteRune(utf8.RuneError)
+		case r == 0x1b:
+			size += escapeLen(line[i+size:])
+		case r == '\t' || !unicode.IsControl(r):
+			b.WriteRune(r)
+		}
+		i += size
+	}
+	return b.String()
+}
@@ -0,0 +1,84 @@
+package k8s
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/alecthomas/assert/v2"
+)
+
+func TestSanitizeLine(t *testing.T) {
+	var testCases = map[string]struct {
+		input  string
+		expect string
+	}{
+		"plain text": {
+			input:  "2024-01-01T00:00:00Z foo bar",
+			expect: "2024-01-01T00:00:00Z foo bar",
+		},
+		"tab preserved": {
+			input:  "foo\tbar",
+			expect: "foo\tbar",
+		},
+		"windows line ending": {
+			input:  "foo bar\r",
+			expect: "foo bar",
+		},
+		"sgr colour": {
+			input:  "\x1b[1;31merror\x1b[0m: bad",
+			expect: "error: bad",
+		},
+		"cursor movement": {
+			input:  "foo\x1b[2J\x1b[Hbar\x1b[?25l",
+			expect: "foobar",
+		},
+		"osc title bel terminated": {
+			input:  "\x1b]0;pwned\abar",
+			expect: "bar",
+		},
+		"osc hyperlink st terminated": {
+			input:  "\x1b]8;;http://example.com\x1b\\link\x1b]8;;\x1b\\",
+			expect: "link",
+		},
+		"charset designation": {
+			input:  "\x1b(Bfoo",
+			expect: "foo",
+		},
+		"unterminated csi": {
+			input:  "foo\x1b[31",
+			expect: "foo",
+		},
+		"trailing escape": {
+			input:  "foo\x1b",
+			expect: "foo",
+		},
+		"control characters": {
+			input:  "a\x00b\x07c\x08d\x7fe\u009bf",
+			expect: "abcdef",
+		},
+		"multi-byte utf-8": {
+			input:  "héllo 世界 🙂",
+			expect: "héllo 世界 🙂",
+		},
+		"partial multi-byte utf-8": {
+			input:  "foo \xe4\xb8",
+			expect: "foo ��",
+		},
+		"invalid utf-8": {
+			input:  "foo\xffbar",
+			expect: "foo�bar",
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			assert.Equal(tt, tc.expect, sanitizeLine(tc.input), name)
+		})
+	}
+}
+
+func TestSanitizeLongLine(t *testing.T) {
+	// a line just under the default bufio.Scanner buffer limit
+	body := strings.Repeat("x", 64*1024-16)
+	line := "\x1b[32m" + body + "\x1b[0m\r"
+	assert.Equal(t, body, sanitizeLine(line))
+}
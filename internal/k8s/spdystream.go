@@ -0,0 +1,35 @@
+package k8s
+
+import (
+	"log/slog"
+	"os"
+
+	"github.com/moby/spdystream"
+)
+
+// spdyStreamDebugEnv is the environment variable which explicitly enables
+// spdystream debug logging.
+const spdyStreamDebugEnv = "SPDYSTREAM_DEBUG"
+
+// DisableSPDYStreamDebug works around
+// https://github.com/moby/spdystream/issues/87.
+//
+// spdystream enables its debug logging if the DEBUG environment variable is
+// set, which is also used to enable debug logging in Lagoon services. Its
+// debug logging is disabled unless it is explicitly enabled by setting
+// SPDYSTREAM_DEBUG. It must be called before any exec or debug sessions are
+// started.
+func DisableSPDYStreamDebug(log *slog.Logger) {
+	if debug := os.Getenv(spdyStreamDebugEnv); debug != "" {
+		spdystream.DEBUG = debug
+		log.Info("spdystream debug logging enabled",
+			slog.String("env", spdyStreamDebugEnv))
+		return
+	}
+	if spdystream.DEBUG == "" {
+		return
+	}
+	spdystream.DEBUG = ""
+	log.Debug("disabled spdystream debug logging",
+		slog.String("issue", "https://github.com/moby/spdystream/issues/87"))
+}
@@ -0,0 +1,173 @@
+package k8s
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/alecthomas/assert/v2"
+	"github.com/moby/spdystream"
+	"github.com/prometheus/client_golang/prometheus"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/remotecommand"
+)
+
+// restClientset wraps a fake clientset so that its CoreV1 client constructs
+// requests using a real REST client. The fake REST client can't construct
+// requests.
+type restClientset struct {
+	*fake.Clientset
+	restClient rest.Interface
+}
+
+func (c restClientset) CoreV1() typedcorev1.CoreV1Interface {
+	return restCoreV1{
+		CoreV1Interface: c.Clientset.CoreV1(),
+		restClient:      c.restClient,
+	}
+}
+
+type restCoreV1 struct {
+	typedcorev1.CoreV1Interface
+	restClient rest.Interface
+}
+
+func (c restCoreV1) RESTClient() rest.Interface {
+	return c.restClient
+}
+
+// echoExecutor is a remotecommand.Executor which copies stdin to stdout, and
+// records the URL it was constructed with.
+type echoExecutor struct {
+	u *url.URL
+}
+
+func (e *echoExecutor) Stream(opts remotecommand.StreamOptions) error {
+	return e.StreamWithContext(context.Background(), opts)
+}
+
+func (e *echoExecutor) StreamWithContext(
+	_ context.Context,
+	opts remotecommand.StreamOptions,
+) error {
+	_, err := io.Copy(opts.Stdout, opts.Stdin)
+	return err
+}
+
+func TestDisableSPDYStreamDebug(t *testing.T) {
+	log := slog.New(slog.NewJSONHandler(os.Stderr, nil))
+	var testCases = map[string]struct {
+		debug           string
+		spdyStreamDebug string
+		expect          string
+	}{
+		"neither set": {},
+		"DEBUG set": {
+			debug: "true",
+		},
+		"SPDYSTREAM_DEBUG set": {
+			spdyStreamDebug: "1",
+			expect:          "1",
+		},
+		"both set": {
+			debug:           "true",
+			spdyStreamDebug: "1",
+			expect:          "1",
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			tt.Setenv("DEBUG", tc.debug)
+			tt.Setenv(spdyStreamDebugEnv, tc.spdyStreamDebug)
+			// spdystream reads DEBUG on initialisation, so emulate that here
+			original := spdystream.DEBUG
+			tt.Cleanup(func() { spdystream.DEBUG = original })
+			spdystream.DEBUG = os.Getenv("DEBUG")
+			DisableSPDYStreamDebug(log)
+			assert.Equal(tt, tc.expect, spdystream.DEBUG, name)
+		})
+	}
+}
+
+func TestExecSPDYStreamDebug(t *testing.T) {
+	// the original bug scenario: DEBUG is set in the environment
+	t.Setenv("DEBUG", "true")
+	original := spdystream.DEBUG
+	t.Cleanup(func() { spdystream.DEBUG = original })
+	spdystream.DEBUG = os.Getenv("DEBUG")
+	DisableSPDYStreamDebug(slog.New(slog.NewJSONHandler(os.Stderr, nil)))
+	assert.Equal(t, "", spdystream.DEBUG)
+	// set up a deployment with a running pod
+	testNS := "testns"
+	deploy := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "nginx",
+			Namespace: testNS,
+		},
+		Spec: appsv1.DeploymentSpec{
+			Selector: &metav1.LabelSelector{
+				MatchLabels: map[string]string{"app": "nginx"},
+			},
+		},
+	}
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "nginx-abc123",
+			Namespace: testNS,
+			Labels:    map[string]string{"app": "nginx"},
+		},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{Name: "nginx"}},
+		},
+		Status: corev1.PodStatus{Phase: corev1.PodRunning},
+	}
+	clientset := fake.NewClientset(deploy, pod)
+	scaleReactors(clientset, 1)
+	base, err := url.Parse("https://kubernetes.default.svc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	restClient, err := rest.NewRESTClient(base, "/api/v1",
+		rest.ClientContentConfig{GroupVersion: corev1.SchemeGroupVersion},
+		nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var executor echoExecutor
+	c := &Client{
+		clientset: restClientset{
+			Clientset:  clientset,
+			restClient: restClient,
+		},
+		metrics: NewMetrics(prometheus.NewRegistry()),
+		newExecutor: func(_ *rest.Config, method string,
+			u *url.URL) (remotecommand.Executor, error) {
+			assert.Equal(t, "POST", method)
+			executor.u = u
+			return &executor, nil
+		},
+	}
+	// execute a command
+	var stdout bytes.Buffer
+	stdio := struct {
+		io.Reader
+		io.Writer
+	}{strings.NewReader("hello"), &stdout}
+	err = c.Exec(context.Background(), testNS, "nginx", "",
+		[]string{"cat"}, stdio, io.Discard, false, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", stdout.String())
+	assert.Equal(t, "/api/v1/namespaces/testns/pods/nginx-abc123/exec",
+		executor.u.Path)
+	assert.Equal(t, []string{"cat"}, executor.u.Query()["command"])
+}
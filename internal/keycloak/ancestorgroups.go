@@ -25,14 +25,14 @@ func (c *Client) rawGroup(
 		groupID.String())
 	req, err := http.NewRequestWithContext(ctx, "GET", groupURL.String(), nil)
 	if err != nil {
-		return nil, fmt.Errorf("couldn't construct group request: %v", err)
+		return nil, fmt.Errorf("couldn't construct group request: %w", err)
 	}
 	q := req.URL.Query()
 	q.Add("briefRepresentation", "false")
 	req.URL.RawQuery = q.Encode()
 	res, err := c.httpClient.Do(req)
 	if err != nil {
-		return nil, fmt.Errorf(`couldn't get groupID "%s": %v`, groupID.String(), err)
+		return nil, fmt.Errorf(`couldn't get groupID "%s": %w`, groupID.String(), err)
 	}
 	defer res.Body.Close()
 	if res.StatusCode > 299 {
@@ -53,48 +53,82 @@ func (c *Client) groupByID(
 		return &group, nil
 	}
 	// otherwise get data from keycloak
-	if err := c.limiter.Wait(ctx); err != nil {
-		return nil, fmt.Errorf("couldn't wait for limiter: %v", err)
+	if err := c.limiter.Wait(ctx, "groupByID"); err != nil {
+		return nil, fmt.Errorf("couldn't wait for limiter: %w", err)
 	}
 	data, err := c.rawGroup(ctx, groupID)
 	if err != nil {
-		return nil, fmt.Errorf("couldn't get group from Keycloak API: %v", err)
+		return nil, fmt.Errorf("couldn't get group from Keycloak API: %w", err)
 	}
 	if err := json.Unmarshal(data, &group); err != nil {
-		return nil, fmt.Errorf("couldn't unmarshal group: %v", err)
+		return nil, fmt.Errorf("couldn't unmarshal group: %w", err)
 	}
 	if group.ID == nil {
 		return nil, fmt.Errorf("group with nil ID: %v", group)
 	}
-	// update cache
-	c.groupIDGroupCache.Set(*group.ID, group)
+	// update caches
+	c.cacheGroup(group)
 	return &group, nil
 }
 
 // ancestorGroupIDs takes a group (UU)ID and returns a slice of all ancestor
-// group IDs.
+// group IDs, starting with the parent. If the ancestors contain a cycle or
+// exceed the maximum group depth, it returns *ErrGroupHierarchy.
 func (c *Client) ancestorGroupIDs(
 	ctx context.Context,
 	groupID uuid.UUID,
 ) ([]uuid.UUID, error) {
 	var ancestorGIDs []uuid.UUID
-	group, err := c.groupByID(ctx, groupID)
-	if err != nil {
-		return nil,
-			fmt.Errorf("couldn't get group %s by ID: %v", groupID.String(), err)
-	}
-	if group.ParentID != nil {
-		// this is not a top level group
-		// get the ancestors of the parent
-		grandParentGIDs, err := c.ancestorGroupIDs(ctx, *group.ParentID)
+	chain := []string{groupID.String()}
+	visited := map[uuid.UUID]bool{groupID: true}
+	for gid := groupID; ; {
+		group, err := c.groupByID(ctx, gid)
 		if err != nil {
 			return nil,
-				fmt.Errorf("couldn't get ancestors of %s: %v", group.ParentID.String(), err)
+				fmt.Errorf("couldn't get group %s by ID: %w", gid.String(), err)
+		}
+		if group.ParentID == nil {
+			return ancestorGIDs, nil // reached top level group
+		}
+		parentID := *group.ParentID
+		chain = append(chain, parentID.String())
+		if visited[parentID] {
+			return nil, c.groupHierarchyError(chain, true)
+		}
+		if len(chain) > c.maxGroupDepth {
+			return nil, c.groupHierarchyError(chain, false)
+		}
+		visited[parentID] = true
+		ancestorGIDs = append(ancestorGIDs, parentID)
+		gid = parentID
+	}
+}
+
+// HasChildGroups returns false if the cached child groups of each of the
+// given groups are all role subgroups, and true otherwise. A group whose child
+// groups aren't cached is assumed to have child groups. It never queries
+// Keycloak.
+//
+// The child groups of each group the user is a member of are cached by
+// UserGroupIDRole, so calling HasChildGroups with the keys of the map it
+// returns is a cheap way to determine whether any of those groups can be an
+// ancestor of another group.
+func (c *Client) HasChildGroups(
+	_ context.Context,
+	groupIDs []uuid.UUID,
+) bool {
+	for _, gid := range groupIDs {
+		children, ok := c.parentIDChildGroupCache.Get(gid)
+		if !ok {
+			return true
+		}
+		for _, child := range children {
+			if !isRoleSubgroup(child) {
+				return true
+			}
 		}
-		ancestorGIDs = append(ancestorGIDs, *group.ParentID)
-		ancestorGIDs = append(ancestorGIDs, grandParentGIDs...)
 	}
-	return ancestorGIDs, nil
+	return false
 }
 
 // AncestorGroups takes a slice of group IDs, and returns the same slice
@@ -109,7 +143,7 @@ func (c *Client) AncestorGroups(
 		ancestorGIDs, err := c.ancestorGroupIDs(ctx, gid)
 		if err != nil {
 			return nil,
-				fmt.Errorf(`couldn't get ancestor group IDs for "%v": %v`, gid, err)
+				fmt.Errorf(`couldn't get ancestor group IDs for "%v": %w`, gid, err)
 		}
 		allGIDs = append(allGIDs, ancestorGIDs...)
 	}
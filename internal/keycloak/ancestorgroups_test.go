@@ -184,7 +184,7 @@ func TestAncestorGroups(t *testing.T) {
 				ts.URL,
 				"auth-server",
 				"",
-				10)
+				newTestLimiter())
 			if err != nil {
 				tt.Fatal(err)
 			}
@@ -4,6 +4,8 @@ package keycloak
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"log/slog"
 	"net/http"
@@ -14,10 +16,11 @@ import (
 	"github.com/MicahParks/keyfunc/v2"
 	"github.com/google/uuid"
 	"github.com/uselagoon/ssh-portal/internal/cache"
+	"github.com/uselagoon/ssh-portal/internal/cachemetrics"
 	oidcClient "github.com/zitadel/oidc/v3/pkg/client"
 	"github.com/zitadel/oidc/v3/pkg/oidc"
+	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/clientcredentials"
-	"golang.org/x/time/rate"
 )
 
 const (
@@ -28,9 +31,13 @@ const (
 
 // newHTTPClient constructs an HTTP client with a reasonable timeout using
 // oauth2 client credentials. This client will automatically and transparently
-// refresh its OAuth2 token as requried.
+// refresh its OAuth2 token as requried. Requests to the token endpoint and
+// to the admin API are made using base, and recorded in m.
 func newHTTPClient(
 	ctx context.Context,
+	log *slog.Logger,
+	m *Metrics,
+	base http.RoundTripper,
 	clientID,
 	clientSecret,
 	tokenURL string,
@@ -40,6 +47,12 @@ func newHTTPClient(
 		ClientSecret: clientSecret,
 		TokenURL:     tokenURL,
 	}
+	// the oauth2 package uses the client in the context to request tokens,
+	// and its transport as the base transport of the returned client.
+	ctx = context.WithValue(ctx, oauth2.HTTPClient, &http.Client{
+		Timeout:   httpTimeout,
+		Transport: newInstrumentedTransport(log, m, tokenURL, base),
+	})
 	client := cc.Client(ctx)
 	client.Timeout = httpTimeout
 	return client
@@ -47,64 +60,153 @@ func newHTTPClient(
 
 // Client is a keycloak client.
 type Client struct {
-	baseURL      *url.URL
-	clientID     string
-	clientSecret string
-	jwks         *keyfunc.JWKS
-	log          *slog.Logger
-	oidcConfig   *oidc.DiscoveryConfiguration
-	limiter      *rate.Limiter
-	httpClient   *http.Client
-	pageSize     int
+	baseURL       *url.URL
+	clientID      string
+	clientSecret  string
+	jwks          *keyfunc.JWKS
+	log           *slog.Logger
+	oidcConfig    *oidc.DiscoveryConfiguration
+	limiter       *Limiter
+	httpClient    *http.Client
+	pageSize      int
+	metrics       *Metrics
+	insecureTLS   bool
+	rootCAs       *x509.CertPool
+	maxGroupDepth int
 
 	// top level groupName to groupID map cache
-	topLevelGroupNameIDCache *cache.Any[map[string]uuid.UUID]
+	topLevelGroupNameIDCache *cachemetrics.Any[map[string]uuid.UUID]
 	// group ID to Group cache
-	groupIDGroupCache *cache.Map[uuid.UUID, Group]
+	groupIDGroupCache *cachemetrics.Map[uuid.UUID, Group]
 	// parent group IDs to child groups cache
-	parentIDChildGroupCache *cache.Map[uuid.UUID, []Group]
+	parentIDChildGroupCache *cachemetrics.Map[uuid.UUID, []Group]
+}
+
+// Option performs optional configuration on Client objects during
+// construction.
+type Option func(*Client)
+
+// ClientMetrics configures the Client to record its metrics in m. This allows
+// multiple clients to share a single set of registered metrics. By default
+// the Client records metrics which are not registered.
+func ClientMetrics(m *Metrics) Option {
+	return func(c *Client) {
+		c.metrics = m
+	}
+}
+
+// PageSize configures the number of groups the Client requests per page when
+// retrieving groups from Keycloak. Values less than one are ignored.
+func PageSize(n int) Option {
+	return func(c *Client) {
+		if n > 0 {
+			c.pageSize = n
+		}
+	}
+}
+
+// MaxGroupDepth configures the maximum depth of the group hierarchy the
+// Client will walk, where a top level group has a depth of one. Values less
+// than one are ignored.
+func MaxGroupDepth(n int) Option {
+	return func(c *Client) {
+		if n > 0 {
+			c.maxGroupDepth = n
+		}
+	}
+}
+
+// InsecureTLS configures the Client to skip verification of the Keycloak TLS
+// certificate. This should only be used for testing.
+func InsecureTLS() Option {
+	return func(c *Client) {
+		c.insecureTLS = true
+	}
 }
 
-// NewClient creates a new keycloak client for the lagoon realm.
+// RootCAs configures the Client to verify the Keycloak TLS certificate
+// against the given certificate authorities instead of the system trust
+// store.
+func RootCAs(pool *x509.CertPool) Option {
+	return func(c *Client) {
+		c.rootCAs = pool
+	}
+}
+
+// transport returns the base HTTP transport used for all requests to
+// Keycloak. If the TLS configuration is customised, this is a dedicated
+// transport so that the customisation doesn't affect other HTTP clients in
+// the process.
+func (c *Client) transport() http.RoundTripper {
+	if !c.insecureTLS && c.rootCAs == nil {
+		return http.DefaultTransport
+	}
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.TLSClientConfig = &tls.Config{
+		RootCAs:            c.rootCAs,
+		InsecureSkipVerify: c.insecureTLS, //nolint:gosec
+	}
+	return t
+}
+
+// NewClient creates a new keycloak client for the lagoon realm. Requests to
+// the Keycloak API are rate limited by the given limiter, which may be shared
+// with other clients.
 func NewClient(
 	ctx context.Context,
 	log *slog.Logger,
 	keycloakURL,
 	clientID,
 	clientSecret string,
-	rateLimit int,
+	limiter *Limiter,
+	opts ...Option,
 ) (*Client, error) {
-	// discover OIDC config
 	baseURL, err := url.Parse(keycloakURL)
 	if err != nil {
-		return nil, fmt.Errorf("couldn't parse keycloak base URL %s: %v",
+		return nil, fmt.Errorf("couldn't parse keycloak base URL %s: %w",
 			keycloakURL, err)
 	}
+	c := &Client{
+		baseURL:       baseURL,
+		clientID:      clientID,
+		clientSecret:  clientSecret,
+		log:           log,
+		limiter:       limiter,
+		pageSize:      defaultPageSize,
+		metrics:       NewMetrics(nil),
+		maxGroupDepth: defaultMaxGroupDepth,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	// discover OIDC config
+	transport := c.transport()
+	discoveryClient := &http.Client{
+		Timeout:   httpTimeout,
+		Transport: transport,
+	}
 	issuerURL := *baseURL
 	issuerURL.Path = path.Join(issuerURL.Path, "auth/realms/lagoon")
-	oidcConfig, err := oidcClient.Discover(ctx, issuerURL.String(),
-		&http.Client{Timeout: httpTimeout})
+	c.oidcConfig, err = oidcClient.Discover(ctx, issuerURL.String(),
+		discoveryClient)
 	if err != nil {
-		return nil, fmt.Errorf("couldn't discover OIDC config: %v", err)
+		return nil, fmt.Errorf("couldn't discover OIDC config: %w", err)
 	}
 	// pull down keys via JWKS
-	jwks, err := keyfunc.Get(oidcConfig.JwksURI, keyfunc.Options{})
+	c.jwks, err = keyfunc.Get(c.oidcConfig.JwksURI,
+		keyfunc.Options{Client: discoveryClient})
 	if err != nil {
-		return nil, fmt.Errorf("couldn't get keycloak lagoon realm JWKS: %v", err)
+		return nil, fmt.Errorf("couldn't get keycloak lagoon realm JWKS: %w", err)
 	}
-	return &Client{
-		baseURL:      baseURL,
-		clientID:     clientID,
-		clientSecret: clientSecret,
-		jwks:         jwks,
-		log:          log,
-		oidcConfig:   oidcConfig,
-		limiter:      rate.NewLimiter(rate.Limit(rateLimit), rateLimit),
-		httpClient:   newHTTPClient(ctx, clientID, clientSecret, oidcConfig.TokenEndpoint),
-		pageSize:     defaultPageSize,
-
-		topLevelGroupNameIDCache: cache.NewAny[map[string]uuid.UUID](),
-		groupIDGroupCache:        cache.NewMap[uuid.UUID, Group](),
-		parentIDChildGroupCache:  cache.NewMap[uuid.UUID, []Group](),
-	}, nil
+	// instrument the caches once the metrics are configured
+	c.topLevelGroupNameIDCache = cachemetrics.NewAny(
+		cache.NewAny[map[string]uuid.UUID](), c.metrics.caches,
+		"top_level_groups")
+	c.groupIDGroupCache = cachemetrics.NewMap(
+		cache.NewMap[uuid.UUID, Group](), c.metrics.caches, "groups")
+	c.parentIDChildGroupCache = cachemetrics.NewMap(
+		cache.NewMap[uuid.UUID, []Group](), c.metrics.caches, "child_groups")
+	c.httpClient = newHTTPClient(ctx, log, c.metrics, transport, clientID,
+		clientSecret, c.oidcConfig.TokenEndpoint)
+	return c, nil
 }
@@ -0,0 +1,49 @@
+package keycloak
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+)
+
+// CheckCredentials makes a lightweight authenticated request to the Keycloak
+// admin API, which requests zero groups. This fails if the client ID or
+// secret are rejected by Keycloak, so that misconfiguration can be detected at
+// startup rather than on the first user request.
+//
+// A forbidden response indicates that the client was authenticated but lacks
+// permission to query groups, so it is not considered a failure.
+func (c *Client) CheckCredentials(ctx context.Context) error {
+	// rate limit keycloak API access
+	if err := c.limiter.Wait(ctx, "CheckCredentials"); err != nil {
+		return fmt.Errorf("couldn't wait for limiter: %w", err)
+	}
+	groupsURL := *c.baseURL
+	groupsURL.Path = path.Join(c.baseURL.Path,
+		"/auth/admin/realms/lagoon/groups")
+	req, err := http.NewRequestWithContext(ctx, "GET", groupsURL.String(), nil)
+	if err != nil {
+		return fmt.Errorf("couldn't construct groups request: %w", err)
+	}
+	q := req.URL.Query()
+	q.Add("briefRepresentation", "true")
+	q.Add("first", "0")
+	q.Add("max", "0")
+	req.URL.RawQuery = q.Encode()
+	// the token is requested by the client transport, so rejected client
+	// credentials surface as an error here.
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("couldn't authenticate client %s: %w",
+			c.clientID, err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode > 299 && res.StatusCode != http.StatusForbidden {
+		body, _ := io.ReadAll(res.Body)
+		return fmt.Errorf("bad groups response for client %s: %d\n%s",
+			c.clientID, res.StatusCode, body)
+	}
+	return nil
+}
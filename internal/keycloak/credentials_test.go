@@ -0,0 +1,109 @@
+package keycloak_test
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/alecthomas/assert/v2"
+	"github.com/uselagoon/ssh-portal/internal/keycloak"
+)
+
+// newTestCredentialsServer sets up a mock keycloak which issues tokens to
+// clients with the given secrets, and rejects other clients. The groups
+// endpoint forbids access by clients which are not admins.
+func newTestCredentialsServer(
+	tt *testing.T,
+	secrets map[string]string,
+	admins map[string]bool,
+) *httptest.Server {
+	mux := keycloak.NewTestMux(tt)
+	// issue a token named after the client if its secret is correct
+	mux.HandleFunc("/auth/realms/lagoon/protocol/openid-connect/token",
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			clientID, secret, ok := r.BasicAuth()
+			if !ok || secret == "" || secrets[clientID] != secret {
+				w.WriteHeader(http.StatusUnauthorized)
+				_, _ = io.WriteString(w, `{"error":"unauthorized_client"}`)
+				return
+			}
+			_, _ = io.WriteString(w, `{"access_token":"`+clientID+
+				`","token_type":"Bearer","expires_in":300}`)
+		})
+	mux.HandleFunc("/auth/admin/realms/lagoon/groups",
+		func(w http.ResponseWriter, r *http.Request) {
+			clientID := strings.TrimPrefix(r.Header.Get("Authorization"),
+				"Bearer ")
+			if !admins[clientID] {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			_, _ = io.WriteString(w, `[]`)
+		})
+	return httptest.NewServer(mux)
+}
+
+func TestCheckCredentials(t *testing.T) {
+	secrets := map[string]string{
+		"service-api": "service-api-secret",
+		"auth-server": "auth-server-secret",
+	}
+	admins := map[string]bool{"service-api": true}
+	var testCases = map[string]struct {
+		clientID     string
+		clientSecret string
+		expectError  bool
+	}{
+		"admin client": {
+			clientID:     "service-api",
+			clientSecret: "service-api-secret",
+		},
+		"non-admin client": {
+			clientID:     "auth-server",
+			clientSecret: "auth-server-secret",
+		},
+		"wrong secret": {
+			clientID:     "service-api",
+			clientSecret: "auth-server-secret",
+			expectError:  true,
+		},
+		"empty secret": {
+			clientID:    "service-api",
+			expectError: true,
+		},
+		"unknown client": {
+			clientID:     "api",
+			clientSecret: "service-api-secret",
+			expectError:  true,
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			ts := newTestCredentialsServer(tt, secrets, admins)
+			defer ts.Close()
+			k, err := keycloak.NewClient(
+				context.Background(),
+				slog.New(slog.NewJSONHandler(os.Stderr, nil)),
+				ts.URL,
+				tc.clientID,
+				tc.clientSecret,
+				newTestLimiter())
+			if err != nil {
+				tt.Fatal(err)
+			}
+			err = k.CheckCredentials(context.Background())
+			if tc.expectError {
+				assert.Error(tt, err, name)
+				assert.Contains(tt, err.Error(), tc.clientID, name)
+			} else {
+				assert.NoError(tt, err, name)
+			}
+		})
+	}
+}
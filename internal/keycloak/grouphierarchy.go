@@ -0,0 +1,51 @@
+package keycloak
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+)
+
+// defaultMaxGroupDepth is the default maximum depth of the group hierarchy
+// walked by the Client.
+const defaultMaxGroupDepth = 32
+
+// ErrGroupHierarchy is returned when walking the group hierarchy finds a
+// cycle, or exceeds the maximum depth. This can happen if the groups in
+// Keycloak are corrupted, for example by a bad import.
+type ErrGroupHierarchy struct {
+	// Chain is the chain of groups walked, ending with the group which
+	// completed the cycle or exceeded the maximum depth.
+	Chain []string
+	// Cycle is true if the chain contains a cycle, and false if it exceeded
+	// the maximum depth.
+	Cycle bool
+	// MaxDepth is the maximum depth of the group hierarchy.
+	MaxDepth int
+}
+
+func (e *ErrGroupHierarchy) Error() string {
+	if e.Cycle {
+		return fmt.Sprintf("cycle in group hierarchy: %s",
+			strings.Join(e.Chain, " -> "))
+	}
+	return fmt.Sprintf("group hierarchy deeper than %d: %s",
+		e.MaxDepth, strings.Join(e.Chain, " -> "))
+}
+
+// groupHierarchyError logs the offending chain of groups and returns an
+// *ErrGroupHierarchy.
+func (c *Client) groupHierarchyError(
+	chain []string,
+	cycle bool,
+) *ErrGroupHierarchy {
+	c.log.Warn("invalid keycloak group hierarchy",
+		slog.Any("chain", chain),
+		slog.Bool("cycle", cycle),
+		slog.Int("maxDepth", c.maxGroupDepth))
+	return &ErrGroupHierarchy{
+		Chain:    chain,
+		Cycle:    cycle,
+		MaxDepth: c.maxGroupDepth,
+	}
+}
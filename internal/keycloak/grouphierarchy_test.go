@@ -0,0 +1,200 @@
+package keycloak_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/alecthomas/assert/v2"
+	"github.com/google/uuid"
+	"github.com/uselagoon/ssh-portal/internal/keycloak"
+)
+
+// Synthetic group IDs for the corrupted group hierarchy served by
+// newTestGroupHierarchyServer.
+var (
+	// loopA and loopB are each other's parent. loopA also lists itself as
+	// its own child.
+	loopA = uuid.MustParse("a0000000-0000-4000-8000-000000000001")
+	loopB = uuid.MustParse("a0000000-0000-4000-8000-000000000002")
+	// deep0 is a top level group, and each deepN is the parent of deepN+1.
+	deep = []uuid.UUID{
+		uuid.MustParse("d0000000-0000-4000-8000-000000000000"),
+		uuid.MustParse("d0000000-0000-4000-8000-000000000001"),
+		uuid.MustParse("d0000000-0000-4000-8000-000000000002"),
+		uuid.MustParse("d0000000-0000-4000-8000-000000000003"),
+		uuid.MustParse("d0000000-0000-4000-8000-000000000004"),
+	}
+)
+
+// hierarchyGroup returns the JSON representation of a group.
+func hierarchyGroup(id uuid.UUID, name string, parentID *uuid.UUID) string {
+	if parentID == nil {
+		return fmt.Sprintf(`{"id":%q,"name":%q}`, id, name)
+	}
+	return fmt.Sprintf(`{"id":%q,"name":%q,"parentId":%q}`, id, name,
+		*parentID)
+}
+
+// newTestGroupHierarchyServer sets up a mock keycloak which serves a
+// corrupted group hierarchy containing cycles.
+func newTestGroupHierarchyServer(tt *testing.T) *httptest.Server {
+	groups := map[uuid.UUID]string{
+		loopA: hierarchyGroup(loopA, "loop-a", &loopB),
+		loopB: hierarchyGroup(loopB, "loop-b", &loopA),
+	}
+	children := map[uuid.UUID]string{
+		loopA: "[" + groups[loopA] + "," + groups[loopB] + "]",
+		loopB: "[" + groups[loopA] + "]",
+	}
+	topLevel := []json.RawMessage{json.RawMessage(groups[loopA])}
+	for i, id := range deep {
+		var parentID *uuid.UUID
+		if i > 0 {
+			parentID = &deep[i-1]
+		}
+		groups[id] = hierarchyGroup(id, fmt.Sprintf("deep%d", i), parentID)
+		if i > 0 {
+			children[deep[i-1]] = "[" + groups[id] + "]"
+		}
+	}
+	children[deep[len(deep)-1]] = "[]"
+	topLevel = append(topLevel, json.RawMessage(groups[deep[0]]))
+	mux := keycloak.NewTestMux(tt)
+	mux.HandleFunc("/auth/admin/realms/lagoon/groups",
+		func(w http.ResponseWriter, r *http.Request) {
+			serveTestGroups(tt, w, r, topLevel)
+		})
+	mux.HandleFunc("/auth/admin/realms/lagoon/groups/",
+		func(w http.ResponseWriter, r *http.Request) {
+			rest := strings.TrimPrefix(r.URL.Path,
+				"/auth/admin/realms/lagoon/groups/")
+			idStr, isChildren := strings.CutSuffix(rest, "/children")
+			id, err := uuid.Parse(idStr)
+			if err != nil {
+				http.NotFound(w, r)
+				return
+			}
+			data := groups
+			if isChildren {
+				data = children
+			}
+			body, ok := data[id]
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			_, _ = io.WriteString(w, body)
+		})
+	return httptest.NewServer(mux)
+}
+
+func TestGroupHierarchy(t *testing.T) {
+	var testCases = map[string]struct {
+		ancestorsOf   []uuid.UUID
+		descendantsOf []uuid.UUID
+		groupPath     string
+		expectCycle   bool
+	}{
+		"ancestor cycle": {
+			ancestorsOf: []uuid.UUID{loopB},
+			expectCycle: true,
+		},
+		"ancestors too deep": {
+			ancestorsOf: []uuid.UUID{deep[4]},
+		},
+		"descendant cycle": {
+			descendantsOf: []uuid.UUID{loopB},
+			expectCycle:   true,
+		},
+		"descendants too deep": {
+			descendantsOf: []uuid.UUID{deep[0]},
+		},
+		"group path cycle": {
+			groupPath:   "/loop-a/loop-a",
+			expectCycle: true,
+		},
+		"group path child cycle": {
+			groupPath:   "/loop-a/loop-b/loop-a",
+			expectCycle: true,
+		},
+		"group path too deep": {
+			groupPath: "/deep0/deep1/deep2/deep3",
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			ts := newTestGroupHierarchyServer(tt)
+			defer ts.Close()
+			k, err := keycloak.NewClient(
+				context.Background(),
+				slog.New(slog.NewJSONHandler(os.Stderr, nil)),
+				ts.URL,
+				"auth-server",
+				"",
+				newTestLimiter(),
+				keycloak.MaxGroupDepth(3))
+			if err != nil {
+				tt.Fatal(err)
+			}
+			k.UseDefaultHTTPClient()
+			switch {
+			case tc.ancestorsOf != nil:
+				_, err = k.AncestorGroups(context.Background(), tc.ancestorsOf)
+			case tc.descendantsOf != nil:
+				_, err = k.DescendantGroups(context.Background(),
+					tc.descendantsOf)
+			default:
+				_, err = k.GroupPathID(context.Background(), tc.groupPath)
+			}
+			assert.Error(tt, err, name)
+			if tc.expectCycle {
+				assert.Contains(tt, err.Error(), "cycle in group hierarchy",
+					name)
+			} else {
+				assert.Contains(tt, err.Error(), "deeper than 3", name)
+			}
+		})
+	}
+}
+
+func TestGroupHierarchyWithinLimits(t *testing.T) {
+	ts := newTestGroupHierarchyServer(t)
+	defer ts.Close()
+	k, err := keycloak.NewClient(
+		context.Background(),
+		slog.New(slog.NewJSONHandler(os.Stderr, nil)),
+		ts.URL,
+		"auth-server",
+		"",
+		newTestLimiter(),
+		keycloak.MaxGroupDepth(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	k.UseDefaultHTTPClient()
+	gids, err := k.AncestorGroups(context.Background(), deep[2:3])
+	assert.NoError(t, err)
+	assert.Equal(t, deep[:3], gids)
+	gids, err = k.DescendantGroups(context.Background(), deep[2:3])
+	assert.NoError(t, err)
+	assert.Equal(t, deep[2:], gids)
+	gid, err := k.GroupPathID(context.Background(), "/deep0/deep1/deep2")
+	assert.NoError(t, err)
+	assert.Equal(t, deep[2], *gid)
+	// the typed error is returned directly by the ancestor walk
+	_, err = k.AncestorGroupIDs(context.Background(), loopA)
+	var hierarchyErr *keycloak.ErrGroupHierarchy
+	assert.True(t, errors.As(err, &hierarchyErr))
+	assert.True(t, hierarchyErr.Cycle)
+	assert.Equal(t, []string{loopA.String(), loopB.String(), loopA.String()},
+		hierarchyErr.Chain)
+}
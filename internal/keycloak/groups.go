@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"log/slog"
 	"net/http"
 	"path"
 	"strconv"
@@ -16,33 +17,101 @@ import (
 // through group results from Keycloak.
 const defaultPageSize = 1000
 
+// maxGroupListAttempts is the maximum number of times the full list of groups
+// is requested from Keycloak if the groups change during the listing.
+const maxGroupListAttempts = 3
+
 // Group represents a Keycloak Group. It holds the fields required when getting
-// a list of groups from keycloak.
+// a list of groups from keycloak. Unknown fields are ignored, and fields which
+// are missing or null in the representation returned by some Keycloak
+// versions are left empty.
 type Group struct {
 	ID         *uuid.UUID          `json:"id"`
 	ParentID   *uuid.UUID          `json:"parentId"`
 	Name       string              `json:"name"`
 	Attributes map[string][]string `json:"attributes"`
 	RealmRoles []string            `json:"realmRoles"`
+	// SubGroups are the child groups included inline by Keycloak versions
+	// before 23. Later versions return an empty list, and report the number
+	// of child groups in SubGroupCount instead.
+	SubGroups     []Group `json:"subGroups"`
+	SubGroupCount *int    `json:"subGroupCount"`
+}
+
+// UnmarshalJSON implements json.Unmarshaler. It treats null attributes as an
+// empty map.
+func (g *Group) UnmarshalJSON(data []byte) error {
+	// use a type without this method to avoid recursion
+	type group Group
+	if err := json.Unmarshal(data, (*group)(g)); err != nil {
+		return err
+	}
+	if g.Attributes == nil {
+		g.Attributes = map[string][]string{}
+	}
+	return nil
+}
+
+// inlineChildGroups returns the child groups included inline in g, and true
+// if they are known to be the complete set of child groups of g.
+func (g Group) inlineChildGroups() ([]Group, bool) {
+	if g.SubGroupCount != nil {
+		return g.SubGroups, len(g.SubGroups) == *g.SubGroupCount
+	}
+	// a missing subGroups field is unmarshalled as a nil slice, while an
+	// empty list means the group has no child groups
+	return g.SubGroups, g.SubGroups != nil
+}
+
+// cacheGroup caches group by ID. If the complete set of child groups of group
+// is included inline, the child groups are cached recursively, saving
+// requests to Keycloak for them. Inline child groups are not retained in the
+// cached group.
+func (c *Client) cacheGroup(group Group) {
+	children, complete := group.inlineChildGroups()
+	group.SubGroups = nil
+	c.groupIDGroupCache.Set(*group.ID, group)
+	if !complete {
+		return
+	}
+	cached := make([]Group, 0, len(children))
+	for _, child := range children {
+		if child.ID == nil {
+			return // ignore malformed child groups
+		}
+		// inline child groups may omit the parent ID
+		if child.ParentID == nil {
+			child.ParentID = group.ID
+		}
+		c.cacheGroup(child)
+		child.SubGroups = nil
+		cached = append(cached, child)
+	}
+	c.parentIDChildGroupCache.Set(*group.ID, cached)
 }
 
-// rawGroups returns the raw JSON group representation of all top-level groups.
-func (c *Client) rawGroups(ctx context.Context, first int) ([]byte, error) {
+// rawGroups returns the raw JSON group representation of at most count
+// top-level groups, starting at offset first.
+func (c *Client) rawGroups(
+	ctx context.Context,
+	first,
+	count int,
+) ([]byte, error) {
 	groupsURL := *c.baseURL
 	groupsURL.Path = path.Join(c.baseURL.Path,
 		"/auth/admin/realms/lagoon/groups")
 	req, err := http.NewRequestWithContext(ctx, "GET", groupsURL.String(), nil)
 	if err != nil {
-		return nil, fmt.Errorf("couldn't construct groups request: %v", err)
+		return nil, fmt.Errorf("couldn't construct groups request: %w", err)
 	}
 	q := req.URL.Query()
 	q.Add("briefRepresentation", "true")
 	q.Add("first", strconv.Itoa(first))
-	q.Add("max", strconv.Itoa(c.pageSize))
+	q.Add("max", strconv.Itoa(count))
 	req.URL.RawQuery = q.Encode()
 	res, err := c.httpClient.Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("couldn't get groups: %v", err)
+		return nil, fmt.Errorf("couldn't get groups: %w", err)
 	}
 	defer res.Body.Close()
 	if res.StatusCode > 299 {
@@ -52,8 +121,62 @@ func (c *Client) rawGroups(ctx context.Context, first int) ([]byte, error) {
 	return io.ReadAll(res.Body)
 }
 
+// topLevelGroups returns all top-level Keycloak groups. Each page after the
+// first is requested starting at the last group of the previous page, so that
+// the pages overlap by one group. If the groups change during the listing the
+// overlapping group won't match, or a group will appear twice, and the
+// returned bool is false.
+func (c *Client) topLevelGroups(ctx context.Context) ([]Group, bool, error) {
+	var groups []Group
+	seen := map[uuid.UUID]bool{}
+	for {
+		var page []Group
+		first, count := 0, c.pageSize
+		if len(groups) > 0 {
+			// overlap with the last group of the previous page
+			first, count = len(groups)-1, c.pageSize+1
+		}
+		if err := c.limiter.Wait(ctx, "TopLevelGroupNameGroupIDMap"); err != nil {
+			return nil, false, fmt.Errorf("couldn't wait for limiter: %w", err)
+		}
+		data, err := c.rawGroups(ctx, first, count)
+		if err != nil {
+			return nil, false,
+				fmt.Errorf("couldn't get groups from Keycloak API: %w", err)
+		}
+		if err := json.Unmarshal(data, &page); err != nil {
+			return nil, false,
+				fmt.Errorf("couldn't unmarshal Keycloak groups: %w", err)
+		}
+		for _, group := range page {
+			if group.ID == nil {
+				return nil, false, fmt.Errorf("missing ID in Keycloak group %s",
+					group.Name)
+			}
+		}
+		if len(groups) > 0 {
+			// a group was inserted or removed before the end of the previous page
+			if len(page) == 0 || *page[0].ID != *groups[len(groups)-1].ID {
+				return nil, false, nil
+			}
+			page = page[1:]
+		}
+		for _, group := range page {
+			if seen[*group.ID] {
+				return nil, false, nil
+			}
+			seen[*group.ID] = true
+		}
+		groups = append(groups, page...)
+		if len(page) < c.pageSize {
+			return groups, true, nil // reached last page
+		}
+	}
+}
+
 // TopLevelGroupNameGroupIDMap returns a map of top-level Keycloak Group names
-// to Group IDs.
+// to Group IDs. If the groups change while they are being listed, the listing
+// is retried.
 func (c *Client) TopLevelGroupNameGroupIDMap(
 	ctx context.Context,
 ) (map[string]uuid.UUID, error) {
@@ -63,24 +186,24 @@ func (c *Client) TopLevelGroupNameGroupIDMap(
 	}
 	// otherwise get data from keycloak
 	var groups []Group
-	var first int
-	for {
-		var page []Group
-		if err := c.limiter.Wait(ctx); err != nil {
-			return nil, fmt.Errorf("couldn't wait for limiter: %v", err)
-		}
-		data, err := c.rawGroups(ctx, first)
+	for attempt := 1; ; attempt++ {
+		var consistent bool
+		var err error
+		groups, consistent, err = c.topLevelGroups(ctx)
 		if err != nil {
-			return nil, fmt.Errorf("couldn't get groups from Keycloak API: %v", err)
+			return nil, err
 		}
-		if err := json.Unmarshal(data, &page); err != nil {
-			return nil, fmt.Errorf("couldn't unmarshal Keycloak groups: %v", err)
+		if consistent {
+			break
 		}
-		groups = append(groups, page...)
-		if len(page) < c.pageSize {
-			break // reached last page
+		if attempt == maxGroupListAttempts {
+			return nil, fmt.Errorf(
+				"couldn't get consistent list of Keycloak groups after %d attempts",
+				attempt)
 		}
-		first += c.pageSize // scroll to next page
+		c.metrics.groupListRetriesTotal.Inc()
+		c.log.Warn("Keycloak groups changed during listing, retrying",
+			slog.Int("attempt", attempt))
 	}
 	groupNameGroupIDMap := map[string]uuid.UUID{}
 	for _, group := range groups {
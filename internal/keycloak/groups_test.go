@@ -0,0 +1,210 @@
+package keycloak_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/alecthomas/assert/v2"
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/uselagoon/ssh-portal/internal/keycloak"
+)
+
+// loadTestGroups returns the top-level groups in the testdata directory, in
+// the order Keycloak returns them.
+func loadTestGroups(tt *testing.T) []json.RawMessage {
+	var groups []json.RawMessage
+	for _, first := range []int{0, 5, 10, 15, 20} {
+		data, err := os.ReadFile(
+			fmt.Sprintf("testdata/usergroups_groups_first%d.json", first))
+		if err != nil {
+			tt.Fatal(err)
+		}
+		var page []json.RawMessage
+		if err = json.Unmarshal(data, &page); err != nil {
+			tt.Fatal(err)
+		}
+		groups = append(groups, page...)
+	}
+	return groups
+}
+
+// serveTestGroups responds to a groups request with the page of groups
+// selected by the first and max query parameters.
+func serveTestGroups(tt *testing.T, w http.ResponseWriter, r *http.Request,
+	groups []json.RawMessage) {
+	first, err := strconv.Atoi(r.URL.Query().Get("first"))
+	if err != nil {
+		tt.Fatal(err)
+	}
+	count, err := strconv.Atoi(r.URL.Query().Get("max"))
+	if err != nil {
+		tt.Fatal(err)
+	}
+	page := []json.RawMessage{}
+	if first < len(groups) {
+		page = groups[first:min(first+count, len(groups))]
+	}
+	if err = json.NewEncoder(w).Encode(page); err != nil {
+		tt.Fatal(err)
+	}
+}
+
+// testGroup returns the JSON representation of a top-level group.
+func testGroup(id, name string) json.RawMessage {
+	return json.RawMessage(fmt.Sprintf(`{"id":%q,"name":%q}`, id, name))
+}
+
+// newTestGroupsServer sets up a mock keycloak which serves pages of the
+// top-level groups. Before each groups request is answered, modify is called
+// with the request count and the current groups, and returns the groups to
+// serve.
+func newTestGroupsServer(
+	tt *testing.T,
+	modify func(int, []json.RawMessage) []json.RawMessage,
+) *httptest.Server {
+	mux := keycloak.NewTestMux(tt)
+	// configure the "all groups" path
+	var mu sync.Mutex
+	var requests int
+	groups := loadTestGroups(tt)
+	mux.HandleFunc("/auth/admin/realms/lagoon/groups",
+		func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			defer mu.Unlock()
+			requests++
+			groups = modify(requests, groups)
+			serveTestGroups(tt, w, r, groups)
+		})
+	// the client credentials are always rejected by the token endpoint, so
+	// tests must use the default HTTP client unless testing token failures
+	mux.HandleFunc("/auth/realms/lagoon/protocol/openid-connect/token",
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = io.WriteString(w, `{"error":"unauthorized_client"}`)
+		})
+	return httptest.NewServer(mux)
+}
+
+func TestTopLevelGroupNameGroupIDMap(t *testing.T) {
+	newGroupID := "8a6a2a4e-3a0b-4c6e-9d8e-0f3c1e8f6b11"
+	newGroup := testGroup(newGroupID, "new-group")
+	var testCases = map[string]struct {
+		modify        func(int, []json.RawMessage) []json.RawMessage
+		expectGroups  int
+		expectNew     bool
+		expectRetries float64
+		expectError   bool
+	}{
+		"unchanged": {
+			modify: func(_ int, groups []json.RawMessage) []json.RawMessage {
+				return groups
+			},
+			expectGroups: 23,
+		},
+		"group inserted between pages": {
+			modify: func(request int, groups []json.RawMessage) []json.RawMessage {
+				if request == 2 {
+					return append([]json.RawMessage{newGroup}, groups...)
+				}
+				return groups
+			},
+			expectGroups:  24,
+			expectNew:     true,
+			expectRetries: 1,
+		},
+		"group inserted at page boundary": {
+			modify: func(request int, groups []json.RawMessage) []json.RawMessage {
+				if request == 3 {
+					return append(groups[:9:9], append([]json.RawMessage{newGroup},
+						groups[9:]...)...)
+				}
+				return groups
+			},
+			expectGroups:  24,
+			expectNew:     true,
+			expectRetries: 1,
+		},
+		"group removed between pages": {
+			modify: func(request int, groups []json.RawMessage) []json.RawMessage {
+				if request == 2 {
+					return groups[1:]
+				}
+				return groups
+			},
+			expectGroups:  22,
+			expectRetries: 1,
+		},
+		"groups keep changing": {
+			modify: func(request int, groups []json.RawMessage) []json.RawMessage {
+				// insert a group before the second page of each attempt
+				if request%2 == 0 {
+					return append([]json.RawMessage{testGroup(uuid.NewString(),
+						fmt.Sprintf("new-group-%d", request))}, groups...)
+				}
+				return groups
+			},
+			expectRetries: 2,
+			expectError:   true,
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			ts := newTestGroupsServer(tt, tc.modify)
+			defer ts.Close()
+			// init keycloak client
+			reg := prometheus.NewRegistry()
+			k, err := keycloak.NewClient(
+				context.Background(),
+				slog.New(slog.NewJSONHandler(os.Stderr, nil)),
+				ts.URL,
+				"auth-server",
+				"",
+				newTestLimiter(),
+				keycloak.ClientMetrics(keycloak.NewMetrics(reg)))
+			if err != nil {
+				tt.Fatal(err)
+			}
+			// override internal HTTP client for testing
+			k.UseDefaultHTTPClient()
+			// override default huge pages
+			k.UsePageSize(5)
+			// perform testing
+			groupNameGroupIDMap, err := k.TopLevelGroupNameGroupIDMap(
+				context.Background())
+			if tc.expectError {
+				assert.Error(tt, err, name)
+			} else {
+				assert.NoError(tt, err, name)
+				assert.Equal(tt, tc.expectGroups, len(groupNameGroupIDMap), name)
+				_, ok := groupNameGroupIDMap["new-group"]
+				assert.Equal(tt, tc.expectNew, ok, name)
+				assert.Equal(tt, uuid.MustParse("5005c22e-48c3-46cd-bf4a-393f6e13e9a8"),
+					groupNameGroupIDMap["project-a-website-for-dogs"], name)
+				// the refresh of the cached groups is recorded
+				refresh := gatherMetric(tt, reg,
+					"keycloak_cache_last_refresh_timestamp_seconds")
+				var refreshed bool
+				for _, metric := range refresh.GetMetric() {
+					if metric.GetLabel()[0].GetValue() == "top_level_groups" {
+						refreshed = metric.GetGauge().GetValue() > 0
+					}
+				}
+				assert.True(tt, refreshed, name)
+			}
+			retries := gatherMetric(tt, reg, "keycloak_group_list_retries_total")
+			assert.Equal(tt, tc.expectRetries,
+				retries.GetMetric()[0].GetCounter().GetValue(), name)
+		})
+	}
+}
@@ -0,0 +1,160 @@
+package keycloak_test
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/alecthomas/assert/v2"
+	"github.com/google/uuid"
+	"github.com/uselagoon/ssh-portal/internal/keycloak"
+	"github.com/uselagoon/ssh-portal/internal/lagoon"
+)
+
+// newTestVersionServer sets up a mock keycloak which serves the group
+// representations returned by a particular Keycloak version from the
+// testdata/versions/<version> directory. Admin API paths are mapped to files
+// by appending ".json", and paths without a file return 404 as Keycloak does
+// for unknown endpoints. The admin API paths requested are appended to
+// requests.
+func newTestVersionServer(
+	tt *testing.T,
+	version string,
+	requests *[]string,
+) *httptest.Server {
+	mux := keycloak.NewTestMux(tt)
+	var mu sync.Mutex
+	mux.HandleFunc("/auth/admin/realms/lagoon/",
+		func(w http.ResponseWriter, r *http.Request) {
+			rel := strings.TrimPrefix(r.URL.Path, "/auth/admin/realms/lagoon/")
+			mu.Lock()
+			*requests = append(*requests, rel)
+			mu.Unlock()
+			data, err := os.ReadFile(
+				filepath.Join("testdata/versions", version, rel+".json"))
+			if err != nil {
+				http.NotFound(w, r)
+				return
+			}
+			_, _ = w.Write(data)
+		})
+	return httptest.NewServer(mux)
+}
+
+func TestGroupVersions(t *testing.T) {
+	projectID := "5f0d3c8e-1a11-4b6e-9d3e-000000000001"
+	teamID := "5f0d3c8e-1a11-4b6e-9d3e-000000000003"
+	var testCases = map[string]struct {
+		version        string
+		expectRequests []string
+	}{
+		"keycloak 16": {
+			version: "keycloak16",
+			// the child groups endpoint doesn't exist, so the child groups
+			// included inline in the project group are used
+			expectRequests: []string{
+				"groups",
+				"groups/" + projectID + "/children",
+				"groups/" + projectID,
+			},
+		},
+		"keycloak 22": {
+			version: "keycloak22",
+			expectRequests: []string{
+				"groups",
+				"groups/" + projectID + "/children",
+				"groups/" + projectID,
+			},
+		},
+		"keycloak 24": {
+			version: "keycloak24",
+			expectRequests: []string{
+				"groups",
+				"groups/" + projectID + "/children",
+				"groups/" + teamID + "/children",
+			},
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			var requests []string
+			ts := newTestVersionServer(tt, tc.version, &requests)
+			defer ts.Close()
+			k, err := keycloak.NewClient(
+				context.Background(),
+				slog.New(slog.NewJSONHandler(os.Stderr, nil)),
+				ts.URL,
+				"auth-server",
+				"",
+				newTestLimiter())
+			if err != nil {
+				tt.Fatal(err)
+			}
+			k.UseDefaultHTTPClient()
+			// userGroup2Role
+			gidRoleMap := k.UserGroupIDRole(context.Background(), []string{
+				"/project-a-website/project-a-website-owner",
+				"/project-a-website/team/team-developer",
+			})
+			assert.Equal(tt, map[uuid.UUID]lagoon.UserRole{
+				uuid.MustParse(projectID): lagoon.Owner,
+				uuid.MustParse(teamID):    lagoon.Developer,
+			}, gidRoleMap, name)
+			// groupIDFromParentAndName
+			gid, err := k.GroupPathID(context.Background(),
+				"/project-a-website/team")
+			assert.NoError(tt, err, name)
+			assert.Equal(tt, uuid.MustParse(teamID), *gid, name)
+			// the role subgroups are cached from the child groups, so they
+			// are never requested individually
+			assert.Equal(tt, tc.expectRequests, requests, name)
+		})
+	}
+}
+
+func TestGroupUnmarshal(t *testing.T) {
+	id := `"id":"5f0d3c8e-1a11-4b6e-9d3e-000000000001"`
+	var testCases = map[string]struct {
+		input            string
+		expectAttributes map[string][]string
+		expectSubGroups  int
+	}{
+		"null attributes": {
+			input:            `{` + id + `,"attributes":null}`,
+			expectAttributes: map[string][]string{},
+		},
+		"missing attributes": {
+			input:            `{` + id + `}`,
+			expectAttributes: map[string][]string{},
+		},
+		"extra fields": {
+			input: `{` + id + `,"access":{"view":true},"clientRoles":{},` +
+				`"attributes":{"type":["role-subgroup"]}}`,
+			expectAttributes: map[string][]string{"type": {"role-subgroup"}},
+		},
+		"inline subgroups": {
+			input: `{` + id + `,"subGroups":[{` + id +
+				`,"attributes":null}]}`,
+			expectAttributes: map[string][]string{},
+			expectSubGroups:  1,
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			var group keycloak.Group
+			assert.NoError(tt, json.Unmarshal([]byte(tc.input), &group), name)
+			assert.Equal(tt, tc.expectAttributes, group.Attributes, name)
+			assert.Equal(tt, tc.expectSubGroups, len(group.SubGroups), name)
+			for _, sub := range group.SubGroups {
+				assert.True(tt, sub.Attributes != nil, name)
+			}
+		})
+	}
+}
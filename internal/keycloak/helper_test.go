@@ -1,12 +1,46 @@
 package keycloak
 
 import (
+	"bytes"
+	"context"
+	"log/slog"
 	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
 
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
 	"golang.org/x/oauth2"
 )
 
+// NewTestMux returns a mux for a mock keycloak which serves the OIDC
+// discovery and JWKS endpoints from the testdata directory. Tests add their
+// own handlers for any other endpoints. The example URL in the discovery JSON
+// is replaced with the URL the server was requested on.
+func NewTestMux(tt *testing.T) *http.ServeMux {
+	discoveryBuf, err := os.ReadFile("testdata/realm.oidc.discovery.json")
+	if err != nil {
+		tt.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/auth/realms/lagoon/.well-known/openid-configuration",
+		func(w http.ResponseWriter, r *http.Request) {
+			url := "http://" + r.Host
+			if r.TLS != nil {
+				url = "https://" + r.Host
+			}
+			_, _ = w.Write(bytes.ReplaceAll(discoveryBuf,
+				[]byte("https://keycloak.example.com"), []byte(url)))
+		})
+	mux.HandleFunc("/auth/realms/lagoon/protocol/openid-connect/certs",
+		func(w http.ResponseWriter, r *http.Request) {
+			http.ServeFile(w, r, "testdata/realm.oidc.certs.json")
+		})
+	return mux
+}
+
 // ValidateTokenClaims is a helper method to expose the underlying private
 // method for unit testing.
 func (c *Client) ValidateToken(t *oauth2.Token, sub string,
@@ -25,8 +59,50 @@ func (c *Client) UseDefaultHTTPClient() {
 	c.httpClient = http.DefaultClient
 }
 
+// NewInstrumentedTransport exposes the instrumented transport for testing.
+func NewInstrumentedTransport(
+	log *slog.Logger,
+	m *Metrics,
+	tokenURL string,
+	next http.RoundTripper,
+) http.RoundTripper {
+	return newInstrumentedTransport(log, m, tokenURL, next)
+}
+
+// GroupPathID exposes the private groupPathID method for testing. The given
+// path is split on "/".
+func (c *Client) GroupPathID(
+	ctx context.Context,
+	path string,
+) (*uuid.UUID, error) {
+	return c.groupPathID(ctx, strings.Split(path, "/"))
+}
+
+// TopLevelGroupPathID exposes the private topLevelGroupPathID method for
+// testing. The given path is split on "/".
+func (c *Client) TopLevelGroupPathID(
+	ctx context.Context,
+	path string,
+) (*uuid.UUID, error) {
+	return c.topLevelGroupPathID(ctx, strings.Split(path, "/"))
+}
+
+// AncestorGroupIDs exposes the private ancestorGroupIDs method for testing.
+func (c *Client) AncestorGroupIDs(
+	ctx context.Context,
+	groupID uuid.UUID,
+) ([]uuid.UUID, error) {
+	return c.ancestorGroupIDs(ctx, groupID)
+}
+
 // UsePageSize sets the page size used by the client when retrieving groups
 // from Keycloak.
 func (c *Client) UsePageSize(pageSize int) {
 	c.pageSize = pageSize
 }
+
+// SetSlowWait sets the duration after which a limiter wait is logged for
+// testing.
+func (l *Limiter) SetSlowWait(d time.Duration) {
+	l.slowWait = d
+}
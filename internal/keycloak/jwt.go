@@ -49,7 +49,7 @@ func (c *Client) parseAccessToken(t *oauth2.Token,
 		c.jwks.Keyfunc,
 		opts...)
 	if err != nil {
-		return nil, fmt.Errorf("couldn't parse user token: %v", err)
+		return nil, fmt.Errorf("couldn't parse user token: %w", err)
 	}
 	claims, ok := tok.Claims.(*LagoonClaims)
 	if !ok {
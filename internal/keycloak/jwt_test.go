@@ -251,7 +251,7 @@ func TestValidateTokenClaims(t *testing.T) {
 			// NOTE: client secret is empty because it isn't used in this test, but
 			// client ID is checked against azp in the token.
 			k, err := keycloak.NewClient(context.Background(), log, ts.URL,
-				"auth-server", "", 10)
+				"auth-server", "", newTestLimiter())
 			if err != nil {
 				tt.Fatal(err)
 			}
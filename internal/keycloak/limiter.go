@@ -0,0 +1,95 @@
+package keycloak
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"golang.org/x/time/rate"
+)
+
+// slowWaitThreshold is the default duration after which a wait for the rate
+// limiter is logged as a warning.
+const slowWaitThreshold = time.Second
+
+// Limiter is a rate limiter for Keycloak API requests which records
+// metrics about waits. A Limiter may be shared between Clients so that they
+// are limited in aggregate.
+type Limiter struct {
+	log      *slog.Logger
+	limiter  *rate.Limiter
+	slowWait time.Duration
+	waiters  prometheus.Gauge
+	duration *prometheus.HistogramVec
+}
+
+// NewLimiter creates a Limiter which allows the given sustained rate of
+// requests per second, and bursts of up to burst requests. If burst is less
+// than one, it is equal to the rate.
+//
+// The limiter metrics are registered with reg, so only one Limiter may be
+// registered with a given reg.
+func NewLimiter(
+	log *slog.Logger,
+	reg prometheus.Registerer,
+	rateLimit float64,
+	burst int,
+) *Limiter {
+	if burst < 1 {
+		burst = int(rateLimit)
+	}
+	l := &Limiter{
+		log:      log,
+		limiter:  rate.NewLimiter(rate.Limit(rateLimit), burst),
+		slowWait: slowWaitThreshold,
+	}
+	factory := promauto.With(reg)
+	factory.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "keycloak_rate_limiter_tokens",
+		Help: "Current number of tokens available in the Keycloak API rate limiter",
+	}, func() float64 {
+		return l.limiter.Tokens()
+	})
+	l.waiters = factory.NewGauge(prometheus.GaugeOpts{
+		Name: "keycloak_rate_limiter_waiters",
+		Help: "Current number of Keycloak API requests waiting on the rate limiter",
+	})
+	l.duration = factory.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "keycloak_rate_limiter_duration_seconds",
+		Help: "Time spent waiting on the client-side Keycloak API rate limiter",
+	}, []string{"method"})
+	return l
+}
+
+// Limit returns the sustained rate of requests per second allowed by the
+// limiter.
+func (l *Limiter) Limit() float64 {
+	return float64(l.limiter.Limit())
+}
+
+// Burst returns the maximum burst of requests allowed by the limiter.
+func (l *Limiter) Burst() int {
+	return l.limiter.Burst()
+}
+
+// Wait blocks until the limiter permits a request by the given Keycloak
+// client method, or ctx is done. The wait time is recorded, and logged if it
+// is unusually long.
+func (l *Limiter) Wait(ctx context.Context, method string) error {
+	start := time.Now()
+	l.waiters.Inc()
+	err := l.limiter.Wait(ctx)
+	l.waiters.Dec()
+	wait := time.Since(start)
+	l.duration.WithLabelValues(method).Observe(wait.Seconds())
+	if wait > l.slowWait {
+		l.log.Warn("slow keycloak rate limiter wait",
+			slog.String("method", method),
+			slog.Duration("wait", wait),
+			slog.Float64("limit", l.Limit()),
+			slog.Int("burst", l.Burst()))
+	}
+	return err
+}
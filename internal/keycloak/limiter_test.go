@@ -0,0 +1,93 @@
+package keycloak_test
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/assert/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/uselagoon/ssh-portal/internal/keycloak"
+)
+
+// newTestLimiter returns an unregistered limiter for use in tests.
+func newTestLimiter() *keycloak.Limiter {
+	return keycloak.NewLimiter(slog.New(slog.NewJSONHandler(os.Stderr, nil)),
+		nil, 10, 0)
+}
+
+// gatherMetric returns the metric family with the given name from reg.
+func gatherMetric(t *testing.T, reg *prometheus.Registry,
+	name string) *dto.MetricFamily {
+	t.Helper()
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range families {
+		if family.GetName() == name {
+			return family
+		}
+	}
+	t.Fatalf("couldn't find metric %s", name)
+	return nil
+}
+
+func TestLimiterBurst(t *testing.T) {
+	var testCases = map[string]struct {
+		rateLimit   float64
+		burst       int
+		expectBurst int
+	}{
+		"default burst": {rateLimit: 10, expectBurst: 10},
+		"custom burst":  {rateLimit: 10, burst: 3, expectBurst: 3},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			l := keycloak.NewLimiter(slog.Default(), nil, tc.rateLimit, tc.burst)
+			assert.Equal(tt, tc.rateLimit, l.Limit(), name)
+			assert.Equal(tt, tc.expectBurst, l.Burst(), name)
+		})
+	}
+}
+
+func TestLimiterWait(t *testing.T) {
+	var buf bytes.Buffer
+	log := slog.New(slog.NewJSONHandler(&buf, nil))
+	reg := prometheus.NewRegistry()
+	// allow one request every 50ms, with no burst
+	l := keycloak.NewLimiter(log, reg, 20, 1)
+	l.SetSlowWait(20 * time.Millisecond)
+	// the first request takes the only token
+	assert.NoError(t, l.Wait(context.Background(), "UserByUUID"))
+	tokens := gatherMetric(t, reg, "keycloak_rate_limiter_tokens")
+	assert.True(t, tokens.GetMetric()[0].GetGauge().GetValue() < 1)
+	assert.Equal(t, "", buf.String())
+	// the second request waits for the next token
+	assert.NoError(t, l.Wait(context.Background(), "UserByUUID"))
+	duration := gatherMetric(t, reg, "keycloak_rate_limiter_duration_seconds")
+	assert.Equal(t, 1, len(duration.GetMetric()))
+	histogram := duration.GetMetric()[0].GetHistogram()
+	assert.Equal(t, uint64(2), histogram.GetSampleCount())
+	assert.True(t, histogram.GetSampleSum() >= 0.04,
+		"expected wait of at least 40ms, got %vs", histogram.GetSampleSum())
+	assert.Equal(t, "method", duration.GetMetric()[0].GetLabel()[0].GetName())
+	assert.Equal(t, "UserByUUID", duration.GetMetric()[0].GetLabel()[0].GetValue())
+	// the slow wait is logged
+	assert.Contains(t, buf.String(), "slow keycloak rate limiter wait")
+	// no requests are waiting
+	waiters := gatherMetric(t, reg, "keycloak_rate_limiter_waiters")
+	assert.Equal(t, float64(0), waiters.GetMetric()[0].GetGauge().GetValue())
+}
+
+func TestLimiterWaitCancelled(t *testing.T) {
+	l := keycloak.NewLimiter(slog.Default(), nil, 0.001, 1)
+	assert.NoError(t, l.Wait(context.Background(), "groupByID"))
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Error(t, l.Wait(ctx, "groupByID"))
+}
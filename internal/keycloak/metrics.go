@@ -0,0 +1,30 @@
+package keycloak
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/uselagoon/ssh-portal/internal/cachemetrics"
+)
+
+// Metrics contains the Prometheus metrics exported by the Keycloak client.
+type Metrics struct {
+	groupListRetriesTotal prometheus.Counter
+	requestDuration       *prometheus.HistogramVec
+	caches                *cachemetrics.Metrics
+}
+
+// NewMetrics creates the Keycloak client metrics and registers them with reg.
+func NewMetrics(reg prometheus.Registerer) *Metrics {
+	factory := promauto.With(reg)
+	return &Metrics{
+		groupListRetriesTotal: factory.NewCounter(prometheus.CounterOpts{
+			Name: "keycloak_group_list_retries_total",
+			Help: "The total number of times listing Keycloak groups was retried because the groups changed during the listing",
+		}),
+		requestDuration: factory.NewHistogramVec(prometheus.HistogramOpts{
+			Name: "keycloak_http_request_duration_seconds",
+			Help: "Time taken by HTTP requests to Keycloak, by endpoint (token or admin) and status code",
+		}, []string{"endpoint", "code"}),
+		caches: cachemetrics.NewMetrics(reg, "keycloak"),
+	}
+}
@@ -0,0 +1,123 @@
+package keycloak_test
+
+import (
+	"context"
+	"crypto/x509"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/alecthomas/assert/v2"
+	"github.com/uselagoon/ssh-portal/internal/keycloak"
+)
+
+// newTestTLSServer sets up a mock keycloak serving HTTPS with a self-signed
+// certificate, which issues tokens to any client.
+func newTestTLSServer(tt *testing.T) *httptest.Server {
+	mux := keycloak.NewTestMux(tt)
+	mux.HandleFunc("/auth/realms/lagoon/protocol/openid-connect/token",
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = io.WriteString(w, `{"access_token":"token",`+
+				`"token_type":"Bearer","expires_in":300}`)
+		})
+	mux.HandleFunc("/auth/admin/realms/lagoon/groups",
+		func(w http.ResponseWriter, r *http.Request) {
+			_, _ = io.WriteString(w, `[]`)
+		})
+	return httptest.NewTLSServer(mux)
+}
+
+func TestTLSConfig(t *testing.T) {
+	var testCases = map[string]struct {
+		opts        func(*httptest.Server) []keycloak.Option
+		expectError bool
+	}{
+		"system trust store": {
+			expectError: true,
+		},
+		"insecure TLS": {
+			opts: func(*httptest.Server) []keycloak.Option {
+				return []keycloak.Option{keycloak.InsecureTLS()}
+			},
+		},
+		"custom CA": {
+			opts: func(ts *httptest.Server) []keycloak.Option {
+				pool := x509.NewCertPool()
+				pool.AddCert(ts.Certificate())
+				return []keycloak.Option{keycloak.RootCAs(pool)}
+			},
+		},
+		"custom CA without server certificate": {
+			opts: func(*httptest.Server) []keycloak.Option {
+				return []keycloak.Option{keycloak.RootCAs(x509.NewCertPool())}
+			},
+			expectError: true,
+		},
+	}
+	defaultTransport := http.DefaultTransport.(*http.Transport)
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			ts := newTestTLSServer(tt)
+			defer ts.Close()
+			var opts []keycloak.Option
+			if tc.opts != nil {
+				opts = tc.opts(ts)
+			}
+			k, err := keycloak.NewClient(
+				context.Background(),
+				slog.New(slog.NewJSONHandler(os.Stderr, nil)),
+				ts.URL,
+				"service-api",
+				"secret",
+				newTestLimiter(),
+				opts...)
+			// the TLS options never modify the default transport
+			assert.True(tt, http.DefaultTransport == defaultTransport, name)
+			if tlsConfig := defaultTransport.TLSClientConfig; tlsConfig != nil {
+				assert.False(tt, tlsConfig.InsecureSkipVerify, name)
+				assert.Zero(tt, tlsConfig.RootCAs, name)
+			}
+			if tc.expectError {
+				assert.Error(tt, err, name)
+				return
+			}
+			assert.NoError(tt, err, name)
+			// the token and admin API requests also skip verification
+			assert.NoError(tt, k.CheckCredentials(context.Background()), name)
+		})
+	}
+}
+
+func TestInsecureTLSScope(t *testing.T) {
+	ts := newTestTLSServer(t)
+	defer ts.Close()
+	// construct insecure clients concurrently, which would race if the TLS
+	// configuration were set on a shared transport
+	log := slog.New(slog.NewJSONHandler(os.Stderr, nil))
+	errs := make(chan error, 2)
+	for range 2 {
+		go func() {
+			_, err := keycloak.NewClient(context.Background(), log, ts.URL,
+				"service-api", "secret", newTestLimiter(),
+				keycloak.InsecureTLS())
+			errs <- err
+		}()
+	}
+	for range 2 {
+		assert.NoError(t, <-errs)
+	}
+	// other HTTP clients in the process still verify certificates
+	defaultTransport := http.DefaultTransport.(*http.Transport)
+	if tlsConfig := defaultTransport.TLSClientConfig; tlsConfig != nil {
+		assert.False(t, tlsConfig.InsecureSkipVerify)
+	}
+	res, err := http.Get(ts.URL + "/auth/admin/realms/lagoon/groups")
+	if err == nil {
+		res.Body.Close()
+	}
+	assert.Error(t, err)
+}
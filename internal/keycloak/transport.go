@@ -0,0 +1,83 @@
+package keycloak
+
+import (
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	tokenEndpoint = "token"
+	adminEndpoint = "admin"
+)
+
+// instrumentedTransport is an http.RoundTripper which records the duration
+// and status code of each request. Requests to the token endpoint are
+// recorded separately from other requests, which are to the admin API.
+// Failed token requests are logged, since they otherwise only surface as
+// failures of the admin API requests which triggered them.
+type instrumentedTransport struct {
+	log      *slog.Logger
+	metrics  *Metrics
+	tokenURL *url.URL
+	next     http.RoundTripper
+}
+
+// newInstrumentedTransport returns an instrumentedTransport which records
+// requests in m and passes them to next. Requests to tokenURL are recorded
+// as token endpoint requests.
+func newInstrumentedTransport(
+	log *slog.Logger,
+	m *Metrics,
+	tokenURL string,
+	next http.RoundTripper,
+) *instrumentedTransport {
+	u, err := url.Parse(tokenURL)
+	if err != nil {
+		// the token URL is validated during OIDC discovery, so this
+		// shouldn't happen
+		log.Warn("couldn't parse token URL", slog.Any("error", err))
+		u = &url.URL{}
+	}
+	return &instrumentedTransport{
+		log:      log,
+		metrics:  m,
+		tokenURL: u,
+		next:     next,
+	}
+}
+
+// endpoint returns the label of the endpoint the request is sent to.
+func (t *instrumentedTransport) endpoint(req *http.Request) string {
+	if req.URL.Host == t.tokenURL.Host && req.URL.Path == t.tokenURL.Path {
+		return tokenEndpoint
+	}
+	return adminEndpoint
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *instrumentedTransport) RoundTrip(
+	req *http.Request,
+) (*http.Response, error) {
+	endpoint := t.endpoint(req)
+	start := time.Now()
+	res, err := t.next.RoundTrip(req)
+	code := "error"
+	if err == nil {
+		code = strconv.Itoa(res.StatusCode)
+	}
+	t.metrics.requestDuration.WithLabelValues(endpoint, code).
+		Observe(time.Since(start).Seconds())
+	if endpoint != tokenEndpoint {
+		return res, err
+	}
+	if err != nil {
+		t.log.Error("couldn't refresh keycloak token", slog.Any("error", err))
+	} else if res.StatusCode >= 400 {
+		t.log.Error("keycloak token refresh failed",
+			slog.Int("status", res.StatusCode))
+	}
+	return res, err
+}
@@ -0,0 +1,135 @@
+package keycloak_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/alecthomas/assert/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/uselagoon/ssh-portal/internal/keycloak"
+)
+
+// requestCounts returns the number of requests recorded in the
+// keycloak_http_request_duration_seconds histogram, keyed by endpoint and
+// status code.
+func requestCounts(t *testing.T, reg *prometheus.Registry) map[string]uint64 {
+	t.Helper()
+	counts := map[string]uint64{}
+	family := gatherMetric(t, reg, "keycloak_http_request_duration_seconds")
+	for _, metric := range family.GetMetric() {
+		labels := map[string]string{}
+		for _, label := range metric.GetLabel() {
+			labels[label.GetName()] = label.GetValue()
+		}
+		counts[labels["endpoint"]+"/"+labels["code"]] =
+			metric.GetHistogram().GetSampleCount()
+	}
+	return counts
+}
+
+func TestInstrumentedTransport(t *testing.T) {
+	var testCases = map[string]struct {
+		path         string
+		status       int
+		expectCounts map[string]uint64
+		expectLog    string
+	}{
+		"admin ok": {
+			path:         "/auth/admin/realms/lagoon/groups",
+			status:       http.StatusOK,
+			expectCounts: map[string]uint64{"admin/200": 1},
+		},
+		"admin error": {
+			path:         "/auth/admin/realms/lagoon/groups",
+			status:       http.StatusForbidden,
+			expectCounts: map[string]uint64{"admin/403": 1},
+		},
+		"token ok": {
+			path:         "/auth/realms/lagoon/protocol/openid-connect/token",
+			status:       http.StatusOK,
+			expectCounts: map[string]uint64{"token/200": 1},
+		},
+		"token error": {
+			path:         "/auth/realms/lagoon/protocol/openid-connect/token",
+			status:       http.StatusUnauthorized,
+			expectCounts: map[string]uint64{"token/401": 1},
+			expectLog:    `"msg":"keycloak token refresh failed","status":401`,
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			ts := httptest.NewServer(http.HandlerFunc(
+				func(w http.ResponseWriter, _ *http.Request) {
+					w.WriteHeader(tc.status)
+				}))
+			defer ts.Close()
+			var buf bytes.Buffer
+			log := slog.New(slog.NewJSONHandler(&buf, nil))
+			reg := prometheus.NewRegistry()
+			client := http.Client{Transport: keycloak.NewInstrumentedTransport(
+				log, keycloak.NewMetrics(reg),
+				ts.URL+"/auth/realms/lagoon/protocol/openid-connect/token",
+				http.DefaultTransport)}
+			res, err := client.Get(ts.URL + tc.path)
+			assert.NoError(tt, err, name)
+			assert.NoError(tt, res.Body.Close(), name)
+			assert.Equal(tt, tc.status, res.StatusCode, name)
+			assert.Equal(tt, tc.expectCounts, requestCounts(tt, reg), name)
+			if tc.expectLog == "" {
+				assert.Equal(tt, "", buf.String(), name)
+			} else {
+				assert.Contains(tt, buf.String(), tc.expectLog, name)
+			}
+		})
+	}
+}
+
+func TestInstrumentedTransportError(t *testing.T) {
+	ts := httptest.NewServer(http.NotFoundHandler())
+	tokenURL := ts.URL + "/token"
+	// requests to a closed server fail without a response
+	ts.Close()
+	var buf bytes.Buffer
+	log := slog.New(slog.NewJSONHandler(&buf, nil))
+	reg := prometheus.NewRegistry()
+	client := http.Client{Transport: keycloak.NewInstrumentedTransport(
+		log, keycloak.NewMetrics(reg), tokenURL, http.DefaultTransport)}
+	_, err := client.Get(tokenURL)
+	assert.Error(t, err)
+	assert.Equal(t, map[string]uint64{"token/error": 1}, requestCounts(t, reg))
+	assert.Contains(t, buf.String(), "couldn't refresh keycloak token")
+}
+
+func TestTokenEndpointFailure(t *testing.T) {
+	ts := newTestGroupsServer(t,
+		func(_ int, groups []json.RawMessage) []json.RawMessage {
+			return groups
+		})
+	defer ts.Close()
+	var buf bytes.Buffer
+	reg := prometheus.NewRegistry()
+	k, err := keycloak.NewClient(
+		context.Background(),
+		slog.New(slog.NewJSONHandler(&buf, nil)),
+		ts.URL,
+		"auth-server",
+		"wrong-secret",
+		newTestLimiter(),
+		keycloak.ClientMetrics(keycloak.NewMetrics(reg)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the admin API request fails because the token can't be refreshed. The
+	// oauth2 package tries both client authentication styles, so there are
+	// two token requests.
+	_, err = k.TopLevelGroupNameGroupIDMap(context.Background())
+	assert.Error(t, err)
+	assert.Equal(t, map[string]uint64{"token/401": 2}, requestCounts(t, reg))
+	assert.Contains(t, buf.String(),
+		`"level":"ERROR","msg":"keycloak token refresh failed","status":401`)
+}
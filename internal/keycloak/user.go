@@ -0,0 +1,85 @@
+package keycloak
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel"
+)
+
+// ErrUserNotFound is returned when the requested user doesn't exist in
+// Keycloak. This may happen if a user has been deleted from Keycloak while
+// their SSH keys remain in the Lagoon API DB.
+var ErrUserNotFound = errors.New("user not found in keycloak")
+
+// User represents a Keycloak User. It holds the fields required when getting
+// a single user from keycloak.
+type User struct {
+	ID       *uuid.UUID `json:"id"`
+	Username string     `json:"username"`
+	Email    string     `json:"email"`
+}
+
+// rawUser returns the raw JSON user representation of a single keycloak user.
+// If the user doesn't exist, it returns an error wrapping ErrUserNotFound.
+func (c *Client) rawUser(
+	ctx context.Context,
+	userUUID uuid.UUID,
+) ([]byte, error) {
+	userURL := *c.baseURL
+	userURL.Path = path.Join(
+		c.baseURL.Path,
+		"/auth/admin/realms/lagoon/users",
+		userUUID.String())
+	req, err := http.NewRequestWithContext(ctx, "GET", userURL.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't construct user request: %w", err)
+	}
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf(`couldn't get userID "%s": %w`, userUUID.String(), err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf(`userID "%s": %w`, userUUID.String(),
+			ErrUserNotFound)
+	}
+	if res.StatusCode > 299 {
+		body, _ := io.ReadAll(res.Body)
+		return nil, fmt.Errorf("bad user response: %d\n%s", res.StatusCode, body)
+	}
+	return io.ReadAll(res.Body)
+}
+
+// UserByUUID queries Keycloak given the user UUID, and returns the user. If
+// the user doesn't exist, it returns an error wrapping ErrUserNotFound.
+func (c *Client) UserByUUID(
+	ctx context.Context,
+	userUUID uuid.UUID,
+) (*User, error) {
+	// set up tracing
+	ctx, span := otel.Tracer(pkgName).Start(ctx, "UserByUUID")
+	defer span.End()
+	// rate limit keycloak API access
+	if err := c.limiter.Wait(ctx, "UserByUUID"); err != nil {
+		return nil, fmt.Errorf("couldn't wait for limiter: %w", err)
+	}
+	data, err := c.rawUser(ctx, userUUID)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get user from Keycloak API: %w", err)
+	}
+	var user User
+	if err := json.Unmarshal(data, &user); err != nil {
+		return nil, fmt.Errorf("couldn't unmarshal user: %w", err)
+	}
+	if user.ID == nil {
+		return nil, fmt.Errorf("user with nil ID: %v", user)
+	}
+	return &user, nil
+}
@@ -0,0 +1,100 @@
+package keycloak_test
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/alecthomas/assert/v2"
+	"github.com/google/uuid"
+	"github.com/uselagoon/ssh-portal/internal/keycloak"
+)
+
+// newTestUserServer sets up a mock keycloak which responds with appropriate
+// user JSON data to exercise UserByUUID. Unknown users are not found, and
+// token exchange requests are rejected.
+func newTestUserServer(tt *testing.T) *httptest.Server {
+	// set up the map of user IDs to responses
+	var reqRespMap map[string]string = map[string]string{
+		"91435afe-ba81-406f-9308-3f0f8d7d6b43": "testdata/user0.json",
+	}
+	mux := keycloak.NewTestMux(tt)
+	mux.HandleFunc("/auth/realms/lagoon/protocol/openid-connect/token",
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			_, err := w.Write([]byte(`{"error":"invalid_request"}`))
+			if err != nil {
+				tt.Fatal(err)
+			}
+		})
+	// configure the user paths
+	for userID, file := range reqRespMap {
+		mux.HandleFunc("/auth/admin/realms/lagoon/users/"+userID,
+			func(w http.ResponseWriter, r *http.Request) {
+				responseData, err := os.Open(file)
+				if err != nil {
+					tt.Fatal(err)
+					return
+				}
+				_, err = io.Copy(w, responseData)
+				if err != nil {
+					tt.Fatal(err)
+				}
+			})
+	}
+	return httptest.NewServer(mux)
+}
+
+func TestUserByUUID(t *testing.T) {
+	var testCases = map[string]struct {
+		userUUID    uuid.UUID
+		expectEmail string
+		expectErr   error
+	}{
+		"known user": {
+			userUUID:    uuid.MustParse("91435afe-ba81-406f-9308-3f0f8d7d6b43"),
+			expectEmail: "jane@example.com",
+		},
+		"unknown user": {
+			userUUID:  uuid.MustParse("00000000-0000-0000-0000-000000000001"),
+			expectErr: keycloak.ErrUserNotFound,
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			ts := newTestUserServer(tt)
+			defer ts.Close()
+			// init keycloak client
+			k, err := keycloak.NewClient(
+				context.Background(),
+				slog.New(slog.NewJSONHandler(os.Stderr, nil)),
+				ts.URL,
+				"auth-server",
+				"",
+				newTestLimiter())
+			if err != nil {
+				tt.Fatal(err)
+			}
+			// override internal HTTP client for testing
+			k.UseDefaultHTTPClient()
+			// perform testing
+			user, err := k.UserByUUID(context.Background(), tc.userUUID)
+			if tc.expectErr != nil {
+				assert.IsError(tt, err, tc.expectErr, name)
+				// both the client method and the request add context
+				assert.Contains(tt, err.Error(),
+					"couldn't get user from Keycloak API", name)
+				assert.Contains(tt, err.Error(), tc.userUUID.String(), name)
+				return
+			}
+			assert.NoError(tt, err, name)
+			assert.Equal(tt, tc.userUUID, *user.ID, name)
+			assert.Equal(tt, tc.expectEmail, user.Email, name)
+		})
+	}
+}
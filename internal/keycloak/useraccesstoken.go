@@ -37,12 +37,12 @@ func (c *Client) getUserToken(
 		// https://www.keycloak.org/docs/latest/securing_apps/#_token-exchange
 		oauth2.SetAuthURLParam("requested_subject", userUUID.String()))
 	if err != nil {
-		return nil, fmt.Errorf("couldn't get user token: %v", err)
+		return nil, fmt.Errorf("couldn't get user token: %w", err)
 	}
 	// parse and extract verified attributes
 	_, err = c.parseAccessToken(userToken, userUUID.String())
 	if err != nil {
-		return nil, fmt.Errorf("couldn't parse user access token: %v", err)
+		return nil, fmt.Errorf("couldn't parse user access token: %w", err)
 	}
 	return userToken, nil
 }
@@ -59,17 +59,17 @@ func (c *Client) UserAccessTokenResponse(
 	ctx, span := otel.Tracer(pkgName).Start(ctx, "UserAccessToken")
 	defer span.End()
 	// rate limit keycloak API access
-	if err := c.limiter.Wait(ctx); err != nil {
-		return "", fmt.Errorf("couldn't wait for limiter: %v", err)
+	if err := c.limiter.Wait(ctx, "UserAccessTokenResponse"); err != nil {
+		return "", fmt.Errorf("couldn't wait for limiter: %w", err)
 	}
 	// get user token
 	userToken, err := c.getUserToken(ctx, userUUID)
 	if err != nil {
-		return "", fmt.Errorf("couldn't get user token: %v", err)
+		return "", fmt.Errorf("couldn't get user token: %w", err)
 	}
 	data, err := json.Marshal(userToken)
 	if err != nil {
-		return "", fmt.Errorf("couldn't marshal user token: %v", err)
+		return "", fmt.Errorf("couldn't marshal user token: %w", err)
 	}
 	return string(data), nil
 }
@@ -85,13 +85,13 @@ func (c *Client) UserAccessToken(
 	ctx, span := otel.Tracer(pkgName).Start(ctx, "UserAccessToken")
 	defer span.End()
 	// rate limit keycloak API access
-	if err := c.limiter.Wait(ctx); err != nil {
-		return "", fmt.Errorf("couldn't wait for limiter: %v", err)
+	if err := c.limiter.Wait(ctx, "UserAccessToken"); err != nil {
+		return "", fmt.Errorf("couldn't wait for limiter: %w", err)
 	}
 	// get user token
 	userToken, err := c.getUserToken(ctx, userUUID)
 	if err != nil {
-		return "", fmt.Errorf("couldn't get user token: %v", err)
+		return "", fmt.Errorf("couldn't get user token: %w", err)
 	}
 	return userToken.AccessToken, nil
 }
@@ -3,6 +3,7 @@ package keycloak
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
@@ -16,6 +17,11 @@ import (
 	"github.com/uselagoon/ssh-portal/internal/lagoon"
 )
 
+// errNoChildGroupsEndpoint is returned by rawChildGroups if Keycloak responds
+// that the child groups endpoint was not found. This happens with Keycloak
+// versions before 23, or if the parent group doesn't exist.
+var errNoChildGroupsEndpoint = errors.New("child groups endpoint not found")
+
 // rawChildGroups returns the raw JSON group representation of child groups of
 // the given group ID.
 func (c *Client) rawChildGroups(
@@ -31,7 +37,7 @@ func (c *Client) rawChildGroups(
 		"children")
 	req, err := http.NewRequestWithContext(ctx, "GET", groupsURL.String(), nil)
 	if err != nil {
-		return nil, fmt.Errorf("couldn't construct groups request: %v", err)
+		return nil, fmt.Errorf("couldn't construct groups request: %w", err)
 	}
 	q := req.URL.Query()
 	q.Add("briefRepresentation", "false")
@@ -40,9 +46,12 @@ func (c *Client) rawChildGroups(
 	req.URL.RawQuery = q.Encode()
 	res, err := c.httpClient.Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("couldn't get groups: %v", err)
+		return nil, fmt.Errorf("couldn't get groups: %w", err)
 	}
 	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return nil, errNoChildGroupsEndpoint
+	}
 	if res.StatusCode > 299 {
 		body, _ := io.ReadAll(res.Body)
 		return nil, fmt.Errorf("bad child groups response for group ID %s: %d\n%s",
@@ -51,6 +60,17 @@ func (c *Client) rawChildGroups(
 	return io.ReadAll(res.Body)
 }
 
+// ErrGroupNotFound is returned when a group in a group path doesn't exist in
+// Keycloak.
+type ErrGroupNotFound struct {
+	// Name is the name of the missing group.
+	Name string
+}
+
+func (e *ErrGroupNotFound) Error() string {
+	return fmt.Sprintf(`group "%s" not found in keycloak`, e.Name)
+}
+
 // topLevelGroupNameFromPath takes a slice of top level group path segments,
 // such as ["", "example-company"], and performs some sanity checks to confirm
 // it has the correct structure before returning the name of the top level
@@ -69,78 +89,59 @@ func topLevelGroupNameFromPath(path []string) (string, error) {
 }
 
 // topLevelGroupPathID returns the group ID for the given slice of path
-// segments of a top level group path.
+// segments of a top level group path. If the group doesn't exist, it returns
+// *ErrGroupNotFound.
 func (c *Client) topLevelGroupPathID(
 	ctx context.Context,
 	path []string,
 ) (*uuid.UUID, error) {
 	name, err := topLevelGroupNameFromPath(path)
 	if err != nil {
-		return nil, fmt.Errorf("couldn't get top level group name from path: %v", err)
+		return nil, fmt.Errorf("couldn't get top level group name from path: %w", err)
 	}
 	groupNameIDMap, err := c.TopLevelGroupNameGroupIDMap(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("couldn't get group name group ID map: %v", err)
+		return nil, fmt.Errorf("couldn't get group name group ID map: %w", err)
 	}
 	gid, ok := groupNameIDMap[name]
 	if !ok {
-		return nil,
-			fmt.Errorf("couldn't find group name in top level groups: %v", err)
+		return nil, &ErrGroupNotFound{Name: name}
 	}
 	return &gid, nil
 }
 
-// groupIDFromParentAndNameCache takes a parent group ID and a child group
-// name and returns the child group ID, if it exists in cache, and a boolean
-// indicating if the parent group ID was found in the cache.
-//
-// If the parent ID exists in the cache but no cached child groups match the
-// given name, the returned child group ID will be nil.
-func (c *Client) groupIDFromParentAndNameCache(
-	parentID uuid.UUID,
-	name string,
-) (*uuid.UUID, bool) {
-	childGroups, ok := c.parentIDChildGroupCache.Get(parentID)
-	if !ok {
-		return nil, false
-	}
-	for _, group := range childGroups {
-		if group.Name == name {
-			return group.ID, true
-		}
-	}
-	return nil, true
-}
-
-// groupIDFromParentAndName takes a parent group ID and a group name, and
-// returns the group ID of the child group matching the given name.
-func (c *Client) groupIDFromParentAndName(
+// childGroups returns the child groups of the given parent group ID.
+func (c *Client) childGroups(
 	ctx context.Context,
 	parentID uuid.UUID,
-	name string,
-) (*uuid.UUID, error) {
+) ([]Group, error) {
 	// prefer to use cached value
-	gid, ok := c.groupIDFromParentAndNameCache(parentID, name)
-	if ok {
-		if gid == nil {
-			return nil, fmt.Errorf(`couldn't find child group "%v" in cache`, name)
-		}
-		return gid, nil
+	if groups, ok := c.parentIDChildGroupCache.Get(parentID); ok {
+		return groups, nil
 	}
 	// otherwise get data from keycloak
 	var groups []Group
 	var first int
 	for {
 		var page []Group
-		if err := c.limiter.Wait(ctx); err != nil {
-			return nil, fmt.Errorf("couldn't wait for limiter: %v", err)
+		if err := c.limiter.Wait(ctx, "childGroups"); err != nil {
+			return nil, fmt.Errorf("couldn't wait for limiter: %w", err)
 		}
 		data, err := c.rawChildGroups(ctx, parentID, first)
+		if errors.Is(err, errNoChildGroupsEndpoint) && first == 0 {
+			return c.childGroupsFromGroup(ctx, parentID)
+		}
 		if err != nil {
-			return nil, fmt.Errorf("couldn't get child groups from Keycloak: %v", err)
+			return nil, fmt.Errorf("couldn't get child groups from Keycloak: %w", err)
 		}
 		if err := json.Unmarshal(data, &page); err != nil {
-			return nil, fmt.Errorf("couldn't unmarshal child groups: %v", err)
+			return nil, fmt.Errorf("couldn't unmarshal child groups: %w", err)
+		}
+		for _, group := range page {
+			if group.ID == nil {
+				return nil, fmt.Errorf("missing ID in Keycloak group %s",
+					group.Name)
+			}
 		}
 		groups = append(groups, page...)
 		if len(page) < c.pageSize {
@@ -149,49 +150,115 @@ func (c *Client) groupIDFromParentAndName(
 		first += c.pageSize // scroll to next page
 	}
 	// update caches
+	for i := range groups {
+		c.cacheGroup(groups[i])
+		groups[i].SubGroups = nil
+	}
 	c.parentIDChildGroupCache.Set(parentID, groups)
-	for _, group := range groups {
-		c.groupIDGroupCache.Set(*group.ID, group)
+	return groups, nil
+}
+
+// childGroupsFromGroup returns the child groups of the given parent group ID
+// included inline in its group representation. It is used with Keycloak
+// versions before 23, which don't have the child groups endpoint.
+func (c *Client) childGroupsFromGroup(
+	ctx context.Context,
+	parentID uuid.UUID,
+) ([]Group, error) {
+	if err := c.limiter.Wait(ctx, "childGroups"); err != nil {
+		return nil, fmt.Errorf("couldn't wait for limiter: %w", err)
+	}
+	data, err := c.rawGroup(ctx, parentID)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get group from Keycloak API: %w", err)
+	}
+	var group Group
+	if err = json.Unmarshal(data, &group); err != nil {
+		return nil, fmt.Errorf("couldn't unmarshal group: %w", err)
+	}
+	if group.ID == nil || *group.ID != parentID {
+		return nil, fmt.Errorf("group with wrong ID: %v", group.ID)
+	}
+	if _, complete := group.inlineChildGroups(); !complete {
+		return nil, fmt.Errorf("no child groups included in group %s",
+			parentID.String())
+	}
+	c.cacheGroup(group)
+	groups, _ := c.parentIDChildGroupCache.Get(parentID)
+	return groups, nil
+}
+
+// groupIDFromParentAndName takes a parent group ID and a group name, and
+// returns the group ID of the child group matching the given name. If there
+// is no such child group, it returns *ErrGroupNotFound.
+func (c *Client) groupIDFromParentAndName(
+	ctx context.Context,
+	parentID uuid.UUID,
+	name string,
+) (*uuid.UUID, error) {
+	groups, err := c.childGroups(ctx, parentID)
+	if err != nil {
+		return nil, err
 	}
-	// return group ID
 	for _, group := range groups {
 		if group.Name == name {
 			return group.ID, nil
 		}
 	}
-	return nil, fmt.Errorf(`couldn't find child group "%v" in keycloak`, name)
+	return nil, &ErrGroupNotFound{Name: name}
 }
 
 // groupPathID returns the ID of the group identified by path.
-// path is a slice of path segments (i.e. full path split on /).
+// path is a slice of path segments (i.e. full path split on /). If the path
+// is deeper than the maximum group depth, or resolves to the same group more
+// than once, it returns *ErrGroupHierarchy.
 func (c *Client) groupPathID(
 	ctx context.Context,
 	path []string,
+) (*uuid.UUID, error) {
+	if len(path)-1 > c.maxGroupDepth {
+		return nil, c.groupHierarchyError(path[1:], false)
+	}
+	return c.walkGroupPath(ctx, path, map[uuid.UUID]bool{})
+}
+
+// walkGroupPath implements groupPathID. visited contains the IDs of the
+// groups already resolved on the path.
+func (c *Client) walkGroupPath(
+	ctx context.Context,
+	path []string,
+	visited map[uuid.UUID]bool,
 ) (*uuid.UUID, error) {
 	switch {
 	case len(path) == 2:
 		gid, err := c.topLevelGroupPathID(ctx, path)
 		if err != nil {
 			return nil,
-				fmt.Errorf(`couldn't get ID for top level group path "%v": %v`,
-					path[1], err)
+				fmt.Errorf(`couldn't get ID for top level group path "%s": %w`,
+					strings.Join(path, "/"), err)
 		}
+		visited[*gid] = true
 		return gid, nil
 	case len(path) > 2:
 		// not a top level group. find the parent ID by slicing off the last
-		// segment and calling groupPathID recursively.
-		parentID, err := c.groupPathID(ctx, path[:len(path)-1])
+		// segment and calling walkGroupPath recursively.
+		parentPath := path[:len(path)-1]
+		parentID, err := c.walkGroupPath(ctx, parentPath, visited)
 		if err != nil {
-			return nil,
-				fmt.Errorf(`couldn't get ID for group path "%v": %v`, path[:1], err)
+			return nil, fmt.Errorf(`couldn't get ID for group path "%s": %w`,
+				strings.Join(parentPath, "/"), err)
 		}
 		groupName := path[len(path)-1]
 		gid, err := c.groupIDFromParentAndName(ctx, *parentID, groupName)
 		if err != nil {
 			return nil,
-				fmt.Errorf(`couldn't get ID for group "%s" with parent ID "%v": %v`,
+				fmt.Errorf(`couldn't get ID for group "%s" with parent ID "%v": %w`,
 					groupName, parentID, err)
 		}
+		if visited[*gid] {
+			return nil, c.groupHierarchyError(path[1:], true)
+		}
+		visited[*gid] = true
 		return gid, nil
 	default:
 		return nil, fmt.Errorf(`invalid case for path "%v"`, path)
@@ -217,18 +284,16 @@ func (c *Client) userGroup2Role(
 	gid, err := c.groupPathID(ctx, path)
 	if err != nil {
 		return lagoon.InvalidUserRole,
-			fmt.Errorf("couldn't get group ID from path: %v", err)
+			fmt.Errorf("couldn't get group ID from path: %w", err)
 	}
 	// get group from ID
 	group, err := c.groupByID(ctx, *gid)
 	if err != nil {
 		return lagoon.InvalidUserRole,
-			fmt.Errorf("couldn't get group %s by ID: %v", gid.String(), err)
+			fmt.Errorf("couldn't get group %s by ID: %w", gid.String(), err)
 	}
 	// validate type attribute
-	if group.Attributes == nil ||
-		len(group.Attributes["type"]) != 1 ||
-		group.Attributes["type"][0] != "role-subgroup" {
+	if !isRoleSubgroup(*group) {
 		return lagoon.InvalidUserRole,
 			fmt.Errorf("group %s invalid type for role subgroup: %v",
 				gid.String(), group.Attributes)
@@ -245,10 +310,10 @@ func (c *Client) userGroup2Role(
 				gid.String(), group.RealmRoles[0], roleString)
 	}
 	// parse role
-	role, err := lagoon.UserRoleString(roleString)
+	role, err := lagoon.UserRoleFromString(roleString)
 	if err != nil {
 		return lagoon.InvalidUserRole,
-			fmt.Errorf(`couldn't parse "%s" as user role: %v`, roleString, err)
+			fmt.Errorf(`couldn't parse "%s" as user role: %w`, roleString, err)
 	}
 	return role, nil
 }
@@ -298,3 +363,67 @@ func (c *Client) UserGroupIDRole(
 	}
 	return gidRole
 }
+
+// isRoleSubgroup returns true if the given group is a Lagoon role subgroup,
+// and false otherwise.
+func isRoleSubgroup(group Group) bool {
+	return group.Attributes != nil &&
+		len(group.Attributes["type"]) == 1 &&
+		group.Attributes["type"][0] == "role-subgroup"
+}
+
+// DescendantGroups takes a slice of group IDs, and returns the same slice
+// with any descendant group IDs appended, without duplicates. Role subgroups
+// are not considered to be descendants. If the descendants of a group contain
+// a cycle or exceed the maximum group depth, it returns *ErrGroupHierarchy.
+func (c *Client) DescendantGroups(
+	ctx context.Context,
+	groupIDs []uuid.UUID,
+) ([]uuid.UUID, error) {
+	// descendant is a group in the queue, and the chain of groups from the
+	// given group it descends from.
+	type descendant struct {
+		gid   uuid.UUID
+		chain []string
+	}
+	var allGIDs []uuid.UUID
+	var queue []descendant
+	visited := map[uuid.UUID]bool{}
+	for _, gid := range groupIDs {
+		if !visited[gid] {
+			visited[gid] = true
+			queue = append(queue,
+				descendant{gid: gid, chain: []string{gid.String()}})
+		}
+	}
+	for len(queue) > 0 {
+		d := queue[0]
+		queue = queue[1:]
+		allGIDs = append(allGIDs, d.gid)
+		children, err := c.childGroups(ctx, d.gid)
+		if err != nil {
+			return nil, fmt.Errorf(
+				`couldn't get descendant group IDs for "%v": %w`, d.gid, err)
+		}
+		for _, child := range children {
+			// role subgroups only indicate the role of their members
+			if isRoleSubgroup(child) {
+				continue
+			}
+			chain := append(slices.Clone(d.chain), child.ID.String())
+			if slices.Contains(d.chain, child.ID.String()) {
+				return nil, c.groupHierarchyError(chain, true)
+			}
+			if len(chain) > c.maxGroupDepth {
+				return nil, c.groupHierarchyError(chain, false)
+			}
+			// a group may be both given and a descendant of another given group
+			if !visited[*child.ID] {
+				visited[*child.ID] = true
+				queue = append(queue, descendant{gid: *child.ID, chain: chain})
+			}
+		}
+	}
+	slices.SortFunc(allGIDs, uuid.Compare)
+	return allGIDs, nil
+}
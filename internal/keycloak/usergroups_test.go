@@ -3,7 +3,7 @@ package keycloak_test
 import (
 	"bytes"
 	"context"
-	"fmt"
+	"errors"
 	"io"
 	"log/slog"
 	"net/http"
@@ -77,22 +77,10 @@ func newTestUGIDRoleServer(tt *testing.T) *httptest.Server {
 			})
 	}
 	// configure the "all groups" paths
+	groups := loadTestGroups(tt)
 	mux.HandleFunc("/auth/admin/realms/lagoon/groups",
 		func(w http.ResponseWriter, r *http.Request) {
-			paramFirst := r.URL.Query().Get("first")
-			paramMax := r.URL.Query().Get("max")
-			assert.Equal(tt, "5", paramMax)
-			dataPath :=
-				fmt.Sprintf("testdata/usergroups_groups_first%s.json", paramFirst)
-			f, err := os.Open(dataPath)
-			if err != nil {
-				tt.Fatal(err)
-				return
-			}
-			_, err = io.Copy(w, f)
-			if err != nil {
-				tt.Fatal(err)
-			}
+			serveTestGroups(tt, w, r, groups)
 		})
 	ts := httptest.NewServer(mux)
 	// now replace the example URL in the discovery JSON with the actual
@@ -201,7 +189,7 @@ func TestUserGroupIDRole(t *testing.T) {
 				ts.URL,
 				"auth-server",
 				"",
-				10)
+				newTestLimiter())
 			if err != nil {
 				tt.Fatal(err)
 			}
@@ -215,3 +203,205 @@ func TestUserGroupIDRole(t *testing.T) {
 		})
 	}
 }
+
+func TestGroupPathIDNotFound(t *testing.T) {
+	var testCases = map[string]struct {
+		path         string
+		expectErrors []string
+	}{
+		"missing top level group": {
+			path: "/no-such-group",
+			expectErrors: []string{
+				`top level group path "/no-such-group"`,
+				`group "no-such-group" not found`,
+			},
+		},
+		"missing child group": {
+			path: "/scott-test-ancestor-group2/no-such-child",
+			expectErrors: []string{
+				`group "no-such-child" not found`,
+			},
+		},
+		"missing parent group": {
+			path: "/scott-test-ancestor-group2/no-such-child/grandchild",
+			expectErrors: []string{
+				`group path "/scott-test-ancestor-group2/no-such-child"`,
+				`group "no-such-child" not found`,
+			},
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			ts := newTestUGIDRoleServer(tt)
+			defer ts.Close()
+			// init keycloak client
+			k, err := keycloak.NewClient(
+				context.Background(),
+				slog.New(slog.NewJSONHandler(os.Stderr, nil)),
+				ts.URL,
+				"auth-server",
+				"",
+				newTestLimiter())
+			if err != nil {
+				tt.Fatal(err)
+			}
+			// override internal HTTP client for testing
+			k.UseDefaultHTTPClient()
+			// override default huge pages
+			k.UsePageSize(5)
+			// perform testing
+			_, err = k.GroupPathID(context.Background(), tc.path)
+			assert.Error(tt, err, name)
+			for _, expect := range tc.expectErrors {
+				assert.Contains(tt, err.Error(), expect, name)
+			}
+		})
+	}
+}
+
+func TestTopLevelGroupPathIDNotFound(t *testing.T) {
+	ts := newTestUGIDRoleServer(t)
+	defer ts.Close()
+	k, err := keycloak.NewClient(
+		context.Background(),
+		slog.New(slog.NewJSONHandler(os.Stderr, nil)),
+		ts.URL,
+		"auth-server",
+		"",
+		newTestLimiter())
+	if err != nil {
+		t.Fatal(err)
+	}
+	k.UseDefaultHTTPClient()
+	_, err = k.TopLevelGroupPathID(context.Background(), "/no-such-group")
+	var notFound *keycloak.ErrGroupNotFound
+	assert.True(t, errors.As(err, &notFound))
+	assert.Equal(t, "no-such-group", notFound.Name)
+}
+
+func TestDescendantGroups(t *testing.T) {
+	var testCases = map[string]struct {
+		groupIDs []uuid.UUID
+		expect   []uuid.UUID
+	}{
+		"project group": {
+			groupIDs: []uuid.UUID{
+				uuid.MustParse("54486df8-450d-4b62-8e10-223ac3419d05"),
+			},
+			expect: []uuid.UUID{
+				uuid.MustParse("54486df8-450d-4b62-8e10-223ac3419d05"),
+			},
+		},
+		"ancestor group": {
+			groupIDs: []uuid.UUID{
+				uuid.MustParse("ee6d02d1-b14b-41dd-95b6-cb8c26b1a321"),
+			},
+			expect: []uuid.UUID{
+				uuid.MustParse("139ad442-1d20-4c58-b009-c0afe21bf85b"),
+				uuid.MustParse("2e833d9b-39b7-4f25-b37f-cfb8765015ab"),
+				uuid.MustParse("7f22ce84-c0af-4ff4-afcd-288f0473deb5"),
+				uuid.MustParse("879d1d38-97d8-449a-affd-8529b8e31feb"),
+				uuid.MustParse("c7d3b738-91f2-4cf1-aeec-2ab444eb3215"),
+				uuid.MustParse("ee6d02d1-b14b-41dd-95b6-cb8c26b1a321"),
+			},
+		},
+		"overlapping groups": {
+			groupIDs: []uuid.UUID{
+				uuid.MustParse("7f22ce84-c0af-4ff4-afcd-288f0473deb5"),
+				uuid.MustParse("139ad442-1d20-4c58-b009-c0afe21bf85b"),
+			},
+			expect: []uuid.UUID{
+				uuid.MustParse("139ad442-1d20-4c58-b009-c0afe21bf85b"),
+				uuid.MustParse("7f22ce84-c0af-4ff4-afcd-288f0473deb5"),
+			},
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			ts := newTestUGIDRoleServer(tt)
+			defer ts.Close()
+			// init keycloak client
+			k, err := keycloak.NewClient(
+				context.Background(),
+				slog.New(slog.NewJSONHandler(os.Stderr, nil)),
+				ts.URL,
+				"auth-server",
+				"",
+				newTestLimiter())
+			if err != nil {
+				tt.Fatal(err)
+			}
+			// override internal HTTP client for testing
+			k.UseDefaultHTTPClient()
+			// perform testing
+			gids, err := k.DescendantGroups(context.Background(), tc.groupIDs)
+			assert.NoError(tt, err, name)
+			assert.Equal(tt, tc.expect, gids, name)
+		})
+	}
+}
+
+func TestHasChildGroups(t *testing.T) {
+	var testCases = map[string]struct {
+		userGroupPaths []string
+		groupIDs       []uuid.UUID
+		expect         bool
+	}{
+		"no groups": {},
+		"project group": {
+			userGroupPaths: []string{
+				"/project-a-fishy-website/project-a-fishy-website-owner",
+			},
+			groupIDs: []uuid.UUID{
+				uuid.MustParse("54486df8-450d-4b62-8e10-223ac3419d05"),
+			},
+		},
+		"regular group": {
+			userGroupPaths: []string{
+				"/corp6-senior-devs/corp6-senior-devs-maintainer",
+			},
+			groupIDs: []uuid.UUID{
+				uuid.MustParse("eca344cd-2b81-4447-bcf9-ce07aa9d4a1b"),
+			},
+		},
+		"group with child groups": {
+			userGroupPaths: []string{
+				"/scott-test-ancestor-group2/scott-test-child-group2/scott-test-child-group2-developer",
+			},
+			groupIDs: []uuid.UUID{
+				uuid.MustParse("2e833d9b-39b7-4f25-b37f-cfb8765015ab"),
+			},
+			expect: true,
+		},
+		"uncached group": {
+			groupIDs: []uuid.UUID{
+				uuid.MustParse("54486df8-450d-4b62-8e10-223ac3419d05"),
+			},
+			expect: true,
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			ts := newTestUGIDRoleServer(tt)
+			defer ts.Close()
+			// init keycloak client
+			k, err := keycloak.NewClient(
+				context.Background(),
+				slog.New(slog.NewJSONHandler(os.Stderr, nil)),
+				ts.URL,
+				"auth-server",
+				"",
+				newTestLimiter())
+			if err != nil {
+				tt.Fatal(err)
+			}
+			// override internal HTTP client for testing
+			k.UseDefaultHTTPClient()
+			// populate the cache as the permission engine does
+			k.UserGroupIDRole(context.Background(), tc.userGroupPaths)
+			// perform testing
+			assert.Equal(tt, tc.expect,
+				k.HasChildGroups(context.Background(), tc.groupIDs), name)
+		})
+	}
+}
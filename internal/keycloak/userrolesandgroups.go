@@ -2,6 +2,7 @@ package keycloak
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/http"
 	"time"
@@ -12,7 +13,8 @@ import (
 )
 
 // UserRolesAndGroups queries Keycloak given the user UUID, and returns the
-// user's realm roles, and group memberships (by path).
+// user's realm roles, and group memberships (by path). If the user doesn't
+// exist, it returns an error wrapping ErrUserNotFound.
 func (c *Client) UserRolesAndGroups(
 	ctx context.Context,
 	userUUID uuid.UUID,
@@ -21,8 +23,8 @@ func (c *Client) UserRolesAndGroups(
 	ctx, span := otel.Tracer(pkgName).Start(ctx, "UserRolesAndGroups")
 	defer span.End()
 	// rate limit keycloak API access
-	if err := c.limiter.Wait(ctx); err != nil {
-		return nil, nil, fmt.Errorf("couldn't wait for limiter: %v", err)
+	if err := c.limiter.Wait(ctx, "UserRolesAndGroups"); err != nil {
+		return nil, nil, fmt.Errorf("couldn't wait for limiter: %w", err)
 	}
 	// get user token
 	userConfig := oauth2.Config{
@@ -42,12 +44,21 @@ func (c *Client) UserRolesAndGroups(
 		// https://www.keycloak.org/docs/latest/securing_apps/#_token-exchange
 		oauth2.SetAuthURLParam("requested_subject", userUUID.String()))
 	if err != nil {
-		return nil, nil, fmt.Errorf("couldn't get user token: %v", err)
+		// Keycloak doesn't clearly distinguish a missing user in the token
+		// exchange response, so check whether the user exists.
+		if _, ok := err.(*oauth2.RetrieveError); ok {
+			_, userErr := c.rawUser(ctx, userUUID)
+			if errors.Is(userErr, ErrUserNotFound) {
+				return nil, nil,
+					fmt.Errorf("couldn't get user token: %w", userErr)
+			}
+		}
+		return nil, nil, fmt.Errorf("couldn't get user token: %w", err)
 	}
 	// parse and extract verified attributes
 	claims, err := c.parseAccessToken(userToken, userUUID.String())
 	if err != nil {
-		return nil, nil, fmt.Errorf("couldn't parse user access token: %v", err)
+		return nil, nil, fmt.Errorf("couldn't parse user access token: %w", err)
 	}
 	return claims.RealmRoles, claims.UserGroups, nil
 }
@@ -0,0 +1,54 @@
+package keycloak_test
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"testing"
+
+	"github.com/alecthomas/assert/v2"
+	"github.com/google/uuid"
+	"github.com/uselagoon/ssh-portal/internal/keycloak"
+)
+
+func TestUserRolesAndGroupsUserNotFound(t *testing.T) {
+	var testCases = map[string]struct {
+		userUUID       uuid.UUID
+		expectNotFound bool
+	}{
+		"known user": {
+			userUUID: uuid.MustParse("91435afe-ba81-406f-9308-3f0f8d7d6b43"),
+		},
+		"unknown user": {
+			userUUID:       uuid.MustParse("00000000-0000-0000-0000-000000000001"),
+			expectNotFound: true,
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			ts := newTestUserServer(tt)
+			defer ts.Close()
+			// init keycloak client
+			k, err := keycloak.NewClient(
+				context.Background(),
+				slog.New(slog.NewJSONHandler(os.Stderr, nil)),
+				ts.URL,
+				"auth-server",
+				"",
+				newTestLimiter())
+			if err != nil {
+				tt.Fatal(err)
+			}
+			// override internal HTTP client for testing
+			k.UseDefaultHTTPClient()
+			// the token exchange always fails, so only the error is checked
+			_, _, err = k.UserRolesAndGroups(context.Background(), tc.userUUID)
+			assert.Error(tt, err, name)
+			if tc.expectNotFound {
+				assert.IsError(tt, err, keycloak.ErrUserNotFound, name)
+			} else {
+				assert.NotIsError(tt, err, keycloak.ErrUserNotFound, name)
+			}
+		})
+	}
+}
@@ -0,0 +1,92 @@
+// Package keypolicy implements checks on the type and size of SSH public keys
+// offered by clients.
+package keypolicy
+
+import (
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"slices"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// knownAlgorithms is the list of public key algorithms which may be
+// configured in a Policy.
+var knownAlgorithms = []string{
+	gossh.KeyAlgoRSA,
+	gossh.KeyAlgoDSA,
+	gossh.KeyAlgoECDSA256,
+	gossh.KeyAlgoECDSA384,
+	gossh.KeyAlgoECDSA521,
+	gossh.KeyAlgoSKECDSA256,
+	gossh.KeyAlgoED25519,
+	gossh.KeyAlgoSKED25519,
+}
+
+var (
+	// ErrAlgorithmNotAllowed is returned by Check when the key algorithm is
+	// not in the list of allowed algorithms.
+	ErrAlgorithmNotAllowed = errors.New("key algorithm not allowed")
+	// ErrRSAKeyTooSmall is returned by Check when an RSA key is smaller than
+	// the configured minimum size.
+	ErrRSAKeyTooSmall = errors.New("RSA key too small")
+)
+
+// Policy defines the types and sizes of SSH public keys which are accepted.
+// The zero value accepts any key.
+type Policy struct {
+	allowedAlgorithms []string
+	minRSABits        int
+}
+
+// NewPolicy validates the given arguments and returns a new Policy.
+//
+// If allowedAlgorithms is empty, any key algorithm is allowed. If minRSABits
+// is zero, RSA keys of any size are allowed.
+func NewPolicy(allowedAlgorithms []string, minRSABits int) (*Policy, error) {
+	for _, algo := range allowedAlgorithms {
+		if !slices.Contains(knownAlgorithms, algo) {
+			return nil, fmt.Errorf("unknown key algorithm %q", algo)
+		}
+	}
+	if minRSABits < 0 {
+		return nil, fmt.Errorf("invalid minimum RSA key size %d", minRSABits)
+	}
+	return &Policy{
+		allowedAlgorithms: allowedAlgorithms,
+		minRSABits:        minRSABits,
+	}, nil
+}
+
+// rsaBits returns the size in bits of the modulus of the given RSA key.
+func rsaBits(key gossh.PublicKey) (int, error) {
+	cryptoKey, ok := key.(gossh.CryptoPublicKey)
+	if !ok {
+		return 0, fmt.Errorf("unsupported key implementation %T", key)
+	}
+	rsaKey, ok := cryptoKey.CryptoPublicKey().(*rsa.PublicKey)
+	if !ok {
+		return 0, fmt.Errorf("invalid RSA key type %T", cryptoKey.CryptoPublicKey())
+	}
+	return rsaKey.N.BitLen(), nil
+}
+
+// Check returns an error if the given key is not accepted by the Policy, and
+// nil otherwise.
+func (p *Policy) Check(key gossh.PublicKey) error {
+	if len(p.allowedAlgorithms) > 0 &&
+		!slices.Contains(p.allowedAlgorithms, key.Type()) {
+		return ErrAlgorithmNotAllowed
+	}
+	if p.minRSABits > 0 && key.Type() == gossh.KeyAlgoRSA {
+		bits, err := rsaBits(key)
+		if err != nil {
+			return fmt.Errorf("couldn't get RSA key size: %v", err)
+		}
+		if bits < p.minRSABits {
+			return ErrRSAKeyTooSmall
+		}
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+package keypolicy_test
+
+import (
+	"crypto/dsa" //nolint:staticcheck // required to test rejection of DSA keys
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"testing"
+
+	"github.com/alecthomas/assert/v2"
+	"github.com/uselagoon/ssh-portal/internal/keypolicy"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+func newKey(tt *testing.T, keyType string, bits int) gossh.PublicKey {
+	var cryptoKey any
+	switch keyType {
+	case gossh.KeyAlgoRSA:
+		k, err := rsa.GenerateKey(rand.Reader, bits)
+		if err != nil {
+			tt.Fatal(err)
+		}
+		cryptoKey = &k.PublicKey
+	case gossh.KeyAlgoDSA:
+		var k dsa.PrivateKey
+		err := dsa.GenerateParameters(&k.Parameters, rand.Reader, dsa.L1024N160)
+		if err != nil {
+			tt.Fatal(err)
+		}
+		if err = dsa.GenerateKey(&k, rand.Reader); err != nil {
+			tt.Fatal(err)
+		}
+		cryptoKey = &k.PublicKey
+	case gossh.KeyAlgoECDSA256:
+		k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			tt.Fatal(err)
+		}
+		cryptoKey = &k.PublicKey
+	case gossh.KeyAlgoED25519:
+		k, _, err := ed25519.GenerateKey(nil)
+		if err != nil {
+			tt.Fatal(err)
+		}
+		cryptoKey = k
+	default:
+		tt.Fatalf("unsupported key type %s", keyType)
+	}
+	sshKey, err := gossh.NewPublicKey(cryptoKey)
+	if err != nil {
+		tt.Fatal(err)
+	}
+	return sshKey
+}
+
+func TestCheck(t *testing.T) {
+	securityPolicy := []string{
+		gossh.KeyAlgoRSA,
+		gossh.KeyAlgoECDSA256,
+		gossh.KeyAlgoED25519,
+	}
+	var testCases = map[string]struct {
+		allowedAlgorithms []string
+		minRSABits        int
+		keyType           string
+		keyBits           int
+		expectErr         error
+	}{
+		"default policy rsa 2048": {
+			keyType: gossh.KeyAlgoRSA,
+			keyBits: 2048,
+		},
+		"default policy dsa": {
+			keyType: gossh.KeyAlgoDSA,
+		},
+		"default policy ed25519": {
+			keyType: gossh.KeyAlgoED25519,
+		},
+		"security policy rsa 2048": {
+			allowedAlgorithms: securityPolicy,
+			minRSABits:        3072,
+			keyType:           gossh.KeyAlgoRSA,
+			keyBits:           2048,
+			expectErr:         keypolicy.ErrRSAKeyTooSmall,
+		},
+		"security policy rsa 3072": {
+			allowedAlgorithms: securityPolicy,
+			minRSABits:        3072,
+			keyType:           gossh.KeyAlgoRSA,
+			keyBits:           3072,
+		},
+		"security policy dsa": {
+			allowedAlgorithms: securityPolicy,
+			minRSABits:        3072,
+			keyType:           gossh.KeyAlgoDSA,
+			expectErr:         keypolicy.ErrAlgorithmNotAllowed,
+		},
+		"security policy ecdsa": {
+			allowedAlgorithms: securityPolicy,
+			minRSABits:        3072,
+			keyType:           gossh.KeyAlgoECDSA256,
+		},
+		"security policy ed25519": {
+			allowedAlgorithms: securityPolicy,
+			minRSABits:        3072,
+			keyType:           gossh.KeyAlgoED25519,
+		},
+		"ed25519 only rsa 4096": {
+			allowedAlgorithms: []string{gossh.KeyAlgoED25519},
+			keyType:           gossh.KeyAlgoRSA,
+			keyBits:           4096,
+			expectErr:         keypolicy.ErrAlgorithmNotAllowed,
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			p, err := keypolicy.NewPolicy(tc.allowedAlgorithms, tc.minRSABits)
+			assert.NoError(tt, err, name)
+			key := newKey(tt, tc.keyType, tc.keyBits)
+			assert.Equal(tt, tc.expectErr, p.Check(key), name)
+		})
+	}
+}
+
+func TestNewPolicyInvalid(t *testing.T) {
+	var testCases = map[string]struct {
+		allowedAlgorithms []string
+		minRSABits        int
+	}{
+		"unknown algorithm": {allowedAlgorithms: []string{"ssh-foo"}},
+		"negative size":     {minRSABits: -1},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			_, err := keypolicy.NewPolicy(tc.allowedAlgorithms, tc.minRSABits)
+			assert.Error(tt, err, name)
+		})
+	}
+}
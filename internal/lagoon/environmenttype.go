@@ -1,6 +1,8 @@
 package lagoon
 
-//go:generate enumer -type=EnvironmentType -sql -transform=lower
+import "strings"
+
+//go:generate enumer -type=EnvironmentType -json -sql -transform=lower
 
 // EnvironmentType is an enum of valid Environment types.
 type EnvironmentType int
@@ -11,3 +13,9 @@ const (
 	// Production environment type.
 	Production
 )
+
+// EnvironmentTypeFromString parses s as an EnvironmentType. Parsing is
+// case-insensitive and ignores surrounding whitespace.
+func EnvironmentTypeFromString(s string) (EnvironmentType, error) {
+	return EnvironmentTypeString(strings.TrimSpace(s))
+}
@@ -0,0 +1,49 @@
+package lagoon_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/alecthomas/assert/v2"
+	"github.com/uselagoon/ssh-portal/internal/lagoon"
+)
+
+func TestEnvironmentTypeJSONRoundTrip(t *testing.T) {
+	for _, envType := range lagoon.EnvironmentTypeValues() {
+		t.Run(envType.String(), func(tt *testing.T) {
+			data, err := json.Marshal(envType)
+			assert.NoError(tt, err)
+			assert.Equal(tt, `"`+envType.String()+`"`, string(data))
+			var parsed lagoon.EnvironmentType
+			assert.NoError(tt, json.Unmarshal(data, &parsed))
+			assert.Equal(tt, envType, parsed)
+		})
+	}
+}
+
+func TestEnvironmentTypeFromString(t *testing.T) {
+	var testCases = map[string]struct {
+		input  string
+		expect lagoon.EnvironmentType
+		expErr bool
+	}{
+		"production":  {input: "production", expect: lagoon.Production},
+		"development": {input: "development", expect: lagoon.Development},
+		"mixed case":  {input: "Production", expect: lagoon.Production},
+		"upper case":  {input: "DEVELOPMENT", expect: lagoon.Development},
+		"whitespace":  {input: "\tproduction ", expect: lagoon.Production},
+		"unknown":     {input: "staging", expErr: true},
+		"empty":       {input: "", expErr: true},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			envType, err := lagoon.EnvironmentTypeFromString(tc.input)
+			if tc.expErr {
+				assert.Error(tt, err, name)
+				return
+			}
+			assert.NoError(tt, err, name)
+			assert.Equal(tt, tc.expect, envType, name)
+		})
+	}
+}
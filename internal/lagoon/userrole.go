@@ -1,8 +1,17 @@
 package lagoon
 
-//go:generate enumer -type=UserRole -transform=lower
+import (
+	"fmt"
+	"strings"
+)
+
+//go:generate enumer -type=UserRole -json -transform=lower
 
 // UserRole is an enum of valid User roles.
+//
+// Roles are ordered by increasing privilege, so that when a user has several
+// roles the highest role can be found by comparing them. Organization roles
+// are ordered alongside the project roles which grant similar access.
 type UserRole int
 
 const (
@@ -10,12 +19,32 @@ const (
 	InvalidUserRole UserRole = iota
 	// Guest user role.
 	Guest
+	// OrganizationViewer user role.
+	OrganizationViewer
 	// Reporter user role.
 	Reporter
 	// Developer user role.
 	Developer
 	// Maintainer user role.
 	Maintainer
+	// OrganizationAdmin user role.
+	OrganizationAdmin
 	// Owner user role.
 	Owner
+	// OrganizationOwner user role.
+	OrganizationOwner
 )
+
+// UserRoleFromString parses s as a UserRole. Parsing is case-insensitive and
+// ignores surrounding whitespace. Unlike UserRoleString, it returns an error
+// rather than InvalidUserRole.
+func UserRoleFromString(s string) (UserRole, error) {
+	role, err := UserRoleString(strings.TrimSpace(s))
+	if err != nil {
+		return InvalidUserRole, err
+	}
+	if role == InvalidUserRole {
+		return InvalidUserRole, fmt.Errorf("invalid user role: %s", s)
+	}
+	return role, nil
+}
@@ -0,0 +1,108 @@
+package lagoon_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/alecthomas/assert/v2"
+	"github.com/uselagoon/ssh-portal/internal/lagoon"
+)
+
+func TestUserRoleJSONRoundTrip(t *testing.T) {
+	for _, role := range lagoon.UserRoleValues() {
+		t.Run(role.String(), func(tt *testing.T) {
+			data, err := json.Marshal(role)
+			assert.NoError(tt, err)
+			assert.Equal(tt, `"`+role.String()+`"`, string(data))
+			var parsed lagoon.UserRole
+			assert.NoError(tt, json.Unmarshal(data, &parsed))
+			assert.Equal(tt, role, parsed)
+		})
+	}
+}
+
+func TestUserRoleUnmarshalJSON(t *testing.T) {
+	var testCases = map[string]struct {
+		input  string
+		expect lagoon.UserRole
+		expErr bool
+	}{
+		"lower case":  {input: `"maintainer"`, expect: lagoon.Maintainer},
+		"mixed case":  {input: `"Maintainer"`, expect: lagoon.Maintainer},
+		"unknown":     {input: `"admin"`, expErr: true},
+		"not string":  {input: `4`, expErr: true},
+		"org role":    {input: `"organizationowner"`, expect: lagoon.OrganizationOwner},
+		"upper case":  {input: `"GUEST"`, expect: lagoon.Guest},
+		"empty input": {input: `""`, expErr: true},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			var role lagoon.UserRole
+			err := json.Unmarshal([]byte(tc.input), &role)
+			if tc.expErr {
+				assert.Error(tt, err, name)
+				return
+			}
+			assert.NoError(tt, err, name)
+			assert.Equal(tt, tc.expect, role, name)
+		})
+	}
+}
+
+func TestUserRoleFromString(t *testing.T) {
+	var testCases = map[string]struct {
+		input  string
+		expect lagoon.UserRole
+		expErr bool
+	}{
+		"guest":              {input: "guest", expect: lagoon.Guest},
+		"mixed case":         {input: "DeVeLoPeR", expect: lagoon.Developer},
+		"whitespace":         {input: " owner\n", expect: lagoon.Owner},
+		"organization admin": {input: "OrganizationAdmin", expect: lagoon.OrganizationAdmin},
+		"invalid role name":  {input: "invaliduserrole", expErr: true},
+		"unknown":            {input: "superuser", expErr: true},
+		"empty":              {input: "", expErr: true},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			role, err := lagoon.UserRoleFromString(tc.input)
+			if tc.expErr {
+				assert.Error(tt, err, name)
+				assert.Equal(tt, lagoon.InvalidUserRole, role, name)
+				return
+			}
+			assert.NoError(tt, err, name)
+			assert.Equal(tt, tc.expect, role, name)
+		})
+	}
+}
+
+func TestUserRoleOrdering(t *testing.T) {
+	// roles in increasing order of privilege
+	ordered := []lagoon.UserRole{
+		lagoon.InvalidUserRole,
+		lagoon.Guest,
+		lagoon.OrganizationViewer,
+		lagoon.Reporter,
+		lagoon.Developer,
+		lagoon.Maintainer,
+		lagoon.OrganizationAdmin,
+		lagoon.Owner,
+		lagoon.OrganizationOwner,
+	}
+	assert.Equal(t, ordered, lagoon.UserRoleValues())
+	for i, lower := range ordered {
+		for j, higher := range ordered {
+			assert.Equal(t, i < j, lower < higher,
+				"%v < %v", lower, higher)
+		}
+	}
+	// the highest role wins
+	highest := lagoon.InvalidUserRole
+	for _, role := range []lagoon.UserRole{
+		lagoon.Reporter, lagoon.Owner, lagoon.Guest, lagoon.Maintainer,
+	} {
+		highest = max(highest, role)
+	}
+	assert.Equal(t, lagoon.Owner, highest)
+}
@@ -29,6 +29,15 @@ type Environment struct {
 	ProjectID     int                    `db:"project_id"`
 	ProjectName   string                 `db:"project_name"`
 	Type          lagoon.EnvironmentType `db:"type"`
+	ClusterName   string                 `db:"cluster_name"`
+}
+
+// EnvironmentEndpoint is a Lagoon project environment, along with the SSH
+// endpoint of the ssh-portal serving it.
+type EnvironmentEndpoint struct {
+	Environment
+	SSHHost string `db:"ssh_host"`
+	SSHPort string `db:"ssh_port"`
 }
 
 // User is a Lagoon user.
@@ -39,6 +48,23 @@ type User struct {
 // ErrNoResult is returned by client methods if there is no result.
 var ErrNoResult = errors.New("no rows in result set")
 
+// ErrQueryTimeout is returned by client methods if a query failed because
+// the deadline of its context was exceeded. It wraps the underlying error, so
+// context.DeadlineExceeded also matches.
+var ErrQueryTimeout = errors.New("lagoon API DB query timed out")
+
+// queryError maps an error returned by a query to the errors returned by
+// client methods.
+func queryError(err error) error {
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return ErrNoResult
+	case errors.Is(err, context.DeadlineExceeded):
+		return fmt.Errorf("%w: %w", ErrQueryTimeout, err)
+	}
+	return err
+}
+
 // NewClient returns a new Lagoon DB Client.
 func NewClient(ctx context.Context, dsn string) (*Client, error) {
 	db, err := sqlx.ConnectContext(ctx, "mysql", dsn)
@@ -71,16 +97,15 @@ func (c *Client) EnvironmentByNamespaceName(
 			`environment.name AS name, `+
 			`environment.openshift_project_name AS namespace_name, `+
 			`project.id AS project_id, `+
-			`project.name AS project_name `+
+			`project.name AS project_name, `+
+			`COALESCE(openshift.name, '') AS cluster_name `+
 			`FROM environment JOIN project ON environment.project = project.id `+
+			`LEFT JOIN openshift ON environment.openshift = openshift.id `+
 			`WHERE environment.openshift_project_name = ? `+
 			`AND environment.deleted = '0000-00-00 00:00:00' `+
 			`LIMIT 1`, name)
 	if err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			return nil, ErrNoResult
-		}
-		return nil, err
+		return nil, queryError(err)
 	}
 	return &env, nil
 }
@@ -102,10 +127,7 @@ func (c *Client) UserBySSHFingerprint(
 			`WHERE ssh_key.key_fingerprint = ?`,
 		fingerprint)
 	if err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			return nil, ErrNoResult
-		}
-		return nil, err
+		return nil, queryError(err)
 	}
 	// usid column in set NOT NULL, so this should be impossible
 	if user.UUID == nil {
@@ -133,10 +155,7 @@ func (c *Client) SSHEndpointByEnvironmentID(ctx context.Context,
 			`WHERE environment.id = ?`,
 		envID)
 	if err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			return "", "", ErrNoResult
-		}
-		return "", "", err
+		return "", "", queryError(err)
 	}
 	return ssh.Host, ssh.Port, nil
 }
@@ -162,8 +181,8 @@ func (c *Client) SSHKeyUsed(
 		used.UTC().Format(time.DateTime),
 		fingerprint)
 	if err != nil {
-		return fmt.Errorf("couldn't update last_used for key_fingerprint=%s: %v",
-			fingerprint, err)
+		return fmt.Errorf("couldn't update last_used for key_fingerprint=%s: %w",
+			fingerprint, queryError(err))
 	}
 	return nil
 }
@@ -185,10 +204,78 @@ func (c *Client) ProjectGroupIDs(
 			`WHERE project_id = ?`,
 		projectID)
 	if err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			return nil, ErrNoResult
-		}
-		return nil, err
+		return nil, queryError(err)
 	}
 	return gids, nil
 }
+
+// ProjectIDsByGroupIDs returns a slice of IDs of projects which are members
+// of any of the groups identified by the given groupIDs.
+func (c *Client) ProjectIDsByGroupIDs(
+	ctx context.Context,
+	groupIDs []uuid.UUID,
+) ([]int, error) {
+	// set up tracing
+	ctx, span := otel.Tracer(pkgName).Start(ctx, "ProjectIDsByGroupIDs")
+	defer span.End()
+	if len(groupIDs) == 0 {
+		return nil, nil
+	}
+	// run query
+	query, args, err := sqlx.In(
+		`SELECT DISTINCT project_id `+
+			`FROM kc_group_projects `+
+			`WHERE group_id IN (?) `+
+			`ORDER BY project_id`,
+		groupIDs)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't construct query: %w", err)
+	}
+	var pids []int
+	err = c.db.SelectContext(ctx, &pids, c.db.Rebind(query), args...)
+	if err != nil {
+		return nil, queryError(err)
+	}
+	return pids, nil
+}
+
+// EnvironmentsByProjectIDs returns the environments, along with their SSH
+// endpoints, of the projects identified by the given projectIDs. Environments
+// are ordered by namespace name.
+func (c *Client) EnvironmentsByProjectIDs(
+	ctx context.Context,
+	projectIDs []int,
+) ([]EnvironmentEndpoint, error) {
+	// set up tracing
+	ctx, span := otel.Tracer(pkgName).Start(ctx, "EnvironmentsByProjectIDs")
+	defer span.End()
+	if len(projectIDs) == 0 {
+		return nil, nil
+	}
+	// run query
+	query, args, err := sqlx.In(
+		`SELECT environment.environment_type AS type, `+
+			`environment.id AS id, `+
+			`environment.name AS name, `+
+			`environment.openshift_project_name AS namespace_name, `+
+			`project.id AS project_id, `+
+			`project.name AS project_name, `+
+			`COALESCE(openshift.name, '') AS cluster_name, `+
+			`COALESCE(openshift.ssh_host, '') AS ssh_host, `+
+			`COALESCE(openshift.ssh_port, '') AS ssh_port `+
+			`FROM environment JOIN project ON environment.project = project.id `+
+			`LEFT JOIN openshift ON environment.openshift = openshift.id `+
+			`WHERE environment.project IN (?) `+
+			`AND environment.deleted = '0000-00-00 00:00:00' `+
+			`ORDER BY environment.openshift_project_name`,
+		projectIDs)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't construct query: %w", err)
+	}
+	var envs []EnvironmentEndpoint
+	err = c.db.SelectContext(ctx, &envs, c.db.Rebind(query), args...)
+	if err != nil {
+		return nil, queryError(err)
+	}
+	return envs, nil
+}
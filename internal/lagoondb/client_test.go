@@ -2,11 +2,17 @@ package lagoondb_test
 
 import (
 	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
 	"testing"
 	"time"
 
 	"github.com/DATA-DOG/go-sqlmock"
 	"github.com/alecthomas/assert/v2"
+	"github.com/google/uuid"
+	"github.com/uselagoon/ssh-portal/internal/lagoon"
 	"github.com/uselagoon/ssh-portal/internal/lagoondb"
 )
 
@@ -114,3 +120,194 @@ func TestProjectGroupIDs(t *testing.T) {
 		})
 	}
 }
+
+func TestProjectIDsByGroupIDs(t *testing.T) {
+	var testCases = map[string]struct {
+		groupIDs    []uuid.UUID
+		expect      []int
+		expectQuery bool
+		rows        *sqlmock.Rows
+	}{
+		"two groups": {
+			groupIDs: []uuid.UUID{
+				uuid.MustParse("486765ce-14ec-4ad8-a454-e026b8cc52a4"),
+				uuid.MustParse("d79a42a6-a5b0-4d37-a1dd-44c2b1f6fddc"),
+			},
+			expect:      []int{12, 18},
+			expectQuery: true,
+			rows:        sqlmock.NewRows([]string{"project_id"}).AddRow(12).AddRow(18),
+		},
+		"no groups": {
+			expectQuery: false,
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			// set up mocks
+			mockDB, mock, err := sqlmock.New()
+			assert.NoError(tt, err, name)
+			if tc.expectQuery {
+				var args []driver.Value
+				for _, gid := range tc.groupIDs {
+					args = append(args, gid.String())
+				}
+				mock.ExpectQuery(
+					`SELECT DISTINCT project_id ` +
+						`FROM kc_group_projects ` +
+						`WHERE group_id IN \(\?, \?\) ` +
+						`ORDER BY project_id`).
+					WithArgs(args...).
+					WillReturnRows(tc.rows)
+			}
+			// execute expected database operations
+			db := lagoondb.NewClientFromDB(mockDB)
+			pids, err := db.ProjectIDsByGroupIDs(context.Background(), tc.groupIDs)
+			assert.NoError(tt, err, name)
+			assert.Equal(tt, tc.expect, pids, name)
+			// check expectations
+			err = mock.ExpectationsWereMet()
+			assert.NoError(tt, err, name)
+		})
+	}
+}
+
+func TestEnvironmentsByProjectIDs(t *testing.T) {
+	columns := []string{"type", "id", "name", "namespace_name", "project_id",
+		"project_name", "cluster_name", "ssh_host", "ssh_port"}
+	var testCases = map[string]struct {
+		projectIDs  []int
+		rows        *sqlmock.Rows
+		error       error
+		expect      []lagoondb.EnvironmentEndpoint
+		expectError bool
+	}{
+		"two environments": {
+			projectIDs: []int{12, 18},
+			rows: sqlmock.NewRows(columns).
+				AddRow("production", 3, "main", "foo-main", 12, "foo", "c1",
+					"ssh.example.com", "22").
+				AddRow("development", 4, "dev", "bar-dev", 18, "bar", "", "", ""),
+			expect: []lagoondb.EnvironmentEndpoint{
+				{
+					Environment: lagoondb.Environment{
+						ID:            3,
+						Name:          "main",
+						NamespaceName: "foo-main",
+						ProjectID:     12,
+						ProjectName:   "foo",
+						Type:          lagoon.Production,
+						ClusterName:   "c1",
+					},
+					SSHHost: "ssh.example.com",
+					SSHPort: "22",
+				},
+				{
+					Environment: lagoondb.Environment{
+						ID:            4,
+						Name:          "dev",
+						NamespaceName: "bar-dev",
+						ProjectID:     18,
+						ProjectName:   "bar",
+						Type:          lagoon.Development,
+					},
+				},
+			},
+		},
+		"query error": {
+			projectIDs:  []int{12},
+			error:       errors.New("connection refused"),
+			expectError: true,
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			// set up mocks
+			mockDB, mock, err := sqlmock.New()
+			assert.NoError(tt, err, name)
+			var args []driver.Value
+			for _, pid := range tc.projectIDs {
+				args = append(args, pid)
+			}
+			query := mock.ExpectQuery(
+				`SELECT (.+) FROM environment JOIN project (.+) ` +
+					`WHERE environment.project IN \((.+)\) (.+)`).
+				WithArgs(args...)
+			if tc.error != nil {
+				query.WillReturnError(tc.error)
+			} else {
+				query.WillReturnRows(tc.rows)
+			}
+			// execute expected database operations
+			db := lagoondb.NewClientFromDB(mockDB)
+			envs, err := db.EnvironmentsByProjectIDs(context.Background(),
+				tc.projectIDs)
+			if tc.expectError {
+				assert.Error(tt, err, name)
+			} else {
+				assert.NoError(tt, err, name)
+				assert.Equal(tt, tc.expect, envs, name)
+			}
+			// check expectations
+			err = mock.ExpectationsWereMet()
+			assert.NoError(tt, err, name)
+		})
+	}
+}
+
+func TestQueryErrors(t *testing.T) {
+	fingerprint := "SHA256:yARVMVDnP2B2QzTvE8eSs5ZZlkZEoMFEIKjtYv1adfU"
+	var testCases = map[string]struct {
+		queryErr      error
+		expectErr     error
+		expectTimeout bool
+	}{
+		"no rows": {
+			queryErr:  sql.ErrNoRows,
+			expectErr: lagoondb.ErrNoResult,
+		},
+		"deadline exceeded": {
+			queryErr:      context.DeadlineExceeded,
+			expectErr:     lagoondb.ErrQueryTimeout,
+			expectTimeout: true,
+		},
+		"wrapped deadline exceeded": {
+			queryErr: fmt.Errorf("driver: bad connection: %w",
+				context.DeadlineExceeded),
+			expectErr:     lagoondb.ErrQueryTimeout,
+			expectTimeout: true,
+		},
+		"other error": {
+			queryErr: errors.New("connection refused"),
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			mockDB, mock, err := sqlmock.New()
+			assert.NoError(tt, err, name)
+			mock.ExpectQuery(`SELECT user_ssh_key.usid AS uuid`).
+				WithArgs(fingerprint).
+				WillReturnError(tc.queryErr)
+			mock.ExpectExec(`UPDATE ssh_key`).
+				WillReturnError(tc.queryErr)
+			db := lagoondb.NewClientFromDB(mockDB)
+			// the query error is returned directly by UserBySSHFingerprint,
+			// and wrapped again by SSHKeyUsed.
+			_, err = db.UserBySSHFingerprint(context.Background(), fingerprint)
+			assert.Error(tt, err, name)
+			if tc.expectErr != nil {
+				assert.IsError(tt, err, tc.expectErr, name)
+			}
+			err = db.SSHKeyUsed(context.Background(), fingerprint, time.Now())
+			assert.Error(tt, err, name)
+			assert.Contains(tt, err.Error(), "couldn't update last_used", name)
+			if tc.expectErr != nil {
+				assert.IsError(tt, err, tc.expectErr, name)
+			}
+			assert.Equal(tt, tc.expectTimeout,
+				errors.Is(err, context.DeadlineExceeded), name)
+			assert.Equal(tt, tc.expectTimeout,
+				errors.Is(err, lagoondb.ErrQueryTimeout), name)
+			assert.NoError(tt, mock.ExpectationsWereMet(), name)
+		})
+	}
+}
@@ -0,0 +1,181 @@
+// Package listener acquires the listeners used by the SSH servers. The TCP
+// listener may be inherited from the parent process, so that a new process
+// can take over a listening socket without dropping connections during a
+// restart. Connections may also be accepted on a Unix domain socket.
+package listener
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// listenFDsStart is the first file descriptor passed by systemd socket
+// activation. See sd_listen_fds(3).
+const listenFDsStart = 3
+
+type config struct {
+	host      string
+	fd        int
+	reusePort bool
+}
+
+// Option is a functional option for New.
+type Option func(*config)
+
+// Address configures New to bind a new listening socket to the given IP
+// address, rather than to all interfaces. An empty host selects all
+// interfaces. See JoinAddress for the accepted formats.
+func Address(host string) Option {
+	return func(c *config) {
+		c.host = host
+	}
+}
+
+// JoinAddress returns the address to listen on for the given host and port,
+// in the form accepted by net.Listen. The host must be empty, which selects
+// all interfaces, or an IPv4 or IPv6 address literal. IPv6 addresses may be
+// enclosed in brackets, and may include a zone.
+func JoinAddress(host string, port uint) (string, error) {
+	if port > 65535 {
+		return "", fmt.Errorf("invalid port %d: must be at most 65535", port)
+	}
+	if host == "" {
+		return fmt.Sprintf(":%d", port), nil
+	}
+	literal := host
+	if strings.HasPrefix(literal, "[") && strings.HasSuffix(literal, "]") {
+		literal = literal[1 : len(literal)-1]
+		if !strings.Contains(literal, ":") {
+			return "", fmt.Errorf("invalid address %q: only IPv6 addresses "+
+				"may be enclosed in brackets", host)
+		}
+	}
+	addr, err := netip.ParseAddr(literal)
+	if err != nil {
+		if _, _, err := net.SplitHostPort(host); err == nil {
+			return "", fmt.Errorf("invalid address %q: must not include a port",
+				host)
+		}
+		return "", fmt.Errorf("invalid address %q: must be an IPv4 or IPv6 "+
+			"address literal, not a hostname or network", host)
+	}
+	return net.JoinHostPort(addr.String(), strconv.Itoa(int(port))), nil
+}
+
+// FD configures New to use the listening socket inherited from the parent
+// process as the given file descriptor. A negative fd disables this option.
+func FD(fd int) Option {
+	return func(c *config) {
+		c.fd = fd
+	}
+}
+
+// ReusePort configures New to set SO_REUSEPORT on a newly bound listening
+// socket. This allows a new process to bind the same port and start accepting
+// connections before the old process stops. Both processes must enable this
+// option.
+func ReusePort(enabled bool) Option {
+	return func(c *config) {
+		c.reusePort = enabled
+	}
+}
+
+// systemdFD returns the file descriptor passed by systemd socket activation,
+// and true. If no file descriptor was passed to the process with the given
+// pid, it returns false.
+func systemdFD(getenv func(string) string, pid int) (int, bool, error) {
+	if getenv("LISTEN_PID") != strconv.Itoa(pid) {
+		return 0, false, nil
+	}
+	n, err := strconv.Atoi(getenv("LISTEN_FDS"))
+	if err != nil {
+		return 0, false, fmt.Errorf("couldn't parse LISTEN_FDS: %v", err)
+	}
+	switch {
+	case n < 1:
+		return 0, false, nil
+	case n > 1:
+		return 0, false, fmt.Errorf("expected one socket, got LISTEN_FDS=%d", n)
+	}
+	return listenFDsStart, true, nil
+}
+
+// fileListener returns a listener for the listening socket with the given
+// file descriptor. The file descriptor is owned by the returned listener.
+func fileListener(fd int) (net.Listener, error) {
+	accepting, err := unix.GetsockoptInt(fd, unix.SOL_SOCKET,
+		unix.SO_ACCEPTCONN)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't inspect file descriptor %d: %v", fd, err)
+	}
+	if accepting == 0 {
+		return nil, fmt.Errorf("file descriptor %d is not a listening socket", fd)
+	}
+	unix.CloseOnExec(fd)
+	// net.FileListener duplicates the file descriptor, so the original is
+	// closed here.
+	f := os.NewFile(uintptr(fd), "listener")
+	defer f.Close()
+	l, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't use file descriptor %d: %v", fd, err)
+	}
+	return l, nil
+}
+
+// reusePortControl sets SO_REUSEPORT on a socket before it is bound.
+func reusePortControl(_, _ string, rc syscall.RawConn) error {
+	var sockErr error
+	err := rc.Control(func(fd uintptr) {
+		sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET,
+			unix.SO_REUSEPORT, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// New returns a TCP listener. In order of preference, the listener is:
+//
+//   - the socket inherited as the file descriptor given via FD;
+//   - the socket passed by systemd socket activation (LISTEN_FDS); or
+//   - a new socket bound to the given port on the address given via Address,
+//     or on all interfaces, with SO_REUSEPORT set if enabled via ReusePort.
+func New(port uint, opts ...Option) (net.Listener, error) {
+	c := config{fd: -1}
+	for _, opt := range opts {
+		opt(&c)
+	}
+	addr, err := JoinAddress(c.host, port)
+	if err != nil {
+		return nil, err
+	}
+	if c.fd >= 0 {
+		return fileListener(c.fd)
+	}
+	fd, ok, err := systemdFD(os.Getenv, os.Getpid())
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		// don't pass the socket activation variables on to child processes
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+		return fileListener(fd)
+	}
+	var lc net.ListenConfig
+	if c.reusePort {
+		lc.Control = reusePortControl
+	}
+	return lc.Listen(context.Background(), "tcp", addr)
+}
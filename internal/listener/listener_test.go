@@ -0,0 +1,241 @@
+package listener
+
+import (
+	"net"
+	"testing"
+
+	"github.com/alecthomas/assert/v2"
+	"golang.org/x/sys/unix"
+)
+
+// listenerFD returns a duplicate of the file descriptor of l, as it would be
+// inherited by a new process.
+func listenerFD(t *testing.T, l net.Listener) int {
+	t.Helper()
+	f, err := l.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fd, err := unix.Dup(int(f.Fd()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fd
+}
+
+func TestSystemdFD(t *testing.T) {
+	var testCases = map[string]struct {
+		env      map[string]string
+		expectFD int
+		expectOK bool
+		expErr   bool
+	}{
+		"not activated": {},
+		"other process": {
+			env: map[string]string{"LISTEN_PID": "2", "LISTEN_FDS": "1"},
+		},
+		"activated": {
+			env:      map[string]string{"LISTEN_PID": "1", "LISTEN_FDS": "1"},
+			expectFD: 3,
+			expectOK: true,
+		},
+		"no sockets": {
+			env: map[string]string{"LISTEN_PID": "1", "LISTEN_FDS": "0"},
+		},
+		"multiple sockets": {
+			env:    map[string]string{"LISTEN_PID": "1", "LISTEN_FDS": "2"},
+			expErr: true,
+		},
+		"invalid": {
+			env:    map[string]string{"LISTEN_PID": "1", "LISTEN_FDS": "x"},
+			expErr: true,
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			getenv := func(key string) string { return tc.env[key] }
+			fd, ok, err := systemdFD(getenv, 1)
+			if tc.expErr {
+				assert.Error(tt, err, name)
+			} else {
+				assert.NoError(tt, err, name)
+			}
+			assert.Equal(tt, tc.expectFD, fd, name)
+			assert.Equal(tt, tc.expectOK, ok, name)
+		})
+	}
+}
+
+func TestFileListener(t *testing.T) {
+	// inherit a duplicate of a listening socket
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	fl, err := fileListener(listenerFD(t, l))
+	assert.NoError(t, err)
+	defer fl.Close()
+	assert.Equal(t, l.Addr().String(), fl.Addr().String())
+	// connections are accepted on the inherited socket
+	conn, err := net.Dial("tcp", l.Addr().String())
+	assert.NoError(t, err)
+	defer conn.Close()
+	l.Close()
+	accepted, err := fl.Accept()
+	assert.NoError(t, err)
+	assert.NoError(t, accepted.Close())
+}
+
+func TestFileListenerNotListening(t *testing.T) {
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(fds[0])
+	defer unix.Close(fds[1])
+	_, err = fileListener(fds[0])
+	assert.Error(t, err)
+}
+
+func TestFileListenerBadFD(t *testing.T) {
+	_, err := fileListener(1 << 20)
+	assert.Error(t, err)
+}
+
+func TestNew(t *testing.T) {
+	var testCases = map[string]struct {
+		reusePort bool
+		expErr    bool
+	}{
+		"reuse port": {reusePort: true},
+		"no reuse port": {
+			expErr: true,
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			l, err := New(0, ReusePort(tc.reusePort))
+			assert.NoError(tt, err, name)
+			defer l.Close()
+			port := l.Addr().(*net.TCPAddr).Port
+			assert.NotEqual(tt, 0, port, name)
+			// a second process binds the same port during a restart
+			l2, err := New(uint(port), ReusePort(tc.reusePort))
+			if tc.expErr {
+				assert.Error(tt, err, name)
+				return
+			}
+			assert.NoError(tt, err, name)
+			assert.NoError(tt, l2.Close(), name)
+		})
+	}
+}
+
+func TestNewFD(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	// the port is ignored when a file descriptor is given
+	fl, err := New(0, FD(listenerFD(t, l)))
+	assert.NoError(t, err)
+	defer fl.Close()
+	assert.Equal(t, l.Addr().String(), fl.Addr().String())
+}
+
+func TestJoinAddress(t *testing.T) {
+	var testCases = map[string]struct {
+		host   string
+		port   uint
+		expect string
+		expErr bool
+	}{
+		"all interfaces": {
+			port:   2222,
+			expect: ":2222",
+		},
+		"ipv4": {
+			host: "192.0.2.1", port: 2222,
+			expect: "192.0.2.1:2222",
+		},
+		"ipv6": {
+			host: "2001:db8::1", port: 22,
+			expect: "[2001:db8::1]:22",
+		},
+		"bracketed ipv6": {
+			host: "[2001:db8::1]", port: 22,
+			expect: "[2001:db8::1]:22",
+		},
+		"ipv6 loopback": {
+			host: "::1", port: 2222,
+			expect: "[::1]:2222",
+		},
+		"ipv6 unspecified": {
+			host: "[::]", port: 2222,
+			expect: "[::]:2222",
+		},
+		"ipv6 zone": {
+			host: "fe80::1%eth0", port: 22,
+			expect: "[fe80::1%eth0]:22",
+		},
+		"ipv4-mapped ipv6": {
+			host: "::ffff:192.0.2.1", port: 22,
+			expect: "[::ffff:192.0.2.1]:22",
+		},
+		"hostname": {
+			host: "localhost", port: 2222,
+			expErr: true,
+		},
+		"ipv4 with port": {
+			host: "192.0.2.1:2222", port: 2222,
+			expErr: true,
+		},
+		"ipv6 with port": {
+			host: "[2001:db8::1]:22", port: 22,
+			expErr: true,
+		},
+		"bracketed ipv4": {
+			host: "[192.0.2.1]", port: 22,
+			expErr: true,
+		},
+		"unbalanced bracket": {
+			host: "[2001:db8::1", port: 22,
+			expErr: true,
+		},
+		"cidr": {
+			host: "192.0.2.0/24", port: 22,
+			expErr: true,
+		},
+		"truncated ipv4": {
+			host: "192.0.2", port: 22,
+			expErr: true,
+		},
+		"port out of range": {
+			host: "192.0.2.1", port: 65536,
+			expErr: true,
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			addr, err := JoinAddress(tc.host, tc.port)
+			if tc.expErr {
+				assert.Error(tt, err, name)
+				return
+			}
+			assert.NoError(tt, err, name)
+			assert.Equal(tt, tc.expect, addr, name)
+		})
+	}
+}
+
+func TestNewAddress(t *testing.T) {
+	l, err := New(0, Address("127.0.0.1"))
+	assert.NoError(t, err)
+	defer l.Close()
+	assert.True(t, l.Addr().(*net.TCPAddr).IP.IsLoopback())
+	_, err = New(0, Address("localhost"))
+	assert.Error(t, err)
+}
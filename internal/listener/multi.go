@@ -0,0 +1,90 @@
+package listener
+
+import (
+	"errors"
+	"net"
+	"sync"
+)
+
+// acceptResult is the result of a call to Accept on one of the listeners of
+// a multiListener.
+type acceptResult struct {
+	conn net.Conn
+	err  error
+}
+
+// multiListener is a net.Listener which accepts connections from several
+// listeners.
+type multiListener struct {
+	listeners []net.Listener
+	results   chan acceptResult
+	closed    chan struct{}
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// Multi returns a listener which accepts connections from all the given
+// listeners. Closing the returned listener closes all the given listeners.
+// Its address is the address of the first listener.
+func Multi(listeners ...net.Listener) net.Listener {
+	if len(listeners) == 1 {
+		return listeners[0]
+	}
+	m := &multiListener{
+		listeners: listeners,
+		results:   make(chan acceptResult),
+		closed:    make(chan struct{}),
+	}
+	for _, l := range listeners {
+		go m.accept(l)
+	}
+	return m
+}
+
+// accept passes connections accepted by l to Accept until l returns a
+// permanent error, or the multiListener is closed.
+func (m *multiListener) accept(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		select {
+		case m.results <- acceptResult{conn: conn, err: err}:
+		case <-m.closed:
+			if conn != nil {
+				conn.Close()
+			}
+			return
+		}
+		var netErr net.Error
+		if err != nil && !(errors.As(err, &netErr) && netErr.Temporary()) {
+			return
+		}
+	}
+}
+
+// Accept implements net.Listener.
+func (m *multiListener) Accept() (net.Conn, error) {
+	select {
+	case r := <-m.results:
+		return r.conn, r.err
+	case <-m.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close implements net.Listener.
+func (m *multiListener) Close() error {
+	m.closeOnce.Do(func() {
+		close(m.closed)
+		for _, l := range m.listeners {
+			if err := l.Close(); err != nil && m.closeErr == nil {
+				m.closeErr = err
+			}
+		}
+	})
+	return m.closeErr
+}
+
+// Addr implements net.Listener.
+func (m *multiListener) Addr() net.Addr {
+	return m.listeners[0].Addr()
+}
@@ -0,0 +1,55 @@
+package listener
+
+import (
+	"errors"
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/alecthomas/assert/v2"
+)
+
+func TestMulti(t *testing.T) {
+	tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "ssh.sock")
+	unixListener, err := NewUnix(path, 0660)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := Multi(tcpListener, unixListener)
+	assert.Equal(t, tcpListener.Addr(), l.Addr())
+	// connections are accepted from both listeners
+	for network, address := range map[string]string{
+		"tcp":  tcpListener.Addr().String(),
+		"unix": path,
+	} {
+		conn, err := net.Dial(network, address)
+		assert.NoError(t, err, network)
+		accepted, err := l.Accept()
+		assert.NoError(t, err, network)
+		assert.Equal(t, network, accepted.LocalAddr().Network(), network)
+		assert.NoError(t, accepted.Close(), network)
+		assert.NoError(t, conn.Close(), network)
+	}
+	// closing the listener closes both listeners
+	assert.NoError(t, l.Close())
+	_, err = l.Accept()
+	assert.True(t, errors.Is(err, net.ErrClosed))
+	_, err = net.Dial("tcp", tcpListener.Addr().String())
+	assert.Error(t, err)
+	_, err = net.Dial("unix", path)
+	assert.Error(t, err)
+}
+
+func TestMultiSingle(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	// a single listener is returned unwrapped
+	assert.Equal(t, l, Multi(l))
+}
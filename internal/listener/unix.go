@@ -0,0 +1,56 @@
+package listener
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+// staleDialTimeout is the time allowed to connect to an existing socket to
+// check whether it is still in use.
+const staleDialTimeout = time.Second
+
+// removeStaleSocket removes the socket at path if no process is listening on
+// it, such as when a previous process exited without cleaning up. It returns
+// an error if the socket is in use, or if path exists but is not a socket.
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("couldn't stat %s: %v", path, err)
+	}
+	if info.Mode().Type() != os.ModeSocket {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+	conn, err := net.DialTimeout("unix", path, staleDialTimeout)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("socket %s is in use", path)
+	}
+	if err = os.Remove(path); err != nil {
+		return fmt.Errorf("couldn't remove stale socket %s: %v", path, err)
+	}
+	return nil
+}
+
+// NewUnix returns a listener on a new Unix domain socket at the given path,
+// with the given permission bits. A stale socket left at path by a previous
+// process is removed first. The socket is removed when the listener is
+// closed.
+func NewUnix(path string, mode os.FileMode) (net.Listener, error) {
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.Chmod(path, mode); err != nil {
+		l.Close()
+		return nil, fmt.Errorf("couldn't set socket permissions: %v", err)
+	}
+	return l, nil
+}
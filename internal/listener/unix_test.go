@@ -0,0 +1,98 @@
+package listener
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/alecthomas/assert/v2"
+)
+
+func TestNewUnix(t *testing.T) {
+	var testCases = map[string]struct {
+		mode  os.FileMode
+		setup func(*testing.T, string)
+	}{
+		"new socket": {
+			mode: 0660,
+		},
+		"restricted permissions": {
+			mode: 0600,
+		},
+		"stale socket": {
+			mode: 0660,
+			setup: func(tt *testing.T, path string) {
+				// leave a socket behind, as if the process had crashed
+				l, err := net.ListenUnix("unix",
+					&net.UnixAddr{Name: path, Net: "unix"})
+				if err != nil {
+					tt.Fatal(err)
+				}
+				l.SetUnlinkOnClose(false)
+				if err = l.Close(); err != nil {
+					tt.Fatal(err)
+				}
+			},
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			path := filepath.Join(tt.TempDir(), "ssh.sock")
+			if tc.setup != nil {
+				tc.setup(tt, path)
+			}
+			l, err := NewUnix(path, tc.mode)
+			assert.NoError(tt, err, name)
+			info, err := os.Stat(path)
+			assert.NoError(tt, err, name)
+			assert.Equal(tt, os.ModeSocket, info.Mode().Type(), name)
+			assert.Equal(tt, tc.mode, info.Mode().Perm(), name)
+			// connections are accepted on the socket
+			conn, err := net.Dial("unix", path)
+			assert.NoError(tt, err, name)
+			defer conn.Close()
+			accepted, err := l.Accept()
+			assert.NoError(tt, err, name)
+			assert.NoError(tt, accepted.Close(), name)
+			// the socket is removed on close
+			assert.NoError(tt, l.Close(), name)
+			_, err = os.Stat(path)
+			assert.True(tt, os.IsNotExist(err), name)
+		})
+	}
+}
+
+func TestNewUnixError(t *testing.T) {
+	var testCases = map[string]struct {
+		setup func(*testing.T, string)
+	}{
+		"socket in use": {
+			setup: func(tt *testing.T, path string) {
+				l, err := net.Listen("unix", path)
+				if err != nil {
+					tt.Fatal(err)
+				}
+				tt.Cleanup(func() { l.Close() })
+			},
+		},
+		"not a socket": {
+			setup: func(tt *testing.T, path string) {
+				if err := os.WriteFile(path, nil, 0600); err != nil {
+					tt.Fatal(err)
+				}
+			},
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			path := filepath.Join(tt.TempDir(), "ssh.sock")
+			tc.setup(tt, path)
+			_, err := NewUnix(path, 0660)
+			assert.Error(tt, err, name)
+			// the existing file is left in place
+			_, err = os.Lstat(path)
+			assert.NoError(tt, err, name)
+		})
+	}
+}
@@ -0,0 +1,243 @@
+// Package messages implements a catalog of the user-facing messages printed
+// by the SSH servers, which operators may override.
+package messages
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/uselagoon/ssh-portal/internal/sessionio"
+	"gopkg.in/yaml.v3"
+)
+
+// Key identifies a message in the catalog. It is also the key of the message
+// in an override file.
+type Key string
+
+// Messages printed by ssh-portal.
+const (
+	AccessDenied          Key = "access-denied"
+	CapabilityMissing     Key = "capability-missing"
+	ClusterError          Key = "cluster-error"
+	CommandTooLong        Key = "command-too-long"
+	ConfirmProduction     Key = "confirm-production"
+	DebugUnsupported      Key = "debug-unsupported"
+	EnvironmentDeleted    Key = "environment-deleted"
+	ExecError             Key = "exec-error"
+	InvalidContainer      Key = "invalid-container"
+	InvalidService        Key = "invalid-service"
+	LogsOnly              Key = "logs-only"
+	MisquotedShell        Key = "misquoted-shell"
+	OldClient             Key = "old-client"
+	ReauthFailed          Key = "reauth-failed"
+	Rejected              Key = "rejected"
+	ServerShutdown        Key = "server-shutdown"
+	ServiceAccessDisabled Key = "service-access-disabled"
+	SessionKindDisabled   Key = "session-kind-disabled"
+	SFTPServerMissing     Key = "sftp-server-missing"
+	TimeLimitReached      Key = "time-limit-reached"
+	TimeLimitWarning      Key = "time-limit-warning"
+	UnknownService        Key = "unknown-service"
+)
+
+// Messages printed by ssh-token.
+const (
+	EnvironmentsMore          Key = "environments-more"
+	InternalError             Key = "internal-error"
+	InvalidCommand            Key = "invalid-command"
+	NoShellAccess             Key = "no-shell-access"
+	PlatformOwnerEnvironments Key = "platform-owner-environments"
+	Redirect                  Key = "redirect"
+	UnknownEnvironment        Key = "unknown-environment"
+	UnsupportedCommand        Key = "unsupported-command"
+	Whoami                    Key = "whoami"
+)
+
+// defaults contains the default template of each message. Newlines are
+// converted to CRLF when the message is formatted.
+var defaults = map[Key]string{
+	AccessDenied: "access denied. SID: {{.SessionID}}\n",
+	CapabilityMissing: "this key doesn't permit {{.Kind}} access. " +
+		"SID: {{.SessionID}}\n",
+	ClusterError: "temporary error talking to the cluster, please retry. " +
+		"SID: {{.SessionID}}\n",
+	CommandTooLong: "command longer than the maximum of {{.Detail}} bytes. " +
+		"SID: {{.SessionID}}\n",
+	ConfirmProduction: "you are about to access the PRODUCTION environment " +
+		"{{.Environment}} of project {{.Project}}.\ntype yes to continue: ",
+	DebugUnsupported: "debug sessions are not supported by this cluster. " +
+		"SID: {{.SessionID}}\n",
+	EnvironmentDeleted: "this environment has been deleted or is being " +
+		"removed. SID: {{.SessionID}}\n",
+	ExecError: "error executing command. SID: {{.SessionID}}\n",
+	InvalidContainer: "invalid container name {{.Container}}. " +
+		"SID: {{.SessionID}}\n",
+	InvalidService: "invalid service name {{.Service}}. " +
+		"SID: {{.SessionID}}\n",
+	LogsOnly: "this key only permits logs access, not {{.Kind}} access " +
+		"(e.g. service=nginx logs=tailLines=100). SID: {{.SessionID}}\n",
+	MisquotedShell: "{{.Detail}}\n",
+	OldClient: "warning: your SSH client is older than OpenSSH " +
+		"{{.Detail}} and may not display terminals correctly. " +
+		"Please upgrade it.\n",
+	ReauthFailed: "temporary error checking access, please retry. " +
+		"SID: {{.SessionID}}\n",
+	Rejected: "{{.Detail}}. SID: {{.SessionID}}\n",
+	ServerShutdown: "\nconnection closed by server (shutting down). " +
+		"SID: {{.SessionID}}\n",
+	ServiceAccessDisabled: "{{.Kind}} access to service {{.Service}} is " +
+		"disabled. SID: {{.SessionID}}\n",
+	SessionKindDisabled: "{{.Kind}} access is disabled on this SSH portal. " +
+		"SID: {{.SessionID}}\n",
+	SFTPServerMissing: "sftp-server not installed in service {{.Service}} " +
+		"container {{.Container}}. SID: {{.SessionID}}\n",
+	TimeLimitReached: "\nmaximum session time reached. SID: {{.SessionID}}\n",
+	TimeLimitWarning: "\nwarning: maximum session time will be reached in " +
+		"{{.Lead}}\n",
+	UnknownService: "unknown service {{.Service}}.{{with .Suggestion}} " +
+		"did you mean '{{.}}'?{{end}} SID: {{.SessionID}}\n",
+	EnvironmentsMore: "Showing environments {{.First}}-{{.Last}} of " +
+		"{{.Total}}. Use --offset={{.Last}} to see more.\n",
+	InternalError:  "internal error. SID: {{.SessionID}}\n",
+	InvalidCommand: "invalid command: {{.Detail}}. SID: {{.SessionID}}\n",
+	NoShellAccess: "This SSH server does not provide shell access. " +
+		"SID: {{.SessionID}}\n",
+	PlatformOwnerEnvironments: "The platform-owner role can SSH to all " +
+		"environments.\n",
+	Redirect: "This SSH server does not provide shell access to your " +
+		"environment.\nTo SSH into your environment use this endpoint:\n\n" +
+		"\t{{.Endpoint}}\n\nSID: {{.SessionID}}\n",
+	UnknownEnvironment: "Unknown environment {{printf \"%q\" .Namespace}}. " +
+		"Check the username in your SSH command. SID: {{.SessionID}}\n",
+	UnsupportedCommand: "invalid command: only \"grant\", \"token\", " +
+		"\"whoami\", and \"environments\" are supported. SID: {{.SessionID}}\n",
+	Whoami: "user UUID: {{.UserUUID}}\nemail: {{.Email}}\n" +
+		"SSH fingerprint: {{.SSHFingerprint}}\n",
+}
+
+// defaultTemplates contains the parsed default templates.
+var defaultTemplates = parseDefaults()
+
+// Vars contains the values which may be used in message templates. Each
+// message uses only the values relevant to it. For example, most messages use
+// SessionID, while Endpoint is only used by Redirect.
+type Vars struct {
+	SessionID      string
+	Detail         string
+	Kind           string
+	Service        string
+	Container      string
+	Suggestion     string
+	Project        string
+	Environment    string
+	Namespace      string
+	Endpoint       string
+	UserUUID       string
+	Email          string
+	SSHFingerprint string
+	Lead           time.Duration
+	First          int
+	Last           int
+	Total          int
+}
+
+// Catalog contains the templates of the user-facing messages. A nil *Catalog
+// formats the default messages.
+type Catalog struct {
+	templates map[Key]*template.Template
+}
+
+// parseDefaults parses the default templates. It panics if any default
+// template is invalid.
+func parseDefaults() map[Key]*template.Template {
+	templates := map[Key]*template.Template{}
+	for key, text := range defaults {
+		templates[key] = template.Must(template.New(string(key)).Parse(text))
+	}
+	return templates
+}
+
+// parse parses the given template text, and validates it by formatting it
+// with empty Vars.
+func parse(key Key, text string) (*template.Template, error) {
+	tmpl, err := template.New(string(key)).Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	if err = tmpl.Execute(io.Discard, Vars{}); err != nil {
+		return nil, err
+	}
+	return tmpl, nil
+}
+
+// Load reads message overrides from the YAML file at the given path, and
+// returns a Catalog containing the overrides and the defaults of any messages
+// which are not overridden. The file contains a map of message keys to
+// templates. Unknown keys are logged and ignored. An error is returned if the
+// file can't be read or contains an invalid template.
+func Load(log *slog.Logger, path string) (*Catalog, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read messages file: %v", err)
+	}
+	var overrides map[string]string
+	if err = yaml.Unmarshal(data, &overrides); err != nil {
+		return nil, fmt.Errorf("couldn't parse messages file: %v", err)
+	}
+	var unknown []string
+	c := Catalog{templates: map[Key]*template.Template{}}
+	for key, text := range overrides {
+		if _, ok := defaults[Key(key)]; !ok {
+			unknown = append(unknown, key)
+			continue
+		}
+		tmpl, err := parse(Key(key), text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid message %s: %v", key, err)
+		}
+		c.templates[Key(key)] = tmpl
+	}
+	if len(unknown) > 0 {
+		slices.Sort(unknown)
+		log.Warn("ignoring unknown keys in messages file",
+			slog.String("path", path),
+			slog.Any("keys", unknown))
+	}
+	return &c, nil
+}
+
+// Format returns the message identified by key, formatted with the given
+// vars. Line endings in the message are converted to CRLF, since messages
+// may be written to a terminal in raw mode.
+func (c *Catalog) Format(key Key, vars Vars) string {
+	tmpl := defaultTemplates[key]
+	if c != nil && c.templates[key] != nil {
+		tmpl = c.templates[key]
+	}
+	var b strings.Builder
+	if err := tmpl.Execute(&b, vars); err != nil {
+		// overrides are validated on load, so this shouldn't happen
+		b.Reset()
+		_ = defaultTemplates[key].Execute(&b, vars)
+	}
+	return strings.ReplaceAll(
+		strings.ReplaceAll(b.String(), "\r\n", "\n"), "\n", "\r\n")
+}
+
+// Fprint formats the message identified by key with the given vars, and
+// writes it to w using sessionio.Fprint.
+func (c *Catalog) Fprint(
+	ctx context.Context,
+	w io.Writer,
+	key Key,
+	vars Vars,
+) (int, error) {
+	return sessionio.Fprint(ctx, w, c.Format(key, vars))
+}
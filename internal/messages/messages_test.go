@@ -0,0 +1,182 @@
+package messages_test
+
+import (
+	"bytes"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/assert/v2"
+	"github.com/uselagoon/ssh-portal/internal/messages"
+)
+
+func TestDefaults(t *testing.T) {
+	var testCases = map[string]struct {
+		key    messages.Key
+		vars   messages.Vars
+		expect string
+	}{
+		"session ID": {
+			key:    messages.ExecError,
+			vars:   messages.Vars{SessionID: "abc123"},
+			expect: "error executing command. SID: abc123\r\n",
+		},
+		"multiple lines": {
+			key: messages.Whoami,
+			vars: messages.Vars{
+				UserUUID:       "8b1c5c9d-0d9c-4f5a-9d6e-4a3f0c6b1e2a",
+				Email:          "user@example.com",
+				SSHFingerprint: "SHA256:abc",
+			},
+			expect: "user UUID: 8b1c5c9d-0d9c-4f5a-9d6e-4a3f0c6b1e2a\r\n" +
+				"email: user@example.com\r\nSSH fingerprint: SHA256:abc\r\n",
+		},
+		"quoted": {
+			key:  messages.UnknownEnvironment,
+			vars: messages.Vars{Namespace: "project-tset", SessionID: "abc123"},
+			expect: `Unknown environment "project-tset". Check the ` +
+				"username in your SSH command. SID: abc123\r\n",
+		},
+		"suggestion": {
+			key: messages.UnknownService,
+			vars: messages.Vars{
+				Service:    "ngnix",
+				Suggestion: "nginx",
+				SessionID:  "abc123",
+			},
+			expect: "unknown service ngnix. did you mean 'nginx'? " +
+				"SID: abc123\r\n",
+		},
+		"duration": {
+			key:  messages.TimeLimitWarning,
+			vars: messages.Vars{Lead: time.Minute},
+			expect: "\r\nwarning: maximum session time will be reached in " +
+				"1m0s\r\n",
+		},
+		"line endings in vars": {
+			key: messages.Rejected,
+			vars: messages.Vars{
+				Detail:    "\r\ntimed out waiting for confirmation",
+				SessionID: "abc123",
+			},
+			expect: "\r\ntimed out waiting for confirmation. SID: abc123\r\n",
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			// a nil catalog formats the default messages
+			var c *messages.Catalog
+			assert.Equal(tt, tc.expect, c.Format(tc.key, tc.vars), name)
+		})
+	}
+}
+
+func writeFile(t *testing.T, data string) string {
+	path := filepath.Join(t.TempDir(), "messages.yaml")
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoad(t *testing.T) {
+	var logs bytes.Buffer
+	log := slog.New(slog.NewJSONHandler(&logs, nil))
+	path := writeFile(t, `
+no-shell-access: |
+  Shell access is provided by ssh.example.com. SID: {{.SessionID}}
+redirect: "Please use {{.Endpoint}} instead."
+not-a-message: ignored
+`)
+	c, err := messages.Load(log, path)
+	assert.NoError(t, err)
+	vars := messages.Vars{SessionID: "abc123", Endpoint: "ssh -p 32222 x@y"}
+	// overridden messages
+	assert.Equal(t,
+		"Shell access is provided by ssh.example.com. SID: abc123\r\n",
+		c.Format(messages.NoShellAccess, vars))
+	assert.Equal(t, "Please use ssh -p 32222 x@y instead.",
+		c.Format(messages.Redirect, vars))
+	// missing keys fall back to the defaults
+	assert.Equal(t, "internal error. SID: abc123\r\n",
+		c.Format(messages.InternalError, vars))
+	// unknown keys are logged
+	assert.Contains(t, logs.String(), "ignoring unknown keys")
+	assert.Contains(t, logs.String(), "not-a-message")
+}
+
+func TestLoadInvalid(t *testing.T) {
+	log := slog.New(slog.NewJSONHandler(os.Stderr, nil))
+	var testCases = map[string]struct {
+		data string
+	}{
+		"not yaml":          {data: "- [unterminated"},
+		"not a map":         {data: "- access-denied"},
+		"invalid template":  {data: "access-denied: '{{.SessionID'"},
+		"unknown variable":  {data: "access-denied: '{{.Password}}'"},
+		"not a string":      {data: "access-denied: {nested: map}"},
+		"unknown function":  {data: "access-denied: '{{exec .SessionID}}'"},
+		"template in error": {data: "exec-error: '{{template \"x\"}}'"},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			_, err := messages.Load(log, writeFile(tt, tc.data))
+			assert.Error(tt, err, name)
+		})
+	}
+	_, err := messages.Load(log, filepath.Join(t.TempDir(), "missing.yaml"))
+	assert.Error(t, err)
+}
+
+// TestCallSites checks that the SSH servers print user-facing messages only
+// via the catalog. The only format strings allowed in direct writes to
+// session streams are those which print data, such as tokens.
+func TestCallSites(t *testing.T) {
+	for _, dir := range []string{"../sshserver", "../sshtoken"} {
+		paths, err := filepath.Glob(filepath.Join(dir, "*.go"))
+		assert.NoError(t, err)
+		for _, path := range paths {
+			if strings.HasSuffix(path, "_test.go") {
+				continue
+			}
+			fset := token.NewFileSet()
+			f, err := parser.ParseFile(fset, path, nil, 0)
+			assert.NoError(t, err)
+			ast.Inspect(f, func(n ast.Node) bool {
+				call, ok := n.(*ast.CallExpr)
+				if !ok {
+					return true
+				}
+				sel, ok := call.Fun.(*ast.SelectorExpr)
+				if !ok {
+					return true
+				}
+				pkg, ok := sel.X.(*ast.Ident)
+				if !ok || pkg.Name != "sessionio" ||
+					!strings.HasPrefix(sel.Sel.Name, "Fprint") {
+					return true
+				}
+				for _, arg := range call.Args {
+					lit, ok := arg.(*ast.BasicLit)
+					if !ok || lit.Kind != token.STRING {
+						continue
+					}
+					value, err := strconv.Unquote(lit.Value)
+					assert.NoError(t, err)
+					if value != "%s\r\n" {
+						t.Errorf("%s: message not in catalog: %s",
+							fset.Position(lit.Pos()), lit.Value)
+					}
+				}
+				return true
+			})
+		}
+	}
+}
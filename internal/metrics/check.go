@@ -0,0 +1,143 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"slices"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// maxSyntheticLabels is the largest number of variable labels tried when
+// creating a synthetic child of a metric vector.
+const maxSyntheticLabels = 8
+
+// syntheticLabelValue is the value of every label of a synthetic child of a
+// metric vector.
+const syntheticLabelValue = "synthetic"
+
+// Family identifies an exported metric family.
+type Family struct {
+	Name string
+	Type dto.MetricType
+}
+
+// String implements fmt.Stringer.
+func (f Family) String() string {
+	return fmt.Sprintf("%s (%s)", f.Name, f.Type)
+}
+
+// labelledChild returns a child of a metric vector with every label set to
+// syntheticLabelValue. The number of labels of the vector is not exposed, so
+// each number is tried in turn.
+func labelledChild[T any](get func(...string) (T, error)) (T, error) {
+	var lastErr error
+	values := []string{}
+	for range maxSyntheticLabels + 1 {
+		child, err := get(values...)
+		if err == nil {
+			return child, nil
+		}
+		lastErr = err
+		values = append(values, syntheticLabelValue)
+	}
+	var zero T
+	return zero, lastErr
+}
+
+// synthesize generates a synthetic observation for the given collector. Metric
+// vectors gain a child with synthetic label values, so that they are
+// exported. Observations are all zero, so counter and gauge values are not
+// changed.
+func synthesize(c prometheus.Collector) error {
+	switch m := c.(type) {
+	case *prometheus.CounterVec:
+		child, err := labelledChild(m.GetMetricWithLabelValues)
+		if err != nil {
+			return err
+		}
+		child.Add(0)
+	case *prometheus.GaugeVec:
+		child, err := labelledChild(m.GetMetricWithLabelValues)
+		if err != nil {
+			return err
+		}
+		child.Add(0)
+	case *prometheus.HistogramVec:
+		child, err := labelledChild(m.GetMetricWithLabelValues)
+		if err != nil {
+			return err
+		}
+		child.Observe(0)
+	case *prometheus.SummaryVec:
+		child, err := labelledChild(m.GetMetricWithLabelValues)
+		if err != nil {
+			return err
+		}
+		child.Observe(0)
+	case prometheus.Gauge:
+		m.Add(0)
+	case prometheus.Counter:
+		// gauges also implement Counter, so this case must follow Gauge
+		m.Add(0)
+	case prometheus.Observer:
+		m.Observe(0)
+	default:
+		return fmt.Errorf("unsupported collector type %T", c)
+	}
+	return nil
+}
+
+// Synthesize generates a synthetic observation for each of the given
+// collectors so that every one of them is exported, and returns the metric
+// families which they export.
+func Synthesize(cs ...prometheus.Collector) ([]Family, error) {
+	// gather the families from a private registry, so that metrics from
+	// other collectors registered alongside cs are ignored.
+	reg := prometheus.NewPedanticRegistry()
+	for _, c := range cs {
+		if err := synthesize(c); err != nil {
+			return nil, fmt.Errorf("couldn't synthesize observation: %v", err)
+		}
+		if err := reg.Register(c); err != nil {
+			return nil, fmt.Errorf("couldn't register collector: %v", err)
+		}
+	}
+	mfs, err := reg.Gather()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't gather metrics: %v", err)
+	}
+	families := make([]Family, 0, len(mfs))
+	for _, mf := range mfs {
+		families = append(families,
+			Family{Name: mf.GetName(), Type: mf.GetType()})
+	}
+	return families, nil
+}
+
+// Verify parses the metrics in the Prometheus text exposition format read
+// from r, and checks that each of the expected families is present with the
+// expected type. It returns a sorted list of the families which are missing
+// or have the wrong type.
+func Verify(r io.Reader, expected []Family) ([]string, error) {
+	var parser expfmt.TextParser
+	mfs, err := parser.TextToMetricFamilies(r)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse metrics: %v", err)
+	}
+	var missing []string
+	for _, f := range expected {
+		mf, ok := mfs[f.Name]
+		switch {
+		case !ok:
+			missing = append(missing, f.String())
+		case mf.GetType() != f.Type:
+			missing = append(missing,
+				fmt.Sprintf("%s, got type %s", f, mf.GetType()))
+		}
+	}
+	slices.Sort(missing)
+	return missing, nil
+}
@@ -0,0 +1,134 @@
+package metrics_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/alecthomas/assert/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/uselagoon/ssh-portal/internal/metrics"
+)
+
+// scrape serves the metrics in reg over HTTP, and returns the response body.
+func scrape(t *testing.T, reg *prometheus.Registry) io.ReadCloser {
+	srv := httptest.NewServer(promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
+	t.Cleanup(srv.Close)
+	res, err := http.Get(srv.URL)
+	assert.NoError(t, err)
+	t.Cleanup(func() { res.Body.Close() })
+	return res.Body
+}
+
+// testCollectors returns one collector of each supported type.
+func testCollectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		prometheus.NewCounter(prometheus.CounterOpts{Name: "test_total"}),
+		prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "test_labelled_total",
+		}, []string{"a", "b"}),
+		prometheus.NewGauge(prometheus.GaugeOpts{Name: "test_gauge"}),
+		prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "test_labelled_gauge",
+		}, []string{"a"}),
+		prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name: "test_seconds",
+		}),
+		prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name: "test_labelled_seconds",
+		}, []string{"a", "b", "c"}),
+		prometheus.NewSummaryVec(prometheus.SummaryOpts{
+			Name: "test_labelled_summary",
+		}, []string{"a"}),
+	}
+}
+
+func TestSynthesize(t *testing.T) {
+	collectors := testCollectors()
+	families, err := metrics.Synthesize(collectors...)
+	assert.NoError(t, err)
+	assert.Equal(t, []metrics.Family{
+		{Name: "test_gauge", Type: dto.MetricType_GAUGE},
+		{Name: "test_labelled_gauge", Type: dto.MetricType_GAUGE},
+		{Name: "test_labelled_seconds", Type: dto.MetricType_HISTOGRAM},
+		{Name: "test_labelled_summary", Type: dto.MetricType_SUMMARY},
+		{Name: "test_labelled_total", Type: dto.MetricType_COUNTER},
+		{Name: "test_seconds", Type: dto.MetricType_HISTOGRAM},
+		{Name: "test_total", Type: dto.MetricType_COUNTER},
+	}, families)
+	// the synthesized metrics are exported by the registry they are
+	// registered with
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(collectors...)
+	missing, err := metrics.Verify(scrape(t, reg), families)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(missing))
+}
+
+func TestSynthesizeUnsupported(t *testing.T) {
+	_, err := metrics.Synthesize(prometheus.NewGoCollector())
+	assert.Error(t, err)
+}
+
+func TestVerify(t *testing.T) {
+	var testCases = map[string]struct {
+		expected      []metrics.Family
+		expectMissing []string
+	}{
+		"all present": {
+			expected: []metrics.Family{
+				{Name: "test_total", Type: dto.MetricType_COUNTER},
+				{Name: "test_gauge", Type: dto.MetricType_GAUGE},
+			},
+		},
+		"missing": {
+			expected: []metrics.Family{
+				{Name: "test_total", Type: dto.MetricType_COUNTER},
+				{Name: "test_unknown", Type: dto.MetricType_GAUGE},
+				{Name: "test_absent_total", Type: dto.MetricType_COUNTER},
+			},
+			expectMissing: []string{
+				"test_absent_total (COUNTER)",
+				"test_unknown (GAUGE)",
+			},
+		},
+		"wrong type": {
+			expected: []metrics.Family{
+				{Name: "test_gauge", Type: dto.MetricType_COUNTER},
+			},
+			expectMissing: []string{
+				"test_gauge (COUNTER), got type GAUGE",
+			},
+		},
+		"unobserved vector": {
+			expected: []metrics.Family{
+				{Name: "test_labelled_total", Type: dto.MetricType_COUNTER},
+			},
+			expectMissing: []string{
+				"test_labelled_total (COUNTER)",
+			},
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			reg := prometheus.NewRegistry()
+			reg.MustRegister(
+				prometheus.NewCounter(prometheus.CounterOpts{
+					Name: "test_total",
+				}),
+				prometheus.NewGauge(prometheus.GaugeOpts{
+					Name: "test_gauge",
+				}),
+				prometheus.NewCounterVec(prometheus.CounterOpts{
+					Name: "test_labelled_total",
+				}, []string{"a"}),
+			)
+			missing, err := metrics.Verify(scrape(tt, reg), tc.expected)
+			assert.NoError(tt, err, name)
+			assert.Equal(tt, tc.expectMissing, missing, name)
+		})
+	}
+}
@@ -1,10 +1,18 @@
 // Package metrics implements the prometheus metrics server.
+//
+// The metrics of other packages are created by their NewMetrics functions,
+// which register them with the given prometheus.Registerer. Commands pass
+// prometheus.DefaultRegisterer, whose metrics this server exports, and tests
+// pass a fresh prometheus.NewRegistry() to keep their metrics isolated. A nil
+// Registerer leaves the metrics unregistered.
 package metrics
 
 import (
 	"context"
 	"fmt"
+	"net"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -16,15 +24,34 @@ const (
 	metricsShutdownTimeout = 2 * time.Second
 )
 
-// Serve runs a prometheus metrics server in goroutines managed by eg. It will
-// gracefully exit with a two second timeout.
+// ValidateAddress returns an error if address is not a valid listen address
+// for the metrics server, of the form [host]:port.
+func ValidateAddress(address string) error {
+	_, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return fmt.Errorf("couldn't parse address: %v", err)
+	}
+	if n, err := strconv.ParseUint(port, 10, 16); err != nil || n == 0 {
+		return fmt.Errorf("invalid port %q", port)
+	}
+	return nil
+}
+
+// Serve runs a prometheus metrics server listening on address in goroutines
+// managed by eg. It will gracefully exit with a two second timeout.
 // Callers should Wait() on eg before exiting.
-func Serve(ctx context.Context, eg *errgroup.Group, metricsPort string) {
+//
+// If address is empty the metrics server is disabled, and Serve does nothing.
+// Metrics may still be registered and recorded, but they aren't exported.
+func Serve(ctx context.Context, eg *errgroup.Group, address string) {
+	if address == "" {
+		return
+	}
 	// configure metrics server
 	mux := http.NewServeMux()
 	mux.Handle("/metrics", promhttp.Handler())
 	metricsSrv := http.Server{
-		Addr:         metricsPort,
+		Addr:         address,
 		ReadTimeout:  metricsReadTimeout,
 		WriteTimeout: metricsReadTimeout,
 		Handler:      mux,
@@ -0,0 +1,44 @@
+package metrics_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/alecthomas/assert/v2"
+	"github.com/uselagoon/ssh-portal/internal/metrics"
+	"golang.org/x/sync/errgroup"
+)
+
+func TestValidateAddress(t *testing.T) {
+	var testCases = map[string]struct {
+		address     string
+		expectError bool
+	}{
+		"port only":     {address: ":9912"},
+		"host and port": {address: "127.0.0.1:9912"},
+		"ipv6":          {address: "[::1]:9912"},
+		"empty":         {address: "", expectError: true},
+		"no colon":      {address: "9912", expectError: true},
+		"no port":       {address: "localhost:", expectError: true},
+		"named port":    {address: ":http", expectError: true},
+		"zero port":     {address: ":0", expectError: true},
+		"large port":    {address: ":65536", expectError: true},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			err := metrics.ValidateAddress(tc.address)
+			if tc.expectError {
+				assert.Error(tt, err, name)
+			} else {
+				assert.NoError(tt, err, name)
+			}
+		})
+	}
+}
+
+func TestServeDisabled(t *testing.T) {
+	// the context is never cancelled, so Wait would block if a server started
+	var eg errgroup.Group
+	metrics.Serve(context.Background(), &eg, "")
+	assert.NoError(t, eg.Wait())
+}
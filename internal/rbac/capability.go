@@ -0,0 +1,101 @@
+package rbac
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/google/uuid"
+)
+
+// Capability is the level of SSH access granted to a user who is permitted
+// to SSH to an environment.
+type Capability int
+
+const (
+	// FullAccess permits shells, commands, sftp, and logs.
+	FullAccess Capability = iota
+	// LogsOnly permits only logs sessions.
+	LogsOnly
+	// ExecOnly permits shells, commands, and sftp, but not logs.
+	ExecOnly
+)
+
+var capabilityNames = map[Capability]string{
+	FullAccess: "full",
+	LogsOnly:   "logs-only",
+	ExecOnly:   "exec-only",
+}
+
+// SessionKind is a kind of SSH session which a Capability may permit.
+type SessionKind string
+
+// Session kinds. Exec sessions include shells, commands, and debug sessions.
+const (
+	SessionExec SessionKind = "exec"
+	SessionLogs SessionKind = "logs"
+	SessionSFTP SessionKind = "sftp"
+)
+
+var capabilityKinds = map[Capability][]SessionKind{
+	FullAccess: {SessionExec, SessionLogs, SessionSFTP},
+	LogsOnly:   {SessionLogs},
+	ExecOnly:   {SessionExec, SessionSFTP},
+}
+
+// String implements fmt.Stringer.
+func (c Capability) String() string {
+	if name, ok := capabilityNames[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("Capability(%d)", int(c))
+}
+
+// Permits returns true if c permits sessions of the given kind. Unknown
+// capabilities permit no sessions.
+func (c Capability) Permits(kind SessionKind) bool {
+	return slices.Contains(capabilityKinds[c], kind)
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (c Capability) MarshalText() ([]byte, error) {
+	if _, ok := capabilityNames[c]; !ok {
+		return nil, fmt.Errorf("invalid capability: %d", int(c))
+	}
+	return []byte(c.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (c *Capability) UnmarshalText(text []byte) error {
+	capability, err := ParseCapability(string(text))
+	if err != nil {
+		return err
+	}
+	*c = capability
+	return nil
+}
+
+// ParseCapability returns the Capability with the given name.
+func ParseCapability(name string) (Capability, error) {
+	for c, n := range capabilityNames {
+		if n == name {
+			return c, nil
+		}
+	}
+	return FullAccess, fmt.Errorf("invalid capability: %s", name)
+}
+
+// ReasonUserNotInKeycloak is the Decision Reason given when the user who owns
+// the SSH key doesn't exist in Keycloak.
+const ReasonUserNotInKeycloak = "user-not-in-keycloak"
+
+// Decision is the result of an SSH permission check. Capability is only
+// meaningful if Allowed is true. Reason may explain why access was not
+// allowed, and is otherwise empty. Group is the ID of the project group or
+// ancestor group whose membership allowed access, and is the zero UUID if
+// access was not allowed or was allowed by a realm role.
+type Decision struct {
+	Allowed    bool
+	Capability Capability
+	Reason     string
+	Group      uuid.UUID
+}
@@ -38,6 +38,27 @@ type KeycloakService interface {
 	UserRolesAndGroups(context.Context, uuid.UUID) ([]string, []string, error)
 }
 
+// ChildGroupService is optionally implemented by a KeycloakService which can
+// report, without querying Keycloak, whether any of the given groups may have
+// child groups other than role subgroups.
+type ChildGroupService interface {
+	HasChildGroups(context.Context, []uuid.UUID) bool
+}
+
+// HasChildGroups returns the result of k.HasChildGroups if k implements
+// ChildGroupService. Otherwise it returns true, since any of the groups may
+// have child groups.
+func HasChildGroups(
+	ctx context.Context,
+	k KeycloakService,
+	groupIDs []uuid.UUID,
+) bool {
+	if cgs, ok := k.(ChildGroupService); ok {
+		return cgs.HasChildGroups(ctx, groupIDs)
+	}
+	return true
+}
+
 // LagoonDBService provides methods for querying the Lagoon API DB.
 type LagoonDBService interface {
 	ProjectGroupIDs(context.Context, int) ([]uuid.UUID, error)
@@ -49,6 +70,9 @@ type Permission struct {
 	keycloak          KeycloakService
 	lagoonDB          LagoonDBService
 	envTypeRoleCanSSH map[lagoon.EnvironmentType]map[lagoon.UserRole]bool
+	logsOnlyRoles     map[lagoon.UserRole]bool
+	execOnlyRoles     map[lagoon.UserRole]bool
+	noAncestorGroups  bool
 }
 
 // Option performs optional configuration on Permission objects during
@@ -74,6 +98,44 @@ func BlockDeveloperSSH() Option {
 	}
 }
 
+// LogsOnlySSH configures the Permission object returned by NewPermission() to
+// grant logs-only SSH access to the given roles. This applies to any
+// environment type where the role would not otherwise be permitted to SSH. It
+// does not reduce the access of roles which have full SSH access.
+func LogsOnlySSH(roles ...lagoon.UserRole) Option {
+	return func(p *Permission) {
+		p.logsOnlyRoles = map[lagoon.UserRole]bool{}
+		for _, role := range roles {
+			p.logsOnlyRoles[role] = true
+		}
+	}
+}
+
+// ExecOnlySSH configures the Permission object returned by NewPermission() to
+// grant exec-only SSH access to the given roles. This applies to any
+// environment type where the role would not otherwise be permitted to SSH. It
+// does not reduce the access of roles which have full SSH access, and takes
+// precedence over logs-only SSH access.
+func ExecOnlySSH(roles ...lagoon.UserRole) Option {
+	return func(p *Permission) {
+		p.execOnlyRoles = map[lagoon.UserRole]bool{}
+		for _, role := range roles {
+			p.execOnlyRoles[role] = true
+		}
+	}
+}
+
+// DisableAncestorGroups configures the Permission object returned by
+// NewPermission() to consider only the groups a project is directly in when
+// calculating permissions, and not their ancestor groups. This avoids
+// querying Keycloak for ancestor groups on installations which don't use
+// nested groups.
+func DisableAncestorGroups() Option {
+	return func(p *Permission) {
+		p.noAncestorGroups = true
+	}
+}
+
 // NewPermission applies the given Options and returns a new Permission object.
 func NewPermission(
 	k KeycloakService,
@@ -2,42 +2,60 @@ package rbac
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
 
 	"github.com/google/uuid"
+	"github.com/uselagoon/ssh-portal/internal/keycloak"
 	"github.com/uselagoon/ssh-portal/internal/lagoon"
 	"go.opentelemetry.io/otel"
 )
 
 const pkgName = "github.com/uselagoon/ssh-portal/internal/rbac"
 
-// calculateUserCanSSHToEnvironment takes a slice of project Group IDs
-// (the direct project group as well as any ancestor groups), a map of user
-// group IDs to Lagoon user roles, and a map of user roles to access
-// permissions.
-// This function returns true if the user is a member of any of the given
-// project groups, with a role that permits SSH access, and false otherwise.
-func calculateUserCanSSHToEnvironment(
+// calculateUserSSHAccess takes a slice of project Group IDs (the direct
+// project group as well as any ancestor groups), a map of user group IDs to
+// Lagoon user roles, a map of user roles to SSH access permissions, and maps
+// of user roles to exec-only and logs-only SSH access permissions.
+// This function returns a Decision allowing full access if the user is a
+// member of any of the given project groups with a role that permits SSH
+// access. Otherwise it allows exec-only access if the user is a member of any
+// of the given project groups with a role that permits exec-only access, and
+// otherwise logs-only access in the same way. Otherwise access is not
+// allowed. The Decision identifies the first project group which allowed the
+// access.
+func calculateUserSSHAccess(
 	projectGroupIDs []uuid.UUID,
 	userGroupIDRole map[uuid.UUID]lagoon.UserRole,
 	sshRoles map[lagoon.UserRole]bool,
-) bool {
+	execOnlyRoles map[lagoon.UserRole]bool,
+	logsOnlyRoles map[lagoon.UserRole]bool,
+) Decision {
+	var decision Decision
 	for _, pgid := range projectGroupIDs {
 		userRole, ok := userGroupIDRole[pgid]
 		if !ok {
 			continue
 		}
-		if sshRoles[userRole] {
-			return true
+		switch {
+		case sshRoles[userRole]:
+			return Decision{Allowed: true, Capability: FullAccess, Group: pgid}
+		case execOnlyRoles[userRole] && decision.Capability != ExecOnly:
+			decision =
+				Decision{Allowed: true, Capability: ExecOnly, Group: pgid}
+		case logsOnlyRoles[userRole] && !decision.Allowed:
+			decision =
+				Decision{Allowed: true, Capability: LogsOnly, Group: pgid}
 		}
 	}
-	return false
+	return decision
 }
 
 // UserCanSSHToEnvironment returns true if the given environment can be
 // connected to via SSH by the user with the given realm roles and user groups,
-// and false otherwise.
+// and false otherwise. This includes exec-only and logs-only access. Use
+// UserSSHAccess to determine the level of access granted.
 func (p *Permission) UserCanSSHToEnvironment(
 	ctx context.Context,
 	log *slog.Logger,
@@ -45,13 +63,55 @@ func (p *Permission) UserCanSSHToEnvironment(
 	projectID int,
 	envType lagoon.EnvironmentType,
 ) (bool, error) {
+	decision, err := p.UserSSHAccess(ctx, log, userUUID, projectID, envType)
+	return decision.Allowed, err
+}
+
+// UserSSHAccess returns a Decision describing whether the given environment
+// can be connected to via SSH by the user with the given realm roles and user
+// groups, and with what Capability. If the user doesn't exist in Keycloak,
+// access is denied with ReasonUserNotInKeycloak and no error is returned.
+func (p *Permission) UserSSHAccess(
+	ctx context.Context,
+	log *slog.Logger,
+	userUUID uuid.UUID,
+	projectID int,
+	envType lagoon.EnvironmentType,
+) (Decision, error) {
 	// set up tracing
-	_, span := otel.Tracer(pkgName).Start(ctx, "UserCanSSHToEnvironment")
+	_, span := otel.Tracer(pkgName).Start(ctx, "UserSSHAccess")
 	defer span.End()
+	log = log.With(slog.String("userID", userUUID.String()))
+	platformOwner, userGroupIDRole, err := p.UserGroupRoles(ctx, log, userUUID)
+	if err != nil {
+		if errors.Is(err, keycloak.ErrUserNotFound) {
+			log.Warn("denying permission to user not found in keycloak")
+			return Decision{Reason: ReasonUserNotInKeycloak}, nil
+		}
+		return Decision{}, err
+	}
+	if platformOwner {
+		return Decision{Allowed: true, Capability: FullAccess}, nil
+	}
+	return p.ProjectSSHAccess(ctx, log, userGroupIDRole, projectID, envType)
+}
+
+// UserGroupRoles returns true if the user has the platform-owner realm role,
+// and a map of the IDs of the groups the user is a member of to the user's
+// role in each group. If the user doesn't exist in Keycloak, it returns
+// keycloak.ErrUserNotFound.
+func (p *Permission) UserGroupRoles(
+	ctx context.Context,
+	log *slog.Logger,
+	userUUID uuid.UUID,
+) (bool, map[uuid.UUID]lagoon.UserRole, error) {
 	// get the user roles and group paths
 	realmRoles, userGroupPaths, err := p.keycloak.UserRolesAndGroups(ctx, userUUID)
 	if err != nil {
-		return false,
+		if errors.Is(err, keycloak.ErrUserNotFound) {
+			return false, nil, err
+		}
+		return false, nil,
 			fmt.Errorf("couldn't query roles and groups for user %v: %v", userUUID, err)
 	}
 	// check for platform owner
@@ -59,33 +119,68 @@ func (p *Permission) UserCanSSHToEnvironment(
 		if r == "platform-owner" {
 			log.Debug("granting permission due to platform-owner realm role",
 				slog.Any("realmRoles", realmRoles))
-			return true, nil
+			return true, nil, nil
 		}
 	}
 	// convert the group paths to group ID -> role map
-	userGroupIDRole := p.keycloak.UserGroupIDRole(ctx, userGroupPaths)
+	return false, p.keycloak.UserGroupIDRole(ctx, userGroupPaths), nil
+}
+
+// ProjectSSHAccess returns a Decision describing whether an environment of
+// the given type in the given project can be connected to via SSH by a user
+// with the given group ID -> role map, as returned by UserGroupRoles. This
+// allows checking multiple environments without repeating user queries.
+func (p *Permission) ProjectSSHAccess(
+	ctx context.Context,
+	log *slog.Logger,
+	userGroupIDRole map[uuid.UUID]lagoon.UserRole,
+	projectID int,
+	envType lagoon.EnvironmentType,
+) (Decision, error) {
 	// get the IDs of all groups the project is in
 	projectGroupIDs, err := p.lagoonDB.ProjectGroupIDs(ctx, projectID)
 	if err != nil {
-		return false,
+		return Decision{},
 			fmt.Errorf("couldn't get group IDs for project %v: %v", projectID, err)
 	}
 	// expand the group IDs for the project with any ancestor groups, since the
 	// user's membership of all ancestor groups should be considered when
 	// calculating permissions.
-	ancestorGroups, err := p.keycloak.AncestorGroups(ctx, projectGroupIDs)
-	if err != nil {
-		return false,
-			fmt.Errorf("couldn't expand project group IDs %v: %v", projectID, err)
+	groupIDs := projectGroupIDs
+	if p.expandAncestorGroups(ctx, userGroupIDRole) {
+		groupIDs, err = p.keycloak.AncestorGroups(ctx, projectGroupIDs)
+		if err != nil {
+			return Decision{}, fmt.Errorf(
+				"couldn't expand project group IDs %v: %v", projectID, err)
+		}
 	}
 	sshRoles := p.envTypeRoleCanSSH[envType]
 	log.Debug("assessing permission",
-		slog.Any("realmRoles", realmRoles),
 		slog.Any("userGroupIDRole", userGroupIDRole),
 		slog.Any("projectGroupIDs", projectGroupIDs),
 		slog.Any("sshRoles", sshRoles),
-		slog.String("userID", userUUID.String()),
+		slog.Any("execOnlyRoles", p.execOnlyRoles),
+		slog.Any("logsOnlyRoles", p.logsOnlyRoles),
 	)
-	return calculateUserCanSSHToEnvironment(
-		ancestorGroups, userGroupIDRole, sshRoles), nil
+	return calculateUserSSHAccess(groupIDs, userGroupIDRole, sshRoles,
+		p.execOnlyRoles, p.logsOnlyRoles), nil
+}
+
+// expandAncestorGroups returns true if the group IDs of a project need to be
+// expanded with their ancestor groups before being compared to the groups in
+// userGroupIDRole. That is unnecessary if it is disabled, or if none of the
+// user's groups has child groups, since then none of them can be an ancestor
+// of a project group.
+func (p *Permission) expandAncestorGroups(
+	ctx context.Context,
+	userGroupIDRole map[uuid.UUID]lagoon.UserRole,
+) bool {
+	if p.noAncestorGroups {
+		return false
+	}
+	userGroupIDs := make([]uuid.UUID, 0, len(userGroupIDRole))
+	for gid := range userGroupIDRole {
+		userGroupIDs = append(userGroupIDs, gid)
+	}
+	return HasChildGroups(ctx, p.keycloak, userGroupIDs)
 }
@@ -7,6 +7,7 @@ import (
 	"testing"
 
 	"github.com/google/uuid"
+	"github.com/uselagoon/ssh-portal/internal/keycloak"
 	"github.com/uselagoon/ssh-portal/internal/lagoon"
 	"github.com/uselagoon/ssh-portal/internal/rbac"
 	"go.uber.org/mock/gomock"
@@ -392,3 +393,521 @@ func TestUserCanSSHDefaultRBAC(t *testing.T) {
 		})
 	}
 }
+
+func TestUserSSHAccessLogsOnly(t *testing.T) {
+	log := slog.New(slog.NewJSONHandler(os.Stderr, nil))
+	projectGroupID := uuid.MustParse("00000000-0000-0000-0000-000000000001")
+	otherGroupID := uuid.MustParse("00000000-0000-0000-0000-000000000002")
+	var testCases = map[string]struct {
+		// input
+		envType           lagoon.EnvironmentType
+		blockDeveloperSSH bool
+		// mock data
+		realmRoles      []string
+		userGroupIDRole map[uuid.UUID]lagoon.UserRole
+		kcErr           error
+		// expectations
+		expect rbac.Decision
+	}{
+		"reporter dev": {
+			envType: lagoon.Development,
+			userGroupIDRole: map[uuid.UUID]lagoon.UserRole{
+				projectGroupID: lagoon.Reporter,
+			},
+			expect: rbac.Decision{
+				Allowed:    true,
+				Capability: rbac.LogsOnly,
+				Group:      projectGroupID,
+			},
+		},
+		"guest prod": {
+			envType: lagoon.Production,
+			userGroupIDRole: map[uuid.UUID]lagoon.UserRole{
+				projectGroupID: lagoon.Guest,
+			},
+			expect: rbac.Decision{
+				Allowed:    true,
+				Capability: rbac.LogsOnly,
+				Group:      projectGroupID,
+			},
+		},
+		"developer dev": {
+			envType: lagoon.Development,
+			userGroupIDRole: map[uuid.UUID]lagoon.UserRole{
+				projectGroupID: lagoon.Developer,
+			},
+			expect: rbac.Decision{
+				Allowed:    true,
+				Capability: rbac.FullAccess,
+				Group:      projectGroupID,
+			},
+		},
+		"developer dev blocked": {
+			envType:           lagoon.Development,
+			blockDeveloperSSH: true,
+			userGroupIDRole: map[uuid.UUID]lagoon.UserRole{
+				projectGroupID: lagoon.Developer,
+			},
+			expect: rbac.Decision{
+				Allowed:    true,
+				Capability: rbac.LogsOnly,
+				Group:      projectGroupID,
+			},
+		},
+		"developer prod": {
+			envType: lagoon.Production,
+			userGroupIDRole: map[uuid.UUID]lagoon.UserRole{
+				projectGroupID: lagoon.Developer,
+			},
+			expect: rbac.Decision{
+				Allowed:    true,
+				Capability: rbac.LogsOnly,
+				Group:      projectGroupID,
+			},
+		},
+		"maintainer prod": {
+			envType: lagoon.Production,
+			userGroupIDRole: map[uuid.UUID]lagoon.UserRole{
+				projectGroupID: lagoon.Maintainer,
+			},
+			expect: rbac.Decision{
+				Allowed:    true,
+				Capability: rbac.FullAccess,
+				Group:      projectGroupID,
+			},
+		},
+		"reporter wrong project": {
+			envType: lagoon.Development,
+			userGroupIDRole: map[uuid.UUID]lagoon.UserRole{
+				otherGroupID: lagoon.Reporter,
+			},
+			expect: rbac.Decision{},
+		},
+		"platform-owner": {
+			envType:    lagoon.Production,
+			realmRoles: []string{"platform-owner"},
+			expect:     rbac.Decision{Allowed: true, Capability: rbac.FullAccess},
+		},
+		"user not in keycloak": {
+			envType: lagoon.Production,
+			kcErr:   keycloak.ErrUserNotFound,
+			expect:  rbac.Decision{Reason: rbac.ReasonUserNotInKeycloak},
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			ctx := context.Background()
+			userUUID := uuid.UUID{}
+			projectID := 4
+			userGroupPaths := []string{"/project-foo/project-foo-group"}
+			// set up mocks
+			ctrl := gomock.NewController(tt)
+			kcService := NewMockKeycloakService(ctrl)
+			kcService.EXPECT().
+				UserRolesAndGroups(ctx, userUUID).
+				Return(tc.realmRoles, userGroupPaths, tc.kcErr)
+			ldbService := NewMockLagoonDBService(ctrl)
+			if len(tc.realmRoles) == 0 && tc.kcErr == nil {
+				kcService.EXPECT().
+					UserGroupIDRole(ctx, userGroupPaths).
+					Return(tc.userGroupIDRole)
+				ldbService.EXPECT().
+					ProjectGroupIDs(ctx, projectID).
+					Return([]uuid.UUID{projectGroupID}, nil)
+				kcService.EXPECT().
+					AncestorGroups(ctx, []uuid.UUID{projectGroupID}).
+					Return([]uuid.UUID{projectGroupID}, nil)
+			}
+			opts := []rbac.Option{
+				rbac.LogsOnlySSH(lagoon.Guest, lagoon.Reporter, lagoon.Developer),
+			}
+			if tc.blockDeveloperSSH {
+				opts = append(opts, rbac.BlockDeveloperSSH())
+			}
+			perm := rbac.NewPermission(kcService, ldbService, opts...)
+			decision, err := perm.UserSSHAccess(
+				ctx,
+				log,
+				userUUID,
+				projectID,
+				tc.envType,
+			)
+			if err != nil {
+				tt.Fatalf("couldn't perform user SSH permisison check: %v", err)
+			}
+			if decision != tc.expect {
+				tt.Fatalf("expected %v, got %v", tc.expect, decision)
+			}
+		})
+	}
+}
+
+func TestUserSSHAccessExecOnly(t *testing.T) {
+	log := slog.New(slog.NewJSONHandler(os.Stderr, nil))
+	projectGroupID := uuid.MustParse("00000000-0000-0000-0000-000000000001")
+	ancestorGroupID := uuid.MustParse("00000000-0000-0000-0000-000000000002")
+	var testCases = map[string]struct {
+		// input
+		envType lagoon.EnvironmentType
+		// mock data
+		userGroupIDRole map[uuid.UUID]lagoon.UserRole
+		// expectations
+		expect rbac.Decision
+	}{
+		"developer prod": {
+			envType: lagoon.Production,
+			userGroupIDRole: map[uuid.UUID]lagoon.UserRole{
+				projectGroupID: lagoon.Developer,
+			},
+			expect: rbac.Decision{
+				Allowed:    true,
+				Capability: rbac.ExecOnly,
+				Group:      projectGroupID,
+			},
+		},
+		"developer dev": {
+			envType: lagoon.Development,
+			userGroupIDRole: map[uuid.UUID]lagoon.UserRole{
+				projectGroupID: lagoon.Developer,
+			},
+			expect: rbac.Decision{
+				Allowed:    true,
+				Capability: rbac.FullAccess,
+				Group:      projectGroupID,
+			},
+		},
+		"guest prod": {
+			envType: lagoon.Production,
+			userGroupIDRole: map[uuid.UUID]lagoon.UserRole{
+				projectGroupID: lagoon.Guest,
+			},
+			expect: rbac.Decision{
+				Allowed:    true,
+				Capability: rbac.LogsOnly,
+				Group:      projectGroupID,
+			},
+		},
+		"exec-only takes precedence over logs-only": {
+			envType: lagoon.Production,
+			userGroupIDRole: map[uuid.UUID]lagoon.UserRole{
+				projectGroupID:  lagoon.Guest,
+				ancestorGroupID: lagoon.Developer,
+			},
+			expect: rbac.Decision{
+				Allowed:    true,
+				Capability: rbac.ExecOnly,
+				Group:      ancestorGroupID,
+			},
+		},
+		"full access takes precedence over exec-only": {
+			envType: lagoon.Production,
+			userGroupIDRole: map[uuid.UUID]lagoon.UserRole{
+				projectGroupID:  lagoon.Developer,
+				ancestorGroupID: lagoon.Maintainer,
+			},
+			expect: rbac.Decision{
+				Allowed:    true,
+				Capability: rbac.FullAccess,
+				Group:      ancestorGroupID,
+			},
+		},
+		"reporter prod": {
+			envType: lagoon.Production,
+			userGroupIDRole: map[uuid.UUID]lagoon.UserRole{
+				projectGroupID: lagoon.Reporter,
+			},
+			expect: rbac.Decision{},
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			ctx := context.Background()
+			userUUID := uuid.UUID{}
+			projectID := 4
+			userGroupPaths := []string{"/project-foo/project-foo-group"}
+			// set up mocks
+			ctrl := gomock.NewController(tt)
+			kcService := NewMockKeycloakService(ctrl)
+			kcService.EXPECT().
+				UserRolesAndGroups(ctx, userUUID).
+				Return(nil, userGroupPaths, nil)
+			kcService.EXPECT().
+				UserGroupIDRole(ctx, userGroupPaths).
+				Return(tc.userGroupIDRole)
+			ldbService := NewMockLagoonDBService(ctrl)
+			ldbService.EXPECT().
+				ProjectGroupIDs(ctx, projectID).
+				Return([]uuid.UUID{projectGroupID}, nil)
+			kcService.EXPECT().
+				AncestorGroups(ctx, []uuid.UUID{projectGroupID}).
+				Return([]uuid.UUID{projectGroupID, ancestorGroupID}, nil)
+			perm := rbac.NewPermission(kcService, ldbService,
+				rbac.ExecOnlySSH(lagoon.Developer),
+				rbac.LogsOnlySSH(lagoon.Guest, lagoon.Developer))
+			decision, err := perm.UserSSHAccess(
+				ctx,
+				log,
+				userUUID,
+				projectID,
+				tc.envType,
+			)
+			if err != nil {
+				tt.Fatalf("couldn't perform user SSH permission check: %v", err)
+			}
+			if decision != tc.expect {
+				tt.Fatalf("expected %v, got %v", tc.expect, decision)
+			}
+		})
+	}
+}
+
+func TestCapabilityText(t *testing.T) {
+	var testCases = map[string]struct {
+		capability rbac.Capability
+		text       string
+	}{
+		"full":      {capability: rbac.FullAccess, text: "full"},
+		"logs-only": {capability: rbac.LogsOnly, text: "logs-only"},
+		"exec-only": {capability: rbac.ExecOnly, text: "exec-only"},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			text, err := tc.capability.MarshalText()
+			if err != nil {
+				tt.Fatal(err)
+			}
+			if string(text) != tc.text {
+				tt.Fatalf("expected %v, got %v", tc.text, string(text))
+			}
+			var capability rbac.Capability
+			if err = capability.UnmarshalText(text); err != nil {
+				tt.Fatal(err)
+			}
+			if capability != tc.capability {
+				tt.Fatalf("expected %v, got %v", tc.capability, capability)
+			}
+		})
+	}
+	if _, err := rbac.ParseCapability("shell"); err == nil {
+		t.Fatal("expected error parsing invalid capability")
+	}
+}
+
+func TestCapabilityPermits(t *testing.T) {
+	var testCases = map[string]struct {
+		capability rbac.Capability
+		expect     map[rbac.SessionKind]bool
+	}{
+		"full": {
+			capability: rbac.FullAccess,
+			expect: map[rbac.SessionKind]bool{
+				rbac.SessionExec: true,
+				rbac.SessionLogs: true,
+				rbac.SessionSFTP: true,
+			},
+		},
+		"logs-only": {
+			capability: rbac.LogsOnly,
+			expect: map[rbac.SessionKind]bool{
+				rbac.SessionExec: false,
+				rbac.SessionLogs: true,
+				rbac.SessionSFTP: false,
+			},
+		},
+		"exec-only": {
+			capability: rbac.ExecOnly,
+			expect: map[rbac.SessionKind]bool{
+				rbac.SessionExec: true,
+				rbac.SessionLogs: false,
+				rbac.SessionSFTP: true,
+			},
+		},
+		"unknown": {
+			capability: rbac.Capability(99),
+			expect: map[rbac.SessionKind]bool{
+				rbac.SessionExec: false,
+				rbac.SessionLogs: false,
+				rbac.SessionSFTP: false,
+			},
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			for kind, expect := range tc.expect {
+				if tc.capability.Permits(kind) != expect {
+					tt.Fatalf("expected %v permits %v: %v", tc.capability, kind,
+						expect)
+				}
+			}
+		})
+	}
+}
+
+// childGroupKeycloakService is a KeycloakService which also implements
+// rbac.ChildGroupService.
+type childGroupKeycloakService struct {
+	*MockKeycloakService
+	hasChildGroups bool
+}
+
+func (s childGroupKeycloakService) HasChildGroups(
+	context.Context,
+	[]uuid.UUID,
+) bool {
+	return s.hasChildGroups
+}
+
+func TestAncestorGroupsParity(t *testing.T) {
+	log := slog.New(slog.NewJSONHandler(os.Stderr, nil))
+	projectGroupID := uuid.MustParse("00000000-0000-0000-0000-000000000001")
+	otherGroupID := uuid.MustParse("00000000-0000-0000-0000-000000000002")
+	// flat-group fixtures, in which no group has an ancestor group
+	var testCases = map[string]struct {
+		envType         lagoon.EnvironmentType
+		userGroupIDRole map[uuid.UUID]lagoon.UserRole
+		projectGroupIDs []uuid.UUID
+		expect          rbac.Decision
+	}{
+		"maintainer prod": {
+			envType: lagoon.Production,
+			userGroupIDRole: map[uuid.UUID]lagoon.UserRole{
+				projectGroupID: lagoon.Maintainer,
+			},
+			projectGroupIDs: []uuid.UUID{projectGroupID},
+			expect: rbac.Decision{
+				Allowed:    true,
+				Capability: rbac.FullAccess,
+				Group:      projectGroupID,
+			},
+		},
+		"developer prod in regular group": {
+			envType: lagoon.Production,
+			userGroupIDRole: map[uuid.UUID]lagoon.UserRole{
+				otherGroupID: lagoon.Developer,
+			},
+			projectGroupIDs: []uuid.UUID{projectGroupID, otherGroupID},
+			expect: rbac.Decision{
+				Allowed:    true,
+				Capability: rbac.LogsOnly,
+				Group:      otherGroupID,
+			},
+		},
+		"guest dev": {
+			envType: lagoon.Development,
+			userGroupIDRole: map[uuid.UUID]lagoon.UserRole{
+				projectGroupID: lagoon.Guest,
+			},
+			projectGroupIDs: []uuid.UUID{projectGroupID},
+		},
+		"wrong project": {
+			envType: lagoon.Development,
+			userGroupIDRole: map[uuid.UUID]lagoon.UserRole{
+				otherGroupID: lagoon.Owner,
+			},
+			projectGroupIDs: []uuid.UUID{projectGroupID},
+		},
+		"no groups": {
+			envType:         lagoon.Development,
+			projectGroupIDs: []uuid.UUID{projectGroupID},
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			ctx := context.Background()
+			userUUID := uuid.UUID{}
+			projectID := 4
+			userGroupPaths := []string{"/project-foo/project-foo-group"}
+			// set up mocks
+			ctrl := gomock.NewController(tt)
+			kcService := NewMockKeycloakService(ctrl)
+			kcService.EXPECT().
+				UserRolesAndGroups(ctx, userUUID).
+				Return(nil, userGroupPaths, nil).
+				Times(3)
+			kcService.EXPECT().
+				UserGroupIDRole(ctx, userGroupPaths).
+				Return(tc.userGroupIDRole).
+				Times(3)
+			ldbService := NewMockLagoonDBService(ctrl)
+			ldbService.EXPECT().
+				ProjectGroupIDs(ctx, projectID).
+				Return(tc.projectGroupIDs, nil).
+				Times(3)
+			// ancestor groups are only queried with expansion enabled, and
+			// without the fast path
+			kcService.EXPECT().
+				AncestorGroups(ctx, tc.projectGroupIDs).
+				Return(tc.projectGroupIDs, nil)
+			opts := []rbac.Option{rbac.LogsOnlySSH(lagoon.Developer)}
+			perms := map[string]*rbac.Permission{
+				"expanded": rbac.NewPermission(kcService, ldbService, opts...),
+				"disabled": rbac.NewPermission(kcService, ldbService,
+					append(opts, rbac.DisableAncestorGroups())...),
+				"fast path": rbac.NewPermission(
+					childGroupKeycloakService{MockKeycloakService: kcService},
+					ldbService, opts...),
+			}
+			for permName, perm := range perms {
+				decision, err := perm.UserSSHAccess(
+					ctx,
+					log,
+					userUUID,
+					projectID,
+					tc.envType,
+				)
+				if err != nil {
+					tt.Fatalf("couldn't perform user SSH permisison check: %v",
+						err)
+				}
+				if decision != tc.expect {
+					tt.Fatalf("%s: expected %v, got %v", permName, tc.expect,
+						decision)
+				}
+			}
+		})
+	}
+}
+
+func TestAncestorGroupsNested(t *testing.T) {
+	log := slog.New(slog.NewJSONHandler(os.Stderr, nil))
+	ctx := context.Background()
+	userUUID := uuid.UUID{}
+	projectID := 4
+	userGroupPaths := []string{"/org/org-maintainer"}
+	projectGroupID := uuid.MustParse("00000000-0000-0000-0000-000000000001")
+	parentGroupID := uuid.MustParse("00000000-0000-0000-0000-000000000002")
+	// the user is a member of the parent group of the project group, which
+	// has child groups
+	ctrl := gomock.NewController(t)
+	kcService := NewMockKeycloakService(ctrl)
+	kcService.EXPECT().
+		UserRolesAndGroups(ctx, userUUID).
+		Return(nil, userGroupPaths, nil)
+	kcService.EXPECT().
+		UserGroupIDRole(ctx, userGroupPaths).
+		Return(map[uuid.UUID]lagoon.UserRole{parentGroupID: lagoon.Maintainer})
+	ldbService := NewMockLagoonDBService(ctrl)
+	ldbService.EXPECT().
+		ProjectGroupIDs(ctx, projectID).
+		Return([]uuid.UUID{projectGroupID}, nil)
+	kcService.EXPECT().
+		AncestorGroups(ctx, []uuid.UUID{projectGroupID}).
+		Return([]uuid.UUID{projectGroupID, parentGroupID}, nil)
+	perm := rbac.NewPermission(childGroupKeycloakService{
+		MockKeycloakService: kcService,
+		hasChildGroups:      true,
+	}, ldbService)
+	decision, err := perm.UserSSHAccess(ctx, log, userUUID, projectID,
+		lagoon.Production)
+	if err != nil {
+		t.Fatalf("couldn't perform user SSH permisison check: %v", err)
+	}
+	expect := rbac.Decision{
+		Allowed:    true,
+		Capability: rbac.FullAccess,
+		Group:      parentGroupID,
+	}
+	if decision != expect {
+		t.Fatalf("expected %v, got %v", expect, decision)
+	}
+}
@@ -0,0 +1,136 @@
+// Package readiness periodically checks the connectivity of the services a
+// process depends on, and exports the results as Prometheus gauges.
+package readiness
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Check returns an error if a component is not ready.
+type Check func(context.Context) error
+
+// Component is a dependency of the process which must be ready for the
+// process to be ready.
+type Component struct {
+	// Name is the name of the gauge exported for the component, without the
+	// namespace prefix.
+	Name string
+	// Help is the help text of the gauge.
+	Help  string
+	Check Check
+}
+
+// Checker checks the readiness of a set of components. It exports a gauge
+// for each component, and an overall ready gauge which is 1 only if every
+// component is ready.
+type Checker struct {
+	log        *slog.Logger
+	components []Component
+	gauges     []prometheus.Gauge
+	ready      prometheus.Gauge
+
+	// mu protects failing, which records whether each component failed its
+	// previous check so that only transitions are logged.
+	mu      sync.Mutex
+	failing []bool
+}
+
+// NewChecker returns a Checker for the given components which registers its
+// gauges in reg, prefixed by namespace. Every gauge is zero until the first
+// check.
+func NewChecker(
+	log *slog.Logger,
+	reg prometheus.Registerer,
+	namespace string,
+	components ...Component,
+) *Checker {
+	factory := promauto.With(reg)
+	gauges := make([]prometheus.Gauge, len(components))
+	for i, comp := range components {
+		gauges[i] = factory.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      comp.Name,
+			Help:      comp.Help,
+		})
+	}
+	return &Checker{
+		log:        log,
+		components: components,
+		gauges:     gauges,
+		ready: factory.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "ready",
+			Help:      "Whether every component is ready (1) or not (0)",
+		}),
+		failing: make([]bool, len(components)),
+	}
+}
+
+// Collectors returns the gauges exported by the Checker.
+func (c *Checker) Collectors() []prometheus.Collector {
+	collectors := []prometheus.Collector{c.ready}
+	for _, g := range c.gauges {
+		collectors = append(collectors, g)
+	}
+	return collectors
+}
+
+// Check runs the check of each component and updates the gauges. It returns
+// nil if every component is ready, and otherwise an error naming each
+// component which is not ready.
+func (c *Checker) Check(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var errs []error
+	for i, comp := range c.components {
+		err := comp.Check(ctx)
+		switch {
+		case err != nil:
+			c.gauges[i].Set(0)
+			errs = append(errs, fmt.Errorf("%s: %v", comp.Name, err))
+			if !c.failing[i] {
+				c.log.Warn("component not ready",
+					slog.String("component", comp.Name),
+					slog.Any("error", err))
+			}
+		case c.failing[i]:
+			c.gauges[i].Set(1)
+			c.log.Info("component ready", slog.String("component", comp.Name))
+		default:
+			c.gauges[i].Set(1)
+		}
+		c.failing[i] = err != nil
+	}
+	if len(errs) > 0 {
+		c.ready.Set(0)
+		return errors.Join(errs...)
+	}
+	c.ready.Set(1)
+	return nil
+}
+
+// Run checks the components immediately, and then at the given interval
+// until ctx is cancelled. Each round of checks must complete within the
+// interval.
+func (c *Checker) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		checkCtx, cancel := context.WithTimeout(ctx, interval)
+		_ = c.Check(checkCtx)
+		cancel()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package readiness_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"testing"
+
+	"github.com/alecthomas/assert/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/uselagoon/ssh-portal/internal/readiness"
+)
+
+// fakeCheck is a readiness check which returns a configurable error.
+type fakeCheck struct {
+	err error
+}
+
+func (f *fakeCheck) check(context.Context) error {
+	return f.err
+}
+
+// gauges returns the value of each gauge exported by the checker, in the
+// order ready, nats, k8s.
+func gauges(tt *testing.T, reg *prometheus.Registry) []float64 {
+	var values []float64
+	for _, name := range []string{
+		"sshportal_ready",
+		"sshportal_nats_connected",
+		"sshportal_k8s_api_reachable",
+	} {
+		mfs, err := reg.Gather()
+		assert.NoError(tt, err)
+		var found bool
+		for _, mf := range mfs {
+			if mf.GetName() == name {
+				values = append(values, mf.GetMetric()[0].GetGauge().GetValue())
+				found = true
+			}
+		}
+		assert.True(tt, found, name)
+	}
+	return values
+}
+
+func TestChecker(t *testing.T) {
+	down := errors.New("connection refused")
+	type step struct {
+		natsErr     error
+		k8sErr      error
+		expectReady bool
+		expect      []float64
+	}
+	var testCases = map[string]struct {
+		steps []step
+	}{
+		"ready": {
+			steps: []step{
+				{expectReady: true, expect: []float64{1, 1, 1}},
+			},
+		},
+		"nats down then up": {
+			steps: []step{
+				{natsErr: down, expect: []float64{0, 0, 1}},
+				{expectReady: true, expect: []float64{1, 1, 1}},
+			},
+		},
+		"k8s flapping": {
+			steps: []step{
+				{expectReady: true, expect: []float64{1, 1, 1}},
+				{k8sErr: down, expect: []float64{0, 1, 0}},
+				{expectReady: true, expect: []float64{1, 1, 1}},
+				{k8sErr: down, expect: []float64{0, 1, 0}},
+			},
+		},
+		"both down": {
+			steps: []step{
+				{natsErr: down, k8sErr: down, expect: []float64{0, 0, 0}},
+				{k8sErr: down, expect: []float64{0, 1, 0}},
+				{expectReady: true, expect: []float64{1, 1, 1}},
+			},
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			nats, k8s := &fakeCheck{}, &fakeCheck{}
+			reg := prometheus.NewPedanticRegistry()
+			log := slog.New(slog.NewJSONHandler(io.Discard, nil))
+			c := readiness.NewChecker(log, reg, "sshportal",
+				readiness.Component{
+					Name:  "nats_connected",
+					Help:  "NATS",
+					Check: nats.check,
+				},
+				readiness.Component{
+					Name:  "k8s_api_reachable",
+					Help:  "Kubernetes API",
+					Check: k8s.check,
+				})
+			assert.Equal(tt, []float64{0, 0, 0}, gauges(tt, reg), name)
+			for _, s := range tc.steps {
+				nats.err, k8s.err = s.natsErr, s.k8sErr
+				err := c.Check(context.Background())
+				if s.expectReady {
+					assert.NoError(tt, err, name)
+				} else {
+					assert.Error(tt, err, name)
+				}
+				assert.Equal(tt, s.expect, gauges(tt, reg), name)
+			}
+		})
+	}
+}
+
+func TestCheckerError(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	log := slog.New(slog.NewJSONHandler(io.Discard, nil))
+	c := readiness.NewChecker(log, reg, "sshportal",
+		readiness.Component{
+			Name:  "nats_connected",
+			Help:  "NATS",
+			Check: (&fakeCheck{err: errors.New("reconnecting")}).check,
+		})
+	err := c.Check(context.Background())
+	assert.EqualError(t, err, "nats_connected: reconnecting")
+	assert.Equal(t, 2, len(c.Collectors()))
+	assert.Equal(t, 0.0, testutil.ToFloat64(c.Collectors()[0]))
+}
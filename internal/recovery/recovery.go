@@ -0,0 +1,45 @@
+// Package recovery implements panic recovery for SSH handlers, so that a
+// panic while serving one session doesn't terminate the server.
+package recovery
+
+import (
+	"log/slog"
+	"runtime/debug"
+
+	"github.com/gliderlabs/ssh"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/uselagoon/ssh-portal/internal/sessionlog"
+)
+
+// exitCodePanic is the exit code sent to the client when a panic occurs. This
+// is the same exit code OpenSSH uses for internal errors.
+const exitCodePanic = 255
+
+// SSHHandler wraps the given ssh.Handler so that any panic while handling a
+// session is recovered. The panic is logged along with a stack trace, the
+// panics counter is incremented, and the session is closed with exit code
+// 255.
+func SSHHandler(
+	log *slog.Logger,
+	panics prometheus.Counter,
+	handler ssh.Handler,
+) ssh.Handler {
+	return func(s ssh.Session) {
+		defer func() {
+			r := recover()
+			if r == nil {
+				return
+			}
+			panics.Inc()
+			log.Error("recovered panic in SSH session handler",
+				slog.String(sessionlog.SessionIDKey, s.Context().SessionID()),
+				slog.String(sessionlog.NamespaceKey, s.User()),
+				slog.Any("panic", r),
+				slog.String("stack", string(debug.Stack())))
+			if err := s.Exit(exitCodePanic); err != nil {
+				log.Warn("couldn't send exit code to client", slog.Any("error", err))
+			}
+		}()
+		handler(s)
+	}
+}
@@ -0,0 +1,86 @@
+package recovery_test
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"net"
+	"testing"
+
+	"github.com/alecthomas/assert/v2"
+	"github.com/gliderlabs/ssh"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/uselagoon/ssh-portal/internal/recovery"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// runCommand runs cmd in a new session on the given client, and returns the
+// exit status.
+func runCommand(t *testing.T, client *gossh.Client, cmd string) int {
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	err = session.Run(cmd)
+	if err == nil {
+		return 0
+	}
+	var exitErr *gossh.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitStatus()
+	}
+	t.Fatal(err)
+	return -1
+}
+
+func TestSSHHandler(t *testing.T) {
+	var buf bytes.Buffer
+	log := slog.New(slog.NewJSONHandler(&buf, nil))
+	panics := prometheus.NewCounter(prometheus.CounterOpts{Name: "test_panics"})
+	// start a server with a handler which panics on request
+	srv := ssh.Server{
+		Handler: recovery.SSHHandler(log, panics, func(s ssh.Session) {
+			if s.RawCommand() == "panic" {
+				var m map[string]string
+				m["boom"] = "boom" // nil map assignment panics
+			}
+			_ = s.Exit(0)
+		}),
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = srv.Serve(l) }()
+	defer srv.Close()
+	// connect a client
+	client, err := gossh.Dial("tcp", l.Addr().String(), &gossh.ClientConfig{
+		User:            "test-namespace",
+		HostKeyCallback: gossh.InsecureIgnoreHostKey(), //nolint:gosec
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	// the panicking session is closed with exit code 255
+	assert.Equal(t, 255, runCommand(t, client, "panic"))
+	assert.Equal(t, float64(1), testutil.ToFloat64(panics))
+	assert.Contains(t, buf.String(), "recovered panic in SSH session handler")
+	assert.Contains(t, buf.String(), "assignment to entry in nil map")
+	assert.Contains(t, buf.String(), `"namespace":"test-namespace"`)
+	assert.Contains(t, buf.String(), `"stack":`)
+	// the server continues serving sessions on the same and new connections
+	assert.Equal(t, 0, runCommand(t, client, "ok"))
+	client2, err := gossh.Dial("tcp", l.Addr().String(), &gossh.ClientConfig{
+		User:            "test-namespace",
+		HostKeyCallback: gossh.InsecureIgnoreHostKey(), //nolint:gosec
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client2.Close()
+	assert.Equal(t, 0, runCommand(t, client2, "ok"))
+	assert.Equal(t, float64(1), testutil.ToFloat64(panics))
+}
@@ -0,0 +1,205 @@
+// Package retry implements retrying of failed operations with exponential
+// backoff, so that each caller doesn't need its own backoff logic.
+package retry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"time"
+)
+
+// Default configuration of a Backoff.
+const (
+	DefaultBase        = 100 * time.Millisecond
+	DefaultCap         = 10 * time.Second
+	DefaultJitter      = 0.5
+	DefaultMaxAttempts = 5
+)
+
+// Option performs optional configuration on Backoff objects during
+// initialization, and is passed to New().
+type Option func(*Backoff)
+
+// Base sets the delay before the first retry. Each following delay is double
+// the previous one, up to the cap.
+func Base(base time.Duration) Option {
+	return func(b *Backoff) {
+		b.base = base
+	}
+}
+
+// Cap sets the maximum delay between attempts.
+func Cap(d time.Duration) Option {
+	return func(b *Backoff) {
+		b.cap = d
+	}
+}
+
+// Jitter sets the fraction of each delay which is randomised, between zero
+// and one. A delay d is reduced by a random duration of up to d*jitter, so
+// that callers which failed together don't retry together.
+func Jitter(jitter float64) Option {
+	return func(b *Backoff) {
+		b.jitter = jitter
+	}
+}
+
+// MaxAttempts sets the maximum number of attempts, including the first. Zero
+// means the operation is retried until it succeeds, fails with an error which
+// isn't retryable, or the context is done.
+func MaxAttempts(n int) Option {
+	return func(b *Backoff) {
+		b.maxAttempts = n
+	}
+}
+
+// RetryIf sets the predicate which returns true if an error is retryable.
+// Errors which aren't retryable are returned immediately. By default all
+// errors are retryable.
+func RetryIf(retryable func(error) bool) Option {
+	return func(b *Backoff) {
+		b.retryable = retryable
+	}
+}
+
+// Clock sets the function used to wait between attempts, which has the
+// signature of time.After. It is intended for use in tests.
+func Clock(after func(time.Duration) <-chan time.Time) Option {
+	return func(b *Backoff) {
+		b.after = after
+	}
+}
+
+// Rand sets the function used to randomise delays, which returns a number in
+// the half-open interval [0,1). It is intended for use in tests.
+func Rand(random func() float64) Option {
+	return func(b *Backoff) {
+		b.random = random
+	}
+}
+
+// Backoff retries operations with exponential backoff. A Backoff is safe for
+// concurrent use.
+type Backoff struct {
+	base        time.Duration
+	cap         time.Duration
+	jitter      float64
+	maxAttempts int
+	retryable   func(error) bool
+	after       func(time.Duration) <-chan time.Time
+	random      func() float64
+}
+
+// New returns a Backoff configured with the given options, or the defaults
+// for any options not given.
+func New(opts ...Option) (*Backoff, error) {
+	b := Backoff{
+		base:        DefaultBase,
+		cap:         DefaultCap,
+		jitter:      DefaultJitter,
+		maxAttempts: DefaultMaxAttempts,
+		retryable:   func(error) bool { return true },
+		after:       time.After,
+		random:      rand.Float64,
+	}
+	for _, opt := range opts {
+		opt(&b)
+	}
+	if b.base <= 0 {
+		return nil, fmt.Errorf("invalid base: %v", b.base)
+	}
+	if b.cap < b.base {
+		return nil, fmt.Errorf("invalid cap: %v less than base %v",
+			b.cap, b.base)
+	}
+	if b.jitter < 0 || b.jitter > 1 {
+		return nil, fmt.Errorf("invalid jitter: %v", b.jitter)
+	}
+	if b.maxAttempts < 0 {
+		return nil, fmt.Errorf("invalid max attempts: %d", b.maxAttempts)
+	}
+	return &b, nil
+}
+
+// Must returns b, and panics if err is not nil. It is intended for package
+// level Backoff variables with constant configuration.
+func Must(b *Backoff, err error) *Backoff {
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// Delay returns the delay after the given failed attempt, counting from one.
+// It is base*2^(attempt-1), limited to the cap, and reduced by the jitter.
+func (b *Backoff) Delay(attempt int) time.Duration {
+	d := b.base
+	// stop doubling once the cap is reached, so that d can't overflow
+	for i := 1; i < attempt && d < b.cap; i++ {
+		d *= 2
+	}
+	d = min(d, b.cap)
+	return d - time.Duration(b.random()*b.jitter*float64(d))
+}
+
+// Do calls fn until it returns nil, returns an error which isn't retryable,
+// or the maximum number of attempts is reached, and returns the error of the
+// last attempt. Each call of fn is passed ctx.
+//
+// If ctx is done while waiting between attempts, Do returns the error of the
+// last attempt joined with the context error, so that both may be inspected
+// with errors.Is.
+func (b *Backoff) Do(
+	ctx context.Context,
+	fn func(context.Context) error,
+) error {
+	for attempt := 1; ; attempt++ {
+		err := fn(ctx)
+		if err == nil || !b.retryable(err) ||
+			(b.maxAttempts > 0 && attempt >= b.maxAttempts) {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return errors.Join(err, ctx.Err())
+		case <-b.after(b.Delay(attempt)):
+		}
+	}
+}
+
+// Is returns a predicate for use with RetryIf, which returns true if the
+// error matches any of the targets using errors.Is.
+func Is(targets ...error) func(error) bool {
+	return func(err error) bool {
+		for _, target := range targets {
+			if errors.Is(err, target) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// As returns a predicate for use with RetryIf, which returns true if the
+// error has type T in its chain using errors.As.
+func As[T error]() func(error) bool {
+	return func(err error) bool {
+		var target T
+		return errors.As(err, &target)
+	}
+}
+
+// Any returns a predicate for use with RetryIf, which returns true if any of
+// the given predicates returns true.
+func Any(predicates ...func(error) bool) func(error) bool {
+	return func(err error) bool {
+		for _, predicate := range predicates {
+			if predicate(err) {
+				return true
+			}
+		}
+		return false
+	}
+}
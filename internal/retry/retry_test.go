@@ -0,0 +1,351 @@
+package retry_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/assert/v2"
+	"github.com/uselagoon/ssh-portal/internal/retry"
+)
+
+var errTemporary = errors.New("temporary")
+
+// fakeClock records the delays waited on, and returns immediately.
+type fakeClock struct {
+	delays []time.Duration
+}
+
+func (c *fakeClock) after(d time.Duration) <-chan time.Time {
+	c.delays = append(c.delays, d)
+	ch := make(chan time.Time, 1)
+	ch <- time.Time{}
+	return ch
+}
+
+// noJitter is a random function which makes delays deterministic.
+func noJitter() float64 { return 0 }
+
+func TestNew(t *testing.T) {
+	var testCases = map[string]struct {
+		opts        []retry.Option
+		expectError bool
+	}{
+		"defaults": {},
+		"valid": {
+			opts: []retry.Option{
+				retry.Base(time.Second),
+				retry.Cap(time.Second),
+				retry.Jitter(1),
+				retry.MaxAttempts(0),
+			},
+		},
+		"zero base": {
+			opts:        []retry.Option{retry.Base(0)},
+			expectError: true,
+		},
+		"cap less than base": {
+			opts:        []retry.Option{retry.Base(time.Second), retry.Cap(0)},
+			expectError: true,
+		},
+		"negative jitter": {
+			opts:        []retry.Option{retry.Jitter(-0.1)},
+			expectError: true,
+		},
+		"jitter above one": {
+			opts:        []retry.Option{retry.Jitter(1.1)},
+			expectError: true,
+		},
+		"negative max attempts": {
+			opts:        []retry.Option{retry.MaxAttempts(-1)},
+			expectError: true,
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			_, err := retry.New(tc.opts...)
+			if tc.expectError {
+				assert.Error(tt, err, name)
+			} else {
+				assert.NoError(tt, err, name)
+			}
+		})
+	}
+}
+
+func TestMust(t *testing.T) {
+	assert.Panics(t, func() { retry.Must(retry.New(retry.Base(0))) })
+	assert.NotZero(t, retry.Must(retry.New()))
+}
+
+func TestDelay(t *testing.T) {
+	var testCases = map[string]struct {
+		random func() float64
+		expect []time.Duration
+	}{
+		"no jitter": {
+			random: noJitter,
+			expect: []time.Duration{
+				100 * time.Millisecond,
+				200 * time.Millisecond,
+				400 * time.Millisecond,
+				800 * time.Millisecond,
+				time.Second,
+				time.Second,
+			},
+		},
+		"maximum jitter": {
+			random: func() float64 { return 1 },
+			expect: []time.Duration{
+				50 * time.Millisecond,
+				100 * time.Millisecond,
+				200 * time.Millisecond,
+				400 * time.Millisecond,
+				500 * time.Millisecond,
+				500 * time.Millisecond,
+			},
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			b := retry.Must(retry.New(
+				retry.Base(100*time.Millisecond),
+				retry.Cap(time.Second),
+				retry.Jitter(0.5),
+				retry.Rand(tc.random)))
+			var delays []time.Duration
+			for attempt := range len(tc.expect) {
+				delays = append(delays, b.Delay(attempt+1))
+			}
+			assert.Equal(tt, tc.expect, delays, name)
+		})
+	}
+}
+
+func TestDelayCapOverflow(t *testing.T) {
+	b := retry.Must(retry.New(
+		retry.Base(time.Second),
+		retry.Cap(time.Hour),
+		retry.Rand(noJitter)))
+	assert.Equal(t, time.Hour, b.Delay(1000))
+}
+
+func TestDelayJitterBounds(t *testing.T) {
+	var testCases = map[string]struct {
+		jitter float64
+	}{
+		"none": {jitter: 0},
+		"half": {jitter: 0.5},
+		"full": {jitter: 1},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			b := retry.Must(retry.New(
+				retry.Base(time.Second),
+				retry.Cap(8*time.Second),
+				retry.Jitter(tc.jitter)))
+			for attempt := 1; attempt <= 5; attempt++ {
+				upper := min(time.Second<<(attempt-1), 8*time.Second)
+				lower := upper - time.Duration(tc.jitter*float64(upper))
+				for range 1000 {
+					d := b.Delay(attempt)
+					assert.True(tt, d >= lower && d <= upper,
+						fmt.Sprintf("%s: attempt %d delay %v not in [%v,%v]",
+							name, attempt, d, lower, upper))
+				}
+			}
+		})
+	}
+}
+
+func TestDo(t *testing.T) {
+	errPermanent := errors.New("permanent")
+	var testCases = map[string]struct {
+		maxAttempts  int
+		errs         []error
+		expectErr    error
+		expectCalls  int
+		expectDelays []time.Duration
+	}{
+		"success": {
+			maxAttempts: 3,
+			expectCalls: 1,
+		},
+		"success after retries": {
+			maxAttempts: 3,
+			errs:        []error{errTemporary, errTemporary},
+			expectCalls: 3,
+			expectDelays: []time.Duration{
+				100 * time.Millisecond,
+				200 * time.Millisecond,
+			},
+		},
+		"attempts exhausted": {
+			maxAttempts: 3,
+			errs:        []error{errTemporary, errTemporary, errTemporary},
+			expectErr:   errTemporary,
+			expectCalls: 3,
+			expectDelays: []time.Duration{
+				100 * time.Millisecond,
+				200 * time.Millisecond,
+			},
+		},
+		"not retryable": {
+			maxAttempts: 3,
+			errs:        []error{errPermanent},
+			expectErr:   errPermanent,
+			expectCalls: 1,
+		},
+		"not retryable after retry": {
+			maxAttempts: 3,
+			errs:        []error{errTemporary, errPermanent},
+			expectErr:   errPermanent,
+			expectCalls: 2,
+			expectDelays: []time.Duration{
+				100 * time.Millisecond,
+			},
+		},
+		"wrapped retryable": {
+			maxAttempts: 3,
+			errs:        []error{fmt.Errorf("wrapped: %w", errTemporary)},
+			expectCalls: 2,
+			expectDelays: []time.Duration{
+				100 * time.Millisecond,
+			},
+		},
+		"unlimited attempts": {
+			errs: []error{
+				errTemporary, errTemporary, errTemporary, errTemporary,
+				errTemporary,
+			},
+			expectCalls: 6,
+			expectDelays: []time.Duration{
+				100 * time.Millisecond,
+				200 * time.Millisecond,
+				400 * time.Millisecond,
+				400 * time.Millisecond,
+				400 * time.Millisecond,
+			},
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			var clock fakeClock
+			b := retry.Must(retry.New(
+				retry.Base(100*time.Millisecond),
+				retry.Cap(400*time.Millisecond),
+				retry.MaxAttempts(tc.maxAttempts),
+				retry.RetryIf(retry.Is(errTemporary)),
+				retry.Clock(clock.after),
+				retry.Rand(noJitter)))
+			var calls int
+			err := b.Do(context.Background(), func(context.Context) error {
+				calls++
+				if calls <= len(tc.errs) {
+					return tc.errs[calls-1]
+				}
+				return nil
+			})
+			assert.Equal(tt, tc.expectErr, err, name)
+			assert.Equal(tt, tc.expectCalls, calls, name)
+			assert.Equal(tt, tc.expectDelays, clock.delays, name)
+		})
+	}
+}
+
+func TestDoContextCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var delays []time.Duration
+	b := retry.Must(retry.New(
+		retry.MaxAttempts(0),
+		retry.Rand(noJitter),
+		// cancel the context while waiting, and never fire the timer
+		retry.Clock(func(d time.Duration) <-chan time.Time {
+			delays = append(delays, d)
+			cancel()
+			return make(chan time.Time)
+		})))
+	var calls int
+	err := b.Do(ctx, func(context.Context) error {
+		calls++
+		return errTemporary
+	})
+	assert.True(t, errors.Is(err, errTemporary), "last error")
+	assert.True(t, errors.Is(err, context.Canceled), "context error")
+	assert.Equal(t, 1, calls)
+	assert.Equal(t, []time.Duration{retry.DefaultBase}, delays)
+}
+
+func TestDoPassesContext(t *testing.T) {
+	type ctxKey struct{}
+	ctx := context.WithValue(context.Background(), ctxKey{}, "value")
+	b := retry.Must(retry.New())
+	err := b.Do(ctx, func(ctx context.Context) error {
+		assert.Equal[any](t, "value", ctx.Value(ctxKey{}))
+		return nil
+	})
+	assert.NoError(t, err)
+}
+
+func TestPredicates(t *testing.T) {
+	pathErr := &fs.PathError{Op: "open", Path: "/x", Err: fs.ErrNotExist}
+	var testCases = map[string]struct {
+		predicate func(error) bool
+		err       error
+		expect    bool
+	}{
+		"is match": {
+			predicate: retry.Is(fs.ErrClosed, errTemporary),
+			err:       errTemporary,
+			expect:    true,
+		},
+		"is wrapped": {
+			predicate: retry.Is(errTemporary),
+			err:       fmt.Errorf("wrapped: %w", errTemporary),
+			expect:    true,
+		},
+		"is no match": {
+			predicate: retry.Is(errTemporary),
+			err:       fs.ErrClosed,
+		},
+		"is no targets": {
+			predicate: retry.Is(),
+			err:       errTemporary,
+		},
+		"as match": {
+			predicate: retry.As[*fs.PathError](),
+			err:       fmt.Errorf("wrapped: %w", pathErr),
+			expect:    true,
+		},
+		"as no match": {
+			predicate: retry.As[*fs.PathError](),
+			err:       errTemporary,
+		},
+		"any match": {
+			predicate: retry.Any(
+				retry.Is(fs.ErrClosed),
+				retry.As[*fs.PathError]()),
+			err:    pathErr,
+			expect: true,
+		},
+		"any no match": {
+			predicate: retry.Any(
+				retry.Is(fs.ErrClosed),
+				retry.As[*fs.PathError]()),
+			err: errTemporary,
+		},
+		"any no predicates": {
+			predicate: retry.Any(),
+			err:       errTemporary,
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			assert.Equal(tt, tc.expect, tc.predicate(tc.err), name)
+		})
+	}
+}
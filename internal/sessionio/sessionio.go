@@ -0,0 +1,90 @@
+// Package sessionio implements bounded writes to SSH session streams.
+//
+// Writes to the stream of a client which has gone away can block, depending
+// on the state of the underlying channel. Writing user-facing messages
+// through this package guarantees that session handlers never block
+// indefinitely on a dead client.
+package sessionio
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// DefaultTimeout is the maximum time that Fprint and Fprintf wait for a write
+// to complete.
+const DefaultTimeout = 10 * time.Second
+
+// ErrWriteTimeout is returned when a write doesn't complete before the
+// timeout.
+var ErrWriteTimeout = errors.New("timed out writing to session stream")
+
+// Writer wraps an io.Writer, bounding the time spent in each write.
+type Writer struct {
+	ctx     context.Context
+	w       io.Writer
+	timeout time.Duration
+}
+
+// NewWriter returns a Writer which writes to w. Each write returns once it
+// completes, ctx is cancelled, or the timeout elapses, whichever happens
+// first.
+func NewWriter(ctx context.Context, w io.Writer, timeout time.Duration) *Writer {
+	return &Writer{ctx: ctx, w: w, timeout: timeout}
+}
+
+// Write implements io.Writer. If ctx is already cancelled nothing is written.
+//
+// A write which doesn't complete in time continues in the background until
+// the underlying writer returns, which for an SSH channel happens when the
+// session is closed. In that case Write returns zero bytes written, and
+// ErrWriteTimeout or the error of the cancelled context.
+func (w *Writer) Write(p []byte) (int, error) {
+	if err := w.ctx.Err(); err != nil {
+		return 0, err
+	}
+	type result struct {
+		n   int
+		err error
+	}
+	// p may not be retained after Write returns, so the background write
+	// needs its own copy
+	buf := bytes.Clone(p)
+	done := make(chan result, 1)
+	go func() {
+		n, err := w.w.Write(buf)
+		done <- result{n: n, err: err}
+	}()
+	timer := time.NewTimer(w.timeout)
+	defer timer.Stop()
+	select {
+	case r := <-done:
+		return r.n, r.err
+	case <-w.ctx.Done():
+		return 0, w.ctx.Err()
+	case <-timer.C:
+		return 0, ErrWriteTimeout
+	}
+}
+
+// Fprint formats using the default formats for its operands and writes to w,
+// in the same way as fmt.Fprint. The write is bounded by ctx and
+// DefaultTimeout.
+func Fprint(ctx context.Context, w io.Writer, a ...any) (int, error) {
+	return fmt.Fprint(NewWriter(ctx, w, DefaultTimeout), a...)
+}
+
+// Fprintf formats according to a format specifier and writes to w, in the
+// same way as fmt.Fprintf. The write is bounded by ctx and DefaultTimeout.
+func Fprintf(
+	ctx context.Context,
+	w io.Writer,
+	format string,
+	a ...any,
+) (int, error) {
+	return fmt.Fprintf(NewWriter(ctx, w, DefaultTimeout), format, a...)
+}
@@ -0,0 +1,103 @@
+package sessionio_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/assert/v2"
+	"github.com/uselagoon/ssh-portal/internal/sessionio"
+)
+
+// blockingWriter is an io.Writer which blocks until unblock is closed.
+type blockingWriter struct {
+	unblock chan struct{}
+}
+
+// Write implements io.Writer.
+func (w *blockingWriter) Write(p []byte) (int, error) {
+	<-w.unblock
+	return len(p), nil
+}
+
+// errWriter is an io.Writer which always fails.
+type errWriter struct{}
+
+// Write implements io.Writer.
+func (errWriter) Write([]byte) (int, error) {
+	return 0, io.ErrClosedPipe
+}
+
+func TestWriter(t *testing.T) {
+	var testCases = map[string]struct {
+		blocking  bool
+		writeErr  bool
+		cancelled bool
+		expectN   int
+		expectErr error
+	}{
+		"write completes": {
+			expectN: 5,
+		},
+		"write fails": {
+			writeErr:  true,
+			expectErr: io.ErrClosedPipe,
+		},
+		"blocking writer": {
+			blocking:  true,
+			expectErr: sessionio.ErrWriteTimeout,
+		},
+		"cancelled context": {
+			cancelled: true,
+			expectErr: context.Canceled,
+		},
+		"blocking writer cancelled context": {
+			blocking:  true,
+			cancelled: true,
+			expectErr: context.Canceled,
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if tc.cancelled {
+				cancel()
+			}
+			var buf bytes.Buffer
+			var w io.Writer = &buf
+			if tc.blocking {
+				bw := &blockingWriter{unblock: make(chan struct{})}
+				defer close(bw.unblock)
+				w = bw
+			} else if tc.writeErr {
+				w = errWriter{}
+			}
+			n, err := sessionio.NewWriter(ctx, w, 50*time.Millisecond).
+				Write([]byte("hello"))
+			assert.Equal(tt, tc.expectN, n, name)
+			assert.True(tt, errors.Is(err, tc.expectErr), name)
+			if tc.expectErr == nil {
+				assert.Equal(tt, "hello", buf.String(), name)
+			}
+		})
+	}
+}
+
+func TestFprintfCancelledWhileBlocked(t *testing.T) {
+	bw := &blockingWriter{unblock: make(chan struct{})}
+	defer close(bw.unblock)
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+	start := time.Now()
+	_, err := sessionio.Fprintf(ctx, bw, "error executing command. SID: %s\r\n",
+		"abc123")
+	assert.Equal(t, context.Canceled, err)
+	assert.True(t, time.Since(start) < sessionio.DefaultTimeout)
+}
@@ -0,0 +1,138 @@
+// Package sessionlog constructs a structured logger with a canonical set of
+// fields for each SSH connection.
+package sessionlog
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/gliderlabs/ssh"
+)
+
+// Canonical field names used in SSH connection logs.
+const (
+	SessionIDKey       = "sessionID"
+	NamespaceKey       = "namespace"
+	SSHFingerprintKey  = "SSHFingerprint"
+	EnvironmentIDKey   = "environmentID"
+	EnvironmentNameKey = "environmentName"
+	ProjectIDKey       = "projectID"
+	ProjectNameKey     = "projectName"
+	UserUUIDKey        = "userUUID"
+	SessionTagKey      = "sessionTag"
+)
+
+// ctxKey is the key used to store the connection logger in the ssh.Context.
+type ctxKey struct{}
+
+// Fields contains the details of an SSH connection which are added to the
+// connection logger. Fields with a zero value are omitted.
+type Fields struct {
+	SessionID       string
+	Namespace       string
+	SSHFingerprint  string
+	EnvironmentID   int
+	EnvironmentName string
+	ProjectID       int
+	ProjectName     string
+	UserUUID        string
+}
+
+// attrs returns the non-zero fields as slog attributes in canonical order.
+func (f Fields) attrs() []any {
+	var attrs []any
+	if f.SessionID != "" {
+		attrs = append(attrs, slog.String(SessionIDKey, f.SessionID))
+	}
+	if f.Namespace != "" {
+		attrs = append(attrs, slog.String(NamespaceKey, f.Namespace))
+	}
+	if f.SSHFingerprint != "" {
+		attrs = append(attrs, slog.String(SSHFingerprintKey, f.SSHFingerprint))
+	}
+	if f.EnvironmentID != 0 {
+		attrs = append(attrs, slog.Int(EnvironmentIDKey, f.EnvironmentID))
+	}
+	if f.EnvironmentName != "" {
+		attrs = append(attrs, slog.String(EnvironmentNameKey, f.EnvironmentName))
+	}
+	if f.ProjectID != 0 {
+		attrs = append(attrs, slog.Int(ProjectIDKey, f.ProjectID))
+	}
+	if f.ProjectName != "" {
+		attrs = append(attrs, slog.String(ProjectNameKey, f.ProjectName))
+	}
+	if f.UserUUID != "" {
+		attrs = append(attrs, slog.String(UserUUIDKey, f.UserUUID))
+	}
+	return attrs
+}
+
+// New returns the connection logger stored in ctx. If there is no logger
+// stored in ctx, it derives one from log with the given fields, stores it in
+// ctx, and returns it.
+//
+// Since the logger is stored in the connection context, it is shared between
+// all sessions multiplexed over a single connection. This function should
+// only be called after authentication is complete, so that fields are only
+// populated from verified values.
+func New(ctx ssh.Context, log *slog.Logger, f Fields) *slog.Logger {
+	if connLog, ok := ctx.Value(ctxKey{}).(*slog.Logger); ok {
+		return connLog
+	}
+	connLog := log.With(f.attrs()...)
+	ctx.SetValue(ctxKey{}, connLog)
+	return connLog
+}
+
+// sessionContext is the context of a single session, which has a session
+// tag. It overrides the connection logger with one including the tag.
+type sessionContext struct {
+	ssh.Context
+	log *slog.Logger
+	tag string
+}
+
+// Value implements the context.Context interface.
+func (c *sessionContext) Value(key any) any {
+	if key == (ctxKey{}) {
+		return c.log
+	}
+	return c.Context.Value(key)
+}
+
+// WithSessionTag returns a copy of the session context ctx whose logger, as
+// returned by FromContext, includes the given client-provided session tag.
+// Since sessions multiplexed over a single connection may have different
+// tags, the returned context should only be used for the session which sent
+// the tag. If tag is empty, ctx is returned unchanged. This function should
+// only be called after New.
+func WithSessionTag(ctx ssh.Context, tag string) ssh.Context {
+	if tag == "" {
+		return ctx
+	}
+	return &sessionContext{
+		Context: ctx,
+		log:     FromContext(ctx).With(slog.String(SessionTagKey, tag)),
+		tag:     tag,
+	}
+}
+
+// SessionTag returns the session tag of a context returned by
+// WithSessionTag, or an empty string if ctx has no session tag.
+func SessionTag(ctx ssh.Context) string {
+	if c, ok := ctx.(*sessionContext); ok {
+		return c.tag
+	}
+	return ""
+}
+
+// FromContext returns the connection logger stored in ctx by New. ctx may be
+// the ssh.Context passed to New, or any context derived from it. If there is
+// no logger stored in ctx, it returns slog.Default().
+func FromContext(ctx context.Context) *slog.Logger {
+	if connLog, ok := ctx.Value(ctxKey{}).(*slog.Logger); ok {
+		return connLog
+	}
+	return slog.Default()
+}
@@ -0,0 +1,102 @@
+package sessionlog
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"testing"
+
+	"github.com/alecthomas/assert/v2"
+	"github.com/gliderlabs/ssh"
+)
+
+func TestFieldsAttrs(t *testing.T) {
+	var testCases = map[string]struct {
+		input  Fields
+		expect []string
+	}{
+		"ssh-portal": {
+			input: Fields{
+				SessionID:       "abc123",
+				Namespace:       "project-main",
+				SSHFingerprint:  "SHA256:foo",
+				EnvironmentID:   1,
+				EnvironmentName: "main",
+				ProjectID:       2,
+				ProjectName:     "project",
+			},
+			expect: []string{
+				SessionIDKey,
+				NamespaceKey,
+				SSHFingerprintKey,
+				EnvironmentIDKey,
+				EnvironmentNameKey,
+				ProjectIDKey,
+				ProjectNameKey,
+			},
+		},
+		"ssh-token": {
+			input: Fields{
+				SessionID:      "abc123",
+				SSHFingerprint: "SHA256:foo",
+				UserUUID:       "a-b-c",
+			},
+			expect: []string{
+				SessionIDKey,
+				SSHFingerprintKey,
+				UserUUIDKey,
+			},
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			var keys []string
+			for _, attr := range tc.input.attrs() {
+				keys = append(keys, attr.(slog.Attr).Key)
+			}
+			assert.Equal(tt, tc.expect, keys, name)
+		})
+	}
+}
+
+// testContext is an ssh.Context which only implements storing values.
+type testContext struct {
+	ssh.Context
+	values map[any]any
+}
+
+func (c *testContext) Value(key any) any {
+	return c.values[key]
+}
+
+func (c *testContext) SetValue(key, value any) {
+	c.values[key] = value
+}
+
+func TestWithSessionTag(t *testing.T) {
+	var buf bytes.Buffer
+	ctx := &testContext{values: map[any]any{}}
+	New(ctx, slog.New(slog.NewJSONHandler(&buf, nil)),
+		Fields{SessionID: "abc123"})
+	// an empty tag doesn't change the context
+	assert.True(t, WithSessionTag(ctx, "") == ssh.Context(ctx))
+	assert.Equal(t, "", SessionTag(ctx))
+	// the tagged logger includes the connection fields and the tag
+	tagged := WithSessionTag(ctx, "cli-1234")
+	assert.Equal(t, "cli-1234", SessionTag(tagged))
+	FromContext(tagged).Info("tagged")
+	FromContext(ctx).Info("untagged")
+	dec := json.NewDecoder(&buf)
+	var line map[string]any
+	assert.NoError(t, dec.Decode(&line))
+	assert.Equal[any](t, "tagged", line[slog.MessageKey])
+	assert.Equal[any](t, "abc123", line[SessionIDKey])
+	assert.Equal[any](t, "cli-1234", line[SessionTagKey])
+	// the connection logger is not changed
+	line = nil
+	assert.NoError(t, dec.Decode(&line))
+	assert.Equal[any](t, "untagged", line[slog.MessageKey])
+	assert.Equal[any](t, "abc123", line[SessionIDKey])
+	_, ok := line[SessionTagKey]
+	assert.False(t, ok)
+}
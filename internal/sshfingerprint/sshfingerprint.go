@@ -0,0 +1,52 @@
+// Package sshfingerprint normalises SSH public key fingerprints so that they
+// can be reliably compared with the fingerprints stored in the Lagoon API DB.
+package sshfingerprint
+
+import (
+	"encoding/base64"
+	"errors"
+	"regexp"
+	"strings"
+)
+
+const (
+	// prefix is the prefix of SHA256 fingerprints as generated by OpenSSH and
+	// gossh.FingerprintSHA256.
+	prefix = "SHA256:"
+	// sha256Len is the length in bytes of a SHA256 digest.
+	sha256Len = 32
+)
+
+var (
+	// md5Regex matches legacy MD5 fingerprints, with or without an MD5:
+	// prefix.
+	md5Regex = regexp.MustCompile(`^(?i:md5:)?[0-9a-fA-F]{2}(:[0-9a-fA-F]{2}){15}$`)
+)
+
+var (
+	// ErrMD5Fingerprint is returned when a legacy MD5 fingerprint is given.
+	ErrMD5Fingerprint = errors.New("MD5 fingerprints are not supported")
+	// ErrInvalidFingerprint is returned when the given fingerprint is not a
+	// valid SHA256 fingerprint.
+	ErrInvalidFingerprint = errors.New("invalid SHA256 fingerprint")
+)
+
+// Normalize returns the given SHA256 fingerprint in the canonical form
+// generated by gossh.FingerprintSHA256: a SHA256: prefix followed by the
+// unpadded base64 encoded digest. The SHA256: prefix and base64 padding are
+// optional in the given fingerprint.
+//
+// If the given fingerprint is a legacy MD5 fingerprint, ErrMD5Fingerprint is
+// returned. If it is otherwise invalid, ErrInvalidFingerprint is returned.
+func Normalize(fingerprint string) (string, error) {
+	fingerprint = strings.TrimSpace(fingerprint)
+	if md5Regex.MatchString(fingerprint) {
+		return "", ErrMD5Fingerprint
+	}
+	digest := strings.TrimRight(strings.TrimPrefix(fingerprint, prefix), "=")
+	raw, err := base64.RawStdEncoding.DecodeString(digest)
+	if err != nil || len(raw) != sha256Len {
+		return "", ErrInvalidFingerprint
+	}
+	return prefix + digest, nil
+}
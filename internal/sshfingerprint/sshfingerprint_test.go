@@ -0,0 +1,104 @@
+package sshfingerprint_test
+
+import (
+	"crypto/ed25519"
+	"testing"
+	"testing/quick"
+
+	"github.com/alecthomas/assert/v2"
+	"github.com/uselagoon/ssh-portal/internal/sshfingerprint"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+func TestNormalize(t *testing.T) {
+	var testCases = map[string]struct {
+		input     string
+		expect    string
+		expectErr error
+	}{
+		"canonical": {
+			input:  "SHA256:RFzBCUItH9LZS0cKB5UE6ceAYhBD5C8GeOBip8Z11+4",
+			expect: "SHA256:RFzBCUItH9LZS0cKB5UE6ceAYhBD5C8GeOBip8Z11+4",
+		},
+		"padded": {
+			input:  "SHA256:RFzBCUItH9LZS0cKB5UE6ceAYhBD5C8GeOBip8Z11+4=",
+			expect: "SHA256:RFzBCUItH9LZS0cKB5UE6ceAYhBD5C8GeOBip8Z11+4",
+		},
+		"no prefix": {
+			input:  "RFzBCUItH9LZS0cKB5UE6ceAYhBD5C8GeOBip8Z11+4",
+			expect: "SHA256:RFzBCUItH9LZS0cKB5UE6ceAYhBD5C8GeOBip8Z11+4",
+		},
+		"no prefix padded with whitespace": {
+			input:  " RFzBCUItH9LZS0cKB5UE6ceAYhBD5C8GeOBip8Z11+4=\n",
+			expect: "SHA256:RFzBCUItH9LZS0cKB5UE6ceAYhBD5C8GeOBip8Z11+4",
+		},
+		"md5": {
+			input:     "d0:4f:2b:8a:a5:8d:6c:15:d4:2f:1e:ab:2c:a3:0f:3b",
+			expectErr: sshfingerprint.ErrMD5Fingerprint,
+		},
+		"md5 prefix": {
+			input:     "MD5:D0:4F:2B:8A:A5:8D:6C:15:D4:2F:1E:AB:2C:A3:0F:3B",
+			expectErr: sshfingerprint.ErrMD5Fingerprint,
+		},
+		"empty": {
+			input:     "",
+			expectErr: sshfingerprint.ErrInvalidFingerprint,
+		},
+		"prefix only": {
+			input:     "SHA256:",
+			expectErr: sshfingerprint.ErrInvalidFingerprint,
+		},
+		"truncated": {
+			input:     "SHA256:RFzBCUItH9LZS0cKB5UE6ceAYhBD5C8GeOBip8Z11",
+			expectErr: sshfingerprint.ErrInvalidFingerprint,
+		},
+		"not base64": {
+			input:     "SHA256:RFzBCUItH9LZS0cKB5UE6ceAYhBD5C8GeOBip8Z11+!",
+			expectErr: sshfingerprint.ErrInvalidFingerprint,
+		},
+		"sql injection": {
+			input:     "SHA256:' OR 1=1 --",
+			expectErr: sshfingerprint.ErrInvalidFingerprint,
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			fingerprint, err := sshfingerprint.Normalize(tc.input)
+			assert.IsError(tt, err, tc.expectErr, name)
+			assert.Equal(tt, tc.expect, fingerprint, name)
+		})
+	}
+}
+
+func TestNormalizeRoundTrip(t *testing.T) {
+	// fingerprint returns the gossh fingerprint of the ed25519 key generated
+	// from the given seed.
+	fingerprint := func(seed [ed25519.SeedSize]byte) string {
+		key := ed25519.NewKeyFromSeed(seed[:]).Public()
+		sshKey, err := gossh.NewPublicKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return gossh.FingerprintSHA256(sshKey)
+	}
+	var testCases = map[string]func(string) string{
+		"canonical": func(fp string) string { return fp },
+		"padded":    func(fp string) string { return fp + "=" },
+		"no prefix": func(fp string) string { return fp[len("SHA256:"):] },
+		"no prefix padded": func(fp string) string {
+			return fp[len("SHA256:"):] + "="
+		},
+	}
+	for name, mangle := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			property := func(seed [ed25519.SeedSize]byte) bool {
+				fp := fingerprint(seed)
+				normalized, err := sshfingerprint.Normalize(mangle(fp))
+				return err == nil && normalized == fp
+			}
+			if err := quick.Check(property, nil); err != nil {
+				tt.Fatal(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,243 @@
+package sshportalapi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/uselagoon/ssh-portal/internal/breaker"
+	"github.com/uselagoon/ssh-portal/internal/keycloak"
+	"github.com/uselagoon/ssh-portal/internal/lagoon"
+	"github.com/uselagoon/ssh-portal/internal/lagoondb"
+	"github.com/uselagoon/ssh-portal/internal/rbac"
+)
+
+// Breakers contains the circuit breakers which guard calls to the backends
+// of ssh-portal-api. While either breaker is open, queries which depend on
+// the backends are denied immediately with reason
+// bus.ReasonBackendUnavailable. A nil *Breakers never denies queries.
+type Breakers struct {
+	Keycloak *breaker.Breaker
+	LagoonDB *breaker.Breaker
+}
+
+// NewBreakers returns Breakers which open after threshold consecutive
+// failed calls to a backend, and stay open for the given cool-down period.
+// The state of each breaker is exported via m. A zero threshold disables the
+// breakers.
+func NewBreakers(
+	m *Metrics,
+	threshold int,
+	coolDown time.Duration,
+) (*Breakers, error) {
+	var b Breakers
+	for backend, dst := range map[string]**breaker.Breaker{
+		"keycloak": &b.Keycloak,
+		"lagoondb": &b.LagoonDB,
+	} {
+		gauge := m.breakerState.WithLabelValues(backend)
+		gauge.Set(float64(breaker.Closed))
+		cb, err := breaker.New(threshold, coolDown,
+			breaker.OnStateChange(func(s breaker.State) {
+				gauge.Set(float64(s))
+			}))
+		if err != nil {
+			return nil, fmt.Errorf("couldn't init %s circuit breaker: %v",
+				backend, err)
+		}
+		*dst = cb
+	}
+	return &b, nil
+}
+
+// open returns true if either breaker is open.
+func (b *Breakers) open() bool {
+	return b != nil &&
+		(b.Keycloak.State() == breaker.Open || b.LagoonDB.State() == breaker.Open)
+}
+
+// guard calls fn if the breaker allows it, and reports the result to the
+// breaker. Errors for which expected returns true indicate a healthy backend,
+// and are not counted as failures. A panic in fn is counted as a failure, so
+// that the breaker isn't left waiting for the result of a probe.
+func guard(
+	b *breaker.Breaker,
+	expected func(error) bool,
+	fn func() error,
+) (err error) {
+	if err = b.Allow(); err != nil {
+		return err
+	}
+	success := false
+	defer func() { b.Done(success) }()
+	err = fn()
+	success = err == nil || expected(err) || errors.Is(err, context.Canceled)
+	return err
+}
+
+// noResult returns true if err indicates that a Lagoon API DB query had no
+// result.
+func noResult(err error) bool {
+	return errors.Is(err, lagoondb.ErrNoResult)
+}
+
+// userNotFound returns true if err indicates that a user doesn't exist in
+// Keycloak.
+func userNotFound(err error) bool {
+	return errors.Is(err, keycloak.ErrUserNotFound)
+}
+
+// LagoonDBBackend is the Lagoon API DB client used by both ssh-portal-api and
+// its RBAC permission engine.
+type LagoonDBBackend interface {
+	LagoonDBService
+	rbac.LagoonDBService
+}
+
+// breakerLagoonDB wraps a LagoonDBBackend with a circuit breaker.
+type breakerLagoonDB struct {
+	ldb LagoonDBBackend
+	b   *breaker.Breaker
+}
+
+// GuardLagoonDB wraps ldb so that calls to it are guarded by the given
+// circuit breaker. While the breaker is open, calls return breaker.ErrOpen
+// without querying the database.
+func GuardLagoonDB(ldb LagoonDBBackend, b *breaker.Breaker) LagoonDBBackend {
+	return &breakerLagoonDB{ldb: ldb, b: b}
+}
+
+// EnvironmentByNamespaceName implements LagoonDBService.
+func (g *breakerLagoonDB) EnvironmentByNamespaceName(
+	ctx context.Context,
+	name string,
+) (*lagoondb.Environment, error) {
+	var env *lagoondb.Environment
+	err := guard(g.b, noResult, func() error {
+		var err error
+		env, err = g.ldb.EnvironmentByNamespaceName(ctx, name)
+		return err
+	})
+	return env, err
+}
+
+// UserBySSHFingerprint implements LagoonDBService.
+func (g *breakerLagoonDB) UserBySSHFingerprint(
+	ctx context.Context,
+	fingerprint string,
+) (*lagoondb.User, error) {
+	var user *lagoondb.User
+	err := guard(g.b, noResult, func() error {
+		var err error
+		user, err = g.ldb.UserBySSHFingerprint(ctx, fingerprint)
+		return err
+	})
+	return user, err
+}
+
+// SSHKeyUsed implements LagoonDBService.
+func (g *breakerLagoonDB) SSHKeyUsed(
+	ctx context.Context,
+	fingerprint string,
+	used time.Time,
+) error {
+	return guard(g.b, noResult, func() error {
+		return g.ldb.SSHKeyUsed(ctx, fingerprint, used)
+	})
+}
+
+// SSHEndpointByEnvironmentID implements LagoonDBService.
+func (g *breakerLagoonDB) SSHEndpointByEnvironmentID(
+	ctx context.Context,
+	envID int,
+) (string, string, error) {
+	var host, port string
+	err := guard(g.b, noResult, func() error {
+		var err error
+		host, port, err = g.ldb.SSHEndpointByEnvironmentID(ctx, envID)
+		return err
+	})
+	return host, port, err
+}
+
+// ProjectGroupIDs implements rbac.LagoonDBService.
+func (g *breakerLagoonDB) ProjectGroupIDs(
+	ctx context.Context,
+	projectID int,
+) ([]uuid.UUID, error) {
+	var groupIDs []uuid.UUID
+	err := guard(g.b, noResult, func() error {
+		var err error
+		groupIDs, err = g.ldb.ProjectGroupIDs(ctx, projectID)
+		return err
+	})
+	return groupIDs, err
+}
+
+// breakerKeycloak wraps an rbac.KeycloakService with a circuit breaker.
+type breakerKeycloak struct {
+	k rbac.KeycloakService
+	b *breaker.Breaker
+}
+
+// GuardKeycloak wraps k so that calls to it are guarded by the given circuit
+// breaker. While the breaker is open, calls return breaker.ErrOpen without
+// querying Keycloak.
+func GuardKeycloak(
+	k rbac.KeycloakService,
+	b *breaker.Breaker,
+) rbac.KeycloakService {
+	return &breakerKeycloak{k: k, b: b}
+}
+
+// AncestorGroups implements rbac.KeycloakService.
+func (g *breakerKeycloak) AncestorGroups(
+	ctx context.Context,
+	groups []uuid.UUID,
+) ([]uuid.UUID, error) {
+	var ancestors []uuid.UUID
+	err := guard(g.b, userNotFound, func() error {
+		var err error
+		ancestors, err = g.k.AncestorGroups(ctx, groups)
+		return err
+	})
+	return ancestors, err
+}
+
+// UserGroupIDRole implements rbac.KeycloakService. The wrapped method
+// doesn't report errors, so its calls can't be counted by the breaker. It
+// returns no roles while the breaker is open.
+func (g *breakerKeycloak) UserGroupIDRole(
+	ctx context.Context,
+	groupPaths []string,
+) map[uuid.UUID]lagoon.UserRole {
+	if g.b.State() == breaker.Open {
+		return map[uuid.UUID]lagoon.UserRole{}
+	}
+	return g.k.UserGroupIDRole(ctx, groupPaths)
+}
+
+// HasChildGroups implements rbac.ChildGroupService. It doesn't query
+// Keycloak, so it isn't guarded by the breaker.
+func (g *breakerKeycloak) HasChildGroups(
+	ctx context.Context,
+	groupIDs []uuid.UUID,
+) bool {
+	return rbac.HasChildGroups(ctx, g.k, groupIDs)
+}
+
+// UserRolesAndGroups implements rbac.KeycloakService.
+func (g *breakerKeycloak) UserRolesAndGroups(
+	ctx context.Context,
+	userUUID uuid.UUID,
+) ([]string, []string, error) {
+	var roles, groups []string
+	err := guard(g.b, userNotFound, func() error {
+		var err error
+		roles, groups, err = g.k.UserRolesAndGroups(ctx, userUUID)
+		return err
+	})
+	return roles, groups, err
+}
@@ -0,0 +1,247 @@
+package sshportalapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/assert/v2"
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/uselagoon/ssh-portal/internal/breaker"
+	"github.com/uselagoon/ssh-portal/internal/bus"
+	"github.com/uselagoon/ssh-portal/internal/keycloak"
+	"github.com/uselagoon/ssh-portal/internal/lagoon"
+	"github.com/uselagoon/ssh-portal/internal/lagoondb"
+	"github.com/uselagoon/ssh-portal/internal/rbac"
+)
+
+var errBackend = errors.New("backend down")
+
+// fakeLagoonDB is a LagoonDBBackend which counts calls, and returns err from
+// each call.
+type fakeLagoonDB struct {
+	calls int
+	err   error
+	user  uuid.UUID
+}
+
+func (f *fakeLagoonDB) EnvironmentByNamespaceName(
+	context.Context,
+	string,
+) (*lagoondb.Environment, error) {
+	f.calls++
+	if f.err != nil {
+		return nil, f.err
+	}
+	return &lagoondb.Environment{ID: 2, ProjectID: 1, Type: lagoon.Production},
+		nil
+}
+
+func (f *fakeLagoonDB) UserBySSHFingerprint(
+	context.Context,
+	string,
+) (*lagoondb.User, error) {
+	f.calls++
+	if f.err != nil {
+		return nil, f.err
+	}
+	return &lagoondb.User{UUID: &f.user}, nil
+}
+
+func (f *fakeLagoonDB) SSHKeyUsed(context.Context, string, time.Time) error {
+	f.calls++
+	return f.err
+}
+
+func (f *fakeLagoonDB) SSHEndpointByEnvironmentID(
+	context.Context,
+	int,
+) (string, string, error) {
+	f.calls++
+	return "", "", f.err
+}
+
+func (f *fakeLagoonDB) ProjectGroupIDs(
+	context.Context,
+	int,
+) ([]uuid.UUID, error) {
+	f.calls++
+	return nil, f.err
+}
+
+// fakeKeycloak is an rbac.KeycloakService which counts calls, and returns err
+// from each call.
+type fakeKeycloak struct {
+	calls int
+	err   error
+}
+
+func (f *fakeKeycloak) AncestorGroups(
+	context.Context,
+	[]uuid.UUID,
+) ([]uuid.UUID, error) {
+	f.calls++
+	return nil, f.err
+}
+
+func (f *fakeKeycloak) UserGroupIDRole(
+	context.Context,
+	[]string,
+) map[uuid.UUID]lagoon.UserRole {
+	f.calls++
+	return map[uuid.UUID]lagoon.UserRole{}
+}
+
+func (f *fakeKeycloak) UserRolesAndGroups(
+	context.Context,
+	uuid.UUID,
+) ([]string, []string, error) {
+	f.calls++
+	return nil, nil, f.err
+}
+
+func TestBreakerFastFail(t *testing.T) {
+	log := slog.New(slog.NewJSONHandler(os.Stderr, nil))
+	fingerprint := "SHA256:NtOIKkyGp6ubsA4F2PDr1EltRRj4Rx+KZ1YYPrzIzE8"
+	unavailable, err := accessResponse(
+		rbac.Decision{Reason: bus.ReasonBackendUnavailable})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var testCases = map[string]struct {
+		subject string
+		ldbErr  error
+		kcErr   error
+		backend string
+		expect  []byte
+	}{
+		"lagoondb down": {
+			subject: bus.SubjectSSHAccessQuery,
+			ldbErr:  errBackend,
+			backend: "lagoondb",
+			expect:  unavailable,
+		},
+		"keycloak down": {
+			subject: bus.SubjectSSHAccessQuery,
+			kcErr:   errBackend,
+			backend: "keycloak",
+			expect:  unavailable,
+		},
+		"legacy keycloak down": {
+			subject: bus.SubjectLegacySSHAccessQuery,
+			kcErr:   errBackend,
+			backend: "keycloak",
+			expect:  falseResponse,
+		},
+		"user info lagoondb down": {
+			subject: bus.SubjectUserInfoQuery,
+			ldbErr:  errBackend,
+			backend: "lagoondb",
+			expect:  []byte(`{"Reason":"backend-unavailable"}`),
+		},
+		"user info keycloak down": {
+			subject: bus.SubjectUserInfoQuery,
+			kcErr:   errBackend,
+			backend: "keycloak",
+			expect:  []byte(`{"Reason":"backend-unavailable"}`),
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			m := NewMetrics(prometheus.NewRegistry())
+			breakers, err := NewBreakers(m, 1, time.Minute)
+			assert.NoError(tt, err, name)
+			ldb := &fakeLagoonDB{err: tc.ldbErr, user: uuid.New()}
+			kc := &fakeKeycloak{err: tc.kcErr}
+			guardedLDB := GuardLagoonDB(ldb, breakers.LagoonDB)
+			p := rbac.NewPermission(GuardKeycloak(kc, breakers.Keycloak),
+				guardedLDB)
+			pub := &recordingPublisher{}
+			handler := sshportal(context.Background(), log, m, pub, p,
+				guardedLDB, breakers)
+			if tc.subject == bus.SubjectUserInfoQuery {
+				handler = userinfo(context.Background(), log, m, pub, p,
+					guardedLDB, breakers)
+			}
+			query, err := json.Marshal(bus.SSHAccessQuery{
+				SSHFingerprint: fingerprint,
+				NamespaceName:  "project-test",
+			})
+			if err != nil {
+				tt.Fatal(err)
+			}
+			gauge := m.breakerState.WithLabelValues(tc.backend)
+			assert.Equal(tt, float64(breaker.Closed), testutil.ToFloat64(gauge),
+				name)
+			// the first query fails and opens the breaker
+			handler(&nats.Msg{Subject: tc.subject, Reply: "_INBOX.test",
+				Data: query})
+			assert.Equal(tt, float64(breaker.Open), testutil.ToFloat64(gauge),
+				name)
+			// subsequent queries fail fast without calling the backends
+			ldbCalls, kcCalls := ldb.calls, kc.calls
+			pub.data = nil
+			handler(&nats.Msg{Subject: tc.subject, Reply: "_INBOX.test",
+				Data: query})
+			assert.Equal(tt, string(tc.expect), string(pub.data), name)
+			assert.Equal(tt, ldbCalls, ldb.calls, name)
+			assert.Equal(tt, kcCalls, kc.calls, name)
+		})
+	}
+}
+
+func TestBreakerExpectedErrors(t *testing.T) {
+	m := NewMetrics(prometheus.NewRegistry())
+	breakers, err := NewBreakers(m, 1, time.Minute)
+	assert.NoError(t, err)
+	ldb := GuardLagoonDB(&fakeLagoonDB{err: lagoondb.ErrNoResult},
+		breakers.LagoonDB)
+	kc := GuardKeycloak(&fakeKeycloak{err: keycloak.ErrUserNotFound},
+		breakers.Keycloak)
+	// errors which indicate a healthy backend don't open the breakers
+	for range 3 {
+		_, err = ldb.UserBySSHFingerprint(context.Background(), "")
+		assert.IsError(t, err, lagoondb.ErrNoResult)
+		_, _, err = kc.UserRolesAndGroups(context.Background(), uuid.New())
+		assert.IsError(t, err, keycloak.ErrUserNotFound)
+	}
+	assert.Equal(t, breaker.Closed, breakers.LagoonDB.State())
+	assert.Equal(t, breaker.Closed, breakers.Keycloak.State())
+	assert.False(t, breakers.open())
+	// while open, calls return breaker.ErrOpen
+	ldb = GuardLagoonDB(&fakeLagoonDB{err: errBackend}, breakers.LagoonDB)
+	_, err = ldb.UserBySSHFingerprint(context.Background(), "")
+	assert.IsError(t, err, errBackend)
+	_, err = ldb.UserBySSHFingerprint(context.Background(), "")
+	assert.IsError(t, err, breaker.ErrOpen)
+	assert.True(t, breakers.open())
+}
+
+func TestGuardPanic(t *testing.T) {
+	now := time.Unix(0, 0)
+	b, err := breaker.New(1, time.Minute,
+		breaker.Clock(func() time.Time { return now }))
+	assert.NoError(t, err)
+	// open the breaker, and wait for the cool-down to allow a probe
+	assert.IsError(t, guard(b, noResult, func() error { return errBackend }),
+		errBackend)
+	assert.Equal(t, breaker.Open, b.State())
+	now = now.Add(time.Minute)
+	// a panic during the probe is counted as a failure
+	func() {
+		defer func() { assert.NotZero(t, recover()) }()
+		_ = guard(b, noResult, func() error { panic("probe panicked") })
+	}()
+	assert.Equal(t, breaker.Open, b.State())
+	// so the next probe is allowed after the cool-down
+	now = now.Add(time.Minute)
+	assert.NoError(t, guard(b, noResult, func() error { return nil }))
+	assert.Equal(t, breaker.Closed, b.State())
+}
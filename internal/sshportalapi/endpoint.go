@@ -0,0 +1,102 @@
+package sshportalapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+
+	"github.com/nats-io/nats.go"
+	"github.com/uselagoon/ssh-portal/internal/bus"
+	"github.com/uselagoon/ssh-portal/internal/lagoondb"
+	"go.opentelemetry.io/otel"
+)
+
+// replySSHEndpoint replies to msg with the given SSH endpoint response.
+// Replies are only sent if msg has a reply subject.
+func replySSHEndpoint(
+	log *slog.Logger,
+	c publisher,
+	msg *nats.Msg,
+	response bus.SSHEndpointResponse,
+) {
+	if msg.Reply == "" {
+		return
+	}
+	data, err := json.Marshal(response)
+	if err != nil {
+		log.Error("couldn't marshal response", slog.Any("error", err))
+		return
+	}
+	if err = c.Publish(msg.Reply, data); err != nil {
+		log.Error("couldn't publish reply", slog.Any("error", err))
+	}
+}
+
+// sshEndpoint returns a nats.MsgHandler which answers SSH endpoint queries.
+// This allows ssh-token to redirect users to the ssh-portal serving their
+// environment without access to the Lagoon API DB. The SSH endpoint of an
+// environment is not sensitive, so no authorization is required.
+func sshEndpoint(
+	ctx context.Context,
+	log *slog.Logger,
+	m *Metrics,
+	c publisher,
+	ldb LagoonDBService,
+) nats.MsgHandler {
+	return func(msg *nats.Msg) {
+		// set up tracing and update metrics
+		ctx, span := otel.Tracer(pkgName).Start(ctx, msg.Subject)
+		defer span.End()
+		m.requestsTotal.WithLabelValues(msg.Subject).Inc()
+		log := log.With(slog.String("subject", msg.Subject))
+		invalid := bus.SSHEndpointResponse{Reason: bus.ReasonInvalidQuery}
+		// reject oversized queries before parsing them
+		if len(msg.Data) > maxQueryBytes {
+			m.rejectedQueriesTotal.WithLabelValues("oversized").Inc()
+			log.Warn("oversized endpoint query", slog.Int("bytes", len(msg.Data)))
+			replySSHEndpoint(log, c, msg, invalid)
+			return
+		}
+		query, unknownFields, err := decodeQuery[bus.SSHEndpointQuery](msg.Data)
+		if err != nil {
+			m.rejectedQueriesTotal.WithLabelValues("malformed").Inc()
+			log.Warn("couldn't decode query",
+				slog.Any("query", msg.Data),
+				slog.Any("error", err))
+			replySSHEndpoint(log, c, msg, invalid)
+			return
+		}
+		log = log.With(slog.Any("query", query))
+		if unknownFields {
+			log.Debug("ignoring unknown fields in endpoint query")
+		}
+		if query.EnvironmentID < 1 {
+			m.rejectedQueriesTotal.WithLabelValues("invalid").Inc()
+			log.Warn("invalid endpoint query")
+			replySSHEndpoint(log, c, msg, invalid)
+			return
+		}
+		host, port, err :=
+			ldb.SSHEndpointByEnvironmentID(ctx, query.EnvironmentID)
+		if err != nil {
+			if errors.Is(err, lagoondb.ErrNoResult) {
+				log.Debug("unknown environment ID", slog.Any("error", err))
+				replySSHEndpoint(log, c, msg, bus.SSHEndpointResponse{
+					Reason: bus.ReasonUnknownEnvironment,
+				})
+				return
+			}
+			log.Error("couldn't get ssh endpoint by environment ID",
+				slog.Any("error", err))
+			return
+		}
+		log.Debug("ssh endpoint resolved",
+			slog.String("sshHost", host),
+			slog.String("sshPort", port))
+		replySSHEndpoint(log, c, msg, bus.SSHEndpointResponse{
+			Host: host,
+			Port: port,
+		})
+	}
+}
@@ -0,0 +1,105 @@
+package sshportalapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"testing"
+
+	"github.com/alecthomas/assert/v2"
+	"github.com/nats-io/nats.go"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/uselagoon/ssh-portal/internal/bus"
+	"github.com/uselagoon/ssh-portal/internal/lagoondb"
+	"go.uber.org/mock/gomock"
+)
+
+func TestSSHEndpoint(t *testing.T) {
+	log := slog.New(slog.NewJSONHandler(os.Stderr, nil))
+	var testCases = map[string]struct {
+		query       string
+		dbErr       error
+		expectReply bool
+		expect      bus.SSHEndpointResponse
+		expectCount string
+	}{
+		"resolved": {
+			query:       `{"EnvironmentID":2}`,
+			expectReply: true,
+			expect: bus.SSHEndpointResponse{
+				Host: "ssh.example.com",
+				Port: "22",
+			},
+		},
+		"unknown environment": {
+			query:       `{"EnvironmentID":2}`,
+			dbErr:       lagoondb.ErrNoResult,
+			expectReply: true,
+			expect: bus.SSHEndpointResponse{
+				Reason: bus.ReasonUnknownEnvironment,
+			},
+		},
+		"lagoon db error": {
+			query: `{"EnvironmentID":2}`,
+			dbErr: errors.New("connection refused"),
+		},
+		"invalid environment ID": {
+			query:       `{"EnvironmentID":0}`,
+			expectReply: true,
+			expect:      bus.SSHEndpointResponse{Reason: bus.ReasonInvalidQuery},
+			expectCount: "invalid",
+		},
+		"malformed query": {
+			query:       `{"EnvironmentID":"2"}`,
+			expectReply: true,
+			expect:      bus.SSHEndpointResponse{Reason: bus.ReasonInvalidQuery},
+			expectCount: "malformed",
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			ctrl := gomock.NewController(tt)
+			ldbService := NewMockLagoonDBService(ctrl)
+			m := NewMetrics(prometheus.NewRegistry())
+			pub := &recordingPublisher{}
+			// configure mocks
+			if tc.expectCount == "" {
+				ldbService.EXPECT().SSHEndpointByEnvironmentID(gomock.Any(), 2).
+					Return("ssh.example.com", "22", tc.dbErr)
+			}
+			// execute
+			handler :=
+				sshEndpoint(context.Background(), log, m, pub, ldbService)
+			handler(&nats.Msg{
+				Subject: bus.SubjectSSHEndpointQuery,
+				Reply:   "_INBOX.test",
+				Data:    []byte(tc.query),
+			})
+			// check the response and metrics
+			if tc.expectReply {
+				assert.Equal(tt, "_INBOX.test", pub.subject, name)
+				var response bus.SSHEndpointResponse
+				if err := json.Unmarshal(pub.data, &response); err != nil {
+					tt.Fatalf("error unmarshaling data %s: %v", pub.data, err)
+				}
+				assert.Equal(tt, tc.expect, response, name)
+			} else {
+				assert.Equal(tt, "", pub.subject, name)
+			}
+			assert.Equal(tt, 1.0, testutil.ToFloat64(
+				m.requestsTotal.WithLabelValues(bus.SubjectSSHEndpointQuery)),
+				name)
+			for _, reason := range []string{"oversized", "malformed", "invalid"} {
+				var expect float64
+				if reason == tc.expectCount {
+					expect = 1
+				}
+				assert.Equal(tt, expect, testutil.ToFloat64(
+					m.rejectedQueriesTotal.WithLabelValues(reason)), name)
+			}
+		})
+	}
+}
@@ -0,0 +1,58 @@
+package sshportalapi
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Metrics contains the Prometheus metrics exported by the ssh-portal-api
+// service.
+type Metrics struct {
+	requestsTotal          *prometheus.CounterVec
+	rejectedQueriesTotal   *prometheus.CounterVec
+	coalescedRequestsTotal prometheus.Counter
+	workerPanicsTotal      prometheus.Counter
+	idMismatchTotal        prometheus.Counter
+	workersBusy            prometheus.Gauge
+	breakerState           *prometheus.GaugeVec
+	stageDuration          *prometheus.HistogramVec
+}
+
+// NewMetrics creates the ssh-portal-api metrics and registers them with reg.
+func NewMetrics(reg prometheus.Registerer) *Metrics {
+	factory := promauto.With(reg)
+	return &Metrics{
+		requestsTotal: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "sshportalapi_requests_total",
+			Help: "The total number of ssh-portal-api requests received",
+		}, []string{"subject"}),
+		rejectedQueriesTotal: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "sshportalapi_rejected_queries_total",
+			Help: "The total number of ssh-portal-api queries rejected before processing",
+		}, []string{"reason"}),
+		coalescedRequestsTotal: factory.NewCounter(prometheus.CounterOpts{
+			Name: "sshportalapi_coalesced_requests_total",
+			Help: "The total number of ssh-portal-api requests answered by sharing the evaluation of a concurrent identical request",
+		}),
+		workerPanicsTotal: factory.NewCounter(prometheus.CounterOpts{
+			Name: "sshportalapi_worker_panics_total",
+			Help: "The total number of panics recovered in ssh-portal-api workers",
+		}),
+		idMismatchTotal: factory.NewCounter(prometheus.CounterOpts{
+			Name: "sshportal_api_id_mismatch_total",
+			Help: "The total number of SSH access queries denied because the project or environment ID doesn't match the Lagoon API DB",
+		}),
+		workersBusy: factory.NewGauge(prometheus.GaugeOpts{
+			Name: "sshportalapi_workers_busy",
+			Help: "Current number of ssh-portal-api workers processing a request",
+		}),
+		breakerState: factory.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "sshportalapi_circuit_breaker_state",
+			Help: "Current state of the circuit breaker guarding each ssh-portal-api backend (0=closed, 1=half-open, 2=open)",
+		}, []string{"backend"}),
+		stageDuration: factory.NewHistogramVec(prometheus.HistogramOpts{
+			Name: "sshportalapi_stage_duration_seconds",
+			Help: "Time taken by each stage of ssh-portal-api queries which calls the Keycloak API or the Lagoon API DB",
+		}, []string{"stage"}),
+	}
+}
@@ -0,0 +1,59 @@
+package sshportalapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/uselagoon/ssh-portal/internal/bus"
+	"github.com/uselagoon/ssh-portal/internal/sshfingerprint"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// maxQueryBytes is the maximum accepted size of a query payload. Queries are
+// small JSON objects, so larger payloads are rejected without being parsed.
+const maxQueryBytes = 4096
+
+// decodeQuery decodes the given payload as a query of type T. Unknown fields
+// are ignored so that newer clients can add fields, but their presence is
+// indicated by the returned bool.
+func decodeQuery[T any](data []byte) (T, bool, error) {
+	var query, zero T
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	err := dec.Decode(&query)
+	if err != nil {
+		// encoding/json doesn't export an error type for unknown fields
+		if !strings.HasPrefix(err.Error(), "json: unknown field ") {
+			return zero, false, err
+		}
+		query = zero
+		if err = json.Unmarshal(data, &query); err != nil {
+			return zero, false, err
+		}
+		return query, true, nil
+	}
+	if dec.More() {
+		return zero, false, errors.New("unexpected data after query")
+	}
+	return query, false, nil
+}
+
+// validateQuery checks the fields of the given query, and returns its SSH
+// fingerprint normalised to match the Lagoon API DB.
+func validateQuery(query bus.SSHAccessQuery) (string, error) {
+	fingerprint, err := sshfingerprint.Normalize(query.SSHFingerprint)
+	if err != nil {
+		return "", err
+	}
+	if errs := validation.IsDNS1123Label(query.NamespaceName); len(errs) > 0 {
+		return "", fmt.Errorf("invalid namespace name: %v", errs)
+	}
+	if query.ProjectID < 0 || query.EnvironmentID < 0 {
+		return "", fmt.Errorf("invalid project ID %d or environment ID %d",
+			query.ProjectID, query.EnvironmentID)
+	}
+	return fingerprint, nil
+}
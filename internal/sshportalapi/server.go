@@ -6,6 +6,7 @@ import (
 	"context"
 	"fmt"
 	"log/slog"
+	"slices"
 	"sync"
 	"time"
 
@@ -18,6 +19,9 @@ import (
 const (
 	queue   = "sshportalapi"
 	pkgName = "github.com/uselagoon/ssh-portal/internal/sshportalapi"
+	// subscriptionDrainTimeout is the maximum time to wait for pending
+	// messages to be delivered to the worker pool during shutdown.
+	subscriptionDrainTimeout = 30 * time.Second
 )
 
 // LagoonDBService provides methods for querying the Lagoon API DB.
@@ -25,17 +29,39 @@ type LagoonDBService interface {
 	EnvironmentByNamespaceName(context.Context, string) (*lagoondb.Environment, error)
 	UserBySSHFingerprint(context.Context, string) (*lagoondb.User, error)
 	SSHKeyUsed(context.Context, string, time.Time) error
+	SSHEndpointByEnvironmentID(context.Context, int) (string, string, error)
 }
 
-// ServeNATS sshportalapi NATS requests.
+// ServeNATS sshportalapi NATS requests on each of the given subjects.
+// Requests are processed concurrently by the given number of workers.
+//
+// Serving several subjects allows clients to migrate between subjects without
+// a flag day. Requests on bus.SubjectLegacySSHAccessQuery are answered in the
+// legacy format. User info queries are also served on
+// bus.SubjectUserInfoQuery, and SSH endpoint queries on
+// bus.SubjectSSHEndpointQuery.
+//
+// Access and user info queries are denied with reason
+// bus.ReasonBackendUnavailable while any of the given breakers is open. Pass
+// a nil breakers to disable this.
+//
+// On shutdown, ServeNATS stops receiving requests and finishes processing
+// any in-flight requests before draining the NATS connection.
 func ServeNATS(
 	ctx context.Context,
 	stop context.CancelFunc,
 	log *slog.Logger,
+	m *Metrics,
 	p *rbac.Permission,
 	ldb LagoonDBService,
+	breakers *Breakers,
 	natsURL string,
+	subjects []string,
+	workers uint,
 ) error {
+	if len(subjects) == 0 {
+		return fmt.Errorf("no NATS subjects to serve")
+	}
 	// setup synchronisation
 	wg := sync.WaitGroup{}
 	wg.Add(1)
@@ -58,17 +84,67 @@ func ServeNATS(
 		return fmt.Errorf("couldn't connect to NATS server: %v", err)
 	}
 	defer nc.Close()
-	// configure callback
-	_, err = nc.QueueSubscribe(
-		bus.SubjectSSHAccessQuery,
-		queue,
-		sshportal(ctx, log, nc, p, ldb),
-	)
-	if err != nil {
-		return fmt.Errorf("couldn't subscribe to queue: %v", err)
+	// configure callback. in-flight requests are allowed to complete after
+	// ctx is cancelled, so the handler context is not cancelled with ctx.
+	accessHandler :=
+		sshportal(context.WithoutCancel(ctx), log, m, nc, p, ldb, breakers)
+	userInfoHandler :=
+		userinfo(context.WithoutCancel(ctx), log, m, nc, p, ldb, breakers)
+	endpointHandler := sshEndpoint(context.WithoutCancel(ctx), log, m, nc, ldb)
+	pool := newWorkerPool(log, m, func(msg *nats.Msg) {
+		switch msg.Subject {
+		case bus.SubjectUserInfoQuery:
+			userInfoHandler(msg)
+		case bus.SubjectSSHEndpointQuery:
+			endpointHandler(msg)
+		default:
+			accessHandler(msg)
+		}
+	}, workers)
+	subjects = slices.Clone(subjects)
+	for _, subject := range []string{
+		bus.SubjectUserInfoQuery,
+		bus.SubjectSSHEndpointQuery,
+	} {
+		if !slices.Contains(subjects, subject) {
+			subjects = append(subjects, subject)
+		}
+	}
+	var subs []*nats.Subscription
+	for _, subject := range subjects {
+		sub, err := nc.QueueSubscribe(subject, queue, pool.handle)
+		if err != nil {
+			for _, sub := range subs {
+				_ = sub.Unsubscribe()
+			}
+			pool.stop()
+			return fmt.Errorf("couldn't subscribe to queue: %v", err)
+		}
+		log.Info("subscribed to subject", slog.String("subject", subject))
+		subs = append(subs, sub)
 	}
 	// wait for context cancellation
 	<-ctx.Done()
+	// stop receiving requests, and wait for pending requests to be handed to
+	// the worker pool
+	drainDeadline := time.Now().Add(subscriptionDrainTimeout)
+	for _, sub := range subs {
+		subClosed := sub.StatusChanged(nats.SubscriptionClosed)
+		if err := sub.Drain(); err != nil {
+			log.Warn("couldn't drain subscription",
+				slog.String("subject", sub.Subject),
+				slog.Any("error", err))
+			continue
+		}
+		select {
+		case <-subClosed:
+		case <-time.After(time.Until(drainDeadline)):
+			log.Warn("timed out draining subscription",
+				slog.String("subject", sub.Subject))
+		}
+	}
+	// wait for in-flight requests to complete
+	pool.stop()
 	// drain and log errors
 	if err := nc.Drain(); err != nil {
 		log.Warn("couldn't drain connection", slog.Any("error", err))
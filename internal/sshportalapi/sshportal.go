@@ -4,23 +4,18 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"log/slog"
+	"strings"
 	"time"
 
 	"github.com/nats-io/nats.go"
-	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/uselagoon/ssh-portal/internal/breaker"
 	"github.com/uselagoon/ssh-portal/internal/bus"
 	"github.com/uselagoon/ssh-portal/internal/lagoondb"
 	"github.com/uselagoon/ssh-portal/internal/rbac"
 	"go.opentelemetry.io/otel"
-)
-
-var (
-	requestsCounter = promauto.NewCounter(prometheus.CounterOpts{
-		Name: "sshportalapi_requests_total",
-		Help: "The total number of ssh-portal-api requests received",
-	})
+	"golang.org/x/sync/singleflight"
 )
 
 var (
@@ -28,103 +23,325 @@ var (
 	trueResponse  = []byte(`true`)
 )
 
+// publisher publishes NATS messages. It is implemented by *nats.Conn.
+type publisher interface {
+	Publish(subject string, data []byte) error
+}
+
+// accessResponse returns the encoded SSH access response for the given
+// decision.
+func accessResponse(decision rbac.Decision) ([]byte, error) {
+	return json.Marshal(bus.SSHAccessResponse{
+		Allowed:    decision.Allowed,
+		Capability: decision.Capability,
+		Reason:     decision.Reason,
+	})
+}
+
+// legacyAccessResponse returns the encoded SSH access response for the given
+// decision in the bare boolean format of the legacy service-api. This format
+// can't represent restricted capabilities, so access is only allowed if the
+// decision grants full access.
+func legacyAccessResponse(decision rbac.Decision) []byte {
+	if decision.Allowed && decision.Capability == rbac.FullAccess {
+		return trueResponse
+	}
+	return falseResponse
+}
+
+// subjectResponse returns the encoded SSH access response for the given
+// decision in the format expected by clients of the given subject.
+func subjectResponse(subject string, decision rbac.Decision) ([]byte, error) {
+	if subject == bus.SubjectLegacySSHAccessQuery {
+		return legacyAccessResponse(decision), nil
+	}
+	return accessResponse(decision)
+}
+
+// denyQuery replies to msg denying access. Replies are only sent if msg has a
+// reply subject.
+func denyQuery(log *slog.Logger, c publisher, msg *nats.Msg) {
+	if msg.Reply == "" {
+		return
+	}
+	if err := c.Publish(msg.Reply, falseResponse); err != nil {
+		log.Error("couldn't publish reply", slog.Any("error", err))
+	}
+}
+
+// replyDecision replies to msg with the given decision, encoded according to
+// the subject of msg.
+func replyDecision(
+	log *slog.Logger,
+	c publisher,
+	msg *nats.Msg,
+	decision rbac.Decision,
+) {
+	response, err := subjectResponse(msg.Subject, decision)
+	if err != nil {
+		log.Error("couldn't marshal response", slog.Any("error", err))
+		response = falseResponse
+	}
+	if err = c.Publish(msg.Reply, response); err != nil {
+		log.Error("couldn't publish reply", slog.Any("error", err))
+	}
+}
+
+// clusterMismatch returns true if the cluster named in the query doesn't
+// match the cluster the environment is deployed to. If either cluster name is
+// unknown, it returns false.
+func clusterMismatch(
+	query bus.SSHAccessQuery,
+	env *lagoondb.Environment,
+) bool {
+	return query.ClusterName != "" && env.ClusterName != "" &&
+		query.ClusterName != env.ClusterName
+}
+
+// idMismatch returns an error describing any mismatch between the project
+// and environment IDs in the query and those of the environment found in the
+// Lagoon API DB. IDs which are zero in the query are not checked. If the IDs
+// match, it returns nil.
+func idMismatch(query bus.SSHAccessQuery, env *lagoondb.Environment) error {
+	var mismatches []string
+	if query.ProjectID != 0 && query.ProjectID != env.ProjectID {
+		mismatches = append(mismatches, fmt.Sprintf(
+			"query project ID %d != Lagoon API DB project ID %d",
+			query.ProjectID, env.ProjectID))
+	}
+	if query.EnvironmentID != 0 && query.EnvironmentID != env.ID {
+		mismatches = append(mismatches, fmt.Sprintf(
+			"query environment ID %d != Lagoon API DB environment ID %d",
+			query.EnvironmentID, env.ID))
+	}
+	if len(mismatches) == 0 {
+		return nil
+	}
+	return fmt.Errorf("ID mismatch: %s", strings.Join(mismatches, ", "))
+}
+
+// evaluation is the shared result of evaluating an SSH access query.
+type evaluation struct {
+	decision rbac.Decision
+	ok       bool
+}
+
+// coalesceKey returns the key identifying queries which can share a single
+// evaluation. The environment IDs are included because they are checked
+// during evaluation.
+func coalesceKey(query bus.SSHAccessQuery, fingerprint string) string {
+	return fmt.Sprintf("%s/%s/%d/%d", fingerprint, query.NamespaceName,
+		query.ProjectID, query.EnvironmentID)
+}
+
+// sshKeyUser returns the user who owns the SSH key with the given
+// fingerprint. If there is no such user, or the user couldn't be queried, it
+// returns nil along with the decision and ok values which evaluateQuery
+// should return.
+func sshKeyUser(
+	ctx context.Context,
+	log *slog.Logger,
+	ldb LagoonDBService,
+	fingerprint string,
+) (*lagoondb.User, rbac.Decision, bool) {
+	user, err := ldb.UserBySSHFingerprint(ctx, fingerprint)
+	if err != nil {
+		if errors.Is(err, breaker.ErrOpen) {
+			log.Warn("backend unavailable", slog.Any("error", err))
+			return nil, rbac.Decision{Reason: bus.ReasonBackendUnavailable}, true
+		}
+		if errors.Is(err, lagoondb.ErrNoResult) {
+			log.Debug("unknown SSH Fingerprint", slog.Any("error", err))
+			return nil, rbac.Decision{}, true
+		}
+		log.Error("couldn't query user by ssh fingerprint", slog.Any("error", err))
+		return nil, rbac.Decision{}, false
+	}
+	if user == nil || user.UUID == nil {
+		log.Error("couldn't query user by ssh fingerprint: " +
+			"no user UUID returned")
+		return nil, rbac.Decision{}, false
+	}
+	return user, rbac.Decision{}, true
+}
+
+// evaluateQuery returns the access decision for the given validated query and
+// normalised fingerprint, and updates the last used time of the SSH key. If
+// the query couldn't be evaluated due to an internal error, it returns false
+// and no reply should be sent.
+func evaluateQuery(
+	ctx context.Context,
+	log *slog.Logger,
+	m *Metrics,
+	p *rbac.Permission,
+	ldb LagoonDBService,
+	query bus.SSHAccessQuery,
+	fingerprint string,
+) (rbac.Decision, bool) {
+	// get the environment
+	env, err := ldb.EnvironmentByNamespaceName(ctx, query.NamespaceName)
+	if err != nil {
+		if errors.Is(err, breaker.ErrOpen) {
+			log.Warn("backend unavailable", slog.Any("error", err))
+			return rbac.Decision{Reason: bus.ReasonBackendUnavailable}, true
+		}
+		if errors.Is(err, lagoondb.ErrNoResult) {
+			// ssh-portal accepts the SSH key in order to tell the user that
+			// the environment no longer exists, so only the owner of a known
+			// SSH key is told.
+			user, decision, ok := sshKeyUser(ctx, log, ldb, fingerprint)
+			if user == nil {
+				return decision, ok
+			}
+			log.Warn("unknown namespace name",
+				slog.Any("error", err),
+				slog.String("userUUID", user.UUID.String()))
+			return rbac.Decision{Reason: bus.ReasonUnknownNamespace}, true
+		}
+		log.Error("couldn't query environment", slog.Any("error", err))
+		return rbac.Decision{}, false
+	}
+	if env == nil {
+		log.Error("couldn't query environment: no environment returned")
+		return rbac.Decision{}, false
+	}
+	// sanity check the environment we found
+	// if this check fails it likely means a collision in
+	// project+environment -> namespace_name mapping, namespace label drift, or
+	// some similar logic error.
+	if err = idMismatch(query, env); err != nil {
+		m.idMismatchTotal.Inc()
+		log.Warn("ID mismatch in environment identification",
+			slog.Any("error", err),
+			slog.Group("lagoonDB",
+				slog.Int("projectID", env.ProjectID),
+				slog.Int("environmentID", env.ID)))
+		return rbac.Decision{Reason: bus.ReasonIDMismatch}, true
+	}
+	// The environment should be deployed to the cluster the query came from.
+	// If not, the ssh-portal serving the request may be receiving traffic
+	// for another cluster due to misrouted DNS.
+	if clusterMismatch(query, env) {
+		log.Warn("cluster name mismatch in environment identification",
+			slog.String("environmentClusterName", env.ClusterName))
+	}
+	// get the user
+	user, decision, ok := sshKeyUser(ctx, log, ldb, fingerprint)
+	if user == nil {
+		return decision, ok
+	}
+	// update last_used
+	if err := ldb.SSHKeyUsed(ctx, fingerprint, time.Now()); err != nil {
+		log.Error("couldn't update ssh key last used",
+			slog.Any("error", err))
+		return rbac.Decision{}, false
+	}
+	// check permission
+	decision, err = p.UserSSHAccess(
+		ctx, log, *user.UUID, env.ProjectID, env.Type)
+	if err != nil {
+		log.Error("couldn't check if user can ssh to environment",
+			slog.Any("error", err))
+	}
+	logMsg, logLevel := "SSH access not authorized", slog.LevelInfo
+	if decision.Allowed {
+		logMsg = "SSH access authorized"
+	}
+	if decision.Reason == rbac.ReasonUserNotInKeycloak {
+		// the SSH key belongs to a user who has been removed from Keycloak
+		logLevel = slog.LevelWarn
+	}
+	log.Log(ctx, logLevel, logMsg,
+		slog.String("capability", decision.Capability.String()),
+		slog.String("reason", decision.Reason),
+		slog.Int("environmentID", env.ID),
+		slog.String("environmentType", env.Type.String()),
+		slog.String("environmentName", env.Name),
+		slog.Int("projectID", env.ProjectID),
+		slog.String("projectName", env.ProjectName),
+		slog.String("userUUID", user.UUID.String()),
+	)
+	return decision, true
+}
+
+// sshportal returns a nats.MsgHandler which answers SSH access queries. The
+// same decision logic is used for every subject, and the response is encoded
+// according to the subject the query was received on. See subjectResponse.
+//
+// Concurrent identical queries, such as those from a CI job opening many
+// connections at once, share a single evaluation and receive the same
+// decision. While any of the given breakers is open, queries are denied
+// without being evaluated.
 func sshportal(
 	ctx context.Context,
 	log *slog.Logger,
-	c *nats.Conn,
+	m *Metrics,
+	c publisher,
 	p *rbac.Permission,
 	ldb LagoonDBService,
+	breakers *Breakers,
 ) nats.MsgHandler {
+	var group singleflight.Group
 	return func(msg *nats.Msg) {
 		// set up tracing and update metrics
-		ctx, span := otel.Tracer(pkgName).Start(ctx, bus.SubjectSSHAccessQuery)
+		ctx, span := otel.Tracer(pkgName).Start(ctx, msg.Subject)
 		defer span.End()
-		requestsCounter.Inc()
-		var query bus.SSHAccessQuery
-		if err := json.Unmarshal(msg.Data, &query); err != nil {
-			log.Warn("couldn't unmarshal query", slog.Any("query", msg.Data))
+		m.requestsTotal.WithLabelValues(msg.Subject).Inc()
+		log := log.With(slog.String("subject", msg.Subject))
+		// reject oversized queries before parsing them
+		if len(msg.Data) > maxQueryBytes {
+			m.rejectedQueriesTotal.WithLabelValues("oversized").Inc()
+			log.Warn("oversized sshportal query", slog.Int("bytes", len(msg.Data)))
+			denyQuery(log, c, msg)
 			return
 		}
-		log := log.With(slog.Any("query", query))
-		// sanity check the query
-		if query.SSHFingerprint == "" || query.NamespaceName == "" {
-			log.Warn("malformed sshportal query")
-			return
-		}
-		// get the environment
-		env, err := ldb.EnvironmentByNamespaceName(ctx, query.NamespaceName)
+		query, unknownFields, err := decodeQuery[bus.SSHAccessQuery](msg.Data)
 		if err != nil {
-			if errors.Is(err, lagoondb.ErrNoResult) {
-				log.Warn("unknown namespace name", slog.Any("error", err))
-				if err = c.Publish(msg.Reply, falseResponse); err != nil {
-					log.Error("couldn't publish reply", slog.Any("error", err))
-				}
-				return
-			}
-			log.Error("couldn't query environment", slog.Any("error", err))
-			return
-		}
-		// sanity check the environment we found
-		// if this check fails it likely means a collision in
-		// project+environment -> namespace_name mapping, or some similar logic
-		// error.
-		if (query.ProjectID != 0 && query.ProjectID != env.ProjectID) ||
-			(query.EnvironmentID != 0 && query.EnvironmentID != env.ID) {
-			log.Warn("ID mismatch in environment identification",
-				slog.Any("env", env),
+			m.rejectedQueriesTotal.WithLabelValues("malformed").Inc()
+			log.Warn("couldn't decode query",
+				slog.Any("query", msg.Data),
 				slog.Any("error", err))
-			if err = c.Publish(msg.Reply, falseResponse); err != nil {
-				log.Error("couldn't publish reply", slog.Any("error", err))
-			}
+			denyQuery(log, c, msg)
 			return
 		}
-		// get the user
-		user, err := ldb.UserBySSHFingerprint(ctx, query.SSHFingerprint)
+		log = log.With(slog.Any("query", query))
+		if unknownFields {
+			log.Debug("ignoring unknown fields in sshportal query")
+		}
+		// sanity check the query, and normalise the fingerprint to match the
+		// Lagoon API DB
+		fingerprint, err := validateQuery(query)
 		if err != nil {
-			if errors.Is(err, lagoondb.ErrNoResult) {
-				log.Debug("unknown SSH Fingerprint", slog.Any("error", err))
-				if err = c.Publish(msg.Reply, falseResponse); err != nil {
-					log.Error("couldn't publish reply", slog.Any("error", err))
-				}
-				return
-			}
-			log.Error("couldn't query user by ssh fingerprint", slog.Any("error", err))
+			m.rejectedQueriesTotal.WithLabelValues("invalid").Inc()
+			log.Warn("invalid sshportal query", slog.Any("error", err))
+			denyQuery(log, c, msg)
 			return
 		}
-		// update last_used
-		if err := ldb.SSHKeyUsed(ctx, query.SSHFingerprint, time.Now()); err != nil {
-			log.Error("couldn't update ssh key last used",
-				slog.Any("error", err))
+		// fail fast while a backend is unavailable
+		if breakers.open() {
+			log.Warn("SSH access not authorized",
+				slog.String("reason", bus.ReasonBackendUnavailable))
+			replyDecision(log, c, msg,
+				rbac.Decision{Reason: bus.ReasonBackendUnavailable})
 			return
 		}
-		// check permission
-		ok, err := p.UserCanSSHToEnvironment(
-			ctx, log, *user.UUID, env.ProjectID, env.Type)
-		if err != nil {
-			log.Error("couldn't check if user can ssh to environment",
-				slog.Any("error", err))
-		}
-		var logMsg string
-		var response []byte
-		if ok {
-			logMsg = "SSH access authorized"
-			response = trueResponse
-		} else {
-			logMsg = "SSH access not authorized"
-			response = falseResponse
+		// evaluate the query, sharing the evaluation with any concurrent
+		// identical queries
+		leader := false
+		v, _, _ := group.Do(coalesceKey(query, fingerprint), func() (any, error) {
+			leader = true
+			decision, ok :=
+				evaluateQuery(ctx, log, m, p, ldb, query, fingerprint)
+			return evaluation{decision: decision, ok: ok}, nil
+		})
+		if !leader {
+			m.coalescedRequestsTotal.Inc()
+			log.Debug("coalesced sshportal query")
 		}
-		log.Info(logMsg,
-			slog.Int("environmentID", env.ID),
-			slog.String("environmentType", env.Type.String()),
-			slog.String("environmentName", env.Name),
-			slog.Int("projectID", env.ProjectID),
-			slog.String("projectName", env.ProjectName),
-			slog.String("userUUID", user.UUID.String()),
-		)
-		if err = c.Publish(msg.Reply, response); err != nil {
-			log.Error("couldn't publish reply",
-				slog.String("userUUID", user.UUID.String()),
-				slog.Any("error", err))
+		result := v.(evaluation)
+		if !result.ok {
+			return
 		}
+		replyDecision(log, c, msg, result.decision)
 	}
 }
@@ -1,8 +1,27 @@
 package sshportalapi
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/alecthomas/assert/v2"
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/uselagoon/ssh-portal/internal/bus"
+	"github.com/uselagoon/ssh-portal/internal/keycloak"
+	"github.com/uselagoon/ssh-portal/internal/lagoon"
+	"github.com/uselagoon/ssh-portal/internal/lagoondb"
+	"github.com/uselagoon/ssh-portal/internal/rbac"
+	"go.uber.org/mock/gomock"
 )
 
 func TestResponseMarshal(t *testing.T) {
@@ -10,7 +29,6 @@ func TestResponseMarshal(t *testing.T) {
 		input  []byte
 		expect bool
 	}{
-		"true":  {input: trueResponse, expect: true},
 		"false": {input: falseResponse, expect: false},
 	}
 	for name, tc := range testCases {
@@ -25,3 +43,691 @@ func TestResponseMarshal(t *testing.T) {
 		})
 	}
 }
+
+func TestAccessResponse(t *testing.T) {
+	var testCases = map[string]struct {
+		decision rbac.Decision
+		expect   bus.SSHAccessResponse
+	}{
+		"denied": {
+			decision: rbac.Decision{},
+			expect:   bus.SSHAccessResponse{Capability: rbac.FullAccess},
+		},
+		"full access": {
+			decision: rbac.Decision{Allowed: true, Capability: rbac.FullAccess},
+			expect: bus.SSHAccessResponse{
+				Allowed:    true,
+				Capability: rbac.FullAccess,
+			},
+		},
+		"logs only": {
+			decision: rbac.Decision{Allowed: true, Capability: rbac.LogsOnly},
+			expect: bus.SSHAccessResponse{
+				Allowed:    true,
+				Capability: rbac.LogsOnly,
+			},
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			data, err := accessResponse(tc.decision)
+			if err != nil {
+				tt.Fatal(err)
+			}
+			var response bus.SSHAccessResponse
+			if err = json.Unmarshal(data, &response); err != nil {
+				tt.Fatalf("error unmarshaling data %s: %v", data, err)
+			}
+			if response != tc.expect {
+				tt.Fatalf("expected %v, got %v", tc.expect, response)
+			}
+			// older clients can only decode denied and full access responses
+			var legacy bool
+			err = json.Unmarshal(data, &legacy)
+			if tc.decision.Capability == rbac.FullAccess {
+				if err != nil || legacy != tc.decision.Allowed {
+					tt.Fatalf("expected legacy %v, got %v (%v)",
+						tc.decision.Allowed, legacy, err)
+				}
+			} else if err == nil {
+				tt.Fatalf("expected legacy decode error for %s", data)
+			}
+		})
+	}
+}
+
+func TestClusterMismatch(t *testing.T) {
+	var testCases = map[string]struct {
+		queryCluster string
+		envCluster   string
+		expect       bool
+	}{
+		"match": {
+			queryCluster: "amazeeio-test1",
+			envCluster:   "amazeeio-test1",
+			expect:       false,
+		},
+		"mismatch": {
+			queryCluster: "amazeeio-test1",
+			envCluster:   "amazeeio-test2",
+			expect:       true,
+		},
+		"unknown query cluster": {
+			queryCluster: "",
+			envCluster:   "amazeeio-test2",
+			expect:       false,
+		},
+		"unknown env cluster": {
+			queryCluster: "amazeeio-test1",
+			envCluster:   "",
+			expect:       false,
+		},
+		"unknown both clusters": {
+			queryCluster: "",
+			envCluster:   "",
+			expect:       false,
+		},
+		"case sensitive mismatch": {
+			queryCluster: "Amazeeio-Test1",
+			envCluster:   "amazeeio-test1",
+			expect:       true,
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			query := bus.SSHAccessQuery{ClusterName: tc.queryCluster}
+			env := lagoondb.Environment{ClusterName: tc.envCluster}
+			if clusterMismatch(query, &env) != tc.expect {
+				tt.Fatalf("expected %v, got %v", tc.expect, !tc.expect)
+			}
+		})
+	}
+}
+
+// recordingPublisher is a publisher which records the last published
+// message, and the data published to each subject.
+type recordingPublisher struct {
+	mu        sync.Mutex
+	subject   string
+	data      []byte
+	published map[string][]byte
+}
+
+// Publish implements the publisher interface.
+func (p *recordingPublisher) Publish(subject string, data []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.subject, p.data = subject, data
+	if p.published == nil {
+		p.published = map[string][]byte{}
+	}
+	p.published[subject] = data
+	return nil
+}
+
+func TestSSHPortalSubjectEncoding(t *testing.T) {
+	log := slog.New(slog.NewJSONHandler(os.Stderr, nil))
+	fingerprint := "SHA256:NtOIKkyGp6ubsA4F2PDr1EltRRj4Rx+KZ1YYPrzIzE8"
+	allowed, err := accessResponse(
+		rbac.Decision{Allowed: true, Capability: rbac.FullAccess})
+	if err != nil {
+		t.Fatal(err)
+	}
+	denied, err := accessResponse(rbac.Decision{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	notInKeycloak, err := accessResponse(
+		rbac.Decision{Reason: rbac.ReasonUserNotInKeycloak})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var testCases = map[string]struct {
+		subject    string
+		realmRoles []string
+		kcErr      error
+		expect     []byte
+	}{
+		"current allowed": {
+			subject:    bus.SubjectSSHAccessQuery,
+			realmRoles: []string{"platform-owner"},
+			expect:     allowed,
+		},
+		"current denied": {
+			subject: bus.SubjectSSHAccessQuery,
+			expect:  denied,
+		},
+		"legacy allowed": {
+			subject:    bus.SubjectLegacySSHAccessQuery,
+			realmRoles: []string{"platform-owner"},
+			expect:     trueResponse,
+		},
+		"legacy denied": {
+			subject: bus.SubjectLegacySSHAccessQuery,
+			expect:  falseResponse,
+		},
+		"current user not in keycloak": {
+			subject: bus.SubjectSSHAccessQuery,
+			kcErr:   keycloak.ErrUserNotFound,
+			expect:  notInKeycloak,
+		},
+		"legacy user not in keycloak": {
+			subject: bus.SubjectLegacySSHAccessQuery,
+			kcErr:   keycloak.ErrUserNotFound,
+			expect:  falseResponse,
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			ctrl := gomock.NewController(tt)
+			ldbService := NewMockLagoonDBService(ctrl)
+			kcService := NewMockRBACKeycloakService(ctrl)
+			rbacLDBService := NewMockRBACLagoonDBService(ctrl)
+			m := NewMetrics(prometheus.NewRegistry())
+			pub := &recordingPublisher{}
+			userUUID := uuid.New()
+			// configure mocks
+			ldbService.EXPECT().
+				EnvironmentByNamespaceName(gomock.Any(), "project-test").
+				Return(&lagoondb.Environment{
+					ID:        2,
+					Name:      "test",
+					ProjectID: 1,
+					Type:      lagoon.Production,
+				}, nil)
+			ldbService.EXPECT().UserBySSHFingerprint(gomock.Any(), fingerprint).
+				Return(&lagoondb.User{UUID: &userUUID}, nil)
+			ldbService.EXPECT().SSHKeyUsed(gomock.Any(), fingerprint, gomock.Any()).
+				Return(nil)
+			kcService.EXPECT().UserRolesAndGroups(gomock.Any(), userUUID).
+				Return(tc.realmRoles, nil, tc.kcErr)
+			if len(tc.realmRoles) == 0 && tc.kcErr == nil {
+				kcService.EXPECT().UserGroupIDRole(gomock.Any(), nil).
+					Return(map[uuid.UUID]lagoon.UserRole{})
+				rbacLDBService.EXPECT().ProjectGroupIDs(gomock.Any(), 1).
+					Return(nil, nil)
+				kcService.EXPECT().AncestorGroups(gomock.Any(), nil).
+					Return(nil, nil)
+			}
+			query, err := json.Marshal(bus.SSHAccessQuery{
+				SSHFingerprint: fingerprint,
+				NamespaceName:  "project-test",
+			})
+			if err != nil {
+				tt.Fatal(err)
+			}
+			// execute
+			handler := sshportal(context.Background(), log, m, pub,
+				rbac.NewPermission(kcService, rbacLDBService), ldbService, nil)
+			handler(&nats.Msg{Subject: tc.subject, Reply: "_INBOX.test", Data: query})
+			// check the response and metrics
+			assert.Equal(tt, "_INBOX.test", pub.subject, name)
+			assert.Equal(tt, string(tc.expect), string(pub.data), name)
+			assert.Equal(tt, 1.0,
+				testutil.ToFloat64(m.requestsTotal.WithLabelValues(tc.subject)), name)
+		})
+	}
+}
+
+func TestSSHPortalUnknownUser(t *testing.T) {
+	log := slog.New(slog.NewJSONHandler(os.Stderr, nil))
+	fingerprint := "SHA256:NtOIKkyGp6ubsA4F2PDr1EltRRj4Rx+KZ1YYPrzIzE8"
+	denied, err := accessResponse(rbac.Decision{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var testCases = map[string]struct {
+		subject string
+		user    *lagoondb.User
+		userErr error
+		expect  []byte
+	}{
+		"current unknown ssh key": {
+			subject: bus.SubjectSSHAccessQuery,
+			userErr: lagoondb.ErrNoResult,
+			expect:  denied,
+		},
+		"legacy unknown ssh key": {
+			subject: bus.SubjectLegacySSHAccessQuery,
+			userErr: lagoondb.ErrNoResult,
+			expect:  falseResponse,
+		},
+		"nil user": {
+			subject: bus.SubjectSSHAccessQuery,
+		},
+		"user without UUID": {
+			subject: bus.SubjectSSHAccessQuery,
+			user:    &lagoondb.User{},
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			ctrl := gomock.NewController(tt)
+			ldbService := NewMockLagoonDBService(ctrl)
+			kcService := NewMockRBACKeycloakService(ctrl)
+			rbacLDBService := NewMockRBACLagoonDBService(ctrl)
+			m := NewMetrics(prometheus.NewRegistry())
+			pub := &recordingPublisher{}
+			// configure mocks
+			ldbService.EXPECT().
+				EnvironmentByNamespaceName(gomock.Any(), "project-test").
+				Return(&lagoondb.Environment{
+					ID:        2,
+					Name:      "test",
+					ProjectID: 1,
+					Type:      lagoon.Production,
+				}, nil)
+			ldbService.EXPECT().UserBySSHFingerprint(gomock.Any(), fingerprint).
+				Return(tc.user, tc.userErr)
+			query, err := json.Marshal(bus.SSHAccessQuery{
+				SSHFingerprint: fingerprint,
+				NamespaceName:  "project-test",
+			})
+			if err != nil {
+				tt.Fatal(err)
+			}
+			// execute
+			handler := sshportal(context.Background(), log, m, pub,
+				rbac.NewPermission(kcService, rbacLDBService), ldbService, nil)
+			handler(&nats.Msg{
+				Subject: tc.subject,
+				Reply:   "_INBOX.test",
+				Data:    query,
+			})
+			// check the response: users without a UUID are internal errors,
+			// which aren't replied to
+			if tc.expect == nil {
+				assert.Equal(tt, "", pub.subject, name)
+				return
+			}
+			assert.Equal(tt, "_INBOX.test", pub.subject, name)
+			assert.Equal(tt, string(tc.expect), string(pub.data), name)
+		})
+	}
+}
+
+func TestSSHPortalUnknownNamespace(t *testing.T) {
+	log := slog.New(slog.NewJSONHandler(os.Stderr, nil))
+	fingerprint := "SHA256:NtOIKkyGp6ubsA4F2PDr1EltRRj4Rx+KZ1YYPrzIzE8"
+	userUUID := uuid.New()
+	denied, err := accessResponse(rbac.Decision{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	unknownNamespace, err := accessResponse(
+		rbac.Decision{Reason: bus.ReasonUnknownNamespace})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var testCases = map[string]struct {
+		subject string
+		user    *lagoondb.User
+		userErr error
+		expect  []byte
+	}{
+		"known ssh key": {
+			subject: bus.SubjectSSHAccessQuery,
+			user:    &lagoondb.User{UUID: &userUUID},
+			expect:  unknownNamespace,
+		},
+		"unregistered ssh key": {
+			subject: bus.SubjectSSHAccessQuery,
+			userErr: lagoondb.ErrNoResult,
+			expect:  denied,
+		},
+		"legacy known ssh key": {
+			subject: bus.SubjectLegacySSHAccessQuery,
+			user:    &lagoondb.User{UUID: &userUUID},
+			expect:  falseResponse,
+		},
+		"user without UUID": {
+			subject: bus.SubjectSSHAccessQuery,
+			user:    &lagoondb.User{},
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			ctrl := gomock.NewController(tt)
+			ldbService := NewMockLagoonDBService(ctrl)
+			kcService := NewMockRBACKeycloakService(ctrl)
+			rbacLDBService := NewMockRBACLagoonDBService(ctrl)
+			m := NewMetrics(prometheus.NewRegistry())
+			pub := &recordingPublisher{}
+			// configure mocks: the environment has been deleted from Lagoon
+			ldbService.EXPECT().
+				EnvironmentByNamespaceName(gomock.Any(), "project-test").
+				Return(nil, lagoondb.ErrNoResult)
+			ldbService.EXPECT().UserBySSHFingerprint(gomock.Any(), fingerprint).
+				Return(tc.user, tc.userErr)
+			query, err := json.Marshal(bus.SSHAccessQuery{
+				SSHFingerprint: fingerprint,
+				NamespaceName:  "project-test",
+			})
+			if err != nil {
+				tt.Fatal(err)
+			}
+			// execute
+			handler := sshportal(context.Background(), log, m, pub,
+				rbac.NewPermission(kcService, rbacLDBService), ldbService, nil)
+			handler(&nats.Msg{
+				Subject: tc.subject,
+				Reply:   "_INBOX.test",
+				Data:    query,
+			})
+			// check the response: users without a UUID are internal errors,
+			// which aren't replied to
+			if tc.expect == nil {
+				assert.Equal(tt, "", pub.subject, name)
+				return
+			}
+			assert.Equal(tt, "_INBOX.test", pub.subject, name)
+			assert.Equal(tt, string(tc.expect), string(pub.data), name)
+		})
+	}
+}
+
+func TestLegacyAccessResponse(t *testing.T) {
+	var testCases = map[string]struct {
+		decision rbac.Decision
+		expect   []byte
+	}{
+		"denied": {
+			decision: rbac.Decision{},
+			expect:   falseResponse,
+		},
+		"full access": {
+			decision: rbac.Decision{Allowed: true, Capability: rbac.FullAccess},
+			expect:   trueResponse,
+		},
+		"logs only": {
+			decision: rbac.Decision{Allowed: true, Capability: rbac.LogsOnly},
+			expect:   falseResponse,
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			assert.Equal(tt, string(tc.expect),
+				string(legacyAccessResponse(tc.decision)), name)
+		})
+	}
+}
+
+func TestSSHPortalRejectedQueries(t *testing.T) {
+	log := slog.New(slog.NewJSONHandler(os.Stderr, nil))
+	fingerprint := "SHA256:NtOIKkyGp6ubsA4F2PDr1EltRRj4Rx+KZ1YYPrzIzE8"
+	var testCases = map[string]struct {
+		data        string
+		reply       string
+		processed   bool
+		expectReply bool
+		expectCount string
+	}{
+		"oversized": {
+			data: `{"SSHFingerprint":"` + fingerprint + `","NamespaceName":"` +
+				strings.Repeat("a", maxQueryBytes) + `"}`,
+			reply:       "_INBOX.test",
+			expectReply: true,
+			expectCount: "oversized",
+		},
+		"malformed": {
+			data:        `{"SSHFingerprint":`,
+			reply:       "_INBOX.test",
+			expectReply: true,
+			expectCount: "malformed",
+		},
+		"wrong type": {
+			data:        `{"SSHFingerprint":"` + fingerprint + `","ProjectID":"1"}`,
+			reply:       "_INBOX.test",
+			expectReply: true,
+			expectCount: "malformed",
+		},
+		"trailing data": {
+			data: `{"SSHFingerprint":"` + fingerprint +
+				`","NamespaceName":"project-test"}{}`,
+			reply:       "_INBOX.test",
+			expectReply: true,
+			expectCount: "malformed",
+		},
+		"invalid fingerprint": {
+			data:        `{"SSHFingerprint":"SHA256:abc","NamespaceName":"project-test"}`,
+			reply:       "_INBOX.test",
+			expectReply: true,
+			expectCount: "invalid",
+		},
+		"missing namespace": {
+			data:        `{"SSHFingerprint":"` + fingerprint + `"}`,
+			reply:       "_INBOX.test",
+			expectReply: true,
+			expectCount: "invalid",
+		},
+		"invalid namespace": {
+			data: `{"SSHFingerprint":"` + fingerprint +
+				`","NamespaceName":"Project_Test"}`,
+			reply:       "_INBOX.test",
+			expectReply: true,
+			expectCount: "invalid",
+		},
+		"negative ID": {
+			data: `{"SSHFingerprint":"` + fingerprint +
+				`","NamespaceName":"project-test","EnvironmentID":-1}`,
+			reply:       "_INBOX.test",
+			expectReply: true,
+			expectCount: "invalid",
+		},
+		"no reply subject": {
+			data:        `{"SSHFingerprint":"SHA256:abc","NamespaceName":"project-test"}`,
+			expectCount: "invalid",
+		},
+		"unknown field": {
+			data: `{"SSHFingerprint":"` + fingerprint +
+				`","NamespaceName":"project-test","Future":true}`,
+			reply:       "_INBOX.test",
+			processed:   true,
+			expectReply: true,
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			ctrl := gomock.NewController(tt)
+			ldbService := NewMockLagoonDBService(ctrl)
+			kcService := NewMockRBACKeycloakService(ctrl)
+			rbacLDBService := NewMockRBACLagoonDBService(ctrl)
+			m := NewMetrics(prometheus.NewRegistry())
+			pub := &recordingPublisher{}
+			if tc.processed {
+				// the query is processed despite the unknown field
+				userUUID := uuid.New()
+				ldbService.EXPECT().
+					EnvironmentByNamespaceName(gomock.Any(), "project-test").
+					Return(nil, lagoondb.ErrNoResult)
+				ldbService.EXPECT().UserBySSHFingerprint(gomock.Any(), fingerprint).
+					Return(&lagoondb.User{UUID: &userUUID}, nil)
+			}
+			// execute
+			handler := sshportal(context.Background(), log, m, pub,
+				rbac.NewPermission(kcService, rbacLDBService), ldbService, nil)
+			handler(&nats.Msg{
+				Subject: bus.SubjectSSHAccessQuery,
+				Reply:   tc.reply,
+				Data:    []byte(tc.data),
+			})
+			// check the response and metrics
+			if tc.expectReply {
+				expect := falseResponse
+				if tc.processed {
+					var err error
+					expect, err = accessResponse(
+						rbac.Decision{Reason: bus.ReasonUnknownNamespace})
+					assert.NoError(tt, err, name)
+				}
+				assert.Equal(tt, tc.reply, pub.subject, name)
+				assert.Equal(tt, string(expect), string(pub.data), name)
+			} else {
+				assert.Equal(tt, "", pub.subject, name)
+			}
+			for _, reason := range []string{"oversized", "malformed", "invalid"} {
+				var expect float64
+				if reason == tc.expectCount {
+					expect = 1
+				}
+				assert.Equal(tt, expect, testutil.ToFloat64(
+					m.rejectedQueriesTotal.WithLabelValues(reason)), name)
+			}
+		})
+	}
+}
+
+func TestSSHPortalCoalescing(t *testing.T) {
+	log := slog.New(slog.NewJSONHandler(os.Stderr, nil))
+	fingerprint := "SHA256:NtOIKkyGp6ubsA4F2PDr1EltRRj4Rx+KZ1YYPrzIzE8"
+	queries := 5
+	ctrl := gomock.NewController(t)
+	ldbService := NewMockLagoonDBService(ctrl)
+	kcService := NewMockRBACKeycloakService(ctrl)
+	rbacLDBService := NewMockRBACLagoonDBService(ctrl)
+	m := NewMetrics(prometheus.NewRegistry())
+	pub := &recordingPublisher{}
+	userUUID := uuid.New()
+	// the first query blocks until the others have arrived, and each
+	// evaluation step happens only once
+	release := make(chan struct{})
+	ldbService.EXPECT().
+		EnvironmentByNamespaceName(gomock.Any(), "project-test").
+		DoAndReturn(func(context.Context, string) (*lagoondb.Environment, error) {
+			<-release
+			return &lagoondb.Environment{
+				ID:        2,
+				Name:      "test",
+				ProjectID: 1,
+				Type:      lagoon.Production,
+			}, nil
+		})
+	ldbService.EXPECT().UserBySSHFingerprint(gomock.Any(), fingerprint).
+		Return(&lagoondb.User{UUID: &userUUID}, nil)
+	ldbService.EXPECT().SSHKeyUsed(gomock.Any(), fingerprint, gomock.Any()).
+		Return(nil)
+	kcService.EXPECT().UserRolesAndGroups(gomock.Any(), userUUID).
+		Return([]string{"platform-owner"}, nil, nil)
+	query, err := json.Marshal(bus.SSHAccessQuery{
+		SSHFingerprint: fingerprint,
+		NamespaceName:  "project-test",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// execute
+	handler := sshportal(context.Background(), log, m, pub,
+		rbac.NewPermission(kcService, rbacLDBService), ldbService, nil)
+	var wg sync.WaitGroup
+	for i := range queries {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			handler(&nats.Msg{
+				Subject: bus.SubjectSSHAccessQuery,
+				Reply:   fmt.Sprintf("_INBOX.test%d", i),
+				Data:    query,
+			})
+		}()
+	}
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	// check every query received the same reply
+	allowed, err := accessResponse(
+		rbac.Decision{Allowed: true, Capability: rbac.FullAccess})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, queries, len(pub.published))
+	for subject, data := range pub.published {
+		assert.Equal(t, string(allowed), string(data), subject)
+	}
+	assert.Equal(t, float64(queries-1),
+		testutil.ToFloat64(m.coalescedRequestsTotal))
+}
+
+func TestSSHPortalIDMismatch(t *testing.T) {
+	fingerprint := "SHA256:NtOIKkyGp6ubsA4F2PDr1EltRRj4Rx+KZ1YYPrzIzE8"
+	mismatch, err := accessResponse(rbac.Decision{Reason: bus.ReasonIDMismatch})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var testCases = map[string]struct {
+		projectID     int
+		environmentID int
+		expectLog     []string
+	}{
+		"project only": {
+			projectID:     3,
+			environmentID: 2,
+			expectLog: []string{
+				"query project ID 3 != Lagoon API DB project ID 1"},
+		},
+		"environment only": {
+			projectID:     1,
+			environmentID: 4,
+			expectLog: []string{
+				"query environment ID 4 != Lagoon API DB environment ID 2"},
+		},
+		"both": {
+			projectID:     3,
+			environmentID: 4,
+			expectLog: []string{
+				"query project ID 3 != Lagoon API DB project ID 1",
+				"query environment ID 4 != Lagoon API DB environment ID 2"},
+		},
+		"environment only without project": {
+			environmentID: 4,
+			expectLog: []string{
+				"query environment ID 4 != Lagoon API DB environment ID 2"},
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			var buf strings.Builder
+			log := slog.New(slog.NewJSONHandler(&buf, nil))
+			ctrl := gomock.NewController(tt)
+			ldbService := NewMockLagoonDBService(ctrl)
+			kcService := NewMockRBACKeycloakService(ctrl)
+			rbacLDBService := NewMockRBACLagoonDBService(ctrl)
+			m := NewMetrics(prometheus.NewRegistry())
+			pub := &recordingPublisher{}
+			// configure mocks. The query is denied before the user is looked
+			// up.
+			ldbService.EXPECT().
+				EnvironmentByNamespaceName(gomock.Any(), "project-test").
+				Return(&lagoondb.Environment{
+					ID:        2,
+					Name:      "test",
+					ProjectID: 1,
+					Type:      lagoon.Production,
+				}, nil)
+			query, err := json.Marshal(bus.SSHAccessQuery{
+				SSHFingerprint: fingerprint,
+				NamespaceName:  "project-test",
+				ProjectID:      tc.projectID,
+				EnvironmentID:  tc.environmentID,
+			})
+			if err != nil {
+				tt.Fatal(err)
+			}
+			// execute
+			handler := sshportal(context.Background(), log, m, pub,
+				rbac.NewPermission(kcService, rbacLDBService), ldbService, nil)
+			handler(&nats.Msg{
+				Subject: bus.SubjectSSHAccessQuery,
+				Reply:   "_INBOX.test",
+				Data:    query,
+			})
+			// check the response, metrics, and logs
+			assert.Equal(tt, string(mismatch), string(pub.data), name)
+			assert.Equal(tt, 1.0, testutil.ToFloat64(m.idMismatchTotal), name)
+			for _, expect := range tc.expectLog {
+				assert.Contains(tt, buf.String(), expect, name)
+			}
+			assert.Contains(tt, buf.String(),
+				`"lagoonDB":{"projectID":1,"environmentID":2}`, name)
+		})
+	}
+}
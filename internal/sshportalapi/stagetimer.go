@@ -0,0 +1,177 @@
+package sshportalapi
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/uselagoon/ssh-portal/internal/lagoon"
+	"github.com/uselagoon/ssh-portal/internal/lagoondb"
+	"github.com/uselagoon/ssh-portal/internal/rbac"
+)
+
+// The values of the stage label of the sshportalapi_stage_duration_seconds
+// metric. Each stage is a call to a backend method.
+const (
+	stageEnvironmentLookup = "environment_lookup"
+	stageUserLookup        = "user_lookup"
+	stageSSHKeyUsed        = "ssh_key_used"
+	stageSSHEndpoint       = "ssh_endpoint_lookup"
+	stageProjectGroups     = "project_groups"
+	stageAncestorGroups    = "ancestor_groups"
+	stageGroupRoles        = "group_roles"
+	stageRolesAndGroups    = "keycloak_roles_groups"
+)
+
+// timeStage calls fn, records how long it took under the given stage in m,
+// and returns its result.
+func timeStage[T any](m *Metrics, stage string, fn func() T) T {
+	start := time.Now()
+	defer func() {
+		m.stageDuration.WithLabelValues(stage).
+			Observe(time.Since(start).Seconds())
+	}()
+	return fn()
+}
+
+// timedLagoonDB wraps a LagoonDBBackend and records the duration of each
+// call.
+type timedLagoonDB struct {
+	ldb LagoonDBBackend
+	m   *Metrics
+}
+
+// TimeLagoonDB wraps ldb so that the duration of each call to it is recorded
+// in m by stage. Both ssh-portal-api and its RBAC permission engine should be
+// given the wrapped value, so that every stage of a query is timed.
+func TimeLagoonDB(ldb LagoonDBBackend, m *Metrics) LagoonDBBackend {
+	return &timedLagoonDB{ldb: ldb, m: m}
+}
+
+// EnvironmentByNamespaceName implements LagoonDBService.
+func (t *timedLagoonDB) EnvironmentByNamespaceName(
+	ctx context.Context,
+	name string,
+) (*lagoondb.Environment, error) {
+	var env *lagoondb.Environment
+	err := timeStage(t.m, stageEnvironmentLookup, func() error {
+		var err error
+		env, err = t.ldb.EnvironmentByNamespaceName(ctx, name)
+		return err
+	})
+	return env, err
+}
+
+// UserBySSHFingerprint implements LagoonDBService.
+func (t *timedLagoonDB) UserBySSHFingerprint(
+	ctx context.Context,
+	fingerprint string,
+) (*lagoondb.User, error) {
+	var user *lagoondb.User
+	err := timeStage(t.m, stageUserLookup, func() error {
+		var err error
+		user, err = t.ldb.UserBySSHFingerprint(ctx, fingerprint)
+		return err
+	})
+	return user, err
+}
+
+// SSHKeyUsed implements LagoonDBService.
+func (t *timedLagoonDB) SSHKeyUsed(
+	ctx context.Context,
+	fingerprint string,
+	used time.Time,
+) error {
+	return timeStage(t.m, stageSSHKeyUsed, func() error {
+		return t.ldb.SSHKeyUsed(ctx, fingerprint, used)
+	})
+}
+
+// SSHEndpointByEnvironmentID implements LagoonDBService.
+func (t *timedLagoonDB) SSHEndpointByEnvironmentID(
+	ctx context.Context,
+	envID int,
+) (string, string, error) {
+	var host, port string
+	err := timeStage(t.m, stageSSHEndpoint, func() error {
+		var err error
+		host, port, err = t.ldb.SSHEndpointByEnvironmentID(ctx, envID)
+		return err
+	})
+	return host, port, err
+}
+
+// ProjectGroupIDs implements rbac.LagoonDBService.
+func (t *timedLagoonDB) ProjectGroupIDs(
+	ctx context.Context,
+	projectID int,
+) ([]uuid.UUID, error) {
+	var groupIDs []uuid.UUID
+	err := timeStage(t.m, stageProjectGroups, func() error {
+		var err error
+		groupIDs, err = t.ldb.ProjectGroupIDs(ctx, projectID)
+		return err
+	})
+	return groupIDs, err
+}
+
+// timedKeycloak wraps an rbac.KeycloakService and records the duration of
+// each call.
+type timedKeycloak struct {
+	k rbac.KeycloakService
+	m *Metrics
+}
+
+// TimeKeycloak wraps k so that the duration of each call to it is recorded
+// in m by stage.
+func TimeKeycloak(k rbac.KeycloakService, m *Metrics) rbac.KeycloakService {
+	return &timedKeycloak{k: k, m: m}
+}
+
+// AncestorGroups implements rbac.KeycloakService.
+func (t *timedKeycloak) AncestorGroups(
+	ctx context.Context,
+	groups []uuid.UUID,
+) ([]uuid.UUID, error) {
+	var ancestors []uuid.UUID
+	err := timeStage(t.m, stageAncestorGroups, func() error {
+		var err error
+		ancestors, err = t.k.AncestorGroups(ctx, groups)
+		return err
+	})
+	return ancestors, err
+}
+
+// UserGroupIDRole implements rbac.KeycloakService.
+func (t *timedKeycloak) UserGroupIDRole(
+	ctx context.Context,
+	groupPaths []string,
+) map[uuid.UUID]lagoon.UserRole {
+	return timeStage(t.m, stageGroupRoles,
+		func() map[uuid.UUID]lagoon.UserRole {
+			return t.k.UserGroupIDRole(ctx, groupPaths)
+		})
+}
+
+// HasChildGroups implements rbac.ChildGroupService. It doesn't query
+// Keycloak, so it isn't timed.
+func (t *timedKeycloak) HasChildGroups(
+	ctx context.Context,
+	groupIDs []uuid.UUID,
+) bool {
+	return rbac.HasChildGroups(ctx, t.k, groupIDs)
+}
+
+// UserRolesAndGroups implements rbac.KeycloakService.
+func (t *timedKeycloak) UserRolesAndGroups(
+	ctx context.Context,
+	userUUID uuid.UUID,
+) ([]string, []string, error) {
+	var roles, groups []string
+	err := timeStage(t.m, stageRolesAndGroups, func() error {
+		var err error
+		roles, groups, err = t.k.UserRolesAndGroups(ctx, userUUID)
+		return err
+	})
+	return roles, groups, err
+}
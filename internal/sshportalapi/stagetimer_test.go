@@ -0,0 +1,119 @@
+package sshportalapi
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/assert/v2"
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/uselagoon/ssh-portal/internal/rbac"
+)
+
+// stageCount returns the number of observations of the stage duration metric
+// with the given stage.
+func stageCount(tt *testing.T, m *Metrics, stage string) uint64 {
+	h, ok := m.stageDuration.WithLabelValues(stage).(prometheus.Histogram)
+	if !ok {
+		tt.Fatal("couldn't get stage duration histogram")
+	}
+	var metric dto.Metric
+	if err := h.Write(&metric); err != nil {
+		tt.Fatal(err)
+	}
+	return metric.GetHistogram().GetSampleCount()
+}
+
+func TestStageTimer(t *testing.T) {
+	ctx := context.Background()
+	var testCases = map[string]struct {
+		call      func(LagoonDBBackend, rbac.KeycloakService) error
+		stage     string
+		expectErr bool
+	}{
+		"environment lookup": {
+			call: func(ldb LagoonDBBackend, _ rbac.KeycloakService) error {
+				_, err := ldb.EnvironmentByNamespaceName(ctx, "project-main")
+				return err
+			},
+			stage:     "environment_lookup",
+			expectErr: true,
+		},
+		"user lookup": {
+			call: func(ldb LagoonDBBackend, _ rbac.KeycloakService) error {
+				_, err := ldb.UserBySSHFingerprint(ctx, "SHA256:abc")
+				return err
+			},
+			stage:     "user_lookup",
+			expectErr: true,
+		},
+		"ssh key used": {
+			call: func(ldb LagoonDBBackend, _ rbac.KeycloakService) error {
+				return ldb.SSHKeyUsed(ctx, "SHA256:abc", time.Now())
+			},
+			stage:     "ssh_key_used",
+			expectErr: true,
+		},
+		"ssh endpoint lookup": {
+			call: func(ldb LagoonDBBackend, _ rbac.KeycloakService) error {
+				_, _, err := ldb.SSHEndpointByEnvironmentID(ctx, 2)
+				return err
+			},
+			stage:     "ssh_endpoint_lookup",
+			expectErr: true,
+		},
+		"project groups": {
+			call: func(ldb LagoonDBBackend, _ rbac.KeycloakService) error {
+				_, err := ldb.ProjectGroupIDs(ctx, 1)
+				return err
+			},
+			stage:     "project_groups",
+			expectErr: true,
+		},
+		"ancestor groups": {
+			call: func(_ LagoonDBBackend, k rbac.KeycloakService) error {
+				_, err := k.AncestorGroups(ctx, []uuid.UUID{uuid.New()})
+				return err
+			},
+			stage:     "ancestor_groups",
+			expectErr: true,
+		},
+		"group roles": {
+			call: func(_ LagoonDBBackend, k rbac.KeycloakService) error {
+				k.UserGroupIDRole(ctx, []string{"/project-foo"})
+				return nil
+			},
+			stage: "group_roles",
+		},
+		"roles and groups": {
+			call: func(_ LagoonDBBackend, k rbac.KeycloakService) error {
+				_, _, err := k.UserRolesAndGroups(ctx, uuid.New())
+				return err
+			},
+			stage:     "keycloak_roles_groups",
+			expectErr: true,
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			m := NewMetrics(prometheus.NewRegistry())
+			ldb := &fakeLagoonDB{err: errBackend}
+			k := &fakeKeycloak{err: errBackend}
+			err := tc.call(TimeLagoonDB(ldb, m), TimeKeycloak(k, m))
+			// the wrapped backend is called once, and its error is returned
+			assert.Equal(tt, 1, ldb.calls+k.calls, name)
+			if tc.expectErr {
+				assert.IsError(tt, err, errBackend, name)
+			} else {
+				assert.NoError(tt, err, name)
+			}
+			// only the duration of the given stage is recorded
+			assert.Equal(tt, 1, testutil.CollectAndCount(m.stageDuration),
+				name)
+			assert.Equal(tt, uint64(1), stageCount(tt, m, tc.stage), name)
+		})
+	}
+}
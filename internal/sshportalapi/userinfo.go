@@ -0,0 +1,160 @@
+package sshportalapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+
+	"github.com/nats-io/nats.go"
+	"github.com/uselagoon/ssh-portal/internal/breaker"
+	"github.com/uselagoon/ssh-portal/internal/bus"
+	"github.com/uselagoon/ssh-portal/internal/keycloak"
+	"github.com/uselagoon/ssh-portal/internal/lagoondb"
+	"github.com/uselagoon/ssh-portal/internal/rbac"
+	"github.com/uselagoon/ssh-portal/internal/sshfingerprint"
+	"go.opentelemetry.io/otel"
+)
+
+// replyUserInfo replies to msg with the given user info response. Replies
+// are only sent if msg has a reply subject.
+func replyUserInfo(
+	log *slog.Logger,
+	c publisher,
+	msg *nats.Msg,
+	response bus.UserInfoResponse,
+) {
+	if msg.Reply == "" {
+		return
+	}
+	data, err := json.Marshal(response)
+	if err != nil {
+		log.Error("couldn't marshal response", slog.Any("error", err))
+		return
+	}
+	if err = c.Publish(msg.Reply, data); err != nil {
+		log.Error("couldn't publish reply", slog.Any("error", err))
+	}
+}
+
+// resolveUserInfo returns the user info response for the given normalised
+// fingerprint. If the query couldn't be resolved due to an internal error, it
+// returns false and no reply should be sent.
+func resolveUserInfo(
+	ctx context.Context,
+	log *slog.Logger,
+	p *rbac.Permission,
+	ldb LagoonDBService,
+	fingerprint string,
+) (bus.UserInfoResponse, bool) {
+	// get the user
+	user, err := ldb.UserBySSHFingerprint(ctx, fingerprint)
+	if err != nil {
+		if errors.Is(err, breaker.ErrOpen) {
+			log.Warn("backend unavailable", slog.Any("error", err))
+			return bus.UserInfoResponse{
+				Reason: bus.ReasonBackendUnavailable,
+			}, true
+		}
+		if errors.Is(err, lagoondb.ErrNoResult) {
+			log.Debug("unknown SSH Fingerprint", slog.Any("error", err))
+			return bus.UserInfoResponse{Reason: bus.ReasonUnknownSSHKey}, true
+		}
+		log.Error("couldn't query user by ssh fingerprint", slog.Any("error", err))
+		return bus.UserInfoResponse{}, false
+	}
+	if user == nil || user.UUID == nil {
+		log.Error("couldn't query user by ssh fingerprint: " +
+			"no user UUID returned")
+		return bus.UserInfoResponse{}, false
+	}
+	log = log.With(slog.String("userUUID", user.UUID.String()))
+	// get the user's roles
+	platformOwner, groupRoles, err := p.UserGroupRoles(ctx, log, *user.UUID)
+	if err != nil {
+		if errors.Is(err, keycloak.ErrUserNotFound) {
+			// the SSH key belongs to a user who has been removed from Keycloak
+			log.Warn("user info not resolved",
+				slog.String("reason", rbac.ReasonUserNotInKeycloak))
+			return bus.UserInfoResponse{
+				UserUUID: user.UUID,
+				Reason:   rbac.ReasonUserNotInKeycloak,
+			}, true
+		}
+		log.Error("couldn't get user group roles", slog.Any("error", err))
+		return bus.UserInfoResponse{}, false
+	}
+	log.Info("user info resolved",
+		slog.Bool("platformOwner", platformOwner),
+		slog.Int("groups", len(groupRoles)))
+	return bus.UserInfoResponse{
+		UserUUID:      user.UUID,
+		PlatformOwner: platformOwner,
+		GroupRoles:    groupRoles,
+	}, true
+}
+
+// userinfo returns a nats.MsgHandler which answers user info queries. This
+// allows other Lagoon services to reuse the data which SSH access decisions
+// are based on without querying Keycloak themselves. The response contains
+// no secrets. While any of the given breakers is open, queries are answered
+// with reason bus.ReasonBackendUnavailable without querying the backends.
+func userinfo(
+	ctx context.Context,
+	log *slog.Logger,
+	m *Metrics,
+	c publisher,
+	p *rbac.Permission,
+	ldb LagoonDBService,
+	breakers *Breakers,
+) nats.MsgHandler {
+	return func(msg *nats.Msg) {
+		// set up tracing and update metrics
+		ctx, span := otel.Tracer(pkgName).Start(ctx, msg.Subject)
+		defer span.End()
+		m.requestsTotal.WithLabelValues(msg.Subject).Inc()
+		log := log.With(slog.String("subject", msg.Subject))
+		invalid := bus.UserInfoResponse{Reason: bus.ReasonInvalidQuery}
+		// reject oversized queries before parsing them
+		if len(msg.Data) > maxQueryBytes {
+			m.rejectedQueriesTotal.WithLabelValues("oversized").Inc()
+			log.Warn("oversized userinfo query", slog.Int("bytes", len(msg.Data)))
+			replyUserInfo(log, c, msg, invalid)
+			return
+		}
+		query, unknownFields, err := decodeQuery[bus.UserInfoQuery](msg.Data)
+		if err != nil {
+			m.rejectedQueriesTotal.WithLabelValues("malformed").Inc()
+			log.Warn("couldn't decode query",
+				slog.Any("query", msg.Data),
+				slog.Any("error", err))
+			replyUserInfo(log, c, msg, invalid)
+			return
+		}
+		log = log.With(slog.Any("query", query))
+		if unknownFields {
+			log.Debug("ignoring unknown fields in userinfo query")
+		}
+		// normalise the fingerprint to match the Lagoon API DB
+		fingerprint, err := sshfingerprint.Normalize(query.SSHFingerprint)
+		if err != nil {
+			m.rejectedQueriesTotal.WithLabelValues("invalid").Inc()
+			log.Warn("invalid userinfo query", slog.Any("error", err))
+			replyUserInfo(log, c, msg, invalid)
+			return
+		}
+		// fail fast while a backend is unavailable
+		if breakers.open() {
+			log.Warn("user info not resolved",
+				slog.String("reason", bus.ReasonBackendUnavailable))
+			replyUserInfo(log, c, msg,
+				bus.UserInfoResponse{Reason: bus.ReasonBackendUnavailable})
+			return
+		}
+		response, ok := resolveUserInfo(ctx, log, p, ldb, fingerprint)
+		if !ok {
+			return
+		}
+		replyUserInfo(log, c, msg, response)
+	}
+}
@@ -0,0 +1,155 @@
+package sshportalapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"testing"
+
+	"github.com/alecthomas/assert/v2"
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/uselagoon/ssh-portal/internal/bus"
+	"github.com/uselagoon/ssh-portal/internal/keycloak"
+	"github.com/uselagoon/ssh-portal/internal/lagoon"
+	"github.com/uselagoon/ssh-portal/internal/lagoondb"
+	"github.com/uselagoon/ssh-portal/internal/rbac"
+	"go.uber.org/mock/gomock"
+)
+
+func TestUserInfo(t *testing.T) {
+	log := slog.New(slog.NewJSONHandler(os.Stderr, nil))
+	fingerprint := "SHA256:NtOIKkyGp6ubsA4F2PDr1EltRRj4Rx+KZ1YYPrzIzE8"
+	userUUID := uuid.MustParse("91435afe-ba81-406b-9308-f80b79fae350")
+	groupUUID := uuid.MustParse("ee6d02d1-b14b-41dd-95b6-cb8c26b1a321")
+	groupPaths := []string{"/project-a/project-a-maintainer"}
+	var testCases = map[string]struct {
+		fingerprint string
+		userErr     error
+		noUUID      bool
+		realmRoles  []string
+		kcErr       error
+		expectReply bool
+		expect      bus.UserInfoResponse
+		expectCount string
+	}{
+		"group member": {
+			fingerprint: fingerprint,
+			expectReply: true,
+			expect: bus.UserInfoResponse{
+				UserUUID: &userUUID,
+				GroupRoles: map[uuid.UUID]lagoon.UserRole{
+					groupUUID: lagoon.Maintainer,
+				},
+			},
+		},
+		"platform owner": {
+			fingerprint: fingerprint,
+			realmRoles:  []string{"platform-owner"},
+			expectReply: true,
+			expect: bus.UserInfoResponse{
+				UserUUID:      &userUUID,
+				PlatformOwner: true,
+			},
+		},
+		"unknown ssh key": {
+			fingerprint: fingerprint,
+			userErr:     lagoondb.ErrNoResult,
+			expectReply: true,
+			expect:      bus.UserInfoResponse{Reason: bus.ReasonUnknownSSHKey},
+		},
+		"user not in keycloak": {
+			fingerprint: fingerprint,
+			kcErr:       keycloak.ErrUserNotFound,
+			expectReply: true,
+			expect: bus.UserInfoResponse{
+				UserUUID: &userUUID,
+				Reason:   rbac.ReasonUserNotInKeycloak,
+			},
+		},
+		"user without UUID": {
+			fingerprint: fingerprint,
+			noUUID:      true,
+		},
+		"lagoon db error": {
+			fingerprint: fingerprint,
+			userErr:     errors.New("connection refused"),
+		},
+		"keycloak error": {
+			fingerprint: fingerprint,
+			kcErr:       errors.New("bad gateway"),
+		},
+		"invalid fingerprint": {
+			fingerprint: "SHA256:abc",
+			expectReply: true,
+			expect:      bus.UserInfoResponse{Reason: bus.ReasonInvalidQuery},
+			expectCount: "invalid",
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			ctrl := gomock.NewController(tt)
+			ldbService := NewMockLagoonDBService(ctrl)
+			kcService := NewMockRBACKeycloakService(ctrl)
+			rbacLDBService := NewMockRBACLagoonDBService(ctrl)
+			m := NewMetrics(prometheus.NewRegistry())
+			pub := &recordingPublisher{}
+			// configure mocks
+			if tc.expectCount == "" {
+				user := &lagoondb.User{UUID: &userUUID}
+				if tc.noUUID {
+					user.UUID = nil
+				}
+				ldbService.EXPECT().UserBySSHFingerprint(gomock.Any(), fingerprint).
+					Return(user, tc.userErr)
+			}
+			if tc.expectCount == "" && tc.userErr == nil && !tc.noUUID {
+				kcService.EXPECT().UserRolesAndGroups(gomock.Any(), userUUID).
+					Return(tc.realmRoles, groupPaths, tc.kcErr)
+			}
+			if tc.expect.GroupRoles != nil {
+				kcService.EXPECT().UserGroupIDRole(gomock.Any(), groupPaths).
+					Return(tc.expect.GroupRoles)
+			}
+			query, err := json.Marshal(bus.UserInfoQuery{
+				SSHFingerprint: tc.fingerprint,
+			})
+			if err != nil {
+				tt.Fatal(err)
+			}
+			// execute
+			handler := userinfo(context.Background(), log, m, pub,
+				rbac.NewPermission(kcService, rbacLDBService), ldbService, nil)
+			handler(&nats.Msg{
+				Subject: bus.SubjectUserInfoQuery,
+				Reply:   "_INBOX.test",
+				Data:    query,
+			})
+			// check the response and metrics
+			if tc.expectReply {
+				assert.Equal(tt, "_INBOX.test", pub.subject, name)
+				var response bus.UserInfoResponse
+				if err = json.Unmarshal(pub.data, &response); err != nil {
+					tt.Fatalf("error unmarshaling data %s: %v", pub.data, err)
+				}
+				assert.Equal(tt, tc.expect, response, name)
+			} else {
+				assert.Equal(tt, "", pub.subject, name)
+			}
+			assert.Equal(tt, 1.0, testutil.ToFloat64(
+				m.requestsTotal.WithLabelValues(bus.SubjectUserInfoQuery)), name)
+			for _, reason := range []string{"oversized", "malformed", "invalid"} {
+				var expect float64
+				if reason == tc.expectCount {
+					expect = 1
+				}
+				assert.Equal(tt, expect, testutil.ToFloat64(
+					m.rejectedQueriesTotal.WithLabelValues(reason)), name)
+			}
+		})
+	}
+}
@@ -0,0 +1,119 @@
+package sshportalapi
+
+import (
+	"log/slog"
+	"runtime/debug"
+	"sync"
+
+	"github.com/nats-io/nats.go"
+)
+
+// workerPool processes NATS messages concurrently with bounded parallelism.
+type workerPool struct {
+	log     *slog.Logger
+	metrics *Metrics
+	handler nats.MsgHandler
+	msgs    chan *nats.Msg
+	wg      sync.WaitGroup
+	// done is closed by stop to release handle calls blocked on a full
+	// queue. mu is held for reading by handle while it may send to msgs, so
+	// that stop can close msgs once it holds mu for writing.
+	done    chan struct{}
+	mu      sync.RWMutex
+	stopped bool
+}
+
+// newWorkerPool starts the given number of workers which call handler on
+// each message passed to the handle method. At least one worker is always
+// started.
+func newWorkerPool(
+	log *slog.Logger,
+	m *Metrics,
+	handler nats.MsgHandler,
+	workers uint,
+) *workerPool {
+	workers = max(workers, 1)
+	wp := &workerPool{
+		log:     log,
+		metrics: m,
+		handler: handler,
+		msgs:    make(chan *nats.Msg, workers),
+		done:    make(chan struct{}),
+	}
+	wp.wg.Add(int(workers))
+	for range workers {
+		go wp.work()
+	}
+	return wp
+}
+
+// handle implements nats.MsgHandler. It queues msg for processing by a
+// worker, blocking if all workers are busy and the queue is full. Messages
+// which are not queued before the pool is stopped are denied, since NATS may
+// still deliver messages if a subscription couldn't be drained in time.
+func (wp *workerPool) handle(msg *nats.Msg) {
+	wp.mu.RLock()
+	defer wp.mu.RUnlock()
+	if !wp.stopped {
+		select {
+		case wp.msgs <- msg:
+			return
+		case <-wp.done:
+		}
+	}
+	wp.log.Warn("dropping NATS message received after worker pool stopped",
+		slog.String("subject", msg.Subject))
+	if msg.Reply == "" {
+		return
+	}
+	if err := msg.Respond(falseResponse); err != nil {
+		wp.log.Error("couldn't publish reply", slog.Any("error", err))
+	}
+}
+
+// stop stops accepting messages and waits for workers to finish processing
+// all queued and in-flight messages. Messages passed to handle during or
+// after stop are dropped.
+func (wp *workerPool) stop() {
+	close(wp.done)
+	wp.mu.Lock()
+	wp.stopped = true
+	close(wp.msgs)
+	wp.mu.Unlock()
+	wp.wg.Wait()
+}
+
+// work processes messages until the pool is stopped.
+func (wp *workerPool) work() {
+	defer wp.wg.Done()
+	for msg := range wp.msgs {
+		wp.process(msg)
+	}
+}
+
+// process calls the handler on msg, recovering from any panic so that the
+// worker survives. If a panic occurs, access is denied so that the requester
+// doesn't have to wait for a timeout.
+func (wp *workerPool) process(msg *nats.Msg) {
+	wp.metrics.workersBusy.Inc()
+	defer wp.metrics.workersBusy.Dec()
+	defer func() {
+		r := recover()
+		if r == nil {
+			return
+		}
+		wp.metrics.workerPanicsTotal.Inc()
+		wp.log.Error("recovered panic in NATS worker",
+			slog.String("subject", msg.Subject),
+			slog.String("query", string(msg.Data)),
+			slog.Any("panic", r),
+			slog.String("stack", string(debug.Stack())))
+		if msg.Reply == "" {
+			return
+		}
+		if err := msg.Respond(falseResponse); err != nil {
+			wp.log.Error("couldn't publish reply", slog.Any("error", err))
+		}
+	}()
+	wp.handler(msg)
+}
@@ -0,0 +1,180 @@
+package sshportalapi
+
+import (
+	"bytes"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/assert/v2"
+	"github.com/nats-io/nats.go"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestWorkerPoolSizing(t *testing.T) {
+	log := slog.New(slog.NewJSONHandler(os.Stderr, nil))
+	var testCases = map[string]struct {
+		workers uint
+		expect  int64
+	}{
+		"zero workers":  {workers: 0, expect: 1},
+		"one worker":    {workers: 1, expect: 1},
+		"four workers":  {workers: 4, expect: 4},
+		"eight workers": {workers: 8, expect: 8},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			var current, peak atomic.Int64
+			entered := make(chan struct{}, 32)
+			release := make(chan struct{})
+			handler := func(_ *nats.Msg) {
+				n := current.Add(1)
+				for {
+					p := peak.Load()
+					if n <= p || peak.CompareAndSwap(p, n) {
+						break
+					}
+				}
+				entered <- struct{}{}
+				<-release
+				current.Add(-1)
+			}
+			wp := newWorkerPool(log, NewMetrics(prometheus.NewRegistry()), handler, tc.workers)
+			// submit more messages than workers
+			submitted := make(chan struct{})
+			go func() {
+				defer close(submitted)
+				for range 32 {
+					wp.handle(&nats.Msg{})
+				}
+			}()
+			// wait for the workers to be saturated
+			for range tc.expect {
+				<-entered
+			}
+			// no further messages are processed while the workers are busy
+			select {
+			case <-entered:
+				tt.Fatalf("more than %d concurrent workers", tc.expect)
+			case <-time.After(50 * time.Millisecond):
+			}
+			close(release)
+			<-submitted
+			wp.stop()
+			assert.Equal(tt, tc.expect, peak.Load(), name)
+		})
+	}
+}
+
+func TestWorkerPoolStopWaitsForInFlight(t *testing.T) {
+	log := slog.New(slog.NewJSONHandler(os.Stderr, nil))
+	var mu sync.Mutex
+	var events []string
+	record := func(event string) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, event)
+	}
+	started := make(chan struct{})
+	handler := func(msg *nats.Msg) {
+		if msg.Subject == "slow" {
+			close(started)
+			time.Sleep(100 * time.Millisecond)
+		}
+		record("handled " + msg.Subject)
+	}
+	wp := newWorkerPool(log, NewMetrics(prometheus.NewRegistry()), handler, 2)
+	wp.handle(&nats.Msg{Subject: "slow"})
+	<-started
+	wp.handle(&nats.Msg{Subject: "queued"})
+	wp.stop()
+	record("stopped")
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, 3, len(events))
+	assert.Equal(t, "stopped", events[2])
+	assert.SliceContains(t, events, "handled slow")
+	assert.SliceContains(t, events, "handled queued")
+}
+
+func TestWorkerPoolPanicRecovery(t *testing.T) {
+	var buf bytes.Buffer
+	log := slog.New(slog.NewJSONHandler(&buf, nil))
+	var handled atomic.Int64
+	handler := func(msg *nats.Msg) {
+		if msg.Subject == "panic" {
+			panic("test panic")
+		}
+		handled.Add(1)
+	}
+	metrics := NewMetrics(prometheus.NewRegistry())
+	// a single worker must survive panics to process later messages
+	wp := newWorkerPool(log, metrics, handler, 1)
+	wp.handle(&nats.Msg{Subject: "ok"})
+	wp.handle(&nats.Msg{Subject: "panic", Data: []byte(`{"SessionID":"abc"}`)})
+	wp.handle(&nats.Msg{Subject: "ok"})
+	wp.handle(&nats.Msg{Subject: "panic"})
+	wp.handle(&nats.Msg{Subject: "ok"})
+	wp.stop()
+	assert.Equal(t, int64(3), handled.Load())
+	assert.Equal(t, float64(2), testutil.ToFloat64(metrics.workerPanicsTotal))
+	assert.Equal(t, 2, strings.Count(buf.String(), "recovered panic in NATS worker"))
+	assert.Contains(t, buf.String(), "test panic")
+	assert.Contains(t, buf.String(), `"query":"{\"SessionID\":\"abc\"}"`)
+	assert.Contains(t, buf.String(), "workerpool_test.go")
+}
+
+func TestWorkerPoolStopWhileBusy(t *testing.T) {
+	var buf bytes.Buffer
+	log := slog.New(slog.NewJSONHandler(&buf, nil))
+	var mu sync.Mutex
+	var handled []string
+	started := make(chan struct{})
+	release := make(chan struct{})
+	handler := func(msg *nats.Msg) {
+		if msg.Subject == "busy" {
+			close(started)
+			<-release
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		handled = append(handled, msg.Subject)
+	}
+	wp := newWorkerPool(log, NewMetrics(prometheus.NewRegistry()), handler, 1)
+	// occupy the only worker and fill the queue
+	wp.handle(&nats.Msg{Subject: "busy"})
+	<-started
+	wp.handle(&nats.Msg{Subject: "queued"})
+	// emulate NATS still delivering a message after the subscription drain
+	// timed out, which blocks because the queue is full
+	blocked := make(chan struct{})
+	go func() {
+		defer close(blocked)
+		wp.handle(&nats.Msg{Subject: "blocked"})
+	}()
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		wp.stop()
+	}()
+	// the blocked delivery is released by stop without waiting for workers
+	select {
+	case <-blocked:
+	case <-time.After(time.Second):
+		t.Fatal("handle still blocked after stop")
+	}
+	// messages delivered after stop are dropped
+	wp.handle(&nats.Msg{Subject: "late"})
+	close(release)
+	<-stopped
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []string{"busy", "queued"}, handled)
+	assert.Equal(t, 2, strings.Count(buf.String(),
+		"dropping NATS message received after worker pool stopped"))
+}
@@ -1,32 +1,82 @@
 package sshserver
 
 import (
+	"context"
 	"log/slog"
 	"strconv"
+	"time"
 
 	"github.com/gliderlabs/ssh"
+	"github.com/uselagoon/ssh-portal/internal/audit"
+	"github.com/uselagoon/ssh-portal/internal/bus"
+	"github.com/uselagoon/ssh-portal/internal/keypolicy"
+	"github.com/uselagoon/ssh-portal/internal/rbac"
+	"github.com/uselagoon/ssh-portal/internal/sessionlog"
+	"github.com/uselagoon/ssh-portal/internal/sshfingerprint"
 	gossh "golang.org/x/crypto/ssh"
+	"golang.org/x/time/rate"
 )
 
 const (
+	capabilityKey      = "uselagoon/capability"
+	deletedKey         = "uselagoon/environmentDeleted"
 	environmentIDKey   = "uselagoon/environmentID"
 	environmentNameKey = "uselagoon/environmentName"
+	environmentTypeKey = "uselagoon/environmentType"
 	projectIDKey       = "uselagoon/projectID"
 	projectNameKey     = "uselagoon/projectName"
+	shellKey           = "uselagoon/shell"
+	sshFingerprintKey  = "uselagoon/sshFingerprint"
 )
 
-// permissionsMarshal takes details of the Lagoon environment and stores them
-// in the Extensions field of the ssh connection permissions.
+// keyPolicyLogSampler limits logging of key policy rejections, since a single
+// client may offer many keys.
+var keyPolicyLogSampler = rate.Sometimes{First: 10, Interval: time.Minute}
+
+// permissionsMarshal takes details of the Lagoon environment (the type of
+// which may be empty), the normalised fingerprint of the authenticated key,
+// the capability granted to the key, and the shell configured for the
+// namespace (which may be empty), and stores them in the Extensions field of
+// the ssh connection permissions.
 //
 // The Extensions field is the only way to safely pass information between
 // handlers. See https://pkg.go.dev/vuln/GO-2024-3321
-func permissionsMarshal(ctx ssh.Context, eid, pid int, ename, pname string) {
-	ctx.Permissions().Extensions = map[string]string{
+func permissionsMarshal(ctx ssh.Context, eid, pid int, ename, pname, etype,
+	fingerprint string, capability rbac.Capability, shell string) {
+	extensions := map[string]string{
+		capabilityKey:      capability.String(),
 		environmentIDKey:   strconv.Itoa(eid),
 		environmentNameKey: ename,
 		projectIDKey:       strconv.Itoa(pid),
 		projectNameKey:     pname,
+		sshFingerprintKey:  fingerprint,
+	}
+	if etype != "" {
+		extensions[environmentTypeKey] = etype
 	}
+	if shell != "" {
+		extensions[shellKey] = shell
+	}
+	ctx.Permissions().Extensions = extensions
+}
+
+// deletedMarshal marks the connection as being to a namespace whose Lagoon
+// environment has been deleted, by storing the normalised fingerprint of the
+// key in the Extensions field of the ssh connection permissions. No other
+// details are stored, so sessions on the connection can't be started. See
+// deletedUnmarshal.
+func deletedMarshal(ctx ssh.Context, fingerprint string) {
+	ctx.Permissions().Extensions = map[string]string{
+		deletedKey:        "true",
+		sshFingerprintKey: fingerprint,
+	}
+}
+
+// NamespaceResolver provides methods for resolving the Lagoon environment
+// which a namespace belongs to.
+type NamespaceResolver interface {
+	NamespaceDetails(context.Context, string) (int, int, string, string, string,
+		string, error)
 }
 
 // pubKeyHandler returns a ssh.PublicKeyHandler which queries the remote
@@ -35,25 +85,87 @@ func permissionsMarshal(ctx ssh.Context, eid, pid int, ename, pname string) {
 // Note that this function will be called for ALL public keys presented by the
 // client, even if the client does not go on to prove ownership of the key by
 // signing with it. See https://pkg.go.dev/vuln/GO-2024-3321
+//
+// The first key denied on a connection counts as a failed authentication
+// attempt by the given tarpit.
+//
+// If the namespace exists in Kubernetes but Lagoon reports that it is
+// unknown, the environment has been deleted and the namespace is being
+// removed. In this case the key is accepted so that the session handler can
+// tell the user why they can't connect, instead of failing authentication
+// with a generic error. The connection is marked as deleted so that no
+// session can be started on it. ssh-portal-api only reports an unknown
+// namespace to the owner of a registered SSH key.
 func pubKeyHandler(
 	log *slog.Logger,
+	m *Metrics,
 	nc NATSService,
-	c K8SAPIService,
+	nr NamespaceResolver,
+	nsFilter *NamespaceFilter,
+	keyPolicy *keypolicy.Policy,
+	auditSink audit.Sink,
+	tarpit *AuthTarpit,
 ) ssh.PublicKeyHandler {
 	return func(ctx ssh.Context, key ssh.PublicKey) bool {
 		log := log.With(
-			slog.String("sessionID", ctx.SessionID()),
-			slog.String("namespace", ctx.User()),
+			slog.String(sessionlog.SessionIDKey, ctx.SessionID()),
+			slog.String(sessionlog.NamespaceKey, ctx.User()),
 		)
+		h := handshakeFromContext(ctx)
+		keysOffered := h.keyOffered()
+		fingerprint, fingerprintErr :=
+			sshfingerprint.Normalize(gossh.FingerprintSHA256(key))
+		// deny emits an audit event for the denied key, delays the response to
+		// the first denied key if the source has repeatedly failed to
+		// authenticate, and returns false
+		deny := func(reason string) bool {
+			emitAudit(ctx, log, auditSink, audit.Event{
+				Type:           audit.AuthDenied,
+				Time:           time.Now(),
+				SessionID:      ctx.SessionID(),
+				Namespace:      ctx.User(),
+				SSHFingerprint: fingerprint,
+				Reason:         reason,
+			})
+			if !tarpit.enabled() || !h.firstKeyDenied() {
+				return false
+			}
+			if delay := tarpit.failed(sourceIP(ctx.RemoteAddr())); delay > 0 {
+				m.authTarpitDelaysTotal.Inc()
+				log.Debug("delaying failed authentication",
+					slog.Duration("delay", delay))
+				tarpit.wait(ctx, delay)
+			}
+			return false
+		}
+		if fingerprintErr != nil {
+			log.Warn("couldn't normalise SSH fingerprint",
+				slog.Any("error", fingerprintErr))
+			return deny("invalid fingerprint")
+		}
+		// reject keys which don't meet the key policy
+		if err := keyPolicy.Check(key); err != nil {
+			m.keyPolicyRejectionsTotal.WithLabelValues(key.Type()).Inc()
+			keyPolicyLogSampler.Do(func() {
+				log.Info("public key rejected by key policy",
+					slog.String("keyType", key.Type()),
+					slog.Any("error", err))
+			})
+			return deny("key policy")
+		}
+		// reject namespaces not served by this ssh-portal as if unknown
+		if !nsFilter.Allowed(ctx.User()) {
+			log.Debug("namespace rejected by allow/deny patterns")
+			return deny("unknown namespace")
+		}
 		// get Lagoon labels from namespace if available
-		eid, pid, ename, pname, err := c.NamespaceDetails(ctx, ctx.User())
+		eid, pid, ename, pname, etype, shell, err :=
+			nr.NamespaceDetails(ctx, ctx.User())
 		if err != nil {
-			log.Debug("couldn't get namespace details",
-				slog.String("namespace", ctx.User()), slog.Any("error", err))
-			return false
+			log.Debug("couldn't get namespace details", slog.Any("error", err))
+			return deny("unknown namespace")
 		}
-		fingerprint := gossh.FingerprintSHA256(key)
-		ok, err := nc.KeyCanAccessEnvironment(
+		response, err := nc.KeyCanAccessEnvironment(
 			ctx.SessionID(),
 			fingerprint,
 			ctx.User(),
@@ -62,17 +174,45 @@ func pubKeyHandler(
 		)
 		if err != nil {
 			log.Warn("couldn't query permission via NATS", slog.Any("error", err))
-			return false
+			return deny("permission query failed")
 		}
 		// handle response
-		if !ok {
+		if !response.Allowed && response.Reason == bus.ReasonUnknownNamespace {
+			log.Info("SSH access to deleted environment",
+				slog.String(sessionlog.SSHFingerprintKey, fingerprint))
+			emitAudit(ctx, log, auditSink, audit.Event{
+				Type:           audit.AuthDenied,
+				Time:           time.Now(),
+				SessionID:      ctx.SessionID(),
+				Namespace:      ctx.User(),
+				SSHFingerprint: fingerprint,
+				Reason:         "environment deleted",
+			})
+			deletedMarshal(ctx, fingerprint)
+			return true
+		}
+		if !response.Allowed && response.Reason == bus.ReasonIDMismatch {
+			// namespace labels have drifted from the Lagoon API
+			log.Warn("SSH access not authorized",
+				slog.String(sessionlog.SSHFingerprintKey, fingerprint),
+				slog.String("reason", response.Reason),
+				slog.Int("projectID", pid),
+				slog.Int("environmentID", eid))
+			return deny("id mismatch")
+		}
+		if !response.Allowed {
 			log.Debug("SSH access not authorized",
-				slog.String("fingerprint", fingerprint))
-			return false
+				slog.String(sessionlog.SSHFingerprintKey, fingerprint),
+				slog.String("reason", response.Reason))
+			return deny("not authorized")
 		}
 		log.Debug("SSH access authorized",
-			slog.String("fingerprint", fingerprint))
-		permissionsMarshal(ctx, eid, pid, ename, pname)
+			slog.String(sessionlog.SSHFingerprintKey, fingerprint),
+			slog.String("capability", response.Capability.String()),
+			slog.Int("keysOffered", keysOffered),
+			slog.Duration("authDuration", h.authorize()))
+		permissionsMarshal(ctx, eid, pid, ename, pname, etype, fingerprint,
+			response.Capability, shell)
 		return true
 	}
 }
@@ -3,11 +3,19 @@ package sshserver_test
 import (
 	"crypto/ed25519"
 	"log/slog"
+	"net"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/alecthomas/assert/v2"
 	"github.com/gliderlabs/ssh"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/uselagoon/ssh-portal/internal/audit"
+	"github.com/uselagoon/ssh-portal/internal/bus"
+	"github.com/uselagoon/ssh-portal/internal/keypolicy"
+	"github.com/uselagoon/ssh-portal/internal/rbac"
 	"github.com/uselagoon/ssh-portal/internal/sshserver"
 	gomock "go.uber.org/mock/gomock"
 	gossh "golang.org/x/crypto/ssh"
@@ -17,25 +25,54 @@ func TestPubKeyHandler(t *testing.T) {
 	log := slog.New(slog.NewJSONHandler(os.Stderr, nil))
 	var testCases = map[string]struct {
 		keyCanAccessEnv bool
+		capability      rbac.Capability
+		reason          string
+		denyPattern     string
+		expectReason    string
 	}{
 		"access granted": {
 			keyCanAccessEnv: true,
 		},
+		"logs-only access granted": {
+			keyCanAccessEnv: true,
+			capability:      rbac.LogsOnly,
+		},
 		"access denied": {
 			keyCanAccessEnv: false,
+			expectReason:    "not authorized",
+		},
+		"id mismatch": {
+			keyCanAccessEnv: false,
+			reason:          bus.ReasonIDMismatch,
+			expectReason:    "id mismatch",
+		},
+		"namespace denied": {
+			keyCanAccessEnv: false,
+			denyPattern:     `my-project-.+`,
+			expectReason:    "unknown namespace",
 		},
 	}
 	for name, tc := range testCases {
 		t.Run(name, func(tt *testing.T) {
 			ctrl := gomock.NewController(tt)
-			k8sService := NewMockK8SAPIService(ctrl)
+			namespaces := NewMockNamespaceResolver(ctrl)
 			natsService := NewMockNATSService(ctrl)
 			sshContext := NewMockContext(ctrl)
+			auditSink := &recordingSink{}
+			nsFilter, err := sshserver.NewNamespaceFilter("", tc.denyPattern)
+			if err != nil {
+				tt.Fatal(err)
+			}
 			// configure callback
 			callback := sshserver.PubKeyHandler(
 				log,
+				sshserver.NewMetrics(prometheus.NewRegistry()),
 				natsService,
-				k8sService,
+				namespaces,
+				nsFilter,
+				&keypolicy.Policy{},
+				auditSink,
+				&sshserver.AuthTarpit{},
 			)
 			// configure mocks
 			namespaceName := "my-project-master"
@@ -44,8 +81,7 @@ func TestPubKeyHandler(t *testing.T) {
 			environmentID := 2
 			sshContext.EXPECT().User().Return(namespaceName).AnyTimes()
 			sshContext.EXPECT().SessionID().Return(sessionID).AnyTimes()
-			k8sService.EXPECT().NamespaceDetails(sshContext, namespaceName).
-				Return(environmentID, projectID, "master", "my-project", nil)
+			emulateContextValues(sshContext)
 			// set up public key mock
 			publicKey, _, err := ed25519.GenerateKey(nil)
 			if err != nil {
@@ -56,13 +92,23 @@ func TestPubKeyHandler(t *testing.T) {
 				tt.Fatal(err)
 			}
 			fingerprint := gossh.FingerprintSHA256(sshPublicKey)
-			natsService.EXPECT().KeyCanAccessEnvironment(
-				sessionID,
-				fingerprint,
-				namespaceName,
-				projectID,
-				environmentID,
-			).Return(tc.keyCanAccessEnv, nil)
+			// backend lookups are skipped if the namespace is denied
+			if tc.denyPattern == "" {
+				namespaces.EXPECT().NamespaceDetails(sshContext, namespaceName).
+					Return(environmentID, projectID, "master", "my-project",
+						"production", "", nil)
+				natsService.EXPECT().KeyCanAccessEnvironment(
+					sessionID,
+					fingerprint,
+					namespaceName,
+					projectID,
+					environmentID,
+				).Return(bus.SSHAccessResponse{
+					Allowed:    tc.keyCanAccessEnv,
+					Capability: tc.capability,
+					Reason:     tc.reason,
+				}, nil)
+			}
 			// set up permissions mock
 			sshPermissions := ssh.Permissions{Permissions: &gossh.Permissions{}}
 			// permissions are not touched if access is denied
@@ -72,6 +118,154 @@ func TestPubKeyHandler(t *testing.T) {
 			// execute callback
 			assert.Equal(
 				tt, tc.keyCanAccessEnv, callback(sshContext, sshPublicKey), name)
+			// denied keys are audited
+			if tc.keyCanAccessEnv {
+				assert.Equal(tt, tc.capability.String(),
+					sshPermissions.Extensions[sshserver.CapabilityKey], name)
+				assert.Equal(tt, fingerprint,
+					sshPermissions.Extensions[sshserver.SSHFingerprintKey], name)
+				assert.Equal(tt, "production",
+					sshPermissions.Extensions[sshserver.EnvironmentTypeKey], name)
+				assert.Equal(tt, 0, len(auditSink.events), name)
+				return
+			}
+			assert.Equal(tt, []audit.EventType{audit.AuthDenied},
+				auditSink.eventTypes(), name)
+			assert.Equal(tt, tc.expectReason, auditSink.events[0].Reason, name)
+			assert.Equal(tt, fingerprint, auditSink.events[0].SSHFingerprint, name)
 		})
 	}
 }
+
+func TestPubKeyHandlerDeletedEnvironment(t *testing.T) {
+	log := slog.New(slog.NewJSONHandler(os.Stderr, nil))
+	ctrl := gomock.NewController(t)
+	namespaces := NewMockNamespaceResolver(ctrl)
+	natsService := NewMockNATSService(ctrl)
+	sshContext := NewMockContext(ctrl)
+	auditSink := &recordingSink{}
+	nsFilter, err := sshserver.NewNamespaceFilter("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	callback := sshserver.PubKeyHandler(
+		log,
+		sshserver.NewMetrics(prometheus.NewRegistry()),
+		natsService,
+		namespaces,
+		nsFilter,
+		&keypolicy.Policy{},
+		auditSink,
+		&sshserver.AuthTarpit{},
+	)
+	namespaceName := "my-project-master"
+	sshContext.EXPECT().User().Return(namespaceName).AnyTimes()
+	sshContext.EXPECT().SessionID().Return("abc123").AnyTimes()
+	emulateContextValues(sshContext)
+	publicKey, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sshPublicKey, err := gossh.NewPublicKey(publicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fingerprint := gossh.FingerprintSHA256(sshPublicKey)
+	// the namespace still exists, but Lagoon no longer knows about it
+	namespaces.EXPECT().NamespaceDetails(sshContext, namespaceName).
+		Return(2, 1, "master", "my-project", "production", "", nil)
+	natsService.EXPECT().KeyCanAccessEnvironment(
+		"abc123", fingerprint, namespaceName, 1, 2).
+		Return(bus.SSHAccessResponse{Reason: bus.ReasonUnknownNamespace}, nil)
+	sshPermissions := ssh.Permissions{Permissions: &gossh.Permissions{}}
+	sshContext.EXPECT().Permissions().Return(&sshPermissions)
+	// the key is accepted so that the session handler can explain the denial,
+	// but no environment details are stored
+	assert.True(t, callback(sshContext, sshPublicKey))
+	assert.Equal(t, map[string]string{
+		sshserver.DeletedKey:        "true",
+		sshserver.SSHFingerprintKey: fingerprint,
+	}, sshPermissions.Extensions)
+	assert.Equal(t, []audit.EventType{audit.AuthDenied}, auditSink.eventTypes())
+	assert.Equal(t, "environment deleted", auditSink.events[0].Reason)
+}
+
+func TestPubKeyHandlerTarpitMultipleKeys(t *testing.T) {
+	log := slog.New(slog.NewJSONHandler(os.Stderr, nil))
+	// set up mocks
+	ctrl := gomock.NewController(t)
+	namespaces := NewMockNamespaceResolver(ctrl)
+	natsService := NewMockNATSService(ctrl)
+	metrics := sshserver.NewMetrics(prometheus.NewRegistry())
+	nsFilter, err := sshserver.NewNamespaceFilter("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// every failed connection after the first is delayed
+	tarpit, err := sshserver.NewAuthTarpit(1, time.Minute, time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tarpit.Stop()
+	callback := sshserver.PubKeyHandler(
+		log,
+		metrics,
+		natsService,
+		namespaces,
+		nsFilter,
+		&keypolicy.Policy{},
+		&recordingSink{},
+		tarpit,
+	)
+	namespaceName := "my-project-master"
+	namespaces.EXPECT().NamespaceDetails(gomock.Any(), namespaceName).
+		Return(2, 1, "master", "my-project", "", "", nil).AnyTimes()
+	// connect offers the given number of keys from the same source, and
+	// only the last key is authorized if authorize is true
+	connect := func(keys int, authorize bool) {
+		sshContext := NewMockContext(ctrl)
+		sshContext.EXPECT().User().Return(namespaceName).AnyTimes()
+		sshContext.EXPECT().SessionID().Return("abc123").AnyTimes()
+		sshContext.EXPECT().RemoteAddr().Return(&net.TCPAddr{
+			IP:   net.ParseIP("192.0.2.1"),
+			Port: 2222,
+		}).AnyTimes()
+		emulateContextValues(sshContext)
+		emulateLiveContext(sshContext)
+		sshPermissions := ssh.Permissions{Permissions: &gossh.Permissions{}}
+		sshContext.EXPECT().Permissions().Return(&sshPermissions).AnyTimes()
+		sshserver.ConnCallback(sshContext, nil)
+		for i := range keys {
+			publicKey, _, err := ed25519.GenerateKey(nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sshPublicKey, err := gossh.NewPublicKey(publicKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			allowed := authorize && i == keys-1
+			natsService.EXPECT().KeyCanAccessEnvironment(
+				"abc123",
+				gossh.FingerprintSHA256(sshPublicKey),
+				namespaceName,
+				1,
+				2,
+			).Return(bus.SSHAccessResponse{
+				Allowed:    allowed,
+				Capability: rbac.FullAccess,
+			}, nil)
+			assert.Equal(t, allowed, callback(sshContext, sshPublicKey))
+		}
+	}
+	// the denied keys of an authenticating client count as one failure
+	connect(4, true)
+	assert.Equal(t, 0.0, testutil.ToFloat64(metrics.AuthTarpitDelaysTotal()))
+	// so the next failed connection is the first to be delayed
+	connect(3, false)
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.AuthTarpitDelaysTotal()))
+	// starting a session clears the failures of the source
+	tarpit.Succeeded("192.0.2.1")
+	connect(1, false)
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.AuthTarpitDelaysTotal()))
+}
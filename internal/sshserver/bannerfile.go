@@ -0,0 +1,47 @@
+package sshserver
+
+import (
+	"fmt"
+	"os"
+	"sync/atomic"
+)
+
+// BannerFile is a banner read from a file, which may be re-read while the
+// server is running. This object should not be constructed by itself, only
+// via NewBannerFile().
+type BannerFile struct {
+	path   string
+	banner atomic.Pointer[string]
+}
+
+// NewBannerFile reads the banner from the file at the given path and returns
+// a new BannerFile. It returns an error if the file can't be read.
+func NewBannerFile(path string) (*BannerFile, error) {
+	b := BannerFile{path: path}
+	if err := b.Reload(); err != nil {
+		return nil, err
+	}
+	return &b, nil
+}
+
+// Reload re-reads the banner from the file. If the file can't be read an
+// error is returned and the previous banner is retained.
+func (b *BannerFile) Reload() error {
+	data, err := os.ReadFile(b.path)
+	if err != nil {
+		return fmt.Errorf("couldn't read banner file: %w", err)
+	}
+	banner := string(data)
+	b.banner.Store(&banner)
+	return nil
+}
+
+// Path returns the path of the banner file.
+func (b *BannerFile) Path() string {
+	return b.path
+}
+
+// String returns the most recently read banner.
+func (b *BannerFile) String() string {
+	return *b.banner.Load()
+}
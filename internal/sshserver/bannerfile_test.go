@@ -0,0 +1,30 @@
+package sshserver_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/alecthomas/assert/v2"
+	"github.com/uselagoon/ssh-portal/internal/sshserver"
+)
+
+func TestBannerFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "banner")
+	// missing files are an error
+	_, err := sshserver.NewBannerFile(path)
+	assert.Error(t, err)
+	// the banner is read on construction
+	assert.NoError(t, os.WriteFile(path, []byte("welcome\r\n"), 0600))
+	b, err := sshserver.NewBannerFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "welcome\r\n", b.String())
+	// and re-read on reload
+	assert.NoError(t, os.WriteFile(path, []byte("maintenance\r\n"), 0600))
+	assert.NoError(t, b.Reload())
+	assert.Equal(t, "maintenance\r\n", b.String())
+	// the previous banner is retained if the file becomes unreadable
+	assert.NoError(t, os.Remove(path))
+	assert.Error(t, b.Reload())
+	assert.Equal(t, "maintenance\r\n", b.String())
+}
@@ -0,0 +1,109 @@
+package sshserver
+
+import (
+	"encoding/json"
+	"log/slog"
+
+	"github.com/gliderlabs/ssh"
+)
+
+// capabilitiesCommand is the reserved command which returns the capabilities
+// of the portal instead of running a command in the environment.
+const capabilitiesCommand = "capabilities"
+
+// CapabilitiesSchemaVersion is the version of the structure of Capabilities.
+// It is incremented whenever a field is removed or its meaning changes.
+// Fields may be added without incrementing it, so clients should treat a
+// missing feature as unsupported.
+const CapabilitiesSchemaVersion = 1
+
+// Capabilities is the document returned as JSON by the capabilities command.
+// It lets client tooling discover which features a portal supports, without
+// trying them and handling the failure.
+type Capabilities struct {
+	SchemaVersion int                `json:"schemaVersion"`
+	PortalVersion string             `json:"portalVersion"`
+	Features      CapabilityFeatures `json:"features"`
+	Limits        CapabilityLimits   `json:"limits"`
+}
+
+// CapabilityFeatures lists the features enabled on a portal. A feature may
+// still be denied to a particular SSH key by its capability.
+type CapabilityFeatures struct {
+	// Exec is true if shell and command sessions are enabled.
+	Exec bool `json:"exec"`
+	// SFTP is true if sftp sessions are enabled.
+	SFTP bool `json:"sftp"`
+	// Debug is true if the debug connection parameter is enabled.
+	Debug bool `json:"debug"`
+	// Logs is true if logs sessions are enabled.
+	Logs bool `json:"logs"`
+	// LogsJSON is true if logs may be requested with format=json.
+	LogsJSON bool `json:"logsJSON"`
+	// LogsFilter is true if logs may be filtered by a regular expression.
+	LogsFilter bool `json:"logsFilter"`
+	// LogsInit is true if the logs of init containers may be requested.
+	LogsInit bool `json:"logsInit"`
+	// JobLogs is true if the logs of Jobs may be requested.
+	JobLogs bool `json:"jobLogs"`
+	// ConfirmProduction is true if interactive sessions to production
+	// environments must be confirmed before they start.
+	ConfirmProduction bool `json:"confirmProduction"`
+}
+
+// CapabilityLimits lists the limits in effect on a portal. A zero value
+// means there is no limit.
+type CapabilityLimits struct {
+	// LogsMaxTailLines is the maximum number of log lines which may be
+	// requested with tailLines.
+	LogsMaxTailLines int64 `json:"logsMaxTailLines"`
+	// LogTimeLimitSeconds is the maximum duration of logs sessions.
+	LogTimeLimitSeconds int64 `json:"logTimeLimitSeconds"`
+	// ExecTimeLimitSeconds is the maximum duration of shell, command, and
+	// sftp sessions.
+	ExecTimeLimitSeconds int64 `json:"execTimeLimitSeconds"`
+	// MaxCommandLengthBytes is the maximum length of a command.
+	MaxCommandLengthBytes int `json:"maxCommandLengthBytes"`
+}
+
+// newCapabilities returns the Capabilities of a portal configured with the
+// given options.
+func newCapabilities(opts Options) Capabilities {
+	logs := opts.LogAccessEnabled
+	return Capabilities{
+		SchemaVersion: CapabilitiesSchemaVersion,
+		PortalVersion: opts.Version,
+		Features: CapabilityFeatures{
+			Exec:              !opts.DisableExec,
+			SFTP:              !opts.DisableSFTP,
+			Debug:             opts.DebugEnabled && !opts.DisableExec,
+			Logs:              logs,
+			LogsJSON:          logs,
+			LogsFilter:        logs,
+			LogsInit:          logs,
+			JobLogs:           logs,
+			ConfirmProduction: opts.ConfirmProduction && !opts.DisableExec,
+		},
+		Limits: CapabilityLimits{
+			LogsMaxTailLines:      opts.LogsMaxTail,
+			LogTimeLimitSeconds:   int64(opts.LogTimeLimit.Seconds()),
+			ExecTimeLimitSeconds:  int64(opts.ExecTimeLimit.Seconds()),
+			MaxCommandLengthBytes: opts.MaxCommandLength,
+		},
+	}
+}
+
+// isCapabilitiesCommand returns true if the given session requests the
+// capabilities of the portal.
+func isCapabilitiesCommand(sftp bool, command []string) bool {
+	return !sftp && len(command) == 1 && command[0] == capabilitiesCommand
+}
+
+// writeCapabilities writes caps to the session as indented JSON.
+func writeCapabilities(log *slog.Logger, s ssh.Session, caps Capabilities) {
+	enc := json.NewEncoder(s)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(caps); err != nil {
+		log.Debug("couldn't write to session stream", slog.Any("error", err))
+	}
+}
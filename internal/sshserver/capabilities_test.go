@@ -0,0 +1,139 @@
+package sshserver_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/assert/v2"
+	"github.com/gliderlabs/ssh"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/uselagoon/ssh-portal/internal/rbac"
+	"github.com/uselagoon/ssh-portal/internal/sshserver"
+	"github.com/uselagoon/ssh-portal/internal/sshserver/sshservertest"
+	"go.uber.org/mock/gomock"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+func TestNewCapabilities(t *testing.T) {
+	var testCases = map[string]struct {
+		opts   sshserver.Options
+		expect sshserver.Capabilities
+	}{
+		"defaults": {
+			expect: sshserver.Capabilities{
+				SchemaVersion: sshserver.CapabilitiesSchemaVersion,
+				Features: sshserver.CapabilityFeatures{
+					Exec: true,
+					SFTP: true,
+				},
+			},
+		},
+		"everything enabled": {
+			opts: sshserver.Options{
+				LogAccessEnabled:  true,
+				DebugEnabled:      true,
+				ConfirmProduction: true,
+				ExecTimeLimit:     2 * time.Hour,
+				LogsMaxTail:       1000,
+				LogTimeLimit:      4 * time.Hour,
+				Version:           "v1.2.3",
+			},
+			expect: sshserver.Capabilities{
+				SchemaVersion: sshserver.CapabilitiesSchemaVersion,
+				PortalVersion: "v1.2.3",
+				Features: sshserver.CapabilityFeatures{
+					Exec:              true,
+					SFTP:              true,
+					Debug:             true,
+					Logs:              true,
+					LogsJSON:          true,
+					LogsFilter:        true,
+					LogsInit:          true,
+					JobLogs:           true,
+					ConfirmProduction: true,
+				},
+				Limits: sshserver.CapabilityLimits{
+					LogsMaxTailLines:     1000,
+					LogTimeLimitSeconds:  14400,
+					ExecTimeLimitSeconds: 7200,
+				},
+			},
+		},
+		"exec disabled": {
+			opts: sshserver.Options{
+				LogAccessEnabled:  true,
+				DebugEnabled:      true,
+				ConfirmProduction: true,
+				DisableExec:       true,
+				DisableSFTP:       true,
+			},
+			expect: sshserver.Capabilities{
+				SchemaVersion: sshserver.CapabilitiesSchemaVersion,
+				Features: sshserver.CapabilityFeatures{
+					Logs:       true,
+					LogsJSON:   true,
+					LogsFilter: true,
+					LogsInit:   true,
+					JobLogs:    true,
+				},
+			},
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			caps := sshserver.NewCapabilities(tc.opts)
+			assert.Equal(tt, tc.expect, caps, name)
+		})
+	}
+}
+
+func TestCapabilitiesCommand(t *testing.T) {
+	log := slog.New(slog.NewJSONHandler(&bytes.Buffer{}, nil))
+	// set up mocks
+	ctrl := gomock.NewController(t)
+	// the namespace has no deployments, so there is no cli service
+	k8sService := &sshservertest.FakeK8S{}
+	sshSession := NewMockSession(ctrl)
+	sshContext := NewMockContext(ctrl)
+	caps := sshserver.NewCapabilities(sshserver.Options{
+		LogAccessEnabled: true,
+		LogsMaxTail:      1000,
+		Version:          "v1.2.3",
+	})
+	// configure callback
+	callback := sshserver.SessionHandler(log,
+		sshserver.NewMetrics(prometheus.NewRegistry()),
+		sshserver.SessionConfig{
+			K8S:              k8sService,
+			LogAccessEnabled: true,
+			DefaultShell:     "sh",
+			AuditSink:        &recordingSink{},
+			Capabilities:     caps,
+		}, false)
+	// configure mocks
+	sshSession.EXPECT().Context().Return(sshContext).AnyTimes()
+	sshContext.EXPECT().SessionID().Return("test_session_id").AnyTimes()
+	emulateContextValues(sshContext)
+	emulateLiveContext(sshContext)
+	sshSession.EXPECT().RawCommand().Return("capabilities").AnyTimes()
+	sshSession.EXPECT().Command().Return([]string{"capabilities"}).AnyTimes()
+	sshSession.EXPECT().Subsystem().Return("").AnyTimes()
+	sshSession.EXPECT().User().Return("project-test").AnyTimes()
+	sshPermissions := ssh.Permissions{Permissions: &gossh.Permissions{}}
+	sshContext.EXPECT().Permissions().Return(&sshPermissions).AnyTimes()
+	sshserver.PermissionsMarshal(sshContext, 1, 2, "foo", "bar", "",
+		testFingerprint, rbac.FullAccess, "")
+	sshSession.EXPECT().Environ().Return(nil).AnyTimes()
+	var stdout bytes.Buffer
+	sshSession.EXPECT().Write(gomock.Any()).DoAndReturn(stdout.Write).
+		AnyTimes()
+	// execute callback
+	callback(sshSession)
+	var got sshserver.Capabilities
+	assert.NoError(t, json.Unmarshal(stdout.Bytes(), &got))
+	assert.Equal(t, caps, got)
+	assert.Equal(t, 0, len(k8sService.Calls()))
+}
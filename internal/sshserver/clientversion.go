@@ -0,0 +1,137 @@
+package sshserver
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/gliderlabs/ssh"
+	"github.com/uselagoon/ssh-portal/internal/messages"
+)
+
+// Normalised SSH client families, used as the client_family label of the
+// client_connections_total metric.
+const (
+	clientFamilyOpenSSH = "openssh"
+	clientFamilyPuTTY   = "putty"
+	clientFamilyLibSSH  = "libssh"
+	clientFamilyOther   = "other"
+)
+
+// openSSHVersionRegex matches the leading major.minor version of an OpenSSH
+// release, such as 9.6p1.
+var openSSHVersionRegex = regexp.MustCompile(`^(\d+)\.(\d+)`)
+
+// openSSHVersion is the major and minor version of an OpenSSH release.
+type openSSHVersion struct {
+	major, minor int
+}
+
+// String implements fmt.Stringer.
+func (v openSSHVersion) String() string {
+	return fmt.Sprintf("%d.%d", v.major, v.minor)
+}
+
+// less returns true if v is an earlier release than w.
+func (v openSSHVersion) less(w openSSHVersion) bool {
+	return v.major < w.major || (v.major == w.major && v.minor < w.minor)
+}
+
+// parseOpenSSHVersion parses an OpenSSH release version such as 7.4 or 9.6p1.
+// Anything following the minor version is ignored.
+func parseOpenSSHVersion(s string) (openSSHVersion, error) {
+	match := openSSHVersionRegex.FindStringSubmatch(s)
+	if match == nil {
+		return openSSHVersion{}, fmt.Errorf("invalid OpenSSH version: %q", s)
+	}
+	major, err := strconv.Atoi(match[1])
+	if err != nil {
+		return openSSHVersion{}, fmt.Errorf("invalid major version: %w", err)
+	}
+	minor, err := strconv.Atoi(match[2])
+	if err != nil {
+		return openSSHVersion{}, fmt.Errorf("invalid minor version: %w", err)
+	}
+	return openSSHVersion{major: major, minor: minor}, nil
+}
+
+// clientSoftware returns the softwareversion field of the SSH identification
+// string sent by a client, which has the form described in RFC 4253 section
+// 4.2:
+//
+//	SSH-protoversion-softwareversion SP comments
+//
+// It returns an empty string if the identification string is malformed.
+func clientSoftware(clientVersion string) string {
+	rest, ok := strings.CutPrefix(clientVersion, "SSH-")
+	if !ok {
+		return ""
+	}
+	_, software, ok := strings.Cut(rest, "-")
+	if !ok {
+		return ""
+	}
+	software, _, _ = strings.Cut(software, " ")
+	return software
+}
+
+// clientFamily returns the normalised family of the SSH client which sent the
+// given identification string: openssh, putty, libssh, or other. Clients
+// built on libssh2 are included in the libssh family.
+func clientFamily(clientVersion string) string {
+	software := strings.ToLower(clientSoftware(clientVersion))
+	switch {
+	case strings.HasPrefix(software, "openssh"):
+		return clientFamilyOpenSSH
+	case strings.HasPrefix(software, "putty"):
+		return clientFamilyPuTTY
+	case strings.HasPrefix(software, "libssh"):
+		return clientFamilyLibSSH
+	default:
+		return clientFamilyOther
+	}
+}
+
+// clientOpenSSHVersion returns the OpenSSH release of the client which sent
+// the given identification string, and true. It returns false if the client
+// is not OpenSSH, or its version can't be parsed.
+func clientOpenSSHVersion(clientVersion string) (openSSHVersion, bool) {
+	software := clientSoftware(clientVersion)
+	version, ok := strings.CutPrefix(software, "OpenSSH_")
+	if !ok {
+		return openSSHVersion{}, false
+	}
+	// Win32-OpenSSH identifies itself as OpenSSH_for_Windows_9.5
+	version = strings.TrimPrefix(version, "for_Windows_")
+	v, err := parseOpenSSHVersion(version)
+	return v, err == nil
+}
+
+// bannerHandler returns a ssh.BannerHandler which sends the given banner, or
+// the contents of bannerFile if it is not nil. If outdated is not nil, a
+// warning is appended to the banner sent to OpenSSH clients older than that
+// release. Other clients are not warned, since their version can't be
+// compared.
+func bannerHandler(
+	banner string,
+	bannerFile *BannerFile,
+	outdated *openSSHVersion,
+	msgs *messages.Catalog,
+) ssh.BannerHandler {
+	return func(ctx ssh.Context) string {
+		text := banner
+		if bannerFile != nil {
+			text = bannerFile.String()
+		}
+		if outdated == nil {
+			return text
+		}
+		v, ok := clientOpenSSHVersion(ctx.ClientVersion())
+		if !ok || !v.less(*outdated) {
+			return text
+		}
+		return text + msgs.Format(messages.OldClient,
+			messages.Vars{Detail: outdated.String()})
+	}
+}
@@ -0,0 +1,232 @@
+package sshserver
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/alecthomas/assert/v2"
+	"github.com/gliderlabs/ssh"
+)
+
+// Identification strings sent by real-world SSH clients.
+const (
+	openSSHUbuntu   = "SSH-2.0-OpenSSH_9.6p1 Ubuntu-3ubuntu13.5"
+	openSSHDebian   = "SSH-2.0-OpenSSH_7.4p1 Debian-10+deb9u7"
+	openSSHCentOS   = "SSH-2.0-OpenSSH_5.3"
+	openSSHMacOS    = "SSH-2.0-OpenSSH_9.7"
+	openSSHWindows  = "SSH-2.0-OpenSSH_for_Windows_8.1"
+	openSSHLegacy   = "SSH-1.99-OpenSSH_3.9p1"
+	puttyRelease    = "SSH-2.0-PuTTY_Release_0.81"
+	puttyKiTTY      = "SSH-2.0-PuTTY_KiTTY"
+	libSSH          = "SSH-2.0-libssh_0.10.6"
+	libSSH2         = "SSH-2.0-libssh2_1.11.0"
+	goSSH           = "SSH-2.0-Go"
+	paramiko        = "SSH-2.0-paramiko_3.4.0"
+	dropbear        = "SSH-2.0-dropbear_2022.83"
+	winSCP          = "SSH-2.0-WinSCP_release_6.3.3"
+	termius         = "SSH-2.0-Termius"
+	lowerOpenSSH    = "SSH-2.0-openssh_9.6"
+	missingPrefix   = "OpenSSH_9.6p1"
+	missingSoftware = "SSH-2.0"
+)
+
+func TestClientFamily(t *testing.T) {
+	var testCases = map[string]struct {
+		clientVersion string
+		expect        string
+	}{
+		"openssh ubuntu":       {openSSHUbuntu, "openssh"},
+		"openssh debian":       {openSSHDebian, "openssh"},
+		"openssh centos":       {openSSHCentOS, "openssh"},
+		"openssh macos":        {openSSHMacOS, "openssh"},
+		"openssh windows":      {openSSHWindows, "openssh"},
+		"openssh legacy proto": {openSSHLegacy, "openssh"},
+		"openssh lower case":   {lowerOpenSSH, "openssh"},
+		"putty release":        {puttyRelease, "putty"},
+		"putty kitty":          {puttyKiTTY, "putty"},
+		"libssh":               {libSSH, "libssh"},
+		"libssh2":              {libSSH2, "libssh"},
+		"go":                   {goSSH, "other"},
+		"paramiko":             {paramiko, "other"},
+		"dropbear":             {dropbear, "other"},
+		"winscp":               {winSCP, "other"},
+		"termius":              {termius, "other"},
+		"missing prefix":       {missingPrefix, "other"},
+		"missing software":     {missingSoftware, "other"},
+		"empty":                {"", "other"},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			assert.Equal(tt, tc.expect, clientFamily(tc.clientVersion), name)
+		})
+	}
+}
+
+func TestClientOpenSSHVersion(t *testing.T) {
+	var testCases = map[string]struct {
+		clientVersion string
+		expect        openSSHVersion
+		expectOK      bool
+	}{
+		"ubuntu": {
+			clientVersion: openSSHUbuntu,
+			expect:        openSSHVersion{major: 9, minor: 6},
+			expectOK:      true,
+		},
+		"debian": {
+			clientVersion: openSSHDebian,
+			expect:        openSSHVersion{major: 7, minor: 4},
+			expectOK:      true,
+		},
+		"centos": {
+			clientVersion: openSSHCentOS,
+			expect:        openSSHVersion{major: 5, minor: 3},
+			expectOK:      true,
+		},
+		"macos": {
+			clientVersion: openSSHMacOS,
+			expect:        openSSHVersion{major: 9, minor: 7},
+			expectOK:      true,
+		},
+		"windows": {
+			clientVersion: openSSHWindows,
+			expect:        openSSHVersion{major: 8, minor: 1},
+			expectOK:      true,
+		},
+		"legacy proto": {
+			clientVersion: openSSHLegacy,
+			expect:        openSSHVersion{major: 3, minor: 9},
+			expectOK:      true,
+		},
+		"putty":            {clientVersion: puttyRelease},
+		"libssh":           {clientVersion: libSSH},
+		"go":               {clientVersion: goSSH},
+		"missing prefix":   {clientVersion: missingPrefix},
+		"missing software": {clientVersion: missingSoftware},
+		"missing version":  {clientVersion: "SSH-2.0-OpenSSH_"},
+		"garbled version":  {clientVersion: "SSH-2.0-OpenSSH_x.y"},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			v, ok := clientOpenSSHVersion(tc.clientVersion)
+			assert.Equal(tt, tc.expectOK, ok, name)
+			assert.Equal(tt, tc.expect, v, name)
+		})
+	}
+}
+
+func TestParseOpenSSHVersion(t *testing.T) {
+	var testCases = map[string]struct {
+		input     string
+		expect    openSSHVersion
+		expectErr bool
+	}{
+		"release":       {input: "7.4", expect: openSSHVersion{7, 4}},
+		"portable":      {input: "9.6p1", expect: openSSHVersion{9, 6}},
+		"two digits":    {input: "10.12", expect: openSSHVersion{10, 12}},
+		"patch version": {input: "8.9.1", expect: openSSHVersion{8, 9}},
+		"major only":    {input: "7", expectErr: true},
+		"word":          {input: "seven", expectErr: true},
+		"leading v":     {input: "v7.4", expectErr: true},
+		"empty":         {input: "", expectErr: true},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			v, err := parseOpenSSHVersion(tc.input)
+			if tc.expectErr {
+				assert.Error(tt, err, name)
+				return
+			}
+			assert.NoError(tt, err, name)
+			assert.Equal(tt, tc.expect, v, name)
+		})
+	}
+}
+
+func TestOpenSSHVersionLess(t *testing.T) {
+	v74 := openSSHVersion{major: 7, minor: 4}
+	assert.True(t, openSSHVersion{major: 7, minor: 3}.less(v74))
+	assert.True(t, openSSHVersion{major: 6, minor: 9}.less(v74))
+	assert.False(t, v74.less(v74))
+	assert.False(t, openSSHVersion{major: 7, minor: 10}.less(v74))
+	assert.False(t, openSSHVersion{major: 8, minor: 0}.less(v74))
+}
+
+// versionContext is a ssh.Context which returns a fixed client version.
+type versionContext struct {
+	ssh.Context
+	clientVersion string
+}
+
+func (c versionContext) ClientVersion() string { return c.clientVersion }
+
+func TestBannerHandler(t *testing.T) {
+	warning := "warning: your SSH client is older than OpenSSH 7.4 and may " +
+		"not display terminals correctly. Please upgrade it.\r\n"
+	path := filepath.Join(t.TempDir(), "banner")
+	assert.NoError(t, os.WriteFile(path, []byte("from file\n"), 0600))
+	bannerFile, err := NewBannerFile(path)
+	assert.NoError(t, err)
+	var testCases = map[string]struct {
+		banner        string
+		bannerFile    *BannerFile
+		outdated      *openSSHVersion
+		clientVersion string
+		expect        string
+	}{
+		"banner": {
+			banner:        "welcome\n",
+			clientVersion: openSSHCentOS,
+			expect:        "welcome\n",
+		},
+		"banner file": {
+			banner:        "welcome\n",
+			bannerFile:    bannerFile,
+			clientVersion: openSSHCentOS,
+			expect:        "from file\n",
+		},
+		"old client warned": {
+			banner:        "welcome\n",
+			outdated:      &openSSHVersion{major: 7, minor: 4},
+			clientVersion: openSSHCentOS,
+			expect:        "welcome\n" + warning,
+		},
+		"old client warned without banner": {
+			outdated:      &openSSHVersion{major: 7, minor: 4},
+			clientVersion: openSSHCentOS,
+			expect:        warning,
+		},
+		"old client warned after banner file": {
+			bannerFile:    bannerFile,
+			outdated:      &openSSHVersion{major: 7, minor: 4},
+			clientVersion: openSSHLegacy,
+			expect:        "from file\n" + warning,
+		},
+		"minimum version not warned": {
+			banner:        "welcome\n",
+			outdated:      &openSSHVersion{major: 7, minor: 4},
+			clientVersion: openSSHDebian,
+			expect:        "welcome\n",
+		},
+		"new client not warned": {
+			banner:        "welcome\n",
+			outdated:      &openSSHVersion{major: 7, minor: 4},
+			clientVersion: openSSHUbuntu,
+			expect:        "welcome\n",
+		},
+		"other client not warned": {
+			banner:        "welcome\n",
+			outdated:      &openSSHVersion{major: 7, minor: 4},
+			clientVersion: puttyRelease,
+			expect:        "welcome\n",
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			handler := bannerHandler(tc.banner, tc.bannerFile, tc.outdated, nil)
+			ctx := versionContext{clientVersion: tc.clientVersion}
+			assert.Equal(tt, tc.expect, handler(ctx), name)
+		})
+	}
+}
@@ -0,0 +1,65 @@
+package sshserver
+
+import (
+	"fmt"
+	"unicode/utf8"
+)
+
+// DefaultMaxCommandLength is the default maximum length in bytes of the
+// command requested by a client.
+const DefaultMaxCommandLength = 64 * 1024
+
+// maxLoggedCommandLength is the maximum length in bytes of a command included
+// in a log line. Longer commands are truncated by truncateCommand and
+// truncateArgs, whether or not they are rejected.
+const maxLoggedCommandLength = 1024
+
+// truncatedSuffix returns the suffix appended to a truncated command.
+func truncatedSuffix(n int) string {
+	return fmt.Sprintf("[truncated %d bytes]", n)
+}
+
+// truncatePrefix returns the longest prefix of s no longer than limit bytes
+// which doesn't split a UTF-8 encoded rune.
+func truncatePrefix(s string, limit int) string {
+	if len(s) <= limit {
+		return s
+	}
+	for limit > 0 && !utf8.RuneStart(s[limit]) {
+		limit--
+	}
+	return s[:limit]
+}
+
+// truncateCommand returns the raw command cmd unchanged if it is no longer
+// than maxLoggedCommandLength, and otherwise a prefix of it followed by a
+// suffix giving the number of bytes removed.
+func truncateCommand(cmd string) string {
+	if len(cmd) <= maxLoggedCommandLength {
+		return cmd
+	}
+	prefix := truncatePrefix(cmd, maxLoggedCommandLength)
+	return prefix + truncatedSuffix(len(cmd)-len(prefix))
+}
+
+// truncateArgs returns args unchanged if their total length is no longer
+// than maxLoggedCommandLength. Otherwise it returns the arguments which fit,
+// followed by a prefix of the next argument with a suffix giving the number
+// of bytes removed from it and any later arguments.
+func truncateArgs(args []string) []string {
+	var total int
+	for i, arg := range args {
+		if total+len(arg) <= maxLoggedCommandLength {
+			total += len(arg)
+			continue
+		}
+		prefix := truncatePrefix(arg, maxLoggedCommandLength-total)
+		removed := len(arg) - len(prefix)
+		for _, later := range args[i+1:] {
+			removed += len(later)
+		}
+		truncated := append([]string{}, args[:i]...)
+		return append(truncated, prefix+truncatedSuffix(removed))
+	}
+	return args
+}
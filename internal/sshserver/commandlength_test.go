@@ -0,0 +1,165 @@
+package sshserver_test
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/alecthomas/assert/v2"
+	"github.com/gliderlabs/ssh"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/uselagoon/ssh-portal/internal/audit"
+	"github.com/uselagoon/ssh-portal/internal/rbac"
+	"github.com/uselagoon/ssh-portal/internal/sshserver"
+	"go.uber.org/mock/gomock"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+func TestTruncateCommand(t *testing.T) {
+	limit := sshserver.MaxLoggedCommandLength
+	var testCases = map[string]struct {
+		input  string
+		expect string
+	}{
+		"empty": {},
+		"short": {
+			input:  "ls -l",
+			expect: "ls -l",
+		},
+		"at limit": {
+			input:  strings.Repeat("a", limit),
+			expect: strings.Repeat("a", limit),
+		},
+		"over limit": {
+			input:  strings.Repeat("a", limit+6),
+			expect: strings.Repeat("a", limit) + "[truncated 6 bytes]",
+		},
+		"multibyte rune at limit": {
+			input:  strings.Repeat("a", limit-1) + "éb",
+			expect: strings.Repeat("a", limit-1) + "[truncated 3 bytes]",
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			assert.Equal(tt, tc.expect, sshserver.TruncateCommand(tc.input),
+				name)
+		})
+	}
+}
+
+func TestTruncateArgs(t *testing.T) {
+	limit := sshserver.MaxLoggedCommandLength
+	var testCases = map[string]struct {
+		input  []string
+		expect []string
+	}{
+		"nil": {},
+		"short": {
+			input:  []string{"ls", "-l"},
+			expect: []string{"ls", "-l"},
+		},
+		"at limit": {
+			input:  []string{"sh", "-c", strings.Repeat("a", limit-4)},
+			expect: []string{"sh", "-c", strings.Repeat("a", limit-4)},
+		},
+		"long argument": {
+			input: []string{"sh", "-c", strings.Repeat("a", limit+76), "x"},
+			expect: []string{"sh", "-c",
+				strings.Repeat("a", limit-4) + "[truncated 81 bytes]"},
+		},
+		"later arguments removed": {
+			input: []string{strings.Repeat("a", limit), "bb", "c"},
+			expect: []string{strings.Repeat("a", limit),
+				"[truncated 3 bytes]"},
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			assert.Equal(tt, tc.expect, sshserver.TruncateArgs(tc.input), name)
+		})
+	}
+}
+
+func TestMaxCommandLength(t *testing.T) {
+	var testCases = map[string]struct {
+		rawCommand       string
+		maxCommandLength int
+		expectRejected   bool
+	}{
+		"over limit": {
+			rawCommand:       "echo hello",
+			maxCommandLength: 9,
+			expectRejected:   true,
+		},
+		"at limit": {
+			rawCommand:       "echo hello",
+			maxCommandLength: 10,
+		},
+		"unlimited": {
+			rawCommand: strings.Repeat("a",
+				sshserver.DefaultMaxCommandLength+1),
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			// capture log output
+			var buf bytes.Buffer
+			log := slog.New(slog.NewJSONHandler(&buf, nil))
+			// set up mocks
+			ctrl := gomock.NewController(tt)
+			k8sService := NewMockK8SAPIService(ctrl)
+			sshSession := NewMockSession(ctrl)
+			sshContext := NewMockContext(ctrl)
+			auditSink := &recordingSink{}
+			// configure callback
+			callback := sshserver.SessionHandler(log,
+				sshserver.NewMetrics(prometheus.NewRegistry()),
+				sshserver.SessionConfig{
+					K8S:              k8sService,
+					LogAccessEnabled: true,
+					DefaultShell:     "sh",
+					AuditSink:        auditSink,
+					MaxCommandLength: tc.maxCommandLength,
+				}, false)
+			// configure mocks for a command session which, if it isn't
+			// rejected for its length, is rejected by the logs-only
+			// capability of the key
+			sshSession.EXPECT().Context().Return(sshContext)
+			sshContext.EXPECT().SessionID().Return("test_session_id").AnyTimes()
+			emulateContextValues(sshContext)
+			emulateLiveContext(sshContext)
+			sshSession.EXPECT().RawCommand().Return(tc.rawCommand).AnyTimes()
+			sshSession.EXPECT().Command().
+				Return(strings.Fields(tc.rawCommand)).AnyTimes()
+			sshSession.EXPECT().Subsystem().Return("").AnyTimes()
+			sshSession.EXPECT().User().Return("project-test").AnyTimes()
+			sshPermissions := ssh.Permissions{Permissions: &gossh.Permissions{}}
+			sshContext.EXPECT().Permissions().Return(&sshPermissions).AnyTimes()
+			sshserver.PermissionsMarshal(sshContext, 1, 2, "foo", "bar", "",
+				testFingerprint, rbac.LogsOnly, "")
+			sshSession.EXPECT().Environ().Return(nil)
+			var stderr bytes.Buffer
+			sshSession.EXPECT().Stderr().Return(&stderr)
+			sshSession.EXPECT().Exit(252).Return(nil)
+			// execute callback
+			callback(sshSession)
+			// check the response
+			assert.Equal(tt, []audit.EventType{audit.AuthDenied},
+				auditSink.eventTypes(), name)
+			if tc.expectRejected {
+				assert.Equal(tt, "command longer than the maximum of 9 bytes. "+
+					"SID: test_session_id\r\n", stderr.String(), name)
+				assert.Equal(tt, "command too long", auditSink.events[0].Reason,
+					name)
+				line := logLine(tt, &buf,
+					"rejecting command longer than maximum length")
+				assert.Equal[any](tt, float64(10), line["length"], name)
+			} else {
+				assert.NotContains(tt, stderr.String(), "maximum", name)
+				assert.NotEqual(tt, "command too long",
+					auditSink.events[0].Reason, name)
+			}
+		})
+	}
+}
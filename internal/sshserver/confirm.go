@@ -0,0 +1,83 @@
+package sshserver
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/uselagoon/ssh-portal/internal/messages"
+)
+
+const (
+	// productionConfirmTimeout is the time allowed for users to confirm
+	// interactive sessions to production environments.
+	productionConfirmTimeout = 30 * time.Second
+	// maxAnswerLen is the maximum length of an answer to the production
+	// confirmation prompt. Further input is ignored.
+	maxAnswerLen = 16
+)
+
+// errConfirmTimeout is returned by confirmProduction if the user does not
+// answer the prompt in time.
+var errConfirmTimeout = errors.New("timed out waiting for confirmation")
+
+// readAnswer reads a single line typed by the user of an interactive session,
+// and returns it. As the client terminal is in raw mode, input is read a byte
+// at a time and echoed back to the user, so that no input after the end of
+// the line is consumed. An interrupt or end-of-file returns an empty answer.
+func readAnswer(rw io.ReadWriter) string {
+	var answer []byte
+	b := make([]byte, 1)
+	for {
+		if _, err := rw.Read(b); err != nil {
+			return ""
+		}
+		switch c := b[0]; {
+		case c == '\r' || c == '\n':
+			_, _ = rw.Write([]byte("\r\n"))
+			return string(answer)
+		case c == 0x03 || c == 0x04: // ctrl-c, ctrl-d
+			_, _ = rw.Write([]byte("\r\n"))
+			return ""
+		case c == 0x7f || c == 0x08: // delete, backspace
+			if len(answer) > 0 {
+				answer = answer[:len(answer)-1]
+				_, _ = rw.Write([]byte("\b \b"))
+			}
+		case c >= 0x20 && c < 0x7f && len(answer) < maxAnswerLen:
+			answer = append(answer, c)
+			_, _ = rw.Write(b)
+		}
+	}
+}
+
+// confirmProduction prompts the user of an interactive session to confirm
+// that they intend to connect to the given production environment. It
+// returns true if the user types yes. If the user does not answer within the
+// timeout, it returns errConfirmTimeout.
+func confirmProduction(ctx context.Context, rw io.ReadWriter,
+	project, environment string, timeout time.Duration,
+	msgs *messages.Catalog) (bool, error) {
+	_, err := msgs.Fprint(ctx, rw, messages.ConfirmProduction, messages.Vars{
+		Project:     project,
+		Environment: environment,
+	})
+	if err != nil {
+		return false, err
+	}
+	// the goroutine is left blocked on read if the user doesn't answer, and
+	// returns when the session is closed
+	answer := make(chan string, 1)
+	go func() { answer <- readAnswer(rw) }()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case a := <-answer:
+		return a == "yes", nil
+	case <-timer.C:
+		return false, errConfirmTimeout
+	case <-ctx.Done():
+		return false, ctx.Err()
+	}
+}
@@ -2,137 +2,304 @@ package sshserver
 
 import (
 	"errors"
+	"fmt"
+	"path"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
+
+	"github.com/anmitsu/go-shlex"
+	"github.com/uselagoon/ssh-portal/internal/k8s"
 )
 
 var (
 	serviceRegex   = regexp.MustCompile(`^service=(\S+)`)
 	containerRegex = regexp.MustCompile(`^container=(\S+)`)
+	jobRegex       = regexp.MustCompile(`^job=(\S+)`)
+	debugRegex     = regexp.MustCompile(`^(debug)(?:\s|$)`)
 	logsRegex      = regexp.MustCompile(`^logs=(\S+)`)
 	tailLinesRegex = regexp.MustCompile(`^tailLines=(\d+)$`)
+	formatRegex    = regexp.MustCompile(`^format=(\S+)$`)
 )
 
+// maxLogsFilterLength is the maximum length in bytes of the filter
+// expression given after a logs=... argument.
+const maxLogsFilterLength = 256
+
+// shellMetacharacters are the characters which have special meaning to a POSIX
+// shell when they appear unquoted.
+const shellMetacharacters = ";&|()<>$`"
+
+// shells is the set of shell binary names recognised by
+// misquotedShellCommand.
+var shells = map[string]bool{
+	"ash":  true,
+	"bash": true,
+	"dash": true,
+	"sh":   true,
+	"zsh":  true,
+}
+
 var (
-	// ErrCmdArgsAfterLogs is returned when command arguments are found after
-	// the logs=... argument.
-	ErrCmdArgsAfterLogs = errors.New("command arguments after logs argument")
+	// ErrCmdArgsAfterLogs is returned when more than one command argument is
+	// found after the logs=... argument.
+	ErrCmdArgsAfterLogs = errors.New("command arguments after logs argument " +
+		"(quote the filter expression as a single argument)")
+	// ErrInvalidLogsFilter is returned when the filter expression after the
+	// logs=... argument is not a valid regular expression, or is too long.
+	ErrInvalidLogsFilter = errors.New("invalid logs filter expression")
 	// ErrInvalidLogsValue is returned when the value of the logs=...
 	// argument is an invalid value.
 	ErrInvalidLogsValue = errors.New("invalid logs argument value")
 	// ErrNoServiceForLogs is returned when logs=... is specified, but
-	// service=... is not.
+	// neither service=... nor job=... is.
 	ErrNoServiceForLogs = errors.New("missing service argument for logs argument")
 )
 
 // parseConnectionParams takes the split and raw SSH command, and parses out any
-// leading service=..., container=..., and logs=... arguments. It returns:
+// leading service=..., container=..., job=..., logs=..., and debug arguments.
+// debug is only parsed as an argument if debugEnabled is true. Otherwise it
+// is a command, as it was before debug sessions were supported.
+// It returns:
 //   - If a service=... argument is given, the value of that argument.
-//     If no such argument is given, it falls back to a default of "cli".
+//     If neither a service=... nor a job=... argument is given, it falls back
+//     to a default of "cli". If only a job=... argument is given, it returns
+//     an empty string.
 //   - If a container=... argument is given, the value of that argument.
 //     If no such argument is given, it returns an empty string.
+//   - If a job=... argument is given, the value of that argument.
+//     If no such argument is given, it returns an empty string.
 //   - If a logs=... argument is given, the value of that argument.
 //     If no such argument is given, it returns an empty string.
-//   - The remaining raw SSH command, with any leading service=, container=, or
-//     logs= arguments removed.
+//   - true if a debug argument is given, and false otherwise.
+//   - The remaining raw SSH command, with any leading service=, container=,
+//     job=, logs=, or debug arguments removed.
 //
 // Notes about the logic implemented here:
-//   - service=... must be given as the first argument to be recognised.
-//   - It is an error to specify container=... without service=...
-//   - If logs=... is given, it must be the final argument.
-//   - If not given in the expected order or with empty values, these
-//     parameters may be interpreted as regular command-line arguments.
+//   - service=..., container=..., job=..., logs=..., and debug may be given
+//     in any order, but must all appear before the command.
+//   - The first argument which is not one of these parameters, or which
+//     repeats a parameter already seen, ends parameter parsing.
+//   - It is an error to specify container=..., logs=..., or debug without
+//     service=... or job=..., in which case all arguments are interpreted as
+//     the command.
+//   - If logs=... is given, the command may only be a filter expression.
+//   - job=... is only valid with logs=..., and not with service=.... This is
+//     checked by the caller.
+//   - debug is only valid without a command, logs=..., or job=.... This is
+//     checked by the caller.
+//   - If given with empty values, these parameters may be interpreted as
+//     regular command-line arguments.
 //
-// In manpage syntax:
+// In manpage syntax, where the bracketed parameters may appear in any order:
 //
 //	[service=... [container=...]] CMD...
-//	service=... [container=...] logs=...
+//	service=... [container=...] logs=... [FILTER]
+//	job=... [container=...] logs=... [FILTER]
+//	service=... [container=...] debug
 func parseConnectionParams(
 	cmd []string,
 	rawCmd string,
-) (string, string, string, string) {
-	// exit early if we have no args
-	if len(cmd) == 0 {
-		return "cli", "", "", rawCmd
-	}
-	// check for service argument
-	serviceMatches := serviceRegex.FindStringSubmatch(cmd[0])
-	if len(serviceMatches) == 0 {
-		// no service= match, so assume cli and return all args
-		return "cli", "", "", rawCmd
-	}
-	service := serviceMatches[1]
-	rawCmd = strings.TrimSpace(serviceRegex.ReplaceAllString(rawCmd, ""))
-	// exit early if we are out of arguments
-	if len(cmd) == 1 {
-		return service, "", "", rawCmd
-	}
-	// check for container and/or logs argument
-	containerMatches := containerRegex.FindStringSubmatch(cmd[1])
-	if len(containerMatches) == 0 {
-		// no container= match, so check for logs=
-		logsMatches := logsRegex.FindStringSubmatch(cmd[1])
-		if len(logsMatches) == 0 {
-			// no container= or logs= match, so just return the args
-			return service, "", "", rawCmd
+	debugEnabled bool,
+) (string, string, string, string, bool, string) {
+	var service, container, job, logs, debug string
+	remainingCmd := rawCmd
+params:
+	for _, arg := range cmd {
+		var paramRegex *regexp.Regexp
+		var value *string
+		switch {
+		case service == "" && serviceRegex.MatchString(arg):
+			paramRegex, value = serviceRegex, &service
+		case container == "" && containerRegex.MatchString(arg):
+			paramRegex, value = containerRegex, &container
+		case job == "" && jobRegex.MatchString(arg):
+			paramRegex, value = jobRegex, &job
+		case logs == "" && logsRegex.MatchString(arg):
+			paramRegex, value = logsRegex, &logs
+		case debugEnabled && debug == "" && debugRegex.MatchString(arg):
+			paramRegex, value = debugRegex, &debug
+		default:
+			// first non-parameter argument, so stop parsing
+			break params
 		}
-		rawCmd = strings.TrimSpace(logsRegex.ReplaceAllString(rawCmd, ""))
-		// found logs=, so return it along with the remaining rawCmd
-		return service, "", logsMatches[1], rawCmd
+		*value = paramRegex.FindStringSubmatch(arg)[1]
+		remainingCmd = strings.TrimSpace(paramRegex.ReplaceAllString(remainingCmd, ""))
 	}
-	container := containerMatches[1]
-	rawCmd = strings.TrimSpace(containerRegex.ReplaceAllString(rawCmd, ""))
-	// exit early if we are out of arguments
-	if len(cmd) == 2 {
-		return service, container, "", rawCmd
+	if service == "" && job == "" {
+		// no service= or job= match, so assume cli and return all args
+		return "cli", "", "", "", false, rawCmd
 	}
-	// container= matched, so check for logs=
-	logsMatches := logsRegex.FindStringSubmatch(cmd[2])
-	if len(logsMatches) == 0 {
-		// no logs= match, so just return the remaining args
-		return service, container, "", rawCmd
+	return service, container, job, logs, debug != "", remainingCmd
+}
+
+// debugSessionError checks that a session with the debug argument is
+// permitted, and returns a message for the client explaining why it is not,
+// or an empty string if it is. Debug sessions must be enabled on the server,
+// and only start an interactive shell, so they can't be combined with sftp,
+// a command, or logs.
+func debugSessionError(
+	debugEnabled,
+	sftp bool,
+	job,
+	logs,
+	rawCmd string,
+) string {
+	switch {
+	case !debugEnabled:
+		return "debug sessions are not enabled"
+	case sftp:
+		return "debug sessions don't support sftp"
+	case job != "" || logs != "":
+		return "debug sessions don't support logs"
+	case rawCmd != "":
+		return "debug sessions only support an interactive shell"
+	default:
+		return ""
 	}
-	rawCmd = strings.TrimSpace(logsRegex.ReplaceAllString(rawCmd, ""))
-	// container= and logs= matched, so return both
-	return service, container, logsMatches[1], rawCmd
 }
 
 // parseLogsArg checks that:
-//   - logs value is one or both of "follow" and "tailLines=n" arguments, comma
-//     separated.
+//   - logs value is one or more of "follow", "nomarkers", "init",
+//     "tailLines=n", and "format=f" arguments, comma separated.
 //   - n is a positive integer.
-//   - if logs is valid, service is not empty.
-//   - if logs is valid, cmd is empty.
+//   - f is either "text" or "json".
+//   - if logs is valid, target is not empty. target is the service or job
+//     whose logs are requested.
+//   - if logs is valid, rawCmd is empty or a single (possibly quoted)
+//     argument, which is a regular expression of at most
+//     maxLogsFilterLength bytes.
 //
-// It returns the follow and tailLines values, and an error if one occurs (or
-// nil otherwise).
+// It returns the follow, tailLines, format, filter, markers, and
+// initContainers values, and an error if one occurs (or nil otherwise). If no
+// format is specified, it defaults to text. If no filter is specified, the
+// returned filter is nil. markers is true unless "nomarkers" is specified.
+// initContainers is true if "init" is specified, and requests the logs of
+// init containers as well.
 //
-// Note that if multiple tailLines= values are specified, the last one will be
-// the value used.
-func parseLogsArg(service, logs string, rawCmd string) (bool, int64, error) {
-	if len(rawCmd) != 0 {
-		return false, 0, ErrCmdArgsAfterLogs
+// Note that if multiple tailLines= or format= values are specified, the last
+// one will be the value used.
+func parseLogsArg(
+	target,
+	logs string,
+	rawCmd string,
+) (bool, int64, k8s.LogFormat, *regexp.Regexp, bool, bool, error) {
+	filter, err := parseLogsFilter(rawCmd)
+	if err != nil {
+		return false, 0, k8s.LogFormatText, nil, false, false, err
 	}
-	if service == "" {
-		return false, 0, ErrNoServiceForLogs
+	if target == "" {
+		return false, 0, k8s.LogFormatText, nil, false, false,
+			ErrNoServiceForLogs
 	}
 	var follow bool
 	var tailLines int64
-	var err error
+	format := k8s.LogFormatText
+	markers := true
+	var initContainers bool
 	for _, arg := range strings.Split(logs, ",") {
-		matches := tailLinesRegex.FindStringSubmatch(arg)
+		tailLinesMatches := tailLinesRegex.FindStringSubmatch(arg)
+		formatMatches := formatRegex.FindStringSubmatch(arg)
 		switch {
 		case arg == "follow":
 			follow = true
-		case len(matches) == 2:
-			tailLines, err = strconv.ParseInt(matches[1], 10, 64)
+		case arg == "nomarkers":
+			markers = false
+		case arg == "init":
+			initContainers = true
+		case len(tailLinesMatches) == 2:
+			tailLines, err = strconv.ParseInt(tailLinesMatches[1], 10, 64)
 			if err != nil {
-				return false, 0, ErrInvalidLogsValue
+				return false, 0, k8s.LogFormatText, nil, false, false,
+					ErrInvalidLogsValue
+			}
+		case len(formatMatches) == 2:
+			switch formatMatches[1] {
+			case "text":
+				format = k8s.LogFormatText
+			case "json":
+				format = k8s.LogFormatJSON
+			default:
+				return false, 0, k8s.LogFormatText, nil, false, false,
+					ErrInvalidLogsValue
 			}
 		default:
-			return false, 0, ErrInvalidLogsValue
+			return false, 0, k8s.LogFormatText, nil, false, false,
+				ErrInvalidLogsValue
 		}
 	}
-	return follow, tailLines, nil
+	return follow, tailLines, format, filter, markers, initContainers, nil
+}
+
+// parseLogsFilter parses the raw command given after a logs=... argument as
+// a log filter expression. It returns nil if rawCmd is empty.
+func parseLogsFilter(rawCmd string) (*regexp.Regexp, error) {
+	if rawCmd == "" {
+		return nil, nil
+	}
+	args, err := shlex.Split(rawCmd, true)
+	if err != nil || len(args) != 1 {
+		return nil, ErrCmdArgsAfterLogs
+	}
+	if len(args[0]) > maxLogsFilterLength {
+		return nil, ErrInvalidLogsFilter
+	}
+	filter, err := regexp.Compile(args[0])
+	if err != nil {
+		return nil, ErrInvalidLogsFilter
+	}
+	return filter, nil
+}
+
+// misquotedShellCommand returns true if cmd looks like a "sh -c ..." invocation
+// where the command string passed to -c was not quoted as a single argument by
+// the user. In this case the shell only executes the first argument after -c,
+// and the rest become positional parameters, which is almost never what was
+// intended.
+//
+// To limit false positives, this only reports a misquoted command if there
+// is more than one argument after -c and at least one of them contains a
+// shell metacharacter. Any leading service=... and container=... arguments
+// are ignored.
+func misquotedShellCommand(cmd []string) bool {
+	for len(cmd) > 0 &&
+		(serviceRegex.MatchString(cmd[0]) || containerRegex.MatchString(cmd[0])) {
+		cmd = cmd[1:]
+	}
+	if len(cmd) <= 3 || !shells[path.Base(cmd[0])] || cmd[1] != "-c" {
+		return false
+	}
+	for _, arg := range cmd[2:] {
+		if strings.ContainsAny(arg, shellMetacharacters) {
+			return true
+		}
+	}
+	return false
+}
+
+// misquotedShellWarning returns a one-line warning suggesting how to quote the
+// given misquoted shell command. rawCmd is the raw SSH command as returned by
+// parseConnectionParams, which is used in the suggestion so that the user's
+// original text is preserved. It returns an empty string if
+// misquotedShellCommand(cmd) is false.
+func misquotedShellWarning(cmd []string, rawCmd string) string {
+	if !misquotedShellCommand(cmd) {
+		return ""
+	}
+	shell, script, ok := strings.Cut(rawCmd, " -c ")
+	if !ok {
+		return ""
+	}
+	script = strings.TrimSpace(script)
+	first := cmd[slices.Index(cmd, "-c")+1]
+	return fmt.Sprintf("warning: the command after %s -c is not quoted, so "+
+		"only %q will be run by the shell. Did you mean: %s -c %s",
+		shell, first, shell, shellQuote(script))
+}
+
+// shellQuote returns s single-quoted so that it is interpreted as a single
+// literal word by a POSIX shell.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
 }
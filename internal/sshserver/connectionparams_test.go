@@ -1,25 +1,31 @@
 package sshserver_test
 
 import (
+	"strings"
 	"testing"
 
 	"github.com/alecthomas/assert/v2"
 	"github.com/anmitsu/go-shlex"
+	"github.com/uselagoon/ssh-portal/internal/k8s"
 	"github.com/uselagoon/ssh-portal/internal/sshserver"
 )
 
 type parsedParams struct {
 	service   string
 	container string
+	job       string
 	logs      string
+	debug     bool
 	rawCmd    string
 }
 
 func TestParseConnectionParams(t *testing.T) {
 	var testCases = map[string]struct {
-		rawCmd string
-		cmd    []string
-		expect parsedParams
+		rawCmd        string
+		cmd           []string
+		debugDisabled bool
+		expect        parsedParams
+		misquoted     bool
 	}{
 		"no special args": {
 			rawCmd: "drush do something",
@@ -51,14 +57,44 @@ func TestParseConnectionParams(t *testing.T) {
 				rawCmd:    "drush do something",
 			},
 		},
-		"invalid order": {
+		"container before service": {
 			rawCmd: "container=php service=nginx drush do something",
 			cmd:    []string{"container=php", "service=nginx", "drush", "do", "something"},
+			expect: parsedParams{
+				service:   "nginx",
+				container: "php",
+				logs:      "",
+				rawCmd:    "drush do something",
+			},
+		},
+		"container without service": {
+			rawCmd: "container=php drush do something",
+			cmd:    []string{"container=php", "drush", "do", "something"},
 			expect: parsedParams{
 				service:   "cli",
 				container: "",
 				logs:      "",
-				rawCmd:    "container=php service=nginx drush do something",
+				rawCmd:    "container=php drush do something",
+			},
+		},
+		"repeated service": {
+			rawCmd: "service=nginx service=php drush do something",
+			cmd:    []string{"service=nginx", "service=php", "drush", "do", "something"},
+			expect: parsedParams{
+				service:   "nginx",
+				container: "",
+				logs:      "",
+				rawCmd:    "service=php drush do something",
+			},
+		},
+		"service after command": {
+			rawCmd: "container=php drush service=nginx",
+			cmd:    []string{"container=php", "drush", "service=nginx"},
+			expect: parsedParams{
+				service:   "cli",
+				container: "",
+				logs:      "",
+				rawCmd:    "container=php drush service=nginx",
 			},
 		},
 		"service and logs params": {
@@ -81,14 +117,44 @@ func TestParseConnectionParams(t *testing.T) {
 				rawCmd:    "drush do something",
 			},
 		},
-		"service, container and logs params (wrong order)": {
+		"service, logs and container params": {
 			rawCmd: "service=nginx logs=follow container=php drush do something",
 			cmd:    []string{"service=nginx", "logs=follow", "container=php", "drush", "do", "something"},
 			expect: parsedParams{
 				service:   "nginx",
-				container: "",
+				container: "php",
 				logs:      "follow",
-				rawCmd:    "container=php drush do something",
+				rawCmd:    "drush do something",
+			},
+		},
+		"logs, service and container params": {
+			rawCmd: "logs=tailLines=10 service=nginx container=php",
+			cmd:    []string{"logs=tailLines=10", "service=nginx", "container=php"},
+			expect: parsedParams{
+				service:   "nginx",
+				container: "php",
+				logs:      "tailLines=10",
+				rawCmd:    "",
+			},
+		},
+		"container, logs and service params": {
+			rawCmd: "container=php logs=follow service=nginx",
+			cmd:    []string{"container=php", "logs=follow", "service=nginx"},
+			expect: parsedParams{
+				service:   "nginx",
+				container: "php",
+				logs:      "follow",
+				rawCmd:    "",
+			},
+		},
+		"logs without service": {
+			rawCmd: "logs=follow container=php",
+			cmd:    []string{"logs=follow", "container=php"},
+			expect: parsedParams{
+				service:   "cli",
+				container: "",
+				logs:      "",
+				rawCmd:    "logs=follow container=php",
 			},
 		},
 		"service and logs params (invalid logs value)": {
@@ -110,6 +176,7 @@ func TestParseConnectionParams(t *testing.T) {
 				logs:      "",
 				rawCmd:    "/bin/sh -c ( echo foo; echo bar; echo baz ) | tail -n2",
 			},
+			misquoted: true,
 		},
 		"subshell quoted": {
 			rawCmd: `/bin/sh -c "( echo foo; echo bar; echo baz ) | tail -n2"`,
@@ -130,6 +197,7 @@ func TestParseConnectionParams(t *testing.T) {
 				logs:      "",
 				rawCmd:    `/bin/sh -c sleep 3 & sleep 1 && pgrep sleep`,
 			},
+			misquoted: true,
 		},
 		"process substitution quoted": {
 			rawCmd: `/bin/sh -c "sleep 3 & sleep 1 && pgrep sleep"`,
@@ -150,6 +218,7 @@ func TestParseConnectionParams(t *testing.T) {
 				logs:      "",
 				rawCmd:    "/bin/sh -c echo $$ $USER",
 			},
+			misquoted: true,
 		},
 		"shell variables quoted": {
 			rawCmd: "/bin/sh -c 'echo $$ $USER'",
@@ -171,6 +240,79 @@ func TestParseConnectionParams(t *testing.T) {
 				rawCmd:    `echo "$(( $$ + 1 ))"`,
 			},
 		},
+		"job logs": {
+			rawCmd: "job=cron-drush-cron logs=tailLines=10",
+			cmd:    []string{"job=cron-drush-cron", "logs=tailLines=10"},
+			expect: parsedParams{
+				job:    "cron-drush-cron",
+				logs:   "tailLines=10",
+				rawCmd: "",
+			},
+		},
+		"job container and logs": {
+			rawCmd: "logs=follow container=cli job=migrate",
+			cmd:    []string{"logs=follow", "container=cli", "job=migrate"},
+			expect: parsedParams{
+				container: "cli",
+				job:       "migrate",
+				logs:      "follow",
+				rawCmd:    "",
+			},
+		},
+		"job and service": {
+			rawCmd: "service=cli job=migrate logs=follow",
+			cmd:    []string{"service=cli", "job=migrate", "logs=follow"},
+			expect: parsedParams{
+				service: "cli",
+				job:     "migrate",
+				logs:    "follow",
+				rawCmd:  "",
+			},
+		},
+		"debug": {
+			rawCmd: "service=nginx debug",
+			cmd:    []string{"service=nginx", "debug"},
+			expect: parsedParams{
+				service: "nginx",
+				debug:   true,
+				rawCmd:  "",
+			},
+		},
+		"debug before container": {
+			rawCmd: "debug container=php service=nginx",
+			cmd:    []string{"debug", "container=php", "service=nginx"},
+			expect: parsedParams{
+				service:   "nginx",
+				container: "php",
+				debug:     true,
+				rawCmd:    "",
+			},
+		},
+		"debug is a command if debug sessions are disabled": {
+			rawCmd:        "service=nginx debug --verbose",
+			cmd:           []string{"service=nginx", "debug", "--verbose"},
+			debugDisabled: true,
+			expect: parsedParams{
+				service: "nginx",
+				rawCmd:  "debug --verbose",
+			},
+		},
+		"debug prefix is a command": {
+			rawCmd: "service=nginx debugger --version",
+			cmd:    []string{"service=nginx", "debugger", "--version"},
+			expect: parsedParams{
+				service: "nginx",
+				rawCmd:  "debugger --version",
+			},
+		},
+		"debug without service": {
+			rawCmd: "debug",
+			cmd:    []string{"debug"},
+			expect: parsedParams{
+				service: "cli",
+				rawCmd:  "debug",
+			},
+		},
 		"ansible": {
 			rawCmd: "/bin/sh -c '( umask 77 && mkdir -p \"` echo /tmp `\"&& mkdir \"` echo /tmp/ansible-tmp-1729564333.3484864-620266-10397749948780 `\" && echo ansible-tmp-1729564333.3484864-620266-10397749948780=\"` echo /tmp/ansible-tmp-1729564333.3484864-620266-10397749948780 `\" ) && sleep 0'",
 			cmd:    []string{"/bin/sh", "-c", "( umask 77 && mkdir -p \"` echo /tmp `\"&& mkdir \"` echo /tmp/ansible-tmp-1729564333.3484864-620266-10397749948780 `\" && echo ansible-tmp-1729564333.3484864-620266-10397749948780=\"` echo /tmp/ansible-tmp-1729564333.3484864-620266-10397749948780 `\" ) && sleep 0"},
@@ -184,11 +326,17 @@ func TestParseConnectionParams(t *testing.T) {
 	}
 	for name, tc := range testCases {
 		t.Run(name, func(tt *testing.T) {
-			service, container, logs, rawCmd := sshserver.ParseConnectionParams(tc.cmd, tc.rawCmd)
+			service, container, job, logs, debug, rawCmd :=
+				sshserver.ParseConnectionParams(tc.cmd, tc.rawCmd,
+					!tc.debugDisabled)
 			assert.Equal(tt, tc.expect.service, service, name)
 			assert.Equal(tt, tc.expect.container, container, name)
+			assert.Equal(tt, tc.expect.job, job, name)
 			assert.Equal(tt, tc.expect.logs, logs, name)
+			assert.Equal(tt, tc.expect.debug, debug, name)
 			assert.Equal(tt, tc.expect.rawCmd, rawCmd, name)
+			assert.Equal(tt, tc.misquoted,
+				sshserver.MisquotedShellCommand(tc.cmd), name)
 			// and just to confirm the test data is correct, emulate ssh.Session.Command()
 			cmd, _ := shlex.Split(tc.rawCmd, true)
 			assert.Equal(tt, tc.cmd, cmd, name)
@@ -196,10 +344,54 @@ func TestParseConnectionParams(t *testing.T) {
 	}
 }
 
+func TestMisquotedShellWarning(t *testing.T) {
+	var testCases = map[string]struct {
+		rawCmd string
+		expect string
+	}{
+		"quoted": {
+			rawCmd: `/bin/sh -c "sleep 3 & sleep 1 && pgrep sleep"`,
+		},
+		"no metacharacters": {
+			rawCmd: "/bin/sh -c echo foo bar",
+		},
+		"not a shell": {
+			rawCmd: "drush sql-query 'select 1;'; echo done",
+		},
+		"subshell misquoted": {
+			rawCmd: "/bin/sh -c ( echo foo; echo bar; echo baz ) | tail -n2",
+			expect: `warning: the command after /bin/sh -c is not quoted, so only ` +
+				`"(" will be run by the shell. Did you mean: ` +
+				`/bin/sh -c '( echo foo; echo bar; echo baz ) | tail -n2'`,
+		},
+		"service and single quote": {
+			rawCmd: `service=nginx bash -c echo "it's" $HOME`,
+			expect: `warning: the command after bash -c is not quoted, so only ` +
+				`"echo" will be run by the shell. Did you mean: ` +
+				`bash -c 'echo "it'\''s" $HOME'`,
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			// emulate ssh.Session.Command()
+			cmd, err := shlex.Split(tc.rawCmd, true)
+			assert.NoError(tt, err, name)
+			_, _, _, _, _, rawCmd :=
+				sshserver.ParseConnectionParams(cmd, tc.rawCmd, true)
+			assert.Equal(tt, tc.expect,
+				sshserver.MisquotedShellWarning(cmd, rawCmd), name)
+		})
+	}
+}
+
 func TestValidateConnectionParams(t *testing.T) {
 	type result struct {
 		follow    bool
 		tailLines int64
+		format    k8s.LogFormat
+		filter    string
+		noMarkers bool
+		init      bool
 		err       error
 	}
 	var testCases = map[string]struct {
@@ -254,6 +446,44 @@ func TestValidateConnectionParams(t *testing.T) {
 				tailLines: 11,
 			},
 		},
+		"json format": {
+			input: parsedParams{
+				service: "nginx-php",
+				logs:    "format=json",
+			},
+			expect: result{
+				format: k8s.LogFormatJSON,
+			},
+		},
+		"follow tail and json format": {
+			input: parsedParams{
+				service: "nginx-php",
+				logs:    "follow,format=json,tailLines=10",
+			},
+			expect: result{
+				follow:    true,
+				tailLines: 10,
+				format:    k8s.LogFormatJSON,
+			},
+		},
+		"multiple format": {
+			input: parsedParams{
+				service: "nginx-php",
+				logs:    "format=json,format=text",
+			},
+			expect: result{
+				format: k8s.LogFormatText,
+			},
+		},
+		"invalid format value": {
+			input: parsedParams{
+				service: "nginx-php",
+				logs:    "follow,format=yaml",
+			},
+			expect: result{
+				err: sshserver.ErrInvalidLogsValue,
+			},
+		},
 		"invalid tail value": {
 			input: parsedParams{
 				service: "nginx-php",
@@ -309,14 +539,180 @@ func TestValidateConnectionParams(t *testing.T) {
 				err: sshserver.ErrInvalidLogsValue,
 			},
 		},
+		"follow without markers": {
+			input: parsedParams{
+				service: "nginx-php",
+				logs:    "follow,nomarkers",
+			},
+			expect: result{
+				follow:    true,
+				noMarkers: true,
+			},
+		},
+		"init containers": {
+			input: parsedParams{
+				service: "nginx-php",
+				logs:    "init",
+			},
+			expect: result{
+				init: true,
+			},
+		},
+		"follow init containers": {
+			input: parsedParams{
+				service: "nginx-php",
+				logs:    "follow,init,tailLines=10",
+			},
+			expect: result{
+				follow:    true,
+				tailLines: 10,
+				init:      true,
+			},
+		},
+		"filter": {
+			input: parsedParams{
+				service: "nginx-php",
+				logs:    "follow",
+				rawCmd:  "error",
+			},
+			expect: result{
+				follow: true,
+				filter: "error",
+			},
+		},
+		"quoted filter": {
+			input: parsedParams{
+				service: "nginx-php",
+				logs:    "tailLines=10",
+				rawCmd:  `'error|warn'`,
+			},
+			expect: result{
+				tailLines: 10,
+				filter:    "error|warn",
+			},
+		},
+		"double quoted filter with spaces": {
+			input: parsedParams{
+				service: "nginx-php",
+				logs:    "follow",
+				rawCmd:  `"GET /index.php"`,
+			},
+			expect: result{
+				follow: true,
+				filter: "GET /index.php",
+			},
+		},
+		"unquoted filter with spaces": {
+			input: parsedParams{
+				service: "nginx-php",
+				logs:    "follow",
+				rawCmd:  "grep error",
+			},
+			expect: result{
+				err: sshserver.ErrCmdArgsAfterLogs,
+			},
+		},
+		"unterminated quote": {
+			input: parsedParams{
+				service: "nginx-php",
+				logs:    "follow",
+				rawCmd:  `'error`,
+			},
+			expect: result{
+				err: sshserver.ErrCmdArgsAfterLogs,
+			},
+		},
+		"invalid filter": {
+			input: parsedParams{
+				service: "nginx-php",
+				logs:    "follow",
+				rawCmd:  "error(",
+			},
+			expect: result{
+				err: sshserver.ErrInvalidLogsFilter,
+			},
+		},
+		"unsupported filter syntax": {
+			input: parsedParams{
+				service: "nginx-php",
+				logs:    "follow",
+				rawCmd:  `'(error)\1'`,
+			},
+			expect: result{
+				err: sshserver.ErrInvalidLogsFilter,
+			},
+		},
+		"filter too long": {
+			input: parsedParams{
+				service: "nginx-php",
+				logs:    "follow",
+				rawCmd:  strings.Repeat("a", 257),
+			},
+			expect: result{
+				err: sshserver.ErrInvalidLogsFilter,
+			},
+		},
 	}
 	for name, tc := range testCases {
 		t.Run(name, func(tt *testing.T) {
-			follow, tailLines, err := sshserver.ParseLogsArg(
-				tc.input.service, tc.input.logs, tc.input.rawCmd)
+			follow, tailLines, format, filter, markers, initContainers, err :=
+				sshserver.ParseLogsArg(tc.input.service, tc.input.logs,
+					tc.input.rawCmd)
 			assert.IsError(tt, err, tc.expect.err, name)
+			assert.Equal(tt, !tc.expect.noMarkers && err == nil, markers, name)
+			assert.Equal(tt, tc.expect.init, initContainers, name)
 			assert.Equal(tt, tc.expect.follow, follow, name)
 			assert.Equal(tt, tc.expect.tailLines, tailLines, name)
+			assert.Equal(tt, tc.expect.format, format, name)
+			if tc.expect.filter == "" {
+				assert.Zero(tt, filter, name)
+			} else {
+				assert.Equal(tt, tc.expect.filter, filter.String(), name)
+			}
+		})
+	}
+}
+
+func TestDebugSessionError(t *testing.T) {
+	var testCases = map[string]struct {
+		debugEnabled bool
+		sftp         bool
+		job          string
+		logs         string
+		rawCmd       string
+		expect       string
+	}{
+		"allowed": {
+			debugEnabled: true,
+		},
+		"not enabled": {
+			expect: "debug sessions are not enabled",
+		},
+		"sftp": {
+			debugEnabled: true,
+			sftp:         true,
+			expect:       "debug sessions don't support sftp",
+		},
+		"logs": {
+			debugEnabled: true,
+			logs:         "follow",
+			expect:       "debug sessions don't support logs",
+		},
+		"job": {
+			debugEnabled: true,
+			job:          "cron",
+			expect:       "debug sessions don't support logs",
+		},
+		"command": {
+			debugEnabled: true,
+			rawCmd:       "ps aux",
+			expect:       "debug sessions only support an interactive shell",
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			assert.Equal(tt, tc.expect, sshserver.DebugSessionError(tc.debugEnabled,
+				tc.sftp, tc.job, tc.logs, tc.rawCmd), name)
 		})
 	}
 }
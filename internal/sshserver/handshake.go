@@ -0,0 +1,104 @@
+package sshserver
+
+import (
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+)
+
+// handshakeCtxKey is the key used to store the *handshake in the ssh.Context.
+type handshakeCtxKey struct{}
+
+// handshake records the timing of the phases of a single SSH connection, and
+// the number of public keys offered by the client during authentication.
+type handshake struct {
+	mu             sync.Mutex
+	accepted       time.Time
+	authorized     time.Time
+	keysOffered    int
+	keyDenied      bool
+	sessionStarted bool
+}
+
+// connCallback is a ssh.ConnCallback which stores a new *handshake in the
+// ssh.Context of each accepted connection.
+func connCallback(ctx ssh.Context, conn net.Conn) net.Conn {
+	ctx.SetValue(handshakeCtxKey{}, &handshake{accepted: time.Now()})
+	return conn
+}
+
+// handshakeFromContext returns the *handshake stored in the ssh.Context by
+// connCallback, or nil if there is none. The methods of a nil *handshake are
+// no-ops.
+func handshakeFromContext(ctx ssh.Context) *handshake {
+	h, _ := ctx.Value(handshakeCtxKey{}).(*handshake)
+	return h
+}
+
+// keyOffered records that the client offered a public key, and returns the
+// number of keys offered so far.
+func (h *handshake) keyOffered() int {
+	if h == nil {
+		return 0
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.keysOffered++
+	return h.keysOffered
+}
+
+// firstKeyDenied records that a public key offered by the client was denied,
+// and returns true if it is the first key denied on the connection.
+func (h *handshake) firstKeyDenied() bool {
+	if h == nil {
+		return true
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	first := !h.keyDenied
+	h.keyDenied = true
+	return first
+}
+
+// authorize records that a public key offered by the client was authorized,
+// and returns the time elapsed since the connection was accepted.
+//
+// Note that the client may not go on to prove ownership of the key, so this
+// is only the time of a successful authentication if a session is started.
+func (h *handshake) authorize() time.Duration {
+	if h == nil {
+		return 0
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.authorized = time.Now()
+	return h.authorized.Sub(h.accepted)
+}
+
+// sessionStart records the start of the first session on the connection. It
+// observes the authentication and session start durations in the given
+// metrics, and returns them along with the number of keys offered as log
+// attributes. It returns nil for every session after the first.
+func (h *handshake) sessionStart(m *Metrics) []any {
+	if h == nil {
+		return nil
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.sessionStarted {
+		return nil
+	}
+	h.sessionStarted = true
+	authDuration := h.authorized.Sub(h.accepted)
+	startDuration := time.Since(h.accepted)
+	m.authDuration.Observe(authDuration.Seconds())
+	m.sessionStartDuration.Observe(startDuration.Seconds())
+	return []any{
+		slog.Int("keysOffered", h.keysOffered),
+		slog.Duration("authDuration", authDuration),
+		slog.Duration("sessionStartDuration", startDuration),
+	}
+}
@@ -0,0 +1,93 @@
+package sshserver_test
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"log/slog"
+	"testing"
+
+	"github.com/alecthomas/assert/v2"
+	"github.com/gliderlabs/ssh"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/uselagoon/ssh-portal/internal/bus"
+	"github.com/uselagoon/ssh-portal/internal/keypolicy"
+	"github.com/uselagoon/ssh-portal/internal/rbac"
+	"github.com/uselagoon/ssh-portal/internal/sshserver"
+	"go.uber.org/mock/gomock"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+func TestHandshakeTiming(t *testing.T) {
+	// capture debug log output
+	var buf bytes.Buffer
+	log := slog.New(slog.NewJSONHandler(&buf,
+		&slog.HandlerOptions{Level: slog.LevelDebug}))
+	// set up mocks
+	ctrl := gomock.NewController(t)
+	namespaces := NewMockNamespaceResolver(ctrl)
+	natsService := NewMockNATSService(ctrl)
+	sshContext := NewMockContext(ctrl)
+	metrics := sshserver.NewMetrics(prometheus.NewRegistry())
+	nsFilter, err := sshserver.NewNamespaceFilter("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	callback := sshserver.PubKeyHandler(
+		log,
+		metrics,
+		natsService,
+		namespaces,
+		nsFilter,
+		&keypolicy.Policy{},
+		&recordingSink{},
+		&sshserver.AuthTarpit{},
+	)
+	namespaceName := "my-project-master"
+	sshContext.EXPECT().User().Return(namespaceName).AnyTimes()
+	sshContext.EXPECT().SessionID().Return("abc123").AnyTimes()
+	emulateContextValues(sshContext)
+	sshPermissions := ssh.Permissions{Permissions: &gossh.Permissions{}}
+	sshContext.EXPECT().Permissions().Return(&sshPermissions)
+	namespaces.EXPECT().NamespaceDetails(sshContext, namespaceName).
+		Return(2, 1, "master", "my-project", "", "", nil).Times(3)
+	// accept the connection
+	sshserver.ConnCallback(sshContext, nil)
+	// the client offers three keys, and only the last is authorized
+	for i := range 3 {
+		publicKey, _, err := ed25519.GenerateKey(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sshPublicKey, err := gossh.NewPublicKey(publicKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		natsService.EXPECT().KeyCanAccessEnvironment(
+			"abc123",
+			gossh.FingerprintSHA256(sshPublicKey),
+			namespaceName,
+			1,
+			2,
+		).Return(bus.SSHAccessResponse{
+			Allowed:    i == 2,
+			Capability: rbac.FullAccess,
+		}, nil)
+		assert.Equal(t, i == 2, callback(sshContext, sshPublicKey))
+	}
+	// check the authorization log fields
+	assert.Contains(t, buf.String(), `"keysOffered":3`)
+	keys := logLineKeys(t, &buf, "SSH access authorized")
+	assert.SliceContains(t, keys, "authDuration")
+	assert.SliceContains(t, keys, "keysOffered")
+	// the handshake timing is only recorded for the first session
+	attrs := sshserver.HandshakeSessionStart(sshContext, metrics)
+	assert.Equal(t, 3, len(attrs))
+	assert.Equal(t, slog.Int("keysOffered", 3), attrs[0].(slog.Attr))
+	assert.Equal(t, "authDuration", attrs[1].(slog.Attr).Key)
+	assert.Equal(t, "sessionStartDuration", attrs[2].(slog.Attr).Key)
+	assert.Zero(t, sshserver.HandshakeSessionStart(sshContext, metrics))
+	var metric dto.Metric
+	assert.NoError(t, metrics.AuthDuration().Write(&metric))
+	assert.Equal(t, uint64(1), metric.GetHistogram().GetSampleCount())
+}
@@ -1,18 +1,119 @@
 package sshserver
 
+import (
+	"github.com/gliderlabs/ssh"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
 // These variables are exposed for testing only.
 var (
 	ParseConnectionParams = parseConnectionParams
 	ParseLogsArg          = parseLogsArg
+	DebugSessionError     = debugSessionError
+	MisquotedShellCommand = misquotedShellCommand
+	MisquotedShellWarning = misquotedShellWarning
 	PermissionsMarshal    = permissionsMarshal
+	DeletedMarshal        = deletedMarshal
 	SessionHandler        = sessionHandler
 	PubKeyHandler         = pubKeyHandler
+	ConnCallback          = connCallback
+	ContextEnded          = contextEnded
+	SessionTag            = sessionTag
+	NewCapabilities       = newCapabilities
+	Levenshtein           = levenshtein
+	SuggestService        = suggestService
+	TruncateCommand       = truncateCommand
+	TruncateArgs          = truncateArgs
 )
 
+// SessionConfig is exposed for testing only.
+type SessionConfig = sessionConfig
+
 // Exposes the private ctxKey constants for testing only.
 const (
+	CapabilityKey      = capabilityKey
+	DeletedKey         = deletedKey
 	EnvironmentIDKey   = environmentIDKey
 	EnvironmentNameKey = environmentNameKey
+	EnvironmentTypeKey = environmentTypeKey
 	ProjectIDKey       = projectIDKey
 	ProjectNameKey     = projectNameKey
+	SSHFingerprintKey  = sshFingerprintKey
 )
+
+// MaxLoggedCommandLength exposes the private maxLoggedCommandLength constant
+// for testing only.
+const MaxLoggedCommandLength = maxLoggedCommandLength
+
+// GetSSHIntent exposes the private getSSHIntent function for testing only.
+func GetSSHIntent(sftp bool, rawCmd, shell, project, environment, sessionID,
+	fingerprint string) []string {
+	return getSSHIntent(sftp, rawCmd, shell, sessionEnv{
+		project:     project,
+		environment: environment,
+		sessionID:   sessionID,
+		fingerprint: fingerprint,
+	})
+}
+
+// SessionPanicsTotal exposes the private sessionPanicsTotal metric for testing
+// only.
+func (m *Metrics) SessionPanicsTotal() prometheus.Counter {
+	return m.sessionPanicsTotal
+}
+
+// SessionTotal exposes the private sessionTotal metric for testing only.
+func (m *Metrics) SessionTotal() *prometheus.CounterVec {
+	return m.sessionTotal
+}
+
+// AuthDuration exposes the private authDuration metric for testing only.
+func (m *Metrics) AuthDuration() prometheus.Histogram {
+	return m.authDuration
+}
+
+// HandshakeSessionStart exposes the private sessionStart method of the
+// handshake stored in ctx for testing only.
+func HandshakeSessionStart(ctx ssh.Context, m *Metrics) []any {
+	return handshakeFromContext(ctx).sessionStart(m)
+}
+
+// AuthTarpitDelaysTotal exposes the private authTarpitDelaysTotal metric for
+// testing only.
+func (m *Metrics) AuthTarpitDelaysTotal() prometheus.Counter {
+	return m.authTarpitDelaysTotal
+}
+
+// Succeeded exposes the private succeeded method for testing only.
+func (t *AuthTarpit) Succeeded(source string) {
+	t.succeeded(source)
+}
+
+// Stop exposes the private stop method for testing only.
+func (t *AuthTarpit) Stop() {
+	t.stop()
+}
+
+// ReauthDeniedTotal exposes the private reauthDeniedTotal metric for testing
+// only.
+func (m *Metrics) ReauthDeniedTotal() prometheus.Counter {
+	return m.reauthDeniedTotal
+}
+
+// SFTPServerMissingTotal exposes the private sftpServerMissingTotal metric for
+// testing only.
+func (m *Metrics) SFTPServerMissingTotal() prometheus.Counter {
+	return m.sftpServerMissingTotal
+}
+
+// ExecTimeLimitTotal exposes the private execTimeLimitTotal metric for
+// testing only.
+func (m *Metrics) ExecTimeLimitTotal() prometheus.Counter {
+	return m.execTimeLimitTotal
+}
+
+// SessionsDisabledTotal exposes the private sessionsDisabledTotal metric for
+// testing only.
+func (m *Metrics) SessionsDisabledTotal() *prometheus.CounterVec {
+	return m.sessionsDisabledTotal
+}
@@ -0,0 +1,108 @@
+package sshserver
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Metrics contains the Prometheus metrics exported by the ssh-portal server.
+type Metrics struct {
+	sessionTotal             *prometheus.CounterVec
+	execSessions             *prometheus.GaugeVec
+	execTimeLimitTotal       prometheus.Counter
+	sessionPanicsTotal       prometheus.Counter
+	logsSessions             *prometheus.GaugeVec
+	keyPolicyRejectionsTotal *prometheus.CounterVec
+	authTarpitDelaysTotal    prometheus.Counter
+	reauthDeniedTotal        prometheus.Counter
+	sftpServerMissingTotal   prometheus.Counter
+	sessionKindEnabled       *prometheus.GaugeVec
+	sessionsDisabledTotal    *prometheus.CounterVec
+	authDuration             prometheus.Histogram
+	sessionStartDuration     prometheus.Histogram
+	clientConnectionsTotal   *prometheus.CounterVec
+}
+
+// NewMetrics creates the ssh-portal server metrics and registers them with
+// reg.
+func NewMetrics(reg prometheus.Registerer) *Metrics {
+	factory := promauto.With(reg)
+	return &Metrics{
+		sessionTotal: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "sshportal_sessions_total",
+			Help: "The total number of ssh-portal sessions started",
+		}, []string{"environment_type"}),
+		execSessions: factory.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "sshportal_exec_sessions",
+			Help: "Current number of ssh-portal exec sessions",
+		}, []string{"environment_type"}),
+		execTimeLimitTotal: factory.NewCounter(prometheus.CounterOpts{
+			Name: "sshportal_exec_time_limit_total",
+			Help: "The total number of ssh-portal exec sessions ended by the exec time limit",
+		}),
+		sessionPanicsTotal: factory.NewCounter(prometheus.CounterOpts{
+			Name: "sshportal_session_panics_total",
+			Help: "The total number of panics recovered in ssh-portal session handlers",
+		}),
+		logsSessions: factory.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "sshportal_logs_sessions",
+			Help: "Current number of ssh-portal logs sessions",
+		}, []string{"environment_type"}),
+		keyPolicyRejectionsTotal: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "sshportal_key_policy_rejections_total",
+			Help: "The total number of public keys rejected by the key policy",
+		}, []string{"key_type"}),
+		authTarpitDelaysTotal: factory.NewCounter(prometheus.CounterOpts{
+			Name: "sshportal_auth_tarpit_delays_total",
+			Help: "The total number of failed authentication attempts delayed due to repeated failures from the same source",
+		}),
+		reauthDeniedTotal: factory.NewCounter(prometheus.CounterOpts{
+			Name: "sshportal_reauth_denied_total",
+			Help: "The total number of ssh-portal sessions denied because access was revoked after the connection was established",
+		}),
+		sftpServerMissingTotal: factory.NewCounter(prometheus.CounterOpts{
+			Name: "sshportal_sftp_server_missing_total",
+			Help: "The total number of ssh-portal sftp sessions to containers without an sftp-server binary",
+		}),
+		sessionKindEnabled: factory.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "sshportal_session_kind_enabled",
+			Help: "Whether each kind of ssh-portal session is enabled (1) or disabled (0) on this portal",
+		}, []string{"session_kind"}),
+		sessionsDisabledTotal: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "sshportal_sessions_disabled_total",
+			Help: "The total number of ssh-portal sessions rejected because their kind is disabled on this portal",
+		}, []string{"session_kind"}),
+		authDuration: factory.NewHistogram(prometheus.HistogramOpts{
+			Name: "sshportal_auth_duration_seconds",
+			Help: "Time from connection accept to successful public key authentication",
+		}),
+		sessionStartDuration: factory.NewHistogram(prometheus.HistogramOpts{
+			Name: "sshportal_session_start_duration_seconds",
+			Help: "Time from connection accept to the start of the first session",
+		}),
+		clientConnectionsTotal: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "sshportal_client_connections_total",
+			Help: "The total number of ssh-portal connections which started a session, by SSH client family",
+		}, []string{"client_family"}),
+	}
+}
+
+// Collectors returns each of the metrics in m.
+func (m *Metrics) Collectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		m.sessionTotal,
+		m.execSessions,
+		m.execTimeLimitTotal,
+		m.sessionPanicsTotal,
+		m.logsSessions,
+		m.keyPolicyRejectionsTotal,
+		m.authTarpitDelaysTotal,
+		m.reauthDeniedTotal,
+		m.sftpServerMissingTotal,
+		m.sessionKindEnabled,
+		m.sessionsDisabledTotal,
+		m.authDuration,
+		m.sessionStartDuration,
+		m.clientConnectionsTotal,
+	}
+}
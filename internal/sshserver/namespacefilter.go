@@ -0,0 +1,70 @@
+package sshserver
+
+import (
+	"fmt"
+	"regexp"
+)
+
+const (
+	// maxNamespacePatternLen is the maximum length of a namespace allow/deny
+	// pattern.
+	maxNamespacePatternLen = 1024
+	// maxNamespaceNameLen is the maximum length of a Kubernetes namespace name.
+	// Longer names are rejected without evaluating any patterns.
+	maxNamespaceNameLen = 63
+)
+
+// NamespaceFilter decides which namespaces this ssh-portal will serve.
+// This object should not be constructed by itself, only via
+// NewNamespaceFilter().
+type NamespaceFilter struct {
+	allow *regexp.Regexp
+	deny  *regexp.Regexp
+}
+
+// compileNamespacePattern compiles the given pattern anchored to match the
+// entire namespace name. An empty pattern returns a nil *regexp.Regexp.
+func compileNamespacePattern(pattern string) (*regexp.Regexp, error) {
+	if pattern == "" {
+		return nil, nil
+	}
+	if len(pattern) > maxNamespacePatternLen {
+		return nil, fmt.Errorf("pattern longer than %d characters",
+			maxNamespacePatternLen)
+	}
+	return regexp.Compile(`^(?:` + pattern + `)$`)
+}
+
+// NewNamespaceFilter validates the given allow and deny patterns and returns
+// a new NamespaceFilter. Patterns use RE2 syntax and must match the entire
+// namespace name. An empty pattern is ignored.
+func NewNamespaceFilter(allow, deny string) (*NamespaceFilter, error) {
+	allowRegex, err := compileNamespacePattern(allow)
+	if err != nil {
+		return nil, fmt.Errorf("invalid namespace allow pattern: %w", err)
+	}
+	denyRegex, err := compileNamespacePattern(deny)
+	if err != nil {
+		return nil, fmt.Errorf("invalid namespace deny pattern: %w", err)
+	}
+	return &NamespaceFilter{
+		allow: allowRegex,
+		deny:  denyRegex,
+	}, nil
+}
+
+// Allowed returns true if the given namespace matches the allow pattern (if
+// any), and does not match the deny pattern (if any). It returns false
+// otherwise.
+func (f *NamespaceFilter) Allowed(namespace string) bool {
+	if len(namespace) > maxNamespaceNameLen {
+		return false
+	}
+	if f.allow != nil && !f.allow.MatchString(namespace) {
+		return false
+	}
+	if f.deny != nil && f.deny.MatchString(namespace) {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,97 @@
+package sshserver_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/alecthomas/assert/v2"
+	"github.com/uselagoon/ssh-portal/internal/sshserver"
+)
+
+func TestNamespaceFilter(t *testing.T) {
+	var testCases = map[string]struct {
+		allow     string
+		deny      string
+		namespace string
+		expect    bool
+	}{
+		"no patterns": {
+			namespace: "project-main",
+			expect:    true,
+		},
+		"allow only match": {
+			allow:     `tenant-a-.+`,
+			namespace: "tenant-a-project-main",
+			expect:    true,
+		},
+		"allow only no match": {
+			allow:     `tenant-a-.+`,
+			namespace: "tenant-b-project-main",
+			expect:    false,
+		},
+		"allow only partial match": {
+			allow:     `tenant-a`,
+			namespace: "tenant-a-project-main",
+			expect:    false,
+		},
+		"deny only match": {
+			deny:      `.+-production`,
+			namespace: "project-production",
+			expect:    false,
+		},
+		"deny only no match": {
+			deny:      `.+-production`,
+			namespace: "project-main",
+			expect:    true,
+		},
+		"combined allowed": {
+			allow:     `tenant-a-.+`,
+			deny:      `.+-production`,
+			namespace: "tenant-a-project-main",
+			expect:    true,
+		},
+		"combined denied": {
+			allow:     `tenant-a-.+`,
+			deny:      `.+-production`,
+			namespace: "tenant-a-project-production",
+			expect:    false,
+		},
+		"combined not allowed": {
+			allow:     `tenant-a-.+`,
+			deny:      `.+-production`,
+			namespace: "tenant-b-project-main",
+			expect:    false,
+		},
+		"namespace too long": {
+			namespace: strings.Repeat("a", 64),
+			expect:    false,
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			f, err := sshserver.NewNamespaceFilter(tc.allow, tc.deny)
+			assert.NoError(tt, err, name)
+			assert.Equal(tt, tc.expect, f.Allowed(tc.namespace), name)
+		})
+	}
+}
+
+func TestNewNamespaceFilterInvalid(t *testing.T) {
+	var testCases = map[string]struct {
+		allow string
+		deny  string
+	}{
+		"invalid allow": {allow: `tenant-(`},
+		"invalid deny":  {deny: `[a-`},
+		"allow too long": {
+			allow: strings.Repeat("a", 1025),
+		},
+		"perl lookahead": {deny: `(?!tenant-a).*`},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			_, err := sshserver.NewNamespaceFilter(tc.allow, tc.deny)
+			assert.Error(tt, err, name)
+		})
+	}
+}
@@ -0,0 +1,145 @@
+package sshserver
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/uselagoon/ssh-portal/internal/audit"
+	"github.com/uselagoon/ssh-portal/internal/keypolicy"
+	"github.com/uselagoon/ssh-portal/internal/messages"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// Options configures the ssh server started by Serve. The zero value of each
+// optional field is replaced by a sensible default.
+type Options struct {
+	// Metrics is the set of metrics updated by the server. If nil, a set of
+	// unregistered metrics is used.
+	Metrics *Metrics
+	// NATS is used to query the ssh-portal-api. Required.
+	NATS NATSService
+	// Listener accepts SSH connections. Required.
+	Listener net.Listener
+	// K8S is used to connect sessions to the cluster. Required.
+	K8S K8SAPIService
+	// Namespaces resolves the Lagoon environment of the namespace given as
+	// the SSH user during authentication. Required.
+	Namespaces NamespaceResolver
+	// HostKeys are the host keys of the server, as returned by
+	// hostkey.Parse. If empty, an ephemeral host key is generated.
+	HostKeys []gossh.Signer
+	// LogAccessEnabled allows logs sessions.
+	LogAccessEnabled bool
+	// DebugEnabled allows debug sessions in ephemeral containers.
+	DebugEnabled bool
+	// DefaultShell is the shell used in exec sessions if the namespace does
+	// not specify one. Defaults to the fallback shell, sh.
+	DefaultShell string
+	// ExecTimeLimit is the maximum duration of exec sessions. Zero means no
+	// limit.
+	ExecTimeLimit time.Duration
+	// MaxCommandLength is the maximum length in bytes of the command
+	// requested by a client. Zero means no limit.
+	MaxCommandLength int
+	// LogsMaxTail is the maximum number of log lines a client may request. It
+	// is only used to advertise the limit to clients, which is enforced by
+	// K8S.
+	LogsMaxTail int64
+	// LogTimeLimit is the maximum duration of logs sessions. It is only used
+	// to advertise the limit to clients, which is enforced by K8S.
+	LogTimeLimit time.Duration
+	// Version is the version of the portal advertised to clients.
+	Version string
+	// ReauthPerSession re-checks access at the start of every session, rather
+	// than only during authentication.
+	ReauthPerSession bool
+	// DisableExec rejects shell, command, and debug sessions regardless of
+	// the capability of the key.
+	DisableExec bool
+	// DisableSFTP rejects sftp sessions regardless of the capability of the
+	// key.
+	DisableSFTP bool
+	// ConfirmProduction requires users of interactive sessions to production
+	// environments to confirm the session before the shell is started.
+	ConfirmProduction bool
+	// Banner is sent to clients before authentication.
+	Banner string
+	// BannerFile overrides Banner if set. The banner is read from the file
+	// whenever BannerFile.Reload() is called.
+	BannerFile *BannerFile
+	// OldClientVersion is an OpenSSH release such as 7.4. OpenSSH clients
+	// older than this are warned in the banner, but not rejected. If empty,
+	// no clients are warned.
+	OldClientVersion string
+	// NamespaceFilter restricts the namespaces which can be connected to. If
+	// nil, all namespaces are allowed.
+	NamespaceFilter *NamespaceFilter
+	// KeyPolicy restricts the public keys which are accepted. If nil, all
+	// keys are accepted.
+	KeyPolicy *keypolicy.Policy
+	// AuditSink receives audit events. If nil, audit events are discarded.
+	AuditSink audit.Sink
+	// Messages contains the user-facing messages printed to clients. If nil,
+	// the default messages are used.
+	Messages *messages.Catalog
+	// AuthTarpit delays failed authentication attempts from sources which
+	// repeatedly fail to authenticate. If nil, failures are not delayed.
+	AuthTarpit *AuthTarpit
+}
+
+// validate returns an error if the options can't be used to start a server.
+func (o *Options) validate() error {
+	if o.NATS == nil {
+		return errors.New("missing NATS service")
+	}
+	if o.Listener == nil {
+		return errors.New("missing listener")
+	}
+	if o.K8S == nil {
+		return errors.New("missing Kubernetes API service")
+	}
+	if o.Namespaces == nil {
+		return errors.New("missing namespace resolver")
+	}
+	for _, hk := range o.HostKeys {
+		if hk == nil {
+			return errors.New("nil host key")
+		}
+	}
+	if o.ExecTimeLimit < 0 {
+		return errors.New("negative exec time limit")
+	}
+	if o.MaxCommandLength < 0 {
+		return errors.New("negative max command length")
+	}
+	if o.OldClientVersion != "" {
+		if _, err := parseOpenSSHVersion(o.OldClientVersion); err != nil {
+			return fmt.Errorf("invalid old client version: %w", err)
+		}
+	}
+	return nil
+}
+
+// setDefaults replaces the zero value of optional fields with their default.
+func (o *Options) setDefaults() {
+	if o.Metrics == nil {
+		o.Metrics = NewMetrics(nil)
+	}
+	if o.DefaultShell == "" {
+		o.DefaultShell = fallbackShell
+	}
+	if o.NamespaceFilter == nil {
+		o.NamespaceFilter = &NamespaceFilter{}
+	}
+	if o.KeyPolicy == nil {
+		o.KeyPolicy = &keypolicy.Policy{}
+	}
+	if o.AuditSink == nil {
+		o.AuditSink = audit.Discard{}
+	}
+	if o.AuthTarpit == nil {
+		o.AuthTarpit = &AuthTarpit{}
+	}
+}
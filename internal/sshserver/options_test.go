@@ -0,0 +1,106 @@
+package sshserver
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/alecthomas/assert/v2"
+	"github.com/uselagoon/ssh-portal/internal/audit"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+func TestOptionsValidate(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	var testCases = map[string]struct {
+		modify      func(*Options)
+		expectError bool
+	}{
+		"valid": {
+			modify: func(*Options) {},
+		},
+		"host keys": {
+			modify: func(o *Options) {
+				o.HostKeys = []gossh.Signer{struct{ gossh.Signer }{}}
+			},
+		},
+		"nil NATS": {
+			modify:      func(o *Options) { o.NATS = nil },
+			expectError: true,
+		},
+		"nil listener": {
+			modify:      func(o *Options) { o.Listener = nil },
+			expectError: true,
+		},
+		"nil K8S": {
+			modify:      func(o *Options) { o.K8S = nil },
+			expectError: true,
+		},
+		"nil namespace resolver": {
+			modify:      func(o *Options) { o.Namespaces = nil },
+			expectError: true,
+		},
+		"nil host key": {
+			modify: func(o *Options) {
+				o.HostKeys = []gossh.Signer{struct{ gossh.Signer }{}, nil}
+			},
+			expectError: true,
+		},
+		"negative exec time limit": {
+			modify:      func(o *Options) { o.ExecTimeLimit = -1 },
+			expectError: true,
+		},
+		"negative max command length": {
+			modify:      func(o *Options) { o.MaxCommandLength = -1 },
+			expectError: true,
+		},
+		"old client version": {
+			modify: func(o *Options) { o.OldClientVersion = "7.4" },
+		},
+		"invalid old client version": {
+			modify:      func(o *Options) { o.OldClientVersion = "seven" },
+			expectError: true,
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			opts := Options{
+				NATS:       struct{ NATSService }{},
+				Listener:   l,
+				K8S:        struct{ K8SAPIService }{},
+				Namespaces: struct{ NamespaceResolver }{},
+			}
+			tc.modify(&opts)
+			if tc.expectError {
+				assert.Error(tt, opts.validate(), name)
+			} else {
+				assert.NoError(tt, opts.validate(), name)
+			}
+		})
+	}
+}
+
+func TestOptionsSetDefaults(t *testing.T) {
+	opts := Options{}
+	opts.setDefaults()
+	assert.NotZero(t, opts.Metrics)
+	assert.Equal(t, "sh", opts.DefaultShell)
+	assert.True(t, opts.NamespaceFilter.Allowed("project-main"))
+	assert.Equal[audit.Sink](t, audit.Discard{}, opts.AuditSink)
+	// explicit values are not replaced
+	opts = Options{DefaultShell: "bash"}
+	opts.setDefaults()
+	assert.Equal(t, "bash", opts.DefaultShell)
+}
+
+func TestServeInvalidOptions(t *testing.T) {
+	log := slog.New(slog.NewJSONHandler(os.Stderr, nil))
+	// Serve returns an error rather than panicking
+	assert.Error(t, Serve(context.Background(), log, Options{}))
+}
@@ -7,10 +7,12 @@ import (
 	"fmt"
 	"log/slog"
 	"net"
+	"sync"
 	"time"
 
 	"github.com/gliderlabs/ssh"
-	"github.com/uselagoon/ssh-portal/internal/k8s"
+	"github.com/uselagoon/ssh-portal/internal/bus"
+	"github.com/uselagoon/ssh-portal/internal/recovery"
 	gossh "golang.org/x/crypto/ssh"
 )
 
@@ -20,7 +22,56 @@ const shutdownTimeout = 8 * time.Second
 
 // NATSService represents a NATS RPC service.
 type NATSService interface {
-	KeyCanAccessEnvironment(string, string, string, int, int) (bool, error)
+	KeyCanAccessEnvironment(string, string, string, int, int) (
+		bus.SSHAccessResponse, error)
+}
+
+// trackingListener wraps a net.Listener and tracks accepted connections until
+// they are closed. Unlike ssh.Server, this includes connections which have not
+// yet completed the SSH handshake.
+type trackingListener struct {
+	net.Listener
+	conns sync.WaitGroup
+}
+
+// Accept implements net.Listener.
+func (l *trackingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	l.conns.Add(1)
+	return &trackedConn{Conn: conn, done: l.conns.Done}, nil
+}
+
+// wait waits until all accepted connections are closed, or the timeout
+// elapses. It returns false if the timeout elapsed. It must not be called
+// until Accept will no longer be called.
+func (l *trackingListener) wait(timeout time.Duration) bool {
+	closed := make(chan struct{})
+	go func() {
+		l.conns.Wait()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// trackedConn wraps a net.Conn and calls done when it is first closed.
+type trackedConn struct {
+	net.Conn
+	once sync.Once
+	done func()
+}
+
+// Close implements net.Conn.
+func (c *trackedConn) Close() error {
+	c.once.Do(c.done)
+	return c.Conn.Close()
 }
 
 // disableSHA1Kex returns a ServerConfig which relies on default for everything
@@ -40,42 +91,104 @@ func disableSHA1Kex(_ ssh.Context) *gossh.ServerConfig {
 	return &c
 }
 
-// Serve implements the ssh server logic.
-func Serve(
-	ctx context.Context,
-	log *slog.Logger,
-	nats NATSService,
-	l net.Listener,
-	c *k8s.Client,
-	hostKeys [][]byte,
-	logAccessEnabled bool,
-	banner string,
-) error {
+// Serve implements the ssh server logic. It returns an error without starting
+// the server if opts are invalid.
+func Serve(ctx context.Context, log *slog.Logger, opts Options) error {
+	if err := opts.validate(); err != nil {
+		return fmt.Errorf("invalid options: %w", err)
+	}
+	opts.setDefaults()
+	m := opts.Metrics
+	cfg := sessionConfig{
+		K8S:              opts.K8S,
+		LogAccessEnabled: opts.LogAccessEnabled,
+		DebugEnabled:     opts.DebugEnabled,
+		DefaultShell:     opts.DefaultShell,
+		ExecTimeLimit:    opts.ExecTimeLimit,
+		AuditSink:        opts.AuditSink,
+		DisableExec:      opts.DisableExec,
+		DisableSFTP:      opts.DisableSFTP,
+		Messages:         opts.Messages,
+		Capabilities:     newCapabilities(opts),
+		MaxCommandLength: opts.MaxCommandLength,
+		AuthTarpit:       opts.AuthTarpit,
+		Shutdown:         ctx,
+	}
+	// re-check access at the start of each session if required
+	if opts.ReauthPerSession {
+		cfg.Reauth = opts.NATS
+	}
+	// prompt for confirmation of production sessions if required
+	if opts.ConfirmProduction {
+		cfg.ConfirmTimeout = productionConfirmTimeout
+	}
+	handler := func(sftp bool) ssh.Handler {
+		return recovery.SSHHandler(log, m.sessionPanicsTotal,
+			sessionHandler(log, m, cfg, sftp))
+	}
+	// report the session kinds enabled on this portal
+	for kind, enabled := range map[string]bool{
+		sessionKindExec: !opts.DisableExec,
+		sessionKindSFTP: !opts.DisableSFTP,
+		sessionKindLogs: opts.LogAccessEnabled,
+	} {
+		if enabled {
+			m.sessionKindEnabled.WithLabelValues(kind).Set(1)
+		} else {
+			m.sessionKindEnabled.WithLabelValues(kind).Set(0)
+		}
+	}
+	log.Info("configured session kinds",
+		slog.Bool("execEnabled", !opts.DisableExec),
+		slog.Bool("sftpEnabled", !opts.DisableSFTP),
+		slog.Bool("logsEnabled", opts.LogAccessEnabled))
 	srv := ssh.Server{
-		Handler: sessionHandler(log, c, false, logAccessEnabled),
+		Handler: handler(false),
 		SubsystemHandlers: map[string]ssh.SubsystemHandler{
-			"sftp": ssh.SubsystemHandler(sessionHandler(log, c, true, logAccessEnabled)),
+			"sftp": ssh.SubsystemHandler(handler(true)),
 		},
-		PublicKeyHandler:     pubKeyHandler(log, nats, c),
+		PublicKeyHandler: pubKeyHandler(log, m, opts.NATS, opts.Namespaces,
+			opts.NamespaceFilter, opts.KeyPolicy, opts.AuditSink,
+			opts.AuthTarpit),
+		ConnCallback:         connCallback,
 		ServerConfigCallback: disableSHA1Kex,
-		Banner:               banner,
+		Banner:               opts.Banner,
 	}
-	for _, hk := range hostKeys {
-		if err := srv.SetOption(ssh.HostKeyPEM(hk)); err != nil {
-			return fmt.Errorf("invalid host key: %v", err)
-		}
+	if opts.OldClientVersion != "" {
+		// validated above
+		outdated, _ := parseOpenSSHVersion(opts.OldClientVersion)
+		srv.BannerHandler = bannerHandler(opts.Banner, opts.BannerFile,
+			&outdated, opts.Messages)
+	} else if opts.BannerFile != nil {
+		srv.BannerHandler = bannerHandler("", opts.BannerFile, nil,
+			opts.Messages)
+	}
+	for _, hk := range opts.HostKeys {
+		srv.AddHostKey(hk)
 	}
 	go func() {
 		// As soon as the top level context is cancelled, shut down the server.
+		// Shutdown closes the listener first so that new connections are
+		// refused, and then waits for authenticated connections to finish.
 		<-ctx.Done()
+		// release tarpitted connections so they don't delay shutdown
+		opts.AuthTarpit.stop()
 		shutCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
 		defer cancel()
 		if err := srv.Shutdown(shutCtx); err != nil {
 			log.Warn("couldn't shutdown cleanly", slog.Any("error", err))
 		}
 	}()
-	if err := srv.Serve(l); !errors.Is(err, ssh.ErrServerClosed) {
+	tl := &trackingListener{Listener: opts.Listener}
+	if err := srv.Serve(tl); !errors.Is(err, ssh.ErrServerClosed) {
 		return err
 	}
+	// Serve returns as soon as the listener is closed, so wait for in-flight
+	// connections, including those which are still authenticating, before
+	// returning. This allows the caller to close the NATS client once Serve
+	// returns.
+	if !tl.wait(shutdownTimeout) {
+		log.Warn("connections still open after shutdown timeout")
+	}
 	return nil
 }
@@ -1,10 +1,19 @@
 package sshserver
 
 import (
+	"context"
+	"log/slog"
+	"net"
+	"os"
 	"slices"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/alecthomas/assert/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/uselagoon/ssh-portal/internal/audit"
+	"github.com/uselagoon/ssh-portal/internal/keypolicy"
 )
 
 func TestDisableSHA1Kex(t *testing.T) {
@@ -22,3 +31,106 @@ func TestDisableSHA1Kex(t *testing.T) {
 		})
 	}
 }
+
+// eventRecorder records the order of shutdown events.
+type eventRecorder struct {
+	mu     sync.Mutex
+	events []string
+}
+
+func (r *eventRecorder) record(event string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, event)
+}
+
+func (r *eventRecorder) recorded() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return slices.Clone(r.events)
+}
+
+// recordingListener wraps a net.Listener and records when it is closed.
+type recordingListener struct {
+	net.Listener
+	recorder *eventRecorder
+	once     sync.Once
+}
+
+func (l *recordingListener) Close() error {
+	l.once.Do(func() { l.recorder.record("listener closed") })
+	return l.Listener.Close()
+}
+
+func TestServeShutdownOrder(t *testing.T) {
+	log := slog.New(slog.NewJSONHandler(os.Stderr, nil))
+	recorder := &eventRecorder{}
+	tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := tcpListener.Addr().String()
+	l := &recordingListener{Listener: tcpListener, recorder: recorder}
+	nsFilter, err := NewNamespaceFilter("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	served := make(chan error)
+	go func() {
+		err := Serve(ctx, log, Options{
+			Metrics:         NewMetrics(prometheus.NewRegistry()),
+			NATS:            struct{ NATSService }{},
+			Listener:        l,
+			K8S:             struct{ K8SAPIService }{},
+			Namespaces:      struct{ NamespaceResolver }{},
+			NamespaceFilter: nsFilter,
+			KeyPolicy:       &keypolicy.Policy{},
+			AuditSink:       audit.Discard{},
+		})
+		recorder.record("serve returned")
+		served <- err
+	}()
+	// open a connection which stays in the handshake until it is closed
+	var conn net.Conn
+	for range 50 {
+		if conn, err = net.Dial("tcp", addr); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	// wait for the server to send its version, so the connection is in-flight
+	_, err = conn.Read(make([]byte, 1))
+	assert.NoError(t, err)
+	// start shutdown
+	cancel()
+	for range 50 {
+		if slices.Contains(recorder.recorded(), "listener closed") {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// new connections are refused, but Serve waits for the in-flight connection
+	_, err = net.Dial("tcp", addr)
+	assert.Error(t, err)
+	select {
+	case <-served:
+		t.Fatal("Serve returned before in-flight connection finished")
+	case <-time.After(100 * time.Millisecond):
+	}
+	recorder.record("connection closed")
+	assert.NoError(t, conn.Close())
+	assert.NoError(t, <-served)
+	// the caller closes NATS once Serve returns
+	recorder.record("nats closed")
+	assert.Equal(t, []string{
+		"listener closed",
+		"connection closed",
+		"serve returned",
+		"nats closed",
+	}, recorder.recorded())
+}
@@ -2,44 +2,59 @@ package sshserver
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
+	"regexp"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/gliderlabs/ssh"
-	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/uselagoon/ssh-portal/internal/audit"
+	"github.com/uselagoon/ssh-portal/internal/bus"
 	"github.com/uselagoon/ssh-portal/internal/k8s"
-	gossh "golang.org/x/crypto/ssh"
+	"github.com/uselagoon/ssh-portal/internal/lagoon"
+	"github.com/uselagoon/ssh-portal/internal/messages"
+	"github.com/uselagoon/ssh-portal/internal/rbac"
+	"github.com/uselagoon/ssh-portal/internal/sessionlog"
 	"k8s.io/utils/exec"
 )
 
+// fallbackShell is the shell used if no other shell is configured, or if the
+// configured shell fails to start.
+const fallbackShell = "sh"
+
+// execTimeWarningLead is how long before the exec time limit is reached that
+// pty sessions are warned. If the time limit is less than twice this value,
+// the warning is sent halfway through the session instead.
+const execTimeWarningLead = 5 * time.Minute
+
+// Session kinds which may be disabled on a portal, or not permitted by the
+// capability of a key.
+const (
+	sessionKindExec = string(rbac.SessionExec)
+	sessionKindSFTP = string(rbac.SessionSFTP)
+	sessionKindLogs = string(rbac.SessionLogs)
+)
+
 // K8SAPIService provides methods for querying the Kubernetes API.
 type K8SAPIService interface {
+	Debug(context.Context, string, string, string, []string, io.ReadWriter,
+		io.Writer, bool, <-chan ssh.Window) error
 	Exec(context.Context, string, string, string, []string, io.ReadWriter,
 		io.Writer, bool, <-chan ssh.Window) error
-	FindDeployment(context.Context, string, string) (string, error)
-	Logs(context.Context, string, string, string, bool, int64, io.ReadWriter) error
-	NamespaceDetails(context.Context, string) (int, int, string, string, error)
+	FindDeployment(context.Context, string, string) (string,
+		k8s.DeploymentAccess, error)
+	JobLogs(context.Context, string, string, string, bool, int64,
+		k8s.LogFormat, *regexp.Regexp, bool, bool, io.ReadWriter) error
+	ListServices(context.Context, string) ([]string, error)
+	Logs(context.Context, string, string, string, bool, int64, k8s.LogFormat,
+		*regexp.Regexp, bool, bool, io.ReadWriter) error
 }
 
-var (
-	sessionTotal = promauto.NewCounter(prometheus.CounterOpts{
-		Name: "sshportal_sessions_total",
-		Help: "The total number of ssh-portal sessions started",
-	})
-	execSessions = promauto.NewGauge(prometheus.GaugeOpts{
-		Name: "sshportal_exec_sessions",
-		Help: "Current number of ssh-portal exec sessions",
-	})
-	logsSessions = promauto.NewGauge(prometheus.GaugeOpts{
-		Name: "sshportal_logs_sessions",
-		Help: "Current number of ssh-portal logs sessions",
-	})
-)
-
 // permissionsUnmarshal extracts details of the Lagoon environment identified
 // in the pubKeyHandler which were stored in the Extensions field of the ssh
 // connection. See permissionsMarshal.
@@ -80,26 +95,271 @@ func permissionsUnmarshal(ctx ssh.Context) (int, int, string, string, error) {
 	return eid, pid, ename, pname, nil
 }
 
+// deletedUnmarshal returns true if the connection was marked by the
+// pubKeyHandler as being to a namespace whose Lagoon environment has been
+// deleted. See deletedMarshal.
+func deletedUnmarshal(ctx ssh.Context) bool {
+	return ctx.Permissions().Extensions[deletedKey] == "true"
+}
+
+// capabilityUnmarshal extracts the capability granted to the key in the
+// pubKeyHandler which was stored in the Extensions field of the ssh
+// connection. See permissionsMarshal.
+func capabilityUnmarshal(ctx ssh.Context) (rbac.Capability, error) {
+	capabilityString, ok := ctx.Permissions().Extensions[capabilityKey]
+	if !ok {
+		return rbac.FullAccess, fmt.Errorf("missing capability in permissions")
+	}
+	capability, err := rbac.ParseCapability(capabilityString)
+	if err != nil {
+		return rbac.FullAccess,
+			fmt.Errorf("couldn't parse capability in permissions")
+	}
+	return capability, nil
+}
+
+// shellUnmarshal extracts the shell configured for the namespace in the
+// pubKeyHandler which was stored in the Extensions field of the ssh
+// connection. It returns an empty string if no shell was configured. See
+// permissionsMarshal.
+func shellUnmarshal(ctx ssh.Context) string {
+	return ctx.Permissions().Extensions[shellKey]
+}
+
+// environmentTypeUnmarshal extracts the type of the Lagoon environment
+// identified in the pubKeyHandler which was stored in the Extensions field of
+// the ssh connection. It returns an empty string if the type is unknown. See
+// permissionsMarshal.
+func environmentTypeUnmarshal(ctx ssh.Context) string {
+	return ctx.Permissions().Extensions[environmentTypeKey]
+}
+
+// environmentTypeLabel returns the environment_type label value of the
+// session metrics for the given context. Sessions to environments of unknown
+// type, such as those authenticated before the type was stored in the
+// permissions, are labelled unknown.
+func environmentTypeLabel(ctx ssh.Context) string {
+	if etype := environmentTypeUnmarshal(ctx); etype != "" {
+		return etype
+	}
+	return "unknown"
+}
+
+// fingerprintUnmarshal extracts the normalised fingerprint of the key
+// authenticated in the pubKeyHandler which was stored in the Extensions field
+// of the ssh connection. See permissionsMarshal.
+func fingerprintUnmarshal(ctx ssh.Context) (string, error) {
+	fingerprint, ok := ctx.Permissions().Extensions[sshFingerprintKey]
+	if !ok {
+		return "", fmt.Errorf("missing sshFingerprint in permissions")
+	}
+	return fingerprint, nil
+}
+
+// reauthorize repeats the SSH access query made by the pubKeyHandler for the
+// key which authenticated the connection. Multiplexed sessions on a single
+// connection don't authenticate again, so this is the only way to detect that
+// access has been revoked since the connection was established.
+func reauthorize(
+	ctx ssh.Context,
+	nc NATSService,
+	namespace string,
+	pid,
+	eid int,
+) (bus.SSHAccessResponse, error) {
+	fingerprint, err := fingerprintUnmarshal(ctx)
+	if err != nil {
+		return bus.SSHAccessResponse{}, err
+	}
+	response, err := nc.KeyCanAccessEnvironment(
+		ctx.SessionID(), fingerprint, namespace, pid, eid)
+	if err != nil {
+		return bus.SSHAccessResponse{},
+			fmt.Errorf("couldn't query permission via NATS: %w", err)
+	}
+	return response, nil
+}
+
+// emitAudit emits the given audit event to the sink, logging any error.
+func emitAudit(
+	ctx context.Context,
+	log *slog.Logger,
+	sink audit.Sink,
+	e audit.Event,
+) {
+	if err := sink.Emit(ctx, e); err != nil {
+		log.Warn("couldn't emit audit event", slog.Any("error", err))
+	}
+}
+
+// sessionEnv contains the Lagoon context of a session, which is exposed to
+// exec sessions as environment variables. The variables are read-only in
+// commands, but not in interactive shells, because the shell started by exec
+// inherits only the values of exported variables, not their attributes.
+type sessionEnv struct {
+	project     string
+	environment string
+	sessionID   string
+	fingerprint string
+}
+
+// script returns a shell script fragment which exports the session
+// environment as read-only variables. It is intended to be prefixed to the
+// script run by the shell.
+func (e sessionEnv) script() string {
+	vars := []struct{ name, value string }{
+		{"LAGOON_SSH_PROJECT", e.project},
+		{"LAGOON_SSH_ENVIRONMENT", e.environment},
+		{"LAGOON_SSH_SESSION_ID", e.sessionID},
+		{"LAGOON_SSH_USER_FINGERPRINT", e.fingerprint},
+	}
+	names := make([]string, len(vars))
+	assignments := make([]string, len(vars))
+	for i, v := range vars {
+		names[i] = v.name
+		assignments[i] = v.name + "=" + shellQuote(v.value)
+	}
+	return fmt.Sprintf("export %s; readonly %s; ",
+		strings.Join(assignments, " "), strings.Join(names, " "))
+}
+
 // getSSHIntent analyses the SFTP flag and the raw command strings to determine
 // if the command should be wrapped, and returns the given cmd wrapped
-// appropriately.
-func getSSHIntent(sftp bool, rawCmd string) []string {
+// appropriately in the given shell. If shell is empty, sh is used. The
+// session environment is exported to the shell before the command is run.
+func getSSHIntent(sftp bool, rawCmd, shell string, env sessionEnv) []string {
 	// if this is an sftp session we ignore any commands
 	if sftp {
 		return []string{"sftp-server", "-u", "0002"}
 	}
-	// if there is no command, assume the user wants a shell
+	if shell == "" {
+		shell = fallbackShell
+	}
+	// if there is no command, assume the user wants a shell. The shell
+	// replaces itself with an interactive shell after exporting the
+	// environment, which is then no longer read-only.
 	if len(rawCmd) == 0 {
-		return []string{"sh"}
+		return []string{shell, "-c", env.script() + "exec " + shellQuote(shell)}
 	}
 	// if there is a command, wrap it in a shell the way openssh does
 	// https://github.com/openssh/openssh-portable/blob/
 	// 	73dcca12115aa12ed0d123b914d473c384e52651/session.c#L1705-L1713
-	return []string{"sh", "-c", rawCmd}
+	return []string{shell, "-c", env.script() + rawCmd}
+}
+
+// shellStartFailed returns true if err indicates that the shell executable
+// couldn't be started in the container, as opposed to the shell exiting
+// with an error or the exec failing for some other reason.
+func shellStartFailed(err error) bool {
+	if _, ok := err.(exec.ExitError); ok {
+		return false
+	}
+	msg := err.Error()
+	return strings.Contains(msg, "executable file not found") ||
+		strings.Contains(msg, "no such file or directory")
+}
+
+// contextEnded returns true if err was caused by the cancellation or expiry of
+// a context.
+func contextEnded(err error) bool {
+	return errors.Is(err, context.Canceled) ||
+		errors.Is(err, context.DeadlineExceeded)
+}
+
+// sftpServerMissing returns the exit status to send to the client and true
+// if err indicates that the sftp-server binary couldn't be executed in the
+// container. This is the case if the binary couldn't be started at all, or if
+// the command exited with the status used by POSIX shells for a command which
+// is not found (127) or not executable (126).
+func sftpServerMissing(err error) (int, bool) {
+	if exitErr, ok := err.(exec.ExitError); ok {
+		status := exitErr.ExitStatus()
+		return status, status == 126 || status == 127
+	}
+	return 127, shellStartFailed(err)
+}
+
+// disabledSessionKind returns the kind of the session, either sftp or exec, if
+// that kind of session is disabled. Otherwise it returns an empty string.
+// Logs sessions are never disabled by this check.
+func disabledSessionKind(execDisabled, sftpDisabled, sftp bool,
+	logs string) string {
+	switch {
+	case sftp && sftpDisabled:
+		return sessionKindSFTP
+	case !sftp && len(logs) == 0 && execDisabled:
+		return sessionKindExec
+	default:
+		return ""
+	}
+}
+
+// requestedSessionKind returns the kind of session requested: sftp, logs, or
+// exec.
+func requestedSessionKind(sftp bool, logs string) rbac.SessionKind {
+	switch {
+	case sftp:
+		return rbac.SessionSFTP
+	case len(logs) != 0:
+		return rbac.SessionLogs
+	default:
+		return rbac.SessionExec
+	}
+}
+
+// sessionConfig configures the ssh.Handler returned by sessionHandler.
+type sessionConfig struct {
+	// K8S is used to connect sessions to the cluster.
+	K8S K8SAPIService
+	// LogAccessEnabled allows logs sessions.
+	LogAccessEnabled bool
+	// DebugEnabled allows the debug connection parameter to start an
+	// interactive shell in an ephemeral debug container instead of in the
+	// target container.
+	DebugEnabled bool
+	// DefaultShell is the shell used in exec sessions if the namespace does
+	// not specify one.
+	DefaultShell string
+	// ExecTimeLimit, if greater than zero, ends shell, command, and sftp
+	// sessions once they have run for that long.
+	ExecTimeLimit time.Duration
+	// AuditSink receives audit events.
+	AuditSink audit.Sink
+	// Reauth, if not nil, is used to check SSH access again at the start of
+	// every session. The session is ended if access has been revoked since
+	// the connection was established.
+	Reauth NATSService
+	// ConfirmTimeout, if greater than zero, is how long users of interactive
+	// sessions to production environments have to confirm the session by
+	// typing yes before the shell is started.
+	ConfirmTimeout time.Duration
+	// DisableExec and DisableSFTP reject exec or sftp sessions respectively
+	// regardless of the capability of the key. Sessions of a kind which is
+	// enabled are also rejected unless the capability of the key permits
+	// them.
+	DisableExec bool
+	DisableSFTP bool
+	// Messages formats user-facing messages. If nil, the default messages are
+	// used.
+	Messages *messages.Catalog
+	// Capabilities is written to the session as JSON in response to the
+	// reserved command "capabilities", instead of running a command in the
+	// environment.
+	Capabilities Capabilities
+	// MaxCommandLength, if greater than zero, rejects sessions requesting a
+	// raw command longer than that many bytes. Commands included in log lines
+	// are truncated regardless.
+	MaxCommandLength int
+	// AuthTarpit, if not nil, has the failures of the source of each
+	// connection cleared once a session is started on it.
+	AuthTarpit *AuthTarpit
+	// Shutdown, if not nil, is done once the server starts shutting down.
+	// Exec sessions which are still running are then ended.
+	Shutdown context.Context
 }
 
 // sessionHandler returns a ssh.Handler which connects the ssh session to the
-// requested container.
+// requested container, as configured by cfg.
 //
 // If sftp is true, the returned ssh.Handler can be type converted to a sftp
 // ssh.SubsystemHandler. The only practical difference in the returned session
@@ -108,17 +368,175 @@ func getSSHIntent(sftp bool, rawCmd string) []string {
 // There is no support for a built-in sftp server.
 func sessionHandler(
 	log *slog.Logger,
-	c K8SAPIService,
-	sftp,
-	logAccessEnabled bool,
+	m *Metrics,
+	cfg sessionConfig,
+	sftp bool,
 ) ssh.Handler {
 	return func(s ssh.Session) {
-		sessionTotal.Inc()
 		ctx := s.Context()
-		log := log.With(slog.String("sessionID", ctx.SessionID()))
+		m.sessionTotal.WithLabelValues(environmentTypeLabel(ctx)).Inc()
+		// reject sessions to deleted environments with a specific message
+		if deletedUnmarshal(ctx) {
+			_, err := cfg.Messages.Fprint(ctx, s.Stderr(),
+				messages.EnvironmentDeleted,
+				messages.Vars{SessionID: ctx.SessionID()})
+			if err != nil {
+				log.Debug("couldn't write to session stream", slog.Any("error", err))
+			}
+			// Send a non-zero exit code to the client on rejecting the session.
+			// Use 252 as for other sessions rejected by policy.
+			if err = s.Exit(252); err != nil {
+				log.Warn("couldn't send exit code to client", slog.Any("error", err))
+			}
+			return
+		}
+		// extract info passed through the context by the authhandler
+		eid, pid, ename, pname, err := permissionsUnmarshal(ctx)
+		etype := environmentTypeUnmarshal(ctx)
+		var capability rbac.Capability
+		if err == nil {
+			capability, err = capabilityUnmarshal(ctx)
+		}
+		// use the fingerprint normalised by the authhandler so that logs and
+		// audit events from both handlers agree
+		var fingerprint string
+		if err == nil {
+			fingerprint, err = fingerprintUnmarshal(ctx)
+		}
+		if err != nil {
+			log.Error("couldn't unmarshal values from permissions",
+				slog.String(sessionlog.SessionIDKey, ctx.SessionID()),
+				slog.Any("error", err))
+			_, err = cfg.Messages.Fprint(ctx, s.Stderr(), messages.ExecError,
+				messages.Vars{SessionID: ctx.SessionID()})
+			if err != nil {
+				log.Debug("couldn't write to session stream", slog.Any("error", err))
+			}
+			return
+		}
+		// the base audit event for this session
+		base := audit.Event{
+			SessionID:       ctx.SessionID(),
+			Namespace:       s.User(),
+			SSHFingerprint:  fingerprint,
+			EnvironmentID:   eid,
+			EnvironmentName: ename,
+			ProjectID:       pid,
+			ProjectName:     pname,
+		}
+		log := sessionlog.New(ctx, log, sessionlog.Fields{
+			SessionID:       base.SessionID,
+			Namespace:       base.Namespace,
+			SSHFingerprint:  base.SSHFingerprint,
+			EnvironmentID:   eid,
+			EnvironmentName: ename,
+			ProjectID:       pid,
+			ProjectName:     pname,
+		})
+		// tag the session with the correlation ID sent by the client, if any.
+		// The tag is included in messages, logs, and audit events, but is
+		// never passed to the command.
+		tag, err := sessionTag(s.Environ())
+		if err != nil {
+			log.Warn("ignoring invalid session tag", slog.Any("error", err))
+		}
+		if tag != "" {
+			ctx = sessionlog.WithSessionTag(ctx, tag)
+			log = sessionlog.FromContext(ctx)
+			base.SessionTag = tag
+		}
+		// auditEvent returns a copy of the base audit event with the given type
+		auditEvent := func(t audit.EventType) audit.Event {
+			e := base
+			e.Type, e.Time = t, time.Now()
+			return e
+		}
+		// log the handshake timing and client version once per connection
+		if attrs := handshakeFromContext(ctx).sessionStart(m); attrs != nil {
+			clientVersion := ctx.ClientVersion()
+			family := clientFamily(clientVersion)
+			m.clientConnectionsTotal.WithLabelValues(family).Inc()
+			log.Info("SSH handshake complete", append(attrs,
+				slog.String("clientVersion", clientVersion),
+				slog.String("clientFamily", family))...)
+			if cfg.AuthTarpit.enabled() {
+				cfg.AuthTarpit.succeeded(sourceIP(ctx.RemoteAddr()))
+			}
+		}
+		// reject overlong commands before doing anything else with them
+		if cfg.MaxCommandLength > 0 &&
+			len(s.RawCommand()) > cfg.MaxCommandLength {
+			rawCmd := s.RawCommand()
+			log.Info("rejecting command longer than maximum length",
+				slog.Int("length", len(rawCmd)),
+				slog.Int("maxCommandLength", cfg.MaxCommandLength),
+				slog.String("rawCommand", truncateCommand(rawCmd)))
+			denied := auditEvent(audit.AuthDenied)
+			denied.Reason = "command too long"
+			emitAudit(ctx, log, cfg.AuditSink, denied)
+			_, err = cfg.Messages.Fprint(ctx, s.Stderr(),
+				messages.CommandTooLong,
+				messages.Vars{
+					Detail:    strconv.Itoa(cfg.MaxCommandLength),
+					SessionID: sessionRef(ctx),
+				})
+			if err != nil {
+				log.Warn("couldn't send error to client", slog.Any("error", err))
+			}
+			// Send a non-zero exit code to the client on rejecting the session.
+			// Use 252 as for other sessions rejected by policy.
+			if err = s.Exit(252); err != nil {
+				log.Warn("couldn't send exit code to client", slog.Any("error", err))
+			}
+			return
+		}
+		// check that access hasn't been revoked since the connection was
+		// established
+		if cfg.Reauth != nil {
+			response, err := reauthorize(ctx, cfg.Reauth, s.User(), pid, eid)
+			if err != nil {
+				log.Warn("couldn't re-check SSH access", slog.Any("error", err))
+				denied := auditEvent(audit.AuthDenied)
+				denied.Reason = "permission query failed"
+				emitAudit(ctx, log, cfg.AuditSink, denied)
+				_, err = cfg.Messages.Fprint(ctx, s.Stderr(),
+					messages.ReauthFailed,
+					messages.Vars{SessionID: sessionRef(ctx)})
+				if err != nil {
+					log.Warn("couldn't send error to client", slog.Any("error", err))
+				}
+				// Send a non-zero exit code to the client on internal error.
+				if err = s.Exit(254); err != nil {
+					log.Warn("couldn't send exit code to client", slog.Any("error", err))
+				}
+				return
+			}
+			if !response.Allowed {
+				m.reauthDeniedTotal.Inc()
+				log.Info("SSH access revoked since connection was established",
+					slog.String("reason", response.Reason))
+				denied := auditEvent(audit.AuthDenied)
+				denied.Reason = "access revoked"
+				emitAudit(ctx, log, cfg.AuditSink, denied)
+				_, err = cfg.Messages.Fprint(ctx, s.Stderr(),
+					messages.AccessDenied,
+					messages.Vars{SessionID: sessionRef(ctx)})
+				if err != nil {
+					log.Warn("couldn't send error to client", slog.Any("error", err))
+				}
+				// Send a non-zero exit code to the client on rejecting the session.
+				// Use 252 as for other sessions rejected by policy.
+				if err = s.Exit(252); err != nil {
+					log.Warn("couldn't send exit code to client", slog.Any("error", err))
+				}
+				return
+			}
+			// the capability may also have changed
+			capability = response.Capability
+		}
 		log.Debug("starting session",
-			slog.Any("command", s.Command()),
-			slog.String("rawCommand", s.RawCommand()),
+			slog.Any("command", truncateArgs(s.Command())),
+			slog.String("rawCommand", truncateCommand(s.RawCommand())),
 			slog.String("subsystem", s.Subsystem()),
 		)
 		// parse the command line arguments to extract any service or container args
@@ -133,15 +551,97 @@ func sessionHandler(
 		//   posix shell arguments:
 		// 	 https://github.com/openssh/openssh-portable/blob/
 		// 		fe4305c37ffe53540a67586854e25f05cf615849/ssh.c#L1179-L1184
-		service, container, logs, rawCmd :=
-			parseConnectionParams(s.Command(), s.RawCommand())
+		command := s.Command()
+		// the capabilities command is answered by the portal itself, so it
+		// succeeds before any service lookup
+		if isCapabilitiesCommand(sftp, command) {
+			log.Info("sending capabilities to SSH client")
+			writeCapabilities(log, s, cfg.Capabilities)
+			return
+		}
+		service, container, job, logs, debug, rawCmd :=
+			parseConnectionParams(command, s.RawCommand(), cfg.DebugEnabled)
+		// session kinds disabled on this portal are rejected regardless of
+		// the capability of the key
+		if kind := disabledSessionKind(cfg.DisableExec, cfg.DisableSFTP, sftp,
+			logs); kind != "" {
+			m.sessionsDisabledTotal.WithLabelValues(kind).Inc()
+			log.Info("rejecting session kind disabled on this portal",
+				slog.String("sessionKind", kind))
+			denied := auditEvent(audit.AuthDenied)
+			denied.Reason = kind + " disabled"
+			emitAudit(ctx, log, cfg.AuditSink, denied)
+			_, err = cfg.Messages.Fprint(ctx, s.Stderr(),
+				messages.SessionKindDisabled,
+				messages.Vars{Kind: kind, SessionID: sessionRef(ctx)})
+			if err != nil {
+				log.Warn("couldn't send error to client", slog.Any("error", err))
+			}
+			// Send a non-zero exit code to the client on rejecting the session.
+			// Use 251 to differentiate this from sessions rejected by policy.
+			if err = s.Exit(251); err != nil {
+				log.Warn("couldn't send exit code to client", slog.Any("error", err))
+			}
+			return
+		}
+		// the capability of the key must permit the kind of session
+		if kind := requestedSessionKind(sftp, logs); !capability.Permits(kind) {
+			log.Info("rejecting session kind not permitted by key capability",
+				slog.String("sessionKind", string(kind)),
+				slog.String("capability", capability.String()))
+			denied := auditEvent(audit.AuthDenied)
+			denied.Reason = capability.String() + " capability"
+			emitAudit(ctx, log, cfg.AuditSink, denied)
+			key := messages.CapabilityMissing
+			if capability == rbac.LogsOnly {
+				key = messages.LogsOnly
+			}
+			_, err = cfg.Messages.Fprint(ctx, s.Stderr(), key,
+				messages.Vars{Kind: string(kind), SessionID: sessionRef(ctx)})
+			if err != nil {
+				log.Warn("couldn't send error to client", slog.Any("error", err))
+			}
+			// Send a non-zero exit code to the client on rejecting the session.
+			// Use 252 to differentiate this from exec and logs errors.
+			if err = s.Exit(252); err != nil {
+				log.Warn("couldn't send exit code to client", slog.Any("error", err))
+			}
+			return
+		}
+		if debug {
+			if msg := debugSessionError(cfg.DebugEnabled, sftp, job, logs,
+				rawCmd); msg != "" {
+				log.Info("rejecting debug session", slog.String("reason", msg))
+				denied := auditEvent(audit.AuthDenied)
+				denied.Debug, denied.Reason = true, msg
+				emitAudit(ctx, log, cfg.AuditSink, denied)
+				_, err = cfg.Messages.Fprint(ctx, s.Stderr(), messages.Rejected,
+					messages.Vars{Detail: msg, SessionID: sessionRef(ctx)})
+				if err != nil {
+					log.Warn("couldn't send error to client", slog.Any("error", err))
+				}
+				// Send a non-zero exit code to the client on rejecting the session.
+				// Use 252 as for other sessions rejected by policy.
+				if err = s.Exit(252); err != nil {
+					log.Warn("couldn't send exit code to client", slog.Any("error", err))
+				}
+				return
+			}
+		}
+		if job != "" {
+			doJobLogsSession(ctx, s, log, m, cfg.K8S, sftp,
+				cfg.LogAccessEnabled, service, job, container, logs, rawCmd,
+				auditEvent(audit.SessionStart), cfg.AuditSink, cfg.Messages)
+			return
+		}
 		// validate the service and container
 		if err := k8s.ValidateLabelValue(service); err != nil {
 			log.Debug("invalid service name",
 				slog.String("service", service),
 				slog.Any("error", err))
-			_, err = fmt.Fprintf(s.Stderr(), "invalid service name %s. SID: %s\r\n",
-				service, ctx.SessionID())
+			_, err = cfg.Messages.Fprint(ctx, s.Stderr(),
+				messages.InvalidService,
+				messages.Vars{Service: service, SessionID: sessionRef(ctx)})
 			if err != nil {
 				log.Debug("couldn't write to session stream", slog.Any("error", err))
 			}
@@ -151,44 +651,95 @@ func sessionHandler(
 			log.Debug("invalid container name",
 				slog.String("container", container),
 				slog.Any("error", err))
-			_, err = fmt.Fprintf(s.Stderr(), "invalid container name %s. SID: %s\r\n",
-				container, ctx.SessionID())
+			_, err = cfg.Messages.Fprint(ctx, s.Stderr(),
+				messages.InvalidContainer,
+				messages.Vars{Container: container, SessionID: sessionRef(ctx)})
 			if err != nil {
 				log.Debug("couldn't write to session stream", slog.Any("error", err))
 			}
 			return
 		}
 		// find the deployment name based on the given service name
-		deployment, err := c.FindDeployment(ctx, s.User(), service)
+		deployment, access, err :=
+			cfg.K8S.FindDeployment(ctx, s.User(), service)
 		if err != nil {
-			log.Debug("couldn't find deployment for service",
+			if errors.Is(err, k8s.ErrDeploymentNotFound) {
+				log.Debug("couldn't find deployment for service",
+					slog.String("service", service),
+					slog.Any("error", err))
+				// suggest a similarly named service, but don't let a failure to
+				// list services change the error
+				var suggestion string
+				services, err := cfg.K8S.ListServices(ctx, s.User())
+				if err != nil {
+					log.Debug("couldn't list services",
+						slog.Any("error", err))
+				} else {
+					suggestion = suggestService(service, services)
+				}
+				_, err = cfg.Messages.Fprint(ctx, s.Stderr(),
+					messages.UnknownService,
+					messages.Vars{
+						Service:    service,
+						Suggestion: suggestion,
+						SessionID:  sessionRef(ctx),
+					})
+				if err != nil {
+					log.Debug("couldn't write to session stream", slog.Any("error", err))
+				}
+				return
+			}
+			log.Warn("couldn't query deployment for service",
 				slog.String("service", service),
 				slog.Any("error", err))
-			_, err = fmt.Fprintf(s.Stderr(), "unknown service %s. SID: %s\r\n",
-				service, ctx.SessionID())
+			_, err = cfg.Messages.Fprint(ctx, s.Stderr(), messages.ClusterError,
+				messages.Vars{SessionID: sessionRef(ctx)})
 			if err != nil {
-				log.Debug("couldn't write to session stream", slog.Any("error", err))
+				log.Warn("couldn't send error to client", slog.Any("error", err))
+			}
+			// Send a non-zero exit code to the client on a Kubernetes API error.
+			// Use 254 as for other exec failures.
+			if err = s.Exit(254); err != nil {
+				log.Warn("couldn't send exit code to client", slog.Any("error", err))
 			}
 			return
 		}
-		// extract info passed through the context by the authhandler
-		eid, pid, ename, pname, err := permissionsUnmarshal(ctx)
-		if err != nil {
-			log.Error("couldn't unmarshal values from permissions",
-				slog.Any("error", err))
-			_, err = fmt.Fprintf(s.Stderr(), "error executing command. SID: %s\r\n",
-				ctx.SessionID())
+		// honour deployment annotations which disable exec or logs sessions
+		if (len(logs) != 0 && !access.Logs) || (len(logs) == 0 && !access.Exec) {
+			sessionType := "shell"
+			if len(logs) != 0 {
+				sessionType = "logs"
+			}
+			log.Info("rejecting session disabled by deployment annotation",
+				slog.String("deployment", deployment),
+				slog.String("sessionType", sessionType))
+			denied := auditEvent(audit.AuthDenied)
+			denied.Deployment = deployment
+			denied.Reason = sessionType + " access disabled for deployment"
+			emitAudit(ctx, log, cfg.AuditSink, denied)
+			_, err = cfg.Messages.Fprint(ctx, s.Stderr(),
+				messages.ServiceAccessDisabled, messages.Vars{
+					Kind:      sessionType,
+					Service:   service,
+					SessionID: sessionRef(ctx),
+				})
 			if err != nil {
-				log.Debug("couldn't write to session stream", slog.Any("error", err))
+				log.Warn("couldn't send error to client", slog.Any("error", err))
+			}
+			// Send a non-zero exit code to the client on rejecting the session.
+			// Use 252 as for other sessions rejected by policy.
+			if err = s.Exit(252); err != nil {
+				log.Warn("couldn't send exit code to client", slog.Any("error", err))
 			}
 			return
 		}
 		if len(logs) != 0 {
-			if !logAccessEnabled {
+			if !cfg.LogAccessEnabled {
 				log.Debug("logs access is not enabled",
 					slog.String("logsArgument", logs))
-				_, err = fmt.Fprintf(s.Stderr(), "error executing command. SID: %s\r\n",
-					ctx.SessionID())
+				_, err = cfg.Messages.Fprint(ctx, s.Stderr(),
+					messages.ExecError,
+					messages.Vars{SessionID: sessionRef(ctx)})
 				if err != nil {
 					log.Warn("couldn't send error to client", slog.Any("error", err))
 				}
@@ -200,13 +751,23 @@ func sessionHandler(
 				}
 				return
 			}
-			follow, tailLines, err := parseLogsArg(service, logs, rawCmd)
+			follow, tailLines, format, filter, markers, initContainers, err :=
+				parseLogsArg(service, logs, rawCmd)
 			if err != nil {
 				log.Debug("couldn't parse logs argument",
 					slog.String("logsArgument", logs),
 					slog.Any("error", err))
-				_, err = fmt.Fprintf(s.Stderr(), "error executing command. SID: %s\r\n",
-					ctx.SessionID())
+				if detail := logsFilterError(err); detail != "" {
+					_, err = cfg.Messages.Fprint(ctx, s.Stderr(),
+						messages.InvalidCommand, messages.Vars{
+							Detail:    detail,
+							SessionID: sessionRef(ctx),
+						})
+				} else {
+					_, err = cfg.Messages.Fprint(ctx, s.Stderr(),
+						messages.ExecError,
+						messages.Vars{SessionID: sessionRef(ctx)})
+				}
 				if err != nil {
 					log.Warn("couldn't send error to client", slog.Any("error", err))
 				}
@@ -219,37 +780,114 @@ func sessionHandler(
 				return
 			}
 			log.Info("sending logs to SSH client",
-				slog.Int("environmentID", eid),
-				slog.Int("projectID", pid),
-				slog.String("SSHFingerprint", gossh.FingerprintSHA256(s.PublicKey())),
 				slog.String("container", container),
 				slog.String("deployment", deployment),
-				slog.String("environmentName", ename),
-				slog.String("namespace", s.User()),
-				slog.String("projectName", pname),
+				slog.String("environmentType", etype),
 				slog.Bool("follow", follow),
 				slog.Int64("tailLines", tailLines),
+				slog.Bool("filter", filter != nil),
+				slog.Bool("initContainers", initContainers),
 			)
-			doLogs(ctx, log, s, deployment, container, follow, tailLines, c)
+			start := auditEvent(audit.SessionStart)
+			start.Deployment, start.Container, start.Logs =
+				deployment, container, true
+			emitAudit(ctx, log, cfg.AuditSink, start)
+			doLogs(ctx, s, m, deployment, "", container, follow, tailLines, format,
+				filter, markers, initContainers, cfg.K8S, cfg.Messages)
+			end := start
+			end.Type, end.Time = audit.SessionEnd, time.Now()
+			emitAudit(ctx, log, cfg.AuditSink, end)
 			return
 		}
-		// handle sftp and sh fallback
-		cmd := getSSHIntent(sftp, rawCmd)
+		// warn about commonly misquoted shell commands, without changing what
+		// is executed
+		if warning := misquotedShellWarning(command, rawCmd); warning != "" {
+			log.Debug("misquoted shell command",
+				slog.String("rawCommand", truncateCommand(rawCmd)))
+			_, err = cfg.Messages.Fprint(ctx, s.Stderr(),
+				messages.MisquotedShell, messages.Vars{Detail: warning})
+			if err != nil {
+				log.Debug("couldn't write to session stream", slog.Any("error", err))
+			}
+		}
+		// handle sftp and shell fallback. The namespace shell takes precedence
+		// over the default shell.
+		shell := shellUnmarshal(ctx)
+		if shell == "" {
+			shell = cfg.DefaultShell
+		}
+		env := sessionEnv{
+			project:     pname,
+			environment: ename,
+			sessionID:   base.SessionID,
+			fingerprint: base.SSHFingerprint,
+		}
+		// debug images are not Lagoon images, so always use sh in debug sessions
+		if debug {
+			shell = fallbackShell
+		}
+		cmd := getSSHIntent(sftp, rawCmd, shell, env)
+		// if a shell other than sh is used, fall back to sh if it fails to start
+		var fallbackCmd []string
+		if !sftp && cmd[0] != fallbackShell {
+			fallbackCmd = getSSHIntent(sftp, rawCmd, fallbackShell, env)
+		}
 		// check if a pty was requested, and get the window size channel
 		_, winch, pty := s.Pty()
+		// require confirmation of interactive sessions to production
+		// environments
+		if pty && !sftp && cfg.ConfirmTimeout > 0 &&
+			environmentTypeUnmarshal(ctx) == lagoon.Production.String() {
+			ok, err := confirmProduction(ctx, s, pname, ename,
+				cfg.ConfirmTimeout, cfg.Messages)
+			if !ok {
+				reason := "production confirmation declined"
+				if err != nil {
+					reason = "production confirmation failed"
+					log.Debug("couldn't confirm production session",
+						slog.Any("error", err))
+				}
+				log.Info("rejecting unconfirmed production session")
+				denied := auditEvent(audit.AuthDenied)
+				denied.Deployment, denied.Container, denied.Debug =
+					deployment, container, debug
+				denied.Reason = reason
+				emitAudit(ctx, log, cfg.AuditSink, denied)
+				msg := "session cancelled"
+				if errors.Is(err, errConfirmTimeout) {
+					msg = "\r\n" + err.Error()
+				}
+				_, err = cfg.Messages.Fprint(ctx, s.Stderr(), messages.Rejected,
+					messages.Vars{Detail: msg, SessionID: sessionRef(ctx)})
+				if err != nil {
+					log.Warn("couldn't send error to client", slog.Any("error", err))
+				}
+				// Send a non-zero exit code to the client on rejecting the
+				// session. Use 252 as for other sessions rejected before exec.
+				if err = s.Exit(252); err != nil {
+					log.Warn("couldn't send exit code to client", slog.Any("error", err))
+				}
+				return
+			}
+		}
 		log.Info("executing SSH command",
 			slog.Bool("pty", pty),
-			slog.Int("environmentID", eid),
-			slog.Int("projectID", pid),
-			slog.String("SSHFingerprint", gossh.FingerprintSHA256(s.PublicKey())),
 			slog.String("container", container),
 			slog.String("deployment", deployment),
-			slog.String("environmentName", ename),
-			slog.String("namespace", s.User()),
-			slog.String("projectName", pname),
-			slog.Any("command", cmd),
+			slog.String("environmentType", etype),
+			slog.Any("command", truncateArgs(cmd)),
+			slog.Bool("debug", debug),
 		)
-		doExec(ctx, log, s, deployment, container, cmd, c, pty, winch)
+		start := auditEvent(audit.SessionStart)
+		start.Deployment, start.Container, start.Command, start.Debug =
+			deployment, container, cmd, debug
+		emitAudit(ctx, log, cfg.AuditSink, start)
+		doExec(ctx, cfg.Shutdown, s, m, service, deployment, container, cmd,
+			fallbackCmd, cfg.K8S, sftp, debug, cfg.ExecTimeLimit, pty, winch,
+			cfg.Messages)
+		end := start
+		end.Type, end.Time = audit.SessionEnd, time.Now()
+		emitAudit(ctx, log, cfg.AuditSink, end)
 	}
 }
 
@@ -278,9 +916,24 @@ func startClientKeepalive(ctx context.Context, cancel context.CancelFunc,
 	}
 }
 
-func doLogs(ctx ssh.Context, log *slog.Logger, s ssh.Session, deployment,
-	container string, follow bool, tailLines int64, c K8SAPIService) {
+// logsFilterError returns a message for the client explaining the given
+// error returned by parseLogsArg, if it is caused by the filter expression.
+// Otherwise it returns an empty string.
+func logsFilterError(err error) string {
+	if errors.Is(err, ErrCmdArgsAfterLogs) ||
+		errors.Is(err, ErrInvalidLogsFilter) {
+		return err.Error()
+	}
+	return ""
+}
+
+func doLogs(ctx ssh.Context, s ssh.Session, m *Metrics,
+	deployment, job, container string,
+	follow bool, tailLines int64, format k8s.LogFormat, filter *regexp.Regexp,
+	markers, initContainers bool, c K8SAPIService, msgs *messages.Catalog) {
+	log := sessionlog.FromContext(ctx)
 	// update metrics
+	logsSessions := m.logsSessions.WithLabelValues(environmentTypeLabel(ctx))
 	logsSessions.Inc()
 	defer logsSessions.Dec()
 	// Wrap the ssh.Context so we can cancel goroutines started from this
@@ -296,11 +949,18 @@ func doLogs(ctx ssh.Context, log *slog.Logger, s ssh.Session, deployment,
 	// ping to the client. If the keepalive fails, close the channel and cancel
 	// the childCtx.
 	go startClientKeepalive(childCtx, cancel, log, s)
-	err := c.Logs(childCtx, s.User(), deployment, container, follow, tailLines, s)
+	var err error
+	if job != "" {
+		err = c.JobLogs(childCtx, s.User(), job, container, follow, tailLines,
+			format, filter, markers, initContainers, s)
+	} else {
+		err = c.Logs(childCtx, s.User(), deployment, container, follow, tailLines,
+			format, filter, markers, initContainers, s)
+	}
 	if err != nil {
 		log.Warn("couldn't send logs", slog.Any("error", err))
-		_, err = fmt.Fprintf(s.Stderr(), "error executing command. SID: %s\r\n",
-			ctx.SessionID())
+		_, err = msgs.Fprint(ctx, s.Stderr(), messages.ExecError,
+			messages.Vars{SessionID: sessionRef(ctx)})
 		if err != nil {
 			log.Warn("couldn't send error to client", slog.Any("error", err))
 		}
@@ -314,24 +974,353 @@ func doLogs(ctx ssh.Context, log *slog.Logger, s ssh.Session, deployment,
 	log.Debug("finished command logs")
 }
 
-func doExec(ctx ssh.Context, log *slog.Logger, s ssh.Session, deployment,
-	container string, cmd []string, c K8SAPIService, pty bool,
-	winch <-chan ssh.Window) {
+// doJobLogsSession handles a session with a job=... argument, which requests
+// the logs of the pods of a Job or of the most recent Job created by a
+// CronJob. start is the audit event emitted when the logs session starts.
+//
+// Jobs aren't Lagoon services, so there are no deployment annotations to
+// honour and access is granted to any key with logs access to the namespace.
+func doJobLogsSession(ctx ssh.Context, s ssh.Session, log *slog.Logger,
+	m *Metrics, c K8SAPIService, sftp, logAccessEnabled bool,
+	service, job, container, logs, rawCmd string, start audit.Event,
+	auditSink audit.Sink, msgs *messages.Catalog) {
+	// reject logs to the client. Use exit code 253, as for other logs errors.
+	reject := func(msg string) {
+		_, err := msgs.Fprint(ctx, s.Stderr(), messages.Rejected,
+			messages.Vars{Detail: msg, SessionID: sessionRef(ctx)})
+		if err != nil {
+			log.Warn("couldn't send error to client", slog.Any("error", err))
+		}
+		if err = s.Exit(253); err != nil {
+			log.Warn("couldn't send exit code to client", slog.Any("error", err))
+		}
+	}
+	if err := k8s.ValidateLabelValue(job); err != nil {
+		log.Debug("invalid job name",
+			slog.String("job", job),
+			slog.Any("error", err))
+		reject("invalid job name " + job)
+		return
+	}
+	if err := k8s.ValidateLabelValue(container); err != nil {
+		log.Debug("invalid container name",
+			slog.String("container", container),
+			slog.Any("error", err))
+		reject("invalid container name " + container)
+		return
+	}
+	switch {
+	case service != "":
+		log.Debug("rejecting job session with service argument",
+			slog.String("service", service),
+			slog.String("job", job))
+		reject("job and service arguments can't be combined")
+		return
+	case sftp || len(logs) == 0:
+		log.Debug("rejecting job session without logs argument",
+			slog.String("job", job),
+			slog.Bool("sftp", sftp))
+		reject("job argument requires a logs argument " +
+			"(e.g. job=cron logs=tailLines=100)")
+		return
+	case !logAccessEnabled:
+		log.Debug("logs access is not enabled",
+			slog.String("logsArgument", logs))
+		reject("error executing command")
+		return
+	}
+	follow, tailLines, format, filter, markers, initContainers, err :=
+		parseLogsArg(job, logs, rawCmd)
+	if err != nil {
+		log.Debug("couldn't parse logs argument",
+			slog.String("logsArgument", logs),
+			slog.Any("error", err))
+		if detail := logsFilterError(err); detail != "" {
+			reject(detail)
+		} else {
+			reject("error executing command")
+		}
+		return
+	}
+	log.Info("sending job logs to SSH client",
+		slog.String("container", container),
+		slog.String("environmentType", environmentTypeUnmarshal(ctx)),
+		slog.String("job", job),
+		slog.Bool("follow", follow),
+		slog.Int64("tailLines", tailLines),
+		slog.Bool("filter", filter != nil),
+		slog.Bool("initContainers", initContainers),
+	)
+	start.Job, start.Container, start.Logs = job, container, true
+	emitAudit(ctx, log, auditSink, start)
+	doLogs(ctx, s, m, "", job, container, follow, tailLines, format, filter,
+		markers, initContainers, c, msgs)
+	end := start
+	end.Type, end.Time = audit.SessionEnd, time.Now()
+	emitAudit(ctx, log, auditSink, end)
+}
+
+// warnSessionEnd writes a warning to w shortly before the exec time limit is
+// reached, unless ctx is cancelled first. See execTimeWarningLead.
+func warnSessionEnd(ctx context.Context, log *slog.Logger, w io.Writer,
+	timeLimit time.Duration, msgs *messages.Catalog) {
+	lead := min(execTimeWarningLead, timeLimit/2)
+	timer := time.NewTimer(timeLimit - lead)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		_, err := msgs.Fprint(ctx, w, messages.TimeLimitWarning,
+			messages.Vars{Lead: lead})
+		if err != nil {
+			log.Debug("couldn't write to session stream", slog.Any("error", err))
+		}
+	case <-ctx.Done():
+	}
+}
+
+// signalExitCode returns the exit code a shell reports for a command killed
+// by the given signal.
+func signalExitCode(sig ssh.Signal) int {
+	if sig == ssh.SIGTERM {
+		return 128 + 15
+	}
+	return 128 + 2
+}
+
+// watchSignals registers a signal channel on the session, and calls cancel
+// when the client sends SIGINT or SIGTERM. The Kubernetes exec protocol can't
+// deliver signals to the remote process, so the exec is cancelled instead,
+// which closes its streams. The signal which caused cancellation is sent on
+// the returned channel. The returned function must be called to stop
+// watching for signals.
+func watchSignals(
+	s ssh.Session,
+	cancel context.CancelFunc,
+) (<-chan ssh.Signal, func()) {
+	signals := make(chan ssh.Signal)
+	interrupted := make(chan ssh.Signal, 1)
+	done := make(chan struct{})
+	s.Signals(signals)
+	go func() {
+		for {
+			select {
+			case sig := <-signals:
+				if sig != ssh.SIGINT && sig != ssh.SIGTERM {
+					continue
+				}
+				select {
+				case interrupted <- sig:
+					cancel()
+				default:
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return interrupted, func() {
+		// The session holds its lock while sending a signal, so signals are
+		// drained until the channel is unregistered.
+		s.Signals(nil)
+		close(done)
+	}
+}
+
+// doExec executes cmd in the given deployment and container. If fallbackCmd
+// is not nil, and the shell in cmd fails to start, fallbackCmd is executed
+// instead. If debug is true, cmd is executed in an ephemeral debug container
+// targeting the given container. If timeLimit is greater than zero, the
+// session is ended after that long. If shutdown is not nil, the session is
+// ended once it is done. Sessions without a pty are ended if the client sends
+// SIGINT or SIGTERM.
+func doExec(ctx ssh.Context, shutdown context.Context, s ssh.Session,
+	m *Metrics, service, deployment, container string, cmd,
+	fallbackCmd []string, c K8SAPIService, sftp, debug bool,
+	timeLimit time.Duration, pty bool, winch <-chan ssh.Window,
+	msgs *messages.Catalog) {
+	log := sessionlog.FromContext(ctx)
 	// update metrics
+	execSessions := m.execSessions.WithLabelValues(environmentTypeLabel(ctx))
 	execSessions.Inc()
 	defer execSessions.Dec()
-	err := c.Exec(ctx, s.User(), deployment, container, cmd, s,
+	// enforce the time limit, warning interactive users before it is reached
+	var execCtx context.Context = ctx
+	stopWarning := func() {}
+	if timeLimit > 0 {
+		var cancel context.CancelFunc
+		execCtx, cancel = context.WithTimeout(ctx, timeLimit)
+		defer cancel()
+		if pty {
+			warnCtx, cancelWarning := context.WithCancel(execCtx)
+			var wg sync.WaitGroup
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				warnSessionEnd(warnCtx, log, s.Stderr(), timeLimit, msgs)
+			}()
+			stopWarning = func() {
+				cancelWarning()
+				wg.Wait()
+			}
+		}
+	}
+	// end the session if the server shuts down
+	if shutdown != nil {
+		var cancel context.CancelFunc
+		execCtx, cancel = context.WithCancel(execCtx)
+		defer cancel()
+		stopShutdown := context.AfterFunc(shutdown, cancel)
+		defer stopShutdown()
+	}
+	// In pty sessions the terminal delivers interrupts in-band, but in other
+	// sessions the client sends signals as SSH requests.
+	var interrupted <-chan ssh.Signal
+	if !pty {
+		var cancel context.CancelFunc
+		execCtx, cancel = context.WithCancel(execCtx)
+		defer cancel()
+		var stopSignals func()
+		interrupted, stopSignals = watchSignals(s, cancel)
+		defer stopSignals()
+	}
+	execFunc := c.Exec
+	if debug {
+		execFunc = c.Debug
+	}
+	err := execFunc(execCtx, s.User(), deployment, container, cmd, s,
 		s.Stderr(), pty, winch)
+	if err != nil && fallbackCmd != nil && shellStartFailed(err) {
+		log.Warn("couldn't start shell, retrying with fallback shell",
+			slog.String("shell", cmd[0]),
+			slog.Any("error", err))
+		err = execFunc(execCtx, s.User(), deployment, container, fallbackCmd, s,
+			s.Stderr(), pty, winch)
+	}
+	limited := timeLimit > 0 && errors.Is(execCtx.Err(), context.DeadlineExceeded)
+	// ensure the warning is not written after this point
+	stopWarning()
+	select {
+	case sig := <-interrupted:
+		log.Info("exec session interrupted by client signal",
+			slog.String("signal", string(sig)))
+		// Send the exit code a shell reports for a command killed by the
+		// signal.
+		if err = s.Exit(signalExitCode(sig)); err != nil {
+			log.Warn("couldn't send exit code to client", slog.Any("error", err))
+		}
+		return
+	default:
+	}
+	if limited {
+		m.execTimeLimitTotal.Inc()
+		log.Info("exec session reached time limit",
+			slog.Duration("execTimeLimit", timeLimit))
+		_, err = msgs.Fprint(ctx, s.Stderr(), messages.TimeLimitReached,
+			messages.Vars{SessionID: sessionRef(ctx)})
+		if err != nil {
+			log.Warn("couldn't send error to client", slog.Any("error", err))
+		}
+		// Send a non-zero exit code to the client, as OpenSSH does when a
+		// connection is closed.
+		if err = s.Exit(255); err != nil {
+			log.Warn("couldn't send exit code to client", slog.Any("error", err))
+		}
+		return
+	}
 	if err != nil {
-		if exitErr, ok := err.(exec.ExitError); ok {
+		var containerErr *k8s.ContainerNotFoundError
+		var scaledErr *k8s.ScaledToZeroError
+		if status, ok := sftpServerMissing(err); sftp && ok {
+			m.sftpServerMissingTotal.Inc()
+			log.Info("sftp-server not installed in container",
+				slog.String("container", container),
+				slog.String("deployment", deployment),
+				slog.Any("error", err))
+			if container == "" {
+				container = "(default)"
+			}
+			_, err = msgs.Fprint(ctx, s.Stderr(), messages.SFTPServerMissing,
+				messages.Vars{
+					Service:   service,
+					Container: container,
+					SessionID: sessionRef(ctx),
+				})
+			if err != nil {
+				log.Warn("couldn't send error to client", slog.Any("error", err))
+			}
+			// Send the exit status of the failed command to the client so that
+			// sftp clients see a consistent failure rather than an internal
+			// error, which some clients retry indefinitely.
+			if err = s.Exit(status); err != nil {
+				log.Warn("couldn't send exit code to client", slog.Any("error", err))
+			}
+		} else if exitErr, ok := err.(exec.ExitError); ok {
 			log.Debug("couldn't execute command", slog.Any("error", err))
 			if err = s.Exit(exitErr.ExitStatus()); err != nil {
 				log.Warn("couldn't send exit code to client", slog.Any("error", err))
 			}
+		} else if errors.Is(err, k8s.ErrEphemeralContainersUnsupported) {
+			log.Info("couldn't start debug container", slog.Any("error", err))
+			_, err = msgs.Fprint(ctx, s.Stderr(), messages.DebugUnsupported,
+				messages.Vars{SessionID: sessionRef(ctx)})
+			if err != nil {
+				log.Warn("couldn't send error to client", slog.Any("error", err))
+			}
+			// Send a non-zero exit code to the client on exec error.
+			if err = s.Exit(254); err != nil {
+				log.Warn("couldn't send exit code to client", slog.Any("error", err))
+			}
+		} else if errors.As(err, &containerErr) {
+			log.Debug("couldn't find container", slog.Any("error", err))
+			_, err = msgs.Fprint(ctx, s.Stderr(), messages.Rejected,
+				messages.Vars{
+					Detail:    containerErr.Error(),
+					SessionID: sessionRef(ctx),
+				})
+			if err != nil {
+				log.Warn("couldn't send error to client", slog.Any("error", err))
+			}
+			// Send a non-zero exit code to the client on exec error.
+			if err = s.Exit(254); err != nil {
+				log.Warn("couldn't send exit code to client", slog.Any("error", err))
+			}
+		} else if errors.As(err, &scaledErr) {
+			log.Info("service scaled to zero", slog.Any("error", err))
+			_, err = msgs.Fprint(ctx, s.Stderr(), messages.Rejected,
+				messages.Vars{
+					Detail:    scaledErr.Error(),
+					SessionID: sessionRef(ctx),
+				})
+			if err != nil {
+				log.Warn("couldn't send error to client", slog.Any("error", err))
+			}
+			// Send a non-zero exit code to the client on exec error.
+			if err = s.Exit(254); err != nil {
+				log.Warn("couldn't send exit code to client", slog.Any("error", err))
+			}
+		} else if contextEnded(err) && shutdown != nil &&
+			shutdown.Err() != nil {
+			log.Info("exec session ended by server shutdown",
+				slog.Any("error", err))
+			_, err = msgs.Fprint(ctx, s.Stderr(), messages.ServerShutdown,
+				messages.Vars{SessionID: sessionRef(ctx)})
+			if err != nil {
+				log.Warn("couldn't send error to client", slog.Any("error", err))
+			}
+			// Send a non-zero exit code to the client, as OpenSSH does when a
+			// connection is closed.
+			if err = s.Exit(255); err != nil {
+				log.Warn("couldn't send exit code to client", slog.Any("error", err))
+			}
+		} else if ctx.Err() != nil {
+			// The session context is cancelled when the client connection is
+			// closed, so there is no one left to tell.
+			log.Info("exec session ended by client disconnect",
+				slog.Any("error", err))
 		} else {
 			log.Warn("couldn't execute command", slog.Any("error", err))
-			_, err = fmt.Fprintf(s.Stderr(), "error executing command. SID: %s\r\n",
-				ctx.SessionID())
+			_, err = msgs.Fprint(ctx, s.Stderr(), messages.ExecError,
+				messages.Vars{SessionID: sessionRef(ctx)})
 			if err != nil {
 				log.Warn("couldn't send error to client", slog.Any("error", err))
 			}
@@ -1,94 +1,220 @@
 package sshserver_test
 
 import (
-	"crypto/ed25519"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"log/slog"
+	"net/url"
 	"os"
+	osexec "os/exec"
+	"regexp"
+	"slices"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/alecthomas/assert/v2"
 	"github.com/anmitsu/go-shlex"
 	"github.com/gliderlabs/ssh"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/uselagoon/ssh-portal/internal/audit"
+	"github.com/uselagoon/ssh-portal/internal/bus"
+	"github.com/uselagoon/ssh-portal/internal/k8s"
+	"github.com/uselagoon/ssh-portal/internal/rbac"
+	"github.com/uselagoon/ssh-portal/internal/recovery"
 	"github.com/uselagoon/ssh-portal/internal/sshserver"
+	"github.com/uselagoon/ssh-portal/internal/sshserver/sshservertest"
 	"go.uber.org/mock/gomock"
 	gossh "golang.org/x/crypto/ssh"
+	"k8s.io/utils/exec"
 )
 
+// emulateContextValues configures the given mock ssh.Context to store and
+// retrieve values in the same way as the real ssh.Context.
+func emulateContextValues(sshContext *MockContext) {
+	values := map[any]any{}
+	sshContext.EXPECT().SetValue(gomock.Any(), gomock.Any()).
+		Do(func(key, value any) { values[key] = value }).AnyTimes()
+	sshContext.EXPECT().Value(gomock.Any()).
+		DoAndReturn(func(key any) any { return values[key] }).AnyTimes()
+}
+
+// emulateLiveContext configures the given mock ssh.Context to behave as the
+// context of a session whose client is still connected.
+func emulateLiveContext(sshContext *MockContext) {
+	sshContext.EXPECT().Done().Return(make(<-chan struct{})).AnyTimes()
+	sshContext.EXPECT().Err().Return(nil).AnyTimes()
+}
+
+// testFingerprint is the fingerprint of the key which authenticated the
+// connection, as stored in the permissions by the auth handler.
+const testFingerprint = "SHA256:NtOIKkyGp6ubsA4F2PDr1EltRRj4Rx+KZ1YYPrzIzE8"
+
+// allowedAccess permits all types of session to a deployment.
+var allowedAccess = k8s.DeploymentAccess{Exec: true, Logs: true}
+
+// recordingSink is an audit.Sink which records emitted events.
+type recordingSink struct {
+	events []audit.Event
+}
+
+// Emit implements the audit.Sink interface.
+func (r *recordingSink) Emit(_ context.Context, e audit.Event) error {
+	r.events = append(r.events, e)
+	return nil
+}
+
+// eventTypes returns the types of the recorded events in order.
+func (r *recordingSink) eventTypes() []audit.EventType {
+	var types []audit.EventType
+	for _, e := range r.events {
+		types = append(types, e.Type)
+	}
+	return types
+}
+
+// logLineKeys returns the sorted keys of the first JSON log line in buf
+// with the given message.
+func logLineKeys(tt *testing.T, buf *bytes.Buffer, msg string) []string {
+	dec := json.NewDecoder(buf)
+	for dec.More() {
+		var line map[string]any
+		if err := dec.Decode(&line); err != nil {
+			tt.Fatal(err)
+		}
+		if line[slog.MessageKey] == msg {
+			var keys []string
+			for key := range line {
+				keys = append(keys, key)
+			}
+			slices.Sort(keys)
+			return keys
+		}
+	}
+	tt.Fatalf("couldn't find log line with message %q", msg)
+	return nil
+}
+
 func TestExec(t *testing.T) {
-	log := slog.New(slog.NewJSONHandler(os.Stderr, nil))
 	var (
 		user       = "project-test"
 		deployment = "cli"
 	)
+	// the environment exported before each command
+	env := "export LAGOON_SSH_PROJECT='bar' LAGOON_SSH_ENVIRONMENT='foo' " +
+		"LAGOON_SSH_SESSION_ID='test_session_id' " +
+		"LAGOON_SSH_USER_FINGERPRINT='" + testFingerprint +
+		"'; readonly LAGOON_SSH_PROJECT LAGOON_SSH_ENVIRONMENT " +
+		"LAGOON_SSH_SESSION_ID LAGOON_SSH_USER_FINGERPRINT; "
 	var testCases = map[string]struct {
 		rawCommand       string
 		command          []string
 		sftp             bool
 		logAccessEnabled bool
 		pty              bool
+		namespaceShell   string
+		environmentType  string
+		execErr          error
+		fallbackCommand  []string
 	}{
 		"bare interactive shell": {
 			rawCommand:       "",
-			command:          []string{"sh"},
+			command:          []string{"sh", "-c", env + "exec 'sh'"},
 			sftp:             false,
 			logAccessEnabled: false,
 			pty:              true,
 		},
 		"non-interactive id command": {
 			rawCommand:       "id",
-			command:          []string{"sh", "-c", "id"},
+			command:          []string{"sh", "-c", env + "id"},
 			sftp:             false,
 			logAccessEnabled: false,
 			pty:              false,
+			environmentType:  "production",
+		},
+		"namespace shell override": {
+			rawCommand:     "id",
+			command:        []string{"bash", "-c", env + "id"},
+			pty:            false,
+			namespaceShell: "bash",
+		},
+		"namespace shell fallback": {
+			rawCommand: "",
+			command: []string{"/opt/busybox/ash", "-c",
+				env + "exec '/opt/busybox/ash'"},
+			pty:            true,
+			namespaceShell: "/opt/busybox/ash",
+			execErr: errors.New(`couldn't exec: OCI runtime exec failed: ` +
+				`exec failed: unable to start container process: exec: ` +
+				`"/opt/busybox/ash": stat /opt/busybox/ash: ` +
+				`no such file or directory: unknown`),
+			fallbackCommand: []string{"sh", "-c", env + "exec 'sh'"},
 		},
 	}
 	for name, tc := range testCases {
 		t.Run(name, func(tt *testing.T) {
+			// capture log output
+			var buf bytes.Buffer
+			log := slog.New(slog.NewJSONHandler(&buf, nil))
 			// set up mocks
 			ctrl := gomock.NewController(tt)
 			k8sService := NewMockK8SAPIService(ctrl)
 			sshSession := NewMockSession(ctrl)
 			sshContext := NewMockContext(ctrl)
+			auditSink := &recordingSink{}
+			metrics := sshserver.NewMetrics(prometheus.NewRegistry())
 			// configure callback
-			callback := sshserver.SessionHandler(
-				log,
-				k8sService,
-				tc.sftp,
-				tc.logAccessEnabled,
-			)
+			callback := sshserver.SessionHandler(log, metrics,
+				sshserver.SessionConfig{
+					K8S:              k8sService,
+					LogAccessEnabled: tc.logAccessEnabled,
+					DefaultShell:     "sh",
+					AuditSink:        auditSink,
+				}, tc.sftp)
 			// configure mocks
 			sshSession.EXPECT().Context().Return(sshContext)
 			sshContext.EXPECT().SessionID().Return("test_session_id")
+			emulateContextValues(sshContext)
 			sshSession.EXPECT().RawCommand().Return(tc.rawCommand).Times(2)
 			// emulate ssh.Session.Command()
 			command, _ := shlex.Split(tc.rawCommand, true)
 			sshSession.EXPECT().Command().Return(command).Times(2)
 			sshSession.EXPECT().Subsystem().Return("")
-			sshSession.EXPECT().User().Return(user).Times(3)
+			// the command is executed again if the shell fails to start
+			execCalls := 1
+			if tc.fallbackCommand != nil {
+				execCalls = 2
+			}
+			sshSession.EXPECT().User().Return(user).Times(2 + execCalls)
 			k8sService.EXPECT().FindDeployment(
 				sshContext,
 				user,
 				deployment,
-			).Return(deployment, nil)
+			).Return(deployment, allowedAccess, nil)
 			// emulate the auth handler and marshal the details
 			sshPermissions := ssh.Permissions{Permissions: &gossh.Permissions{}}
-			sshContext.EXPECT().Permissions().Return(&sshPermissions).Times(5)
-			sshserver.PermissionsMarshal(sshContext, 1, 2, "foo", "bar")
-			// set up public key mock
-			publicKey, _, err := ed25519.GenerateKey(nil)
-			if err != nil {
-				tt.Fatal(err)
-			}
-			sshPublicKey, err := gossh.NewPublicKey(publicKey)
-			if err != nil {
-				tt.Fatal(err)
-			}
-			sshSession.EXPECT().PublicKey().Return(sshPublicKey)
+			sshContext.EXPECT().Permissions().Return(&sshPermissions).AnyTimes()
+			sshserver.PermissionsMarshal(sshContext, 1, 2, "foo", "bar",
+				tc.environmentType, testFingerprint, rbac.FullAccess,
+				tc.namespaceShell)
+			sshSession.EXPECT().Environ().Return(nil).AnyTimes()
 			// configure remaining mocks
 			winch := make(<-chan ssh.Window)
 			sshSession.EXPECT().Pty().Return(ssh.Pty{}, winch, tc.pty)
-			sshSession.EXPECT().Stderr().Return(os.Stderr)
+			if !tc.pty {
+				// non-pty sessions watch for signals and run the command in a
+				// cancellable context
+				emulateLiveContext(sshContext)
+				sshSession.EXPECT().Signals(gomock.Any()).Times(2)
+			}
+			sshSession.EXPECT().Stderr().Return(os.Stderr).Times(execCalls)
 			k8sService.EXPECT().Exec(
-				sshContext,
+				gomock.Any(),
 				user,
 				deployment,
 				"",
@@ -97,9 +223,779 @@ func TestExec(t *testing.T) {
 				os.Stderr,
 				tc.pty,
 				winch,
-			).Return(nil)
+			).Return(tc.execErr)
+			if tc.fallbackCommand != nil {
+				k8sService.EXPECT().Exec(
+					gomock.Any(),
+					user,
+					deployment,
+					"",
+					tc.fallbackCommand,
+					sshSession,
+					os.Stderr,
+					tc.pty,
+					winch,
+				).Return(nil)
+			}
+			// execute callback
+			callback(sshSession)
+			// check the canonical log fields
+			assert.Equal(tt, []string{
+				"SSHFingerprint",
+				"command",
+				"container",
+				"debug",
+				"deployment",
+				"environmentID",
+				"environmentName",
+				"environmentType",
+				"level",
+				"msg",
+				"namespace",
+				"projectID",
+				"projectName",
+				"pty",
+				"sessionID",
+				"time",
+			}, logLineKeys(tt, &buf, "executing SSH command"), name)
+			// check the session metrics are labelled by environment type
+			envTypeLabel := tc.environmentType
+			if envTypeLabel == "" {
+				envTypeLabel = "unknown"
+			}
+			assert.Equal(tt, 1.0, testutil.ToFloat64(
+				metrics.SessionTotal().WithLabelValues(envTypeLabel)), name)
+			// check the audit events
+			assert.Equal(tt, []audit.EventType{
+				audit.SessionStart,
+				audit.SessionEnd,
+			}, auditSink.eventTypes(), name)
+			for _, e := range auditSink.events {
+				assert.Equal(tt, user, e.Namespace, name)
+				assert.Equal(tt, deployment, e.Deployment, name)
+				assert.Equal(tt, tc.command, e.Command, name)
+				assert.Equal(tt, 1, e.EnvironmentID, name)
+				assert.Equal(tt, testFingerprint, e.SSHFingerprint, name)
+			}
+		})
+	}
+}
+
+func TestSessionEnvShell(t *testing.T) {
+	if _, err := osexec.LookPath("sh"); err != nil {
+		t.Skip("no sh in PATH")
+	}
+	// script prints the variable, tries to change it, and prints it again
+	script := `echo "$LAGOON_SSH_PROJECT"; ` +
+		`LAGOON_SSH_PROJECT=changed; echo "$LAGOON_SSH_PROJECT"`
+	var testCases = map[string]struct {
+		rawCmd       string
+		stdin        string
+		expectStdout string
+		expectErr    bool
+	}{
+		"command": {
+			rawCmd:       script,
+			expectStdout: "bar\n",
+			expectErr:    true,
+		},
+		// the interactive shell inherits the variables, but not the
+		// read-only attribute
+		"shell": {
+			stdin:        script + "\n",
+			expectStdout: "bar\nchanged\n",
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			cmd := sshserver.GetSSHIntent(false, tc.rawCmd, "sh", "bar", "foo",
+				"test_session_id", testFingerprint)
+			c := osexec.Command(cmd[0], cmd[1:]...)
+			c.Stdin = strings.NewReader(tc.stdin)
+			stdout, err := c.Output()
+			assert.Equal(tt, tc.expectStdout, string(stdout), name)
+			if tc.expectErr {
+				assert.Error(tt, err, name)
+			} else {
+				assert.NoError(tt, err, name)
+			}
+		})
+	}
+}
+
+func TestExecTimeLimit(t *testing.T) {
+	var (
+		user       = "project-test"
+		deployment = "cli"
+	)
+	var testCases = map[string]struct {
+		pty           bool
+		execDuration  time.Duration
+		expectLimited bool
+	}{
+		"pty session reaches limit": {
+			pty:           true,
+			expectLimited: true,
+		},
+		"command reaches limit": {
+			expectLimited: true,
+		},
+		"session ends before limit": {
+			pty:          true,
+			execDuration: 10 * time.Millisecond,
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			log := slog.New(slog.NewJSONHandler(os.Stderr, nil))
+			// set up mocks
+			ctrl := gomock.NewController(tt)
+			k8sService := NewMockK8SAPIService(ctrl)
+			sshSession := NewMockSession(ctrl)
+			sshContext := NewMockContext(ctrl)
+			metrics := sshserver.NewMetrics(prometheus.NewRegistry())
+			// configure callback
+			callback := sshserver.SessionHandler(log, metrics,
+				sshserver.SessionConfig{
+					K8S:           k8sService,
+					DefaultShell:  "sh",
+					ExecTimeLimit: 200 * time.Millisecond,
+					AuditSink:     &recordingSink{},
+				}, false)
+			// configure mocks
+			sshSession.EXPECT().Context().Return(sshContext)
+			sshContext.EXPECT().SessionID().Return("test_session_id").AnyTimes()
+			emulateContextValues(sshContext)
+			// called by context.WithTimeout()
+			sshContext.EXPECT().Deadline().Return(time.Time{}, false).AnyTimes()
+			sshContext.EXPECT().Done().Return(make(<-chan struct{})).AnyTimes()
+			sshContext.EXPECT().Err().Return(nil).AnyTimes()
+			sshSession.EXPECT().RawCommand().Return("").Times(2)
+			sshSession.EXPECT().Command().Return(nil).Times(2)
+			sshSession.EXPECT().Subsystem().Return("")
+			sshSession.EXPECT().User().Return(user).AnyTimes()
+			k8sService.EXPECT().FindDeployment(sshContext, user, deployment).
+				Return(deployment, allowedAccess, nil)
+			// emulate the auth handler and marshal the details
+			sshPermissions := ssh.Permissions{Permissions: &gossh.Permissions{}}
+			sshContext.EXPECT().Permissions().Return(&sshPermissions).AnyTimes()
+			sshserver.PermissionsMarshal(sshContext, 1, 2, "foo", "bar", "",
+				testFingerprint, rbac.FullAccess, "")
+			sshSession.EXPECT().Environ().Return(nil).AnyTimes()
+			winch := make(<-chan ssh.Window)
+			sshSession.EXPECT().Pty().Return(ssh.Pty{}, winch, tc.pty)
+			sshSession.EXPECT().Signals(gomock.Any()).AnyTimes()
+			var stderr bytes.Buffer
+			sshSession.EXPECT().Stderr().Return(&stderr).AnyTimes()
+			// Exec blocks until the session ends or the context is cancelled
+			k8sService.EXPECT().Exec(gomock.Any(), user, deployment, "",
+				gomock.Any(), sshSession, &stderr, tc.pty, winch).
+				DoAndReturn(func(ctx context.Context, _, _, _ string, _ []string,
+					_ io.ReadWriter, _ io.Writer, _ bool, _ <-chan ssh.Window) error {
+					if tc.execDuration > 0 {
+						time.Sleep(tc.execDuration)
+						return nil
+					}
+					<-ctx.Done()
+					return ctx.Err()
+				})
+			if tc.expectLimited {
+				sshSession.EXPECT().Exit(255).Return(nil)
+			}
+			// execute callback
+			callback(sshSession)
+			// check the result
+			if tc.expectLimited {
+				assert.Contains(tt, stderr.String(), "maximum session time reached",
+					name)
+				assert.Equal(tt, 1.0,
+					testutil.ToFloat64(metrics.ExecTimeLimitTotal()), name)
+			} else {
+				assert.Equal(tt, 0.0,
+					testutil.ToFloat64(metrics.ExecTimeLimitTotal()), name)
+			}
+			if tc.pty && tc.expectLimited {
+				assert.Contains(tt, stderr.String(),
+					"warning: maximum session time will be reached in 100ms", name)
+			} else {
+				assert.NotContains(tt, stderr.String(), "warning", name)
+			}
+		})
+	}
+}
+
+func TestExecSignal(t *testing.T) {
+	var (
+		user       = "project-test"
+		deployment = "cli"
+	)
+	var testCases = map[string]struct {
+		signal       ssh.Signal
+		expectErr    error
+		expectStatus int
+	}{
+		"interrupt": {
+			signal:       ssh.SIGINT,
+			expectErr:    context.Canceled,
+			expectStatus: 130,
+		},
+		"terminate": {
+			signal:       ssh.SIGTERM,
+			expectErr:    context.Canceled,
+			expectStatus: 143,
+		},
+		"other signal ignored": {
+			signal: ssh.SIGHUP,
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			log := slog.New(slog.NewJSONHandler(os.Stderr, nil))
+			// set up mocks
+			ctrl := gomock.NewController(tt)
+			k8sService := NewMockK8SAPIService(ctrl)
+			sshSession := NewMockSession(ctrl)
+			sshContext := NewMockContext(ctrl)
+			// configure callback
+			callback := sshserver.SessionHandler(log,
+				sshserver.NewMetrics(prometheus.NewRegistry()),
+				sshserver.SessionConfig{
+					K8S:          k8sService,
+					DefaultShell: "sh",
+					AuditSink:    &recordingSink{},
+				}, false)
+			// configure mocks
+			sshSession.EXPECT().Context().Return(sshContext)
+			sshContext.EXPECT().SessionID().Return("test_session_id").AnyTimes()
+			emulateContextValues(sshContext)
+			emulateLiveContext(sshContext)
+			sshSession.EXPECT().RawCommand().Return("").Times(2)
+			sshSession.EXPECT().Command().Return(nil).Times(2)
+			sshSession.EXPECT().Subsystem().Return("")
+			sshSession.EXPECT().User().Return(user).AnyTimes()
+			k8sService.EXPECT().FindDeployment(sshContext, user, deployment).
+				Return(deployment, allowedAccess, nil)
+			// emulate the auth handler and marshal the details
+			sshPermissions := ssh.Permissions{Permissions: &gossh.Permissions{}}
+			sshContext.EXPECT().Permissions().Return(&sshPermissions).AnyTimes()
+			sshserver.PermissionsMarshal(sshContext, 1, 2, "foo", "bar", "",
+				testFingerprint, rbac.FullAccess, "")
+			sshSession.EXPECT().Environ().Return(nil).AnyTimes()
+			winch := make(<-chan ssh.Window)
+			sshSession.EXPECT().Pty().Return(ssh.Pty{}, winch, false)
+			var stderr bytes.Buffer
+			sshSession.EXPECT().Stderr().Return(&stderr).AnyTimes()
+			// the client sends a signal once the channel is registered
+			sshSession.EXPECT().Signals(gomock.Any()).
+				Do(func(c chan<- ssh.Signal) {
+					if c != nil {
+						go func() { c <- tc.signal }()
+					}
+				}).Times(2)
+			// Exec blocks until the context is cancelled, or returns
+			// successfully after a delay
+			var execErr error
+			k8sService.EXPECT().Exec(gomock.Any(), user, deployment, "",
+				gomock.Any(), sshSession, &stderr, false, winch).
+				DoAndReturn(func(ctx context.Context, _, _, _ string, _ []string,
+					_ io.ReadWriter, _ io.Writer, _ bool, _ <-chan ssh.Window) error {
+					select {
+					case <-ctx.Done():
+						execErr = ctx.Err()
+						return execErr
+					case <-time.After(100 * time.Millisecond):
+						return nil
+					}
+				})
+			if tc.expectStatus != 0 {
+				sshSession.EXPECT().Exit(tc.expectStatus).Return(nil)
+			}
+			// execute callback
+			callback(sshSession)
+			// check the result
+			assert.Equal(tt, tc.expectErr, execErr, name)
+		})
+	}
+}
+
+func TestExecShutdown(t *testing.T) {
+	var (
+		user       = "project-test"
+		deployment = "cli"
+	)
+	var testCases = map[string]struct {
+		shutdown     bool
+		expectLog    string
+		expectStderr string
+		expectStatus int
+	}{
+		"server shutdown": {
+			shutdown:  true,
+			expectLog: "exec session ended by server shutdown",
+			expectStderr: "\r\nconnection closed by server (shutting down). " +
+				"SID: test_session_id\r\n",
+			expectStatus: 255,
+		},
+		"client disconnect": {
+			expectLog: "exec session ended by client disconnect",
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			// capture log output
+			var buf bytes.Buffer
+			log := slog.New(slog.NewJSONHandler(&buf, nil))
+			// set up mocks
+			ctrl := gomock.NewController(tt)
+			k8sService := NewMockK8SAPIService(ctrl)
+			sshSession := NewMockSession(ctrl)
+			sshContext := NewMockContext(ctrl)
+			shutdown, startShutdown := context.WithCancel(context.Background())
+			defer startShutdown()
+			// configure callback
+			callback := sshserver.SessionHandler(log,
+				sshserver.NewMetrics(prometheus.NewRegistry()),
+				sshserver.SessionConfig{
+					K8S:          k8sService,
+					DefaultShell: "sh",
+					AuditSink:    &recordingSink{},
+					Shutdown:     shutdown,
+				}, false)
+			// configure mocks
+			sshSession.EXPECT().Context().Return(sshContext)
+			sshContext.EXPECT().SessionID().Return("test_session_id").AnyTimes()
+			emulateContextValues(sshContext)
+			// the session context is cancelled when the client disconnects
+			disconnected := make(chan struct{})
+			sshContext.EXPECT().Done().Return((<-chan struct{})(disconnected)).
+				AnyTimes()
+			sshContext.EXPECT().Err().DoAndReturn(func() error {
+				select {
+				case <-disconnected:
+					return context.Canceled
+				default:
+					return nil
+				}
+			}).AnyTimes()
+			sshSession.EXPECT().RawCommand().Return("").Times(2)
+			sshSession.EXPECT().Command().Return(nil).Times(2)
+			sshSession.EXPECT().Subsystem().Return("")
+			sshSession.EXPECT().User().Return(user).AnyTimes()
+			k8sService.EXPECT().FindDeployment(sshContext, user, deployment).
+				Return(deployment, allowedAccess, nil)
+			// emulate the auth handler and marshal the details
+			sshPermissions := ssh.Permissions{Permissions: &gossh.Permissions{}}
+			sshContext.EXPECT().Permissions().Return(&sshPermissions).AnyTimes()
+			sshserver.PermissionsMarshal(sshContext, 1, 2, "foo", "bar", "",
+				testFingerprint, rbac.FullAccess, "")
+			sshSession.EXPECT().Environ().Return(nil).AnyTimes()
+			winch := make(<-chan ssh.Window)
+			sshSession.EXPECT().Pty().Return(ssh.Pty{}, winch, false)
+			var stderr bytes.Buffer
+			sshSession.EXPECT().Stderr().Return(&stderr).AnyTimes()
+			sshSession.EXPECT().Signals(gomock.Any()).Times(2)
+			// Exec blocks until the context is cancelled by either the server
+			// shutting down or the client disconnecting
+			k8sService.EXPECT().Exec(gomock.Any(), user, deployment, "",
+				gomock.Any(), sshSession, &stderr, false, winch).
+				DoAndReturn(func(ctx context.Context, _, _, _ string, _ []string,
+					_ io.ReadWriter, _ io.Writer, _ bool, _ <-chan ssh.Window) error {
+					if tc.shutdown {
+						startShutdown()
+					} else {
+						close(disconnected)
+					}
+					<-ctx.Done()
+					return ctx.Err()
+				})
+			if tc.expectStatus != 0 {
+				sshSession.EXPECT().Exit(tc.expectStatus).Return(nil)
+			}
+			// execute callback
+			callback(sshSession)
+			// check the result
+			assert.Contains(tt, buf.String(), tc.expectLog, name)
+			assert.Equal(tt, tc.expectStderr, stderr.String(), name)
+		})
+	}
+}
+
+func TestContextEnded(t *testing.T) {
+	var testCases = map[string]struct {
+		err    error
+		expect bool
+	}{
+		"canceled": {
+			err:    context.Canceled,
+			expect: true,
+		},
+		"url error": {
+			err: &url.Error{
+				Op:  "Post",
+				URL: "https://10.0.0.1/api/v1/namespaces/foo/pods/bar/exec",
+				Err: context.Canceled,
+			},
+			expect: true,
+		},
+		"wrapped deadline exceeded": {
+			err: fmt.Errorf("error dialing backend: %w",
+				context.DeadlineExceeded),
+			expect: true,
+		},
+		"nested wrapping": {
+			err: fmt.Errorf("stream error: %w", &url.Error{
+				Op:  "Get",
+				URL: "wss://10.0.0.1/api/v1/namespaces/foo/pods/bar/exec",
+				Err: context.Canceled,
+			}),
+			expect: true,
+		},
+		"context error text only": {
+			err: errors.New("context canceled"),
+		},
+		"exit error": {
+			err: exec.CodeExitError{
+				Err:  errors.New("command terminated with exit code 1"),
+				Code: 1,
+			},
+		},
+		"nil": {},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			assert.Equal(tt, tc.expect, sshserver.ContextEnded(tc.err), name)
+		})
+	}
+}
+
+func TestSFTPServerMissing(t *testing.T) {
+	var (
+		user       = "project-test"
+		deployment = "cli"
+	)
+	var testCases = map[string]struct {
+		container     string
+		execErr       error
+		expectStatus  int
+		expectMessage string
+	}{
+		"not found": {
+			execErr: exec.CodeExitError{
+				Err:  errors.New("command terminated with exit code 127"),
+				Code: 127,
+			},
+			expectStatus: 127,
+			expectMessage: "sftp-server not installed in service cli " +
+				"container (default). SID: test_session_id\r\n",
+		},
+		"not executable": {
+			container: "php",
+			execErr: exec.CodeExitError{
+				Err:  errors.New("command terminated with exit code 126"),
+				Code: 126,
+			},
+			expectStatus: 126,
+			expectMessage: "sftp-server not installed in service cli " +
+				"container php. SID: test_session_id\r\n",
+		},
+		"start failure": {
+			container: "php",
+			execErr: errors.New(`couldn't exec: OCI runtime exec failed: ` +
+				`exec failed: unable to start container process: exec: ` +
+				`"sftp-server": executable file not found in $PATH: unknown`),
+			expectStatus: 127,
+			expectMessage: "sftp-server not installed in service cli " +
+				"container php. SID: test_session_id\r\n",
+		},
+		"sftp-server error": {
+			execErr: exec.CodeExitError{
+				Err:  errors.New("command terminated with exit code 1"),
+				Code: 1,
+			},
+			expectStatus: 1,
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			log := slog.New(slog.NewJSONHandler(os.Stderr, nil))
+			// set up mocks
+			ctrl := gomock.NewController(tt)
+			k8sService := NewMockK8SAPIService(ctrl)
+			sshSession := NewMockSession(ctrl)
+			sshContext := NewMockContext(ctrl)
+			metrics := sshserver.NewMetrics(prometheus.NewRegistry())
+			// configure callback
+			callback := sshserver.SessionHandler(log, metrics,
+				sshserver.SessionConfig{
+					K8S:          k8sService,
+					DefaultShell: "sh",
+					AuditSink:    &recordingSink{},
+				}, true)
+			// configure mocks
+			rawCommand := "service=cli"
+			if tc.container != "" {
+				rawCommand += " container=" + tc.container
+			}
+			command, _ := shlex.Split(rawCommand, true)
+			sshSession.EXPECT().Context().Return(sshContext)
+			sshContext.EXPECT().SessionID().Return("test_session_id").AnyTimes()
+			emulateContextValues(sshContext)
+			emulateLiveContext(sshContext)
+			sshSession.EXPECT().RawCommand().Return(rawCommand).Times(2)
+			sshSession.EXPECT().Command().Return(command).Times(2)
+			sshSession.EXPECT().Subsystem().Return("sftp")
+			sshSession.EXPECT().User().Return(user).AnyTimes()
+			k8sService.EXPECT().FindDeployment(sshContext, user, deployment).
+				Return(deployment, allowedAccess, nil)
+			// emulate the auth handler and marshal the details
+			sshPermissions := ssh.Permissions{Permissions: &gossh.Permissions{}}
+			sshContext.EXPECT().Permissions().Return(&sshPermissions).AnyTimes()
+			sshserver.PermissionsMarshal(sshContext, 1, 2, "foo", "bar", "",
+				testFingerprint, rbac.FullAccess, "")
+			sshSession.EXPECT().Environ().Return(nil).AnyTimes()
+			winch := make(<-chan ssh.Window)
+			sshSession.EXPECT().Pty().Return(ssh.Pty{}, winch, false)
+			sshSession.EXPECT().Signals(gomock.Any()).Times(2)
+			var stderr bytes.Buffer
+			sshSession.EXPECT().Stderr().Return(&stderr).AnyTimes()
+			sftpCommand := []string{"sftp-server", "-u", "0002"}
+			k8sService.EXPECT().Exec(gomock.Any(), user, deployment,
+				tc.container, sftpCommand, sshSession, &stderr, false, winch).
+				Return(tc.execErr)
+			sshSession.EXPECT().Exit(tc.expectStatus).Return(nil)
+			// execute callback
+			callback(sshSession)
+			// check the result
+			assert.Equal(tt, tc.expectMessage, stderr.String(), name)
+			var expectMissing float64
+			if tc.expectMessage != "" {
+				expectMissing = 1
+			}
+			assert.Equal(tt, expectMissing,
+				testutil.ToFloat64(metrics.SFTPServerMissingTotal()), name)
+		})
+	}
+}
+
+func TestConfirmProduction(t *testing.T) {
+	var (
+		user       = "project-test"
+		deployment = "cli"
+		prompt     = "you are about to access the PRODUCTION environment foo " +
+			"of project bar.\r\ntype yes to continue: "
+	)
+	var testCases = map[string]struct {
+		environmentType string
+		pty             bool
+		input           string
+		blockInput      bool
+		expectPrompt    bool
+		expectExec      bool
+		expectStderr    string
+	}{
+		"accept": {
+			environmentType: "production",
+			pty:             true,
+			input:           "yes\r",
+			expectPrompt:    true,
+			expectExec:      true,
+		},
+		"accept after correction": {
+			environmentType: "production",
+			pty:             true,
+			input:           "yse\x7f\x7fes\r",
+			expectPrompt:    true,
+			expectExec:      true,
+		},
+		"reject": {
+			environmentType: "production",
+			pty:             true,
+			input:           "no\r",
+			expectPrompt:    true,
+			expectStderr:    "session cancelled. SID: test_session_id\r\n",
+		},
+		"interrupt": {
+			environmentType: "production",
+			pty:             true,
+			input:           "ye\x03",
+			expectPrompt:    true,
+			expectStderr:    "session cancelled. SID: test_session_id\r\n",
+		},
+		"timeout": {
+			environmentType: "production",
+			pty:             true,
+			blockInput:      true,
+			expectPrompt:    true,
+			expectStderr: "\r\ntimed out waiting for confirmation. " +
+				"SID: test_session_id\r\n",
+		},
+		"non-interactive": {
+			environmentType: "production",
+			expectExec:      true,
+		},
+		"development": {
+			environmentType: "development",
+			pty:             true,
+			expectExec:      true,
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			log := slog.New(slog.NewJSONHandler(os.Stderr, nil))
+			// set up mocks
+			ctrl := gomock.NewController(tt)
+			k8sService := NewMockK8SAPIService(ctrl)
+			sshSession := NewMockSession(ctrl)
+			sshContext := NewMockContext(ctrl)
+			auditSink := &recordingSink{}
+			// configure callback
+			callback := sshserver.SessionHandler(log,
+				sshserver.NewMetrics(prometheus.NewRegistry()),
+				sshserver.SessionConfig{
+					K8S:            k8sService,
+					DefaultShell:   "sh",
+					AuditSink:      auditSink,
+					ConfirmTimeout: 100 * time.Millisecond,
+				}, false)
+			// configure mocks
+			sshSession.EXPECT().Context().Return(sshContext)
+			sshContext.EXPECT().SessionID().Return("test_session_id").AnyTimes()
+			emulateContextValues(sshContext)
+			emulateLiveContext(sshContext)
+			sshSession.EXPECT().RawCommand().Return("").Times(2)
+			sshSession.EXPECT().Command().Return(nil).Times(2)
+			sshSession.EXPECT().Subsystem().Return("")
+			sshSession.EXPECT().User().Return(user).AnyTimes()
+			k8sService.EXPECT().FindDeployment(sshContext, user, deployment).
+				Return(deployment, allowedAccess, nil)
+			// emulate the auth handler and marshal the details
+			sshPermissions := ssh.Permissions{Permissions: &gossh.Permissions{}}
+			sshContext.EXPECT().Permissions().Return(&sshPermissions).AnyTimes()
+			sshserver.PermissionsMarshal(sshContext, 1, 2, "foo", "bar",
+				tc.environmentType, testFingerprint, rbac.FullAccess, "")
+			sshSession.EXPECT().Environ().Return(nil).AnyTimes()
+			winch := make(<-chan ssh.Window)
+			sshSession.EXPECT().Pty().Return(ssh.Pty{}, winch, tc.pty)
+			sshSession.EXPECT().Signals(gomock.Any()).AnyTimes()
+			var stdout, stderr bytes.Buffer
+			sshSession.EXPECT().Stderr().Return(&stderr).AnyTimes()
+			// emulate the user typing into the session
+			if tc.expectPrompt {
+				sshSession.EXPECT().Write(gomock.Any()).
+					DoAndReturn(stdout.Write).AnyTimes()
+				input := strings.NewReader(tc.input)
+				unblock := make(chan struct{})
+				tt.Cleanup(func() { close(unblock) })
+				sshSession.EXPECT().Read(gomock.Any()).DoAndReturn(
+					func(p []byte) (int, error) {
+						if tc.blockInput {
+							<-unblock
+							return 0, io.EOF
+						}
+						return input.Read(p)
+					}).AnyTimes()
+			}
+			if tc.expectExec {
+				k8sService.EXPECT().Exec(gomock.Any(), user, deployment, "",
+					gomock.Any(), sshSession, &stderr, tc.pty, winch).
+					Return(nil)
+			} else {
+				sshSession.EXPECT().Exit(252).Return(nil)
+			}
 			// execute callback
 			callback(sshSession)
+			// check the result
+			if tc.expectPrompt {
+				assert.True(tt, strings.HasPrefix(stdout.String(), prompt),
+					name)
+			}
+			assert.Equal(tt, tc.expectStderr, stderr.String(), name)
+			expectEvents := []audit.EventType{
+				audit.SessionStart,
+				audit.SessionEnd,
+			}
+			if !tc.expectExec {
+				expectEvents = []audit.EventType{audit.AuthDenied}
+			}
+			assert.Equal(tt, expectEvents, auditSink.eventTypes(), name)
+		})
+	}
+}
+
+func TestGetSSHIntent(t *testing.T) {
+	var testCases = map[string]struct {
+		sftp        bool
+		rawCommand  string
+		shell       string
+		project     string
+		environment string
+		expect      []string
+	}{
+		"sftp": {
+			sftp:        true,
+			rawCommand:  "id",
+			project:     "foo",
+			environment: "main",
+			expect:      []string{"sftp-server", "-u", "0002"},
+		},
+		"interactive": {
+			project:     "foo",
+			environment: "main",
+			expect: []string{"sh", "-c", "export LAGOON_SSH_PROJECT='foo' " +
+				"LAGOON_SSH_ENVIRONMENT='main' LAGOON_SSH_SESSION_ID='sid' " +
+				"LAGOON_SSH_USER_FINGERPRINT='SHA256:abc'; readonly " +
+				"LAGOON_SSH_PROJECT LAGOON_SSH_ENVIRONMENT LAGOON_SSH_SESSION_ID " +
+				"LAGOON_SSH_USER_FINGERPRINT; exec 'sh'"},
+		},
+		"interactive shell override": {
+			shell:       "/bin/bash",
+			project:     "foo",
+			environment: "main",
+			expect: []string{"/bin/bash", "-c", "export LAGOON_SSH_PROJECT='foo' " +
+				"LAGOON_SSH_ENVIRONMENT='main' LAGOON_SSH_SESSION_ID='sid' " +
+				"LAGOON_SSH_USER_FINGERPRINT='SHA256:abc'; readonly " +
+				"LAGOON_SSH_PROJECT LAGOON_SSH_ENVIRONMENT LAGOON_SSH_SESSION_ID " +
+				"LAGOON_SSH_USER_FINGERPRINT; exec '/bin/bash'"},
+		},
+		"non-interactive": {
+			rawCommand:  "echo $LAGOON_SSH_PROJECT",
+			project:     "foo",
+			environment: "main",
+			expect: []string{"sh", "-c", "export LAGOON_SSH_PROJECT='foo' " +
+				"LAGOON_SSH_ENVIRONMENT='main' LAGOON_SSH_SESSION_ID='sid' " +
+				"LAGOON_SSH_USER_FINGERPRINT='SHA256:abc'; readonly " +
+				"LAGOON_SSH_PROJECT LAGOON_SSH_ENVIRONMENT LAGOON_SSH_SESSION_ID " +
+				"LAGOON_SSH_USER_FINGERPRINT; echo $LAGOON_SSH_PROJECT"},
+		},
+		"interactive spaces and quotes": {
+			project:     `it's a "project"`,
+			environment: "feature branch",
+			expect: []string{"sh", "-c",
+				`export LAGOON_SSH_PROJECT='it'\''s a "project"' ` +
+					"LAGOON_SSH_ENVIRONMENT='feature branch' " +
+					"LAGOON_SSH_SESSION_ID='sid' " +
+					"LAGOON_SSH_USER_FINGERPRINT='SHA256:abc'; readonly " +
+					"LAGOON_SSH_PROJECT LAGOON_SSH_ENVIRONMENT LAGOON_SSH_SESSION_ID " +
+					"LAGOON_SSH_USER_FINGERPRINT; exec 'sh'"},
+		},
+		"non-interactive spaces and quotes": {
+			rawCommand:  "id",
+			project:     "foo'; rm -rf /; echo '",
+			environment: "$(reboot) `id`",
+			expect: []string{"sh", "-c",
+				`export LAGOON_SSH_PROJECT='foo'\''; rm -rf /; echo '\''' ` +
+					"LAGOON_SSH_ENVIRONMENT='$(reboot) `id`' " +
+					"LAGOON_SSH_SESSION_ID='sid' " +
+					"LAGOON_SSH_USER_FINGERPRINT='SHA256:abc'; readonly " +
+					"LAGOON_SSH_PROJECT LAGOON_SSH_ENVIRONMENT LAGOON_SSH_SESSION_ID " +
+					"LAGOON_SSH_USER_FINGERPRINT; id"},
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			assert.Equal(tt, tc.expect, sshserver.GetSSHIntent(tc.sftp,
+				tc.rawCommand, tc.shell, tc.project, tc.environment, "sid",
+				"SHA256:abc"), name)
 		})
 	}
 }
@@ -131,16 +1027,26 @@ func TestLogs(t *testing.T) {
 		t.Run(name, func(tt *testing.T) {
 			// set up mocks
 			ctrl := gomock.NewController(tt)
-			k8sService := NewMockK8SAPIService(ctrl)
+			k8sService := &sshservertest.FakeK8S{
+				Deployments: map[string]map[string]sshservertest.Deployment{
+					tc.user: {tc.deployment: {
+						Name:   tc.deployment,
+						Access: allowedAccess,
+					}},
+				},
+			}
 			sshSession := NewMockSession(ctrl)
 			sshContext := NewMockContext(ctrl)
+			auditSink := &recordingSink{}
 			// configure callback
-			callback := sshserver.SessionHandler(
-				log,
-				k8sService,
-				tc.sftp,
-				tc.logAccessEnabled,
-			)
+			callback := sshserver.SessionHandler(log,
+				sshserver.NewMetrics(prometheus.NewRegistry()),
+				sshserver.SessionConfig{
+					K8S:              k8sService,
+					LogAccessEnabled: tc.logAccessEnabled,
+					DefaultShell:     "sh",
+					AuditSink:        auditSink,
+				}, tc.sftp)
 			// configure mocks
 			sshSession.EXPECT().Context().Return(sshContext)
 			sshContext.EXPECT().SessionID().Return("test_session_id")
@@ -150,40 +1056,1062 @@ func TestLogs(t *testing.T) {
 			sshSession.EXPECT().Command().Return(command).Times(2)
 			sshSession.EXPECT().Subsystem().Return("")
 			sshSession.EXPECT().User().Return(tc.user).Times(3)
-			k8sService.EXPECT().FindDeployment(
-				sshContext,
-				tc.user,
-				tc.deployment,
-			).Return(tc.deployment, nil)
 			// emulate the auth handler and marshal the details
 			sshPermissions := ssh.Permissions{Permissions: &gossh.Permissions{}}
-			sshContext.EXPECT().Permissions().Return(&sshPermissions).Times(5)
-			sshserver.PermissionsMarshal(sshContext, 1, 2, "foo", "bar")
-			// set up public key mock
-			publicKey, _, err := ed25519.GenerateKey(nil)
-			if err != nil {
-				tt.Fatal(err)
-			}
-			sshPublicKey, err := gossh.NewPublicKey(publicKey)
-			if err != nil {
-				tt.Fatal(err)
-			}
-			sshSession.EXPECT().PublicKey().Return(sshPublicKey)
-			// called by context.WithCancel()
-			sshContext.EXPECT().Value(gomock.Any()).Return(nil).AnyTimes()
+			sshContext.EXPECT().Permissions().Return(&sshPermissions).AnyTimes()
+			sshserver.PermissionsMarshal(sshContext, 1, 2, "foo", "bar", "",
+				testFingerprint, rbac.FullAccess, "")
+			sshSession.EXPECT().Environ().Return(nil).AnyTimes()
+			// also called by context.WithCancel()
+			emulateContextValues(sshContext)
 			// configure remaining mocks
 			sshContext.EXPECT().Done().Return(make(<-chan struct{})).AnyTimes()
-			k8sService.EXPECT().Logs(
-				gomock.Any(), // private childCtx
-				tc.user,
-				tc.deployment,
-				"",
-				tc.follow,
-				tc.taillines,
-				sshSession,
-			).Return(nil)
 			// execute callback
 			callback(sshSession)
+			assert.Equal(tt, []sshservertest.Call{
+				{
+					Method:     sshservertest.MethodFindDeployment,
+					Namespace:  tc.user,
+					Deployment: tc.deployment,
+				},
+				{
+					Method:     sshservertest.MethodLogs,
+					Namespace:  tc.user,
+					Deployment: tc.deployment,
+					Follow:     tc.follow,
+					TailLines:  tc.taillines,
+				},
+			}, k8sService.Calls(), name)
+		})
+	}
+}
+
+func TestSessionPanicRecovery(t *testing.T) {
+	var buf bytes.Buffer
+	log := slog.New(slog.NewJSONHandler(&buf, nil))
+	// set up mocks
+	ctrl := gomock.NewController(t)
+	k8sService := NewMockK8SAPIService(ctrl)
+	sshSession := NewMockSession(ctrl)
+	sshContext := NewMockContext(ctrl)
+	// configure callback wrapped in panic recovery
+	metrics := sshserver.NewMetrics(prometheus.NewRegistry())
+	callback := recovery.SSHHandler(log, metrics.SessionPanicsTotal(),
+		sshserver.SessionHandler(log, metrics,
+			sshserver.SessionConfig{
+				K8S:          k8sService,
+				DefaultShell: "sh",
+				AuditSink:    &recordingSink{},
+			}, false))
+	// configure mocks
+	sshSession.EXPECT().Context().Return(sshContext).AnyTimes()
+	sshContext.EXPECT().SessionID().Return("test_session_id").AnyTimes()
+	emulateContextValues(sshContext)
+	sshSession.EXPECT().RawCommand().Return("id").AnyTimes()
+	sshSession.EXPECT().Command().Return([]string{"id"}).AnyTimes()
+	sshSession.EXPECT().Subsystem().Return("").AnyTimes()
+	sshSession.EXPECT().User().Return("project-test").AnyTimes()
+	sshPermissions := ssh.Permissions{Permissions: &gossh.Permissions{}}
+	sshContext.EXPECT().Permissions().Return(&sshPermissions).AnyTimes()
+	sshserver.PermissionsMarshal(sshContext, 1, 2, "foo", "bar", "",
+		testFingerprint, rbac.FullAccess, "")
+	sshSession.EXPECT().Environ().Return(nil).AnyTimes()
+	// force a panic in the k8s service
+	k8sService.EXPECT().FindDeployment(sshContext, "project-test", "cli").
+		DoAndReturn(func(context.Context, string, string) (string,
+			k8s.DeploymentAccess, error) {
+			panic("unexpected k8s object")
+		})
+	// the session is closed with exit code 255
+	sshSession.EXPECT().Exit(255).Return(nil)
+	// execute callback
+	callback(sshSession)
+	assert.Equal(t, float64(1),
+		testutil.ToFloat64(metrics.SessionPanicsTotal()))
+	assert.Contains(t, buf.String(), "recovered panic in SSH session handler")
+	assert.Contains(t, buf.String(), "unexpected k8s object")
+	assert.Contains(t, buf.String(), `"sessionID":"test_session_id"`)
+}
+
+func TestLogsOnlyCapability(t *testing.T) {
+	var (
+		user       = "project-test"
+		deployment = "nginx"
+	)
+	var testCases = map[string]struct {
+		rawCommand string
+		sftp       bool
+		expectLogs bool
+	}{
+		"logs allowed": {
+			rawCommand: "service=nginx logs=tailLines=10",
+			expectLogs: true,
+		},
+		"shell rejected": {
+			rawCommand: "",
+		},
+		"command rejected": {
+			rawCommand: "service=nginx id",
+		},
+		"sftp rejected": {
+			rawCommand: "",
+			sftp:       true,
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			log := slog.New(slog.NewJSONHandler(os.Stderr, nil))
+			// set up mocks
+			ctrl := gomock.NewController(tt)
+			k8sService := NewMockK8SAPIService(ctrl)
+			sshSession := NewMockSession(ctrl)
+			sshContext := NewMockContext(ctrl)
+			auditSink := &recordingSink{}
+			// configure callback
+			callback := sshserver.SessionHandler(log,
+				sshserver.NewMetrics(prometheus.NewRegistry()),
+				sshserver.SessionConfig{
+					K8S:              k8sService,
+					LogAccessEnabled: true,
+					DefaultShell:     "sh",
+					AuditSink:        auditSink,
+				}, tc.sftp)
+			// configure mocks
+			sshSession.EXPECT().Context().Return(sshContext)
+			sshContext.EXPECT().SessionID().Return("test_session_id").AnyTimes()
+			emulateContextValues(sshContext)
+			emulateLiveContext(sshContext)
+			sshSession.EXPECT().RawCommand().Return(tc.rawCommand).Times(2)
+			// emulate ssh.Session.Command()
+			command, _ := shlex.Split(tc.rawCommand, true)
+			sshSession.EXPECT().Command().Return(command).Times(2)
+			sshSession.EXPECT().Subsystem().Return("")
+			sshSession.EXPECT().User().Return(user).AnyTimes()
+			// emulate the auth handler and marshal the details
+			sshPermissions := ssh.Permissions{Permissions: &gossh.Permissions{}}
+			sshContext.EXPECT().Permissions().Return(&sshPermissions).AnyTimes()
+			sshserver.PermissionsMarshal(sshContext, 1, 2, "foo", "bar", "",
+				testFingerprint, rbac.LogsOnly, "")
+			sshSession.EXPECT().Environ().Return(nil).AnyTimes()
+			if tc.expectLogs {
+				k8sService.EXPECT().FindDeployment(sshContext, user, deployment).
+					Return(deployment, allowedAccess, nil)
+				k8sService.EXPECT().Logs(
+					gomock.Any(), // private childCtx
+					user,
+					deployment,
+					"",
+					false,
+					int64(10),
+					k8s.LogFormatText,
+					gomock.Nil(),
+					true,
+					false,
+					sshSession,
+				).Return(nil)
+			} else {
+				var stderr bytes.Buffer
+				sshSession.EXPECT().Stderr().Return(&stderr)
+				sshSession.EXPECT().Exit(252).Return(nil)
+				defer func() {
+					assert.Contains(tt, stderr.String(), "only permits logs access", name)
+				}()
+			}
+			// execute callback
+			callback(sshSession)
+			// check the audit events
+			if tc.expectLogs {
+				assert.Equal(tt, []audit.EventType{
+					audit.SessionStart,
+					audit.SessionEnd,
+				}, auditSink.eventTypes(), name)
+				return
+			}
+			assert.Equal(tt, []audit.EventType{audit.AuthDenied},
+				auditSink.eventTypes(), name)
+			assert.Equal(tt, "logs-only capability", auditSink.events[0].Reason, name)
+		})
+	}
+}
+
+func TestSessionCapability(t *testing.T) {
+	var (
+		user       = "project-test"
+		deployment = "nginx"
+	)
+	// the command requesting each kind of session
+	rawCommands := map[rbac.SessionKind]string{
+		rbac.SessionExec: "service=nginx id",
+		rbac.SessionLogs: "service=nginx logs=tailLines=10",
+		rbac.SessionSFTP: "",
+	}
+	// the session kinds permitted by each capability
+	permitted := map[rbac.Capability][]rbac.SessionKind{
+		rbac.FullAccess: {rbac.SessionExec, rbac.SessionLogs, rbac.SessionSFTP},
+		rbac.LogsOnly:   {rbac.SessionLogs},
+		rbac.ExecOnly:   {rbac.SessionExec, rbac.SessionSFTP},
+	}
+	type testCase struct {
+		kind          rbac.SessionKind
+		capability    rbac.Capability
+		logsEnabled   bool
+		execDisabled  bool
+		sftpDisabled  bool
+		expectExit    int
+		expectStderr  string
+		expectReason  string
+		expectAllowed bool
+	}
+	// test every combination of global flags, capability, and session kind
+	testCases := map[string]testCase{}
+	for kind := range rawCommands {
+		for capability, kinds := range permitted {
+			for flags := range 8 {
+				tc := testCase{
+					kind:         kind,
+					capability:   capability,
+					logsEnabled:  flags&1 != 0,
+					execDisabled: flags&2 != 0,
+					sftpDisabled: flags&4 != 0,
+				}
+				switch {
+				case kind == rbac.SessionExec && tc.execDisabled,
+					kind == rbac.SessionSFTP && tc.sftpDisabled:
+					tc.expectExit = 251
+					tc.expectStderr = string(kind) + " access is disabled"
+					tc.expectReason = string(kind) + " disabled"
+				case !slices.Contains(kinds, kind):
+					tc.expectExit = 252
+					tc.expectStderr = "not " + string(kind) + " access"
+					if capability != rbac.LogsOnly {
+						tc.expectStderr = "doesn't permit " + string(kind) +
+							" access"
+					}
+					tc.expectReason = capability.String() + " capability"
+				case kind == rbac.SessionLogs && !tc.logsEnabled:
+					tc.expectExit = 253
+					tc.expectStderr = "error executing command"
+				default:
+					tc.expectAllowed = true
+				}
+				testCases[fmt.Sprintf("%s %s logs=%v exec=%v sftp=%v", kind,
+					capability, tc.logsEnabled, !tc.execDisabled,
+					!tc.sftpDisabled)] = tc
+			}
+		}
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			log := slog.New(slog.NewJSONHandler(io.Discard, nil))
+			sftp := tc.kind == rbac.SessionSFTP
+			// set up mocks
+			ctrl := gomock.NewController(tt)
+			k8sService := NewMockK8SAPIService(ctrl)
+			sshSession := NewMockSession(ctrl)
+			sshContext := NewMockContext(ctrl)
+			auditSink := &recordingSink{}
+			// configure callback
+			callback := sshserver.SessionHandler(log,
+				sshserver.NewMetrics(prometheus.NewRegistry()),
+				sshserver.SessionConfig{
+					K8S:              k8sService,
+					LogAccessEnabled: tc.logsEnabled,
+					DefaultShell:     "sh",
+					AuditSink:        auditSink,
+					DisableExec:      tc.execDisabled,
+					DisableSFTP:      tc.sftpDisabled,
+				}, sftp)
+			// configure mocks
+			sshSession.EXPECT().Context().Return(sshContext).AnyTimes()
+			sshContext.EXPECT().SessionID().Return("test_session_id").AnyTimes()
+			emulateContextValues(sshContext)
+			emulateLiveContext(sshContext)
+			rawCommand := rawCommands[tc.kind]
+			sshSession.EXPECT().RawCommand().Return(rawCommand).AnyTimes()
+			command, _ := shlex.Split(rawCommand, true)
+			sshSession.EXPECT().Command().Return(command).AnyTimes()
+			sshSession.EXPECT().Subsystem().Return("").AnyTimes()
+			sshSession.EXPECT().User().Return(user).AnyTimes()
+			sshPermissions := ssh.Permissions{Permissions: &gossh.Permissions{}}
+			sshContext.EXPECT().Permissions().Return(&sshPermissions).AnyTimes()
+			sshserver.PermissionsMarshal(sshContext, 1, 2, "foo", "bar", "",
+				testFingerprint, tc.capability, "")
+			sshSession.EXPECT().Environ().Return(nil).AnyTimes()
+			var stderr bytes.Buffer
+			sshSession.EXPECT().Stderr().Return(&stderr).AnyTimes()
+			switch {
+			case tc.kind == rbac.SessionLogs &&
+				(tc.expectAllowed || tc.expectExit == 253):
+				// logs access is checked once the deployment is found
+				k8sService.EXPECT().
+					FindDeployment(sshContext, user, deployment).
+					Return(deployment, allowedAccess, nil)
+				if tc.expectAllowed {
+					k8sService.EXPECT().Logs(gomock.Any(), user, deployment, "",
+						false, int64(10), k8s.LogFormatText, gomock.Nil(), true,
+						false, sshSession).Return(nil)
+				}
+			case tc.expectAllowed:
+				// end allowed exec and sftp sessions before they start
+				k8sService.EXPECT().
+					FindDeployment(sshContext, user, gomock.Any()).
+					Return("", k8s.DeploymentAccess{},
+						k8s.ErrDeploymentNotFound)
+				k8sService.EXPECT().ListServices(sshContext, user).
+					Return(nil, nil)
+			}
+			if tc.expectExit != 0 {
+				sshSession.EXPECT().Exit(tc.expectExit).Return(nil)
+			}
+			// execute callback
+			callback(sshSession)
+			assert.Contains(tt, stderr.String(), tc.expectStderr, name)
+			if tc.expectReason != "" {
+				assert.Equal(tt, []audit.EventType{audit.AuthDenied},
+					auditSink.eventTypes(), name)
+				assert.Equal(tt, tc.expectReason, auditSink.events[0].Reason,
+					name)
+			}
+		})
+	}
+}
+
+func TestJobLogs(t *testing.T) {
+	user := "project-test"
+	var testCases = map[string]struct {
+		rawCommand   string
+		sftp         bool
+		expectLogs   bool
+		container    string
+		follow       bool
+		filter       string
+		expectStderr string
+	}{
+		"cronjob logs": {
+			rawCommand: "job=cron-drush-cron logs=tailLines=10",
+			expectLogs: true,
+		},
+		"job container logs": {
+			rawCommand: "job=migrate container=cli logs=follow,tailLines=10",
+			expectLogs: true,
+			container:  "cli",
+			follow:     true,
+		},
+		"job without logs": {
+			rawCommand:   "job=migrate drush status",
+			expectStderr: "job argument requires a logs argument",
+		},
+		"job and service": {
+			rawCommand:   "service=cli job=migrate logs=tailLines=10",
+			expectStderr: "job and service arguments can't be combined",
+		},
+		"job sftp": {
+			rawCommand:   "job=migrate logs=tailLines=10",
+			sftp:         true,
+			expectStderr: "job argument requires a logs argument",
+		},
+		"invalid job name": {
+			rawCommand:   "job=-migrate logs=tailLines=10",
+			expectStderr: "invalid job name",
+		},
+		"filtered logs": {
+			rawCommand: "job=migrate logs=follow,tailLines=10 'error|warn'",
+			expectLogs: true,
+			follow:     true,
+			filter:     "error|warn",
+		},
+		"unquoted filter": {
+			rawCommand:   "job=migrate logs=follow grep error",
+			expectStderr: "quote the filter expression as a single argument",
+		},
+		"invalid filter": {
+			rawCommand:   "job=migrate logs=follow 'error('",
+			expectStderr: "invalid logs filter expression",
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			log := slog.New(slog.NewJSONHandler(os.Stderr, nil))
+			// set up mocks
+			ctrl := gomock.NewController(tt)
+			k8sService := NewMockK8SAPIService(ctrl)
+			sshSession := NewMockSession(ctrl)
+			sshContext := NewMockContext(ctrl)
+			auditSink := &recordingSink{}
+			// configure callback
+			callback := sshserver.SessionHandler(log,
+				sshserver.NewMetrics(prometheus.NewRegistry()),
+				sshserver.SessionConfig{
+					K8S:              k8sService,
+					LogAccessEnabled: true,
+					DefaultShell:     "sh",
+					AuditSink:        auditSink,
+				}, tc.sftp)
+			// configure mocks
+			sshSession.EXPECT().Context().Return(sshContext)
+			sshContext.EXPECT().SessionID().Return("test_session_id").AnyTimes()
+			emulateContextValues(sshContext)
+			emulateLiveContext(sshContext)
+			sshSession.EXPECT().RawCommand().Return(tc.rawCommand).Times(2)
+			// emulate ssh.Session.Command()
+			command, _ := shlex.Split(tc.rawCommand, true)
+			sshSession.EXPECT().Command().Return(command).Times(2)
+			sshSession.EXPECT().Subsystem().Return("")
+			sshSession.EXPECT().User().Return(user).AnyTimes()
+			// emulate the auth handler and marshal the details
+			sshPermissions := ssh.Permissions{Permissions: &gossh.Permissions{}}
+			sshContext.EXPECT().Permissions().Return(&sshPermissions).AnyTimes()
+			sshserver.PermissionsMarshal(sshContext, 1, 2, "foo", "bar", "",
+				testFingerprint, rbac.FullAccess, "")
+			sshSession.EXPECT().Environ().Return(nil).AnyTimes()
+			var stderr bytes.Buffer
+			if tc.expectLogs {
+				k8sService.EXPECT().JobLogs(
+					gomock.Any(), // private childCtx
+					user,
+					command[0][len("job="):],
+					tc.container,
+					tc.follow,
+					int64(10),
+					k8s.LogFormatText,
+					gomock.Cond(func(filter *regexp.Regexp) bool {
+						if tc.filter == "" {
+							return filter == nil
+						}
+						return filter != nil && filter.String() == tc.filter
+					}),
+					true,
+					false,
+					sshSession,
+				).Return(nil)
+			} else {
+				sshSession.EXPECT().Stderr().Return(&stderr)
+				sshSession.EXPECT().Exit(253).Return(nil)
+			}
+			// execute callback
+			callback(sshSession)
+			// check the result
+			if tc.expectLogs {
+				assert.Equal(tt, []audit.EventType{
+					audit.SessionStart,
+					audit.SessionEnd,
+				}, auditSink.eventTypes(), name)
+				assert.Equal(tt, command[0][len("job="):], auditSink.events[0].Job,
+					name)
+				assert.Equal(tt, "", auditSink.events[0].Deployment, name)
+				return
+			}
+			assert.Contains(tt, stderr.String(), tc.expectStderr, name)
+			assert.Equal(tt, 0, len(auditSink.events), name)
+		})
+	}
+}
+
+func TestDebugSession(t *testing.T) {
+	var (
+		user       = "project-test"
+		deployment = "nginx"
+	)
+	// the environment exported before each command
+	env := "export LAGOON_SSH_PROJECT='bar' LAGOON_SSH_ENVIRONMENT='foo' " +
+		"LAGOON_SSH_SESSION_ID='test_session_id' " +
+		"LAGOON_SSH_USER_FINGERPRINT='" + testFingerprint +
+		"'; readonly LAGOON_SSH_PROJECT LAGOON_SSH_ENVIRONMENT " +
+		"LAGOON_SSH_SESSION_ID LAGOON_SSH_USER_FINGERPRINT; "
+	var testCases = map[string]struct {
+		rawCommand   string
+		debugEnabled bool
+		debugErr     error
+		expectDebug  bool
+		expectExec   bool
+		expectExit   int
+		expectStderr string
+		expectAudit  []audit.EventType
+	}{
+		"debug shell": {
+			rawCommand:   "service=nginx container=php debug",
+			debugEnabled: true,
+			expectDebug:  true,
+			expectAudit:  []audit.EventType{audit.SessionStart, audit.SessionEnd},
+		},
+		"ephemeral containers unsupported": {
+			rawCommand:   "service=nginx container=php debug",
+			debugEnabled: true,
+			debugErr:     k8s.ErrEphemeralContainersUnsupported,
+			expectDebug:  true,
+			expectExit:   254,
+			expectStderr: "debug sessions are not supported by this cluster",
+			expectAudit:  []audit.EventType{audit.SessionStart, audit.SessionEnd},
+		},
+		"debug disabled runs a debug command": {
+			rawCommand:  "service=nginx container=php debug",
+			expectExec:  true,
+			expectAudit: []audit.EventType{audit.SessionStart, audit.SessionEnd},
+		},
+		"debug command": {
+			rawCommand:   "service=nginx debug ps aux",
+			debugEnabled: true,
+			expectExit:   252,
+			expectStderr: "debug sessions only support an interactive shell",
+			expectAudit:  []audit.EventType{audit.AuthDenied},
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			log := slog.New(slog.NewJSONHandler(os.Stderr, nil))
+			// set up mocks
+			ctrl := gomock.NewController(tt)
+			k8sService := NewMockK8SAPIService(ctrl)
+			sshSession := NewMockSession(ctrl)
+			sshContext := NewMockContext(ctrl)
+			auditSink := &recordingSink{}
+			// configure callback
+			callback := sshserver.SessionHandler(log,
+				sshserver.NewMetrics(prometheus.NewRegistry()),
+				sshserver.SessionConfig{
+					K8S:          k8sService,
+					DebugEnabled: tc.debugEnabled,
+					DefaultShell: "sh",
+					AuditSink:    auditSink,
+				}, false)
+			// configure mocks
+			sshSession.EXPECT().Context().Return(sshContext)
+			sshContext.EXPECT().SessionID().Return("test_session_id").AnyTimes()
+			emulateContextValues(sshContext)
+			emulateLiveContext(sshContext)
+			sshSession.EXPECT().RawCommand().Return(tc.rawCommand).Times(2)
+			// emulate ssh.Session.Command()
+			command, _ := shlex.Split(tc.rawCommand, true)
+			sshSession.EXPECT().Command().Return(command).Times(2)
+			sshSession.EXPECT().Subsystem().Return("")
+			sshSession.EXPECT().User().Return(user).AnyTimes()
+			// emulate the auth handler and marshal the details. The namespace
+			// shell is not used in debug containers.
+			sshPermissions := ssh.Permissions{Permissions: &gossh.Permissions{}}
+			sshContext.EXPECT().Permissions().Return(&sshPermissions).AnyTimes()
+			sshserver.PermissionsMarshal(sshContext, 1, 2, "foo", "bar", "",
+				testFingerprint, rbac.FullAccess, "bash")
+			sshSession.EXPECT().Environ().Return(nil).AnyTimes()
+			var stderr bytes.Buffer
+			sshSession.EXPECT().Stderr().Return(&stderr).AnyTimes()
+			winch := make(<-chan ssh.Window)
+			if tc.expectDebug || tc.expectExec {
+				k8sService.EXPECT().FindDeployment(sshContext, user, deployment).
+					Return(deployment, allowedAccess, nil)
+				sshSession.EXPECT().Pty().Return(ssh.Pty{}, winch, true)
+			}
+			if tc.expectExec {
+				k8sService.EXPECT().Exec(sshContext, user, deployment, "php",
+					[]string{"bash", "-c", env + "debug"}, sshSession, &stderr,
+					true, winch).Return(nil)
+			}
+			if tc.expectDebug {
+				k8sService.EXPECT().Debug(
+					sshContext,
+					user,
+					deployment,
+					"php",
+					[]string{"sh", "-c", env + "exec 'sh'"},
+					sshSession,
+					&stderr,
+					true,
+					winch,
+				).Return(tc.debugErr)
+			}
+			if tc.expectExit != 0 {
+				sshSession.EXPECT().Exit(tc.expectExit).Return(nil)
+			}
+			// execute callback
+			callback(sshSession)
+			// check the result
+			assert.Contains(tt, stderr.String(), tc.expectStderr, name)
+			assert.Equal(tt, tc.expectAudit, auditSink.eventTypes(), name)
+			assert.Equal(tt, !tc.expectExec, auditSink.events[0].Debug, name)
+		})
+	}
+}
+
+func TestDeploymentAccessAnnotations(t *testing.T) {
+	var (
+		user       = "project-test"
+		deployment = "payments"
+	)
+	var testCases = map[string]struct {
+		rawCommand   string
+		sftp         bool
+		access       k8s.DeploymentAccess
+		expectStderr string
+		expectReason string
+	}{
+		"shell disabled": {
+			rawCommand:   "service=payments",
+			access:       k8s.DeploymentAccess{Exec: false, Logs: true},
+			expectStderr: "shell access to service payments is disabled.",
+			expectReason: "shell access disabled for deployment",
+		},
+		"command disabled": {
+			rawCommand:   "service=payments id",
+			access:       k8s.DeploymentAccess{Exec: false, Logs: true},
+			expectStderr: "shell access to service payments is disabled.",
+			expectReason: "shell access disabled for deployment",
+		},
+		"sftp disabled": {
+			rawCommand:   "service=payments",
+			sftp:         true,
+			access:       k8s.DeploymentAccess{Exec: false, Logs: true},
+			expectStderr: "shell access to service payments is disabled.",
+			expectReason: "shell access disabled for deployment",
+		},
+		"logs disabled": {
+			rawCommand:   "service=payments logs=tailLines=10",
+			access:       k8s.DeploymentAccess{Exec: true, Logs: false},
+			expectStderr: "logs access to service payments is disabled.",
+			expectReason: "logs access disabled for deployment",
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			log := slog.New(slog.NewJSONHandler(os.Stderr, nil))
+			// set up mocks
+			ctrl := gomock.NewController(tt)
+			k8sService := &sshservertest.FakeK8S{
+				Deployments: map[string]map[string]sshservertest.Deployment{
+					user: {deployment: {Name: deployment, Access: tc.access}},
+				},
+			}
+			sshSession := NewMockSession(ctrl)
+			sshContext := NewMockContext(ctrl)
+			auditSink := &recordingSink{}
+			// configure callback
+			callback := sshserver.SessionHandler(log,
+				sshserver.NewMetrics(prometheus.NewRegistry()),
+				sshserver.SessionConfig{
+					K8S:              k8sService,
+					LogAccessEnabled: true,
+					DefaultShell:     "sh",
+					AuditSink:        auditSink,
+				}, tc.sftp)
+			// configure mocks
+			sshSession.EXPECT().Context().Return(sshContext)
+			sshContext.EXPECT().SessionID().Return("test_session_id").AnyTimes()
+			emulateContextValues(sshContext)
+			emulateLiveContext(sshContext)
+			sshSession.EXPECT().RawCommand().Return(tc.rawCommand).Times(2)
+			// emulate ssh.Session.Command()
+			command, _ := shlex.Split(tc.rawCommand, true)
+			sshSession.EXPECT().Command().Return(command).Times(2)
+			sshSession.EXPECT().Subsystem().Return("")
+			sshSession.EXPECT().User().Return(user).AnyTimes()
+			// emulate the auth handler and marshal the details
+			sshPermissions := ssh.Permissions{Permissions: &gossh.Permissions{}}
+			sshContext.EXPECT().Permissions().Return(&sshPermissions).AnyTimes()
+			sshserver.PermissionsMarshal(sshContext, 1, 2, "foo", "bar", "",
+				testFingerprint, rbac.FullAccess, "")
+			sshSession.EXPECT().Environ().Return(nil).AnyTimes()
+			var stderr bytes.Buffer
+			sshSession.EXPECT().Stderr().Return(&stderr)
+			sshSession.EXPECT().Exit(252).Return(nil)
+			// execute callback
+			callback(sshSession)
+			assert.Contains(tt, stderr.String(), tc.expectStderr, name)
+			assert.Equal(tt, []audit.EventType{audit.AuthDenied},
+				auditSink.eventTypes(), name)
+			assert.Equal(tt, tc.expectReason, auditSink.events[0].Reason, name)
+			assert.Equal(tt, deployment, auditSink.events[0].Deployment, name)
+		})
+	}
+}
+
+func TestFindDeploymentError(t *testing.T) {
+	nginx := map[string]sshservertest.Deployment{
+		"nginx": {Name: "nginx", Access: allowedAccess},
+	}
+	var testCases = map[string]struct {
+		command      []string
+		deployments  map[string]sshservertest.Deployment
+		errors       map[string]error
+		expectStderr string
+		expectExit   bool
+	}{
+		"unknown service": {
+			command:      []string{"id"},
+			deployments:  nginx,
+			expectStderr: "unknown service cli. SID: test_session_id\r\n",
+		},
+		"suggested service": {
+			command:     []string{"service=ngnix", "id"},
+			deployments: nginx,
+			expectStderr: "unknown service ngnix. did you mean 'nginx'? " +
+				"SID: test_session_id\r\n",
+		},
+		"list services error": {
+			command:     []string{"service=ngnix", "id"},
+			deployments: nginx,
+			errors: map[string]error{
+				sshservertest.MethodListServices: errors.New("timed out"),
+			},
+			expectStderr: "unknown service ngnix. SID: test_session_id\r\n",
+		},
+		"api error": {
+			command: []string{"id"},
+			errors: map[string]error{
+				sshservertest.MethodFindDeployment: errors.New(
+					"couldn't list deployments: etcdserver: request timed out"),
+			},
+			expectStderr: "temporary error talking to the cluster, please " +
+				"retry. SID: test_session_id\r\n",
+			expectExit: true,
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			var buf bytes.Buffer
+			log := slog.New(slog.NewJSONHandler(&buf, nil))
+			// set up mocks
+			ctrl := gomock.NewController(tt)
+			k8sService := &sshservertest.FakeK8S{
+				Deployments: map[string]map[string]sshservertest.Deployment{
+					"project-test": tc.deployments,
+				},
+				Errors: tc.errors,
+			}
+			sshSession := NewMockSession(ctrl)
+			sshContext := NewMockContext(ctrl)
+			// configure callback
+			callback := sshserver.SessionHandler(log,
+				sshserver.NewMetrics(prometheus.NewRegistry()),
+				sshserver.SessionConfig{
+					K8S:          k8sService,
+					DefaultShell: "sh",
+					AuditSink:    &recordingSink{},
+				}, false)
+			// configure mocks
+			sshSession.EXPECT().Context().Return(sshContext).AnyTimes()
+			sshContext.EXPECT().SessionID().Return("test_session_id").AnyTimes()
+			emulateContextValues(sshContext)
+			emulateLiveContext(sshContext)
+			sshSession.EXPECT().RawCommand().
+				Return(strings.Join(tc.command, " ")).AnyTimes()
+			sshSession.EXPECT().Command().Return(tc.command).AnyTimes()
+			sshSession.EXPECT().Subsystem().Return("").AnyTimes()
+			sshSession.EXPECT().User().Return("project-test").AnyTimes()
+			sshPermissions := ssh.Permissions{Permissions: &gossh.Permissions{}}
+			sshContext.EXPECT().Permissions().Return(&sshPermissions).AnyTimes()
+			sshserver.PermissionsMarshal(sshContext, 1, 2, "foo", "bar", "",
+				testFingerprint, rbac.FullAccess, "")
+			sshSession.EXPECT().Environ().Return(nil).AnyTimes()
+			var stderr bytes.Buffer
+			sshSession.EXPECT().Stderr().Return(&stderr)
+			if tc.expectExit {
+				sshSession.EXPECT().Exit(254).Return(nil)
+			}
+			// execute callback
+			callback(sshSession)
+			assert.Equal(tt, tc.expectStderr, stderr.String(), name)
+			if tc.expectExit {
+				assert.Contains(tt, buf.String(), `"level":"WARN"`, name)
+			}
+		})
+	}
+}
+
+func TestReauthPerSession(t *testing.T) {
+	var testCases = map[string]struct {
+		response     bus.SSHAccessResponse
+		queryErr     error
+		expectStderr string
+		expectExit   int
+		expectReason string
+		expectDenied float64
+	}{
+		"still allowed": {
+			response: bus.SSHAccessResponse{
+				Allowed:    true,
+				Capability: rbac.FullAccess,
+			},
+			expectStderr: "unknown service cli. SID: test_session_id\r\n",
+		},
+		"revoked mid-connection": {
+			response: bus.SSHAccessResponse{
+				Reason: rbac.ReasonUserNotInKeycloak,
+			},
+			expectStderr: "access denied. SID: test_session_id\r\n",
+			expectExit:   252,
+			expectReason: "access revoked",
+			expectDenied: 1,
+		},
+		"downgraded to logs-only": {
+			response: bus.SSHAccessResponse{
+				Allowed:    true,
+				Capability: rbac.LogsOnly,
+			},
+			expectStderr: "this key only permits logs access, " +
+				"not exec access (e.g. service=nginx logs=tailLines=100). " +
+				"SID: test_session_id\r\n",
+			expectExit:   252,
+			expectReason: "logs-only capability",
+		},
+		"query error": {
+			queryErr: errors.New("nats: timeout"),
+			expectStderr: "temporary error checking access, please retry. " +
+				"SID: test_session_id\r\n",
+			expectExit:   254,
+			expectReason: "permission query failed",
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			log := slog.New(slog.NewJSONHandler(os.Stderr, nil))
+			// set up mocks
+			ctrl := gomock.NewController(tt)
+			k8sService := NewMockK8SAPIService(ctrl)
+			natsService := NewMockNATSService(ctrl)
+			sshSession := NewMockSession(ctrl)
+			sshContext := NewMockContext(ctrl)
+			auditSink := &recordingSink{}
+			metrics := sshserver.NewMetrics(prometheus.NewRegistry())
+			// configure callback
+			callback := sshserver.SessionHandler(log, metrics,
+				sshserver.SessionConfig{
+					K8S:          k8sService,
+					DefaultShell: "sh",
+					AuditSink:    auditSink,
+					Reauth:       natsService,
+				}, false)
+			// configure mocks
+			sshSession.EXPECT().Context().Return(sshContext).AnyTimes()
+			sshContext.EXPECT().SessionID().Return("test_session_id").AnyTimes()
+			emulateContextValues(sshContext)
+			emulateLiveContext(sshContext)
+			sshSession.EXPECT().RawCommand().Return("id").AnyTimes()
+			sshSession.EXPECT().Command().Return([]string{"id"}).AnyTimes()
+			sshSession.EXPECT().Subsystem().Return("").AnyTimes()
+			sshSession.EXPECT().User().Return("project-test").AnyTimes()
+			// emulate the auth handler granting full access when the connection
+			// was established
+			sshPermissions := ssh.Permissions{Permissions: &gossh.Permissions{}}
+			sshContext.EXPECT().Permissions().Return(&sshPermissions).AnyTimes()
+			sshserver.PermissionsMarshal(sshContext, 1, 2, "foo", "bar", "",
+				testFingerprint, rbac.FullAccess, "")
+			sshSession.EXPECT().Environ().Return(nil).AnyTimes()
+			var stderr bytes.Buffer
+			sshSession.EXPECT().Stderr().Return(&stderr)
+			// access is checked again using the stored fingerprint
+			natsService.EXPECT().KeyCanAccessEnvironment("test_session_id",
+				testFingerprint, "project-test", 2, 1).
+				Return(tc.response, tc.queryErr)
+			if tc.expectExit == 0 {
+				k8sService.EXPECT().FindDeployment(sshContext, "project-test", "cli").
+					Return("", k8s.DeploymentAccess{}, k8s.ErrDeploymentNotFound)
+				k8sService.EXPECT().ListServices(sshContext, "project-test").
+					Return(nil, nil)
+			} else {
+				sshSession.EXPECT().Exit(tc.expectExit).Return(nil)
+			}
+			// execute callback
+			callback(sshSession)
+			assert.Equal(tt, tc.expectStderr, stderr.String(), name)
+			if tc.expectReason != "" {
+				assert.Equal(tt, []audit.EventType{audit.AuthDenied},
+					auditSink.eventTypes(), name)
+				assert.Equal(tt, tc.expectReason, auditSink.events[0].Reason, name)
+			}
+			assert.Equal(tt, tc.expectDenied,
+				testutil.ToFloat64(metrics.ReauthDeniedTotal()), name)
+		})
+	}
+}
+
+func TestDisabledSessionKinds(t *testing.T) {
+	var testCases = map[string]struct {
+		sftp             bool
+		rawCommand       string
+		execDisabled     bool
+		sftpDisabled     bool
+		logAccessEnabled bool
+		expectStderr     string
+		expectExit       int
+		expectKind       string
+		expectLogs       bool
+	}{
+		"exec disabled shell": {
+			execDisabled: true,
+			expectStderr: "exec access is disabled on this SSH portal. " +
+				"SID: test_session_id\r\n",
+			expectExit: 251,
+			expectKind: "exec",
+		},
+		"exec disabled command": {
+			rawCommand:   "service=nginx id",
+			execDisabled: true,
+			expectStderr: "exec access is disabled on this SSH portal. " +
+				"SID: test_session_id\r\n",
+			expectExit: 251,
+			expectKind: "exec",
+		},
+		"exec disabled debug": {
+			rawCommand:   "service=nginx debug=true",
+			execDisabled: true,
+			expectStderr: "exec access is disabled on this SSH portal. " +
+				"SID: test_session_id\r\n",
+			expectExit: 251,
+			expectKind: "exec",
+		},
+		"sftp disabled": {
+			sftp:         true,
+			sftpDisabled: true,
+			expectStderr: "sftp access is disabled on this SSH portal. " +
+				"SID: test_session_id\r\n",
+			expectExit: 251,
+			expectKind: "sftp",
+		},
+		"exec disabled sftp allowed": {
+			sftp:         true,
+			execDisabled: true,
+			expectStderr: "unknown service cli. SID: test_session_id\r\n",
+		},
+		"sftp disabled exec allowed": {
+			sftpDisabled: true,
+			expectStderr: "unknown service cli. SID: test_session_id\r\n",
+		},
+		"exec and sftp disabled logs allowed": {
+			rawCommand:       "service=nginx logs=tailLines=10",
+			execDisabled:     true,
+			sftpDisabled:     true,
+			logAccessEnabled: true,
+			expectLogs:       true,
+		},
+		"exec disabled logs not enabled": {
+			rawCommand:   "service=nginx logs=tailLines=10",
+			execDisabled: true,
+			expectStderr: "error executing command. SID: test_session_id\r\n",
+			expectExit:   253,
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			log := slog.New(slog.NewJSONHandler(os.Stderr, nil))
+			// set up mocks
+			ctrl := gomock.NewController(tt)
+			k8sService := NewMockK8SAPIService(ctrl)
+			sshSession := NewMockSession(ctrl)
+			sshContext := NewMockContext(ctrl)
+			auditSink := &recordingSink{}
+			metrics := sshserver.NewMetrics(prometheus.NewRegistry())
+			// configure callback
+			callback := sshserver.SessionHandler(log, metrics,
+				sshserver.SessionConfig{
+					K8S:              k8sService,
+					LogAccessEnabled: tc.logAccessEnabled,
+					DebugEnabled:     true,
+					DefaultShell:     "sh",
+					AuditSink:        auditSink,
+					DisableExec:      tc.execDisabled,
+					DisableSFTP:      tc.sftpDisabled,
+				}, tc.sftp)
+			// configure mocks
+			sshSession.EXPECT().Context().Return(sshContext).AnyTimes()
+			sshContext.EXPECT().SessionID().Return("test_session_id").AnyTimes()
+			emulateContextValues(sshContext)
+			emulateLiveContext(sshContext)
+			sshSession.EXPECT().RawCommand().Return(tc.rawCommand).AnyTimes()
+			command, _ := shlex.Split(tc.rawCommand, true)
+			sshSession.EXPECT().Command().Return(command).AnyTimes()
+			sshSession.EXPECT().Subsystem().Return("").AnyTimes()
+			sshSession.EXPECT().User().Return("project-test").AnyTimes()
+			// emulate the auth handler granting full access
+			sshPermissions := ssh.Permissions{Permissions: &gossh.Permissions{}}
+			sshContext.EXPECT().Permissions().Return(&sshPermissions).AnyTimes()
+			sshserver.PermissionsMarshal(sshContext, 1, 2, "foo", "bar", "",
+				testFingerprint, rbac.FullAccess, "")
+			sshSession.EXPECT().Environ().Return(nil).AnyTimes()
+			var stderr bytes.Buffer
+			sshSession.EXPECT().Stderr().Return(&stderr).AnyTimes()
+			switch {
+			case tc.expectKind != "":
+			case tc.expectLogs || tc.expectExit == 253:
+				k8sService.EXPECT().FindDeployment(sshContext, "project-test",
+					"nginx").Return("nginx", allowedAccess, nil)
+			default:
+				k8sService.EXPECT().FindDeployment(sshContext, "project-test",
+					"cli").Return("", k8s.DeploymentAccess{},
+					k8s.ErrDeploymentNotFound)
+				k8sService.EXPECT().ListServices(sshContext, "project-test").
+					Return(nil, nil)
+			}
+			if tc.expectLogs {
+				k8sService.EXPECT().Logs(gomock.Any(), "project-test", "nginx",
+					"", false, int64(10), k8s.LogFormatText, gomock.Nil(),
+					true, false, sshSession).Return(nil)
+			}
+			if tc.expectExit != 0 {
+				sshSession.EXPECT().Exit(tc.expectExit).Return(nil)
+			}
+			// execute callback
+			callback(sshSession)
+			assert.Equal(tt, tc.expectStderr, stderr.String(), name)
+			disabledTotal := metrics.SessionsDisabledTotal()
+			for _, kind := range []string{"exec", "sftp"} {
+				var expect float64
+				if kind == tc.expectKind {
+					expect = 1
+				}
+				assert.Equal(tt, expect, testutil.ToFloat64(
+					disabledTotal.WithLabelValues(kind)), name)
+			}
+			if tc.expectKind != "" {
+				assert.Equal(tt, []audit.EventType{audit.AuthDenied},
+					auditSink.eventTypes(), name)
+				assert.Equal(tt, tc.expectKind+" disabled",
+					auditSink.events[0].Reason, name)
+			}
+		})
+	}
+}
+
+func TestDeletedEnvironment(t *testing.T) {
+	var testCases = map[string]struct {
+		sftp bool
+	}{
+		"shell": {},
+		"sftp":  {sftp: true},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			log := slog.New(slog.NewJSONHandler(os.Stderr, nil))
+			// set up mocks
+			ctrl := gomock.NewController(tt)
+			k8sService := NewMockK8SAPIService(ctrl)
+			sshSession := NewMockSession(ctrl)
+			sshContext := NewMockContext(ctrl)
+			auditSink := &recordingSink{}
+			// configure callback
+			callback := sshserver.SessionHandler(log,
+				sshserver.NewMetrics(prometheus.NewRegistry()),
+				sshserver.SessionConfig{
+					K8S:              k8sService,
+					LogAccessEnabled: true,
+					DebugEnabled:     true,
+					DefaultShell:     "sh",
+					AuditSink:        auditSink,
+				}, tc.sftp)
+			// configure mocks
+			sshSession.EXPECT().Context().Return(sshContext).AnyTimes()
+			sshContext.EXPECT().SessionID().Return("test_session_id").AnyTimes()
+			emulateContextValues(sshContext)
+			emulateLiveContext(sshContext)
+			// emulate the auth handler accepting a key for a deleted
+			// environment
+			sshPermissions := ssh.Permissions{Permissions: &gossh.Permissions{}}
+			sshContext.EXPECT().Permissions().Return(&sshPermissions).AnyTimes()
+			sshserver.DeletedMarshal(sshContext, testFingerprint)
+			var stderr bytes.Buffer
+			sshSession.EXPECT().Stderr().Return(&stderr).AnyTimes()
+			sshSession.EXPECT().Exit(252).Return(nil)
+			// execute callback
+			callback(sshSession)
+			assert.Equal(tt, "this environment has been deleted or is being "+
+				"removed. SID: test_session_id\r\n", stderr.String(), name)
 		})
 	}
 }
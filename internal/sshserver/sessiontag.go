@@ -0,0 +1,58 @@
+package sshserver
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/gliderlabs/ssh"
+	"github.com/uselagoon/ssh-portal/internal/sessionlog"
+)
+
+// sessionTagEnv is the environment variable which clients may send to tag a
+// session with a correlation ID, for example using the OpenSSH SetEnv or
+// SendEnv options.
+const sessionTagEnv = "LAGOON_SESSION_TAG"
+
+// maxSessionTagLength is the maximum length in bytes of a session tag.
+const maxSessionTagLength = 64
+
+// sessionTagRegex matches the characters permitted in a session tag.
+var sessionTagRegex = regexp.MustCompile(`^[A-Za-z0-9._:-]+$`)
+
+// sessionTag returns the session tag in the given environment requested by
+// the client, or an empty string if none was sent. If the client sent the
+// variable more than once, the last value is used. An error is returned if
+// the tag is too long or contains characters other than ASCII letters,
+// digits, and any of ".", "_", ":", and "-".
+//
+// The session tag is only used for logging. It is never passed to the
+// command executed in the session.
+func sessionTag(environ []string) (string, error) {
+	var tag string
+	for _, kv := range environ {
+		if v, ok := strings.CutPrefix(kv, sessionTagEnv+"="); ok {
+			tag = v
+		}
+	}
+	switch {
+	case tag == "":
+		return "", nil
+	case len(tag) > maxSessionTagLength:
+		return "", fmt.Errorf("session tag longer than %d bytes",
+			maxSessionTagLength)
+	case !sessionTagRegex.MatchString(tag):
+		return "", errors.New("invalid characters in session tag")
+	}
+	return tag, nil
+}
+
+// sessionRef returns the reference to the session printed in messages to the
+// user: the session ID, followed by the session tag if there is one.
+func sessionRef(ctx ssh.Context) string {
+	if tag := sessionlog.SessionTag(ctx); tag != "" {
+		return ctx.SessionID() + " tag: " + tag
+	}
+	return ctx.SessionID()
+}
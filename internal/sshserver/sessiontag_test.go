@@ -0,0 +1,175 @@
+package sshserver_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/alecthomas/assert/v2"
+	"github.com/gliderlabs/ssh"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/uselagoon/ssh-portal/internal/audit"
+	"github.com/uselagoon/ssh-portal/internal/rbac"
+	"github.com/uselagoon/ssh-portal/internal/sshserver"
+	"go.uber.org/mock/gomock"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+func TestSessionTag(t *testing.T) {
+	var testCases = map[string]struct {
+		environ   []string
+		expect    string
+		expectErr bool
+	}{
+		"no environment": {},
+		"not sent": {
+			environ: []string{"LANG=C.UTF-8"},
+		},
+		"valid": {
+			environ: []string{"LANG=C", "LAGOON_SESSION_TAG=cli-1.2_3:abc"},
+			expect:  "cli-1.2_3:abc",
+		},
+		"last value wins": {
+			environ: []string{"LAGOON_SESSION_TAG=a", "LAGOON_SESSION_TAG=b"},
+			expect:  "b",
+		},
+		"empty": {
+			environ: []string{"LAGOON_SESSION_TAG="},
+		},
+		"maximum length": {
+			environ: []string{"LAGOON_SESSION_TAG=" + strings.Repeat("a", 64)},
+			expect:  strings.Repeat("a", 64),
+		},
+		"too long": {
+			environ: []string{
+				"LAGOON_SESSION_TAG=" + strings.Repeat("a", 65)},
+			expectErr: true,
+		},
+		"space": {
+			environ:   []string{"LAGOON_SESSION_TAG=a b"},
+			expectErr: true,
+		},
+		"shell metacharacters": {
+			environ:   []string{"LAGOON_SESSION_TAG=$(id)"},
+			expectErr: true,
+		},
+		"control characters": {
+			environ:   []string{"LAGOON_SESSION_TAG=a\x1b[2Jb"},
+			expectErr: true,
+		},
+		"prefix of another variable": {
+			environ: []string{"LAGOON_SESSION_TAGS=a"},
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			tag, err := sshserver.SessionTag(tc.environ)
+			if tc.expectErr {
+				assert.Error(tt, err, name)
+			} else {
+				assert.NoError(tt, err, name)
+			}
+			assert.Equal(tt, tc.expect, tag, name)
+		})
+	}
+}
+
+// logLine returns the first log line in buf with the given message.
+func logLine(tt *testing.T, buf *bytes.Buffer, msg string) map[string]any {
+	dec := json.NewDecoder(bytes.NewReader(buf.Bytes()))
+	for dec.More() {
+		var line map[string]any
+		if err := dec.Decode(&line); err != nil {
+			tt.Fatal(err)
+		}
+		if line[slog.MessageKey] == msg {
+			return line
+		}
+	}
+	tt.Fatalf("couldn't find log line with message %q", msg)
+	return nil
+}
+
+func TestSessionTagPropagation(t *testing.T) {
+	var testCases = map[string]struct {
+		environ       []string
+		expectTag     string
+		expectInvalid bool
+	}{
+		"tagged": {
+			environ:   []string{"LAGOON_SESSION_TAG=cli-1234"},
+			expectTag: "cli-1234",
+		},
+		"untagged": {},
+		"invalid tag": {
+			environ:       []string{"LAGOON_SESSION_TAG=cli 1234"},
+			expectInvalid: true,
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			// capture log output
+			var buf bytes.Buffer
+			log := slog.New(slog.NewJSONHandler(&buf, nil))
+			// set up mocks
+			ctrl := gomock.NewController(tt)
+			k8sService := NewMockK8SAPIService(ctrl)
+			sshSession := NewMockSession(ctrl)
+			sshContext := NewMockContext(ctrl)
+			auditSink := &recordingSink{}
+			// configure callback
+			callback := sshserver.SessionHandler(log,
+				sshserver.NewMetrics(prometheus.NewRegistry()),
+				sshserver.SessionConfig{
+					K8S:              k8sService,
+					LogAccessEnabled: true,
+					DefaultShell:     "sh",
+					AuditSink:        auditSink,
+				}, false)
+			// configure mocks for a shell session rejected by the logs-only
+			// capability of the key
+			sshSession.EXPECT().Context().Return(sshContext)
+			sshContext.EXPECT().SessionID().Return("test_session_id").AnyTimes()
+			emulateContextValues(sshContext)
+			emulateLiveContext(sshContext)
+			sshSession.EXPECT().RawCommand().Return("").AnyTimes()
+			sshSession.EXPECT().Command().Return(nil).AnyTimes()
+			sshSession.EXPECT().Subsystem().Return("")
+			sshSession.EXPECT().User().Return("project-test").AnyTimes()
+			sshPermissions := ssh.Permissions{Permissions: &gossh.Permissions{}}
+			sshContext.EXPECT().Permissions().Return(&sshPermissions).AnyTimes()
+			sshserver.PermissionsMarshal(sshContext, 1, 2, "foo", "bar", "",
+				testFingerprint, rbac.LogsOnly, "")
+			sshSession.EXPECT().Environ().Return(tc.environ)
+			var stderr bytes.Buffer
+			sshSession.EXPECT().Stderr().Return(&stderr)
+			sshSession.EXPECT().Exit(252).Return(nil)
+			// execute callback
+			callback(sshSession)
+			// check the tag is echoed alongside the SID
+			expectRef := "SID: test_session_id\r\n"
+			if tc.expectTag != "" {
+				expectRef = "SID: test_session_id tag: " + tc.expectTag + "\r\n"
+			}
+			assert.True(tt, strings.HasSuffix(stderr.String(), expectRef), name)
+			// check the tag is included in session log lines
+			line := logLine(tt, &buf,
+				"rejecting session kind not permitted by key capability")
+			if tc.expectTag != "" {
+				assert.Equal[any](tt, tc.expectTag, line["sessionTag"], name)
+			} else {
+				_, ok := line["sessionTag"]
+				assert.False(tt, ok, name)
+			}
+			if tc.expectInvalid {
+				logLine(tt, &buf, "ignoring invalid session tag")
+			}
+			// check the tag is included in audit events
+			assert.Equal(tt, []audit.EventType{audit.AuthDenied},
+				auditSink.eventTypes(), name)
+			assert.Equal(tt, tc.expectTag, auditSink.events[0].SessionTag, name)
+		})
+	}
+}
@@ -1,9 +1,9 @@
 // Code generated by MockGen. DO NOT EDIT.
-// Source: github.com/uselagoon/ssh-portal/internal/sshserver (interfaces: K8SAPIService,NATSService)
+// Source: github.com/uselagoon/ssh-portal/internal/sshserver (interfaces: K8SAPIService,NamespaceResolver,NATSService)
 //
 // Generated by this command:
 //
-//	mockgen -package=sshserver_test -destination=sshserver_mock_test.go -write_generate_directive . K8SAPIService,NATSService
+//	mockgen -package=sshserver_test -destination=sshserver_mock_test.go -write_generate_directive . K8SAPIService,NamespaceResolver,NATSService
 //
 
 // Package sshserver_test is a generated GoMock package.
@@ -13,12 +13,15 @@ import (
 	context "context"
 	io "io"
 	reflect "reflect"
+	regexp "regexp"
 
 	ssh "github.com/gliderlabs/ssh"
+	bus "github.com/uselagoon/ssh-portal/internal/bus"
+	k8s "github.com/uselagoon/ssh-portal/internal/k8s"
 	gomock "go.uber.org/mock/gomock"
 )
 
-//go:generate mockgen -package=sshserver_test -destination=sshserver_mock_test.go -write_generate_directive . K8SAPIService,NATSService
+//go:generate mockgen -package=sshserver_test -destination=sshserver_mock_test.go -write_generate_directive . K8SAPIService,NamespaceResolver,NATSService
 
 // MockK8SAPIService is a mock of K8SAPIService interface.
 type MockK8SAPIService struct {
@@ -43,6 +46,20 @@ func (m *MockK8SAPIService) EXPECT() *MockK8SAPIServiceMockRecorder {
 	return m.recorder
 }
 
+// Debug mocks base method.
+func (m *MockK8SAPIService) Debug(arg0 context.Context, arg1, arg2, arg3 string, arg4 []string, arg5 io.ReadWriter, arg6 io.Writer, arg7 bool, arg8 <-chan ssh.Window) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Debug", arg0, arg1, arg2, arg3, arg4, arg5, arg6, arg7, arg8)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Debug indicates an expected call of Debug.
+func (mr *MockK8SAPIServiceMockRecorder) Debug(arg0, arg1, arg2, arg3, arg4, arg5, arg6, arg7, arg8 any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Debug", reflect.TypeOf((*MockK8SAPIService)(nil).Debug), arg0, arg1, arg2, arg3, arg4, arg5, arg6, arg7, arg8)
+}
+
 // Exec mocks base method.
 func (m *MockK8SAPIService) Exec(arg0 context.Context, arg1, arg2, arg3 string, arg4 []string, arg5 io.ReadWriter, arg6 io.Writer, arg7 bool, arg8 <-chan ssh.Window) error {
 	m.ctrl.T.Helper()
@@ -58,12 +75,13 @@ func (mr *MockK8SAPIServiceMockRecorder) Exec(arg0, arg1, arg2, arg3, arg4, arg5
 }
 
 // FindDeployment mocks base method.
-func (m *MockK8SAPIService) FindDeployment(arg0 context.Context, arg1, arg2 string) (string, error) {
+func (m *MockK8SAPIService) FindDeployment(arg0 context.Context, arg1, arg2 string) (string, k8s.DeploymentAccess, error) {
 	m.ctrl.T.Helper()
 	ret := m.ctrl.Call(m, "FindDeployment", arg0, arg1, arg2)
 	ret0, _ := ret[0].(string)
-	ret1, _ := ret[1].(error)
-	return ret0, ret1
+	ret1, _ := ret[1].(k8s.DeploymentAccess)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
 }
 
 // FindDeployment indicates an expected call of FindDeployment.
@@ -72,36 +90,90 @@ func (mr *MockK8SAPIServiceMockRecorder) FindDeployment(arg0, arg1, arg2 any) *g
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "FindDeployment", reflect.TypeOf((*MockK8SAPIService)(nil).FindDeployment), arg0, arg1, arg2)
 }
 
+// JobLogs mocks base method.
+func (m *MockK8SAPIService) JobLogs(arg0 context.Context, arg1, arg2, arg3 string, arg4 bool, arg5 int64, arg6 k8s.LogFormat, arg7 *regexp.Regexp, arg8, arg9 bool, arg10 io.ReadWriter) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "JobLogs", arg0, arg1, arg2, arg3, arg4, arg5, arg6, arg7, arg8, arg9, arg10)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// JobLogs indicates an expected call of JobLogs.
+func (mr *MockK8SAPIServiceMockRecorder) JobLogs(arg0, arg1, arg2, arg3, arg4, arg5, arg6, arg7, arg8, arg9, arg10 any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "JobLogs", reflect.TypeOf((*MockK8SAPIService)(nil).JobLogs), arg0, arg1, arg2, arg3, arg4, arg5, arg6, arg7, arg8, arg9, arg10)
+}
+
+// ListServices mocks base method.
+func (m *MockK8SAPIService) ListServices(arg0 context.Context, arg1 string) ([]string, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ListServices", arg0, arg1)
+	ret0, _ := ret[0].([]string)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ListServices indicates an expected call of ListServices.
+func (mr *MockK8SAPIServiceMockRecorder) ListServices(arg0, arg1 any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ListServices", reflect.TypeOf((*MockK8SAPIService)(nil).ListServices), arg0, arg1)
+}
+
 // Logs mocks base method.
-func (m *MockK8SAPIService) Logs(arg0 context.Context, arg1, arg2, arg3 string, arg4 bool, arg5 int64, arg6 io.ReadWriter) error {
+func (m *MockK8SAPIService) Logs(arg0 context.Context, arg1, arg2, arg3 string, arg4 bool, arg5 int64, arg6 k8s.LogFormat, arg7 *regexp.Regexp, arg8, arg9 bool, arg10 io.ReadWriter) error {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "Logs", arg0, arg1, arg2, arg3, arg4, arg5, arg6)
+	ret := m.ctrl.Call(m, "Logs", arg0, arg1, arg2, arg3, arg4, arg5, arg6, arg7, arg8, arg9, arg10)
 	ret0, _ := ret[0].(error)
 	return ret0
 }
 
 // Logs indicates an expected call of Logs.
-func (mr *MockK8SAPIServiceMockRecorder) Logs(arg0, arg1, arg2, arg3, arg4, arg5, arg6 any) *gomock.Call {
+func (mr *MockK8SAPIServiceMockRecorder) Logs(arg0, arg1, arg2, arg3, arg4, arg5, arg6, arg7, arg8, arg9, arg10 any) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Logs", reflect.TypeOf((*MockK8SAPIService)(nil).Logs), arg0, arg1, arg2, arg3, arg4, arg5, arg6)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Logs", reflect.TypeOf((*MockK8SAPIService)(nil).Logs), arg0, arg1, arg2, arg3, arg4, arg5, arg6, arg7, arg8, arg9, arg10)
+}
+
+// MockNamespaceResolver is a mock of NamespaceResolver interface.
+type MockNamespaceResolver struct {
+	ctrl     *gomock.Controller
+	recorder *MockNamespaceResolverMockRecorder
+}
+
+// MockNamespaceResolverMockRecorder is the mock recorder for MockNamespaceResolver.
+type MockNamespaceResolverMockRecorder struct {
+	mock *MockNamespaceResolver
+}
+
+// NewMockNamespaceResolver creates a new mock instance.
+func NewMockNamespaceResolver(ctrl *gomock.Controller) *MockNamespaceResolver {
+	mock := &MockNamespaceResolver{ctrl: ctrl}
+	mock.recorder = &MockNamespaceResolverMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockNamespaceResolver) EXPECT() *MockNamespaceResolverMockRecorder {
+	return m.recorder
 }
 
 // NamespaceDetails mocks base method.
-func (m *MockK8SAPIService) NamespaceDetails(arg0 context.Context, arg1 string) (int, int, string, string, error) {
+func (m *MockNamespaceResolver) NamespaceDetails(arg0 context.Context, arg1 string) (int, int, string, string, string, string, error) {
 	m.ctrl.T.Helper()
 	ret := m.ctrl.Call(m, "NamespaceDetails", arg0, arg1)
 	ret0, _ := ret[0].(int)
 	ret1, _ := ret[1].(int)
 	ret2, _ := ret[2].(string)
 	ret3, _ := ret[3].(string)
-	ret4, _ := ret[4].(error)
-	return ret0, ret1, ret2, ret3, ret4
+	ret4, _ := ret[4].(string)
+	ret5, _ := ret[5].(string)
+	ret6, _ := ret[6].(error)
+	return ret0, ret1, ret2, ret3, ret4, ret5, ret6
 }
 
 // NamespaceDetails indicates an expected call of NamespaceDetails.
-func (mr *MockK8SAPIServiceMockRecorder) NamespaceDetails(arg0, arg1 any) *gomock.Call {
+func (mr *MockNamespaceResolverMockRecorder) NamespaceDetails(arg0, arg1 any) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "NamespaceDetails", reflect.TypeOf((*MockK8SAPIService)(nil).NamespaceDetails), arg0, arg1)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "NamespaceDetails", reflect.TypeOf((*MockNamespaceResolver)(nil).NamespaceDetails), arg0, arg1)
 }
 
 // MockNATSService is a mock of NATSService interface.
@@ -128,10 +200,10 @@ func (m *MockNATSService) EXPECT() *MockNATSServiceMockRecorder {
 }
 
 // KeyCanAccessEnvironment mocks base method.
-func (m *MockNATSService) KeyCanAccessEnvironment(arg0, arg1, arg2 string, arg3, arg4 int) (bool, error) {
+func (m *MockNATSService) KeyCanAccessEnvironment(arg0, arg1, arg2 string, arg3, arg4 int) (bus.SSHAccessResponse, error) {
 	m.ctrl.T.Helper()
 	ret := m.ctrl.Call(m, "KeyCanAccessEnvironment", arg0, arg1, arg2, arg3, arg4)
-	ret0, _ := ret[0].(bool)
+	ret0, _ := ret[0].(bus.SSHAccessResponse)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
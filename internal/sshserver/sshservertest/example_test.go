@@ -0,0 +1,88 @@
+package sshservertest_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/uselagoon/ssh-portal/internal/k8s"
+	"github.com/uselagoon/ssh-portal/internal/sshserver"
+	"github.com/uselagoon/ssh-portal/internal/sshserver/sshservertest"
+)
+
+// FakeK8S implements the interfaces required by the sshserver package.
+var (
+	_ sshserver.K8SAPIService     = &sshservertest.FakeK8S{}
+	_ sshserver.NamespaceResolver = &sshservertest.FakeK8S{}
+)
+
+// rwBuffer is an io.ReadWriter which reads from in and writes to out, like an
+// SSH session channel.
+type rwBuffer struct {
+	in  *bytes.Buffer
+	out *bytes.Buffer
+}
+
+func (b rwBuffer) Read(p []byte) (int, error)  { return b.in.Read(p) }
+func (b rwBuffer) Write(p []byte) (int, error) { return b.out.Write(p) }
+
+func ExampleFakeK8S() {
+	fake := &sshservertest.FakeK8S{
+		Deployments: map[string]map[string]sshservertest.Deployment{
+			"project-main": {
+				"cli": {
+					Name:   "cli",
+					Access: k8s.DeploymentAccess{Exec: true, Logs: true},
+				},
+			},
+		},
+	}
+	ctx := context.Background()
+	name, access, err := fake.FindDeployment(ctx, "project-main", "cli")
+	fmt.Println(name, access.Exec, err)
+	_, _, err = fake.FindDeployment(ctx, "project-main", "nginx")
+	fmt.Println(errors.Is(err, k8s.ErrDeploymentNotFound))
+	// by default, Exec echoes stdin to stdout
+	stdio := rwBuffer{
+		in:  bytes.NewBufferString("hello\n"),
+		out: &bytes.Buffer{},
+	}
+	err = fake.Exec(ctx, "project-main", name, "", []string{"cat"}, stdio,
+		os.Stderr, false, nil)
+	fmt.Print(stdio.out.String())
+	fmt.Println(err, len(fake.Calls()))
+	// Output:
+	// cli true <nil>
+	// true
+	// hello
+	// <nil> 3
+}
+
+func ExampleFakeK8S_logs() {
+	fake := &sshservertest.FakeK8S{LogLines: 2}
+	var out bytes.Buffer
+	err := fake.Logs(context.Background(), "project-main", "nginx", "", false,
+		10, k8s.LogFormatText, nil, true, false,
+		rwBuffer{in: &bytes.Buffer{}, out: &out})
+	fmt.Print(out.String())
+	fmt.Println(err)
+	// Output:
+	// nginx log line 1
+	// nginx log line 2
+	// <nil>
+}
+
+func ExampleFakeK8S_errors() {
+	fake := &sshservertest.FakeK8S{
+		Errors: map[string]error{
+			sshservertest.MethodExec: errors.New("container not running"),
+		},
+	}
+	err := fake.Exec(context.Background(), "project-main", "cli", "",
+		[]string{"id"}, rwBuffer{}, os.Stderr, false, nil)
+	fmt.Println(err)
+	// Output:
+	// container not running
+}
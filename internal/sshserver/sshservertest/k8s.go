@@ -0,0 +1,310 @@
+// Package sshservertest provides utilities for testing code which uses
+// package sshserver, in the manner of net/http/httptest.
+package sshservertest
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"regexp"
+	"slices"
+	"sync"
+
+	"github.com/gliderlabs/ssh"
+	"github.com/uselagoon/ssh-portal/internal/k8s"
+)
+
+// Method names which may be used as keys of FakeK8S.Errors.
+const (
+	MethodDebug            = "Debug"
+	MethodExec             = "Exec"
+	MethodFindDeployment   = "FindDeployment"
+	MethodJobLogs          = "JobLogs"
+	MethodListServices     = "ListServices"
+	MethodLogs             = "Logs"
+	MethodNamespaceDetails = "NamespaceDetails"
+)
+
+// Namespace contains the Lagoon details of a namespace, as returned by
+// NamespaceDetails.
+type Namespace struct {
+	EnvironmentID   int
+	ProjectID       int
+	EnvironmentName string
+	ProjectName     string
+	EnvironmentType string
+	Shell           string
+}
+
+// Deployment is a deployment returned by FindDeployment.
+type Deployment struct {
+	Name   string
+	Access k8s.DeploymentAccess
+}
+
+// ExecCall contains the arguments of a call to Exec or Debug.
+type ExecCall struct {
+	Method     string
+	Namespace  string
+	Deployment string
+	Container  string
+	Command    []string
+	Stdio      io.ReadWriter
+	Stderr     io.Writer
+	TTY        bool
+}
+
+// Call is a record of a call to a FakeK8S method. Deployment is the service
+// name for FindDeployment, and the job name for JobLogs. Follow and
+// TailLines are only set for Logs and JobLogs.
+type Call struct {
+	Method     string
+	Namespace  string
+	Deployment string
+	Follow     bool
+	TailLines  int64
+}
+
+// FakeK8S is an in-memory implementation of sshserver.K8SAPIService and
+// sshserver.NamespaceResolver. Its behaviour is configured by setting its
+// fields before use. Fields must not be modified while the FakeK8S is in use.
+//
+// The zero value is a cluster with no namespaces or deployments.
+type FakeK8S struct {
+	// Namespaces maps namespace names to their Lagoon details. Unknown
+	// namespaces cause NamespaceDetails to return an error.
+	Namespaces map[string]Namespace
+	// Deployments maps namespace names to a map of Lagoon service names to
+	// deployments. Unknown services cause FindDeployment to return
+	// k8s.ErrDeploymentNotFound.
+	Deployments map[string]map[string]Deployment
+	// ExecFunc handles calls to Exec and Debug. If nil, stdin is echoed to
+	// stdout until EOF.
+	ExecFunc func(context.Context, ExecCall) error
+	// LogLines is the number of lines written by Logs and JobLogs, before
+	// any filter is applied. Following logs return after the lines are
+	// written, or when the context is cancelled if LogLines is negative.
+	LogLines int
+	// Errors maps method names to errors returned by those methods.
+	Errors map[string]error
+
+	mu    sync.Mutex
+	calls []Call
+}
+
+// record records a call, and returns the injected error for the method.
+func (f *FakeK8S) record(call Call) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, call)
+	return f.Errors[call.Method]
+}
+
+// Calls returns the calls made to the FakeK8S, in order.
+func (f *FakeK8S) Calls() []Call {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]Call(nil), f.calls...)
+}
+
+// exec implements Exec and Debug.
+func (f *FakeK8S) exec(ctx context.Context, call ExecCall) error {
+	err := f.record(Call{
+		Method:     call.Method,
+		Namespace:  call.Namespace,
+		Deployment: call.Deployment,
+	})
+	if err != nil {
+		return err
+	}
+	if f.ExecFunc != nil {
+		return f.ExecFunc(ctx, call)
+	}
+	_, err = io.Copy(call.Stdio, call.Stdio)
+	return err
+}
+
+// Debug implements sshserver.K8SAPIService.
+func (f *FakeK8S) Debug(
+	ctx context.Context,
+	namespace,
+	deployment,
+	container string,
+	cmd []string,
+	stdio io.ReadWriter,
+	stderr io.Writer,
+	tty bool,
+	_ <-chan ssh.Window,
+) error {
+	return f.exec(ctx, ExecCall{
+		Method:     MethodDebug,
+		Namespace:  namespace,
+		Deployment: deployment,
+		Container:  container,
+		Command:    cmd,
+		Stdio:      stdio,
+		Stderr:     stderr,
+		TTY:        tty,
+	})
+}
+
+// Exec implements sshserver.K8SAPIService.
+func (f *FakeK8S) Exec(
+	ctx context.Context,
+	namespace,
+	deployment,
+	container string,
+	cmd []string,
+	stdio io.ReadWriter,
+	stderr io.Writer,
+	tty bool,
+	_ <-chan ssh.Window,
+) error {
+	return f.exec(ctx, ExecCall{
+		Method:     MethodExec,
+		Namespace:  namespace,
+		Deployment: deployment,
+		Container:  container,
+		Command:    cmd,
+		Stdio:      stdio,
+		Stderr:     stderr,
+		TTY:        tty,
+	})
+}
+
+// FindDeployment implements sshserver.K8SAPIService.
+func (f *FakeK8S) FindDeployment(
+	_ context.Context,
+	namespace,
+	service string,
+) (string, k8s.DeploymentAccess, error) {
+	err := f.record(Call{
+		Method:     MethodFindDeployment,
+		Namespace:  namespace,
+		Deployment: service,
+	})
+	if err != nil {
+		return "", k8s.DeploymentAccess{}, err
+	}
+	d, ok := f.Deployments[namespace][service]
+	if !ok {
+		return "", k8s.DeploymentAccess{}, k8s.ErrDeploymentNotFound
+	}
+	return d.Name, d.Access, nil
+}
+
+// ListServices implements sshserver.K8SAPIService. It returns the sorted
+// service names of the Deployments in the namespace.
+func (f *FakeK8S) ListServices(
+	_ context.Context,
+	namespace string,
+) ([]string, error) {
+	err := f.record(Call{
+		Method:    MethodListServices,
+		Namespace: namespace,
+	})
+	if err != nil {
+		return nil, err
+	}
+	var services []string
+	for service := range f.Deployments[namespace] {
+		services = append(services, service)
+	}
+	slices.Sort(services)
+	return services, nil
+}
+
+// logs writes the configured number of log lines which match filter to
+// stdio.
+func (f *FakeK8S) logs(
+	ctx context.Context,
+	name string,
+	follow bool,
+	filter *regexp.Regexp,
+	stdio io.Writer,
+) error {
+	for i := range max(f.LogLines, 0) {
+		line := fmt.Sprintf("%s log line %d", name, i+1)
+		if filter != nil && !filter.MatchString(line) {
+			continue
+		}
+		_, err := fmt.Fprintln(stdio, line)
+		if err != nil {
+			return err
+		}
+	}
+	if follow && f.LogLines < 0 {
+		<-ctx.Done()
+	}
+	return nil
+}
+
+// JobLogs implements sshserver.K8SAPIService.
+func (f *FakeK8S) JobLogs(
+	ctx context.Context,
+	namespace,
+	job,
+	_ string,
+	follow bool,
+	tailLines int64,
+	_ k8s.LogFormat,
+	filter *regexp.Regexp,
+	_, _ bool,
+	stdio io.ReadWriter,
+) error {
+	err := f.record(Call{
+		Method:     MethodJobLogs,
+		Namespace:  namespace,
+		Deployment: job,
+		Follow:     follow,
+		TailLines:  tailLines,
+	})
+	if err != nil {
+		return err
+	}
+	return f.logs(ctx, job, follow, filter, stdio)
+}
+
+// Logs implements sshserver.K8SAPIService.
+func (f *FakeK8S) Logs(
+	ctx context.Context,
+	namespace,
+	deployment,
+	_ string,
+	follow bool,
+	tailLines int64,
+	_ k8s.LogFormat,
+	filter *regexp.Regexp,
+	_, _ bool,
+	stdio io.ReadWriter,
+) error {
+	err := f.record(Call{
+		Method:     MethodLogs,
+		Namespace:  namespace,
+		Deployment: deployment,
+		Follow:     follow,
+		TailLines:  tailLines,
+	})
+	if err != nil {
+		return err
+	}
+	return f.logs(ctx, deployment, follow, filter, stdio)
+}
+
+// NamespaceDetails implements sshserver.NamespaceResolver.
+func (f *FakeK8S) NamespaceDetails(
+	_ context.Context,
+	name string,
+) (int, int, string, string, string, string, error) {
+	err := f.record(Call{Method: MethodNamespaceDetails, Namespace: name})
+	if err != nil {
+		return 0, 0, "", "", "", "", err
+	}
+	ns, ok := f.Namespaces[name]
+	if !ok {
+		return 0, 0, "", "", "", "",
+			fmt.Errorf("couldn't get namespace %s: not found", name)
+	}
+	return ns.EnvironmentID, ns.ProjectID, ns.EnvironmentName, ns.ProjectName,
+		ns.EnvironmentType, ns.Shell, nil
+}
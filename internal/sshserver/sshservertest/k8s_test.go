@@ -0,0 +1,98 @@
+package sshservertest_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/assert/v2"
+	"github.com/uselagoon/ssh-portal/internal/k8s"
+	"github.com/uselagoon/ssh-portal/internal/sshserver/sshservertest"
+)
+
+func TestNamespaceDetails(t *testing.T) {
+	fake := &sshservertest.FakeK8S{
+		Namespaces: map[string]sshservertest.Namespace{
+			"project-main": {
+				EnvironmentID:   2,
+				ProjectID:       1,
+				EnvironmentName: "main",
+				ProjectName:     "project",
+				EnvironmentType: "production",
+			},
+		},
+	}
+	eid, pid, ename, pname, etype, shell, err :=
+		fake.NamespaceDetails(context.Background(), "project-main")
+	assert.NoError(t, err)
+	assert.Equal(t, []any{2, 1, "main", "project", "production", ""},
+		[]any{eid, pid, ename, pname, etype, shell})
+	_, _, _, _, _, _, err =
+		fake.NamespaceDetails(context.Background(), "project-other")
+	assert.Error(t, err)
+	assert.Equal(t, []sshservertest.Call{
+		{
+			Method:    sshservertest.MethodNamespaceDetails,
+			Namespace: "project-main",
+		},
+		{
+			Method:    sshservertest.MethodNamespaceDetails,
+			Namespace: "project-other",
+		},
+	}, fake.Calls())
+}
+
+func TestExecFunc(t *testing.T) {
+	var got sshservertest.ExecCall
+	fake := &sshservertest.FakeK8S{
+		ExecFunc: func(_ context.Context, call sshservertest.ExecCall) error {
+			got = call
+			return errors.New("exit status 1")
+		},
+	}
+	err := fake.Debug(context.Background(), "project-main", "cli", "php",
+		[]string{"sh"}, rwBuffer{}, &bytes.Buffer{}, true, nil)
+	assert.EqualError(t, err, "exit status 1")
+	assert.Equal(t, sshservertest.MethodDebug, got.Method)
+	assert.Equal(t, "php", got.Container)
+	assert.Equal(t, []string{"sh"}, got.Command)
+	assert.True(t, got.TTY)
+}
+
+func TestLogsFollow(t *testing.T) {
+	var testCases = map[string]struct {
+		logLines    int
+		follow      bool
+		filter      *regexp.Regexp
+		expectLines int
+		expectWait  bool
+	}{
+		"lines":        {logLines: 3, expectLines: 3},
+		"follow lines": {logLines: 3, follow: true, expectLines: 3},
+		"filtered lines": {
+			logLines:    3,
+			filter:      regexp.MustCompile(`line [12]$`),
+			expectLines: 2,
+		},
+		"follow forever": {logLines: -1, follow: true, expectWait: true},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			fake := &sshservertest.FakeK8S{LogLines: tc.logLines}
+			ctx, cancel := context.WithTimeout(context.Background(),
+				50*time.Millisecond)
+			defer cancel()
+			var out bytes.Buffer
+			err := fake.JobLogs(ctx, "project-main", "job-1", "", tc.follow, 0,
+				k8s.LogFormatText, tc.filter, true, false,
+				rwBuffer{in: &bytes.Buffer{}, out: &out})
+			assert.NoError(tt, err, name)
+			assert.Equal(tt, tc.expectLines,
+				bytes.Count(out.Bytes(), []byte("\n")), name)
+			assert.Equal(tt, tc.expectWait, ctx.Err() != nil, name)
+		})
+	}
+}
@@ -0,0 +1,48 @@
+package sshserver
+
+// maxSuggestionDistance is the maximum edit distance between an unknown
+// service name and a service name suggested in its place.
+const maxSuggestionDistance = 2
+
+// levenshtein returns the number of single character insertions, deletions,
+// and substitutions required to change a into b.
+func levenshtein(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	// prev and curr are the previous and current rows of the distance matrix
+	prev := make([]int, len(rb)+1)
+	curr := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := range ra {
+		curr[0] = i + 1
+		for j := range rb {
+			cost := 1
+			if ra[i] == rb[j] {
+				cost = 0
+			}
+			curr[j+1] = min(prev[j+1]+1, curr[j]+1, prev[j]+cost)
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(rb)]
+}
+
+// suggestService returns the name in services which is closest to the
+// unknown service, or an empty string if none is close enough to suggest.
+// A name is close enough if it is within maxSuggestionDistance edits of
+// service, and needs fewer edits than half the length of service, so that
+// short names aren't matched with unrelated ones. Ties are broken by the
+// order of services.
+func suggestService(service string, services []string) string {
+	limit := min(maxSuggestionDistance, (len([]rune(service))-1)/2)
+	var suggestion string
+	best := limit + 1
+	for _, candidate := range services {
+		d := levenshtein(service, candidate)
+		if d > 0 && d < best {
+			suggestion, best = candidate, d
+		}
+	}
+	return suggestion
+}
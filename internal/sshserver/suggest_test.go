@@ -0,0 +1,54 @@
+package sshserver_test
+
+import (
+	"testing"
+
+	"github.com/alecthomas/assert/v2"
+	"github.com/uselagoon/ssh-portal/internal/sshserver"
+)
+
+func TestLevenshtein(t *testing.T) {
+	var testCases = map[string]struct {
+		a      string
+		b      string
+		expect int
+	}{
+		"equal":        {a: "nginx", b: "nginx", expect: 0},
+		"empty":        {a: "", b: "cli", expect: 3},
+		"substitution": {a: "nginz", b: "nginx", expect: 1},
+		"insertion":    {a: "sol", b: "solr", expect: 1},
+		"deletion":     {a: "mariadbb", b: "mariadb", expect: 1},
+		"transposed":   {a: "ngnix", b: "nginx", expect: 2},
+		"unrelated":    {a: "redis", b: "cli", expect: 4},
+		"multibyte":    {a: "naïve", b: "naive", expect: 1},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			assert.Equal(tt, tc.expect, sshserver.Levenshtein(tc.a, tc.b), name)
+			assert.Equal(tt, tc.expect, sshserver.Levenshtein(tc.b, tc.a), name)
+		})
+	}
+}
+
+func TestSuggestService(t *testing.T) {
+	services := []string{"cli", "mariadb", "nginx", "php", "solr"}
+	var testCases = map[string]struct {
+		service string
+		expect  string
+	}{
+		"transposed":    {service: "ngnix", expect: "nginx"},
+		"missing char":  {service: "mariad", expect: "mariadb"},
+		"extra char":    {service: "solrr", expect: "solr"},
+		"short":         {service: "sol", expect: "solr"},
+		"too short":     {service: "db"},
+		"too far":       {service: "nodejs"},
+		"exact match":   {service: "cli"},
+		"closest first": {service: "phpx", expect: "php"},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			assert.Equal(tt, tc.expect,
+				sshserver.SuggestService(tc.service, services), name)
+		})
+	}
+}
@@ -0,0 +1,166 @@
+package sshserver
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// tarpitBaseDelay is the delay applied to the first failed authentication
+// attempt from a source once it exceeds the failure threshold. The delay
+// doubles with each further failure, up to the maximum delay.
+const tarpitBaseDelay = 500 * time.Millisecond
+
+// sourceFailures tracks the connections from a single source which failed to
+// authenticate within the current window.
+type sourceFailures struct {
+	count int
+	start time.Time
+}
+
+// AuthTarpit progressively delays failed authentication attempts from source
+// IP addresses which repeatedly fail to authenticate. This slows down
+// brute-force fingerprint scans without banning sources outright, since
+// many users may share a source address behind NAT.
+//
+// Clients commonly offer several keys before the one which is authorized, so
+// a failure is counted, and delayed, at most once per connection. A session
+// started by a source clears its failures.
+//
+// The zero value is disabled. This object should otherwise not be
+// constructed by itself, only via NewAuthTarpit().
+type AuthTarpit struct {
+	threshold int
+	window    time.Duration
+	maxDelay  time.Duration
+	now       func() time.Time
+	done      chan struct{}
+	stopOnce  sync.Once
+	mu        sync.Mutex
+	sources   map[string]*sourceFailures
+	lastSweep time.Time
+}
+
+// NewAuthTarpit returns a new AuthTarpit which delays failed authentication
+// attempts from a source after it has failed threshold times within window.
+// The delay starts at 500ms, doubles with each further failure, and is capped
+// at maxDelay. A threshold of zero returns a disabled AuthTarpit.
+func NewAuthTarpit(threshold int, window,
+	maxDelay time.Duration) (*AuthTarpit, error) {
+	if threshold < 0 {
+		return nil, errors.New("negative auth failure threshold")
+	}
+	if threshold == 0 {
+		return &AuthTarpit{}, nil
+	}
+	if window <= 0 {
+		return nil, errors.New("auth failure window must be positive")
+	}
+	if maxDelay <= 0 {
+		return nil, errors.New("auth tarpit max delay must be positive")
+	}
+	return &AuthTarpit{
+		threshold: threshold,
+		window:    window,
+		maxDelay:  maxDelay,
+		now:       time.Now,
+		done:      make(chan struct{}),
+		sources:   map[string]*sourceFailures{},
+	}, nil
+}
+
+// sourceIP returns the IP address of the given remote address, or its string
+// representation if it has no IP address, such as for Unix domain sockets.
+func sourceIP(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// sweep removes sources whose window has expired. It must be called with mu
+// held.
+func (t *AuthTarpit) sweep(now time.Time) {
+	if now.Sub(t.lastSweep) < t.window {
+		return
+	}
+	for source, f := range t.sources {
+		if now.Sub(f.start) >= t.window {
+			delete(t.sources, source)
+		}
+	}
+	t.lastSweep = now
+}
+
+// enabled returns true if the AuthTarpit delays failed authentication
+// attempts.
+func (t *AuthTarpit) enabled() bool {
+	return t != nil && t.threshold > 0
+}
+
+// succeeded clears the failures recorded for the given source, since a
+// client there has proven ownership of an authorized key.
+func (t *AuthTarpit) succeeded(source string) {
+	if !t.enabled() {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.sources, source)
+}
+
+// failed records a failed authentication attempt from the given source, and
+// returns the delay to apply before the failure is reported to the client.
+func (t *AuthTarpit) failed(source string) time.Duration {
+	if !t.enabled() {
+		return 0
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := t.now()
+	t.sweep(now)
+	f, ok := t.sources[source]
+	if !ok || now.Sub(f.start) >= t.window {
+		f = &sourceFailures{start: now}
+		t.sources[source] = f
+	}
+	f.count++
+	if f.count <= t.threshold {
+		return 0
+	}
+	delay := tarpitBaseDelay
+	for i := t.threshold + 1; i < f.count && delay < t.maxDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, t.maxDelay)
+}
+
+// wait blocks for the given delay. It returns early if ctx is cancelled, or
+// if the AuthTarpit is stopped.
+func (t *AuthTarpit) wait(ctx context.Context, delay time.Duration) {
+	if delay <= 0 {
+		return
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+	case <-t.done:
+	}
+}
+
+// stop releases any pending delays, so that server shutdown isn't blocked by
+// tarpitted connections. Subsequent delays return immediately.
+func (t *AuthTarpit) stop() {
+	if t.done == nil {
+		return
+	}
+	t.stopOnce.Do(func() { close(t.done) })
+}
@@ -0,0 +1,140 @@
+package sshserver
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/assert/v2"
+)
+
+func TestAuthTarpitDelays(t *testing.T) {
+	var testCases = map[string]struct {
+		threshold int
+		maxDelay  time.Duration
+		// elapsed is the fake time which passes before each failure
+		elapsed []time.Duration
+		expect  []time.Duration
+	}{
+		"disabled": {
+			elapsed: []time.Duration{0, 0, 0},
+			expect:  []time.Duration{0, 0, 0},
+		},
+		"progression": {
+			threshold: 2,
+			maxDelay:  time.Minute,
+			elapsed:   []time.Duration{0, 0, 0, 0, 0, 0},
+			expect: []time.Duration{0, 0, 500 * time.Millisecond,
+				time.Second, 2 * time.Second, 4 * time.Second},
+		},
+		"capped": {
+			threshold: 1,
+			maxDelay:  1500 * time.Millisecond,
+			elapsed:   []time.Duration{0, 0, 0, 0, 0},
+			expect: []time.Duration{0, 500 * time.Millisecond, time.Second,
+				1500 * time.Millisecond, 1500 * time.Millisecond},
+		},
+		"window expiry resets count": {
+			threshold: 1,
+			maxDelay:  time.Minute,
+			elapsed: []time.Duration{0, time.Minute, time.Minute,
+				10 * time.Minute, 0},
+			expect: []time.Duration{0, 500 * time.Millisecond, time.Second,
+				0, 500 * time.Millisecond},
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			tarpit, err :=
+				NewAuthTarpit(tc.threshold, 10*time.Minute, tc.maxDelay)
+			assert.NoError(tt, err, name)
+			now := time.Unix(0, 0)
+			tarpit.now = func() time.Time { return now }
+			for i, elapsed := range tc.elapsed {
+				now = now.Add(elapsed)
+				assert.Equal(tt, tc.expect[i], tarpit.failed("192.0.2.1"), name)
+			}
+			// other sources are tracked independently
+			assert.Equal(tt, time.Duration(0), tarpit.failed("192.0.2.2"), name)
+		})
+	}
+}
+
+func TestNewAuthTarpitInvalid(t *testing.T) {
+	var testCases = map[string]struct {
+		threshold int
+		window    time.Duration
+		maxDelay  time.Duration
+	}{
+		"negative threshold": {threshold: -1, window: time.Minute,
+			maxDelay: time.Second},
+		"zero window":    {threshold: 1, maxDelay: time.Second},
+		"zero max delay": {threshold: 1, window: time.Minute},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			_, err := NewAuthTarpit(tc.threshold, tc.window, tc.maxDelay)
+			assert.Error(tt, err, name)
+		})
+	}
+}
+
+func TestAuthTarpitWaitCancel(t *testing.T) {
+	tarpit, err := NewAuthTarpit(1, time.Minute, time.Hour)
+	assert.NoError(t, err)
+	// cancelling the context releases the wait
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	done := make(chan struct{})
+	go func() {
+		tarpit.wait(ctx, time.Hour)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("wait not cancelled by context")
+	}
+	// stopping the tarpit releases the wait
+	done = make(chan struct{})
+	go func() {
+		tarpit.wait(context.Background(), time.Hour)
+		close(done)
+	}()
+	tarpit.stop()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("wait not released by stop")
+	}
+	// stop is idempotent, and is safe on a disabled tarpit
+	tarpit.stop()
+	(&AuthTarpit{}).stop()
+}
+
+func TestSourceIP(t *testing.T) {
+	var testCases = map[string]struct {
+		input  net.Addr
+		expect string
+	}{
+		"ipv4": {
+			input:  &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 2222},
+			expect: "192.0.2.1",
+		},
+		"ipv6": {
+			input:  &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 2222},
+			expect: "2001:db8::1",
+		},
+		"unix": {
+			input:  &net.UnixAddr{Name: "/run/ssh.sock", Net: "unix"},
+			expect: "/run/ssh.sock",
+		},
+		"nil": {},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			assert.Equal(tt, tc.expect, sourceIP(tc.input), name)
+		})
+	}
+}
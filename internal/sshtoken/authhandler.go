@@ -3,17 +3,26 @@ package sshtoken
 import (
 	"errors"
 	"log/slog"
+	"time"
 
 	"github.com/gliderlabs/ssh"
 	"github.com/google/uuid"
+	"github.com/uselagoon/ssh-portal/internal/keypolicy"
 	"github.com/uselagoon/ssh-portal/internal/lagoondb"
+	"github.com/uselagoon/ssh-portal/internal/sessionlog"
+	"github.com/uselagoon/ssh-portal/internal/sshfingerprint"
 	gossh "golang.org/x/crypto/ssh"
+	"golang.org/x/time/rate"
 )
 
 const (
 	userUUIDKey = "uselagoon/userUUID"
 )
 
+// keyPolicyLogSampler limits logging of key policy rejections, since a single
+// client may offer many keys.
+var keyPolicyLogSampler = rate.Sometimes{First: 10, Interval: time.Minute}
+
 // permissionsMarshal takes the user UUID and stores it in the Extensions field
 // of the ssh connection permissions.
 //
@@ -32,9 +41,24 @@ func permissionsMarshal(ctx ssh.Context, userUUID uuid.UUID) {
 // Note that this function will be called for ALL public keys presented by the
 // client, even if the client does not go on to prove ownership of the key by
 // signing with it. See https://pkg.go.dev/vuln/GO-2024-3321
-func pubKeyHandler(log *slog.Logger, ldb LagoonDBService) ssh.PublicKeyHandler {
+func pubKeyHandler(
+	log *slog.Logger,
+	m *Metrics,
+	ldb LagoonDBService,
+	keyPolicy *keypolicy.Policy,
+) ssh.PublicKeyHandler {
 	return func(ctx ssh.Context, key ssh.PublicKey) bool {
-		log := log.With(slog.String("sessionID", ctx.SessionID()))
+		log := log.With(slog.String(sessionlog.SessionIDKey, ctx.SessionID()))
+		// reject keys which don't meet the key policy
+		if err := keyPolicy.Check(key); err != nil {
+			m.keyPolicyRejectionsTotal.WithLabelValues(key.Type()).Inc()
+			keyPolicyLogSampler.Do(func() {
+				log.Info("public key rejected by key policy",
+					slog.String("keyType", key.Type()),
+					slog.Any("error", err))
+			})
+			return false
+		}
 		// parse SSH public key
 		pubKey, err := gossh.ParsePublicKey(key.Marshal())
 		if err != nil {
@@ -42,8 +66,12 @@ func pubKeyHandler(log *slog.Logger, ldb LagoonDBService) ssh.PublicKeyHandler {
 			return false
 		}
 		// identify Lagoon user by ssh key fingerprint
-		fingerprint := gossh.FingerprintSHA256(pubKey)
-		log = log.With(slog.String("fingerprint", fingerprint))
+		fingerprint, err := sshfingerprint.Normalize(gossh.FingerprintSHA256(pubKey))
+		if err != nil {
+			log.Warn("couldn't normalise SSH fingerprint", slog.Any("error", err))
+			return false
+		}
+		log = log.With(slog.String(sessionlog.SSHFingerprintKey, fingerprint))
 		user, err := ldb.UserBySSHFingerprint(ctx, fingerprint)
 		if err != nil {
 			if errors.Is(err, lagoondb.ErrNoResult) {
@@ -54,6 +82,11 @@ func pubKeyHandler(log *slog.Logger, ldb LagoonDBService) ssh.PublicKeyHandler {
 			}
 			return false
 		}
+		if user == nil || user.UUID == nil {
+			log.Warn("couldn't query for user by SSH key fingerprint: " +
+				"no user UUID returned")
+			return false
+		}
 		permissionsMarshal(ctx, *user.UUID)
 		log.Info("authentication successful",
 			slog.String("userUUID", user.UUID.String()))
@@ -9,6 +9,8 @@ import (
 	"github.com/alecthomas/assert/v2"
 	"github.com/gliderlabs/ssh"
 	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/uselagoon/ssh-portal/internal/keypolicy"
 	"github.com/uselagoon/ssh-portal/internal/lagoondb"
 	"github.com/uselagoon/ssh-portal/internal/sshtoken"
 	gomock "go.uber.org/mock/gomock"
@@ -17,9 +19,12 @@ import (
 
 func TestPubKeyHandler(t *testing.T) {
 	log := slog.New(slog.NewJSONHandler(os.Stderr, nil))
+	metrics := sshtoken.NewMetrics(prometheus.NewRegistry())
 	var testCases = map[string]struct {
 		userBySSHFingerprintErr error
+		noUUID                  bool
 		keyFound                bool
+		allowedAlgorithms       []string
 	}{
 		"key matches user": {
 			userBySSHFingerprintErr: nil,
@@ -29,6 +34,14 @@ func TestPubKeyHandler(t *testing.T) {
 			userBySSHFingerprintErr: lagoondb.ErrNoResult,
 			keyFound:                false,
 		},
+		"user without UUID": {
+			noUUID:   true,
+			keyFound: false,
+		},
+		"key rejected by policy": {
+			keyFound:          false,
+			allowedAlgorithms: []string{gossh.KeyAlgoRSA},
+		},
 	}
 	for name, tc := range testCases {
 		t.Run(name, func(tt *testing.T) {
@@ -36,9 +49,15 @@ func TestPubKeyHandler(t *testing.T) {
 			ldbService := NewMockLagoonDBService(ctrl)
 			sshContext := NewMockContext(ctrl)
 			// configure callback
+			keyPolicy, err := keypolicy.NewPolicy(tc.allowedAlgorithms, 0)
+			if err != nil {
+				tt.Fatal(err)
+			}
 			callback := sshtoken.PubKeyHandler(
 				log,
+				metrics,
 				ldbService,
+				keyPolicy,
 			)
 			// set up public key mock
 			publicKey, _, err := ed25519.GenerateKey(nil)
@@ -52,8 +71,15 @@ func TestPubKeyHandler(t *testing.T) {
 			fingerprint := gossh.FingerprintSHA256(sshPublicKey)
 			// configure mocks
 			userUUID := uuid.Must(uuid.NewRandom())
-			ldbService.EXPECT().UserBySSHFingerprint(sshContext, fingerprint).
-				Return(&lagoondb.User{UUID: &userUUID}, tc.userBySSHFingerprintErr)
+			// the database is not queried if the key is rejected by policy
+			if len(tc.allowedAlgorithms) == 0 {
+				user := &lagoondb.User{UUID: &userUUID}
+				if tc.noUUID {
+					user.UUID = nil
+				}
+				ldbService.EXPECT().UserBySSHFingerprint(sshContext, fingerprint).
+					Return(user, tc.userBySSHFingerprintErr)
+			}
 			sessionID := "abc123"
 			sshContext.EXPECT().SessionID().Return(sessionID).AnyTimes()
 			// set up permissions mock
@@ -0,0 +1,55 @@
+package sshtoken
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+
+	"github.com/uselagoon/ssh-portal/internal/bus"
+)
+
+// SSHEndpointService provides a method for looking up the SSH endpoint of the
+// ssh-portal serving an environment. It is implemented by both the Lagoon API
+// DB client and the NATS client.
+type SSHEndpointService interface {
+	SSHEndpointByEnvironmentID(context.Context, int) (string, string, error)
+}
+
+// fallbackSSHEndpoint looks up SSH endpoints using a primary service, and
+// falls back to a secondary service if the primary service fails.
+type fallbackSSHEndpoint struct {
+	log      *slog.Logger
+	primary  SSHEndpointService
+	fallback SSHEndpointService
+}
+
+// NewFallbackSSHEndpoint returns an SSHEndpointService which looks up SSH
+// endpoints using primary. If primary returns an error other than
+// bus.ErrUnknownEnvironment, the error is logged and the lookup is retried
+// using fallback.
+func NewFallbackSSHEndpoint(
+	log *slog.Logger,
+	primary,
+	fallback SSHEndpointService,
+) SSHEndpointService {
+	return &fallbackSSHEndpoint{
+		log:      log,
+		primary:  primary,
+		fallback: fallback,
+	}
+}
+
+// SSHEndpointByEnvironmentID implements SSHEndpointService.
+func (f *fallbackSSHEndpoint) SSHEndpointByEnvironmentID(
+	ctx context.Context,
+	envID int,
+) (string, string, error) {
+	host, port, err := f.primary.SSHEndpointByEnvironmentID(ctx, envID)
+	if err == nil || errors.Is(err, bus.ErrUnknownEnvironment) {
+		return host, port, err
+	}
+	f.log.Warn("couldn't get ssh endpoint, falling back",
+		slog.Int("environmentID", envID),
+		slog.Any("error", err))
+	return f.fallback.SSHEndpointByEnvironmentID(ctx, envID)
+}
@@ -0,0 +1,74 @@
+package sshtoken_test
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"testing"
+
+	"github.com/alecthomas/assert/v2"
+	"github.com/uselagoon/ssh-portal/internal/bus"
+	"github.com/uselagoon/ssh-portal/internal/sshtoken"
+	"go.uber.org/mock/gomock"
+)
+
+func TestFallbackSSHEndpoint(t *testing.T) {
+	log := slog.New(slog.NewJSONHandler(os.Stderr, nil))
+	var testCases = map[string]struct {
+		primaryErr   error
+		expectLookup bool
+		fallbackErr  error
+		expectHost   string
+		expectErr    error
+	}{
+		"primary": {
+			expectHost: "ssh.primary.example.com",
+		},
+		"unknown environment": {
+			primaryErr: bus.ErrUnknownEnvironment,
+			expectErr:  bus.ErrUnknownEnvironment,
+		},
+		"fallback": {
+			primaryErr:   errors.New("nats: timeout"),
+			expectLookup: true,
+			expectHost:   "ssh.fallback.example.com",
+		},
+		"fallback error": {
+			primaryErr:   errors.New("nats: timeout"),
+			expectLookup: true,
+			fallbackErr:  errors.New("connection refused"),
+			expectErr:    errors.New("connection refused"),
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			ctrl := gomock.NewController(tt)
+			primary := NewMockSSHEndpointService(ctrl)
+			fallback := NewMockSSHEndpointService(ctrl)
+			ctx := context.Background()
+			// configure mocks
+			if tc.primaryErr == nil {
+				primary.EXPECT().SSHEndpointByEnvironmentID(ctx, 2).
+					Return("ssh.primary.example.com", "22", nil)
+			} else {
+				primary.EXPECT().SSHEndpointByEnvironmentID(ctx, 2).
+					Return("", "", tc.primaryErr)
+			}
+			if tc.expectLookup {
+				if tc.fallbackErr == nil {
+					fallback.EXPECT().SSHEndpointByEnvironmentID(ctx, 2).
+						Return("ssh.fallback.example.com", "22", nil)
+				} else {
+					fallback.EXPECT().SSHEndpointByEnvironmentID(ctx, 2).
+						Return("", "", tc.fallbackErr)
+				}
+			}
+			// execute
+			endpoints := sshtoken.NewFallbackSSHEndpoint(log, primary, fallback)
+			host, _, err := endpoints.SSHEndpointByEnvironmentID(ctx, 2)
+			assert.Equal(tt, tc.expectErr, err, name)
+			assert.Equal(tt, tc.expectHost, host, name)
+		})
+	}
+}
@@ -0,0 +1,251 @@
+package sshtoken
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/gliderlabs/ssh"
+	"github.com/google/uuid"
+	"github.com/uselagoon/ssh-portal/internal/lagoon"
+	"github.com/uselagoon/ssh-portal/internal/lagoondb"
+	"github.com/uselagoon/ssh-portal/internal/messages"
+	"github.com/uselagoon/ssh-portal/internal/rbac"
+	"github.com/uselagoon/ssh-portal/internal/sessionio"
+)
+
+const (
+	// defaultEnvironmentsLimit is the number of environments listed if no
+	// --limit argument is given.
+	defaultEnvironmentsLimit = 50
+	// maxEnvironmentsLimit is the maximum value of the --limit argument.
+	maxEnvironmentsLimit = 500
+)
+
+// parseEnvironmentsArgs parses the arguments of the environments command,
+// and returns the limit and offset of the environments to list.
+func parseEnvironmentsArgs(args []string) (int, int, error) {
+	limit, offset := defaultEnvironmentsLimit, 0
+	for _, arg := range args {
+		name, value, ok := strings.Cut(arg, "=")
+		if !ok {
+			return 0, 0, fmt.Errorf("invalid argument: %s", arg)
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return 0, 0, fmt.Errorf("invalid value for %s: %s", name, value)
+		}
+		switch name {
+		case "--limit":
+			if n < 1 || n > maxEnvironmentsLimit {
+				return 0, 0, fmt.Errorf("%s must be between 1 and %d",
+					name, maxEnvironmentsLimit)
+			}
+			limit = n
+		case "--offset":
+			offset = n
+		default:
+			return 0, 0, fmt.Errorf("invalid argument: %s", arg)
+		}
+	}
+	return limit, offset, nil
+}
+
+// sshCommand returns the ssh command used to connect to the given
+// environment, or "-" if the environment has no SSH endpoint.
+func sshCommand(env lagoondb.EnvironmentEndpoint) string {
+	switch {
+	case env.SSHHost == "":
+		return "-"
+	case env.SSHPort == "" || env.SSHPort == "22":
+		return fmt.Sprintf("ssh %s@%s", env.NamespaceName, env.SSHHost)
+	default:
+		return fmt.Sprintf("ssh -p %s %s@%s",
+			env.SSHPort, env.NamespaceName, env.SSHHost)
+	}
+}
+
+// candidateEnvironments returns the environments of the projects in the
+// groups of the user with the given UUID, along with the user's role in each
+// of their groups. It returns true if the user is a platform-owner, in which
+// case no environments are returned.
+func candidateEnvironments(
+	ctx context.Context,
+	log *slog.Logger,
+	p *rbac.Permission,
+	keycloakUser KeycloakUserService,
+	ldb LagoonDBService,
+	userUUID uuid.UUID,
+) (
+	bool,
+	map[uuid.UUID]lagoon.UserRole,
+	[]lagoondb.EnvironmentEndpoint,
+	error,
+) {
+	platformOwner, userGroupIDRole, err := p.UserGroupRoles(ctx, log, userUUID)
+	if err != nil {
+		return false, nil, nil, err
+	}
+	if platformOwner {
+		return true, nil, nil, nil
+	}
+	// The user has access to projects in their groups, and in any descendant
+	// groups.
+	var groupIDs []uuid.UUID
+	for gid := range userGroupIDRole {
+		groupIDs = append(groupIDs, gid)
+	}
+	slices.SortFunc(groupIDs, uuid.Compare)
+	groupIDs, err = keycloakUser.DescendantGroups(ctx, groupIDs)
+	if err != nil {
+		return false, nil, nil,
+			fmt.Errorf("couldn't get descendant groups: %v", err)
+	}
+	projectIDs, err := ldb.ProjectIDsByGroupIDs(ctx, groupIDs)
+	if err != nil {
+		return false, nil, nil,
+			fmt.Errorf("couldn't get project IDs by group IDs: %v", err)
+	}
+	envs, err := ldb.EnvironmentsByProjectIDs(ctx, projectIDs)
+	if err != nil {
+		return false, nil, nil,
+			fmt.Errorf("couldn't get environments by project IDs: %v", err)
+	}
+	return false, userGroupIDRole, envs, nil
+}
+
+// environmentDecisions returns the decision of the RBAC policy on SSH access
+// by the user to each of the given environments. Decisions only depend on
+// the project and environment type, so they are cached.
+func environmentDecisions(
+	ctx context.Context,
+	log *slog.Logger,
+	p *rbac.Permission,
+	userGroupIDRole map[uuid.UUID]lagoon.UserRole,
+	envs []lagoondb.EnvironmentEndpoint,
+) ([]rbac.Decision, error) {
+	type projectEnvType struct {
+		projectID int
+		envType   lagoon.EnvironmentType
+	}
+	decisionCache := map[projectEnvType]rbac.Decision{}
+	decisions := make([]rbac.Decision, len(envs))
+	for i, env := range envs {
+		key := projectEnvType{projectID: env.ProjectID, envType: env.Type}
+		decision, ok := decisionCache[key]
+		if !ok {
+			var err error
+			decision, err = p.ProjectSSHAccess(
+				ctx, log, userGroupIDRole, env.ProjectID, env.Type)
+			if err != nil {
+				return nil,
+					fmt.Errorf("couldn't check project SSH access: %v", err)
+			}
+			decisionCache[key] = decision
+		}
+		decisions[i] = decision
+	}
+	return decisions, nil
+}
+
+// accessColumn returns the ACCESS column of the environments table for the
+// given decision, or "-" if the user can't SSH to the environment.
+func accessColumn(decision rbac.Decision) string {
+	if !decision.Allowed {
+		return "-"
+	}
+	return decision.Capability.String()
+}
+
+// environmentsSession writes a list of the environments of the projects the
+// user has access to, and the level of SSH access to each. The list is
+// limited by the --limit and --offset arguments, and the RBAC policy is only
+// evaluated for the environments in the list.
+func environmentsSession(
+	s ssh.Session,
+	log *slog.Logger,
+	m *Metrics,
+	p *rbac.Permission,
+	keycloakUser KeycloakUserService,
+	ldb LagoonDBService,
+	userUUID uuid.UUID,
+	args []string,
+	msgs *messages.Catalog,
+) {
+	ctx := s.Context()
+	limit, offset, err := parseEnvironmentsArgs(args)
+	if err != nil {
+		log.Debug("invalid environments arguments",
+			slog.Any("args", args),
+			slog.Any("error", err))
+		_, err = msgs.Fprint(ctx, s.Stderr(), messages.InvalidCommand,
+			messages.Vars{Detail: err.Error(), SessionID: ctx.SessionID()})
+		if err != nil {
+			log.Debug("couldn't write error message to session stream",
+				slog.Any("error", err))
+		}
+		return
+	}
+	// fail logs the given error and reports an internal error to the user
+	fail := func(err error) {
+		log.Warn("couldn't list accessible environments",
+			slog.Any("error", err))
+		_, err = msgs.Fprint(ctx, s.Stderr(), messages.InternalError,
+			messages.Vars{SessionID: ctx.SessionID()})
+		if err != nil {
+			log.Debug("couldn't write error message to session stream",
+				slog.Any("error", err))
+		}
+	}
+	platformOwner, userGroupIDRole, envs, err :=
+		candidateEnvironments(ctx, log, p, keycloakUser, ldb, userUUID)
+	if err != nil {
+		fail(err)
+		return
+	}
+	if platformOwner {
+		_, err = msgs.Fprint(ctx, s, messages.PlatformOwnerEnvironments,
+			messages.Vars{})
+		if err != nil {
+			log.Debug("couldn't write response to session stream",
+				slog.Any("error", err))
+		}
+		return
+	}
+	// evaluate the RBAC policy only for the requested page of environments
+	start, end := min(offset, len(envs)), min(offset+limit, len(envs))
+	decisions, err :=
+		environmentDecisions(ctx, log, p, userGroupIDRole, envs[start:end])
+	if err != nil {
+		fail(err)
+		return
+	}
+	// send response
+	w := tabwriter.NewWriter(
+		sessionio.NewWriter(ctx, s, sessionio.DefaultTimeout), 0, 0, 2, ' ', 0)
+	_, err = fmt.Fprintf(w, "NAMESPACE\tPROJECT\tENVIRONMENT\tTYPE\tACCESS\tSSH\r\n")
+	for i := start; i < end && err == nil; i++ {
+		_, err = fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\r\n",
+			envs[i].NamespaceName, envs[i].ProjectName, envs[i].Name,
+			envs[i].Type, accessColumn(decisions[i-start]), sshCommand(envs[i]))
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil && end < len(envs) {
+		_, err = msgs.Fprint(ctx, s.Stderr(), messages.EnvironmentsMore,
+			messages.Vars{First: start + 1, Last: end, Total: len(envs)})
+	}
+	if err != nil {
+		log.Debug("couldn't write response to session stream",
+			slog.Any("error", err))
+		return
+	}
+	m.environmentsTotal.Inc()
+	log.Info("sent environments response to user",
+		slog.Int("environments", len(envs)))
+}
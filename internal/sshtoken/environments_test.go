@@ -0,0 +1,246 @@
+package sshtoken_test
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/alecthomas/assert/v2"
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/uselagoon/ssh-portal/internal/lagoon"
+	"github.com/uselagoon/ssh-portal/internal/lagoondb"
+	"github.com/uselagoon/ssh-portal/internal/rbac"
+	"github.com/uselagoon/ssh-portal/internal/sshtoken"
+	gomock "go.uber.org/mock/gomock"
+)
+
+func TestParseEnvironmentsArgs(t *testing.T) {
+	var testCases = map[string]struct {
+		args         []string
+		expectLimit  int
+		expectOffset int
+		expectErr    bool
+	}{
+		"defaults": {
+			expectLimit: 50,
+		},
+		"limit": {
+			args:        []string{"--limit=10"},
+			expectLimit: 10,
+		},
+		"limit and offset": {
+			args:         []string{"--offset=20", "--limit=10"},
+			expectLimit:  10,
+			expectOffset: 20,
+		},
+		"zero limit": {
+			args:      []string{"--limit=0"},
+			expectErr: true,
+		},
+		"limit too large": {
+			args:      []string{"--limit=501"},
+			expectErr: true,
+		},
+		"negative offset": {
+			args:      []string{"--offset=-1"},
+			expectErr: true,
+		},
+		"missing value": {
+			args:      []string{"--limit"},
+			expectErr: true,
+		},
+		"unknown argument": {
+			args:      []string{"--sort=name"},
+			expectErr: true,
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			limit, offset, err := sshtoken.ParseEnvironmentsArgs(tc.args)
+			if tc.expectErr {
+				assert.Error(tt, err, name)
+				return
+			}
+			assert.NoError(tt, err, name)
+			assert.Equal(tt, tc.expectLimit, limit, name)
+			assert.Equal(tt, tc.expectOffset, offset, name)
+		})
+	}
+}
+
+// outputFields splits the given tabular output into lines of fields.
+func outputFields(output string) [][]string {
+	var lines [][]string
+	for _, line := range strings.Split(strings.TrimSpace(output), "\r\n") {
+		lines = append(lines, strings.Fields(line))
+	}
+	return lines
+}
+
+func TestEnvironmentsSession(t *testing.T) {
+	log := slog.New(slog.NewJSONHandler(os.Stderr, nil))
+	metrics := sshtoken.NewMetrics(prometheus.NewRegistry())
+	userUUID := uuid.MustParse("91435afe-ba81-406f-9308-3f0f8d7d6b43")
+	userGroupPaths := []string{"/customer-a/customer-a-developer"}
+	// the user is a developer in the customer-a group, which contains project
+	// 1, and which has a subgroup containing project 2.
+	userGroupID := uuid.MustParse("00000000-0000-0000-0000-000000000001")
+	subGroupID := uuid.MustParse("00000000-0000-0000-0000-000000000002")
+	header := []string{"NAMESPACE", "PROJECT", "ENVIRONMENT", "TYPE", "ACCESS",
+		"SSH"}
+	envs := []lagoondb.EnvironmentEndpoint{
+		{
+			Environment: lagoondb.Environment{
+				ID: 1, Name: "dev", NamespaceName: "p1-dev", ProjectID: 1,
+				ProjectName: "p1", Type: lagoon.Development,
+			},
+			SSHHost: "ssh.example.com",
+			SSHPort: "22",
+		},
+		{
+			Environment: lagoondb.Environment{
+				ID: 2, Name: "main", NamespaceName: "p1-main", ProjectID: 1,
+				ProjectName: "p1", Type: lagoon.Production,
+			},
+			SSHHost: "ssh.example.com",
+			SSHPort: "22",
+		},
+		{
+			Environment: lagoondb.Environment{
+				ID: 3, Name: "dev", NamespaceName: "p2-dev", ProjectID: 2,
+				ProjectName: "p2", Type: lagoon.Development,
+			},
+			SSHHost: "ssh2.example.com",
+			SSHPort: "2020",
+		},
+	}
+	var testCases = map[string]struct {
+		args          []string
+		realmRoles    []string
+		descendantErr error
+		// expectChecks is the number of times the SSH access of the user to
+		// each project is checked
+		expectChecks map[int]int
+		expectStdout [][]string
+		expectStderr string
+	}{
+		"all environments": {
+			expectChecks: map[int]int{1: 2, 2: 1},
+			expectStdout: [][]string{
+				header,
+				{"p1-dev", "p1", "dev", "development", "full", "ssh",
+					"p1-dev@ssh.example.com"},
+				{"p1-main", "p1", "main", "production", "-", "ssh",
+					"p1-main@ssh.example.com"},
+				{"p2-dev", "p2", "dev", "development", "full", "ssh", "-p", "2020",
+					"p2-dev@ssh2.example.com"},
+			},
+		},
+		"limited": {
+			args:         []string{"--limit=1"},
+			expectChecks: map[int]int{1: 1},
+			expectStdout: [][]string{
+				header,
+				{"p1-dev", "p1", "dev", "development", "full", "ssh",
+					"p1-dev@ssh.example.com"},
+			},
+			expectStderr: "Showing environments 1-1 of 3. " +
+				"Use --offset=1 to see more.\r\n",
+		},
+		"offset": {
+			args:         []string{"--limit=1", "--offset=2"},
+			expectChecks: map[int]int{2: 1},
+			expectStdout: [][]string{
+				header,
+				{"p2-dev", "p2", "dev", "development", "full", "ssh", "-p", "2020",
+					"p2-dev@ssh2.example.com"},
+			},
+		},
+		"offset past the end": {
+			args:         []string{"--offset=3"},
+			expectStdout: [][]string{header},
+		},
+		"platform-owner": {
+			realmRoles: []string{"platform-owner"},
+			expectStdout: [][]string{
+				strings.Fields("The platform-owner role can SSH to all environments."),
+			},
+		},
+		"descendant groups failure": {
+			descendantErr: errors.New("bad child groups response"),
+			expectStderr:  "internal error. SID: abc123\r\n",
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			ctrl := gomock.NewController(tt)
+			keycloakToken := NewMockKeycloakTokenService(ctrl)
+			keycloakUser := NewMockKeycloakUserService(ctrl)
+			ldbService := NewMockLagoonDBService(ctrl)
+			kcService := NewMockRBACKeycloakService(ctrl)
+			rbacLDBService := NewMockRBACLagoonDBService(ctrl)
+			sshSession := NewMockSession(ctrl)
+			sshContext := NewMockContext(ctrl)
+			p := rbac.NewPermission(kcService, rbacLDBService)
+			var stdout, stderr bytes.Buffer
+			// configure session mocks
+			sshSession.EXPECT().Context().Return(sshContext).Times(2)
+			sshSession.EXPECT().Command().
+				Return(append([]string{"environments"}, tc.args...))
+			sshSession.EXPECT().Stderr().Return(&stderr).AnyTimes()
+			sshSession.EXPECT().Write(gomock.Any()).DoAndReturn(stdout.Write).
+				AnyTimes()
+			sshContext.EXPECT().SessionID().Return("abc123").AnyTimes()
+			emulateLiveContext(sshContext)
+			// configure user group mocks
+			kcService.EXPECT().UserRolesAndGroups(sshContext, userUUID).
+				Return(tc.realmRoles, userGroupPaths, nil)
+			if len(tc.realmRoles) == 0 {
+				kcService.EXPECT().UserGroupIDRole(sshContext, userGroupPaths).
+					Return(map[uuid.UUID]lagoon.UserRole{userGroupID: lagoon.Developer})
+				if tc.descendantErr != nil {
+					keycloakUser.EXPECT().
+						DescendantGroups(sshContext, []uuid.UUID{userGroupID}).
+						Return(nil, tc.descendantErr)
+				} else {
+					keycloakUser.EXPECT().
+						DescendantGroups(sshContext, []uuid.UUID{userGroupID}).
+						Return([]uuid.UUID{userGroupID, subGroupID}, nil)
+					ldbService.EXPECT().ProjectIDsByGroupIDs(sshContext,
+						[]uuid.UUID{userGroupID, subGroupID}).Return([]int{1, 2}, nil)
+					ldbService.EXPECT().EnvironmentsByProjectIDs(sshContext, []int{1, 2}).
+						Return(envs, nil)
+					// project permissions are checked once per environment
+					// type, and only for the listed environments
+					rbacLDBService.EXPECT().ProjectGroupIDs(sshContext, 1).
+						Return([]uuid.UUID{userGroupID}, nil).
+						Times(tc.expectChecks[1])
+					kcService.EXPECT().AncestorGroups(sshContext,
+						[]uuid.UUID{userGroupID}).
+						Return([]uuid.UUID{userGroupID}, nil).
+						Times(tc.expectChecks[1])
+					rbacLDBService.EXPECT().ProjectGroupIDs(sshContext, 2).
+						Return([]uuid.UUID{subGroupID}, nil).
+						Times(tc.expectChecks[2])
+					kcService.EXPECT().AncestorGroups(sshContext,
+						[]uuid.UUID{subGroupID}).
+						Return([]uuid.UUID{userGroupID, subGroupID}, nil).
+						Times(tc.expectChecks[2])
+				}
+			}
+			// execute
+			sshtoken.TokenSession(sshSession, log, metrics, p, keycloakToken,
+				keycloakUser, ldbService, userUUID, "SHA256:abc", nil)
+			if tc.expectStdout != nil {
+				assert.Equal(tt, tc.expectStdout, outputFields(stdout.String()), name)
+			} else {
+				assert.Equal(tt, "", stdout.String(), name)
+			}
+			assert.Equal(tt, tc.expectStderr, stderr.String(), name)
+		})
+	}
+}
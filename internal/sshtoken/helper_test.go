@@ -1,10 +1,22 @@
 package sshtoken
 
+import "github.com/prometheus/client_golang/prometheus"
+
 // These variables are exposed for testing only.
 var (
-	PubKeyHandler = pubKeyHandler
+	PubKeyHandler         = pubKeyHandler
+	RedirectSession       = redirectSession
+	TokenSession          = tokenSession
+	ParseEnvironmentsArgs = parseEnvironmentsArgs
+	SessionHandler        = sessionHandler
 )
 
 const (
 	UserUUIDKey = userUUIDKey
 )
+
+// KeyUsedErrorsTotal exposes the private keyUsedErrorsTotal metric for
+// testing only.
+func (m *Metrics) KeyUsedErrorsTotal() prometheus.Counter {
+	return m.keyUsedErrorsTotal
+}
@@ -0,0 +1,57 @@
+package sshtoken
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Metrics contains the Prometheus metrics exported by the ssh-token server.
+type Metrics struct {
+	sessionTotal             prometheus.Counter
+	sessionPanicsTotal       prometheus.Counter
+	tokensGeneratedTotal     prometheus.Counter
+	redirectsTotal           prometheus.Counter
+	whoamiTotal              prometheus.Counter
+	environmentsTotal        prometheus.Counter
+	keyPolicyRejectionsTotal *prometheus.CounterVec
+	keyUsedErrorsTotal       prometheus.Counter
+}
+
+// NewMetrics creates the ssh-token server metrics and registers them with reg.
+func NewMetrics(reg prometheus.Registerer) *Metrics {
+	factory := promauto.With(reg)
+	return &Metrics{
+		sessionTotal: factory.NewCounter(prometheus.CounterOpts{
+			Name: "sshtoken_sessions_total",
+			Help: "The total number of ssh-token sessions started",
+		}),
+		sessionPanicsTotal: factory.NewCounter(prometheus.CounterOpts{
+			Name: "sshtoken_session_panics_total",
+			Help: "The total number of panics recovered in ssh-token session handlers",
+		}),
+		tokensGeneratedTotal: factory.NewCounter(prometheus.CounterOpts{
+			Name: "sshtoken_tokens_generated_total",
+			Help: "The total number of ssh-token user access tokens generated",
+		}),
+		redirectsTotal: factory.NewCounter(prometheus.CounterOpts{
+			Name: "sshtoken_redirects_total",
+			Help: "The total number of ssh redirect responses served",
+		}),
+		whoamiTotal: factory.NewCounter(prometheus.CounterOpts{
+			Name: "sshtoken_whoami_total",
+			Help: "The total number of ssh-token whoami responses served",
+		}),
+		environmentsTotal: factory.NewCounter(prometheus.CounterOpts{
+			Name: "sshtoken_environments_total",
+			Help: "The total number of ssh-token environments responses served",
+		}),
+		keyPolicyRejectionsTotal: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "sshtoken_key_policy_rejections_total",
+			Help: "The total number of public keys rejected by the key policy",
+		}, []string{"key_type"}),
+		keyUsedErrorsTotal: factory.NewCounter(prometheus.CounterOpts{
+			Name: "sshtoken_key_used_errors_total",
+			Help: "The total number of failed updates of the last used time of SSH keys",
+		}),
+	}
+}
@@ -0,0 +1,79 @@
+package sshtoken
+
+import (
+	"errors"
+	"net"
+
+	"github.com/uselagoon/ssh-portal/internal/keypolicy"
+	"github.com/uselagoon/ssh-portal/internal/messages"
+	"github.com/uselagoon/ssh-portal/internal/rbac"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// Options configures the ssh server started by Serve. The zero value of each
+// optional field is replaced by a sensible default.
+type Options struct {
+	// Metrics is the set of metrics updated by the server. If nil, a set of
+	// unregistered metrics is used.
+	Metrics *Metrics
+	// Listener accepts SSH connections. Required.
+	Listener net.Listener
+	// Permission is the RBAC permission engine. Required.
+	Permission *rbac.Permission
+	// LagoonDB is used to query the Lagoon API DB. Required.
+	LagoonDB LagoonDBService
+	// SSHEndpoint is used to look up the SSH endpoint users are redirected
+	// to. If nil, endpoints are looked up in the Lagoon API DB.
+	SSHEndpoint SSHEndpointService
+	// KeycloakToken is used to generate user tokens. Required.
+	KeycloakToken KeycloakTokenService
+	// KeycloakUser is used to query user details. Required.
+	KeycloakUser KeycloakUserService
+	// HostKeys are the host keys of the server, as returned by
+	// hostkey.Parse. If empty, an ephemeral host key is generated.
+	HostKeys []gossh.Signer
+	// KeyPolicy restricts the public keys which are accepted. If nil, all
+	// keys are accepted.
+	KeyPolicy *keypolicy.Policy
+	// Messages contains the user-facing messages printed to clients. If nil,
+	// the default messages are used.
+	Messages *messages.Catalog
+}
+
+// validate returns an error if the options can't be used to start a server.
+func (o *Options) validate() error {
+	if o.Listener == nil {
+		return errors.New("missing listener")
+	}
+	if o.Permission == nil {
+		return errors.New("missing permission engine")
+	}
+	if o.LagoonDB == nil {
+		return errors.New("missing Lagoon DB service")
+	}
+	if o.KeycloakToken == nil {
+		return errors.New("missing Keycloak token service")
+	}
+	if o.KeycloakUser == nil {
+		return errors.New("missing Keycloak user service")
+	}
+	for _, hk := range o.HostKeys {
+		if hk == nil {
+			return errors.New("nil host key")
+		}
+	}
+	return nil
+}
+
+// setDefaults replaces the zero value of optional fields with their default.
+func (o *Options) setDefaults() {
+	if o.Metrics == nil {
+		o.Metrics = NewMetrics(nil)
+	}
+	if o.SSHEndpoint == nil {
+		o.SSHEndpoint = o.LagoonDB
+	}
+	if o.KeyPolicy == nil {
+		o.KeyPolicy = &keypolicy.Policy{}
+	}
+}
@@ -0,0 +1,76 @@
+package sshtoken
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/alecthomas/assert/v2"
+	"github.com/uselagoon/ssh-portal/internal/rbac"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+func TestOptionsValidate(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	var testCases = map[string]struct {
+		modify      func(*Options)
+		expectError bool
+	}{
+		"valid": {
+			modify: func(*Options) {},
+		},
+		"nil listener": {
+			modify:      func(o *Options) { o.Listener = nil },
+			expectError: true,
+		},
+		"nil permission": {
+			modify:      func(o *Options) { o.Permission = nil },
+			expectError: true,
+		},
+		"nil Lagoon DB": {
+			modify:      func(o *Options) { o.LagoonDB = nil },
+			expectError: true,
+		},
+		"nil Keycloak token service": {
+			modify:      func(o *Options) { o.KeycloakToken = nil },
+			expectError: true,
+		},
+		"nil Keycloak user service": {
+			modify:      func(o *Options) { o.KeycloakUser = nil },
+			expectError: true,
+		},
+		"nil host key": {
+			modify:      func(o *Options) { o.HostKeys = []gossh.Signer{nil} },
+			expectError: true,
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			opts := Options{
+				Listener:      l,
+				Permission:    &rbac.Permission{},
+				LagoonDB:      struct{ LagoonDBService }{},
+				KeycloakToken: struct{ KeycloakTokenService }{},
+				KeycloakUser:  struct{ KeycloakUserService }{},
+			}
+			tc.modify(&opts)
+			if tc.expectError {
+				assert.Error(tt, opts.validate(), name)
+			} else {
+				assert.NoError(tt, opts.validate(), name)
+			}
+		})
+	}
+}
+
+func TestServeInvalidOptions(t *testing.T) {
+	log := slog.New(slog.NewJSONHandler(os.Stderr, nil))
+	// Serve returns an error rather than panicking
+	assert.Error(t, Serve(context.Background(), log, Options{}))
+}
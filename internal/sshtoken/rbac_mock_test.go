@@ -0,0 +1,127 @@
+// Code generated by MockGen. DO NOT EDIT.
+// Source: github.com/uselagoon/ssh-portal/internal/rbac (interfaces: KeycloakService,LagoonDBService)
+//
+// Generated by this command:
+//
+//	mockgen -package=sshtoken_test -destination=rbac_mock_test.go -write_generate_directive -mock_names=KeycloakService=MockRBACKeycloakService,LagoonDBService=MockRBACLagoonDBService github.com/uselagoon/ssh-portal/internal/rbac KeycloakService,LagoonDBService
+//
+
+// Package sshtoken_test is a generated GoMock package.
+package sshtoken_test
+
+import (
+	context "context"
+	reflect "reflect"
+
+	uuid "github.com/google/uuid"
+	lagoon "github.com/uselagoon/ssh-portal/internal/lagoon"
+	gomock "go.uber.org/mock/gomock"
+)
+
+//go:generate mockgen -package=sshtoken_test -destination=rbac_mock_test.go -write_generate_directive -mock_names=KeycloakService=MockRBACKeycloakService,LagoonDBService=MockRBACLagoonDBService github.com/uselagoon/ssh-portal/internal/rbac KeycloakService,LagoonDBService
+
+// MockRBACKeycloakService is a mock of KeycloakService interface.
+type MockRBACKeycloakService struct {
+	ctrl     *gomock.Controller
+	recorder *MockRBACKeycloakServiceMockRecorder
+}
+
+// MockRBACKeycloakServiceMockRecorder is the mock recorder for MockRBACKeycloakService.
+type MockRBACKeycloakServiceMockRecorder struct {
+	mock *MockRBACKeycloakService
+}
+
+// NewMockRBACKeycloakService creates a new mock instance.
+func NewMockRBACKeycloakService(ctrl *gomock.Controller) *MockRBACKeycloakService {
+	mock := &MockRBACKeycloakService{ctrl: ctrl}
+	mock.recorder = &MockRBACKeycloakServiceMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockRBACKeycloakService) EXPECT() *MockRBACKeycloakServiceMockRecorder {
+	return m.recorder
+}
+
+// AncestorGroups mocks base method.
+func (m *MockRBACKeycloakService) AncestorGroups(arg0 context.Context, arg1 []uuid.UUID) ([]uuid.UUID, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "AncestorGroups", arg0, arg1)
+	ret0, _ := ret[0].([]uuid.UUID)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// AncestorGroups indicates an expected call of AncestorGroups.
+func (mr *MockRBACKeycloakServiceMockRecorder) AncestorGroups(arg0, arg1 any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AncestorGroups", reflect.TypeOf((*MockRBACKeycloakService)(nil).AncestorGroups), arg0, arg1)
+}
+
+// UserGroupIDRole mocks base method.
+func (m *MockRBACKeycloakService) UserGroupIDRole(arg0 context.Context, arg1 []string) map[uuid.UUID]lagoon.UserRole {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "UserGroupIDRole", arg0, arg1)
+	ret0, _ := ret[0].(map[uuid.UUID]lagoon.UserRole)
+	return ret0
+}
+
+// UserGroupIDRole indicates an expected call of UserGroupIDRole.
+func (mr *MockRBACKeycloakServiceMockRecorder) UserGroupIDRole(arg0, arg1 any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UserGroupIDRole", reflect.TypeOf((*MockRBACKeycloakService)(nil).UserGroupIDRole), arg0, arg1)
+}
+
+// UserRolesAndGroups mocks base method.
+func (m *MockRBACKeycloakService) UserRolesAndGroups(arg0 context.Context, arg1 uuid.UUID) ([]string, []string, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "UserRolesAndGroups", arg0, arg1)
+	ret0, _ := ret[0].([]string)
+	ret1, _ := ret[1].([]string)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+// UserRolesAndGroups indicates an expected call of UserRolesAndGroups.
+func (mr *MockRBACKeycloakServiceMockRecorder) UserRolesAndGroups(arg0, arg1 any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UserRolesAndGroups", reflect.TypeOf((*MockRBACKeycloakService)(nil).UserRolesAndGroups), arg0, arg1)
+}
+
+// MockRBACLagoonDBService is a mock of LagoonDBService interface.
+type MockRBACLagoonDBService struct {
+	ctrl     *gomock.Controller
+	recorder *MockRBACLagoonDBServiceMockRecorder
+}
+
+// MockRBACLagoonDBServiceMockRecorder is the mock recorder for MockRBACLagoonDBService.
+type MockRBACLagoonDBServiceMockRecorder struct {
+	mock *MockRBACLagoonDBService
+}
+
+// NewMockRBACLagoonDBService creates a new mock instance.
+func NewMockRBACLagoonDBService(ctrl *gomock.Controller) *MockRBACLagoonDBService {
+	mock := &MockRBACLagoonDBService{ctrl: ctrl}
+	mock.recorder = &MockRBACLagoonDBServiceMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockRBACLagoonDBService) EXPECT() *MockRBACLagoonDBServiceMockRecorder {
+	return m.recorder
+}
+
+// ProjectGroupIDs mocks base method.
+func (m *MockRBACLagoonDBService) ProjectGroupIDs(arg0 context.Context, arg1 int) ([]uuid.UUID, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ProjectGroupIDs", arg0, arg1)
+	ret0, _ := ret[0].([]uuid.UUID)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ProjectGroupIDs indicates an expected call of ProjectGroupIDs.
+func (mr *MockRBACLagoonDBServiceMockRecorder) ProjectGroupIDs(arg0, arg1 any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ProjectGroupIDs", reflect.TypeOf((*MockRBACLagoonDBService)(nil).ProjectGroupIDs), arg0, arg1)
+}
@@ -6,13 +6,12 @@ import (
 	"errors"
 	"fmt"
 	"log/slog"
-	"net"
 	"time"
 
 	"github.com/gliderlabs/ssh"
-	"github.com/uselagoon/ssh-portal/internal/keycloak"
+	"github.com/google/uuid"
 	"github.com/uselagoon/ssh-portal/internal/lagoondb"
-	"github.com/uselagoon/ssh-portal/internal/rbac"
+	"github.com/uselagoon/ssh-portal/internal/recovery"
 )
 
 // give an 8 second deadline to shut down cleanly.
@@ -24,26 +23,28 @@ type LagoonDBService interface {
 	UserBySSHFingerprint(context.Context, string) (*lagoondb.User, error)
 	SSHEndpointByEnvironmentID(context.Context, int) (string, string, error)
 	SSHKeyUsed(context.Context, string, time.Time) error
+	ProjectIDsByGroupIDs(context.Context, []uuid.UUID) ([]int, error)
+	EnvironmentsByProjectIDs(context.Context, []int) (
+		[]lagoondb.EnvironmentEndpoint, error)
 }
 
-// Serve contains the main ssh session logic
-func Serve(
-	ctx context.Context,
-	log *slog.Logger,
-	l net.Listener,
-	p *rbac.Permission,
-	ldb *lagoondb.Client,
-	keycloakToken *keycloak.Client,
-	hostKeys [][]byte,
-) error {
+// Serve contains the main ssh session logic. It returns an error without
+// starting the server if opts are invalid.
+func Serve(ctx context.Context, log *slog.Logger, opts Options) error {
+	if err := opts.validate(); err != nil {
+		return fmt.Errorf("invalid options: %v", err)
+	}
+	opts.setDefaults()
+	m := opts.Metrics
 	srv := ssh.Server{
-		Handler:          sessionHandler(log, p, keycloakToken, ldb),
-		PublicKeyHandler: pubKeyHandler(log, ldb),
+		Handler: recovery.SSHHandler(log, m.sessionPanicsTotal,
+			sessionHandler(log, m, opts.Permission, opts.KeycloakToken,
+				opts.KeycloakUser, opts.LagoonDB, opts.SSHEndpoint,
+				opts.Messages)),
+		PublicKeyHandler: pubKeyHandler(log, m, opts.LagoonDB, opts.KeyPolicy),
 	}
-	for _, hk := range hostKeys {
-		if err := srv.SetOption(ssh.HostKeyPEM(hk)); err != nil {
-			return fmt.Errorf("invalid host key: %v", err)
-		}
+	for _, hk := range opts.HostKeys {
+		srv.AddHostKey(hk)
 	}
 	go func() {
 		// As soon as the top level context is cancelled, shut down the server.
@@ -54,7 +55,7 @@ func Serve(
 			log.Warn("couldn't shutdown cleanly", slog.Any("error", err))
 		}
 	}()
-	if err := srv.Serve(l); !errors.Is(err, ssh.ErrServerClosed) {
+	if err := srv.Serve(opts.Listener); !errors.Is(err, ssh.ErrServerClosed) {
 		return err
 	}
 	return nil
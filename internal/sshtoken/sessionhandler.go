@@ -2,6 +2,7 @@ package sshtoken
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"log/slog"
@@ -9,13 +10,20 @@ import (
 
 	"github.com/gliderlabs/ssh"
 	"github.com/google/uuid"
-	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/uselagoon/ssh-portal/internal/bus"
+	"github.com/uselagoon/ssh-portal/internal/keycloak"
 	"github.com/uselagoon/ssh-portal/internal/lagoondb"
+	"github.com/uselagoon/ssh-portal/internal/messages"
 	"github.com/uselagoon/ssh-portal/internal/rbac"
+	"github.com/uselagoon/ssh-portal/internal/sessionio"
+	"github.com/uselagoon/ssh-portal/internal/sessionlog"
 	gossh "golang.org/x/crypto/ssh"
 )
 
+// keyUsedTimeout is the time allowed to update the last used time of the SSH
+// key which authenticated a session.
+const keyUsedTimeout = 2 * time.Second
+
 // KeycloakTokenService provides methods for querying the Keycloak API for user
 // access tokens.
 type KeycloakTokenService interface {
@@ -23,42 +31,130 @@ type KeycloakTokenService interface {
 	UserAccessToken(context.Context, uuid.UUID) (string, error)
 }
 
-var (
-	sessionTotal = promauto.NewCounter(prometheus.CounterOpts{
-		Name: "sshtoken_sessions_total",
-		Help: "The total number of ssh-token sessions started",
-	})
-	tokensGeneratedTotal = promauto.NewCounter(prometheus.CounterOpts{
-		Name: "sshtoken_tokens_generated_total",
-		Help: "The total number of ssh-token user access tokens generated",
-	})
-	redirectsTotal = promauto.NewCounter(prometheus.CounterOpts{
-		Name: "sshtoken_redirects_total",
-		Help: "The total number of ssh redirect responses served",
-	})
-)
+// KeycloakUserService provides methods for querying the Keycloak API for user
+// details.
+type KeycloakUserService interface {
+	UserByUUID(context.Context, uuid.UUID) (*keycloak.User, error)
+	DescendantGroups(context.Context, []uuid.UUID) ([]uuid.UUID, error)
+}
+
+// whoamiResponse is the JSON structure of the whoami command response.
+type whoamiResponse struct {
+	UserUUID       string `json:"userUUID"`
+	Email          string `json:"email"`
+	SSHFingerprint string `json:"sshFingerprint"`
+}
+
+// whoamiSession writes the UUID and email of the user, and the fingerprint of
+// the SSH key which authenticated the session. If args contains "json" the
+// response is formatted as JSON, otherwise it is plain text. No token is
+// generated.
+func whoamiSession(
+	s ssh.Session,
+	log *slog.Logger,
+	m *Metrics,
+	keycloakUser KeycloakUserService,
+	userUUID uuid.UUID,
+	fingerprint string,
+	args []string,
+	msgs *messages.Catalog,
+) {
+	ctx := s.Context()
+	if len(args) > 1 || (len(args) == 1 && args[0] != "json") {
+		log.Debug("invalid whoami arguments",
+			slog.Any("args", args))
+		_, err := msgs.Fprint(ctx, s.Stderr(), messages.InvalidCommand,
+			messages.Vars{
+				Detail:    `whoami only supports a "json" argument`,
+				SessionID: ctx.SessionID(),
+			})
+		if err != nil {
+			log.Debug("couldn't write error message to session stream",
+				slog.Any("error", err))
+		}
+		return
+	}
+	user, err := keycloakUser.UserByUUID(ctx, userUUID)
+	if err != nil {
+		log.Warn("couldn't get user details",
+			slog.Any("error", err))
+		_, err = msgs.Fprint(ctx, s.Stderr(), messages.InternalError,
+			messages.Vars{SessionID: ctx.SessionID()})
+		if err != nil {
+			log.Debug("couldn't write error message to session stream",
+				slog.Any("error", err))
+		}
+		return
+	}
+	// send response
+	if len(args) == 1 {
+		var data []byte
+		data, err = json.Marshal(whoamiResponse{
+			UserUUID:       userUUID.String(),
+			Email:          user.Email,
+			SSHFingerprint: fingerprint,
+		})
+		if err == nil {
+			_, err = sessionio.Fprintf(ctx, s, "%s\r\n", data)
+		}
+	} else {
+		_, err = msgs.Fprint(ctx, s, messages.Whoami,
+			messages.Vars{
+				UserUUID:       userUUID.String(),
+				Email:          user.Email,
+				SSHFingerprint: fingerprint,
+			})
+	}
+	if err != nil {
+		log.Debug("couldn't write response to session stream",
+			slog.Any("error", err))
+		return
+	}
+	m.whoamiTotal.Inc()
+	log.Info("sent whoami response to user")
+}
 
 // tokenSession returns a bare access token or full access token response based
 // on the user ID
 func tokenSession(
 	s ssh.Session,
 	log *slog.Logger,
+	m *Metrics,
+	p *rbac.Permission,
 	keycloakToken KeycloakTokenService,
+	keycloakUser KeycloakUserService,
+	ldb LagoonDBService,
 	userUUID uuid.UUID,
+	fingerprint string,
+	msgs *messages.Catalog,
 ) {
 	// valid commands:
 	// - grant: returns a full access token response as per
 	//   https://www.rfc-editor.org/rfc/rfc6749#section-4.1.4
 	// - token: returns a bare access token (the contents of the access_token
 	//   field inside a full token access token response)
+	// - whoami: returns the user and key details, without generating a token
+	// - environments: returns the environments of the user's projects and
+	//   the user's SSH access to each, without generating a token
 	ctx := s.Context()
 	cmd := s.Command()
+	if len(cmd) > 0 {
+		switch cmd[0] {
+		case "whoami":
+			whoamiSession(s, log, m, keycloakUser, userUUID, fingerprint,
+				cmd[1:], msgs)
+			return
+		case "environments":
+			environmentsSession(s, log, m, p, keycloakUser, ldb, userUUID,
+				cmd[1:], msgs)
+			return
+		}
+	}
 	if len(cmd) != 1 {
 		log.Debug("too many arguments",
 			slog.Any("command", cmd))
-		_, err := fmt.Fprintf(s.Stderr(),
-			"invalid command: only \"grant\" and \"token\" are supported. SID: %s\r\n",
-			ctx.SessionID())
+		_, err := msgs.Fprint(ctx, s.Stderr(), messages.UnsupportedCommand,
+			messages.Vars{SessionID: ctx.SessionID()})
 		if err != nil {
 			log.Debug("couldn't write error message to session stream",
 				slog.Any("error", err))
@@ -74,8 +170,8 @@ func tokenSession(
 		if err != nil {
 			log.Warn("couldn't get user access token response",
 				slog.Any("error", err))
-			_, err = fmt.Fprintf(s.Stderr(),
-				"internal error. SID: %s\r\n", ctx.SessionID())
+			_, err = msgs.Fprint(ctx, s.Stderr(), messages.InternalError,
+				messages.Vars{SessionID: ctx.SessionID()})
 			if err != nil {
 				log.Debug("couldn't write error message to session stream",
 					slog.Any("error", err))
@@ -87,9 +183,8 @@ func tokenSession(
 		if err != nil {
 			log.Warn("couldn't get user access token",
 				slog.Any("error", err))
-			_, err = fmt.Fprintf(s.Stderr(),
-				"internal error. SID: %s\r\n",
-				ctx.SessionID())
+			_, err = msgs.Fprint(ctx, s.Stderr(), messages.InternalError,
+				messages.Vars{SessionID: ctx.SessionID()})
 			if err != nil {
 				log.Debug("couldn't write error message to session stream",
 					slog.Any("error", err))
@@ -99,9 +194,8 @@ func tokenSession(
 	default:
 		log.Debug("invalid command",
 			slog.Any("command", cmd))
-		_, err := fmt.Fprintf(s.Stderr(),
-			"invalid command: only \"grant\" and \"token\" are supported. SID: %s\r\n",
-			ctx.SessionID())
+		_, err := msgs.Fprint(ctx, s.Stderr(), messages.UnsupportedCommand,
+			messages.Vars{SessionID: ctx.SessionID()})
 		if err != nil {
 			log.Debug("couldn't write error message to session stream",
 				slog.Any("error", err))
@@ -109,42 +203,52 @@ func tokenSession(
 		return
 	}
 	// send response
-	_, err = fmt.Fprintf(s, "%s\r\n", response)
+	_, err = sessionio.Fprintf(ctx, s, "%s\r\n", response)
 	if err != nil {
 		log.Debug("couldn't write response to session stream",
 			slog.Any("error", err))
 		return
 	}
-	tokensGeneratedTotal.Inc()
+	m.tokensGeneratedTotal.Inc()
 	log.Info("generated token for user")
 }
 
 // redirectSession inspects the user string, and if it matches a namespace that
 // the user has access to, returns an error message to the user with the SSH
-// endpoint to use for ssh shell access. If the user doesn't have access to the
+// endpoint to use for ssh shell access. If the namespace doesn't match any
+// environment, the user is told so. Namespace existence is not sensitive, and
+// this helps users to spot typos. If the user doesn't have access to the
 // environment a generic error message is returned.
 func redirectSession(
 	s ssh.Session,
 	log *slog.Logger,
+	m *Metrics,
 	p *rbac.Permission,
 	ldb LagoonDBService,
+	endpoints SSHEndpointService,
 	userUUID uuid.UUID,
+	msgs *messages.Catalog,
 ) {
 	ctx := s.Context()
 	env, err := ldb.EnvironmentByNamespaceName(s.Context(), s.User())
 	if err != nil {
 		if errors.Is(err, lagoondb.ErrNoResult) {
 			log.Info("unknown namespace name",
-				slog.String("namespaceName", s.User()),
-				slog.Any("error", err))
-		} else {
-			log.Error("couldn't get environment by namespace name",
-				slog.String("namespaceName", s.User()),
+				slog.String(sessionlog.NamespaceKey, s.User()),
 				slog.Any("error", err))
+			_, err = msgs.Fprint(ctx, s.Stderr(), messages.UnknownEnvironment,
+				messages.Vars{Namespace: s.User(), SessionID: ctx.SessionID()})
+			if err != nil {
+				log.Debug("couldn't write error message to session stream",
+					slog.Any("error", err))
+			}
+			return
 		}
-		_, err = fmt.Fprintf(s.Stderr(),
-			"This SSH server does not provide shell access. SID: %s\r\n",
-			ctx.SessionID())
+		log.Error("couldn't get environment by namespace name",
+			slog.String(sessionlog.NamespaceKey, s.User()),
+			slog.Any("error", err))
+		_, err = msgs.Fprint(ctx, s.Stderr(), messages.NoShellAccess,
+			messages.Vars{SessionID: ctx.SessionID()})
 		if err != nil {
 			log.Debug("couldn't write error message to session stream",
 				slog.Any("error", err))
@@ -156,9 +260,8 @@ func redirectSession(
 		slog.Int("projectID", env.ProjectID),
 		slog.String("environmentName", env.Name),
 		slog.String("environmentType", env.Type.String()),
-		slog.String("namespaceName", s.User()),
+		slog.String(sessionlog.NamespaceKey, s.User()),
 		slog.String("projectName", env.ProjectName),
-		slog.String("userUUID", userUUID.String()),
 	)
 	// check permission
 	ok, err := p.UserCanSSHToEnvironment(
@@ -168,9 +271,8 @@ func redirectSession(
 	}
 	if !ok {
 		log.Info("user cannot SSH to environment")
-		_, err = fmt.Fprintf(s.Stderr(),
-			"This SSH server does not provide shell access. SID: %s\r\n",
-			ctx.SessionID())
+		_, err = msgs.Fprint(ctx, s.Stderr(), messages.NoShellAccess,
+			messages.Vars{SessionID: ctx.SessionID()})
 		if err != nil {
 			log.Debug("couldn't write error message to session stream",
 				slog.Any("error", err))
@@ -178,43 +280,40 @@ func redirectSession(
 		return
 	}
 	log.Info("user can SSH to environment")
-	sshHost, sshPort, err := ldb.SSHEndpointByEnvironmentID(s.Context(), env.ID)
+	sshHost, sshPort, err :=
+		endpoints.SSHEndpointByEnvironmentID(s.Context(), env.ID)
 	if err != nil {
-		if errors.Is(err, lagoondb.ErrNoResult) {
+		if errors.Is(err, lagoondb.ErrNoResult) ||
+			errors.Is(err, bus.ErrUnknownEnvironment) {
 			log.Warn("no results for ssh endpoint by environment ID",
 				slog.Any("error", err))
 		} else {
 			log.Error("couldn't get ssh endpoint by environment ID",
 				slog.Any("error", err))
 		}
-		_, err = fmt.Fprintf(s.Stderr(),
-			"This SSH server does not provide shell access. SID: %s\r\n",
-			ctx.SessionID())
+		_, err = msgs.Fprint(ctx, s.Stderr(), messages.NoShellAccess,
+			messages.Vars{SessionID: ctx.SessionID()})
 		if err != nil {
 			log.Debug("couldn't write error message to session stream",
 				slog.Any("error", err))
 		}
 		return
 	}
-	preamble :=
-		"This SSH server does not provide shell access to your environment.\r\n" +
-			"To SSH into your environment use this endpoint:\r\n\n"
-	// send response
-	if sshPort == "22" {
-		_, err = fmt.Fprintf(s.Stderr(),
-			preamble+"\tssh %s@%s\r\n\nSID: %s\r\n",
-			s.User(), sshHost, ctx.SessionID())
-	} else {
-		_, err = fmt.Fprintf(s.Stderr(),
-			preamble+"\tssh -p %s %s@%s\r\n\nSID: %s\r\n",
-			sshPort, s.User(), sshHost, ctx.SessionID())
+	endpoint := fmt.Sprintf("ssh %s@%s", s.User(), sshHost)
+	if sshPort != "22" {
+		endpoint = fmt.Sprintf("ssh -p %s %s@%s", sshPort, s.User(), sshHost)
 	}
+	// send response
+	_, err = msgs.Fprint(ctx, s.Stderr(), messages.Redirect, messages.Vars{
+		Endpoint:  endpoint,
+		SessionID: ctx.SessionID(),
+	})
 	if err != nil {
 		log.Debug("couldn't write response to session stream",
 			slog.Any("error", err))
 		return
 	}
-	redirectsTotal.Inc()
+	m.redirectsTotal.Inc()
 	log.Info("redirected user to SSH portal endpoint",
 		slog.String("sshHost", sshHost),
 		slog.String("sshPort", sshPort))
@@ -231,48 +330,73 @@ func permissionsUnmarshal(ctx ssh.Context) (uuid.UUID, error) {
 	return uuid.Parse(userUUIDString)
 }
 
+// keyUsed updates the last_used attribute of the SSH key with the given
+// fingerprint. It is not bound by the cancellation of ctx, so that the update
+// completes if the session ends first. Failure is logged and counted, but
+// otherwise ignored.
+func keyUsed(
+	ctx context.Context,
+	log *slog.Logger,
+	m *Metrics,
+	ldb LagoonDBService,
+	fingerprint string,
+) {
+	ctx, cancel :=
+		context.WithTimeout(context.WithoutCancel(ctx), keyUsedTimeout)
+	defer cancel()
+	if err := ldb.SSHKeyUsed(ctx, fingerprint, time.Now()); err != nil {
+		m.keyUsedErrorsTotal.Inc()
+		log.Warn("couldn't update ssh key last used",
+			slog.Any("error", err))
+	}
+}
+
 // sessionHandler returns a ssh.Handler which writes a Lagoon access token to
 // the session stream and then closes the connection.
 func sessionHandler(
 	log *slog.Logger,
+	m *Metrics,
 	p *rbac.Permission,
 	keycloakToken KeycloakTokenService,
+	keycloakUser KeycloakUserService,
 	ldb LagoonDBService,
+	endpoints SSHEndpointService,
+	msgs *messages.Catalog,
 ) ssh.Handler {
 	return func(s ssh.Session) {
-		sessionTotal.Inc()
+		m.sessionTotal.Inc()
 		ctx := s.Context()
 		fingerprint := gossh.FingerprintSHA256(s.PublicKey())
-		log = log.With(
-			slog.String("fingerprint", fingerprint),
-			slog.String("sessionID", ctx.SessionID()),
-		)
-		// update last_used, since at this point the key has been used to
-		// authenticate the session
-		if err := ldb.SSHKeyUsed(ctx, fingerprint, time.Now()); err != nil {
-			log.Error("couldn't update ssh key last used: %v",
-				slog.Any("error", err))
-			return
-		}
 		// Get the user UUID to pass on to the tokenSession or redirectSession
 		userUUID, err := permissionsUnmarshal(ctx)
 		if err != nil {
 			log.Warn(
 				"couldn't get userUUID from ssh session context",
+				slog.String(sessionlog.SessionIDKey, ctx.SessionID()),
 				slog.Any("error", err))
-			_, err := fmt.Fprintf(s.Stderr(), "internal error. SID: %s\r\n",
-				ctx.SessionID())
+			_, err := msgs.Fprint(ctx, s.Stderr(), messages.InternalError,
+				messages.Vars{SessionID: ctx.SessionID()})
 			if err != nil {
 				log.Debug("couldn't write error message to session stream",
 					slog.Any("error", err))
 			}
 			return
 		}
-		log = log.With(slog.String("userUUID", userUUID.String()))
+		log := sessionlog.New(ctx, log, sessionlog.Fields{
+			SessionID:      ctx.SessionID(),
+			SSHFingerprint: fingerprint,
+			UserUUID:       userUUID.String(),
+		})
+		// update last_used, since at this point the key has been used to
+		// authenticate the session. This happens in the background so that
+		// database latency doesn't delay the response, and a failed update
+		// doesn't prevent the user from getting a token.
+		go keyUsed(ctx, log, m, ldb, fingerprint)
 		if s.User() == "lagoon" {
-			tokenSession(s, log, keycloakToken, userUUID)
+			tokenSession(s, log, m, p, keycloakToken, keycloakUser, ldb, userUUID,
+				fingerprint, msgs)
 		} else {
-			redirectSession(s, log, p, ldb, userUUID)
+			redirectSession(s, log, m, p, ldb, endpoints, userUUID, msgs)
 		}
 	}
 }
@@ -0,0 +1,274 @@
+package sshtoken_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"log/slog"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/assert/v2"
+	"github.com/gliderlabs/ssh"
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/uselagoon/ssh-portal/internal/bus"
+	"github.com/uselagoon/ssh-portal/internal/keycloak"
+	"github.com/uselagoon/ssh-portal/internal/lagoon"
+	"github.com/uselagoon/ssh-portal/internal/lagoondb"
+	"github.com/uselagoon/ssh-portal/internal/rbac"
+	"github.com/uselagoon/ssh-portal/internal/sshtoken"
+	gomock "go.uber.org/mock/gomock"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// emulateLiveContext configures the given mock ssh.Context to behave as the
+// context of a session whose client is still connected.
+func emulateLiveContext(sshContext *MockContext) {
+	sshContext.EXPECT().Done().Return(make(<-chan struct{})).AnyTimes()
+	sshContext.EXPECT().Err().Return(nil).AnyTimes()
+}
+
+func TestRedirectSession(t *testing.T) {
+	log := slog.New(slog.NewJSONHandler(os.Stderr, nil))
+	metrics := sshtoken.NewMetrics(prometheus.NewRegistry())
+	var testCases = map[string]struct {
+		envErr      error
+		realmRoles  []string
+		endpointErr error
+		expect      string
+	}{
+		"unknown namespace": {
+			envErr: lagoondb.ErrNoResult,
+			expect: `Unknown environment "project-test". ` +
+				"Check the username in your SSH command. SID: abc123\r\n",
+		},
+		"database error": {
+			envErr: errors.New("connection refused"),
+			expect: "This SSH server does not provide shell access. SID: abc123\r\n",
+		},
+		"permission denied": {
+			expect: "This SSH server does not provide shell access. SID: abc123\r\n",
+		},
+		"redirected": {
+			realmRoles: []string{"platform-owner"},
+			expect: "This SSH server does not provide shell access to your " +
+				"environment.\r\nTo SSH into your environment use this endpoint:" +
+				"\r\n\r\n\tssh project-test@ssh.example.com\r\n\r\n" +
+				"SID: abc123\r\n",
+		},
+		"unknown endpoint": {
+			realmRoles:  []string{"platform-owner"},
+			endpointErr: bus.ErrUnknownEnvironment,
+			expect:      "This SSH server does not provide shell access. SID: abc123\r\n",
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			ctrl := gomock.NewController(tt)
+			ldbService := NewMockLagoonDBService(ctrl)
+			endpointService := NewMockSSHEndpointService(ctrl)
+			kcService := NewMockRBACKeycloakService(ctrl)
+			rbacLDBService := NewMockRBACLagoonDBService(ctrl)
+			sshSession := NewMockSession(ctrl)
+			sshContext := NewMockContext(ctrl)
+			p := rbac.NewPermission(kcService, rbacLDBService)
+			userUUID := uuid.New()
+			namespaceName := "project-test"
+			var stderr bytes.Buffer
+			// configure mocks
+			sshSession.EXPECT().Context().Return(sshContext).AnyTimes()
+			sshSession.EXPECT().User().Return(namespaceName).AnyTimes()
+			sshSession.EXPECT().Stderr().Return(&stderr)
+			sshContext.EXPECT().SessionID().Return("abc123")
+			emulateLiveContext(sshContext)
+			// called by tracing
+			sshContext.EXPECT().Value(gomock.Any()).Return(nil).AnyTimes()
+			env := &lagoondb.Environment{
+				ID:          2,
+				Name:        "test",
+				ProjectID:   1,
+				ProjectName: "project",
+				Type:        lagoon.Production,
+			}
+			if tc.envErr != nil {
+				env = nil
+			}
+			ldbService.EXPECT().
+				EnvironmentByNamespaceName(sshContext, namespaceName).
+				Return(env, tc.envErr)
+			if tc.envErr == nil {
+				kcService.EXPECT().UserRolesAndGroups(sshContext, userUUID).
+					Return(tc.realmRoles, nil, nil)
+			}
+			if tc.envErr == nil && len(tc.realmRoles) == 0 {
+				kcService.EXPECT().UserGroupIDRole(sshContext, nil).
+					Return(map[uuid.UUID]lagoon.UserRole{})
+				rbacLDBService.EXPECT().ProjectGroupIDs(sshContext, 1).
+					Return(nil, nil)
+				kcService.EXPECT().AncestorGroups(sshContext, nil).
+					Return(nil, nil)
+			}
+			if len(tc.realmRoles) > 0 {
+				endpointService.EXPECT().SSHEndpointByEnvironmentID(sshContext, 2).
+					Return("ssh.example.com", "22", tc.endpointErr)
+			}
+			// execute
+			sshtoken.RedirectSession(sshSession, log, metrics, p, ldbService,
+				endpointService, userUUID, nil)
+			assert.Equal(tt, tc.expect, stderr.String(), name)
+		})
+	}
+}
+
+func TestWhoami(t *testing.T) {
+	log := slog.New(slog.NewJSONHandler(os.Stderr, nil))
+	metrics := sshtoken.NewMetrics(prometheus.NewRegistry())
+	userUUID := uuid.MustParse("91435afe-ba81-406f-9308-3f0f8d7d6b43")
+	fingerprint := "SHA256:NtOIKkyGp6ubsA4F2PDr1EltRRj4Rx+KZ1YYPrzIzE8"
+	var testCases = map[string]struct {
+		command      []string
+		userErr      error
+		expectStdout string
+		expectStderr string
+	}{
+		"text": {
+			command: []string{"whoami"},
+			expectStdout: "user UUID: 91435afe-ba81-406f-9308-3f0f8d7d6b43\r\n" +
+				"email: jane@example.com\r\n" +
+				"SSH fingerprint: " + fingerprint + "\r\n",
+		},
+		"json": {
+			command: []string{"whoami", "json"},
+			expectStdout: `{"userUUID":"91435afe-ba81-406f-9308-3f0f8d7d6b43",` +
+				`"email":"jane@example.com",` +
+				`"sshFingerprint":"` + fingerprint + `"}` + "\r\n",
+		},
+		"lookup failure": {
+			command:      []string{"whoami"},
+			userErr:      errors.New("bad user response: 500"),
+			expectStderr: "internal error. SID: abc123\r\n",
+		},
+		"invalid argument": {
+			command: []string{"whoami", "yaml"},
+			expectStderr: "invalid command: whoami only supports a \"json\" " +
+				"argument. SID: abc123\r\n",
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			ctrl := gomock.NewController(tt)
+			keycloakToken := NewMockKeycloakTokenService(ctrl)
+			keycloakUser := NewMockKeycloakUserService(ctrl)
+			ldbService := NewMockLagoonDBService(ctrl)
+			sshSession := NewMockSession(ctrl)
+			sshContext := NewMockContext(ctrl)
+			var stdout, stderr bytes.Buffer
+			// configure mocks
+			sshSession.EXPECT().Context().Return(sshContext).Times(2)
+			sshSession.EXPECT().Command().Return(tc.command)
+			sshSession.EXPECT().Stderr().Return(&stderr).AnyTimes()
+			sshSession.EXPECT().Write(gomock.Any()).DoAndReturn(stdout.Write).
+				AnyTimes()
+			sshContext.EXPECT().SessionID().Return("abc123").AnyTimes()
+			emulateLiveContext(sshContext)
+			if len(tc.command) == 1 || tc.command[1] == "json" {
+				var user *keycloak.User
+				if tc.userErr == nil {
+					user = &keycloak.User{
+						ID:       &userUUID,
+						Username: "jane@example.com",
+						Email:    "jane@example.com",
+					}
+				}
+				keycloakUser.EXPECT().UserByUUID(sshContext, userUUID).
+					Return(user, tc.userErr)
+			}
+			// execute
+			sshtoken.TokenSession(sshSession, log, metrics, nil, keycloakToken,
+				keycloakUser, ldbService, userUUID, fingerprint, nil)
+			assert.Equal(tt, tc.expectStdout, stdout.String(), name)
+			assert.Equal(tt, tc.expectStderr, stderr.String(), name)
+		})
+	}
+}
+
+func TestSessionHandlerKeyUsed(t *testing.T) {
+	log := slog.New(slog.NewJSONHandler(os.Stderr, nil))
+	userUUID := uuid.MustParse("91435afe-ba81-406f-9308-3f0f8d7d6b43")
+	var testCases = map[string]struct {
+		keyUsedErr   error
+		expectErrors float64
+	}{
+		"updated": {},
+		"update failed": {
+			keyUsedErr:   errors.New("connection refused"),
+			expectErrors: 1,
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			ctrl := gomock.NewController(tt)
+			keycloakToken := NewMockKeycloakTokenService(ctrl)
+			keycloakUser := NewMockKeycloakUserService(ctrl)
+			ldbService := NewMockLagoonDBService(ctrl)
+			sshSession := NewMockSession(ctrl)
+			sshContext := NewMockContext(ctrl)
+			metrics := sshtoken.NewMetrics(prometheus.NewRegistry())
+			publicKey, _, err := ed25519.GenerateKey(nil)
+			assert.NoError(tt, err, name)
+			sshPublicKey, err := gossh.NewPublicKey(publicKey)
+			assert.NoError(tt, err, name)
+			fingerprint := gossh.FingerprintSHA256(sshPublicKey)
+			var stdout bytes.Buffer
+			// configure mocks
+			sshSession.EXPECT().Context().Return(sshContext).AnyTimes()
+			sshSession.EXPECT().PublicKey().Return(sshPublicKey)
+			sshSession.EXPECT().User().Return("lagoon").AnyTimes()
+			sshSession.EXPECT().Command().Return([]string{"token"})
+			sshSession.EXPECT().Write(gomock.Any()).DoAndReturn(stdout.Write).
+				AnyTimes()
+			sshPermissions := ssh.Permissions{Permissions: &gossh.Permissions{
+				Extensions: map[string]string{
+					sshtoken.UserUUIDKey: userUUID.String(),
+				},
+			}}
+			sshContext.EXPECT().Permissions().Return(&sshPermissions)
+			sshContext.EXPECT().SessionID().Return("abc123").AnyTimes()
+			sshContext.EXPECT().SetValue(gomock.Any(), gomock.Any()).AnyTimes()
+			sshContext.EXPECT().Value(gomock.Any()).Return(nil).AnyTimes()
+			emulateLiveContext(sshContext)
+			keycloakToken.EXPECT().UserAccessToken(sshContext, userUUID).
+				Return("test-token", nil)
+			// the key update doesn't complete until the token has been sent
+			sent, updated := make(chan struct{}), make(chan struct{})
+			ldbService.EXPECT().
+				SSHKeyUsed(gomock.Any(), fingerprint, gomock.Any()).
+				DoAndReturn(func(context.Context, string, time.Time) error {
+					defer close(updated)
+					<-sent
+					return tc.keyUsedErr
+				})
+			// execute
+			callback := sshtoken.SessionHandler(log, metrics, nil,
+				keycloakToken, keycloakUser, ldbService, nil, nil)
+			callback(sshSession)
+			close(sent)
+			assert.Equal(tt, "test-token\r\n", stdout.String(), name)
+			// wait for the failure to be counted
+			<-updated
+			for range 100 {
+				if testutil.ToFloat64(metrics.KeyUsedErrorsTotal()) ==
+					tc.expectErrors {
+					break
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			assert.Equal(tt, tc.expectErrors,
+				testutil.ToFloat64(metrics.KeyUsedErrorsTotal()), name)
+		})
+	}
+}
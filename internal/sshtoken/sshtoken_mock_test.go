@@ -1,9 +1,9 @@
 // Code generated by MockGen. DO NOT EDIT.
-// Source: github.com/uselagoon/ssh-portal/internal/sshtoken (interfaces: LagoonDBService,KeycloakTokenService)
+// Source: github.com/uselagoon/ssh-portal/internal/sshtoken (interfaces: LagoonDBService,KeycloakTokenService,KeycloakUserService,SSHEndpointService)
 //
 // Generated by this command:
 //
-//	mockgen -package=sshtoken_test -destination=sshtoken_mock_test.go -write_generate_directive . LagoonDBService,KeycloakTokenService
+//	mockgen -package=sshtoken_test -destination=sshtoken_mock_test.go -write_generate_directive . LagoonDBService,KeycloakTokenService,KeycloakUserService,SSHEndpointService
 //
 
 // Package sshtoken_test is a generated GoMock package.
@@ -15,11 +15,12 @@ import (
 	time "time"
 
 	uuid "github.com/google/uuid"
+	keycloak "github.com/uselagoon/ssh-portal/internal/keycloak"
 	lagoondb "github.com/uselagoon/ssh-portal/internal/lagoondb"
 	gomock "go.uber.org/mock/gomock"
 )
 
-//go:generate mockgen -package=sshtoken_test -destination=sshtoken_mock_test.go -write_generate_directive . LagoonDBService,KeycloakTokenService
+//go:generate mockgen -package=sshtoken_test -destination=sshtoken_mock_test.go -write_generate_directive . LagoonDBService,KeycloakTokenService,KeycloakUserService,SSHEndpointService
 
 // MockLagoonDBService is a mock of LagoonDBService interface.
 type MockLagoonDBService struct {
@@ -59,6 +60,36 @@ func (mr *MockLagoonDBServiceMockRecorder) EnvironmentByNamespaceName(arg0, arg1
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "EnvironmentByNamespaceName", reflect.TypeOf((*MockLagoonDBService)(nil).EnvironmentByNamespaceName), arg0, arg1)
 }
 
+// EnvironmentsByProjectIDs mocks base method.
+func (m *MockLagoonDBService) EnvironmentsByProjectIDs(arg0 context.Context, arg1 []int) ([]lagoondb.EnvironmentEndpoint, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "EnvironmentsByProjectIDs", arg0, arg1)
+	ret0, _ := ret[0].([]lagoondb.EnvironmentEndpoint)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// EnvironmentsByProjectIDs indicates an expected call of EnvironmentsByProjectIDs.
+func (mr *MockLagoonDBServiceMockRecorder) EnvironmentsByProjectIDs(arg0, arg1 any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "EnvironmentsByProjectIDs", reflect.TypeOf((*MockLagoonDBService)(nil).EnvironmentsByProjectIDs), arg0, arg1)
+}
+
+// ProjectIDsByGroupIDs mocks base method.
+func (m *MockLagoonDBService) ProjectIDsByGroupIDs(arg0 context.Context, arg1 []uuid.UUID) ([]int, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ProjectIDsByGroupIDs", arg0, arg1)
+	ret0, _ := ret[0].([]int)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ProjectIDsByGroupIDs indicates an expected call of ProjectIDsByGroupIDs.
+func (mr *MockLagoonDBServiceMockRecorder) ProjectIDsByGroupIDs(arg0, arg1 any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ProjectIDsByGroupIDs", reflect.TypeOf((*MockLagoonDBService)(nil).ProjectIDsByGroupIDs), arg0, arg1)
+}
+
 // SSHEndpointByEnvironmentID mocks base method.
 func (m *MockLagoonDBService) SSHEndpointByEnvironmentID(arg0 context.Context, arg1 int) (string, string, error) {
 	m.ctrl.T.Helper()
@@ -156,3 +187,95 @@ func (mr *MockKeycloakTokenServiceMockRecorder) UserAccessTokenResponse(arg0, ar
 	mr.mock.ctrl.T.Helper()
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UserAccessTokenResponse", reflect.TypeOf((*MockKeycloakTokenService)(nil).UserAccessTokenResponse), arg0, arg1)
 }
+
+// MockKeycloakUserService is a mock of KeycloakUserService interface.
+type MockKeycloakUserService struct {
+	ctrl     *gomock.Controller
+	recorder *MockKeycloakUserServiceMockRecorder
+}
+
+// MockKeycloakUserServiceMockRecorder is the mock recorder for MockKeycloakUserService.
+type MockKeycloakUserServiceMockRecorder struct {
+	mock *MockKeycloakUserService
+}
+
+// NewMockKeycloakUserService creates a new mock instance.
+func NewMockKeycloakUserService(ctrl *gomock.Controller) *MockKeycloakUserService {
+	mock := &MockKeycloakUserService{ctrl: ctrl}
+	mock.recorder = &MockKeycloakUserServiceMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockKeycloakUserService) EXPECT() *MockKeycloakUserServiceMockRecorder {
+	return m.recorder
+}
+
+// DescendantGroups mocks base method.
+func (m *MockKeycloakUserService) DescendantGroups(arg0 context.Context, arg1 []uuid.UUID) ([]uuid.UUID, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "DescendantGroups", arg0, arg1)
+	ret0, _ := ret[0].([]uuid.UUID)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// DescendantGroups indicates an expected call of DescendantGroups.
+func (mr *MockKeycloakUserServiceMockRecorder) DescendantGroups(arg0, arg1 any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DescendantGroups", reflect.TypeOf((*MockKeycloakUserService)(nil).DescendantGroups), arg0, arg1)
+}
+
+// UserByUUID mocks base method.
+func (m *MockKeycloakUserService) UserByUUID(arg0 context.Context, arg1 uuid.UUID) (*keycloak.User, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "UserByUUID", arg0, arg1)
+	ret0, _ := ret[0].(*keycloak.User)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// UserByUUID indicates an expected call of UserByUUID.
+func (mr *MockKeycloakUserServiceMockRecorder) UserByUUID(arg0, arg1 any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UserByUUID", reflect.TypeOf((*MockKeycloakUserService)(nil).UserByUUID), arg0, arg1)
+}
+
+// MockSSHEndpointService is a mock of SSHEndpointService interface.
+type MockSSHEndpointService struct {
+	ctrl     *gomock.Controller
+	recorder *MockSSHEndpointServiceMockRecorder
+}
+
+// MockSSHEndpointServiceMockRecorder is the mock recorder for MockSSHEndpointService.
+type MockSSHEndpointServiceMockRecorder struct {
+	mock *MockSSHEndpointService
+}
+
+// NewMockSSHEndpointService creates a new mock instance.
+func NewMockSSHEndpointService(ctrl *gomock.Controller) *MockSSHEndpointService {
+	mock := &MockSSHEndpointService{ctrl: ctrl}
+	mock.recorder = &MockSSHEndpointServiceMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockSSHEndpointService) EXPECT() *MockSSHEndpointServiceMockRecorder {
+	return m.recorder
+}
+
+// SSHEndpointByEnvironmentID mocks base method.
+func (m *MockSSHEndpointService) SSHEndpointByEnvironmentID(arg0 context.Context, arg1 int) (string, string, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SSHEndpointByEnvironmentID", arg0, arg1)
+	ret0, _ := ret[0].(string)
+	ret1, _ := ret[1].(string)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+// SSHEndpointByEnvironmentID indicates an expected call of SSHEndpointByEnvironmentID.
+func (mr *MockSSHEndpointServiceMockRecorder) SSHEndpointByEnvironmentID(arg0, arg1 any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SSHEndpointByEnvironmentID", reflect.TypeOf((*MockSSHEndpointService)(nil).SSHEndpointByEnvironmentID), arg0, arg1)
+}
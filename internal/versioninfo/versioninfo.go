@@ -0,0 +1,172 @@
+// Package versioninfo implements the output of the version command shared by
+// the ssh-portal binaries. In addition to build information it describes the
+// configuration flags of a command, so that operators can check which
+// features are enabled and which limits are in effect.
+package versioninfo
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"reflect"
+	"slices"
+	"strings"
+
+	"github.com/alecthomas/kong"
+)
+
+// Redacted replaces the value of secret configuration flags.
+const Redacted = "REDACTED"
+
+// Output formats supported by Write.
+const (
+	FormatJSON = "json"
+	FormatText = "text"
+)
+
+// Build contains information about the build of a binary. It is usually set
+// by GoReleaser.
+type Build struct {
+	ProjectName string
+	Version     string
+	Commit      string
+	BuildDate   string
+	GoVersion   string
+}
+
+// Info is the output of the version command.
+type Info struct {
+	Build
+	// Defaults contains the compile-time default value of each flag which has
+	// one, keyed by flag name.
+	Defaults map[string]string `json:",omitempty"`
+	// Config contains the effective value of every flag, keyed by flag name.
+	// It is only populated in verbose mode.
+	Config map[string]string `json:",omitempty"`
+	// ConfigError is set if the configuration couldn't be parsed. Config
+	// contains the values which were resolved regardless.
+	ConfigError string `json:",omitempty"`
+}
+
+// secret returns true if the value of the named flag must not be shown.
+func secret(name string) bool {
+	return strings.Contains(name, "secret") ||
+		strings.Contains(name, "password") ||
+		strings.HasPrefix(name, "host-key")
+}
+
+// redact returns the value of the named flag suitable for display. Secret
+// values are replaced with Redacted, as are credentials embedded in URLs.
+func redact(name, value string) string {
+	if value == "" {
+		return value
+	}
+	if secret(name) {
+		return Redacted
+	}
+	u, err := url.Parse(value)
+	if err != nil || u.User == nil || u.Host == "" {
+		return value
+	}
+	u.User = url.User(Redacted)
+	return u.String()
+}
+
+// format returns the string representation of a flag value.
+func format(v reflect.Value) string {
+	if v.Kind() == reflect.Slice {
+		parts := make([]string, v.Len())
+		for i := range v.Len() {
+			parts[i] = fmt.Sprint(v.Index(i).Interface())
+		}
+		return strings.Join(parts, ",")
+	}
+	return fmt.Sprint(v.Interface())
+}
+
+// New returns the Info for the given build and command. cmd is a pointer to
+// the kong command struct whose flags are described. If verbose is true, the
+// configuration of cmd is parsed from the environment and the effective value
+// of each flag is included.
+func New(b Build, cmd any, verbose bool) Info {
+	info := Info{Build: b}
+	parser, err := kong.New(cmd,
+		kong.Exit(func(int) {}),
+		kong.Writers(io.Discard, io.Discard))
+	if err != nil {
+		info.ConfigError =
+			fmt.Sprintf("couldn't describe configuration: %v", err)
+		return info
+	}
+	flags := slices.DeleteFunc(slices.Clone(parser.Model.Node.Flags),
+		func(f *kong.Flag) bool { return f.Name == "help" })
+	info.Defaults = map[string]string{}
+	for _, f := range flags {
+		if f.HasDefault {
+			info.Defaults[f.Name] = redact(f.Name, f.Default)
+		}
+	}
+	if !verbose {
+		return info
+	}
+	if _, err = parser.Parse(nil); err != nil {
+		info.ConfigError = err.Error()
+	}
+	info.Config = map[string]string{}
+	for _, f := range flags {
+		info.Config[f.Name] = redact(f.Name, format(f.Target))
+	}
+	return info
+}
+
+// Write the Info to w in the given format.
+func (i Info) Write(w io.Writer, format string) error {
+	switch format {
+	case FormatJSON:
+		v, err := json.Marshal(i)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(w, string(v))
+		return err
+	case FormatText:
+		return i.writeText(w)
+	default:
+		return fmt.Errorf("unknown output format: %s", format)
+	}
+}
+
+// writeText writes the Info to w in a human-readable format.
+func (i Info) writeText(w io.Writer) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "project:    %s\n", i.ProjectName)
+	fmt.Fprintf(&b, "version:    %s\n", i.Version)
+	fmt.Fprintf(&b, "commit:     %s\n", i.Commit)
+	fmt.Fprintf(&b, "build date: %s\n", i.BuildDate)
+	fmt.Fprintf(&b, "go version: %s\n", i.GoVersion)
+	writeMap(&b, "defaults", i.Defaults)
+	writeMap(&b, "config", i.Config)
+	if i.ConfigError != "" {
+		fmt.Fprintf(&b, "config error: %s\n", i.ConfigError)
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// writeMap writes a titled section containing the sorted keys and values of
+// m to b. Nothing is written if m is empty.
+func writeMap(b *strings.Builder, title string, m map[string]string) {
+	if len(m) == 0 {
+		return
+	}
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	fmt.Fprintf(b, "%s:\n", title)
+	for _, k := range keys {
+		fmt.Fprintf(b, "  %s: %s\n", k, m[k])
+	}
+}